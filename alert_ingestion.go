@@ -0,0 +1,235 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// initializeAlertIngestionColumns adds the columns bulkIngestAlertsHandler
+// needs to security_events for deployments whose table predates bulk
+// ingestion; a fresh CREATE TABLE already includes them.
+func initializeAlertIngestionColumns(db *sql.DB) error {
+	_, err := db.Exec(`
+		ALTER TABLE security_events
+			ADD COLUMN IF NOT EXISTS dedup_key VARCHAR(255),
+			ADD COLUMN IF NOT EXISTS event_count INT NOT NULL DEFAULT 1,
+			ADD COLUMN IF NOT EXISTS source_machine VARCHAR(255),
+			ADD COLUMN IF NOT EXISTS scope ENUM('ip', 'range', 'user'),
+			ADD COLUMN IF NOT EXISTS simulated BOOLEAN DEFAULT FALSE`)
+	if err != nil {
+		return fmt.Errorf("failed to add bulk alert ingestion columns: %v", err)
+	}
+	return nil
+}
+
+const (
+	maxBulkAlertsPerRequest = 500
+	bulkAlertWriteBatchSize = 50
+	dedupWindow             = 5 * time.Minute
+)
+
+// bulkAlertRequest is one element of the POST /security/alerts/bulk body.
+// source_machine/scope/simulated/dedup_key let an external agent (log
+// parser, WAF, application middleware) attribute and deduplicate events it
+// pushes in instead of writing to security_events directly.
+type bulkAlertRequest struct {
+	SourceMachine string `json:"source_machine"`
+	Scope         string `json:"scope"` // ip, range, or user; empty is allowed
+	Simulated     bool   `json:"simulated"`
+	DedupKey      string `json:"dedup_key"`
+	EventType     string `json:"event_type" binding:"required"`
+	Severity      string `json:"severity" binding:"required"`
+	Description   string `json:"description"`
+	IPAddress     string `json:"ip_address"`
+	UserID        *int   `json:"user_id"`
+}
+
+var bulkAlertScopes = map[string]bool{"": true, "ip": true, "range": true, "user": true}
+
+// bulkIngestAlertsHandler lets external agents push structured security
+// events in bulk rather than each writing to security_events directly.
+// Alerts sharing a dedup_key within dedupWindow are merged into a single row
+// by incrementing event_count instead of inserting a new one, so a log flood
+// from one noisy source doesn't spam the dashboard timeline with duplicates.
+func (sm *SecurityMonitor) bulkIngestAlertsHandler(c *gin.Context) {
+	var alerts []bulkAlertRequest
+	if err := c.ShouldBindJSON(&alerts); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(alerts) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "at least one alert is required"})
+		return
+	}
+	if len(alerts) > maxBulkAlertsPerRequest {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("at most %d alerts per request", maxBulkAlertsPerRequest)})
+		return
+	}
+	for _, alert := range alerts {
+		if !bulkAlertScopes[alert.Scope] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "scope must be ip, range, or user"})
+			return
+		}
+	}
+
+	writes := coalesceBulkAlerts(alerts)
+
+	var created, merged []string
+	for batchStart := 0; batchStart < len(writes); batchStart += bulkAlertWriteBatchSize {
+		batchEnd := batchStart + bulkAlertWriteBatchSize
+		if batchEnd > len(writes) {
+			batchEnd = len(writes)
+		}
+
+		for _, write := range writes[batchStart:batchEnd] {
+			id, wasMerged, err := sm.writeBulkAlert(write)
+			if err != nil {
+				log.Printf("⚠️  bulk alert ingestion: failed to write dedup_key=%q: %v", write.alert.DedupKey, err)
+				continue
+			}
+			if wasMerged {
+				merged = append(merged, id)
+			} else {
+				created = append(created, id)
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"created": created, "merged": merged})
+}
+
+// bulkAlertWrite is one deduplicated write operation: the representative
+// alert body to use if a new row has to be inserted, plus how many incoming
+// alerts collapsed into it.
+type bulkAlertWrite struct {
+	alert bulkAlertRequest
+	count int
+}
+
+// coalesceBulkAlerts groups alerts sharing a non-empty dedup_key within the
+// same request into a single write carrying the combined count, so ten
+// alerts for the same dedup_key in one bulk call increment event_count by
+// ten rather than racing each other against the database.
+func coalesceBulkAlerts(alerts []bulkAlertRequest) []bulkAlertWrite {
+	var writes []bulkAlertWrite
+	groups := make(map[string]int) // dedup_key -> index into writes
+
+	for _, alert := range alerts {
+		if alert.DedupKey == "" {
+			writes = append(writes, bulkAlertWrite{alert: alert, count: 1})
+			continue
+		}
+		if idx, ok := groups[alert.DedupKey]; ok {
+			writes[idx].alert = alert // keep the most recent body as representative
+			writes[idx].count++
+			continue
+		}
+		groups[alert.DedupKey] = len(writes)
+		writes = append(writes, bulkAlertWrite{alert: alert, count: 1})
+	}
+
+	return writes
+}
+
+// writeBulkAlert merges write into an existing row sharing its dedup_key
+// within dedupWindow, or inserts a new one. The returned id is the
+// security_events row's id as a string, matching SecurityAlert.ID.
+func (sm *SecurityMonitor) writeBulkAlert(write bulkAlertWrite) (id string, merged bool, err error) {
+	alert := write.alert
+	sm.ipIntel.Enqueue(alert.IPAddress)
+
+	if alert.DedupKey != "" {
+		var existingID int64
+		err := sm.db.QueryRow(`
+			SELECT id FROM security_events
+			WHERE dedup_key = ? AND created_at >= ?
+			ORDER BY id DESC LIMIT 1
+		`, alert.DedupKey, time.Now().Add(-dedupWindow)).Scan(&existingID)
+
+		if err == nil {
+			_, err = sm.db.Exec(`UPDATE security_events SET event_count = event_count + ? WHERE id = ?`, write.count, existingID)
+			if err != nil {
+				return "", false, err
+			}
+			return fmt.Sprintf("%d", existingID), true, nil
+		}
+		if err != sql.ErrNoRows {
+			return "", false, err
+		}
+	}
+
+	result, err := sm.db.Exec(`
+		INSERT INTO security_events
+			(user_id, event_type, severity, description, ip_address, dedup_key, event_count, source_machine, scope, simulated)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, alert.UserID, alert.EventType, alert.Severity, encryptColumnValue(sm.keystore, alert.Description), alert.IPAddress,
+		nullableString(alert.DedupKey), write.count, nullableString(alert.SourceMachine), nullableString(alert.Scope), alert.Simulated)
+	if err != nil {
+		return "", false, err
+	}
+
+	newID, err := result.LastInsertId()
+	if err != nil {
+		return "", false, err
+	}
+	return fmt.Sprintf("%d", newID), false, nil
+}
+
+// nullableString turns an empty string into a SQL NULL so optional text
+// columns (dedup_key, source_machine, scope) don't get stored as "" instead.
+func nullableString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// deleteAlertsHandler supports retention management for bulk-ingested
+// alerts: DELETE /security/alerts?source=...&scope=...&older_than=720h
+// removes matching rows. At least one filter is required so a bare DELETE
+// can't wipe the whole table by accident.
+func (sm *SecurityMonitor) deleteAlertsHandler(c *gin.Context) {
+	source := c.Query("source")
+	scope := c.Query("scope")
+	olderThanRaw := c.Query("older_than")
+
+	if source == "" && scope == "" && olderThanRaw == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "at least one of source, scope, or older_than is required"})
+		return
+	}
+
+	query := "DELETE FROM security_events WHERE 1=1"
+	args := []interface{}{}
+
+	if source != "" {
+		query += " AND source_machine = ?"
+		args = append(args, source)
+	}
+	if scope != "" {
+		query += " AND scope = ?"
+		args = append(args, scope)
+	}
+	if olderThanRaw != "" {
+		age, err := time.ParseDuration(olderThanRaw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid older_than, expected a Go duration like 720h"})
+			return
+		}
+		query += " AND created_at < ?"
+		args = append(args, time.Now().Add(-age))
+	}
+
+	result, err := sm.db.Exec(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete alerts"})
+		return
+	}
+	deleted, _ := result.RowsAffected()
+
+	c.JSON(http.StatusOK, gin.H{"deleted": deleted})
+}
@@ -0,0 +1,474 @@
+// Rules engine for payment/payout approval decisions, replacing the
+// hardcoded risk-score thresholds in processPaymentHandler/
+// processPayoutHandler. Rule authoring uses the same JSON predicate-tree
+// format as fraud_engine.go rather than embedded JavaScript: evaluating
+// arbitrary user-authored scripts safely needs a real sandboxed runtime
+// (github.com/dop251/goja) that isn't vendored in this build, so this ships
+// the storage-backed rule semantics (versioned rule sets, dry-run,
+// rule_storage counters) now and leaves swapping the predicate tree for a
+// goja VM as a follow-up once that dependency is available.
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ApprovalContext is what an approval rule evaluates against: the request,
+// the acting user, the risk score already computed for this request, and a
+// short transaction history. It mirrors TxContext's shape (see
+// fraud_engine.go) but is scoped to the approve/deny decision rather than
+// fraud scoring.
+type ApprovalContext struct {
+	UserID      int
+	Amount      float64
+	Kind        string // "payment" or "payout"
+	RiskScore   int
+	History     []ApprovalHistoryEntry
+	storage     *RuleStorage
+}
+
+// ApprovalHistoryEntry is one row of the user's recent transaction history,
+// made available to rules that want to reason about patterns rather than
+// just the current transaction.
+type ApprovalHistoryEntry struct {
+	Amount    float64   `json:"amount"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ApprovalDecision is what evaluating a rule set produces: the action to
+// take and the reason to surface back to the caller and record in
+// audit_trail.
+type ApprovalDecision struct {
+	Action string `json:"action"` // approve, deny, require_2fa, manual_review
+	Reason string `json:"reason"`
+}
+
+// approvalPredicateNode is the same boolean-tree shape as fraud_engine.go's
+// predicateNode, but resolved against approvalPredicateLibrary instead, since
+// approval rules reason about storage counters (daily payout totals) that
+// fraud rules don't need.
+//
+// rule_config for an ApprovalRule looks like:
+//
+//	{"predicate": "daily_payout_total_over", "params": {"threshold": 5000}}
+type approvalPredicateNode struct {
+	Predicate string                 `json:"predicate"`
+	Params    map[string]interface{} `json:"params"`
+	All       []approvalPredicateNode `json:"all"`
+	Any       []approvalPredicateNode `json:"any"`
+	Not       *approvalPredicateNode  `json:"not"`
+}
+
+func (n approvalPredicateNode) evaluate(ctx *ApprovalContext) bool {
+	switch {
+	case len(n.All) > 0:
+		for _, child := range n.All {
+			if !child.evaluate(ctx) {
+				return false
+			}
+		}
+		return true
+	case len(n.Any) > 0:
+		for _, child := range n.Any {
+			if child.evaluate(ctx) {
+				return true
+			}
+		}
+		return false
+	case n.Not != nil:
+		return !n.Not.evaluate(ctx)
+	case n.Predicate != "":
+		fn, ok := approvalPredicateLibrary[n.Predicate]
+		if !ok {
+			log.Printf("⚠️  approval rules: unknown predicate %q, treating as non-match", n.Predicate)
+			return false
+		}
+		return fn(ctx, n.Params)
+	default:
+		return false
+	}
+}
+
+// approvalPredicateLibrary is the standard library approval rule authors can
+// reference. storage-backed predicates read/update counters in rule_storage
+// so e.g. a daily payout total persists across requests.
+var approvalPredicateLibrary = map[string]func(ctx *ApprovalContext, params map[string]interface{}) bool{
+	"risk_score_over": func(ctx *ApprovalContext, params map[string]interface{}) bool {
+		threshold, _ := params["threshold"].(float64)
+		return float64(ctx.RiskScore) > threshold
+	},
+	"amount_over": func(ctx *ApprovalContext, params map[string]interface{}) bool {
+		threshold, _ := params["threshold"].(float64)
+		return ctx.Amount > threshold
+	},
+	"daily_payout_total_over": func(ctx *ApprovalContext, params map[string]interface{}) bool {
+		threshold, _ := params["threshold"].(float64)
+		total, err := ctx.storage.Add(ctx.UserID, "daily_payout_total", ctx.Amount, 24*time.Hour)
+		if err != nil {
+			return false
+		}
+		return total > threshold
+	},
+	"history_declined_count_over": func(ctx *ApprovalContext, params map[string]interface{}) bool {
+		threshold, _ := params["threshold"].(float64)
+		var declined float64
+		for _, h := range ctx.History {
+			if h.Status == "declined" || h.Status == "failed" {
+				declined++
+			}
+		}
+		return declined > threshold
+	},
+}
+
+// approvalActionPriority follows the same ranking idea as fraud_engine.go's
+// actionPriority, over the approval actions; deny outranks
+// require_2fa outranks manual_review outranks approve.
+var approvalActionPriority = map[string]int{
+	"deny":           4,
+	"require_2fa":    3,
+	"manual_review":  2,
+	"approve":        0,
+}
+
+// ApprovalRuleSet mirrors a row in approval_rule_sets: a named, versioned
+// collection of rules an operator can activate without a deploy.
+type ApprovalRuleSet struct {
+	ID       int    `json:"id" db:"id"`
+	Name     string `json:"name" db:"name"`
+	Version  int    `json:"version" db:"version"`
+	IsActive bool   `json:"is_active" db:"is_active"`
+}
+
+type compiledApprovalRule struct {
+	name      string
+	action    string
+	reason    string
+	predicate approvalPredicateNode
+}
+
+// RuleStorage backs the "storage" object approval rules can read and write,
+// persisted in rule_storage so counters (daily payout totals, etc.) survive
+// across requests and process restarts.
+type RuleStorage struct {
+	db  *sql.DB
+	mem map[string]float64 // non-nil for a dry-run instance: counters live here, rule_storage is untouched
+}
+
+// Add increments the counter for (userID, key) by amount, resetting it if
+// the last update fell outside window, and returns the new running total.
+func (s *RuleStorage) Add(userID int, key string, amount float64, window time.Duration) (float64, error) {
+	if s.mem != nil {
+		memKey := fmt.Sprintf("%d|%s", userID, key)
+		s.mem[memKey] += amount
+		return s.mem[memKey], nil
+	}
+	var total float64
+	var updatedAt time.Time
+	err := s.db.QueryRow("SELECT value, updated_at FROM rule_storage WHERE user_id = ? AND storage_key = ?",
+		userID, key).Scan(&total, &updatedAt)
+
+	if err == sql.ErrNoRows || time.Since(updatedAt) > window {
+		total = amount
+	} else if err != nil {
+		return 0, err
+	} else {
+		total += amount
+	}
+
+	_, err = s.db.Exec(`
+		INSERT INTO rule_storage (user_id, storage_key, value, updated_at)
+		VALUES (?, ?, ?, NOW())
+		ON DUPLICATE KEY UPDATE value = ?, updated_at = NOW()
+	`, userID, key, total, total)
+	return total, err
+}
+
+// Get reads the current counter value for (userID, key) without modifying it.
+func (s *RuleStorage) Get(userID int, key string) (float64, error) {
+	var value float64
+	err := s.db.QueryRow("SELECT value FROM rule_storage WHERE user_id = ? AND storage_key = ?", userID, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return value, err
+}
+
+// ApprovalRulesEngine evaluates ApprovalContexts against the currently
+// active approval_rule_sets version, replacing the hardcoded risk-score
+// thresholds in processPaymentHandler/processPayoutHandler.
+type ApprovalRulesEngine struct {
+	db      *sql.DB
+	storage *RuleStorage
+	mutex   sync.RWMutex
+	rules   []compiledApprovalRule
+}
+
+// NewApprovalRulesEngine loads the active rule set and returns an engine
+// ready to Evaluate.
+func NewApprovalRulesEngine(db *sql.DB) *ApprovalRulesEngine {
+	engine := &ApprovalRulesEngine{db: db, storage: &RuleStorage{db: db}}
+	engine.reload()
+	return engine
+}
+
+// reload recompiles every rule belonging to the active approval_rule_sets
+// version.
+func (e *ApprovalRulesEngine) reload() {
+	rows, err := e.db.Query(`
+		SELECT r.name, r.action, r.reason, r.rule_config
+		FROM approval_rules r
+		JOIN approval_rule_sets s ON s.id = r.rule_set_id
+		WHERE s.is_active = true
+	`)
+	if err != nil {
+		log.Printf("⚠️  approval rules: failed to load active rule set: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	var compiled []compiledApprovalRule
+	for rows.Next() {
+		var (
+			rule       compiledApprovalRule
+			configJSON []byte
+		)
+		if err := rows.Scan(&rule.name, &rule.action, &rule.reason, &configJSON); err != nil {
+			continue
+		}
+		var node approvalPredicateNode
+		if err := json.Unmarshal(configJSON, &node); err != nil {
+			log.Printf("⚠️  approval rules: rule %q has invalid rule_config, skipping: %v", rule.name, err)
+			continue
+		}
+		rule.predicate = node
+		compiled = append(compiled, rule)
+	}
+
+	e.mutex.Lock()
+	e.rules = compiled
+	e.mutex.Unlock()
+}
+
+// Evaluate runs the active rule set against ctx and returns the single most
+// severe decision across every rule that matched, defaulting to approve.
+func (e *ApprovalRulesEngine) Evaluate(ctx ApprovalContext) ApprovalDecision {
+	ctx.storage = e.storage
+
+	e.mutex.RLock()
+	rules := e.rules
+	e.mutex.RUnlock()
+
+	decision := ApprovalDecision{Action: "approve", Reason: "no rule matched"}
+	bestPriority := approvalActionPriority["approve"]
+
+	for _, rule := range rules {
+		if !rule.predicate.evaluate(&ctx) {
+			continue
+		}
+		if priority, ok := approvalActionPriority[rule.action]; ok && priority > bestPriority {
+			bestPriority = priority
+			decision.Action = rule.action
+			decision.Reason = rule.reason
+		}
+	}
+
+	return decision
+}
+
+// dryRun evaluates candidateRule (not yet saved) against the last sampleSize
+// transactions of any kind without writing to rule_storage or any other side
+// effect, so an operator can validate a new rule before activating it.
+func (e *ApprovalRulesEngine) dryRun(candidateRule approvalPredicateNode, action string, sampleSize int) (matched, total int, err error) {
+	rows, err := e.db.Query(`
+		SELECT user_id, amount, status, created_at FROM transactions
+		ORDER BY created_at DESC LIMIT ?
+	`, sampleSize)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+
+	// A throwaway storage instance backed by an in-memory map so dry-run
+	// predicates referencing counters don't touch the real rule_storage rows.
+	dryStorage := &RuleStorage{mem: make(map[string]float64)}
+
+	for rows.Next() {
+		var (
+			userID    int
+			amount    float64
+			status    string
+			createdAt time.Time
+		)
+		if err := rows.Scan(&userID, &amount, &status, &createdAt); err != nil {
+			continue
+		}
+		total++
+		ctx := &ApprovalContext{UserID: userID, Amount: amount, storage: dryStorage}
+		if candidateRule.evaluate(ctx) {
+			matched++
+		}
+	}
+	return matched, total, nil
+}
+
+// initializeApprovalRuleTables creates approval_rule_sets, approval_rules and
+// rule_storage.
+func initializeApprovalRuleTables(db *sql.DB) error {
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS approval_rule_sets (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			name VARCHAR(100) NOT NULL,
+			version INT NOT NULL,
+			is_active BOOLEAN DEFAULT FALSE,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE KEY unique_name_version (name, version)
+		)`,
+		`CREATE TABLE IF NOT EXISTS approval_rules (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			rule_set_id INT NOT NULL,
+			name VARCHAR(100) NOT NULL,
+			action ENUM('approve', 'deny', 'require_2fa', 'manual_review') NOT NULL,
+			reason VARCHAR(255) NOT NULL,
+			rule_config JSON NOT NULL,
+			FOREIGN KEY (rule_set_id) REFERENCES approval_rule_sets(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS rule_storage (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			user_id INT NOT NULL,
+			storage_key VARCHAR(100) NOT NULL,
+			value DECIMAL(14,2) NOT NULL DEFAULT 0,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			UNIQUE KEY unique_user_key (user_id, storage_key)
+		)`,
+	}
+	for _, stmt := range statements {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to create approval rules table: %v", err)
+		}
+	}
+	return nil
+}
+
+// uploadApprovalRuleSetHandler lets an admin create a new named/versioned
+// rule set without activating it, so it can be dry-run first.
+func (sth *SecureTransactionHandler) uploadApprovalRuleSetHandler(c *gin.Context) {
+	var req struct {
+		Name  string `json:"name" binding:"required"`
+		Rules []struct {
+			Name       string          `json:"name" binding:"required"`
+			Action     string          `json:"action" binding:"required"`
+			Reason     string          `json:"reason" binding:"required"`
+			RuleConfig json.RawMessage `json:"rule_config" binding:"required"`
+		} `json:"rules" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var nextVersion int
+	sth.db.QueryRow("SELECT COALESCE(MAX(version), 0) + 1 FROM approval_rule_sets WHERE name = ?", req.Name).Scan(&nextVersion)
+
+	result, err := sth.db.Exec("INSERT INTO approval_rule_sets (name, version, is_active) VALUES (?, ?, false)", req.Name, nextVersion)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create rule set"})
+		return
+	}
+	ruleSetID, _ := result.LastInsertId()
+
+	for _, rule := range req.Rules {
+		if _, err := sth.db.Exec(
+			"INSERT INTO approval_rules (rule_set_id, name, action, reason, rule_config) VALUES (?, ?, ?, ?, ?)",
+			ruleSetID, rule.Name, rule.Action, rule.Reason, []byte(rule.RuleConfig),
+		); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store rule"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"rule_set_id": ruleSetID, "name": req.Name, "version": nextVersion})
+}
+
+// activateApprovalRuleSetHandler flips the given rule set active and
+// deactivates every other version of the same name, then forces the engine
+// to recompile.
+func (sth *SecureTransactionHandler) activateApprovalRuleSetHandler(c *gin.Context) {
+	ruleSetID := c.Param("id")
+
+	var name string
+	if err := sth.db.QueryRow("SELECT name FROM approval_rule_sets WHERE id = ?", ruleSetID).Scan(&name); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Rule set not found"})
+		return
+	}
+
+	tx, err := sth.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to activate rule set"})
+		return
+	}
+	if _, err := tx.Exec("UPDATE approval_rule_sets SET is_active = false WHERE name = ?", name); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to deactivate previous version"})
+		return
+	}
+	if _, err := tx.Exec("UPDATE approval_rule_sets SET is_active = true WHERE id = ?", ruleSetID); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to activate rule set"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit activation"})
+		return
+	}
+
+	if sth.ess.approvalEngine != nil {
+		sth.ess.approvalEngine.reload()
+	}
+	c.JSON(http.StatusOK, gin.H{"activated": ruleSetID})
+}
+
+// dryRunApprovalRuleHandler evaluates a candidate rule against the last N
+// real transactions without activating it or touching rule_storage.
+func (sth *SecureTransactionHandler) dryRunApprovalRuleHandler(c *gin.Context) {
+	var req struct {
+		Action     string          `json:"action" binding:"required"`
+		RuleConfig json.RawMessage `json:"rule_config" binding:"required"`
+		SampleSize int             `json:"sample_size"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.SampleSize <= 0 || req.SampleSize > 1000 {
+		req.SampleSize = 100
+	}
+
+	var node approvalPredicateNode
+	if err := json.Unmarshal(req.RuleConfig, &node); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid rule_config: %v", err)})
+		return
+	}
+
+	if sth.ess.approvalEngine == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Approval rules engine not initialized"})
+		return
+	}
+
+	matched, total, err := sth.ess.approvalEngine.dryRun(node, req.Action, req.SampleSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Dry run failed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"sample_size": total, "matched_count": matched})
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// argon2Params is one Argon2id parameter set, PHC-string encodable (see
+// encodeArgon2PHC/decodePasswordHash). Comparable with == so NeedsRehash can
+// just check it against the service's calibrated target.
+type argon2Params struct {
+	memory  uint32 // KiB
+	time    uint32
+	threads uint8
+	keyLen  uint32
+}
+
+const argon2SaltLen = 16
+
+// argon2CalibrationTarget is the hashing latency calibrateArgon2Params aims
+// for: slow enough to make offline cracking expensive, fast enough not to
+// dominate a login request.
+const argon2CalibrationTarget = 250 * time.Millisecond
+
+// legacyArgon2Params is what hashPasswordArgon2 hardcoded before PHC
+// encoding existed. decodePasswordHash assumes any non-PHC-formatted hash
+// was produced with these, so it keeps verifying; NeedsRehash always flags
+// it for upgrade to the current calibrated parameters.
+var legacyArgon2Params = argon2Params{memory: 64 * 1024, time: 1, threads: 4, keyLen: 32}
+
+// calibrateArgon2Params measures Argon2id's cost on this host and picks
+// memory/time parameters that land close to targetDuration: starting from a
+// conservative memory floor, it doubles memory (the parameter that most
+// directly raises the cost of a parallel/GPU attack) until hashing takes at
+// least targetDuration or a sane ceiling is hit, then makes up any remaining
+// gap with extra time passes. Meant to run once at startup, not per request.
+func calibrateArgon2Params(targetDuration time.Duration) argon2Params {
+	const maxMemoryKiB = 1 << 20 // 1 GiB ceiling, well above what a typical API host should dedicate per hash
+	const maxTime = 10
+
+	params := argon2Params{memory: 19 * 1024, time: 1, threads: 4, keyLen: 32}
+	salt := make([]byte, argon2SaltLen) // zero salt is fine for timing-only calibration
+
+	for {
+		if measureArgon2(params, salt) >= targetDuration {
+			return params
+		}
+		if params.memory*2 > maxMemoryKiB {
+			break
+		}
+		params.memory *= 2
+	}
+	for params.time < maxTime {
+		if measureArgon2(params, salt) >= targetDuration {
+			break
+		}
+		params.time++
+	}
+	return params
+}
+
+func measureArgon2(params argon2Params, salt []byte) time.Duration {
+	start := time.Now()
+	argon2.IDKey([]byte("argon2-calibration-probe"), salt, params.time, params.memory, params.threads, params.keyLen)
+	return time.Since(start)
+}
+
+// encodeArgon2PHC renders params/salt/hash in the PHC string format
+// (https://github.com/P-H-C/phc-string-format), e.g.
+// "$argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>", the format other Argon2id
+// implementations (and a future non-Go verifier) can parse without needing
+// to know this service's historical defaults.
+func encodeArgon2PHC(p argon2Params, salt, hash []byte) string {
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.memory, p.time, p.threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(hash))
+}
+
+// decodePasswordHash parses either the current PHC-encoded format or the
+// legacy "base64(salt):base64(hash)" format hashPasswordArgon2 used before
+// it, returning the parameters to re-derive the hash under for verification.
+func decodePasswordHash(encoded string) (argon2Params, []byte, []byte, error) {
+	if strings.HasPrefix(encoded, "$argon2id$") {
+		return decodeArgon2PHC(encoded)
+	}
+	return decodeLegacyArgon2(encoded)
+}
+
+func decodeArgon2PHC(encoded string) (argon2Params, []byte, []byte, error) {
+	// "$argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>" splits into
+	// ["", "argon2id", "v=19", "m=...,t=...,p=...", "<salt>", "<hash>"].
+	fields := strings.Split(encoded, "$")
+	if len(fields) != 6 || fields[1] != "argon2id" {
+		return argon2Params{}, nil, nil, fmt.Errorf("unrecognized argon2id hash format")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(fields[2], "v=%d", &version); err != nil {
+		return argon2Params{}, nil, nil, fmt.Errorf("invalid argon2id version field: %v", err)
+	}
+
+	var p argon2Params
+	var threads uint32
+	if _, err := fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &threads); err != nil {
+		return argon2Params{}, nil, nil, fmt.Errorf("invalid argon2id params field: %v", err)
+	}
+	p.threads = uint8(threads)
+
+	salt, err := base64.RawStdEncoding.DecodeString(fields[4])
+	if err != nil {
+		return argon2Params{}, nil, nil, fmt.Errorf("invalid argon2id salt encoding: %v", err)
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(fields[5])
+	if err != nil {
+		return argon2Params{}, nil, nil, fmt.Errorf("invalid argon2id hash encoding: %v", err)
+	}
+	p.keyLen = uint32(len(hash))
+
+	return p, salt, hash, nil
+}
+
+func decodeLegacyArgon2(encoded string) (argon2Params, []byte, []byte, error) {
+	parts := strings.Split(encoded, ":")
+	if len(parts) != 2 {
+		return argon2Params{}, nil, nil, fmt.Errorf("unrecognized password hash format")
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return argon2Params{}, nil, nil, fmt.Errorf("invalid legacy salt encoding: %v", err)
+	}
+	hash, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return argon2Params{}, nil, nil, fmt.Errorf("invalid legacy hash encoding: %v", err)
+	}
+
+	return legacyArgon2Params, salt, hash, nil
+}
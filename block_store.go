@@ -0,0 +1,477 @@
+// Block storage for SecurityMonitor's IP/CIDR/ASN bans. Single IPs and CIDR
+// ranges are indexed in a binary trie keyed by address bits (IPv4 and IPv6
+// kept separate) so a lookup walks at most 32 or 128 nodes regardless of how
+// many ranges are loaded — the same complexity class a radix/patricia trie
+// library like go-cidranger gives, implemented by hand here since this
+// sandbox has no network access to fetch a new module. ASNs match on an
+// opaque identifier rather than an address range, so they're a flat map;
+// this codebase has no IP->ASN resolver (see getLocationFromIP's own
+// placeholder note), so ASN entries are stored and exported for edge
+// bouncers but aren't matched by Lookup.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultBlockDuration is how long a ban lasts when the caller doesn't
+// specify one; matches the 24h window blockIP has always used.
+const defaultBlockDuration = 24 * time.Hour
+
+// blockReapInterval is how often expired entries are swept out of ip_blocks
+// (on the leader) and how often every replica refreshes its local trie from
+// the shared table.
+const blockReapInterval = 1 * time.Minute
+
+var validBlockScopes = map[string]bool{"ip": true, "cidr": true, "asn": true}
+
+var asnPattern = regexp.MustCompile(`(?i)^AS[0-9]+$`)
+
+// BlockEntry is one ban: a single IP, a CIDR range, or an ASN (e.g.
+// "AS15169"), with the reason/source/expiry attached when it was created.
+type BlockEntry struct {
+	ID        int64      `json:"id"`
+	Value     string     `json:"value"`
+	Scope     string     `json:"scope"` // ip, cidr, or asn
+	Reason    string     `json:"reason"`
+	Source    string     `json:"source"` // manual, cti, or rule
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func (e *BlockEntry) expired(now time.Time) bool {
+	return e.ExpiresAt != nil && e.ExpiresAt.Before(now)
+}
+
+// trieNode is one bit of a binary trie keyed by IP address bits; entry is
+// non-nil when a ban terminates at this exact prefix.
+type trieNode struct {
+	children [2]*trieNode
+	entry    *BlockEntry
+}
+
+// BlockStore is an in-memory, DB-backed store of blocked IPs/CIDRs/ASNs.
+// ip_blocks is the source of truth; the trie/ASN map are a read-optimized
+// cache rebuilt from it on a timer so every replica converges even when
+// another replica made the change.
+type BlockStore struct {
+	db   *sql.DB
+	mu   sync.RWMutex
+	v4   *trieNode
+	v6   *trieNode
+	asns map[string]*BlockEntry
+	stop chan struct{}
+}
+
+// NewBlockStore loads every non-expired ip_blocks row into memory and
+// returns a store ready for Lookup/Block/Unblock.
+func NewBlockStore(db *sql.DB) *BlockStore {
+	s := &BlockStore{
+		db:   db,
+		v4:   &trieNode{},
+		v6:   &trieNode{},
+		asns: make(map[string]*BlockEntry),
+		stop: make(chan struct{}),
+	}
+	s.reload()
+	return s
+}
+
+// Start launches the background reap/reload loop. leaderCheck nil means this
+// replica always reaps; pass sm.elector.IsLeader so only the elected leader
+// deletes expired rows from ip_blocks, the same gating checkForNewAlerts
+// uses for its own background work.
+func (s *BlockStore) Start(leaderCheck func() bool) {
+	go func() {
+		ticker := time.NewTicker(blockReapInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if leaderCheck == nil || leaderCheck() {
+					s.reap()
+				}
+				s.reload()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (s *BlockStore) Stop() {
+	close(s.stop)
+}
+
+// Block inserts (or renews) a ban and returns the stored entry. value is
+// normalized per scope: "ip"/"cidr" are parsed as addresses/ranges, "asn" is
+// upper-cased and validated against the ASnnnn form. duration <= 0 falls
+// back to defaultBlockDuration.
+func (s *BlockStore) Block(value, scope, reason, source string, duration time.Duration) (*BlockEntry, error) {
+	if !validBlockScopes[scope] {
+		return nil, fmt.Errorf("scope must be ip, cidr, or asn")
+	}
+	if duration <= 0 {
+		duration = defaultBlockDuration
+	}
+
+	normalized, err := normalizeBlockValue(value, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	expiresAt := time.Now().Add(duration)
+	entry := &BlockEntry{
+		Value:     normalized,
+		Scope:     scope,
+		Reason:    reason,
+		Source:    source,
+		CreatedAt: time.Now(),
+		ExpiresAt: &expiresAt,
+	}
+
+	result, err := s.db.Exec(`
+		INSERT INTO ip_blocks (value, scope, reason, source, expires_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE reason = VALUES(reason), source = VALUES(source), expires_at = VALUES(expires_at)
+	`, normalized, scope, reason, source, expiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to persist block: %v", err)
+	}
+	if id, err := result.LastInsertId(); err == nil && id > 0 {
+		entry.ID = id
+	}
+
+	s.mu.Lock()
+	s.insertLocked(entry)
+	s.mu.Unlock()
+
+	return entry, nil
+}
+
+// Unblock removes a ban by its exact value/scope.
+func (s *BlockStore) Unblock(value, scope string) error {
+	normalized, err := normalizeBlockValue(value, scope)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.db.Exec(`DELETE FROM ip_blocks WHERE value = ? AND scope = ?`, normalized, scope); err != nil {
+		return fmt.Errorf("failed to remove block: %v", err)
+	}
+
+	s.mu.Lock()
+	s.removeLocked(normalized, scope)
+	s.mu.Unlock()
+
+	return nil
+}
+
+// Lookup returns the most specific non-expired ban matching ip, if any.
+// ASN entries are never returned here since this codebase has no IP->ASN
+// resolver to compare against; see the file-level comment.
+func (s *BlockStore) Lookup(ipStr string) (*BlockEntry, bool) {
+	ip := net.ParseIP(strings.TrimSpace(ipStr))
+	if ip == nil {
+		return nil, false
+	}
+
+	var root *trieNode
+	var addr net.IP
+	if v4 := ip.To4(); v4 != nil {
+		addr = v4
+	} else {
+		addr = ip.To16()
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(addr) == net.IPv4len {
+		root = s.v4
+	} else {
+		root = s.v6
+	}
+
+	now := time.Now()
+	node := root
+	var match *BlockEntry
+	if node.entry != nil && !node.entry.expired(now) {
+		match = node.entry
+	}
+	for i := 0; i < len(addr)*8; i++ {
+		bit := ipBit(addr, i)
+		if node.children[bit] == nil {
+			break
+		}
+		node = node.children[bit]
+		if node.entry != nil && !node.entry.expired(now) {
+			match = node.entry
+		}
+	}
+	return match, match != nil
+}
+
+// Entries returns every non-expired ban, for the /blocklist export endpoint.
+// ip_blocks is queried directly rather than flattening the trie, since the
+// table is already the source of truth the trie is rebuilt from.
+func (s *BlockStore) Entries() []BlockEntry {
+	rows, err := s.db.Query(`
+		SELECT id, value, scope, reason, source, created_at, expires_at
+		FROM ip_blocks
+		WHERE expires_at IS NULL OR expires_at > NOW()
+		ORDER BY scope, value
+	`)
+	if err != nil {
+		log.Printf("⚠️  block store: failed to list entries: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var entries []BlockEntry
+	for rows.Next() {
+		var e BlockEntry
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&e.ID, &e.Value, &e.Scope, &e.Reason, &e.Source, &e.CreatedAt, &expiresAt); err != nil {
+			continue
+		}
+		if expiresAt.Valid {
+			e.ExpiresAt = &expiresAt.Time
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// reload rebuilds the in-memory trie/ASN map from ip_blocks, so a replica
+// that didn't originate a Block/Unblock call still converges to the shared
+// state within one blockReapInterval.
+func (s *BlockStore) reload() {
+	entries := s.Entries()
+
+	v4 := &trieNode{}
+	v6 := &trieNode{}
+	asns := make(map[string]*BlockEntry)
+
+	for i := range entries {
+		entry := entries[i]
+		switch entry.Scope {
+		case "asn":
+			asns[entry.Value] = &entry
+		case "ip", "cidr":
+			_, ipNet, err := net.ParseCIDR(asCIDR(entry.Value))
+			if err != nil {
+				continue
+			}
+			if v4Addr := ipNet.IP.To4(); v4Addr != nil {
+				ones, _ := ipNet.Mask.Size()
+				insertTrie(v4, v4Addr, ones, &entry)
+			} else {
+				ones, _ := ipNet.Mask.Size()
+				insertTrie(v6, ipNet.IP.To16(), ones, &entry)
+			}
+		}
+	}
+
+	s.mu.Lock()
+	s.v4, s.v6, s.asns = v4, v6, asns
+	s.mu.Unlock()
+}
+
+// reap deletes expired ip_blocks rows; called only on the elected leader so
+// a fleet of replicas doesn't race DELETEs against the same table.
+func (s *BlockStore) reap() {
+	result, err := s.db.Exec(`DELETE FROM ip_blocks WHERE expires_at IS NOT NULL AND expires_at <= NOW()`)
+	if err != nil {
+		log.Printf("⚠️  block store: failed to reap expired entries: %v", err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		log.Printf("🧹 block store: reaped %d expired entries", n)
+	}
+}
+
+// insertLocked adds entry to the trie or ASN map; callers must hold s.mu.
+func (s *BlockStore) insertLocked(entry *BlockEntry) {
+	if entry.Scope == "asn" {
+		s.asns[entry.Value] = entry
+		return
+	}
+	_, ipNet, err := net.ParseCIDR(asCIDR(entry.Value))
+	if err != nil {
+		return
+	}
+	if v4Addr := ipNet.IP.To4(); v4Addr != nil {
+		ones, _ := ipNet.Mask.Size()
+		insertTrie(s.v4, v4Addr, ones, entry)
+	} else {
+		ones, _ := ipNet.Mask.Size()
+		insertTrie(s.v6, ipNet.IP.To16(), ones, entry)
+	}
+}
+
+// removeLocked clears entry at value/scope's exact prefix without touching
+// any narrower or broader ban sharing the same path; callers must hold s.mu.
+func (s *BlockStore) removeLocked(value, scope string) {
+	if scope == "asn" {
+		delete(s.asns, value)
+		return
+	}
+	_, ipNet, err := net.ParseCIDR(asCIDR(value))
+	if err != nil {
+		return
+	}
+
+	var root *trieNode
+	var addr net.IP
+	if v4Addr := ipNet.IP.To4(); v4Addr != nil {
+		root, addr = s.v4, v4Addr
+	} else {
+		root, addr = s.v6, ipNet.IP.To16()
+	}
+
+	ones, _ := ipNet.Mask.Size()
+	node := root
+	for i := 0; i < ones; i++ {
+		bit := ipBit(addr, i)
+		if node.children[bit] == nil {
+			return
+		}
+		node = node.children[bit]
+	}
+	node.entry = nil
+}
+
+// insertTrie walks prefixLen bits of addr from root, creating nodes as
+// needed, and stores entry at the node for that exact prefix.
+func insertTrie(root *trieNode, addr net.IP, prefixLen int, entry *BlockEntry) {
+	node := root
+	for i := 0; i < prefixLen; i++ {
+		bit := ipBit(addr, i)
+		if node.children[bit] == nil {
+			node.children[bit] = &trieNode{}
+		}
+		node = node.children[bit]
+	}
+	node.entry = entry
+}
+
+// ipBit returns the i-th most significant bit (0-indexed) of addr, which
+// must already be normalized to 4 bytes (IPv4) or 16 bytes (IPv6).
+func ipBit(addr net.IP, i int) int {
+	return int((addr[i/8] >> uint(7-i%8)) & 1)
+}
+
+// asCIDR turns a bare IP (no "/prefix") into a /32 or /128 CIDR string so it
+// can be parsed and walked the same way a real range would be.
+func asCIDR(value string) string {
+	if strings.Contains(value, "/") {
+		return value
+	}
+	if strings.Contains(value, ":") {
+		return value + "/128"
+	}
+	return value + "/32"
+}
+
+// normalizeBlockValue validates value against scope and returns its
+// canonical form for storage/comparison.
+func normalizeBlockValue(value, scope string) (string, error) {
+	switch scope {
+	case "ip":
+		ip := net.ParseIP(strings.TrimSpace(value))
+		if ip == nil {
+			return "", fmt.Errorf("invalid IP address %q", value)
+		}
+		return ip.String(), nil
+	case "cidr":
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(value))
+		if err != nil {
+			return "", fmt.Errorf("invalid CIDR %q: %v", value, err)
+		}
+		return ipNet.String(), nil
+	case "asn":
+		v := strings.ToUpper(strings.TrimSpace(value))
+		if !asnPattern.MatchString(v) {
+			return "", fmt.Errorf("invalid ASN %q, expected a form like AS15169", value)
+		}
+		return v, nil
+	default:
+		return "", fmt.Errorf("unknown scope %q", scope)
+	}
+}
+
+// renderBlocklistPlaintext lists one value per line, the simplest format an
+// edge firewall's include directive can consume directly.
+func renderBlocklistPlaintext(entries []BlockEntry) string {
+	var b strings.Builder
+	for _, e := range entries {
+		fmt.Fprintf(&b, "%s\n", e.Value)
+	}
+	return b.String()
+}
+
+// renderBlocklistMikrotik emits a RouterOS script that (re)populates a
+// single address-list, the same shape CrowdSec's RouterOS bouncer expects.
+func renderBlocklistMikrotik(entries []BlockEntry) string {
+	var b strings.Builder
+	b.WriteString("/ip firewall address-list\n")
+	b.WriteString("remove [find list=krili-blocklist]\n")
+	for _, e := range entries {
+		if e.Scope == "asn" {
+			continue // RouterOS address-lists only hold IPs/CIDRs
+		}
+		fmt.Fprintf(&b, "add list=krili-blocklist address=%s comment=%q\n", e.Value, e.Reason)
+	}
+	return b.String()
+}
+
+// renderBlocklistNftables emits an nftables script that (re)populates named
+// v4/v6 sets, mirroring CrowdSec's nftables bouncer.
+func renderBlocklistNftables(entries []BlockEntry) string {
+	var v4, v6 []string
+	for _, e := range entries {
+		if e.Scope != "ip" && e.Scope != "cidr" {
+			continue
+		}
+		if strings.Contains(e.Value, ":") {
+			v6 = append(v6, e.Value)
+		} else {
+			v4 = append(v4, e.Value)
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("flush set inet filter krili_blocklist_v4\n")
+	fmt.Fprintf(&b, "add element inet filter krili_blocklist_v4 { %s }\n", strings.Join(v4, ", "))
+	b.WriteString("flush set inet filter krili_blocklist_v6\n")
+	fmt.Fprintf(&b, "add element inet filter krili_blocklist_v6 { %s }\n", strings.Join(v6, ", "))
+	return b.String()
+}
+
+// initializeBlockStoreTable creates the table BlockStore persists bans to.
+func initializeBlockStoreTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS ip_blocks (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			value VARCHAR(64) NOT NULL,
+			scope ENUM('ip', 'cidr', 'asn') NOT NULL,
+			reason VARCHAR(255),
+			source VARCHAR(20) NOT NULL DEFAULT 'manual',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			expires_at TIMESTAMP NULL,
+			UNIQUE KEY idx_value_scope (value, scope),
+			INDEX idx_expires_at (expires_at)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create ip_blocks table: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	_ "embed"
+	"strings"
+)
+
+// commonPasswordsSeed is a small bundled list of well-known common
+// passwords (data/common_passwords.txt) - a seed list in the spirit of the
+// HIBP top-100k corpus, not a copy of it: pulling in the real 100k-entry
+// list isn't possible in this build (no network access to fetch it, no
+// vendored copy), so buildCommonPasswordFilter below expands this seed with
+// the numeric/year suffixes attackers commonly tack onto a base word to get
+// closer to that corpus's practical coverage without shipping a multi-MB
+// embedded file.
+//
+//go:embed data/common_passwords.txt
+var commonPasswordsSeed string
+
+// commonPasswordSuffixes are appended to each seed word, mirroring the
+// "password1", "password123", "password2024" style variations that make up
+// a large share of real-world breached passwords built from a dictionary
+// word.
+var commonPasswordSuffixes = []string{
+	"", "1", "12", "123", "1234", "!", "01", "007",
+	"2020", "2021", "2022", "2023", "2024", "2025",
+}
+
+// buildCommonPasswordFilter parses commonPasswordsSeed and loads every
+// seed-word/suffix combination (lowercased, since isCommonPassword
+// lowercases its input) into the same bloomFilter threat_intel.go uses for
+// MightBeMalicious, sized for a ~1% false-positive rate so an unlucky
+// legitimate password is only ever rejected, not silently accepted, with
+// negligible odds.
+func buildCommonPasswordFilter() *bloomFilter {
+	var words []string
+	scanner := bufio.NewScanner(strings.NewReader(commonPasswordsSeed))
+	for scanner.Scan() {
+		word := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if word == "" || strings.HasPrefix(word, "#") {
+			continue
+		}
+		words = append(words, word)
+	}
+
+	filter := newBloomFilter(len(words)*len(commonPasswordSuffixes), 0.01)
+	for _, word := range words {
+		for _, suffix := range commonPasswordSuffixes {
+			filter.Add(word + suffix)
+		}
+	}
+	return filter
+}
+
+// commonPasswordFilter is built once at package init from the bundled seed
+// list; validatePasswordStrength consults it synchronously on every
+// password submission, so it needs to be O(1) and allocation-free per check.
+var commonPasswordFilter = buildCommonPasswordFilter()
+
+// isCommonPassword reports whether password (case-insensitively) matches a
+// known common password or one of its numeric/year-suffixed variants.
+func isCommonPassword(password string) bool {
+	return commonPasswordFilter.MightContain(strings.ToLower(password))
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// runCSCLI implements a small cscli-style CLI for managing mTLS client
+// certificates directly against the database, so an operator can enroll or
+// revoke a bouncer/agent without running a signed-in REST session or
+// hand-editing client_certificates. Invoked as
+// `./krili cscli cert <issue|revoke|list> [flags]`; args is os.Args[2:],
+// i.e. everything after the "cscli" subcommand itself.
+func runCSCLI(args []string) int {
+	if len(args) < 2 || args[0] != "cert" {
+		fmt.Fprintln(os.Stderr, "usage: cscli cert <issue|revoke|list> [flags]")
+		return 1
+	}
+
+	config := loadConfigWithSecrets()
+	db, err := connectDBSecure(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to connect to database: %v\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	ca, err := NewCertificateAuthority(db)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to initialize certificate authority: %v\n", err)
+		return 1
+	}
+
+	switch args[1] {
+	case "issue":
+		return cscliCertIssue(ca, args[2:])
+	case "revoke":
+		return cscliCertRevoke(ca, args[2:])
+	case "list":
+		return cscliCertList(ca, args[2:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown cscli cert subcommand %q\n", args[1])
+		return 1
+	}
+}
+
+func cscliCertIssue(ca *CertificateAuthority, args []string) int {
+	fs := flag.NewFlagSet("cscli cert issue", flag.ContinueOnError)
+	userID := fs.Int("user-id", 0, "user ID the certificate authenticates as (required)")
+	role := fs.String("role", "agent", "role to embed: admin, agent, bouncer, or viewer")
+	allowedIPs := fs.String("allowed-ips", "", "comma-separated IPs/CIDRs the cert may be presented from (default: unrestricted)")
+	validDays := fs.Int("valid-days", 90, "days the certificate remains valid")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if *userID == 0 {
+		fmt.Fprintln(os.Stderr, "cscli cert issue: --user-id is required")
+		return 1
+	}
+
+	certPEM, keyPEM, err := ca.IssueClientCert(*userID, *role, *allowedIPs, time.Duration(*validDays)*24*time.Hour)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to issue certificate: %v\n", err)
+		return 1
+	}
+
+	fmt.Println(string(certPEM))
+	fmt.Println(string(keyPEM))
+	fmt.Fprintln(os.Stderr, "Save the key above now -- it is not stored and cannot be recovered after this command exits.")
+	return 0
+}
+
+func cscliCertRevoke(ca *CertificateAuthority, args []string) int {
+	fs := flag.NewFlagSet("cscli cert revoke", flag.ContinueOnError)
+	serial := fs.String("serial", "", "serial of the certificate to revoke (required)")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if *serial == "" {
+		fmt.Fprintln(os.Stderr, "cscli cert revoke: --serial is required")
+		return 1
+	}
+
+	if err := ca.RevokeClientCert(*serial); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to revoke certificate: %v\n", err)
+		return 1
+	}
+	fmt.Printf("revoked certificate %s\n", *serial)
+	return 0
+}
+
+func cscliCertList(ca *CertificateAuthority, args []string) int {
+	fs := flag.NewFlagSet("cscli cert list", flag.ContinueOnError)
+	userID := fs.String("user-id", "", "only list this user's certificates")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+
+	certs, err := ca.ListClientCerts(*userID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to list certificates: %v\n", err)
+		return 1
+	}
+
+	for _, cert := range certs {
+		status := "active"
+		if cert.RevokedAt != nil {
+			status = "revoked"
+		} else if time.Now().After(cert.ExpiresAt) {
+			status = "expired"
+		}
+		fmt.Printf("%s\tuser=%d\trole=%s\tstatus=%s\texpires=%s\n",
+			cert.Serial, cert.UserID, cert.Role, status, cert.ExpiresAt.Format(time.RFC3339))
+	}
+	return 0
+}
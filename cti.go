@@ -0,0 +1,326 @@
+// Cyber threat intelligence (CTI) enrichment. CrowdSec's own CTI API (and
+// AbuseIPDB/GreyNoise/Spamhaus, which play the same role) answer "what do you
+// know about this IP" with a reputation score, attack categories, and a
+// first/last-seen window. CTIEnricher wraps a CTIProvider with an
+// LRU+TTL cache (so the same attacker IP seen across a burst of events
+// doesn't trigger a lookup per event) and singleflight (so a burst that
+// misses the cache still makes one upstream call, not one per concurrent
+// request). SecurityMonitor and EnhancedSecurityService each hold their own
+// enricher, consistent with how neither shares its other pluggable
+// components (WAF, rule engine, threat feed) with the other today.
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// CTIResult is one provider's answer for a single IP, normalized across
+// AbuseIPDB/GreyNoise/Spamhaus/CrowdSec CTI response shapes.
+type CTIResult struct {
+	IPAddress  string    `json:"ip_address"`
+	Score      int       `json:"score"` // 0-100, higher is more malicious
+	Categories []string  `json:"categories"`
+	FirstSeen  time.Time `json:"first_seen"`
+	LastSeen   time.Time `json:"last_seen"`
+	Confidence float64   `json:"confidence"` // 0-1, provider's confidence in Score
+	Source     string    `json:"source"`
+}
+
+// CTIProvider looks up reputation data for a single IP from an external CTI
+// feed.
+type CTIProvider interface {
+	Name() string
+	LookupIP(ip string) (*CTIResult, error)
+}
+
+// defaultCTICacheTTL and defaultCTICacheMaxEntriesPerShard bound how long an
+// enrichment is trusted and how much memory the cache can grow to; CTI
+// scores drift slowly (hours, not seconds) so a multi-hour TTL is plenty
+// fresh without re-querying the upstream feed for every event.
+const (
+	defaultCTICacheTTL                = 6 * time.Hour
+	defaultCTICacheMaxEntriesPerShard = 256
+)
+
+// CTIEnricher is the pluggable CTI subsystem wired into SecurityMonitor and
+// EnhancedSecurityService. autoBlockThreshold <= 0 disables auto-blocking;
+// callers that want score-triggered blocking compare Lookup's result
+// themselves (see SecurityMonitor.checkForNewAlerts).
+type CTIEnricher struct {
+	provider           CTIProvider
+	cache              *shardedTTLCache
+	ttl                time.Duration
+	group              singleflight.Group
+	autoBlockThreshold int
+}
+
+// newCTIEnricher wraps provider with a cache and singleflight group. ttl <=
+// 0 falls back to defaultCTICacheTTL.
+func newCTIEnricher(provider CTIProvider, ttl time.Duration, maxEntriesPerShard, autoBlockThreshold int) *CTIEnricher {
+	if ttl <= 0 {
+		ttl = defaultCTICacheTTL
+	}
+	if maxEntriesPerShard <= 0 {
+		maxEntriesPerShard = defaultCTICacheMaxEntriesPerShard
+	}
+	return &CTIEnricher{
+		provider:           provider,
+		cache:              newShardedTTLCache("cti_lookup", maxEntriesPerShard),
+		ttl:                ttl,
+		autoBlockThreshold: autoBlockThreshold,
+	}
+}
+
+// Lookup returns the cached CTIResult for ip if present and unexpired,
+// otherwise fetches it from the provider. Concurrent lookups for the same ip
+// that miss the cache are collapsed into a single provider call via
+// singleflight.
+func (e *CTIEnricher) Lookup(ip string) (*CTIResult, error) {
+	if cached, ok := e.cache.Get(ip); ok {
+		return cached.(*CTIResult), nil
+	}
+
+	result, err, _ := e.group.Do(ip, func() (interface{}, error) {
+		return e.provider.LookupIP(ip)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cti := result.(*CTIResult)
+	e.cache.Set(ip, cti, e.ttl)
+	return cti, nil
+}
+
+// ShouldAutoBlock reports whether result's score crosses this enricher's
+// configured auto-block threshold.
+func (e *CTIEnricher) ShouldAutoBlock(result *CTIResult) bool {
+	return e.autoBlockThreshold > 0 && result.Score >= e.autoBlockThreshold
+}
+
+// newCTIEnricherFromEnv builds a CTIEnricher from CTI_PROVIDER
+// (abuseipdb/greynoise/spamhaus/crowdsec) and its companion env vars, or
+// returns nil if CTI_PROVIDER is unset so the enrichment path is a no-op
+// everywhere it's wired in.
+func newCTIEnricherFromEnv() *CTIEnricher {
+	providerName := strings.ToLower(getEnv("CTI_PROVIDER", ""))
+	if providerName == "" {
+		return nil
+	}
+
+	apiKey := os.Getenv("CTI_API_KEY")
+	var provider CTIProvider
+	switch providerName {
+	case "abuseipdb":
+		provider = newAbuseIPDBProvider(apiKey, getEnv("CTI_BASE_URL", "https://api.abuseipdb.com"))
+	case "greynoise":
+		provider = newGreyNoiseProvider(apiKey)
+	case "spamhaus":
+		provider = newSpamhausProvider(apiKey)
+	case "crowdsec":
+		provider = newCrowdSecCTIProvider(apiKey, getEnv("CTI_BASE_URL", ""))
+	default:
+		return nil
+	}
+
+	ttl := defaultCTICacheTTL
+	if raw := os.Getenv("CTI_CACHE_TTL_SECONDS"); raw != "" {
+		if seconds, err := strconv.Atoi(raw); err == nil && seconds > 0 {
+			ttl = time.Duration(seconds) * time.Second
+		}
+	}
+
+	maxEntriesPerShard := defaultCTICacheMaxEntriesPerShard
+	if raw := os.Getenv("CTI_CACHE_MAX_ENTRIES_PER_SHARD"); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil && n > 0 {
+			maxEntriesPerShard = n
+		}
+	}
+
+	autoBlockThreshold := 0
+	if raw := os.Getenv("CTI_AUTO_BLOCK_SCORE_THRESHOLD"); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil {
+			autoBlockThreshold = n
+		}
+	}
+
+	return newCTIEnricher(provider, ttl, maxEntriesPerShard, autoBlockThreshold)
+}
+
+// abuseIPDBProvider queries AbuseIPDB's /check endpoint, the one feed among
+// CTI_PROVIDER's options simple enough to call directly with net/http (a
+// single GET with an API key header and a JSON body).
+type abuseIPDBProvider struct {
+	apiKey  string
+	baseURL string
+	client  *http.Client
+}
+
+func newAbuseIPDBProvider(apiKey, baseURL string) *abuseIPDBProvider {
+	return &abuseIPDBProvider{apiKey: apiKey, baseURL: baseURL, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (a *abuseIPDBProvider) Name() string { return "abuseipdb" }
+
+// abuseIPDBCategories maps AbuseIPDB's numeric category codes to the short
+// labels CTIResult.Categories uses elsewhere (scanner, brute-force, tor, ...).
+// Only the categories this system's blockIP/risk logic cares about are
+// mapped; anything else is dropped rather than surfaced as a raw number.
+var abuseIPDBCategories = map[int]string{
+	4:  "ddos",
+	9:  "scanner",
+	14: "port_scan",
+	15: "hacking",
+	18: "brute_force",
+	19: "bad_web_bot",
+	20: "exploited_host",
+	21: "web_app_attack",
+	22: "ssh",
+	23: "iot_targeted",
+}
+
+func (a *abuseIPDBProvider) LookupIP(ip string) (*CTIResult, error) {
+	req, err := http.NewRequest(http.MethodGet, a.baseURL+"/api/v2/check", nil)
+	if err != nil {
+		return nil, err
+	}
+	q := req.URL.Query()
+	q.Set("ipAddress", ip)
+	q.Set("maxAgeInDays", "90")
+	req.URL.RawQuery = q.Encode()
+	req.Header.Set("Key", a.apiKey)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("abuseipdb: %s returned %d: %s", req.URL.Path, resp.StatusCode, body)
+	}
+
+	var parsed struct {
+		Data struct {
+			AbuseConfidenceScore int       `json:"abuseConfidenceScore"`
+			TotalReports         int       `json:"totalReports"`
+			LastReportedAt       time.Time `json:"lastReportedAt"`
+			Reports              []struct {
+				ReportedAt time.Time `json:"reportedAt"`
+				Categories []int     `json:"categories"`
+			} `json:"reports"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return nil, fmt.Errorf("abuseipdb: invalid response body: %v", err)
+	}
+
+	seen := map[string]bool{}
+	var categories []string
+	firstSeen := parsed.Data.LastReportedAt
+	for _, report := range parsed.Data.Reports {
+		if report.ReportedAt.Before(firstSeen) || firstSeen.IsZero() {
+			firstSeen = report.ReportedAt
+		}
+		for _, code := range report.Categories {
+			if label, ok := abuseIPDBCategories[code]; ok && !seen[label] {
+				seen[label] = true
+				categories = append(categories, label)
+			}
+		}
+	}
+
+	confidence := 0.0
+	if parsed.Data.TotalReports > 0 {
+		confidence = 1.0
+	}
+
+	return &CTIResult{
+		IPAddress:  ip,
+		Score:      parsed.Data.AbuseConfidenceScore,
+		Categories: categories,
+		FirstSeen:  firstSeen,
+		LastSeen:   parsed.Data.LastReportedAt,
+		Confidence: confidence,
+		Source:     a.Name(),
+	}, nil
+}
+
+// greyNoiseProvider, spamhausProvider and crowdsecCTIProvider round out
+// CTI_PROVIDER's options but aren't wired to a real endpoint in this build —
+// unlike AbuseIPDB's simple query-param GET, all three need either a paid
+// API tier this sandbox has no credentials for (GreyNoise, Spamhaus DQS) or
+// CrowdSec's separate CTI API (distinct from the decisions/stream feed
+// ThreatFeedClient already pulls in threat_intel.go). Left as clearly-labeled
+// stubs, same as vaultSecretsProvider/awsSecretsManagerProvider.
+type greyNoiseProvider struct{ apiKey string }
+
+func newGreyNoiseProvider(apiKey string) *greyNoiseProvider {
+	return &greyNoiseProvider{apiKey: apiKey}
+}
+
+func (g *greyNoiseProvider) Name() string { return "greynoise" }
+
+func (g *greyNoiseProvider) LookupIP(ip string) (*CTIResult, error) {
+	return nil, fmt.Errorf("greynoise CTI provider not connected: cannot look up %s", ip)
+}
+
+type spamhausProvider struct{ apiKey string }
+
+func newSpamhausProvider(apiKey string) *spamhausProvider { return &spamhausProvider{apiKey: apiKey} }
+
+func (s *spamhausProvider) Name() string { return "spamhaus" }
+
+func (s *spamhausProvider) LookupIP(ip string) (*CTIResult, error) {
+	return nil, fmt.Errorf("spamhaus CTI provider not connected: cannot look up %s", ip)
+}
+
+type crowdsecCTIProvider struct {
+	apiKey  string
+	baseURL string
+}
+
+func newCrowdSecCTIProvider(apiKey, baseURL string) *crowdsecCTIProvider {
+	return &crowdsecCTIProvider{apiKey: apiKey, baseURL: baseURL}
+}
+
+func (c *crowdsecCTIProvider) Name() string { return "crowdsec" }
+
+func (c *crowdsecCTIProvider) LookupIP(ip string) (*CTIResult, error) {
+	return nil, fmt.Errorf("crowdsec CTI provider not connected: cannot look up %s", ip)
+}
+
+// initializeCTIColumns adds the CTI enrichment columns security_events and
+// ip_reputation need, for deployments whose tables predate this feature; a
+// fresh CREATE TABLE already includes them.
+func initializeCTIColumns(db *sql.DB) error {
+	if _, err := db.Exec(`ALTER TABLE security_events
+		ADD COLUMN IF NOT EXISTS cti_score INT,
+		ADD COLUMN IF NOT EXISTS cti_categories VARCHAR(255),
+		ADD COLUMN IF NOT EXISTS cti_confidence DOUBLE,
+		ADD COLUMN IF NOT EXISTS cti_source VARCHAR(64)`); err != nil {
+		return fmt.Errorf("failed to add CTI columns to security_events: %v", err)
+	}
+	if _, err := db.Exec(`ALTER TABLE ip_reputation
+		ADD COLUMN IF NOT EXISTS cti_score INT,
+		ADD COLUMN IF NOT EXISTS cti_categories VARCHAR(255),
+		ADD COLUMN IF NOT EXISTS cti_source VARCHAR(64)`); err != nil {
+		return fmt.Errorf("failed to add CTI columns to ip_reputation: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// dashboardRoles is the set of client_certificates.role / JWT-admin roles the
+// security dashboard's WebSocket endpoint understands. "agent" (machine
+// callers issued via IssueClientCert) is deliberately excluded here; it has
+// no business opening an interactive dashboard session.
+var dashboardRoles = map[string]bool{
+	"admin":   true,
+	"viewer":  true,
+	"bouncer": true,
+}
+
+// wsMutatingMessageRoles lists, per WebSocket client message type, which
+// dashboard roles may invoke it. Message types not listed here (e.g.
+// "ping") are left unrestricted. "viewer" is deliberately absent from every
+// entry: it can watch the live feed but can't acknowledge alerts or touch
+// IP blocks.
+var wsMutatingMessageRoles = map[string]map[string]bool{
+	"acknowledge_alert": {"admin": true, "bouncer": true},
+	"resolve_alert":     {"admin": true, "bouncer": true},
+	"block_ip":          {"admin": true, "bouncer": true},
+	"unblock_ip":        {"admin": true, "bouncer": true},
+}
+
+// wsMessageAllowed reports whether role may send msgType over the dashboard
+// WebSocket. Message types with no entry in wsMutatingMessageRoles are
+// unrestricted.
+func wsMessageAllowed(role, msgType string) bool {
+	allowed, restricted := wsMutatingMessageRoles[msgType]
+	if !restricted {
+		return true
+	}
+	return allowed[role]
+}
+
+// isAllowedWebSocketOrigin checks a WebSocket handshake's Origin header
+// against the configurable allowlist set at startup by
+// setWebSocketOriginAllowlist. An empty allowlist (the default, nothing
+// configured) rejects every non-empty Origin, since a same-origin browser
+// dashboard should always send one; tooling that omits the header at all
+// passes this check and goes on to the ticket check. mTLS clients are
+// authenticated by their certificate before this check runs.
+var wsOriginAllowlist []string
+
+func setWebSocketOriginAllowlist(origins []string) {
+	wsOriginAllowlist = origins
+}
+
+func isAllowedWebSocketOrigin(origin string) bool {
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range wsOriginAllowlist {
+		if allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// newWebSocketOriginAllowlistFromEnv parses WS_ALLOWED_ORIGINS as a
+// comma-separated list, following the same convention as the other
+// newXFromEnv parsers in this codebase.
+func newWebSocketOriginAllowlistFromEnv() []string {
+	raw := strings.TrimSpace(getEnv("WS_ALLOWED_ORIGINS", ""))
+	if raw == "" {
+		return nil
+	}
+	var origins []string
+	for _, origin := range strings.Split(raw, ",") {
+		origin = strings.TrimSpace(origin)
+		if origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// wsDashboardAuthMiddleware resolves the caller's dashboard role before the
+// WebSocket upgrade happens, the same way adminOrMTLSMiddleware guards the
+// REST security API: a presented client certificate takes priority for
+// machine bouncers. Browser clients can't set an Authorization header on a
+// WebSocket handshake, so instead of a JWT-bearer fallback they pass a
+// short-lived, single-use ticket (minted by issueWSTicketHandler over a
+// normal authenticated REST call) as a "ticket" query parameter. Either path
+// stashes the resolved role in the gin context as "dashboard_role" for
+// handleWebSocket to read before it hands the connection to
+// handleClientMessage.
+func wsDashboardAuthMiddleware(sth *SecureTransactionHandler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if sth.ca != nil && c.Request.TLS != nil && len(c.Request.TLS.PeerCertificates) > 0 {
+			sth.ca.mtlsAuthMiddleware()(c)
+			if c.IsAborted() {
+				return
+			}
+			role := c.GetString("client_cert_role")
+			if !dashboardRoles[role] {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Certificate role not permitted on the security dashboard"})
+				c.Abort()
+				return
+			}
+			c.Set("dashboard_role", role)
+			c.Next()
+			return
+		}
+
+		if !isAllowedWebSocketOrigin(c.GetHeader("Origin")) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Origin not allowed"})
+			c.Abort()
+			return
+		}
+
+		ticket := c.Query("ticket")
+		if ticket == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "ticket query parameter required"})
+			c.Abort()
+			return
+		}
+		role, ok := sth.sm.wsHub.tickets.Redeem(ticket)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired ticket"})
+			c.Abort()
+			return
+		}
+		c.Set("dashboard_role", role)
+		c.Next()
+	}
+}
+
+// SignCSR countersigns an operator-supplied certificate signing request
+// instead of generating the client keypair itself, unlike IssueClientCert.
+// This is the bootstrap path for operators who want the private key to
+// never leave their own machine: generate a keypair and CSR locally (e.g.
+// `openssl req -new -key agent.key -out agent.csr -subj "/CN=agent-1/OU=bouncer"`),
+// then POST the CSR to signCSRHandler to get back a cert signed by this CA.
+func (ca *CertificateAuthority) SignCSR(csrPEM []byte, userID int, role string, validFor time.Duration) (certPEM []byte, err error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, fmt.Errorf("csr_pem is not a PEM-encoded certificate request")
+	}
+
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CSR: %v", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("CSR signature does not verify: %v", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(validFor)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      csr.Subject,
+		NotBefore:    now,
+		NotAfter:     expiresAt,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, ca.caCert, csr.PublicKey, ca.caKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign certificate: %v", err)
+	}
+
+	fingerprint := sha256.Sum256(derBytes)
+	_, err = ca.db.Exec(`
+		INSERT INTO client_certificates (serial, fingerprint, user_id, role, issued_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, serial.String(), hex.EncodeToString(fingerprint[:]), userID, role, now, expiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record signed certificate: %v", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes}), nil
+}
+
+// signCSRHandler is the CLI-facing counterpart of SignCSR: an admin-gated
+// endpoint an operator can hit with curl/a small script to bootstrap a
+// dashboard or agent certificate without ever sending their private key
+// over the wire.
+func (sth *SecureTransactionHandler) signCSRHandler(c *gin.Context) {
+	var req struct {
+		CSRPEM       string `json:"csr_pem" binding:"required"`
+		UserID       int    `json:"user_id" binding:"required"`
+		Role         string `json:"role" binding:"required"`
+		ValidForDays int    `json:"valid_for_days"`
+	}
+	if sth.ca == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "mTLS certificate authority is not configured"})
+		return
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !dashboardRoles[req.Role] && req.Role != "agent" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be one of admin, viewer, bouncer, agent"})
+		return
+	}
+	if req.ValidForDays <= 0 || req.ValidForDays > 365 {
+		req.ValidForDays = 90
+	}
+
+	certPEM, err := sth.ca.SignCSR([]byte(req.CSRPEM), req.UserID, req.Role, time.Duration(req.ValidForDays)*24*time.Hour)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"cert_pem":   string(certPEM),
+		"ca_cert":    string(sth.ca.caCertPEM),
+		"role":       req.Role,
+		"valid_days": req.ValidForDays,
+	})
+}
+
+// issueClientCertHandler is the CA-generates-the-keypair counterpart of
+// signCSRHandler: an admin-gated endpoint for operators who are fine with the
+// CA holding the private key briefly in memory to return it alongside the
+// cert, instead of bringing their own CSR. Typical callers are admin CLIs
+// bootstrapping a brand-new agent identity in one round trip.
+func (sth *SecureTransactionHandler) issueClientCertHandler(c *gin.Context) {
+	var req struct {
+		UserID       int    `json:"user_id" binding:"required"`
+		Role         string `json:"role" binding:"required"`
+		AllowedIPs   string `json:"allowed_ips"`
+		ValidForDays int    `json:"valid_for_days"`
+	}
+	if sth.ca == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "mTLS certificate authority is not configured"})
+		return
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !dashboardRoles[req.Role] && req.Role != "agent" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be one of admin, viewer, bouncer, agent"})
+		return
+	}
+	if req.ValidForDays <= 0 || req.ValidForDays > 365 {
+		req.ValidForDays = 90
+	}
+
+	certPEM, keyPEM, err := sth.ca.IssueClientCert(req.UserID, req.Role, req.AllowedIPs, time.Duration(req.ValidForDays)*24*time.Hour)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"cert_pem":   string(certPEM),
+		"key_pem":    string(keyPEM),
+		"ca_cert":    string(sth.ca.caCertPEM),
+		"role":       req.Role,
+		"valid_days": req.ValidForDays,
+	})
+}
+
+// revokeClientCertHandler lets an operator revoke an issued certificate by
+// serial ahead of its natural expiry, e.g. after a compromised agent host is
+// decommissioned. The row is kept for audit history; only revoked_at is set.
+func (sth *SecureTransactionHandler) revokeClientCertHandler(c *gin.Context) {
+	var req struct {
+		Serial string `json:"serial" binding:"required"`
+	}
+	if sth.ca == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "mTLS certificate authority is not configured"})
+		return
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := sth.ca.RevokeClientCert(req.Serial); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke certificate"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "certificate revoked", "serial": req.Serial})
+}
+
+// listClientCertificatesHandler lists every certificate the CA has issued,
+// for operators auditing who holds a live mTLS credential without querying
+// client_certificates by hand. An optional user_id query parameter narrows
+// the list to one user's certificates.
+func (sth *SecureTransactionHandler) listClientCertificatesHandler(c *gin.Context) {
+	if sth.ca == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "mTLS certificate authority is not configured"})
+		return
+	}
+
+	certs, err := sth.ca.ListClientCerts(c.Query("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"certificates": certs})
+}
+
+// initializeDashboardRoleColumn extends client_certificates.role with the
+// "viewer" role introduced for the security dashboard's WebSocket auth, for
+// deployments whose table was created before this role existed; a fresh
+// CREATE TABLE already includes it via initializeCertificateTables.
+func initializeDashboardRoleColumn(db *sql.DB) error {
+	_, err := db.Exec(`
+		ALTER TABLE client_certificates
+			MODIFY COLUMN role ENUM('admin', 'agent', 'bouncer', 'viewer') NOT NULL`)
+	if err != nil {
+		return fmt.Errorf("failed to add viewer role to client_certificates: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Dialect abstracts the handful of SQL constructs that differ between MySQL,
+// PostgreSQL and SQLite so the schema/migration strings in
+// initializeTables/initializeSecurityTables/initializeMonitoringTables don't
+// have to be hand-written per driver.
+//
+// Adoption is partial, not repo-wide: only secure_system.go's and
+// security_repository.go's own table definitions and queries go through
+// Dialect today. Every feature added since (ledger, payment invoices, the
+// invoice flow, webhooks, TAN challenges, the payment data vault,
+// idempotency keys, approval rules, the reconciliation chore, the block
+// store, geo intel, RBAC, mTLS auth, notification channels, the alert
+// dispatcher, TOTP, and the payment provider router) still hardcodes MySQL
+// DDL and `?` placeholders directly. A commit subject claiming to "drop the
+// last raw SQL" means the last raw SQL in the security-monitor tables this
+// file covers, not in the module as a whole -- migrating every one of those
+// call sites to Dialect is its own follow-up, not done here.
+type Dialect interface {
+	Name() string
+	AutoIncrement() string
+	JSONType() string
+	UpsertIgnore(table, columns, values string) string
+	Now() string
+	OnUpdateTimestamp() string
+	Placeholder(n int) string
+}
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) Name() string          { return "mysql" }
+func (mysqlDialect) AutoIncrement() string { return "INT AUTO_INCREMENT PRIMARY KEY" }
+func (mysqlDialect) JSONType() string      { return "JSON" }
+func (mysqlDialect) Now() string           { return "NOW()" }
+func (mysqlDialect) OnUpdateTimestamp() string {
+	return "TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP"
+}
+func (mysqlDialect) UpsertIgnore(table, columns, values string) string {
+	return fmt.Sprintf("INSERT IGNORE INTO %s (%s) VALUES %s", table, columns, values)
+}
+func (mysqlDialect) Placeholder(n int) string { return "?" }
+
+type postgresDialect struct{}
+
+func (postgresDialect) Name() string          { return "postgres" }
+func (postgresDialect) AutoIncrement() string { return "SERIAL PRIMARY KEY" }
+func (postgresDialect) JSONType() string      { return "JSONB" }
+func (postgresDialect) Now() string           { return "NOW()" }
+func (postgresDialect) OnUpdateTimestamp() string {
+	// Postgres has no ON UPDATE clause, so the column is only set on insert;
+	// no trigger is installed to refresh it on update.
+	return "TIMESTAMP DEFAULT CURRENT_TIMESTAMP"
+}
+func (postgresDialect) UpsertIgnore(table, columns, values string) string {
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES %s ON CONFLICT DO NOTHING", table, columns, values)
+}
+func (postgresDialect) Placeholder(n int) string { return fmt.Sprintf("$%d", n) }
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Name() string          { return "sqlite3" }
+func (sqliteDialect) AutoIncrement() string { return "INTEGER PRIMARY KEY AUTOINCREMENT" }
+func (sqliteDialect) JSONType() string      { return "TEXT" }
+func (sqliteDialect) Now() string           { return "CURRENT_TIMESTAMP" }
+func (sqliteDialect) OnUpdateTimestamp() string {
+	// SQLite also has no ON UPDATE clause; as with Postgres, the column is
+	// only set on insert.
+	return "TIMESTAMP DEFAULT CURRENT_TIMESTAMP"
+}
+func (sqliteDialect) UpsertIgnore(table, columns, values string) string {
+	return fmt.Sprintf("INSERT OR IGNORE INTO %s (%s) VALUES %s", table, columns, values)
+}
+func (sqliteDialect) Placeholder(n int) string { return "?" }
+
+// dialectForDriver resolves a Dialect from a DSN prefix (mysql://, postgres://,
+// sqlite://), defaulting to MySQL for bare DSNs to preserve existing behavior.
+func dialectForDriver(dsn string) Dialect {
+	switch {
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		return postgresDialect{}
+	case strings.HasPrefix(dsn, "sqlite://"), strings.HasSuffix(dsn, ".db"):
+		return sqliteDialect{}
+	default:
+		return mysqlDialect{}
+	}
+}
+
+// openWithDialect opens a *sql.DB for the driver implied by dsn and returns
+// the matching Dialect, so NewSecureTransactionHandler can accept any driver
+// instead of being hard-wired to the "mysql" driver name.
+func openWithDialect(dsn string) (*sql.DB, Dialect, error) {
+	dialect := dialectForDriver(dsn)
+
+	driverDSN := dsn
+	for _, prefix := range []string{"mysql://", "postgres://", "postgresql://", "sqlite://"} {
+		driverDSN = strings.TrimPrefix(driverDSN, prefix)
+	}
+
+	db, err := sql.Open(dialect.Name(), driverDSN)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open %s connection: %v", dialect.Name(), err)
+	}
+
+	return db, dialect, nil
+}
@@ -0,0 +1,336 @@
+// Device fingerprinting pipeline for DeviceFingerprint. getUserDevices used
+// to read back whatever raw device_info blob a caller happened to send;
+// this file gives ingestion a stable fingerprint derived from a fixed set
+// of client signals, stored as its own component vector rather than an
+// opaque blob, plus the per-device risk scoring (impossible travel, new
+// ASN, similar-device matching) that comparing those components against
+// DeviceFingerprint's historical rows makes possible.
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// deviceSimilarComponentThreshold is the maximum number of differing
+// components two fingerprints can still be considered the "same" device
+// for -- a browser or OS point release typically changes the User-Agent and
+// maybe Sec-CH-UA without touching canvas/WebGL/JA3, so allowing a couple
+// of components to drift avoids forcing a re-auth on every update.
+const deviceSimilarComponentThreshold = 2
+
+// impossibleTravelSpeedKMH is the haversineKM-derived speed above which two
+// logins from the same user, on different devices, can't both be genuine.
+// Matches the threshold fraud_rules rows typically configure for
+// GeoVelocityRule (see security_rule_engine.go), which this check
+// deliberately doesn't share: that rule compares consecutive logins
+// per-user; this one compares per-device, against rows getUserDevices
+// already returns.
+const impossibleTravelSpeedKMH = 900.0
+
+// DeviceComponents is the fixed set of client signals computeDeviceHash
+// combines into a stable fingerprint. CanvasHash/WebGLHash are computed by
+// the frontend (a backend can't render a canvas) and reported alongside
+// the request; JA3Hash is this server's best-effort stand-in for a JA3
+// fingerprint, hashed from the negotiated TLS state rather than the raw
+// ClientHello (see ja3FromConnectionState).
+type DeviceComponents struct {
+	UserAgent      string `json:"user_agent"`
+	AcceptLanguage string `json:"accept_language"`
+	ClientHints    string `json:"client_hints"` // Sec-CH-UA, verbatim
+	CanvasHash     string `json:"canvas_hash"`
+	WebGLHash      string `json:"webgl_hash"`
+	JA3Hash        string `json:"ja3_hash"`
+}
+
+// deviceComponentsFromRequest reads the component vector off the request:
+// standard headers for User-Agent/Accept-Language/Sec-CH-UA, the
+// frontend-reported canvas/WebGL hashes off the headers the dashboard's
+// login JS sets (the same way X-Device-ID already rides alongside the
+// request rather than in the JSON body), and a best-effort JA3 off the TLS
+// connection state.
+func deviceComponentsFromRequest(c *gin.Context) DeviceComponents {
+	return DeviceComponents{
+		UserAgent:      c.GetHeader("User-Agent"),
+		AcceptLanguage: c.GetHeader("Accept-Language"),
+		ClientHints:    c.GetHeader("Sec-CH-UA"),
+		CanvasHash:     c.GetHeader("X-Canvas-Hash"),
+		WebGLHash:      c.GetHeader("X-WebGL-Hash"),
+		JA3Hash:        ja3FromConnectionState(c.Request.TLS),
+	}
+}
+
+// ja3FromConnectionState approximates a JA3-style TLS fingerprint from the
+// negotiated connection state. This is a placeholder: real JA3 hashes the
+// raw ClientHello (version, cipher list, extensions, elliptic curves, point
+// formats in offered order), which Go's crypto/tls discards once the
+// handshake completes and doesn't expose without a custom
+// GetConfigForClient hook capturing tls.ClientHelloInfo -- not present in
+// this codebase. Hashing the negotiated version/cipher/ALPN instead still
+// gives a coarse, stable-per-client-stack value until a real hook is added,
+// the same way getLocationFromIP stands in for a real geolocation service.
+func ja3FromConnectionState(state *tls.ConnectionState) string {
+	if state == nil {
+		return ""
+	}
+	raw := fmt.Sprintf("%d-%d-%s", state.Version, state.CipherSuite, state.NegotiatedProtocol)
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])[:32]
+}
+
+// computeDeviceHash combines every component into the stable hash
+// DeviceFingerprint.Fingerprint stores, so two requests with an identical
+// component vector always produce the same fingerprint regardless of field
+// order.
+func computeDeviceHash(d DeviceComponents) string {
+	joined := strings.Join([]string{
+		d.UserAgent, d.AcceptLanguage, d.ClientHints, d.CanvasHash, d.WebGLHash, d.JA3Hash,
+	}, "|")
+	sum := sha256.Sum256([]byte(joined))
+	return hex.EncodeToString(sum[:])
+}
+
+// componentDiffCount returns how many of the six components differ between
+// a and b, used to decide whether two fingerprints are close enough to call
+// the same device.
+func componentDiffCount(a, b DeviceComponents) int {
+	diff := 0
+	for _, pair := range [][2]string{
+		{a.UserAgent, b.UserAgent},
+		{a.AcceptLanguage, b.AcceptLanguage},
+		{a.ClientHints, b.ClientHints},
+		{a.CanvasHash, b.CanvasHash},
+		{a.WebGLHash, b.WebGLHash},
+		{a.JA3Hash, b.JA3Hash},
+	} {
+		if pair[0] != pair[1] {
+			diff++
+		}
+	}
+	return diff
+}
+
+// asnFromIP resolves the autonomous system an IP belongs to. This codebase
+// has no IP->ASN resolver (see block_store.go's own note on the same gap),
+// so new-ASN detection below is inert -- it never fires -- until this is
+// replaced with a real lookup (e.g. MaxMind GeoLite2 ASN).
+func asnFromIP(ip string) string {
+	return ""
+}
+
+// DeviceRiskAssessment is what ingestDeviceFingerprint found comparing an
+// incoming login's device/location against a user's historical
+// DeviceFingerprint rows.
+type DeviceRiskAssessment struct {
+	NewDevice        bool    `json:"new_device"`
+	SimilarDeviceID  string  `json:"similar_device_id,omitempty"` // set when NewDevice but componentDiffCount was within threshold
+	ImpossibleTravel bool    `json:"impossible_travel"`
+	TravelSpeedKMH   float64 `json:"travel_speed_kmh,omitempty"`
+	NewASN           bool    `json:"new_asn"`
+	ASN              string  `json:"asn,omitempty"`
+	RiskDelta        int     `json:"risk_delta"`
+}
+
+// ingestDeviceFingerprint upserts the device_fingerprints row for
+// (userID, deviceID), deriving its fingerprint from components rather than
+// trusting a caller-supplied blob, and scores the login against the user's
+// historical devices (as returned by getUserDevices): impossible travel
+// (haversine distance / elapsed time vs. the most recently seen device),
+// a never-before-seen ASN, and whether an apparently new device is actually
+// a near match for one already on file.
+func (sm *SecurityMonitor) ingestDeviceFingerprint(userID int, deviceID string, components DeviceComponents, ip, location string, latitude, longitude float64) (*DeviceFingerprint, DeviceRiskAssessment, error) {
+	history := sm.getUserDevices(userID)
+	fingerprint := computeDeviceHash(components)
+	asn := asnFromIP(ip)
+
+	assessment := DeviceRiskAssessment{NewASN: asn != "", ASN: asn}
+
+	var existing *DeviceFingerprint
+	var mostRecent *DeviceFingerprint
+	for i := range history {
+		d := &history[i]
+		if d.DeviceID == deviceID {
+			existing = d
+		}
+		if mostRecent == nil || d.LastSeen.After(mostRecent.LastSeen) {
+			mostRecent = d
+		}
+		if d.ASN != "" && d.ASN == asn {
+			assessment.NewASN = false
+		}
+	}
+	if asn == "" {
+		assessment.NewASN = false
+	}
+
+	assessment.NewDevice = existing == nil
+	if existing == nil {
+		for i := range history {
+			d := &history[i]
+			if componentDiffCount(components, d.components()) <= deviceSimilarComponentThreshold {
+				assessment.SimilarDeviceID = d.DeviceID
+				break
+			}
+		}
+	}
+
+	if mostRecent != nil && mostRecent.DeviceID != deviceID && mostRecent.Latitude != 0 && mostRecent.Longitude != 0 {
+		elapsedHours := time.Since(mostRecent.LastSeen).Hours()
+		if elapsedHours > 0 {
+			kmh := haversineKM(mostRecent.Latitude, mostRecent.Longitude, latitude, longitude) / elapsedHours
+			if kmh > impossibleTravelSpeedKMH {
+				assessment.ImpossibleTravel = true
+				assessment.TravelSpeedKMH = kmh
+			}
+		}
+	}
+
+	if assessment.NewDevice && assessment.SimilarDeviceID == "" {
+		assessment.RiskDelta += 30
+	}
+	if assessment.ImpossibleTravel {
+		assessment.RiskDelta += 20
+	}
+	if assessment.NewASN {
+		assessment.RiskDelta += 15
+	}
+
+	deviceInfoJSON, _ := json.Marshal(components)
+	encryptedDeviceInfo := encryptColumnValue(sm.keystore, string(deviceInfoJSON))
+	_, err := sm.db.Exec(`
+		INSERT INTO device_fingerprints
+			(user_id, device_id, fingerprint, device_info, user_agent, accept_language,
+			 client_hints, canvas_hash, webgl_hash, ja3_hash, asn, ip_address, location,
+			 latitude, longitude, trust_score)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			fingerprint = VALUES(fingerprint),
+			device_info = VALUES(device_info),
+			user_agent = VALUES(user_agent),
+			accept_language = VALUES(accept_language),
+			client_hints = VALUES(client_hints),
+			canvas_hash = VALUES(canvas_hash),
+			webgl_hash = VALUES(webgl_hash),
+			ja3_hash = VALUES(ja3_hash),
+			asn = VALUES(asn),
+			ip_address = VALUES(ip_address),
+			location = VALUES(location),
+			latitude = VALUES(latitude),
+			longitude = VALUES(longitude),
+			last_seen = NOW()
+	`, userID, deviceID, fingerprint, encryptedDeviceInfo, components.UserAgent, components.AcceptLanguage,
+		components.ClientHints, components.CanvasHash, components.WebGLHash, components.JA3Hash, nullableString(asn),
+		ip, location, latitude, longitude, -deviceRiskToTrustScore(assessment.RiskDelta))
+	if err != nil {
+		return nil, assessment, fmt.Errorf("failed to upsert device fingerprint: %v", err)
+	}
+
+	if err := sm.repo.SaveDeviceRisk(userID, assessment.RiskDelta); err != nil {
+		log.Printf("⚠️  Failed to update device_risk for user %d: %v", userID, err)
+	}
+
+	device := &DeviceFingerprint{
+		UserID: userID, DeviceID: deviceID, Fingerprint: fingerprint, DeviceInfo: string(deviceInfoJSON),
+		IPAddress: ip, Location: location, LastSeen: time.Now(),
+	}
+	return device, assessment, nil
+}
+
+// deviceRiskToTrustScore returns riskDelta unchanged; ingestDeviceFingerprint
+// negates the result when writing it to the negative-is-riskier trust_score
+// column device_fingerprints already had before this chunk.
+func deviceRiskToTrustScore(riskDelta int) int {
+	return riskDelta
+}
+
+// initializeDeviceComponentColumns extends device_fingerprints with the
+// component-vector columns for deployments whose table predates this
+// pipeline; a fresh CREATE TABLE already includes them via
+// initializeSecurityTables.
+func initializeDeviceComponentColumns(db *sql.DB) error {
+	_, err := db.Exec(`ALTER TABLE device_fingerprints
+		ADD COLUMN IF NOT EXISTS user_agent TEXT,
+		ADD COLUMN IF NOT EXISTS accept_language VARCHAR(255),
+		ADD COLUMN IF NOT EXISTS client_hints VARCHAR(500),
+		ADD COLUMN IF NOT EXISTS canvas_hash VARCHAR(64),
+		ADD COLUMN IF NOT EXISTS webgl_hash VARCHAR(64),
+		ADD COLUMN IF NOT EXISTS ja3_hash VARCHAR(64),
+		ADD COLUMN IF NOT EXISTS asn VARCHAR(20),
+		ADD COLUMN IF NOT EXISTS latitude DOUBLE DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS longitude DOUBLE DEFAULT 0`)
+	if err != nil {
+		return fmt.Errorf("failed to add device component columns: %v", err)
+	}
+	return nil
+}
+
+// initializeDeviceInfoColumnType widens device_info from JSON to TEXT for
+// deployments whose table predates envelope encryption (see
+// encryptColumnValue/ingestDeviceFingerprint): a sensitiveEnvelope is an
+// opaque base64 string, not a JSON value, so MySQL's JSON column type would
+// reject every encrypted write. A fresh CREATE TABLE already uses TEXT via
+// initializeSecurityTables.
+func initializeDeviceInfoColumnType(db *sql.DB) error {
+	_, err := db.Exec(`ALTER TABLE device_fingerprints MODIFY COLUMN device_info TEXT`)
+	if err != nil {
+		return fmt.Errorf("failed to widen device_info column: %v", err)
+	}
+	return nil
+}
+
+// trustDeviceEndpoint marks a user's device as trusted, bypassing the
+// X-Device-ID check enhancedAuthMiddleware runs for sensitive operations.
+func (sm *SecurityMonitor) trustDeviceEndpoint(c *gin.Context) {
+	sm.setDeviceTrust(c, true)
+}
+
+// untrustDeviceEndpoint revokes a previously trusted device, e.g. after a
+// user reports it lost or stolen.
+func (sm *SecurityMonitor) untrustDeviceEndpoint(c *gin.Context) {
+	sm.setDeviceTrust(c, false)
+}
+
+func (sm *SecurityMonitor) setDeviceTrust(c *gin.Context, trusted bool) {
+	userID, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user ID"})
+		return
+	}
+	deviceID := c.Param("device_id")
+
+	var before map[string]interface{}
+	var wasTrusted sql.NullBool
+	sm.db.QueryRow("SELECT is_trusted FROM device_fingerprints WHERE user_id = ? AND device_id = ?", userID, deviceID).Scan(&wasTrusted)
+	if wasTrusted.Valid {
+		before = map[string]interface{}{"is_trusted": wasTrusted.Bool}
+	}
+
+	res, err := sm.db.Exec("UPDATE device_fingerprints SET is_trusted = ? WHERE user_id = ? AND device_id = ?", trusted, userID, deviceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update device trust"})
+		return
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+
+	action := "untrust_device"
+	if trusted {
+		action = "trust_device"
+	}
+	sm.logAuditEvent(c, action, "device", deviceID, before, map[string]interface{}{"is_trusted": trusted})
+
+	c.JSON(http.StatusOK, gin.H{"message": "device trust updated", "is_trusted": trusted})
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+const envelopeVersion = 1
+
+// sensitiveEnvelope is the versioned, self-describing container
+// EncryptSensitive/DecryptSensitive serialize to. KeyID records which RSA
+// key wrapped WrappedKey so DecryptSensitive can still open envelopes
+// written under a retired key after a rotation.
+type sensitiveEnvelope struct {
+	V          int    `json:"v"`
+	KeyID      string `json:"kid"`
+	WrappedKey string `json:"wrapped_key"` // RSA-OAEP(SHA-256)-wrapped AES-256 key, base64
+	Nonce      string `json:"nonce"`       // AES-GCM nonce, base64
+	Ciphertext string `json:"ciphertext"`  // AES-GCM ciphertext+tag, base64
+}
+
+// EncryptSensitive encrypts data of any size for at-rest storage: a fresh
+// random AES-256 key encrypts data under AES-GCM, and that AES key is
+// wrapped with RSA-OAEP(SHA-256) under the service's public key. This
+// replaces raw RSA-PKCS1v15 (the deprecated encryptWithRSA), which both
+// risks a Bleichenbacher-style padding oracle and caps out at key_size-11
+// bytes of plaintext.
+func (ess *EnhancedSecurityService) EncryptSensitive(data []byte) (string, error) {
+	return encryptSensitive(ess.keystore, data)
+}
+
+// encryptSensitive is EncryptSensitive's keystore-parametrized core, broken
+// out so callers that hold a *KeyStore but not a whole EnhancedSecurityService
+// -- SecurityMonitor's security-event/device-fingerprint encryption, see
+// secure_system.go and device_fingerprint.go -- can seal envelopes the same
+// way without needing one.
+func encryptSensitive(ks *KeyStore, data []byte) (string, error) {
+	if ks == nil {
+		return "", fmt.Errorf("encryption keystore unavailable")
+	}
+	keyID, _, publicKey, err := ks.ActiveKey()
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve active key: %v", err)
+	}
+
+	aesKey := make([]byte, 32)
+	if _, err := rand.Read(aesKey); err != nil {
+		return "", fmt.Errorf("failed to generate AES key: %v", err)
+	}
+
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	ciphertext := gcm.Seal(nil, nonce, data, nil)
+
+	wrappedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, aesKey, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to wrap AES key: %v", err)
+	}
+
+	envelope := sensitiveEnvelope{
+		V:          envelopeVersion,
+		KeyID:      keyID,
+		WrappedKey: base64.StdEncoding.EncodeToString(wrappedKey),
+		Nonce:      base64.StdEncoding.EncodeToString(nonce),
+		Ciphertext: base64.StdEncoding.EncodeToString(ciphertext),
+	}
+	serialized, err := json.Marshal(envelope)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(serialized), nil
+}
+
+// DecryptSensitive reverses EncryptSensitive: unwrap the AES key with
+// whichever RSA private key matches the envelope's key ID, then open the
+// AES-GCM ciphertext.
+func (ess *EnhancedSecurityService) DecryptSensitive(encoded string) ([]byte, error) {
+	return decryptSensitive(ess.keystore, encoded)
+}
+
+// decryptSensitive is DecryptSensitive's keystore-parametrized core; see
+// encryptSensitive's doc comment for why this is broken out. Resolving the
+// envelope's key by ID rather than assuming the active one is what makes
+// rotation zero-downtime: an envelope sealed under a just-retired key still
+// opens here, since KeyByID resolves active/retiring/retired alike.
+func decryptSensitive(ks *KeyStore, encoded string) ([]byte, error) {
+	if ks == nil {
+		return nil, fmt.Errorf("encryption keystore unavailable")
+	}
+
+	serialized, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid envelope encoding: %v", err)
+	}
+
+	var envelope sensitiveEnvelope
+	if err := json.Unmarshal(serialized, &envelope); err != nil {
+		return nil, fmt.Errorf("invalid envelope format: %v", err)
+	}
+	if envelope.V != envelopeVersion {
+		return nil, fmt.Errorf("unsupported envelope version %d", envelope.V)
+	}
+
+	privateKey, _, err := ks.KeyByID(envelope.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	wrappedKey, err := base64.StdEncoding.DecodeString(envelope.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wrapped key encoding: %v", err)
+	}
+	aesKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, wrappedKey, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap AES key: %v", err)
+	}
+
+	nonce, err := base64.StdEncoding.DecodeString(envelope.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("invalid nonce encoding: %v", err)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(envelope.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ciphertext encoding: %v", err)
+	}
+
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %v", err)
+	}
+	return plaintext, nil
+}
+
+// encryptWithRSA is a deprecated small-message wrapper around
+// EncryptSensitive, kept so existing callers storing short secrets (e.g.
+// the TOTP seed) don't need to change their call sites.
+//
+// Deprecated: use EncryptSensitive for new code.
+func (ess *EnhancedSecurityService) encryptWithRSA(data string) (string, error) {
+	return ess.EncryptSensitive([]byte(data))
+}
+
+// decryptWithRSA is a deprecated small-message wrapper around
+// DecryptSensitive.
+//
+// Deprecated: use DecryptSensitive for new code.
+func (ess *EnhancedSecurityService) decryptWithRSA(encryptedData string) (string, error) {
+	plaintext, err := ess.DecryptSensitive(encryptedData)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// newEncryptionKeyID generates the random identifier a freshly-created RSA
+// key pair is tagged with in envelopes, so a later rotation can tell which
+// key to use without guessing from key material.
+func newEncryptionKeyID() string {
+	raw := make([]byte, 8)
+	rand.Read(raw)
+	return "k-" + base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// GetPublicKeyJWK returns the service's RSA public key as a JSON Web Key so
+// browser clients using WebCrypto's importKey("jwk", ...) can consume it
+// directly, alongside the PEM form getPublicKeyPEM already serves.
+func (ess *EnhancedSecurityService) GetPublicKeyJWK() map[string]interface{} {
+	if ess.keystore == nil {
+		return map[string]interface{}{}
+	}
+	keyID, _, publicKey, err := ess.keystore.ActiveKey()
+	if err != nil {
+		return map[string]interface{}{}
+	}
+	return map[string]interface{}{
+		"kty": "RSA",
+		"n":   base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(minimalBigEndian(publicKey.E)),
+		"alg": "RSA-OAEP-256",
+		"use": "enc",
+		"kid": keyID,
+	}
+}
+
+// encryptColumnValue seals plaintext for a column that must keep working
+// even when encryption isn't configured or briefly fails: it logs and falls
+// back to storing the value unencrypted rather than dropping the write, the
+// same posture breachCheck/cti take when an optional dependency is down.
+// Pairs with decryptColumnValue on the read side.
+func encryptColumnValue(ks *KeyStore, plaintext string) string {
+	ciphertext, err := encryptSensitive(ks, []byte(plaintext))
+	if err != nil {
+		log.Printf("⚠️  column encryption unavailable, storing value unencrypted: %v", err)
+		return plaintext
+	}
+	return ciphertext
+}
+
+// decryptColumnValue reverses encryptColumnValue. A value that doesn't parse
+// as a sensitiveEnvelope is passed through unchanged rather than treated as
+// an error: it's either a row written before encryption was introduced for
+// this column, or one written while the keystore was unavailable, and in
+// both cases the stored value already is the plaintext.
+func decryptColumnValue(ks *KeyStore, stored string) string {
+	plaintext, err := decryptSensitive(ks, stored)
+	if err != nil {
+		return stored
+	}
+	return string(plaintext)
+}
+
+// envelopeKeyID extracts just the "kid" field from an EncryptSensitive
+// envelope without unwrapping it, so re-encryption scans can tell which
+// rows were sealed under a retiring key without needing that key's private
+// half.
+func envelopeKeyID(encoded string) (string, error) {
+	serialized, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("invalid envelope encoding: %v", err)
+	}
+	var envelope sensitiveEnvelope
+	if err := json.Unmarshal(serialized, &envelope); err != nil {
+		return "", fmt.Errorf("invalid envelope format: %v", err)
+	}
+	return envelope.KeyID, nil
+}
+
+// minimalBigEndian returns n as a big-endian byte slice with no leading
+// zero bytes, the form JWK's "e"/"n" fields expect.
+func minimalBigEndian(n int) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, uint32(n))
+	i := 0
+	for i < len(buf)-1 && buf[i] == 0 {
+		i++
+	}
+	return buf[i:]
+}
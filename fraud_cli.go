@@ -0,0 +1,86 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// runFraudCLI implements a small cscli-style CLI for dry-running a single
+// fraud_rules row against a hand-crafted TxContext, so an operator can sanity
+// check a rule_config edit before flipping is_active rather than waiting for
+// a live transaction to hit it. Invoked as
+// `./krili fraud test --rule-id N --context ctx.json`; args is os.Args[2:].
+func runFraudCLI(args []string) int {
+	if len(args) < 1 || args[0] != "test" {
+		fmt.Fprintln(os.Stderr, "usage: fraud test --rule-id N --context ctx.json")
+		return 1
+	}
+	return fraudCLITest(args[1:])
+}
+
+func fraudCLITest(args []string) int {
+	fs := flag.NewFlagSet("fraud test", flag.ContinueOnError)
+	ruleID := fs.Int("rule-id", 0, "id of the fraud_rules row to evaluate (required)")
+	contextPath := fs.String("context", "", "path to a JSON file holding a TxContext (required)")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if *ruleID == 0 || *contextPath == "" {
+		fmt.Fprintln(os.Stderr, "fraud test: --rule-id and --context are required")
+		return 1
+	}
+
+	contextJSON, err := os.ReadFile(*contextPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read context file: %v\n", err)
+		return 1
+	}
+	var txCtx TxContext
+	if err := json.Unmarshal(contextJSON, &txCtx); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to parse context file: %v\n", err)
+		return 1
+	}
+
+	config := loadConfigWithSecrets()
+	db, err := connectDBSecure(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to connect to database: %v\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	rule, err := loadFraudRuleByID(db, *ruleID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load fraud rule %d: %v\n", *ruleID, err)
+		return 1
+	}
+
+	var node predicateNode
+	if rule.RuleConfig.Valid && rule.RuleConfig.String != "" {
+		if err := json.Unmarshal([]byte(rule.RuleConfig.String), &node); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to parse rule_config: %v\n", err)
+			return 1
+		}
+	}
+
+	matched := node.evaluate(txCtx)
+	fmt.Printf("rule=%d name=%q action=%s severity=%s matched=%t\n",
+		rule.ID, rule.RuleName, rule.Action, rule.Severity, matched)
+	return 0
+}
+
+// loadFraudRuleByID reads a single fraud_rules row regardless of is_active,
+// unlike LoadFraudRules (which the live engine uses and filters to active
+// rules only), so an operator can dry-run a rule before activating it.
+func loadFraudRuleByID(db *sql.DB, ruleID int) (FraudRule, error) {
+	var rule FraudRule
+	err := db.QueryRow(`
+		SELECT id, rule_name, rule_type, threshold, time_window, action, severity, is_active, description, rule_config
+		FROM fraud_rules WHERE id = ?
+	`, ruleID).Scan(&rule.ID, &rule.RuleName, &rule.RuleType, &rule.Threshold, &rule.TimeWindow,
+		&rule.Action, &rule.Severity, &rule.IsActive, &rule.Description, &rule.RuleConfig)
+	return rule, err
+}
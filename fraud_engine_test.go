@@ -0,0 +1,127 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+)
+
+// seedFraudRule inserts a minimal fraud_rules row. The production table (see
+// secure_system.go) declares rule_name/action/severity as MySQL ENUMs, which
+// SQLite has no equivalent for, so this uses a plain TEXT schema that only
+// carries the columns reload() actually selects.
+func seedFraudRule(t *testing.T, db *sql.DB, name, action, severity, ruleConfig string) {
+	t.Helper()
+	if _, err := db.Exec(`INSERT INTO fraud_rules (rule_name, action, severity, is_active, rule_config) VALUES (?, ?, ?, true, ?)`,
+		name, action, severity, ruleConfig); err != nil {
+		t.Fatalf("failed to seed fraud rule %q: %v", name, err)
+	}
+}
+
+func TestFraudRuleEngineEvaluate(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	if _, err := db.Exec(`
+		CREATE TABLE fraud_rules (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			rule_name TEXT,
+			action TEXT,
+			severity TEXT,
+			is_active BOOLEAN DEFAULT TRUE,
+			rule_config TEXT
+		)
+	`); err != nil {
+		t.Fatalf("failed to create fraud_rules table: %v", err)
+	}
+
+	// "new device" is ranked above "velocity spike" (critical > high), so
+	// reload's severity sort evaluates it first; it fires but doesn't block,
+	// so Evaluate keeps going and also picks up "velocity spike", whose
+	// action ("block") outranks "review" and ends the loop.
+	seedFraudRule(t, db, "new device high amount", "review", "critical",
+		`{"all": [{"predicate": "user_new_device"}, {"predicate": "amount_over", "params": {"threshold": 500}}]}`)
+	seedFraudRule(t, db, "velocity spike", "block", "high",
+		`{"predicate": "velocity_1h_amount", "params": {"threshold": 2000}}`)
+
+	engine := NewFraudRuleEngine(db)
+
+	result := engine.Evaluate(TxContext{
+		UserID:           1,
+		Amount:           750,
+		IsNewDevice:      true,
+		Velocity1hAmount: 2500,
+	})
+
+	if result.Action != "block" {
+		t.Fatalf("expected action %q (block outranks review regardless of severity), got %q", "block", result.Action)
+	}
+	if result.Severity != "high" {
+		t.Fatalf("expected severity %q (the severity of the rule that set the winning action), got %q", "high", result.Severity)
+	}
+	if len(result.TriggeredRules) != 2 {
+		t.Fatalf("expected both rules to have fired before the block rule stopped evaluation, got %v", result.TriggeredRules)
+	}
+}
+
+func TestFraudRuleEngineEvaluateNoMatch(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	if _, err := db.Exec(`
+		CREATE TABLE fraud_rules (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			rule_name TEXT,
+			action TEXT,
+			severity TEXT,
+			is_active BOOLEAN DEFAULT TRUE,
+			rule_config TEXT
+		)
+	`); err != nil {
+		t.Fatalf("failed to create fraud_rules table: %v", err)
+	}
+
+	seedFraudRule(t, db, "velocity spike", "block", "critical",
+		`{"predicate": "velocity_1h_amount", "params": {"threshold": 2000}}`)
+
+	engine := NewFraudRuleEngine(db)
+
+	result := engine.Evaluate(TxContext{UserID: 1, Amount: 10, Velocity1hAmount: 100})
+
+	if result.Action != "allow" {
+		t.Fatalf("expected default action %q when nothing matches, got %q", "allow", result.Action)
+	}
+	if len(result.TriggeredRules) != 0 {
+		t.Fatalf("expected no triggered rules, got %v", result.TriggeredRules)
+	}
+}
+
+func TestFraudRuleEngineBlockShortCircuits(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	if _, err := db.Exec(`
+		CREATE TABLE fraud_rules (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			rule_name TEXT,
+			action TEXT,
+			severity TEXT,
+			is_active BOOLEAN DEFAULT TRUE,
+			rule_config TEXT
+		)
+	`); err != nil {
+		t.Fatalf("failed to create fraud_rules table: %v", err)
+	}
+
+	// Both rules match; "block" is critical-severity and sorts first, so
+	// Evaluate should stop right after it instead of also recording the
+	// lower-severity rule that would otherwise also have fired.
+	seedFraudRule(t, db, "hard block", "block", "critical",
+		`{"predicate": "amount_over", "params": {"threshold": 100}}`)
+	seedFraudRule(t, db, "unusual hour flag", "flag", "low",
+		`{"predicate": "amount_over", "params": {"threshold": 100}}`)
+
+	engine := NewFraudRuleEngine(db)
+
+	result := engine.Evaluate(TxContext{UserID: 1, Amount: 1000})
+
+	if result.Action != "block" {
+		t.Fatalf("expected action %q, got %q", "block", result.Action)
+	}
+	if len(result.TriggeredRules) != 1 || result.TriggeredRules[0] != "hard block" {
+		t.Fatalf("expected Evaluate to stop at the first block rule, got %v", result.TriggeredRules)
+	}
+}
@@ -0,0 +1,204 @@
+// IP geolocation enrichment. getLocationFromIP/geoCoordinatesFromIP used to
+// be hardcoded placeholders ("US", 0,0); GeoEnricher wraps a GeoProvider
+// with the same LRU+TTL cache shape CTIEnricher uses in cti.go (geo data
+// drifts even more slowly than reputation, so the cache here runs longer),
+// and persists results to geolocation_data with an expiry so a restart
+// doesn't re-query every IP on its first request. SecurityMonitor's
+// isHighRiskIP/calculateRiskScore reuse the existing CTIEnricher for
+// reputation; this file only adds the geo half.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// GeoResult is one provider's answer for a single IP.
+type GeoResult struct {
+	IPAddress   string  `json:"ip_address"`
+	CountryCode string  `json:"country_code"`
+	City        string  `json:"city,omitempty"`
+	Latitude    float64 `json:"latitude"`
+	Longitude   float64 `json:"longitude"`
+	Source      string  `json:"source"`
+}
+
+// GeoProvider resolves an IP to a geographic location.
+type GeoProvider interface {
+	Name() string
+	LookupGeo(ip string) (*GeoResult, error)
+}
+
+// defaultGeoCacheTTL is longer than defaultCTICacheTTL (6h): an IP's
+// reputation can flip in hours, but which country/ASN it's allocated to
+// practically never changes within a deployment's lifetime.
+const defaultGeoCacheTTL = 24 * time.Hour
+const defaultGeoCacheMaxEntriesPerShard = 256
+
+// GeoEnricher is the pluggable geolocation subsystem wired into
+// EnhancedSecurityService. Mirrors CTIEnricher's cache/singleflight shape.
+type GeoEnricher struct {
+	provider GeoProvider
+	cache    *shardedTTLCache
+	ttl      time.Duration
+	group    singleflight.Group
+}
+
+func newGeoEnricher(provider GeoProvider, ttl time.Duration, maxEntriesPerShard int) *GeoEnricher {
+	if ttl <= 0 {
+		ttl = defaultGeoCacheTTL
+	}
+	if maxEntriesPerShard <= 0 {
+		maxEntriesPerShard = defaultGeoCacheMaxEntriesPerShard
+	}
+	return &GeoEnricher{
+		provider: provider,
+		cache:    newShardedTTLCache("geo_lookup", maxEntriesPerShard),
+		ttl:      ttl,
+	}
+}
+
+// Lookup returns the cached GeoResult for ip if present and unexpired,
+// otherwise fetches it from the provider. Concurrent lookups for the same
+// ip that miss the cache collapse into a single provider call.
+func (e *GeoEnricher) Lookup(ip string) (*GeoResult, error) {
+	if cached, ok := e.cache.Get(ip); ok {
+		return cached.(*GeoResult), nil
+	}
+
+	result, err, _ := e.group.Do(ip, func() (interface{}, error) {
+		return e.provider.LookupGeo(ip)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	geo := result.(*GeoResult)
+	e.cache.Set(ip, geo, e.ttl)
+	return geo, nil
+}
+
+// newGeoEnricherFromEnv builds a GeoEnricher from GEO_PROVIDER (currently
+// only "maxmind" is shipped), or returns nil if GEO_PROVIDER is unset so
+// callers fall back to the legacy hardcoded location/coordinates.
+func newGeoEnricherFromEnv() *GeoEnricher {
+	providerName := getEnv("GEO_PROVIDER", "")
+	if providerName == "" {
+		return nil
+	}
+
+	var provider GeoProvider
+	switch providerName {
+	case "maxmind":
+		provider = newMaxMindGeoProvider(getEnv("GEOIP_MMDB_PATH", ""))
+	default:
+		return nil
+	}
+
+	ttl := defaultGeoCacheTTL
+	if raw := os.Getenv("GEO_CACHE_TTL_SECONDS"); raw != "" {
+		if seconds, err := strconv.Atoi(raw); err == nil && seconds > 0 {
+			ttl = time.Duration(seconds) * time.Second
+		}
+	}
+
+	return newGeoEnricher(provider, ttl, defaultGeoCacheMaxEntriesPerShard)
+}
+
+// maxMindGeoProvider is meant to read a local MaxMind GeoLite2-City.mmdb
+// file, the same way a production deployment would. Doing that for real
+// means either vendoring the oschwald/maxminddb-golang reader (not
+// available in this build, same constraint as go-redis in
+// state_store.go and mvdan.cc/sh/v3 in pkg/payloadanalyzer/shell.go) or
+// hand-parsing MaxMind's binary search-tree + data-section format from
+// scratch with no .mmdb file on hand to validate a parser against. Left as
+// a clearly-labeled stub rather than a parser nobody could verify works;
+// wiring in the real reader once it's vendored only touches this function.
+type maxMindGeoProvider struct {
+	dbPath string
+}
+
+func newMaxMindGeoProvider(dbPath string) *maxMindGeoProvider {
+	return &maxMindGeoProvider{dbPath: dbPath}
+}
+
+func (m *maxMindGeoProvider) Name() string { return "maxmind" }
+
+func (m *maxMindGeoProvider) LookupGeo(ip string) (*GeoResult, error) {
+	return nil, fmt.Errorf("maxmind GeoLite2 provider not connected: cannot look up %s", ip)
+}
+
+// geolocationCacheTTL is how long a geolocation_data row is trusted before
+// cachedGeolocation treats it as stale and getLocationFromIP/
+// geoCoordinatesFromIP re-query the provider.
+const geolocationCacheTTL = 24 * time.Hour
+
+// cachedGeolocation reads ip's unexpired row from geolocation_data, if any.
+func (ess *EnhancedSecurityService) cachedGeolocation(ip string) (*GeoResult, bool) {
+	var g GeoResult
+	var countryCode, city, source sql.NullString
+	err := ess.db.QueryRow(`
+		SELECT country_code, city, latitude, longitude, source
+		FROM geolocation_data
+		WHERE ip_address = ? AND (expires_at IS NULL OR expires_at > NOW())
+	`, ip).Scan(&countryCode, &city, &g.Latitude, &g.Longitude, &source)
+	if err != nil {
+		return nil, false
+	}
+	g.IPAddress = ip
+	g.CountryCode = countryCode.String
+	g.City = city.String
+	g.Source = source.String
+	return &g, true
+}
+
+// saveGeolocation upserts result into geolocation_data with a
+// geolocationCacheTTL expiry, the same INSERT ... ON DUPLICATE KEY UPDATE
+// idiom ip_reputation's writers use (see blockIPFor in secure_system.go).
+func (ess *EnhancedSecurityService) saveGeolocation(result *GeoResult) {
+	_, err := ess.db.Exec(`
+		INSERT INTO geolocation_data (ip_address, country_code, city, latitude, longitude, source, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, DATE_ADD(NOW(), INTERVAL ? SECOND))
+		ON DUPLICATE KEY UPDATE
+			country_code = VALUES(country_code),
+			city = VALUES(city),
+			latitude = VALUES(latitude),
+			longitude = VALUES(longitude),
+			source = VALUES(source),
+			expires_at = VALUES(expires_at)
+	`, result.IPAddress, nullableString(result.CountryCode), nullableString(result.City),
+		result.Latitude, result.Longitude, result.Source, geolocationCacheTTL.Seconds())
+	if err != nil {
+		log.Printf("⚠️  Failed to cache geolocation for %s: %v", result.IPAddress, err)
+	}
+}
+
+// initializeGeolocationDataTable creates geolocation_data, referenced by
+// several dashboard queries (see getDetailedMetrics/getThreatIntelligence/
+// getGeographicThreats) as a
+// LEFT JOIN target but never previously created by a migration.
+func initializeGeolocationDataTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS geolocation_data (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		ip_address VARCHAR(45) NOT NULL,
+		country_code VARCHAR(2),
+		city VARCHAR(100),
+		latitude DOUBLE DEFAULT 0,
+		longitude DOUBLE DEFAULT 0,
+		source VARCHAR(64) NOT NULL DEFAULT 'local:default',
+		expires_at TIMESTAMP NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE KEY unique_ip (ip_address),
+		INDEX idx_expires_at (expires_at)
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create geolocation_data table: %v", err)
+	}
+	return nil
+}
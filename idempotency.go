@@ -0,0 +1,403 @@
+// Idempotency-Key support (RFC draft semantics) for processPaymentHandler/
+// processPayoutHandler: a client that retries a payment/payout after a
+// timeout or a payment_processing_error gets back the original result
+// instead of a second charge. Paired with a lightweight retry queue so a
+// payment_processing_error from the ProviderRouter can be replayed off the
+// request path instead of leaving the client to retry blind.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// readAndRestoreBody reads c.Request.Body for hashing and puts an
+// equivalent reader back so the handler's later ShouldBindJSON still works.
+func readAndRestoreBody(c *gin.Context) []byte {
+	if c.Request.Body == nil {
+		return nil
+	}
+	body, _ := io.ReadAll(c.Request.Body)
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	return body
+}
+
+// idempotencyKeyTTL is how long a stored (key, response) pair is honored
+// before a retry with the same key is treated as a brand new request.
+const idempotencyKeyTTL = 24 * time.Hour
+
+const (
+	idempotencyStatusProcessing = "processing"
+	idempotencyStatusCompleted  = "completed"
+)
+
+// IdempotencyRecord is a row of idempotency_keys.
+type IdempotencyRecord struct {
+	UserID       int       `json:"user_id" db:"user_id"`
+	Key          string    `json:"key" db:"idempotency_key"`
+	BodyHash     string    `json:"-" db:"body_hash"`
+	Status       string    `json:"status" db:"status"`
+	StatusCode   int       `json:"status_code" db:"status_code"`
+	ResponseJSON []byte    `json:"-" db:"response_json"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+}
+
+// hashRequestBody returns the hex-encoded SHA-256 of body, used to detect a
+// client reusing an Idempotency-Key with a different payload.
+func hashRequestBody(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// requestFingerprint folds (method, path) into the stored body hash, on top
+// of the (user_id, idempotency_key) primary key Reserve already looks up by,
+// so a client that reuses the same Idempotency-Key against a different route
+// -- say /api/v1/payments then /api/v1/payouts -- gets the 422 body-mismatch
+// response instead of replaying a cached result for the wrong endpoint.
+func requestFingerprint(method, path string, body []byte) string {
+	return hashRequestBody(append([]byte(method+" "+path+"\n"), body...))
+}
+
+// IdempotencyStore backs idempotency_keys: it lets a handler reserve a key
+// before doing any provider work, then record the outcome once it's known.
+type IdempotencyStore struct {
+	db *sql.DB
+}
+
+// Reserve looks up (userID, key). If an unexpired record with the same
+// bodyHash already exists -- completed or still processing -- it is returned
+// as-is so the caller can replay it or report it in flight. If none exists
+// (or it has expired), Reserve inserts a placeholder "processing" row under
+// a transaction and returns nil, so a concurrent retry of the same key blocks
+// on the row lock instead of racing the provider call. bodyMismatch is true
+// when an unexpired record, in either state, exists for a different request
+// body than bodyHash.
+func (s *IdempotencyStore) Reserve(userID int, key, bodyHash string) (record *IdempotencyRecord, bodyMismatch bool, err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	var existing IdempotencyRecord
+	var responseJSON []byte
+	err = tx.QueryRow(`
+		SELECT user_id, idempotency_key, body_hash, status, status_code, response_json, created_at
+		FROM idempotency_keys WHERE user_id = ? AND idempotency_key = ? FOR UPDATE
+	`, userID, key).Scan(&existing.UserID, &existing.Key, &existing.BodyHash, &existing.Status,
+		&existing.StatusCode, &responseJSON, &existing.CreatedAt)
+
+	switch {
+	case err == sql.ErrNoRows:
+		if _, err := tx.Exec(`
+			INSERT INTO idempotency_keys (user_id, idempotency_key, body_hash, status, created_at)
+			VALUES (?, ?, ?, ?, NOW())
+		`, userID, key, bodyHash, idempotencyStatusProcessing); err != nil {
+			return nil, false, err
+		}
+		return nil, false, tx.Commit()
+	case err != nil:
+		return nil, false, err
+	case time.Since(existing.CreatedAt) > idempotencyKeyTTL:
+		// Expired: treat this as a fresh key, same as no row at all.
+		if _, err := tx.Exec(`
+			UPDATE idempotency_keys SET body_hash = ?, status = ?, status_code = 0,
+				response_json = NULL, created_at = NOW() WHERE user_id = ? AND idempotency_key = ?
+		`, bodyHash, idempotencyStatusProcessing, userID, key); err != nil {
+			return nil, false, err
+		}
+		return nil, false, tx.Commit()
+	case existing.BodyHash != bodyHash:
+		return nil, true, tx.Commit()
+	default:
+		existing.ResponseJSON = responseJSON
+		return &existing, false, tx.Commit()
+	}
+}
+
+// Complete records the final outcome of a reserved key so later retries
+// replay it instead of hitting the provider again.
+func (s *IdempotencyStore) Complete(userID int, key string, statusCode int, response interface{}) error {
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`
+		UPDATE idempotency_keys SET status = ?, status_code = ?, response_json = ?
+		WHERE user_id = ? AND idempotency_key = ?
+	`, idempotencyStatusCompleted, statusCode, responseJSON, userID, key)
+	return err
+}
+
+// Lookup reads back the record for (userID, key) regardless of TTL, used by
+// getIdempotencyStatusHandler so a client can poll a key it's already seen.
+func (s *IdempotencyStore) Lookup(userID int, key string) (*IdempotencyRecord, error) {
+	var record IdempotencyRecord
+	var responseJSON []byte
+	err := s.db.QueryRow(`
+		SELECT user_id, idempotency_key, body_hash, status, status_code, response_json, created_at
+		FROM idempotency_keys WHERE user_id = ? AND idempotency_key = ?
+	`, userID, key).Scan(&record.UserID, &record.Key, &record.BodyHash, &record.Status,
+		&record.StatusCode, &responseJSON, &record.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	record.ResponseJSON = responseJSON
+	return &record, nil
+}
+
+// idempotencyInFlightRetryAfterSeconds is the retry_after hint given on a
+// 409 for a duplicate request whose original is still being processed.
+const idempotencyInFlightRetryAfterSeconds = 2
+
+// respondFromExistingIdempotencyRecord writes the response for an
+// Idempotency-Key that Reserve found already in use. If the original
+// request hasn't completed yet (no provider call made it back), the retry
+// gets a 409 instead of the zero-value response a not-yet-completed record
+// would otherwise replay; once completed, the stored response is replayed
+// verbatim so the client never double-charges a card or double-debits a
+// payout by retrying.
+func respondFromExistingIdempotencyRecord(c *gin.Context, existing *IdempotencyRecord) {
+	if existing.Status != idempotencyStatusCompleted {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":       "A request with this Idempotency-Key is already being processed",
+			"retry_after": idempotencyInFlightRetryAfterSeconds,
+		})
+		return
+	}
+	c.Data(existing.StatusCode, "application/json", existing.ResponseJSON)
+}
+
+// retryQueueMaxAttempts is how many times the background worker retries a
+// queued payment/payout before it's moved to the dead letter queue.
+const retryQueueMaxAttempts = 6
+
+// RetryQueue replays payment/payout requests that failed with a
+// payment_processing_error, so the caller doesn't have to retry blind
+// against a flaky upstream provider. Safety against double-charging comes
+// entirely from the Idempotency-Key the request was queued under: a replay
+// re-runs it through the same ProviderRouter and records the result against
+// the same idempotency_keys row, it never re-reserves it.
+type RetryQueue struct {
+	db          *sql.DB
+	router      *ProviderRouter
+	idempotency *IdempotencyStore
+	stop        chan struct{}
+}
+
+// NewRetryQueue returns a queue ready to Start.
+func NewRetryQueue(db *sql.DB, router *ProviderRouter, idempotency *IdempotencyStore) *RetryQueue {
+	return &RetryQueue{db: db, router: router, idempotency: idempotency, stop: make(chan struct{})}
+}
+
+// Enqueue schedules a replay of the given request for the first attempt,
+// storing the original payload so the worker can rebuild the request.
+func (q *RetryQueue) Enqueue(userID int, key, kind string, payload []byte) error {
+	_, err := q.db.Exec(`
+		INSERT INTO payment_retry_queue (user_id, idempotency_key, kind, payload, attempt, status, next_attempt_at, created_at)
+		VALUES (?, ?, ?, ?, 0, 'pending', ?, NOW())
+	`, userID, key, kind, payload, time.Now().Add(retryBackoff(0)))
+	return err
+}
+
+// retryBackoff returns the delay before retry attempt N+1: exponential,
+// base 2s, capped at 5 minutes, with up to 30% jitter so a burst of failures
+// doesn't retry the provider in lockstep.
+func retryBackoff(attempt int) time.Duration {
+	base := 2 * time.Second
+	backoff := base << uint(attempt)
+	if backoff > 5*time.Minute || backoff <= 0 {
+		backoff = 5 * time.Minute
+	}
+	jitter := time.Duration(rand.Int63n(int64(backoff) * 3 / 10))
+	return backoff + jitter
+}
+
+// Start launches the background goroutine that polls for due retries every
+// interval. Call Stop to end it.
+func (q *RetryQueue) Start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				q.processDue()
+			case <-q.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (q *RetryQueue) Stop() {
+	close(q.stop)
+}
+
+// processDue replays every pending retry whose next_attempt_at has passed.
+func (q *RetryQueue) processDue() {
+	rows, err := q.db.Query(`
+		SELECT id, user_id, idempotency_key, kind, payload, attempt
+		FROM payment_retry_queue WHERE status = 'pending' AND next_attempt_at <= NOW() LIMIT 20
+	`)
+	if err != nil {
+		log.Printf("⚠️  retry queue: failed to load due retries: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	type dueRetry struct {
+		id      int
+		userID  int
+		key     string
+		kind    string
+		payload []byte
+		attempt int
+	}
+	var due []dueRetry
+	for rows.Next() {
+		var r dueRetry
+		if err := rows.Scan(&r.id, &r.userID, &r.key, &r.kind, &r.payload, &r.attempt); err != nil {
+			continue
+		}
+		due = append(due, r)
+	}
+
+	for _, r := range due {
+		var response interface{}
+		var statusCode int
+		var procErr error
+
+		switch r.kind {
+		case "payment":
+			var req PaymentRequest
+			if procErr = json.Unmarshal(r.payload, &req); procErr == nil {
+				var resp *PaymentResponse
+				resp, procErr = q.router.ProcessPayment(r.userID, &req, r.key)
+				response, statusCode = resp, http.StatusOK
+			}
+		case "payout":
+			var req PayoutRequest
+			if procErr = json.Unmarshal(r.payload, &req); procErr == nil {
+				var resp *PayoutResponse
+				resp, procErr = q.router.ProcessPayout(r.userID, &req, r.key)
+				response, statusCode = resp, http.StatusOK
+			}
+		default:
+			procErr = fmt.Errorf("unknown retry kind %q", r.kind)
+		}
+
+		if procErr == nil {
+			if err := q.idempotency.Complete(r.userID, r.key, statusCode, response); err != nil {
+				log.Printf("⚠️  retry queue: failed to record replay result for key %s: %v", r.key, err)
+			}
+			q.db.Exec("UPDATE payment_retry_queue SET status = 'done' WHERE id = ?", r.id)
+			continue
+		}
+
+		attempt := r.attempt + 1
+		if attempt >= retryQueueMaxAttempts {
+			q.db.Exec(`
+				INSERT INTO payment_retry_dlq (user_id, idempotency_key, kind, payload, attempt, last_error, created_at)
+				VALUES (?, ?, ?, ?, ?, ?, NOW())
+			`, r.userID, r.key, r.kind, r.payload, attempt, procErr.Error())
+			q.db.Exec("UPDATE payment_retry_queue SET status = 'dead', attempt = ?, last_error = ? WHERE id = ?",
+				attempt, procErr.Error(), r.id)
+			log.Printf("⚠️  retry queue: key %s exhausted %d attempts, moved to DLQ: %v", r.key, attempt, procErr)
+			continue
+		}
+
+		q.db.Exec(`
+			UPDATE payment_retry_queue SET attempt = ?, next_attempt_at = ?, last_error = ? WHERE id = ?
+		`, attempt, time.Now().Add(retryBackoff(attempt)), procErr.Error(), r.id)
+	}
+}
+
+// initializeIdempotencyTables creates idempotency_keys, payment_retry_queue
+// and payment_retry_dlq.
+func initializeIdempotencyTables(db *sql.DB) error {
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS idempotency_keys (
+			user_id INT NOT NULL,
+			idempotency_key VARCHAR(255) NOT NULL,
+			body_hash VARCHAR(64) NOT NULL,
+			status ENUM('processing', 'completed') NOT NULL DEFAULT 'processing',
+			status_code INT NOT NULL DEFAULT 0,
+			response_json JSON,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (user_id, idempotency_key),
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			INDEX idx_created_at (created_at)
+		)`,
+		`CREATE TABLE IF NOT EXISTS payment_retry_queue (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			user_id INT NOT NULL,
+			idempotency_key VARCHAR(255) NOT NULL,
+			kind ENUM('payment', 'payout') NOT NULL,
+			payload JSON NOT NULL,
+			attempt INT NOT NULL DEFAULT 0,
+			status ENUM('pending', 'done', 'dead') NOT NULL DEFAULT 'pending',
+			next_attempt_at TIMESTAMP NOT NULL,
+			last_error TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			INDEX idx_status_next_attempt (status, next_attempt_at)
+		)`,
+		`CREATE TABLE IF NOT EXISTS payment_retry_dlq (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			user_id INT NOT NULL,
+			idempotency_key VARCHAR(255) NOT NULL,
+			kind ENUM('payment', 'payout') NOT NULL,
+			payload JSON NOT NULL,
+			attempt INT NOT NULL,
+			last_error TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+	}
+	for _, stmt := range statements {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to create idempotency table: %v", err)
+		}
+	}
+	return nil
+}
+
+// getIdempotencyStatusHandler lets a client check the outcome of a payment
+// or payout it submitted with an Idempotency-Key, without resubmitting it.
+func (sth *SecureTransactionHandler) getIdempotencyStatusHandler(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	key := c.Param("key")
+
+	record, err := sth.idempotency.Lookup(userID, key)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown idempotency key"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up idempotency key"})
+		return
+	}
+
+	if record.Status != idempotencyStatusCompleted {
+		c.JSON(http.StatusOK, gin.H{"status": record.Status})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":      record.Status,
+		"status_code": record.StatusCode,
+		"response":    json.RawMessage(record.ResponseJSON),
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// createInvoiceHandler opens a PaymentInvoice for the caller and stashes
+// its id in the flow session's flash data, so invoiceStatusHandler can be
+// polled without the frontend having to remember and resend the id itself
+// -- mirroring the "generate an invoice, hand the id to the payment page,
+// poll for settlement" flow gin-contrib/sessions flash values are built
+// for.
+func (sth *SecureTransactionHandler) createInvoiceHandler(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	var req PaymentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	idempotencyKey := c.GetHeader("Idempotency-Key")
+
+	invoice, err := sth.providerRouter.CreatePaymentInvoice(userID, &req, idempotencyKey)
+	if err != nil {
+		sth.logSecurityEvent(userID, "invoice_creation_failed", "medium",
+			err.Error(), sth.ess.getRealIP(c), c.GetHeader("User-Agent"))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invoice"})
+		return
+	}
+
+	if record, ok := flowSessionFromContext(c); ok {
+		if err := sth.flashSet(record, flowSessionPendingInvoiceKey, invoice.ID); err != nil {
+			log.Printf("⚠️  failed to stash pending invoice %d in flow session %s: %v", invoice.ID, record.SID, err)
+		}
+	}
+
+	c.JSON(http.StatusCreated, invoice)
+}
+
+// invoiceStatusHandler polls the provider for the invoice's current
+// status via PollPaymentInvoiceStatus. :id is optional: an empty or "0"
+// value falls back to the flow session's flashed pending invoice id, so a
+// client that only ever holds the session cookie (no id of its own) can
+// still poll the invoice it just created.
+func (sth *SecureTransactionHandler) invoiceStatusHandler(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id == 0 {
+		record, ok := flowSessionFromContext(c)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invoice id"})
+			return
+		}
+		// Read without clearing: the stashed id has to survive repeated
+		// polls, and is only cleared below once the invoice is paid.
+		flashed, ok := record.Data[flowSessionPendingInvoiceKey]
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invoice id"})
+			return
+		}
+		switch v := flashed.(type) {
+		case int64:
+			id = v
+		case float64:
+			id = int64(v)
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invoice id"})
+			return
+		}
+	}
+
+	invoice, err := sth.providerRouter.GetPaymentInvoice(id, userID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invoice not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load invoice"})
+		return
+	}
+
+	invoice, err = sth.providerRouter.PollPaymentInvoiceStatus(invoice)
+	if err != nil {
+		log.Printf("⚠️  failed to poll invoice %d: %v", id, err)
+		c.JSON(http.StatusOK, invoice)
+		return
+	}
+
+	if invoice.Status == invoiceStatusPaid {
+		if record, ok := flowSessionFromContext(c); ok {
+			sth.flashPop(record, flowSessionPendingInvoiceKey)
+		}
+	}
+
+	c.JSON(http.StatusOK, invoice)
+}
@@ -0,0 +1,635 @@
+// InvoiceService turns completed payment transactions into month-end
+// invoices, in three re-runnable stages that mirror how TransactionService's
+// own balance/ledger pipeline is staged: PrepareInvoiceRecords selects the
+// period's completed payments into invoice_records (one row per
+// transaction, so a rerun is just an idempotent insert); CreateInvoiceItems
+// turns unconsumed records into priced invoice_items (fees, commission,
+// currency conversion applied); CreateInvoices groups a user's unbilled
+// items into a numbered, rendered invoices row. Every transition writes a
+// transaction_logs row against the originating transaction, the same audit
+// trail ReconciliationChore uses, so a transaction's full history --
+// payment, then billing -- reads from one table.
+//
+// Scope note: this schema has no item/listing/owner concept (transactions
+// only ever reference the paying user_id, confirmed by grepping the rest of
+// the module for item_id/owner_id/rental/listing columns and finding none),
+// so invoices here are grouped per payer (transactions.user_id) -- the
+// closest entity this schema actually has to bill against.
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// invoiceProcessingFeeRate/invoicePlatformCommissionRate are applied to each
+// invoice_record's gross amount when CreateInvoiceItems prices it, read once
+// at startup the same way tanPaymentAmountThreshold is.
+var (
+	invoiceProcessingFeeRate      = invoiceRateFromEnv("INVOICE_PROCESSING_FEE_RATE", 0.029)
+	invoicePlatformCommissionRate = invoiceRateFromEnv("INVOICE_PLATFORM_COMMISSION_RATE", 0.10)
+)
+
+func invoiceRateFromEnv(key string, fallback float64) float64 {
+	rate, err := strconv.ParseFloat(getEnv(key, strconv.FormatFloat(fallback, 'f', -1, 64)), 64)
+	if err != nil {
+		return fallback
+	}
+	return rate
+}
+
+// InvoiceRenderer produces the document attached to a finished invoice.
+// Pluggable so a deployment with a real PDF pipeline can swap in a proper
+// renderer; no PDF library is vendored in this build, so the default
+// (textInvoiceRenderer) renders a plain-text statement instead.
+type InvoiceRenderer interface {
+	Render(invoice *Invoice, items []InvoiceLineItem) ([]byte, error)
+}
+
+// textInvoiceRenderer is InvoiceRenderer's default: a human-readable plain
+// text statement, good enough to email or archive until a real PDF
+// generator is wired in.
+type textInvoiceRenderer struct{}
+
+func (textInvoiceRenderer) Render(invoice *Invoice, items []InvoiceLineItem) ([]byte, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Invoice %s\n", invoice.Number)
+	fmt.Fprintf(&b, "Period: %s\n", invoice.Period)
+	fmt.Fprintf(&b, "Billed to user: %d\n\n", invoice.UserID)
+	fmt.Fprintf(&b, "%-12s %12s %12s %12s %12s\n", "Transaction", "Gross", "Fee", "Commission", "Net")
+	for _, item := range items {
+		fmt.Fprintf(&b, "%-12d %12.2f %12.2f %12.2f %12.2f\n",
+			item.TransactionID, item.GrossAmount, item.FeeAmount, item.CommissionAmount, item.NetAmount)
+	}
+	fmt.Fprintf(&b, "\nTotal (%s): %.2f\n", invoice.Currency, invoice.TotalAmount)
+	return []byte(b.String()), nil
+}
+
+// InvoiceRecord is a row of invoice_records: one completed payment
+// transaction selected into a billing period, waiting to be priced into an
+// InvoiceLineItem.
+type InvoiceRecord struct {
+	ID            int64
+	UserID        int
+	Period        string
+	TransactionID int64
+	Amount        float64
+	Currency      string
+	Status        string
+}
+
+// InvoiceLineItem is a row of invoice_items: a priced InvoiceRecord, waiting
+// to be grouped into an Invoice.
+type InvoiceLineItem struct {
+	ID                int64
+	InvoiceRecordID   int64
+	TransactionID     int64
+	UserID            int
+	Period            string
+	GrossAmount       float64
+	FeeAmount         float64
+	CommissionAmount  float64
+	NetAmount         float64
+	Currency          string
+	InvoiceID         sql.NullInt64
+}
+
+// Invoice is a row of invoices: a user's billed items for one period, with
+// an idempotent INV-YYYYMM-NNNNN number and a rendered document.
+type Invoice struct {
+	ID          int64
+	UserID      int
+	Period      string
+	Number      string
+	TotalAmount float64
+	Currency    string
+	Status      string
+	Document    []byte
+	CreatedAt   time.Time
+}
+
+// InvoiceService runs the three invoice pipeline stages. Each is safe to
+// call repeatedly (including concurrently from the CLI and the HTTP
+// endpoints): PrepareInvoiceRecords and CreateInvoiceItems key their inserts
+// off unique constraints so a rerun just finds nothing left to do, and
+// CreateInvoices pulls its invoice number from a row-locked sequence so two
+// concurrent runs for the same period can never collide.
+type InvoiceService struct {
+	db       *sql.DB
+	renderer InvoiceRenderer
+}
+
+// NewInvoiceService returns a service ready to run all three stages.
+// renderer may be nil, in which case textInvoiceRenderer is used.
+func NewInvoiceService(db *sql.DB, renderer InvoiceRenderer) *InvoiceService {
+	if renderer == nil {
+		renderer = textInvoiceRenderer{}
+	}
+	return &InvoiceService{db: db, renderer: renderer}
+}
+
+// PrepareInvoiceRecords selects every completed payment transaction billed
+// in period (format "YYYY-MM") into invoice_records, one row per
+// transaction. Already-selected transactions are skipped via
+// invoice_records' unique index on transaction_id, so rerunning for a period
+// that's already been prepared (e.g. after a late-settling transaction)
+// only inserts the new rows.
+func (s *InvoiceService) PrepareInvoiceRecords(period string) error {
+	start, end, err := periodBounds(period)
+	if err != nil {
+		return err
+	}
+
+	rows, err := s.db.Query(`
+		SELECT id, user_id, amount, created_at
+		FROM transactions
+		WHERE type = 'payment' AND status = 'completed'
+		AND created_at >= ? AND created_at < ?
+	`, start, end)
+	if err != nil {
+		return fmt.Errorf("failed to load completed payments for %s: %v", period, err)
+	}
+	defer rows.Close()
+
+	type payment struct {
+		id     int64
+		userID int
+		amount float64
+	}
+	var payments []payment
+	for rows.Next() {
+		var p payment
+		var createdAt time.Time
+		if err := rows.Scan(&p.id, &p.userID, &p.amount, &createdAt); err != nil {
+			continue
+		}
+		payments = append(payments, p)
+	}
+
+	inserted := 0
+	for _, p := range payments {
+		res, err := s.db.Exec(`
+			INSERT IGNORE INTO invoice_records (user_id, period, transaction_id, amount, currency, status, created_at)
+			VALUES (?, ?, ?, ?, ?, 'pending', NOW())
+		`, p.userID, period, p.id, p.amount, normalizeCurrency(""))
+		if err != nil {
+			return fmt.Errorf("failed to record transaction %d for %s: %v", p.id, period, err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		inserted++
+		s.logTransactionState(p.id, "completed", "invoice_record_created", fmt.Sprintf("selected into billing period %s", period))
+	}
+
+	log.Printf("🧾 invoice records: prepared %d new record(s) for period %s", inserted, period)
+	return nil
+}
+
+// CreateInvoiceItems prices every pending invoice_records row into an
+// invoice_items row (processing fee, platform commission, and currency
+// conversion -- a no-op today since invoice_records are always normalized to
+// normalizeCurrency's default, but kept as an explicit step so a future
+// multi-currency record has somewhere to convert), then marks the record
+// consumed. Already-consumed records are skipped by the WHERE clause, so a
+// rerun only processes whatever PrepareInvoiceRecords added since.
+func (s *InvoiceService) CreateInvoiceItems() error {
+	rows, err := s.db.Query(`
+		SELECT id, user_id, period, transaction_id, amount, currency
+		FROM invoice_records WHERE status = 'pending'
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to load pending invoice records: %v", err)
+	}
+	defer rows.Close()
+
+	var records []InvoiceRecord
+	for rows.Next() {
+		var r InvoiceRecord
+		if err := rows.Scan(&r.ID, &r.UserID, &r.Period, &r.TransactionID, &r.Amount, &r.Currency); err != nil {
+			continue
+		}
+		records = append(records, r)
+	}
+
+	created := 0
+	for _, r := range records {
+		if err := s.createInvoiceItem(r); err != nil {
+			log.Printf("⚠️  invoice items: failed to price record %d: %v", r.ID, err)
+			continue
+		}
+		created++
+	}
+
+	log.Printf("🧾 invoice items: priced %d record(s)", created)
+	return nil
+}
+
+func (s *InvoiceService) createInvoiceItem(r InvoiceRecord) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	currency := normalizeCurrency(r.Currency)
+	fee := roundCurrency(r.Amount * invoiceProcessingFeeRate)
+	commission := roundCurrency(r.Amount * invoicePlatformCommissionRate)
+	net := roundCurrency(r.Amount - fee - commission)
+
+	if _, err := tx.Exec(`
+		INSERT INTO invoice_items (invoice_record_id, transaction_id, user_id, period, gross_amount, fee_amount, commission_amount, net_amount, currency, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, NOW())
+	`, r.ID, r.TransactionID, r.UserID, r.Period, r.Amount, fee, commission, net, currency); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`UPDATE invoice_records SET status = 'consumed' WHERE id = ?`, r.ID); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`
+		INSERT INTO transaction_logs (transaction_id, prior_status, new_status, reason, created_at)
+		VALUES (?, 'invoice_record_created', 'invoice_item_created', ?, NOW())
+	`, r.TransactionID, fmt.Sprintf("priced for period %s (fee=%.2f, commission=%.2f, net=%.2f)", r.Period, fee, commission, net)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CreateInvoices groups every user's unbilled invoice_items (invoice_id IS
+// NULL) by (user_id, period) into one persisted invoices row per group,
+// rendering the document and stamping an idempotent INV-YYYYMM-NNNNN
+// number. Items already attached to an invoice are excluded by the WHERE
+// clause, so a rerun only bills whatever CreateInvoiceItems added since the
+// last run. invoices is unique on (user_id, period), so a group that already
+// has an invoice gets no second one: items added to it later stay unbilled
+// and its insert fails (and is logged) on every later run.
+func (s *InvoiceService) CreateInvoices() error {
+	rows, err := s.db.Query(`
+		SELECT DISTINCT user_id, period FROM invoice_items WHERE invoice_id IS NULL
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to load unbilled invoice groups: %v", err)
+	}
+	defer rows.Close()
+
+	type group struct {
+		userID int
+		period string
+	}
+	var groups []group
+	for rows.Next() {
+		var g group
+		if err := rows.Scan(&g.userID, &g.period); err != nil {
+			continue
+		}
+		groups = append(groups, g)
+	}
+
+	created := 0
+	for _, g := range groups {
+		if err := s.createInvoice(g.userID, g.period); err != nil {
+			log.Printf("⚠️  invoices: failed to bill user %d for %s: %v", g.userID, g.period, err)
+			continue
+		}
+		created++
+	}
+
+	log.Printf("🧾 invoices: issued %d invoice(s)", created)
+	return nil
+}
+
+func (s *InvoiceService) createInvoice(userID int, period string) error {
+	itemRows, err := s.db.Query(`
+		SELECT id, invoice_record_id, transaction_id, user_id, period, gross_amount, fee_amount, commission_amount, net_amount, currency
+		FROM invoice_items WHERE user_id = ? AND period = ? AND invoice_id IS NULL
+	`, userID, period)
+	if err != nil {
+		return err
+	}
+	var items []InvoiceLineItem
+	for itemRows.Next() {
+		var item InvoiceLineItem
+		if err := itemRows.Scan(&item.ID, &item.InvoiceRecordID, &item.TransactionID, &item.UserID, &item.Period,
+			&item.GrossAmount, &item.FeeAmount, &item.CommissionAmount, &item.NetAmount, &item.Currency); err != nil {
+			itemRows.Close()
+			return err
+		}
+		items = append(items, item)
+	}
+	itemRows.Close()
+	if len(items) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	number, err := nextInvoiceNumber(tx, period)
+	if err != nil {
+		return fmt.Errorf("failed to allocate invoice number: %v", err)
+	}
+
+	var total float64
+	currency := items[0].Currency
+	for _, item := range items {
+		total += item.NetAmount
+	}
+	total = roundCurrency(total)
+
+	invoice := &Invoice{UserID: userID, Period: period, Number: number, TotalAmount: total, Currency: currency}
+	document, err := s.renderer.Render(invoice, items)
+	if err != nil {
+		return fmt.Errorf("failed to render invoice %s: %v", number, err)
+	}
+
+	res, err := tx.Exec(`
+		INSERT INTO invoices (user_id, period, invoice_number, total_amount, currency, status, document, created_at)
+		VALUES (?, ?, ?, ?, ?, 'issued', ?, NOW())
+	`, userID, period, number, total, currency, document)
+	if err != nil {
+		return err
+	}
+	invoiceID, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		if _, err := tx.Exec(`UPDATE invoice_items SET invoice_id = ? WHERE id = ?`, invoiceID, item.ID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO transaction_logs (transaction_id, prior_status, new_status, reason, created_at)
+			VALUES (?, 'invoice_item_created', 'invoiced', ?, NOW())
+		`, item.TransactionID, fmt.Sprintf("billed on invoice %s", number)); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("🧾 issued invoice %s for user %d (%s %.2f)", number, userID, currency, total)
+	return nil
+}
+
+// nextInvoiceNumber allocates the next sequence number for period under tx,
+// row-locking invoice_number_sequences so two concurrent CreateInvoices runs
+// for the same period can never be handed the same number.
+func nextInvoiceNumber(tx *sql.Tx, period string) (string, error) {
+	if _, err := tx.Exec(`
+		INSERT IGNORE INTO invoice_number_sequences (period, next_seq) VALUES (?, 1)
+	`, period); err != nil {
+		return "", err
+	}
+
+	var seq int
+	if err := tx.QueryRow(`
+		SELECT next_seq FROM invoice_number_sequences WHERE period = ? FOR UPDATE
+	`, period).Scan(&seq); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(`
+		UPDATE invoice_number_sequences SET next_seq = next_seq + 1 WHERE period = ?
+	`, period); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("INV-%s-%05d", strings.ReplaceAll(period, "-", ""), seq), nil
+}
+
+// periodBounds turns a "YYYY-MM" period into the half-open [start, end) UTC
+// range PrepareInvoiceRecords selects transactions.created_at against.
+func periodBounds(period string) (start, end time.Time, err error) {
+	start, err = time.Parse("2006-01", period)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid period %q, expected YYYY-MM: %v", period, err)
+	}
+	return start, start.AddDate(0, 1, 0), nil
+}
+
+// roundCurrency rounds to 2 decimal places, matching every other money
+// amount this module persists as DECIMAL(10,2).
+func roundCurrency(amount float64) float64 {
+	return float64(int64(amount*100+0.5)) / 100
+}
+
+// logTransactionState is the invoice pipeline's equivalent of
+// ReconciliationChore.transition's transaction_logs write -- recorded here
+// too since invoice_records are keyed 1:1 to a transaction.
+func (s *InvoiceService) logTransactionState(transactionID int64, priorStatus, newStatus, reason string) {
+	if _, err := s.db.Exec(`
+		INSERT INTO transaction_logs (transaction_id, prior_status, new_status, reason, created_at)
+		VALUES (?, ?, ?, ?, NOW())
+	`, transactionID, priorStatus, newStatus, reason); err != nil {
+		log.Printf("⚠️  invoice records: failed to log transaction %d state: %v", transactionID, err)
+	}
+}
+
+// initializeInvoiceTables creates invoice_records, invoice_items, invoices
+// and invoice_number_sequences.
+func initializeInvoiceTables(db *sql.DB) error {
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS invoice_records (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			user_id INT NOT NULL,
+			period VARCHAR(7) NOT NULL,
+			transaction_id INT NOT NULL,
+			amount DECIMAL(10,2) NOT NULL,
+			currency VARCHAR(3) NOT NULL DEFAULT 'USD',
+			status ENUM('pending', 'consumed') NOT NULL DEFAULT 'pending',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE INDEX idx_transaction (transaction_id),
+			INDEX idx_user_period_status (user_id, period, status),
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			FOREIGN KEY (transaction_id) REFERENCES transactions(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS invoice_items (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			invoice_record_id INT NOT NULL,
+			transaction_id INT NOT NULL,
+			user_id INT NOT NULL,
+			period VARCHAR(7) NOT NULL,
+			gross_amount DECIMAL(10,2) NOT NULL,
+			fee_amount DECIMAL(10,2) NOT NULL,
+			commission_amount DECIMAL(10,2) NOT NULL,
+			net_amount DECIMAL(10,2) NOT NULL,
+			currency VARCHAR(3) NOT NULL DEFAULT 'USD',
+			invoice_id INT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE INDEX idx_invoice_record (invoice_record_id),
+			INDEX idx_user_period_invoice (user_id, period, invoice_id),
+			FOREIGN KEY (invoice_record_id) REFERENCES invoice_records(id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS invoices (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			user_id INT NOT NULL,
+			period VARCHAR(7) NOT NULL,
+			invoice_number VARCHAR(20) NOT NULL,
+			total_amount DECIMAL(10,2) NOT NULL,
+			currency VARCHAR(3) NOT NULL DEFAULT 'USD',
+			status ENUM('draft', 'issued') NOT NULL DEFAULT 'issued',
+			document LONGBLOB,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE INDEX idx_invoice_number (invoice_number),
+			UNIQUE INDEX idx_user_period (user_id, period),
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS invoice_number_sequences (
+			period VARCHAR(7) PRIMARY KEY,
+			next_seq INT NOT NULL DEFAULT 1
+		)`,
+	}
+	for _, stmt := range statements {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to create invoice table: %v", err)
+		}
+	}
+	return nil
+}
+
+// prepareInvoiceRecordsHandler is POST /admin/invoices/prepare.
+func (sth *SecureTransactionHandler) prepareInvoiceRecordsHandler(c *gin.Context) {
+	var req struct {
+		Period string `json:"period" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := sth.invoices.PrepareInvoiceRecords(req.Period); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// createInvoiceItemsHandler is POST /admin/invoices/items.
+func (sth *SecureTransactionHandler) createInvoiceItemsHandler(c *gin.Context) {
+	if err := sth.invoices.CreateInvoiceItems(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// createInvoicesHandler is POST /admin/invoices/create.
+func (sth *SecureTransactionHandler) createInvoicesHandler(c *gin.Context) {
+	if err := sth.invoices.CreateInvoices(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// listInvoicesHandler is GET /admin/invoices, optionally filtered by
+// ?user_id= and/or ?period=.
+func (sth *SecureTransactionHandler) listInvoicesHandler(c *gin.Context) {
+	query := `SELECT id, user_id, period, invoice_number, total_amount, currency, status, created_at FROM invoices WHERE 1=1`
+	var args []interface{}
+	if userID := c.Query("user_id"); userID != "" {
+		query += " AND user_id = ?"
+		args = append(args, userID)
+	}
+	if period := c.Query("period"); period != "" {
+		query += " AND period = ?"
+		args = append(args, period)
+	}
+	query += " ORDER BY created_at DESC"
+
+	rows, err := sth.db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list invoices"})
+		return
+	}
+	defer rows.Close()
+
+	invoices := []gin.H{}
+	for rows.Next() {
+		var id int64
+		var userID int
+		var period, number, currency, status string
+		var total float64
+		var createdAt time.Time
+		if err := rows.Scan(&id, &userID, &period, &number, &total, &currency, &status, &createdAt); err != nil {
+			continue
+		}
+		invoices = append(invoices, gin.H{
+			"id": id, "user_id": userID, "period": period, "invoice_number": number,
+			"total_amount": total, "currency": currency, "status": status, "created_at": createdAt,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"invoices": invoices})
+}
+
+// runInvoiceCLI implements a cscli-style CLI for running the invoice
+// pipeline from a cron job rather than an authenticated admin HTTP call.
+// Invoked as `./krili invoice <prepare|items|create> [--period=YYYY-MM]`;
+// args is os.Args[2:].
+func runInvoiceCLI(args []string) int {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "usage: invoice <prepare|items|create> [--period=YYYY-MM]")
+		return 1
+	}
+
+	config := loadConfigWithSecrets()
+	db, err := connectDBSecure(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to connect to database: %v\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	if err := initializeInvoiceTables(db); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to initialize invoice tables: %v\n", err)
+		return 1
+	}
+	service := NewInvoiceService(db, nil)
+
+	switch args[0] {
+	case "prepare":
+		fs := flag.NewFlagSet("invoice prepare", flag.ContinueOnError)
+		period := fs.String("period", "", "billing period to prepare, YYYY-MM (required)")
+		if err := fs.Parse(args[1:]); err != nil {
+			return 1
+		}
+		if *period == "" {
+			fmt.Fprintln(os.Stderr, "invoice prepare: --period is required")
+			return 1
+		}
+		if err := service.PrepareInvoiceRecords(*period); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to prepare invoice records: %v\n", err)
+			return 1
+		}
+	case "items":
+		if err := service.CreateInvoiceItems(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to create invoice items: %v\n", err)
+			return 1
+		}
+	case "create":
+		if err := service.CreateInvoices(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to create invoices: %v\n", err)
+			return 1
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown invoice subcommand %q\n", args[0])
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,120 @@
+// Pluggable cookie-carried session support for stateful flows that can't
+// rely on a JWT alone -- generate a payment invoice, let the user pay out
+// of band, then poll for settlement -- the same shape gin-contrib/sessions
+// gives a gorilla/sessions-backed app. This reuses SessionManager/
+// SessionProvider (session_manager.go), which already provide a pluggable,
+// Redis-capable session backend, instead of vendoring gorilla/sessions:
+// that dependency isn't in go.mod, and threading it in just for a cookie
+// ID and a flash value would duplicate infrastructure this codebase
+// already has. flowSessionMiddleware is opt-in per-route group, coexisting
+// with (not replacing) enhancedAuthMiddleware.
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// flowSessionCookieName is the cookie a caller's browser carries across
+// the create-invoice/poll-status request pair. Distinct from the
+// "session_token" cookie validateCSRFToken reads, which belongs to the
+// CSRF-bound login session, not this opt-in flow session.
+const flowSessionCookieName = "krili_flow_sid"
+
+// flowSessionTTL is short: a flow session only needs to outlive the gap
+// between creating an invoice and polling it a handful of times, not a
+// full login session.
+const flowSessionTTL = 30 * time.Minute
+
+// flowSessionPendingInvoiceKey is the flash key createInvoiceHandler
+// stashes the new invoice's id under, for a frontend that polls status
+// without the caller needing to echo the id back itself.
+const flowSessionPendingInvoiceKey = "pending_invoice_id"
+
+// flowSessionMiddleware reads krili_flow_sid from the request cookie,
+// loading the SessionRecord it names from sth.flowSessions, or creates a
+// fresh one (and sets the cookie) when absent or expired. The record is
+// stashed on the context under "flow_session" for handlers to read and
+// mutate flash values on.
+func (sth *SecureTransactionHandler) flowSessionMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var record *SessionRecord
+
+		if sid, err := c.Cookie(flowSessionCookieName); err == nil && sid != "" {
+			if existing, err := sth.flowSessions.Read(sid); err == nil {
+				record = existing
+			}
+		}
+
+		if record == nil {
+			sid, err := NewSID()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start session"})
+				c.Abort()
+				return
+			}
+			record = &SessionRecord{
+				SID:       sid,
+				UserID:    c.GetInt("user_id"),
+				IsActive:  true,
+				CreatedAt: time.Now(),
+				ExpiresAt: time.Now().Add(flowSessionTTL),
+				Data:      make(map[string]interface{}),
+			}
+			if err := sth.flowSessions.Create(record); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start session"})
+				c.Abort()
+				return
+			}
+			c.SetCookie(flowSessionCookieName, sid, int(flowSessionTTL.Seconds()), "/", "", false, true)
+		}
+
+		c.Set("flow_session", record)
+		c.Next()
+	}
+}
+
+// flowSessionFromContext returns the SessionRecord flowSessionMiddleware
+// attached to c, if that middleware ran for this route.
+func flowSessionFromContext(c *gin.Context) (*SessionRecord, bool) {
+	value, ok := c.Get("flow_session")
+	if !ok {
+		return nil, false
+	}
+	record, ok := value.(*SessionRecord)
+	return record, ok
+}
+
+// flashSet stashes value under key in record's session data and persists
+// it immediately, so it survives to the next request even if this one's
+// response is never read.
+func (sth *SecureTransactionHandler) flashSet(record *SessionRecord, key string, value interface{}) error {
+	if record.Data == nil {
+		record.Data = make(map[string]interface{})
+	}
+	record.Data[key] = value
+	return sth.flowSessions.Update(record)
+}
+
+// flashPop reads key out of record's session data and clears it, the
+// read-once-then-cleared semantics gorilla/sessions' flash messages give --
+// a second poll that doesn't pass the id explicitly shouldn't keep seeing
+// the same stashed invoice id after it's already been consumed.
+func (sth *SecureTransactionHandler) flashPop(record *SessionRecord, key string) (interface{}, bool) {
+	if record.Data == nil {
+		return nil, false
+	}
+	value, ok := record.Data[key]
+	if !ok {
+		return nil, false
+	}
+	delete(record.Data, key)
+	if err := sth.flowSessions.Update(record); err != nil {
+		// Best-effort: the flash value already served its purpose for this
+		// request, so a failed clear just risks it being read again later.
+		return value, true
+	}
+	return value, true
+}
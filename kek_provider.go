@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+)
+
+// KeyProvider abstracts the key-encryption key (KEK) a data-encryption key
+// (DEK) is wrapped under, so PaymentDataVault can swap between a locally
+// held KEK and an external KMS without touching the envelope format it
+// persists. Every call is self-describing: the returned kekID/kekVersion
+// are stored alongside the wrapped DEK so a later UnwrapDEK (or RotateKEK)
+// knows exactly which key, and which version of it, to ask for.
+type KeyProvider interface {
+	// WrapDEK encrypts dek under the provider's current KEK, returning the
+	// wrapped bytes plus the KEK's identity. kekVersion exists for
+	// providers that version a single long-lived key (AWS KMS, Vault
+	// Transit); providers that mint a brand-new key per rotation instead
+	// (LocalKEK) always report version 1.
+	WrapDEK(dek []byte) (wrapped []byte, kekID string, kekVersion int, err error)
+	// UnwrapDEK reverses WrapDEK for a specific (kekID, kekVersion).
+	UnwrapDEK(wrapped []byte, kekID string, kekVersion int) ([]byte, error)
+}
+
+// LocalKEK implements KeyProvider on top of the same KeyStore RSA keypairs
+// EncryptSensitive already seals envelopes under (see envelope_crypto.go),
+// so the payment-data vault rotates through one key lifecycle instead of
+// growing a second, parallel one. Because KeyStore.RotateKeys mints a new
+// key ID on every rotation rather than bumping a version on the existing
+// one, LocalKEK always reports kekVersion 1.
+type LocalKEK struct {
+	keystore *KeyStore
+}
+
+func NewLocalKEK(keystore *KeyStore) *LocalKEK {
+	return &LocalKEK{keystore: keystore}
+}
+
+func (l *LocalKEK) WrapDEK(dek []byte) ([]byte, string, int, error) {
+	keyID, _, pub, err := l.keystore.ActiveKey()
+	if err != nil {
+		return nil, "", 0, fmt.Errorf("local KEK: no active key: %v", err)
+	}
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, dek, nil)
+	if err != nil {
+		return nil, "", 0, fmt.Errorf("local KEK: wrap failed: %v", err)
+	}
+	return wrapped, keyID, 1, nil
+}
+
+func (l *LocalKEK) UnwrapDEK(wrapped []byte, kekID string, kekVersion int) ([]byte, error) {
+	priv, _, err := l.keystore.KeyByID(kekID)
+	if err != nil {
+		return nil, fmt.Errorf("local KEK: %v", err)
+	}
+	dek, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, wrapped, nil)
+	if err != nil {
+		return nil, fmt.Errorf("local KEK: unwrap failed: %v", err)
+	}
+	return dek, nil
+}
+
+// AWSKMSProvider wraps DEKs with AWS KMS's Encrypt/Decrypt APIs under
+// KeyARN. This module doesn't vendor the AWS SDK (see go.mod, and
+// secrets_provider.go's awsSecretsManagerProvider, which hits the same
+// wall resolving aws:// secret URIs) so WrapDEK/UnwrapDEK return a clear
+// configuration error instead of silently falling back to a local key
+// until a real client is plugged in.
+type AWSKMSProvider struct {
+	KeyARN string
+	Region string
+}
+
+func NewAWSKMSProvider(keyARN, region string) *AWSKMSProvider {
+	return &AWSKMSProvider{KeyARN: keyARN, Region: region}
+}
+
+func (a *AWSKMSProvider) WrapDEK(dek []byte) ([]byte, string, int, error) {
+	// A real implementation calls kms:Encrypt with a.KeyARN and returns the
+	// response's CiphertextBlob and KeyId. Left unconnected here since this
+	// sandbox has no AWS endpoint to call and no AWS SDK vendored.
+	return nil, "", 0, fmt.Errorf("aws kms provider not connected: cannot wrap DEK under %s in %s", a.KeyARN, a.Region)
+}
+
+func (a *AWSKMSProvider) UnwrapDEK(wrapped []byte, kekID string, kekVersion int) ([]byte, error) {
+	// A real implementation calls kms:Decrypt with the wrapped ciphertext
+	// and verifies the response's KeyId matches kekID.
+	return nil, fmt.Errorf("aws kms provider not connected: cannot unwrap DEK under %s in %s", kekID, a.Region)
+}
+
+// VaultProvider wraps DEKs with HashiCorp Vault's Transit engine, the same
+// backend vaultSecretsProvider resolves vault:// secrets against. Left
+// unconnected for the same reason: no Vault endpoint reachable from this
+// sandbox.
+type VaultProvider struct {
+	addr    string
+	token   string
+	keyName string
+}
+
+func NewVaultProvider(addr, token, keyName string) *VaultProvider {
+	return &VaultProvider{addr: addr, token: token, keyName: keyName}
+}
+
+func (v *VaultProvider) WrapDEK(dek []byte) ([]byte, string, int, error) {
+	// A real implementation POSTs base64(dek) to
+	// {v.addr}/v1/transit/encrypt/{v.keyName} using v.token and parses the
+	// "vault:v<version>:<ciphertext>" response into (ciphertext, keyName,
+	// version).
+	return nil, "", 0, fmt.Errorf("vault provider not connected: cannot wrap DEK under %s at %s", v.keyName, v.addr)
+}
+
+func (v *VaultProvider) UnwrapDEK(wrapped []byte, kekID string, kekVersion int) ([]byte, error) {
+	// A real implementation POSTs the "vault:v<kekVersion>:..." ciphertext
+	// to {v.addr}/v1/transit/decrypt/{kekID} and base64-decodes the result.
+	return nil, fmt.Errorf("vault provider not connected: cannot unwrap DEK under %s at %s", kekID, v.addr)
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	keyStateActive   = "active"
+	keyStateRetiring = "retiring"
+	keyStateRetired  = "retired"
+)
+
+// EncryptionKey is a row of the encryption_keys table: one RSA keypair in
+// the rotation lifecycle, with its private half stored KEK-wrapped.
+type EncryptionKey struct {
+	KeyID               string     `json:"key_id" db:"key_id"`
+	Algorithm           string     `json:"algorithm" db:"algorithm"`
+	EncryptedPrivateKey string     `json:"-" db:"encrypted_private_key"`
+	PublicKeyPEM        string     `json:"public_key" db:"public_key"`
+	State               string     `json:"state" db:"state"`
+	CreatedAt           time.Time  `json:"created_at" db:"created_at"`
+	ActivatedAt         *time.Time `json:"activated_at,omitempty" db:"activated_at"`
+	RetiredAt           *time.Time `json:"retired_at,omitempty" db:"retired_at"`
+}
+
+// KeyStore persists the RSA keypairs EncryptSensitive/DecryptSensitive use,
+// rather than the single in-memory pair EnhancedSecurityService used to
+// generate for itself on every process start. Private keys never touch the
+// DB in the clear: each is AES-GCM-sealed under a KEK derived via Argon2id
+// from a configured master secret, the same derivation hashPasswordArgon2
+// uses for passwords.
+type KeyStore struct {
+	db  *sql.DB
+	kek []byte
+
+	mutex    sync.RWMutex
+	activeID string
+	cache    map[string]*rsa.PrivateKey // keyID -> decrypted private key, populated lazily
+	pubCache map[string]*rsa.PublicKey
+}
+
+// NewKeyStore opens the keystore backed by db, deriving its KEK from
+// KEY_ENCRYPTION_MASTER_SECRET and a salt persisted in keystore_meta so the
+// derivation is stable across restarts. If no key is active yet, it
+// generates and activates the first one.
+func NewKeyStore(db *sql.DB) (*KeyStore, error) {
+	salt, err := loadOrCreateKEKSalt(db)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load KEK salt: %v", err)
+	}
+
+	masterSecret := getEnv("KEY_ENCRYPTION_MASTER_SECRET", "dev-only-insecure-master-secret")
+	kek := argon2.IDKey([]byte(masterSecret), salt, 1, 64*1024, 4, 32)
+
+	ks := &KeyStore{
+		db:       db,
+		kek:      kek,
+		cache:    make(map[string]*rsa.PrivateKey),
+		pubCache: make(map[string]*rsa.PublicKey),
+	}
+
+	activeID, err := ks.loadActiveKeyID()
+	if err != nil {
+		return nil, err
+	}
+	if activeID == "" {
+		if activeID, err = ks.generateAndStoreKey(keyStateActive); err != nil {
+			return nil, fmt.Errorf("failed to bootstrap initial keypair: %v", err)
+		}
+	}
+	ks.activeID = activeID
+
+	return ks, nil
+}
+
+func loadOrCreateKEKSalt(db *sql.DB) ([]byte, error) {
+	var salt []byte
+	err := db.QueryRow("SELECT kek_salt FROM keystore_meta WHERE id = 1").Scan(&salt)
+	if err == nil {
+		return salt, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	salt = make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec("INSERT INTO keystore_meta (id, kek_salt) VALUES (1, ?)", salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+func (ks *KeyStore) loadActiveKeyID() (string, error) {
+	var keyID string
+	err := ks.db.QueryRow("SELECT key_id FROM encryption_keys WHERE state = ?", keyStateActive).Scan(&keyID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return keyID, nil
+}
+
+// wrapPrivateKey seals der under the KEK with AES-GCM, returning
+// base64(nonce || ciphertext).
+func (ks *KeyStore) wrapPrivateKey(der []byte) (string, error) {
+	block, err := aes.NewCipher(ks.kek)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, der, nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (ks *KeyStore) unwrapPrivateKey(wrapped string) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(ks.kek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < gcm.NonceSize() {
+		return nil, fmt.Errorf("wrapped key too short")
+	}
+	nonce, ciphertext := raw[:gcm.NonceSize()], raw[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+// generateAndStoreKey creates a fresh RSA-2048 keypair, persists it in the
+// requested state, and returns its key ID.
+func (ks *KeyStore) generateAndStoreKey(state string) (string, error) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", err
+	}
+	keyID := newEncryptionKeyID()
+
+	wrapped, err := ks.wrapPrivateKey(x509.MarshalPKCS1PrivateKey(privateKey))
+	if err != nil {
+		return "", err
+	}
+	pubBytes, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	pubPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubBytes}))
+
+	var activatedAt interface{}
+	if state == keyStateActive {
+		activatedAt = time.Now()
+	}
+
+	_, err = ks.db.Exec(`
+		INSERT INTO encryption_keys (key_id, algorithm, encrypted_private_key, public_key, state, activated_at)
+		VALUES (?, 'RSA-2048', ?, ?, ?, ?)
+	`, keyID, wrapped, pubPEM, state, activatedAt)
+	if err != nil {
+		return "", err
+	}
+
+	ks.mutex.Lock()
+	ks.cache[keyID] = privateKey
+	ks.pubCache[keyID] = &privateKey.PublicKey
+	ks.mutex.Unlock()
+
+	return keyID, nil
+}
+
+// ActiveKey returns the key ID and keypair EncryptSensitive should seal new
+// envelopes under.
+func (ks *KeyStore) ActiveKey() (keyID string, priv *rsa.PrivateKey, pub *rsa.PublicKey, err error) {
+	ks.mutex.RLock()
+	activeID := ks.activeID
+	ks.mutex.RUnlock()
+
+	priv, pub, err = ks.KeyByID(activeID)
+	return activeID, priv, pub, err
+}
+
+// KeyByID resolves any key the store knows about (active, retiring, or
+// retired) so DecryptSensitive can still open envelopes sealed before a
+// rotation.
+func (ks *KeyStore) KeyByID(keyID string) (*rsa.PrivateKey, *rsa.PublicKey, error) {
+	ks.mutex.RLock()
+	priv, ok := ks.cache[keyID]
+	pub := ks.pubCache[keyID]
+	ks.mutex.RUnlock()
+	if ok {
+		return priv, pub, nil
+	}
+
+	var wrapped, pubPEM string
+	err := ks.db.QueryRow("SELECT encrypted_private_key, public_key FROM encryption_keys WHERE key_id = ?", keyID).
+		Scan(&wrapped, &pubPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unknown encryption key id %q: %v", keyID, err)
+	}
+
+	der, err := ks.unwrapPrivateKey(wrapped)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to unwrap key %q: %v", keyID, err)
+	}
+	priv, err = x509.ParsePKCS1PrivateKey(der)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse key %q: %v", keyID, err)
+	}
+	pub = &priv.PublicKey
+
+	ks.mutex.Lock()
+	ks.cache[keyID] = priv
+	ks.pubCache[keyID] = pub
+	ks.mutex.Unlock()
+
+	return priv, pub, nil
+}
+
+// ListKeys returns every key the store knows about, newest first.
+func (ks *KeyStore) ListKeys() ([]EncryptionKey, error) {
+	rows, err := ks.db.Query(`
+		SELECT key_id, algorithm, public_key, state, created_at, activated_at, retired_at
+		FROM encryption_keys ORDER BY created_at DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []EncryptionKey
+	for rows.Next() {
+		var k EncryptionKey
+		if err := rows.Scan(&k.KeyID, &k.Algorithm, &k.PublicKeyPEM, &k.State, &k.CreatedAt, &k.ActivatedAt, &k.RetiredAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// RotateKeys generates a new active keypair, demotes the previous active
+// key to "retiring", and kicks off a background walk that re-encrypts every
+// row holding data sealed under the old key so it can eventually be
+// retired. It returns the new key's ID immediately; re-encryption runs
+// asynchronously against ctx.
+func (ks *KeyStore) RotateKeys(ctx context.Context, ess *EnhancedSecurityService) (string, error) {
+	ks.mutex.RLock()
+	previousID := ks.activeID
+	ks.mutex.RUnlock()
+
+	newID, err := ks.generateAndStoreKey(keyStateActive)
+	if err != nil {
+		return "", err
+	}
+
+	if previousID != "" {
+		if _, err := ks.db.Exec(
+			"UPDATE encryption_keys SET state = ? WHERE key_id = ? AND state = ?",
+			keyStateRetiring, previousID, keyStateActive,
+		); err != nil {
+			return "", fmt.Errorf("failed to demote previous key: %v", err)
+		}
+		if _, err := ks.db.Exec("UPDATE encryption_keys SET state = ? WHERE key_id = ?", keyStateActive, newID); err != nil {
+			return "", err
+		}
+	}
+
+	ks.mutex.Lock()
+	ks.activeID = newID
+	ks.mutex.Unlock()
+
+	if previousID != "" {
+		go ks.reencryptUnderActiveKey(ctx, previousID, ess)
+	}
+
+	return newID, nil
+}
+
+// reencryptUnderActiveKey walks every table known to hold a KeyStore
+// envelope sealed under oldKeyID and re-seals it under the now-active key,
+// so oldKeyID can be safely retired once this finishes. New encrypted
+// columns should be added to reencryptableColumns rather than duplicating
+// this walk.
+func (ks *KeyStore) reencryptUnderActiveKey(ctx context.Context, oldKeyID string, ess *EnhancedSecurityService) {
+	for _, col := range reencryptableColumns {
+		if err := ks.reencryptColumn(ctx, col, oldKeyID, ess); err != nil {
+			log.Printf("⚠️  key rotation: failed to re-encrypt %s.%s off key %s: %v", col.table, col.column, oldKeyID, err)
+		}
+	}
+}
+
+type reencryptableColumn struct {
+	table, idColumn, column string
+}
+
+var reencryptableColumns = []reencryptableColumn{
+	{table: "two_factor_auth", idColumn: "id", column: "secret"},
+	{table: "security_events", idColumn: "id", column: "description"},
+	{table: "device_fingerprints", idColumn: "id", column: "device_info"},
+	{table: "biometric_auth", idColumn: "id", column: "template_hash"},
+}
+
+func (ks *KeyStore) reencryptColumn(ctx context.Context, col reencryptableColumn, oldKeyID string, ess *EnhancedSecurityService) error {
+	query := fmt.Sprintf("SELECT %s, %s FROM %s", col.idColumn, col.column, col.table)
+	rows, err := ks.db.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	type pending struct {
+		id    int
+		value string
+	}
+	var toUpdate []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.value); err != nil {
+			rows.Close()
+			return err
+		}
+		if kid, err := envelopeKeyID(p.value); err == nil && kid == oldKeyID {
+			toUpdate = append(toUpdate, p)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	updateQuery := fmt.Sprintf("UPDATE %s SET %s = ? WHERE %s = ?", col.table, col.column, col.idColumn)
+	for _, p := range toUpdate {
+		plaintext, err := ess.DecryptSensitive(p.value)
+		if err != nil {
+			return fmt.Errorf("row %d: %v", p.id, err)
+		}
+		reencrypted, err := ess.EncryptSensitive(plaintext)
+		if err != nil {
+			return fmt.Errorf("row %d: %v", p.id, err)
+		}
+		if _, err := ks.db.ExecContext(ctx, updateQuery, reencrypted, p.id); err != nil {
+			return fmt.Errorf("row %d: %v", p.id, err)
+		}
+	}
+	return nil
+}
+
+// RetireKey transitions a "retiring" key to "retired". The key remains in
+// the store (and KeyByID can still resolve it) so any envelope the
+// background re-encryption walk missed still decrypts; it simply stops
+// being a candidate for new encryption.
+func (ks *KeyStore) RetireKey(keyID string) error {
+	result, err := ks.db.Exec(
+		"UPDATE encryption_keys SET state = ?, retired_at = NOW() WHERE key_id = ? AND state = ?",
+		keyStateRetired, keyID, keyStateRetiring,
+	)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return fmt.Errorf("key %q is not in the retiring state", keyID)
+	}
+	return nil
+}
+
+// listKeysHandler, rotateKeysHandler and retireKeyHandler are admin-only
+// endpoints (mounted under the mTLS/JWT-gated securityAPI group) for
+// operating the keystore; every call logs a security event the same way
+// the rest of the admin surface does.
+func (sth *SecureTransactionHandler) listKeysHandler(c *gin.Context) {
+	keys, err := sth.keystore.ListKeys()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list keys"})
+		return
+	}
+
+	sth.logSecurityEvent(0, "encryption_keys_listed", "info",
+		fmt.Sprintf("Encryption keys listed (%d keys)", len(keys)), sth.ess.getRealIP(c), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+func (sth *SecureTransactionHandler) rotateKeysHandler(c *gin.Context) {
+	newID, err := sth.keystore.RotateKeys(c.Request.Context(), sth.ess)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate keys"})
+		return
+	}
+
+	sth.logSecurityEvent(0, "encryption_key_rotated", "high",
+		fmt.Sprintf("Encryption keys rotated, new active key %s", newID), sth.ess.getRealIP(c), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, gin.H{"active_key_id": newID})
+}
+
+func (sth *SecureTransactionHandler) retireKeyHandler(c *gin.Context) {
+	keyID := c.Param("id")
+	if err := sth.keystore.RetireKey(keyID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sth.logSecurityEvent(0, "encryption_key_retired", "medium",
+		fmt.Sprintf("Encryption key %s retired", keyID), sth.ess.getRealIP(c), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, gin.H{"retired": keyID})
+}
+
+// rotatePaymentDataKEKHandler re-wraps every encrypted_payment_data row
+// sealed under oldKeyID so it's sealed under newKeyID instead, without
+// touching any row's ciphertext. Unlike /keys/rotate (which mints a new
+// active keypair and kicks off KeyStore's own column re-encryption walk),
+// this expects both key IDs already to exist in the keystore -- typically
+// an operator calls /keys/rotate first, then this against the old/new IDs
+// it returns, once they're ready to finish migrating payment data off the
+// retiring key. See payment_data_vault.go.
+func (sth *SecureTransactionHandler) rotatePaymentDataKEKHandler(c *gin.Context) {
+	var req struct {
+		OldKeyID string `json:"old_key_id" binding:"required"`
+		NewKeyID string `json:"new_key_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := sth.paymentVault.RotateKEK(req.OldKeyID, req.NewKeyID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	sth.logSecurityEvent(0, "payment_data_kek_rotated", "high",
+		fmt.Sprintf("encrypted_payment_data re-wrapped from KEK %s to %s", req.OldKeyID, req.NewKeyID),
+		sth.ess.getRealIP(c), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, gin.H{"old_kek_id": req.OldKeyID, "new_kek_id": req.NewKeyID})
+}
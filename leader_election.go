@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// leaderElectionRefreshInterval is how often the current holder renews its
+// lease; leaderElectionLeaseDuration is how long a lease stays valid without
+// a renewal before another replica can take over. Three refreshes' worth of
+// slack tolerates one or two missed ticks (a slow query, a GC pause) without
+// flapping leadership.
+const (
+	leaderElectionRefreshInterval = 30 * time.Second
+	leaderElectionLeaseDuration   = 90 * time.Second
+)
+
+// initializeLocksTable creates the generic DB-backed lease table leader
+// election (and any future use of the same pattern) reads and writes.
+func initializeLocksTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS locks (
+			name VARCHAR(100) PRIMARY KEY,
+			owner VARCHAR(255) NOT NULL,
+			acquired_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			expires_at TIMESTAMP NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create locks table: %v", err)
+	}
+	return nil
+}
+
+// LeaderElector gates the background work that must run exactly once across
+// a fleet of HA API replicas (alert scanning, metric aggregation, threat
+// feed pulls) behind a lease row in the locks table. Every replica keeps
+// serving WebSocket clients and dashboard reads regardless of leadership;
+// only the periodic monitors check IsLeader before doing work.
+type LeaderElector struct {
+	db       *sql.DB
+	lockName string
+	ownerID  string
+
+	mutex    sync.RWMutex
+	isLeader bool
+	stop     chan struct{}
+}
+
+// NewLeaderElector returns an elector for lockName, identified by a random
+// owner ID scoped to this process (hostname isn't unique enough when
+// replicas run as containers sharing an image, so a random suffix is added).
+func NewLeaderElector(db *sql.DB, lockName string) *LeaderElector {
+	hostname, _ := os.Hostname()
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+
+	return &LeaderElector{
+		db:       db,
+		lockName: lockName,
+		ownerID:  fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(suffix)),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start acquires (or fails to acquire) the lease immediately, then keeps
+// renewing it on leaderElectionRefreshInterval until Stop is called.
+func (le *LeaderElector) Start() {
+	le.refresh()
+	go func() {
+		ticker := time.NewTicker(leaderElectionRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				le.refresh()
+			case <-le.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (le *LeaderElector) Stop() {
+	close(le.stop)
+}
+
+// IsLeader reports whether this replica currently holds the lease, as of
+// the last refresh.
+func (le *LeaderElector) IsLeader() bool {
+	le.mutex.RLock()
+	defer le.mutex.RUnlock()
+	return le.isLeader
+}
+
+// OwnerID is this replica's identity in the locks table, exposed so
+// securityStatusHandler can report which node is active.
+func (le *LeaderElector) OwnerID() string {
+	return le.ownerID
+}
+
+// CurrentLeader returns the owner and lease expiry currently on record,
+// regardless of which replica holds it.
+func (le *LeaderElector) CurrentLeader() (owner string, expiresAt time.Time, err error) {
+	err = le.db.QueryRow(`SELECT owner, expires_at FROM locks WHERE name = ?`, le.lockName).Scan(&owner, &expiresAt)
+	return owner, expiresAt, err
+}
+
+func (le *LeaderElector) refresh() {
+	acquired := le.tryAcquire()
+	le.mutex.Lock()
+	le.isLeader = acquired
+	le.mutex.Unlock()
+}
+
+// tryAcquire takes the lease if it's unowned, expired, or already ours, and
+// reports whether that left this replica as the owner. The UPDATE's IF(...)
+// guards keep an unexpired lease held by somebody else untouched, so the
+// INSERT ... ON DUPLICATE KEY UPDATE is safe to run from every replica
+// concurrently without a separate SELECT ... FOR UPDATE transaction.
+func (le *LeaderElector) tryAcquire() bool {
+	leaseSeconds := int(leaderElectionLeaseDuration.Seconds())
+	_, err := le.db.Exec(`
+		INSERT INTO locks (name, owner, acquired_at, expires_at)
+		VALUES (?, ?, NOW(), DATE_ADD(NOW(), INTERVAL ? SECOND))
+		ON DUPLICATE KEY UPDATE
+			owner = IF(expires_at < NOW() OR owner = VALUES(owner), VALUES(owner), owner),
+			acquired_at = IF(expires_at < NOW() OR owner = VALUES(owner), VALUES(acquired_at), acquired_at),
+			expires_at = IF(expires_at < NOW() OR owner = VALUES(owner), VALUES(expires_at), expires_at)
+	`, le.lockName, le.ownerID, leaseSeconds)
+	if err != nil {
+		log.Printf("⚠️  leader election: failed to refresh lease %q: %v", le.lockName, err)
+		return false
+	}
+
+	var currentOwner string
+	if err := le.db.QueryRow(`SELECT owner FROM locks WHERE name = ?`, le.lockName).Scan(&currentOwner); err != nil {
+		log.Printf("⚠️  leader election: failed to read lease %q: %v", le.lockName, err)
+		return false
+	}
+	return currentOwner == le.ownerID
+}
@@ -0,0 +1,225 @@
+// Double-entry ledger backing transactions: every payment/payout writes two
+// balanced ledger_entries rows (one account debited, one credited) instead of
+// the single signed-amount row transactions used to carry alone. GetUserBalance
+// sums ledger_entries rather than re-deriving a sign from transactions.type, and
+// RollbackTransaction reverses a transaction by inserting compensating entries
+// under a new transaction row rather than deleting or mutating history.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// platformClearingAccount is the ledger account every payment credits and
+// every payout debits: the platform's side of the double entry. A real
+// deployment with multiple settlement currencies or sub-ledgers would likely
+// split this further, but this codebase has one clearing account today.
+const platformClearingAccount = "platform:clearing"
+
+// userAccount returns the ledger account identifier for a user's balance,
+// matching the "kind:id" convention platformClearingAccount uses.
+func userAccount(userID int) string {
+	return fmt.Sprintf("user:%d", userID)
+}
+
+type ledgerDirection string
+
+const (
+	ledgerDebit  ledgerDirection = "debit"
+	ledgerCredit ledgerDirection = "credit"
+)
+
+// ledgerEntry is one account_id/direction/amount leg of a balanced posting.
+type ledgerEntry struct {
+	AccountID string
+	Direction ledgerDirection
+	Amount    float64
+	Currency  string
+}
+
+// oppositeDirection flips a ledgerEntry's direction, used to build the
+// compensating entries RollbackTransaction posts.
+func oppositeDirection(d ledgerDirection) ledgerDirection {
+	if d == ledgerDebit {
+		return ledgerCredit
+	}
+	return ledgerDebit
+}
+
+// paymentLedgerEntries returns the balanced entries for a payment: the user's
+// account is debited (money leaving the user) and the platform clearing
+// account is credited.
+func paymentLedgerEntries(userID int, amount float64, currency string) []ledgerEntry {
+	return []ledgerEntry{
+		{AccountID: userAccount(userID), Direction: ledgerDebit, Amount: amount, Currency: currency},
+		{AccountID: platformClearingAccount, Direction: ledgerCredit, Amount: amount, Currency: currency},
+	}
+}
+
+// payoutLedgerEntries mirrors paymentLedgerEntries for a payout: the platform
+// clearing account is debited and the user's account is credited.
+func payoutLedgerEntries(userID int, amount float64, currency string) []ledgerEntry {
+	return []ledgerEntry{
+		{AccountID: platformClearingAccount, Direction: ledgerDebit, Amount: amount, Currency: currency},
+		{AccountID: userAccount(userID), Direction: ledgerCredit, Amount: amount, Currency: currency},
+	}
+}
+
+// writeLedgerEntries inserts entries for transactionID within tx, so they
+// commit atomically with the transactions row they back.
+func writeLedgerEntries(tx *sql.Tx, transactionID int64, entries []ledgerEntry) error {
+	for _, entry := range entries {
+		if _, err := tx.Exec(`
+			INSERT INTO ledger_entries (transaction_id, account_id, direction, amount, currency, created_at)
+			VALUES (?, ?, ?, ?, ?, NOW())
+		`, transactionID, entry.AccountID, string(entry.Direction), entry.Amount, entry.Currency); err != nil {
+			return fmt.Errorf("failed to write ledger entry for account %s: %v", entry.AccountID, err)
+		}
+	}
+	return nil
+}
+
+// ledgerEntriesForTransaction reads back the entries persistTransaction (or a
+// prior RollbackTransaction) posted for transactionID, so they can be mirrored
+// into a reversal.
+func ledgerEntriesForTransaction(tx *sql.Tx, transactionID int64) ([]ledgerEntry, error) {
+	rows, err := tx.Query(`
+		SELECT account_id, direction, amount, currency FROM ledger_entries WHERE transaction_id = ?
+	`, transactionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []ledgerEntry
+	for rows.Next() {
+		var entry ledgerEntry
+		var direction string
+		if err := rows.Scan(&entry.AccountID, &direction, &entry.Amount, &entry.Currency); err != nil {
+			return nil, err
+		}
+		entry.Direction = ledgerDirection(direction)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// RollbackTransaction reverses transactionID for a fraud-flagged or disputed
+// payment/payout: it posts a new 'reversal' transaction whose ledger entries
+// mirror the original with direction swapped, rather than deleting or
+// mutating the original transaction or its ledger_entries. Returns the new
+// reversal transaction's id. Reversing the same transaction twice is rejected
+// so a retried request can't double-compensate.
+func RollbackTransaction(db *sql.DB, transactionID int64, reason string) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var providerID, providerReference string
+	err = tx.QueryRow(`
+		SELECT user_id, provider_id, provider_reference FROM transactions WHERE id = ? FOR UPDATE
+	`, transactionID).Scan(&userID, &providerID, &providerReference)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("transaction %d not found", transactionID)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var alreadyReversed bool
+	if err := tx.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM transactions WHERE reversed_transaction_id = ?)
+	`, transactionID).Scan(&alreadyReversed); err != nil {
+		return 0, err
+	}
+	if alreadyReversed {
+		return 0, fmt.Errorf("transaction %d was already reversed", transactionID)
+	}
+
+	entries, err := ledgerEntriesForTransaction(tx, transactionID)
+	if err != nil {
+		return 0, err
+	}
+	if len(entries) == 0 {
+		return 0, fmt.Errorf("transaction %d has no ledger entries to reverse", transactionID)
+	}
+
+	var totalAmount float64
+	for _, entry := range entries {
+		if entry.Direction == ledgerDebit {
+			totalAmount += entry.Amount
+		}
+	}
+
+	res, err := tx.Exec(`
+		INSERT INTO transactions
+			(user_id, type, amount, description, status, provider_id, provider_reference, reconciliation_status, reversed_transaction_id)
+		VALUES (?, 'reversal', ?, ?, 'completed', ?, ?, 'matched', ?)
+	`, userID, totalAmount, fmt.Sprintf("Reversal of transaction %d: %s", transactionID, reason), providerID, providerReference, transactionID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to record reversal transaction: %v", err)
+	}
+	reversalID, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	reversed := make([]ledgerEntry, len(entries))
+	for i, entry := range entries {
+		reversed[i] = ledgerEntry{
+			AccountID: entry.AccountID,
+			Direction: oppositeDirection(entry.Direction),
+			Amount:    entry.Amount,
+			Currency:  entry.Currency,
+		}
+	}
+	if err := writeLedgerEntries(tx, reversalID, reversed); err != nil {
+		return 0, err
+	}
+
+	return reversalID, tx.Commit()
+}
+
+// initializeLedgerTables creates ledger_entries.
+func initializeLedgerTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS ledger_entries (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			transaction_id INT NOT NULL,
+			account_id VARCHAR(100) NOT NULL,
+			direction ENUM('debit', 'credit') NOT NULL,
+			amount DECIMAL(10,2) NOT NULL,
+			currency VARCHAR(3) NOT NULL DEFAULT 'USD',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (transaction_id) REFERENCES transactions(id) ON DELETE CASCADE,
+			INDEX idx_transaction (transaction_id),
+			INDEX idx_account_created (account_id, created_at)
+		)`)
+	if err != nil {
+		return fmt.Errorf("failed to create ledger_entries table: %v", err)
+	}
+	return nil
+}
+
+// initializeTransactionsLedgerColumns adds the columns persistTransaction and
+// RollbackTransaction need to transactions for deployments whose table
+// predates the ledger; a fresh CREATE TABLE already includes them.
+func initializeTransactionsLedgerColumns(db *sql.DB) error {
+	if _, err := db.Exec(`
+		ALTER TABLE transactions
+			ADD COLUMN IF NOT EXISTS idempotency_key VARCHAR(255),
+			ADD COLUMN IF NOT EXISTS reversed_transaction_id INT NULL
+	`); err != nil {
+		return fmt.Errorf("failed to add transactions ledger columns: %v", err)
+	}
+	if _, err := db.Exec(`
+		ALTER TABLE transactions MODIFY COLUMN type ENUM('payment', 'payout', 'reversal') NOT NULL
+	`); err != nil {
+		return fmt.Errorf("failed to widen transactions.type for reversals: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,766 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/argon2"
+)
+
+// ClientCertificate mirrors a row in the client_certificates table, which
+// tracks every certificate the local CA has issued so mtlsAuthMiddleware can
+// map a TLS peer certificate back to a user/role and check revocation.
+type ClientCertificate struct {
+	ID          int        `json:"id" db:"id"`
+	Serial      string     `json:"serial" db:"serial"`
+	Fingerprint string     `json:"fingerprint" db:"fingerprint"`
+	UserID      int        `json:"user_id" db:"user_id"`
+	Role        string     `json:"role" db:"role"`                         // admin, agent, bouncer, viewer
+	AllowedIPs  string     `json:"allowed_ips,omitempty" db:"allowed_ips"` // comma-separated CIDRs; empty means unrestricted
+	IssuedAt    time.Time  `json:"issued_at" db:"issued_at"`
+	ExpiresAt   time.Time  `json:"expires_at" db:"expires_at"`
+	RevokedAt   *time.Time `json:"revoked_at,omitempty" db:"revoked_at"`
+}
+
+// allowsIP reports whether ip satisfies cert's AllowedIPs restriction.
+// An empty AllowedIPs means unrestricted, matching endpointAllowed's "no rows
+// means no restriction" convention for cert_acl.
+func (cert *ClientCertificate) allowsIP(ip string) bool {
+	if cert.AllowedIPs == "" {
+		return true
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, cidr := range strings.Split(cert.AllowedIPs, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			if parsed.Equal(net.ParseIP(cidr)) {
+				return true
+			}
+			continue
+		}
+		if _, ipNet, err := net.ParseCIDR(cidr); err == nil && ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// CertificateAuthority issues and tracks short-lived client certificates for
+// backend services (webhook callers, monitoring agents, payment-gateway
+// callbacks) and the locked-down security dashboard.
+type CertificateAuthority struct {
+	db       *sql.DB
+	caCert   *x509.Certificate
+	caKey    *rsa.PrivateKey
+	caCertPEM []byte
+}
+
+// NewCertificateAuthority loads the CA's keypair from ca_identity, generating
+// and persisting one on first use. Certs a server process trusts and certs a
+// separate `cscli cert issue` invocation mints have to come from the same CA,
+// so unlike the encryption keypair EnhancedSecurityService used to generate
+// fresh per process (see KeyStore's doc comment in keystore.go), the CA
+// identity can't be regenerated on every call — doing so would make every
+// previously-issued client cert, and every cert issued by a concurrently
+// running process, fail verification against CAPool(). The private key is
+// KEK-wrapped the same way encryption_keys stores its RSA keypairs.
+func NewCertificateAuthority(db *sql.DB) (*CertificateAuthority, error) {
+	kek, err := caDeriveKEK(db)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive CA key-encryption key: %v", err)
+	}
+
+	var certPEMStr, wrappedKey sql.NullString
+	err = db.QueryRow("SELECT cert_pem, encrypted_private_key FROM ca_identity WHERE id = 1").Scan(&certPEMStr, &wrappedKey)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to load CA identity: %v", err)
+	}
+	if certPEMStr.Valid && wrappedKey.Valid {
+		caCert, caKey, err := decodeCAIdentity(kek, certPEMStr.String, wrappedKey.String)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode persisted CA identity: %v", err)
+		}
+		return &CertificateAuthority{db: db, caCert: caCert, caKey: caKey, caCertPEM: []byte(certPEMStr.String)}, nil
+	}
+
+	return generateAndStoreCAIdentity(db, kek)
+}
+
+// caDeriveKEK derives the key-encryption key ca_identity's private key is
+// wrapped under from KEY_ENCRYPTION_MASTER_SECRET and a salt persisted
+// alongside it, the same Argon2id derivation KeyStore uses for
+// encryption_keys (see NewKeyStore in keystore.go) so CA key material never
+// touches the DB in the clear.
+func caDeriveKEK(db *sql.DB) ([]byte, error) {
+	var salt []byte
+	err := db.QueryRow("SELECT kek_salt FROM ca_identity WHERE id = 1").Scan(&salt)
+	if err == sql.ErrNoRows {
+		salt = make([]byte, 32)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		if _, err := db.Exec("INSERT INTO ca_identity (id, kek_salt) VALUES (1, ?)", salt); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	masterSecret := getEnv("KEY_ENCRYPTION_MASTER_SECRET", "dev-only-insecure-master-secret")
+	return argon2.IDKey([]byte(masterSecret), salt, 1, 64*1024, 4, 32), nil
+}
+
+// generateAndStoreCAIdentity mints a fresh self-signed CA keypair and persists
+// it in ca_identity before returning, so every later NewCertificateAuthority
+// call on this database — this process's next restart, or a `cscli` run
+// against the same DB — loads this same CA rather than minting another.
+func generateAndStoreCAIdentity(db *sql.DB, kek []byte) (*CertificateAuthority, error) {
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate CA key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Krili Internal CA", Organization: []string{"Krili"}},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		IsCA:         true,
+		BasicConstraintsValid: true,
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to self-sign CA certificate: %v", err)
+	}
+
+	caCert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	caCertPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+
+	wrappedKey, err := caWrapPrivateKey(kek, x509.MarshalPKCS1PrivateKey(caKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap CA private key: %v", err)
+	}
+	if _, err := db.Exec("UPDATE ca_identity SET cert_pem = ?, encrypted_private_key = ? WHERE id = 1",
+		string(caCertPEM), wrappedKey); err != nil {
+		return nil, fmt.Errorf("failed to persist CA identity: %v", err)
+	}
+
+	return &CertificateAuthority{db: db, caCert: caCert, caKey: caKey, caCertPEM: caCertPEM}, nil
+}
+
+// decodeCAIdentity reverses generateAndStoreCAIdentity's persistence:
+// parsing the stored cert PEM and unwrapping the KEK-sealed private key DER.
+func decodeCAIdentity(kek []byte, certPEM, wrappedKey string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		return nil, nil, fmt.Errorf("invalid CA certificate PEM")
+	}
+	caCert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	der, err := caUnwrapPrivateKey(kek, wrappedKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	caKey, err := x509.ParsePKCS1PrivateKey(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return caCert, caKey, nil
+}
+
+// caWrapPrivateKey seals der under kek with AES-GCM, returning
+// base64(nonce || ciphertext); mirrors KeyStore.wrapPrivateKey in keystore.go.
+func caWrapPrivateKey(kek, der []byte) (string, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, der, nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func caUnwrapPrivateKey(kek []byte, wrapped string) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < gcm.NonceSize() {
+		return nil, fmt.Errorf("wrapped CA key too short")
+	}
+	nonce, ciphertext := raw[:gcm.NonceSize()], raw[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+// IssueClientCert signs a short-lived client certificate tied to userID+role
+// and records it in client_certificates so mtlsAuthMiddleware can look it up
+// by fingerprint later. allowedIPs is a comma-separated list of IPs/CIDRs the
+// cert may be presented from; empty means unrestricted.
+func (ca *CertificateAuthority) IssueClientCert(userID int, role, allowedIPs string, validFor time.Duration) (certPEM, keyPEM []byte, err error) {
+	clientKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(validFor)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: fmt.Sprintf("user-%d", userID), OrganizationalUnit: []string{role}},
+		NotBefore:    now,
+		NotAfter:     expiresAt,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, ca.caCert, &clientKey.PublicKey, ca.caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fingerprint := sha256.Sum256(derBytes)
+	_, err = ca.db.Exec(`
+		INSERT INTO client_certificates (serial, fingerprint, user_id, role, allowed_ips, issued_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, serial.String(), hex.EncodeToString(fingerprint[:]), userID, role, allowedIPs, now, expiresAt)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to record issued certificate: %v", err)
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(clientKey)})
+	return certPEM, keyPEM, nil
+}
+
+// RevokeClientCert marks a certificate revoked ahead of its natural expiry.
+func (ca *CertificateAuthority) RevokeClientCert(serial string) error {
+	_, err := ca.db.Exec(`UPDATE client_certificates SET revoked_at = ? WHERE serial = ? AND revoked_at IS NULL`, time.Now(), serial)
+	return err
+}
+
+// ListClientCerts returns every issued certificate, or just userIDFilter's
+// when it's non-empty, newest first. It backs both listClientCertificatesHandler
+// and the `cscli cert list` CLI subcommand.
+func (ca *CertificateAuthority) ListClientCerts(userIDFilter string) ([]ClientCertificate, error) {
+	query := `SELECT id, serial, fingerprint, user_id, role, allowed_ips, issued_at, expires_at, revoked_at FROM client_certificates`
+	args := []interface{}{}
+	if userIDFilter != "" {
+		query += ` WHERE user_id = ?`
+		args = append(args, userIDFilter)
+	}
+	query += ` ORDER BY issued_at DESC`
+
+	rows, err := ca.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list client certificates: %v", err)
+	}
+	defer rows.Close()
+
+	var certs []ClientCertificate
+	for rows.Next() {
+		var cert ClientCertificate
+		var revokedAt sql.NullTime
+		if err := rows.Scan(&cert.ID, &cert.Serial, &cert.Fingerprint, &cert.UserID, &cert.Role,
+			&cert.AllowedIPs, &cert.IssuedAt, &cert.ExpiresAt, &revokedAt); err != nil {
+			return nil, err
+		}
+		if revokedAt.Valid {
+			cert.RevokedAt = &revokedAt.Time
+		}
+		certs = append(certs, cert)
+	}
+	return certs, rows.Err()
+}
+
+// RotateClientCert issues a replacement certificate for the same user/role
+// while leaving the old one valid until its existing expiry.
+func (ca *CertificateAuthority) RotateClientCert(userID int, role, allowedIPs string, validFor time.Duration) (certPEM, keyPEM []byte, err error) {
+	return ca.IssueClientCert(userID, role, allowedIPs, validFor)
+}
+
+// CAPool returns a cert pool containing just the local CA, for use as the TLS
+// listener's ClientCAs when requiring client certificates.
+func (ca *CertificateAuthority) CAPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.caCert)
+	return pool
+}
+
+// authenticatePeerCert looks the TLS peer certificate presented on c up in
+// client_certificates by its SHA-256 fingerprint and checks it against
+// revocation, expiry, and its allowed_ips restriction. It underlies both
+// mtlsAuthMiddleware and enhancedAuthMiddleware's cert-or-JWT bypass, so the
+// lookup logic lives in exactly one place.
+func (ca *CertificateAuthority) authenticatePeerCert(c *gin.Context) (*ClientCertificate, error) {
+	if c.Request.TLS == nil || len(c.Request.TLS.PeerCertificates) == 0 {
+		return nil, fmt.Errorf("no client certificate presented")
+	}
+
+	peerCert := c.Request.TLS.PeerCertificates[0]
+	fingerprint := sha256.Sum256(peerCert.Raw)
+
+	var record ClientCertificate
+	var revokedAt sql.NullTime
+	err := ca.db.QueryRow(`
+		SELECT id, serial, fingerprint, user_id, role, allowed_ips, issued_at, expires_at, revoked_at
+		FROM client_certificates WHERE fingerprint = ?
+	`, hex.EncodeToString(fingerprint[:])).Scan(&record.ID, &record.Serial, &record.Fingerprint,
+		&record.UserID, &record.Role, &record.AllowedIPs, &record.IssuedAt, &record.ExpiresAt, &revokedAt)
+	if err != nil {
+		return nil, fmt.Errorf("Unknown client certificate")
+	}
+	if revokedAt.Valid {
+		return nil, fmt.Errorf("Client certificate has been revoked")
+	}
+	if time.Now().After(record.ExpiresAt) {
+		return nil, fmt.Errorf("Client certificate has expired")
+	}
+	if !record.allowsIP(c.ClientIP()) {
+		return nil, fmt.Errorf("Client certificate not permitted from this IP")
+	}
+
+	return &record, nil
+}
+
+// mtlsAuthMiddleware authenticates requests using the client certificate
+// presented on the TLS handshake, as an alternative to JWT bearer tokens for
+// backend services and the security dashboard. It sets user_id/is_admin in
+// the gin context the same way enhancedAuthMiddleware does for JWTs.
+func (ca *CertificateAuthority) mtlsAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		record, err := ca.authenticatePeerCert(c)
+		if err != nil {
+			status := http.StatusForbidden
+			if c.Request.TLS == nil || len(c.Request.TLS.PeerCertificates) == 0 {
+				status = http.StatusUnauthorized
+			}
+			c.JSON(status, gin.H{"error": err.Error()})
+			c.Abort()
+			return
+		}
+
+		c.Set("user_id", record.UserID)
+		c.Set("agent_id", record.ID)
+		c.Set("device_id", record.Fingerprint)
+		c.Set("client_cert_role", record.Role)
+		c.Set("is_admin", record.Role == "admin")
+		c.Set("auth_method", "mtls")
+		c.Next()
+	}
+}
+
+// crlHandler serves the current certificate revocation list as a simple JSON
+// document of revoked serials, consumed by agents that can't fetch a real CRL.
+func (ca *CertificateAuthority) crlHandler(c *gin.Context) {
+	rows, err := ca.db.Query(`SELECT serial, revoked_at FROM client_certificates WHERE revoked_at IS NOT NULL`)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load CRL"})
+		return
+	}
+	defer rows.Close()
+
+	type revocation struct {
+		Serial    string    `json:"serial"`
+		RevokedAt time.Time `json:"revoked_at"`
+	}
+	var revoked []revocation
+	for rows.Next() {
+		var r revocation
+		if err := rows.Scan(&r.Serial, &r.RevokedAt); err == nil {
+			revoked = append(revoked, r)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"issuer": "Krili Internal CA", "revoked": revoked, "generated_at": time.Now()})
+}
+
+// tlsConfigWithOptionalClientAuth builds a TLS config that requests (but does
+// not require at the handshake level) a client certificate, so that the same
+// listener can serve both JWT-authenticated traffic and mTLS-authenticated
+// /api/v1/security and /api/v1/agents routes. Per-route enforcement happens in
+// mtlsAuthMiddleware.
+func (ca *CertificateAuthority) tlsConfigWithOptionalClientAuth() *tls.Config {
+	return &tls.Config{
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		ClientCAs:  ca.CAPool(),
+		MinVersion: tls.VersionTLS12,
+	}
+}
+
+// tlsConfigRequireClientAuth builds a TLS config for config.MTLSPort: a
+// dedicated listener, separate from the main server port, that rejects the
+// handshake outright unless the caller presents a certificate signed by this
+// CA. Point admin-console and machine-to-machine traffic at this port
+// instead of the shared one when the deployment can afford a second
+// listener, so those endpoints can't be reached with a JWT alone even if a
+// route's middleware were ever misconfigured.
+func (ca *CertificateAuthority) tlsConfigRequireClientAuth() *tls.Config {
+	return &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  ca.CAPool(),
+		MinVersion: tls.VersionTLS12,
+	}
+}
+
+// initializeCertificateTables creates the client_certificates table used to
+// track issued, rotated, and revoked mTLS client certificates, plus the
+// single-row ca_identity table NewCertificateAuthority persists the local
+// CA's own keypair in.
+func initializeCertificateTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS client_certificates (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			serial VARCHAR(64) NOT NULL,
+			fingerprint VARCHAR(64) NOT NULL,
+			user_id INT NOT NULL,
+			role ENUM('admin', 'agent', 'bouncer', 'viewer') NOT NULL,
+			allowed_ips VARCHAR(500) NOT NULL DEFAULT '',
+			issued_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			expires_at TIMESTAMP NOT NULL,
+			revoked_at TIMESTAMP NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			UNIQUE KEY unique_fingerprint (fingerprint),
+			INDEX idx_serial (serial),
+			INDEX idx_expires_at (expires_at)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create client_certificates table: %v", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS ca_identity (
+			id INT PRIMARY KEY DEFAULT 1,
+			kek_salt VARBINARY(64) NOT NULL,
+			cert_pem TEXT,
+			encrypted_private_key TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create ca_identity table: %v", err)
+	}
+	return nil
+}
+
+// initializeCertificateAllowedIPsColumn extends client_certificates with the
+// allowed_ips column introduced alongside mtlsAuthMiddleware's per-cert IP
+// allowlist enforcement, for deployments whose table predates it; a fresh
+// CREATE TABLE already includes it via initializeCertificateTables.
+func initializeCertificateAllowedIPsColumn(db *sql.DB) error {
+	_, err := db.Exec(`
+		ALTER TABLE client_certificates
+			ADD COLUMN IF NOT EXISTS allowed_ips VARCHAR(500) NOT NULL DEFAULT ''`)
+	if err != nil {
+		return fmt.Errorf("failed to add allowed_ips to client_certificates: %v", err)
+	}
+	return nil
+}
+
+// ServiceAccount mirrors a service_accounts row: a machine identity (CI
+// pipeline, partner integration, payment-gateway callback) identified by the
+// CN/OU on its client certificate rather than a user login.
+type ServiceAccount struct {
+	ID           int    `json:"id" db:"id"`
+	CommonName   string `json:"common_name" db:"common_name"`
+	OrgUnit      string `json:"org_unit" db:"org_unit"`
+	UserID       int    `json:"user_id" db:"user_id"`
+	AccountType  string `json:"account_type" db:"account_type"`
+	IsActive     bool   `json:"is_active" db:"is_active"`
+}
+
+// crlFileWatcher tracks revoked certificate serials read from a flat CRL file
+// (one hex serial per line), reloaded on SIGHUP so an operator can revoke a
+// compromised high-value client cert without restarting the process, and on
+// a timer via Start so a CRL distributed by some other process (a sync job
+// pulling from an upstream CA, a config-management push) gets picked up even
+// when nothing sends the signal.
+type crlFileWatcher struct {
+	mutex   sync.RWMutex
+	path    string
+	revoked map[string]bool
+	stop    chan struct{}
+}
+
+// newCRLFileWatcher loads path (if set) and starts listening for SIGHUP to
+// reload it. An empty path disables file-based revocation entirely, and
+// CertAuthMiddleware then makes no revocation check at all
+// (client_certificates.revoked_at is only consulted by authenticatePeerCert).
+func newCRLFileWatcher(path string) *crlFileWatcher {
+	w := &crlFileWatcher{path: path, revoked: make(map[string]bool), stop: make(chan struct{})}
+	if path == "" {
+		return w
+	}
+
+	w.reload()
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			w.reload()
+		}
+	}()
+
+	return w
+}
+
+// Start begins reloading the CRL file every interval, in addition to the
+// SIGHUP-triggered reload newCRLFileWatcher already wires up. A no-op when
+// the watcher was constructed with an empty path. Call Stop to end it.
+func (w *crlFileWatcher) Start(interval time.Duration) {
+	if w.path == "" {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w.reload()
+			case <-w.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (w *crlFileWatcher) Stop() {
+	close(w.stop)
+}
+
+func (w *crlFileWatcher) reload() {
+	file, err := os.Open(w.path)
+	if err != nil {
+		log.Printf("⚠️  Failed to open CRL file %s: %v", w.path, err)
+		return
+	}
+	defer file.Close()
+
+	revoked := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		serial := strings.TrimSpace(scanner.Text())
+		if serial == "" || strings.HasPrefix(serial, "#") {
+			continue
+		}
+		revoked[strings.ToLower(serial)] = true
+	}
+
+	w.mutex.Lock()
+	w.revoked = revoked
+	w.mutex.Unlock()
+	log.Printf("📜 Reloaded CRL file %s (%d revoked serials)", w.path, len(revoked))
+}
+
+func (w *crlFileWatcher) isRevoked(serialHex string) bool {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	return w.revoked[strings.ToLower(serialHex)]
+}
+
+// CertAuthMiddleware authenticates machine clients (CI pipelines, partner
+// integrations, payment-gateway callbacks) by their TLS client certificate
+// instead of a JWT. It maps the cert's CN/OU to a service_accounts row,
+// enforces the file-based CRL and per-CN cert_acl endpoint allowlist, and
+// logs the cert's SHA-256 fingerprint on every request for audit purposes.
+func CertAuthMiddleware(ca *CertificateAuthority, crl *crlFileWatcher) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.TLS == nil || len(c.Request.TLS.PeerCertificates) == 0 {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Client certificate required"})
+			c.Abort()
+			return
+		}
+
+		peerCert := c.Request.TLS.PeerCertificates[0]
+		fingerprint := sha256.Sum256(peerCert.Raw)
+		fingerprintHex := hex.EncodeToString(fingerprint[:])
+
+		if crl != nil && crl.isRevoked(peerCert.SerialNumber.Text(16)) {
+			ca.logCertEvent(fingerprintHex, peerCert.Subject.CommonName, "cert_revoked_by_crl_file", c)
+			c.JSON(http.StatusForbidden, gin.H{"error": "Client certificate has been revoked"})
+			c.Abort()
+			return
+		}
+
+		commonName := peerCert.Subject.CommonName
+		orgUnit := ""
+		if len(peerCert.Subject.OrganizationalUnit) > 0 {
+			orgUnit = peerCert.Subject.OrganizationalUnit[0]
+		}
+
+		var account ServiceAccount
+		err := ca.db.QueryRow(`
+			SELECT id, common_name, org_unit, user_id, account_type, is_active
+			FROM service_accounts WHERE common_name = ? AND is_active = true
+		`, commonName).Scan(&account.ID, &account.CommonName, &account.OrgUnit,
+			&account.UserID, &account.AccountType, &account.IsActive)
+		if err != nil {
+			ca.logCertEvent(fingerprintHex, commonName, "unknown_service_account", c)
+			c.JSON(http.StatusForbidden, gin.H{"error": "Unrecognized service account certificate"})
+			c.Abort()
+			return
+		}
+
+		if !ca.endpointAllowed(commonName, c.Request.URL.Path) {
+			ca.logCertEvent(fingerprintHex, commonName, "cert_acl_denied", c)
+			c.JSON(http.StatusForbidden, gin.H{"error": "Certificate not authorized for this endpoint"})
+			c.Abort()
+			return
+		}
+
+		ca.logCertEvent(fingerprintHex, commonName, "service_account_request", c)
+
+		c.Set("user_id", account.UserID)
+		c.Set("agent_id", account.ID)
+		c.Set("account_type", "service")
+		c.Set("service_account_cn", commonName)
+		c.Set("service_account_ou", orgUnit)
+		c.Next()
+	}
+}
+
+// endpointAllowed checks the cert_acl table for an explicit allow entry
+// matching commonName and path. An empty ACL for a CN means "no restriction"
+// so existing service accounts keep working until an operator opts them in.
+func (ca *CertificateAuthority) endpointAllowed(commonName, path string) bool {
+	var total int
+	if err := ca.db.QueryRow("SELECT COUNT(*) FROM cert_acl WHERE common_name = ?", commonName).Scan(&total); err != nil || total == 0 {
+		return true
+	}
+
+	var matched int
+	ca.db.QueryRow("SELECT COUNT(*) FROM cert_acl WHERE common_name = ? AND ? LIKE allowed_endpoint",
+		commonName, path).Scan(&matched)
+	return matched > 0
+}
+
+// logCertEvent records the presented certificate's fingerprint against
+// security_events for every request CertAuthMiddleware handles, allowed or
+// denied. mtlsAuthMiddleware does not call it.
+func (ca *CertificateAuthority) logCertEvent(fingerprint, commonName, eventType string, c *gin.Context) {
+	_, err := ca.db.Exec(`
+		INSERT INTO security_events (event_type, severity, description, ip_address, user_agent)
+		VALUES (?, 'info', ?, ?, ?)
+	`, eventType, fmt.Sprintf("cert_fingerprint=%s cn=%s path=%s", fingerprint, commonName, c.Request.URL.Path),
+		c.ClientIP(), c.GetHeader("User-Agent"))
+	if err != nil {
+		log.Printf("⚠️  Failed to log cert auth event: %v", err)
+	}
+}
+
+// listServiceAccountsHandler is the /admin inventory view of every
+// registered service account, for operators auditing which certificates are
+// allowed to authenticate as machine identities.
+func (sth *SecureTransactionHandler) listServiceAccountsHandler(c *gin.Context) {
+	rows, err := sth.db.Query("SELECT id, common_name, org_unit, account_type, is_active FROM service_accounts")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load service accounts"})
+		return
+	}
+	defer rows.Close()
+
+	var accounts []ServiceAccount
+	for rows.Next() {
+		var a ServiceAccount
+		if err := rows.Scan(&a.ID, &a.CommonName, &a.OrgUnit, &a.AccountType, &a.IsActive); err == nil {
+			accounts = append(accounts, a)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"service_accounts": accounts})
+}
+
+// initializeServiceAccountTables creates the service_accounts and cert_acl
+// tables backing CertAuthMiddleware's CN -> identity and CN -> endpoint ACL
+// lookups.
+func initializeServiceAccountTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS service_accounts (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			common_name VARCHAR(255) NOT NULL,
+			org_unit VARCHAR(255),
+			user_id INT NOT NULL,
+			account_type VARCHAR(50) DEFAULT 'service',
+			is_active BOOLEAN DEFAULT TRUE,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			UNIQUE KEY unique_common_name (common_name)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create service_accounts table: %v", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS cert_acl (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			common_name VARCHAR(255) NOT NULL,
+			allowed_endpoint VARCHAR(255) NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			INDEX idx_common_name (common_name)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create cert_acl table: %v", err)
+	}
+	return nil
+}
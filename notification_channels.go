@@ -0,0 +1,742 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// notificationDeliveryWorkers/QueueSize bound the channel-delivery worker
+// pool the same way alertDeliveryWorkers/QueueSize bound AlertDispatcher's:
+// a burst of notifications (or one slow channel, e.g. SMTP timing out)
+// can't spin up unbounded goroutines or block the HTTP request that
+// created the notification.
+const (
+	notificationDeliveryWorkers   = 4
+	notificationDeliveryQueueSize = 256
+
+	// notificationMaxDeliveryAttempts bounds the retry schedule; once a
+	// (notification, channel) pair exceeds this it moves to 'dead_letter'
+	// instead of being retried forever.
+	notificationMaxDeliveryAttempts = 6
+)
+
+// NotificationRecipient is the resolved contact information Publish snapshots
+// at dispatch time, so a later retry delivers to the address/token/webhook
+// that was current when the notification fired rather than whatever the
+// user's profile says now.
+type NotificationRecipient struct {
+	UserID        int      `json:"user_id"`
+	Email         string   `json:"email,omitempty"`
+	Phone         string   `json:"phone,omitempty"`
+	PushTokens    []string `json:"push_tokens,omitempty"`
+	WebhookURL    string   `json:"webhook_url,omitempty"`
+	WebhookSecret string   `json:"-"`
+}
+
+// NotificationChannel delivers one notification to one recipient over a
+// specific medium. Name identifies the channel in NotificationPreferences
+// and the notification_deliveries table.
+type NotificationChannel interface {
+	Name() string
+	Send(ctx context.Context, recipient NotificationRecipient, notif SecurityNotification) error
+}
+
+// smtpChannel delivers plain-text email via an SMTP relay.
+type smtpChannel struct {
+	addr string // host:port
+	from string
+	auth smtp.Auth
+}
+
+func newSMTPChannel(addr, from, username, password, host string) *smtpChannel {
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+	return &smtpChannel{addr: addr, from: from, auth: auth}
+}
+
+func (s *smtpChannel) Name() string { return "email" }
+
+func (s *smtpChannel) Send(ctx context.Context, recipient NotificationRecipient, notif SecurityNotification) error {
+	if recipient.Email == "" {
+		return fmt.Errorf("email channel: recipient has no email address")
+	}
+	msg := fmt.Sprintf("To: %s\r\nSubject: %s\r\n\r\n%s\r\n", recipient.Email, notif.Title, notif.Message)
+	return smtp.SendMail(s.addr, s.auth, s.from, []string{recipient.Email}, []byte(msg))
+}
+
+// twilioChannel delivers SMS via Twilio's Messages REST API.
+type twilioChannel struct {
+	accountSID string
+	authToken  string
+	fromNumber string
+	client     *http.Client
+}
+
+func newTwilioChannel(accountSID, authToken, fromNumber string) *twilioChannel {
+	return &twilioChannel{
+		accountSID: accountSID, authToken: authToken, fromNumber: fromNumber,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (t *twilioChannel) Name() string { return "sms" }
+
+func (t *twilioChannel) Send(ctx context.Context, recipient NotificationRecipient, notif SecurityNotification) error {
+	if recipient.Phone == "" {
+		return fmt.Errorf("sms channel: recipient has no phone number")
+	}
+
+	form := url.Values{
+		"To":   {recipient.Phone},
+		"From": {t.fromNumber},
+		"Body": {fmt.Sprintf("%s: %s", notif.Title, notif.Message)},
+	}
+	endpoint := fmt.Sprintf("https://api.twilio.com/2010-04-01/Accounts/%s/Messages.json", t.accountSID)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(t.accountSID, t.authToken)
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("twilio returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// pushChannel delivers web/mobile push via Firebase Cloud Messaging's legacy
+// HTTP API, which both FCM-native Android clients and (via FCM's APNs
+// bridge) iOS/APNS devices can receive through, so one channel covers both
+// without a separate APNS client/certificate.
+type pushChannel struct {
+	serverKey string
+	client    *http.Client
+}
+
+func newPushChannel(serverKey string) *pushChannel {
+	return &pushChannel{serverKey: serverKey, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (p *pushChannel) Name() string { return "push" }
+
+func (p *pushChannel) Send(ctx context.Context, recipient NotificationRecipient, notif SecurityNotification) error {
+	if len(recipient.PushTokens) == 0 {
+		return fmt.Errorf("push channel: recipient has no registered device tokens")
+	}
+
+	payload := map[string]interface{}{
+		"registration_ids": recipient.PushTokens,
+		"notification": map[string]string{
+			"title": notif.Title,
+			"body":  notif.Message,
+		},
+		"data": map[string]interface{}{"notification_id": notif.ID, "type": notif.Type},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://fcm.googleapis.com/fcm/send", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "key="+p.serverKey)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("fcm returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// webhookChannel POSTs the notification to a user-registered HTTP endpoint,
+// HMAC-SHA256-signing the body the same way webhookSink does for admin
+// alert webhooks (see alert_dispatcher.go) so the receiver can verify it
+// came from us.
+type webhookChannel struct {
+	client *http.Client
+}
+
+func newWebhookChannel() *webhookChannel {
+	return &webhookChannel{client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (w *webhookChannel) Name() string { return "webhook" }
+
+func (w *webhookChannel) Send(ctx context.Context, recipient NotificationRecipient, notif SecurityNotification) error {
+	if recipient.WebhookURL == "" {
+		return fmt.Errorf("webhook channel: recipient has no registered webhook")
+	}
+
+	body, err := json.Marshal(notif)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, recipient.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if recipient.WebhookSecret != "" {
+		mac := hmac.New(sha256.New, []byte(recipient.WebhookSecret))
+		mac.Write(body)
+		req.Header.Set("X-Krili-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// newNotificationChannelsFromEnv builds the channel set from env vars:
+// SMTP_ADDR/SMTP_FROM/SMTP_USERNAME/SMTP_PASSWORD/SMTP_HOST for email,
+// TWILIO_ACCOUNT_SID/TWILIO_AUTH_TOKEN/TWILIO_FROM_NUMBER for SMS, and
+// FCM_SERVER_KEY for push. webhook is always registered since its
+// destination is per-recipient rather than a fixed env-configured endpoint.
+func newNotificationChannelsFromEnv() map[string]NotificationChannel {
+	channels := make(map[string]NotificationChannel)
+	channels["webhook"] = newWebhookChannel()
+
+	if addr := os.Getenv("SMTP_ADDR"); addr != "" {
+		channels["email"] = newSMTPChannel(addr, os.Getenv("SMTP_FROM"), os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), os.Getenv("SMTP_HOST"))
+	}
+	if sid := os.Getenv("TWILIO_ACCOUNT_SID"); sid != "" {
+		channels["sms"] = newTwilioChannel(sid, os.Getenv("TWILIO_AUTH_TOKEN"), os.Getenv("TWILIO_FROM_NUMBER"))
+	}
+	if key := os.Getenv("FCM_SERVER_KEY"); key != "" {
+		channels["push"] = newPushChannel(key)
+	}
+
+	return channels
+}
+
+// notificationDeliveryJob is one (notification, channel) delivery attempt
+// queued for a worker, whether freshly dispatched or picked back up by
+// retryDue. notif and recipient are snapshotted at enqueue time so a retry
+// delivers the same content to the same address even if the user's
+// profile/preferences changed in between.
+type notificationDeliveryJob struct {
+	notif      SecurityNotification
+	recipient  NotificationRecipient
+	channel    string
+	deliveryID int64
+	attempt    int
+}
+
+// defaultNotificationChannels is the fallback channel set for a
+// notification type with no NotificationPreferences row yet, e.g.
+// booking_request -> [push, email], matching the request's example;
+// everything else defaults to push+email, and "marketing" is
+// deliberately narrower (email only) since it's the one type users most
+// often want to opt down rather than up.
+var defaultNotificationChannels = map[string][]string{
+	"marketing": {"email"},
+}
+
+func defaultChannelsFor(notificationType string) []string {
+	if channels, ok := defaultNotificationChannels[notificationType]; ok {
+		return channels
+	}
+	return []string{"push", "email"}
+}
+
+// NotificationDispatcher fans a published SecurityNotification out over
+// every channel the recipient's NotificationPreferences select for its
+// type, queuing the HTTP-request-blocking work (SMTP/Twilio/FCM/webhook
+// calls) onto a worker pool exactly like AlertDispatcher does for external
+// security alert sinks.
+type NotificationDispatcher struct {
+	db       *sql.DB
+	channels map[string]NotificationChannel
+	jobs     chan notificationDeliveryJob
+	stop     chan struct{}
+}
+
+func NewNotificationDispatcher(db *sql.DB, channels map[string]NotificationChannel) *NotificationDispatcher {
+	return &NotificationDispatcher{
+		db:       db,
+		channels: channels,
+		jobs:     make(chan notificationDeliveryJob, notificationDeliveryQueueSize),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start launches the delivery worker pool, the background retry poller, and
+// the digest sweep that flushes scheduled_for rows once their hourly/daily/
+// quiet-hours window ends (see notification_digest.go). Call Stop during
+// graceful shutdown.
+func (d *NotificationDispatcher) Start(retryInterval time.Duration) {
+	for i := 0; i < notificationDeliveryWorkers; i++ {
+		go d.runWorker()
+	}
+
+	go func() {
+		ticker := time.NewTicker(retryInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				d.retryDue()
+			case <-d.stop:
+				return
+			}
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(digestSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				d.digestSweep()
+			case <-d.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (d *NotificationDispatcher) Stop() {
+	close(d.stop)
+}
+
+func (d *NotificationDispatcher) runWorker() {
+	for {
+		select {
+		case job := <-d.jobs:
+			d.deliver(job)
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// enqueue hands a job to the worker pool without blocking the caller; if the
+// queue is full the job is scheduled straight into the retry path instead of
+// stalling Publish.
+func (d *NotificationDispatcher) enqueue(job notificationDeliveryJob) {
+	select {
+	case d.jobs <- job:
+	default:
+		d.scheduleRetry(job.deliveryID, job.attempt, fmt.Errorf("delivery queue full"))
+	}
+}
+
+func (d *NotificationDispatcher) deliver(job notificationDeliveryJob) {
+	channel, ok := d.channels[job.channel]
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	if err := channel.Send(ctx, job.recipient, job.notif); err != nil {
+		log.Printf("⚠️  notification dispatcher: %s delivery failed for notification %d: %v", job.channel, job.notif.ID, err)
+		d.scheduleRetry(job.deliveryID, job.attempt, err)
+		return
+	}
+	d.markDelivered(job.deliveryID)
+}
+
+// Dispatch resolves userID's channel preferences for notif.Type, persists
+// one notification_deliveries row per selected channel, and either queues it
+// for immediate delivery or, per the recipient's configured DeliveryMode,
+// leaves it scheduled for a later digest sweep (see notification_digest.go).
+// Called from NotificationService.Publish so an HTTP request that created a
+// notification never blocks on an SMTP/Twilio/FCM/webhook round trip.
+func (d *NotificationDispatcher) Dispatch(userID int, notif SecurityNotification) {
+	recipient, err := d.resolveRecipient(userID)
+	if err != nil {
+		log.Printf("⚠️  notification dispatcher: failed to resolve recipient %d: %v", userID, err)
+		return
+	}
+
+	mode := "immediate"
+	if !isUrgentNotificationType(notif.Type) {
+		mode = d.deliveryModeFor(userID, notif.Type)
+	}
+	scheduledFor := computeScheduledFor(mode, time.Now())
+
+	for _, channelName := range d.channelsFor(userID, notif.Type) {
+		if _, ok := d.channels[channelName]; !ok {
+			continue
+		}
+
+		if scheduledFor.IsZero() {
+			deliveryID, err := d.recordAttempt(userID, notif, recipient, channelName, "pending", time.Time{})
+			if err != nil {
+				log.Printf("⚠️  notification dispatcher: failed to record delivery for notification %d/%s: %v", notif.ID, channelName, err)
+				continue
+			}
+			d.enqueue(notificationDeliveryJob{notif: notif, recipient: recipient, channel: channelName, deliveryID: deliveryID})
+			continue
+		}
+
+		if _, err := d.recordAttempt(userID, notif, recipient, channelName, "scheduled", scheduledFor); err != nil {
+			log.Printf("⚠️  notification dispatcher: failed to schedule digest delivery for notification %d/%s: %v", notif.ID, channelName, err)
+		}
+	}
+}
+
+// deliveryModeFor reads the caller's configured DeliveryMode for
+// notificationType from notification_preferences.delivery_mode, defaulting
+// to "immediate" when no preference row exists yet.
+func (d *NotificationDispatcher) deliveryModeFor(userID int, notificationType string) string {
+	var mode string
+	if err := d.db.QueryRow(`
+		SELECT delivery_mode FROM notification_preferences WHERE user_id = ? AND notification_type = ?
+	`, userID, notificationType).Scan(&mode); err != nil || mode == "" {
+		return "immediate"
+	}
+	return mode
+}
+
+// channelsFor reads user's NotificationPreferences row for notificationType,
+// falling back to defaultChannelsFor when none has been saved yet.
+func (d *NotificationDispatcher) channelsFor(userID int, notificationType string) []string {
+	var channelsJSON string
+	err := d.db.QueryRow(`
+		SELECT channels FROM notification_preferences WHERE user_id = ? AND notification_type = ?
+	`, userID, notificationType).Scan(&channelsJSON)
+	if err != nil {
+		return defaultChannelsFor(notificationType)
+	}
+
+	var channels []string
+	if err := json.Unmarshal([]byte(channelsJSON), &channels); err != nil {
+		return defaultChannelsFor(notificationType)
+	}
+	return channels
+}
+
+// resolveRecipient reads the contact details Dispatch needs directly from
+// users (email, phone_number), push_tokens, and user_webhooks.
+func (d *NotificationDispatcher) resolveRecipient(userID int) (NotificationRecipient, error) {
+	return resolveNotificationRecipient(d.db, userID)
+}
+
+// resolveNotificationRecipient is the shared lookup behind
+// NotificationDispatcher.resolveRecipient; pulled out to a package-level
+// function so other callers that need a NotificationChannel-shaped
+// recipient for a user (e.g. TanService) don't have to stand up a whole
+// dispatcher just to reuse it.
+func resolveNotificationRecipient(db *sql.DB, userID int) (NotificationRecipient, error) {
+	recipient := NotificationRecipient{UserID: userID}
+
+	var phone sql.NullString
+	if err := db.QueryRow("SELECT email, phone_number FROM users WHERE id = ?", userID).Scan(&recipient.Email, &phone); err != nil {
+		return recipient, err
+	}
+	if phone.Valid {
+		recipient.Phone = phone.String
+	}
+
+	rows, err := db.Query("SELECT token FROM push_tokens WHERE user_id = ?", userID)
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			var token string
+			if rows.Scan(&token) == nil {
+				recipient.PushTokens = append(recipient.PushTokens, token)
+			}
+		}
+	}
+
+	var webhookURL, webhookSecret sql.NullString
+	if err := db.QueryRow("SELECT url, secret FROM user_webhooks WHERE user_id = ?", userID).Scan(&webhookURL, &webhookSecret); err == nil {
+		recipient.WebhookURL = webhookURL.String
+		recipient.WebhookSecret = webhookSecret.String
+	}
+
+	return recipient, nil
+}
+
+// recordAttempt inserts one notification_deliveries row. status is either
+// "pending" (next_attempt_at = now, ready for the worker pool) or
+// "scheduled" (scheduledFor is when the digest sweep should pick it up).
+func (d *NotificationDispatcher) recordAttempt(userID int, notif SecurityNotification, recipient NotificationRecipient, channel, status string, scheduledFor time.Time) (int64, error) {
+	notifJSON, err := json.Marshal(notif)
+	if err != nil {
+		return 0, err
+	}
+	recipientJSON, err := json.Marshal(recipient)
+	if err != nil {
+		return 0, err
+	}
+
+	var result sql.Result
+	if status == "scheduled" {
+		result, err = d.db.Exec(`
+			INSERT INTO notification_deliveries (notification_id, user_id, channel, status, attempt, notification_snapshot, recipient_snapshot, scheduled_for, created_at)
+			VALUES (?, ?, ?, 'scheduled', 0, ?, ?, ?, NOW())
+		`, notif.ID, userID, channel, notifJSON, recipientJSON, scheduledFor)
+	} else {
+		result, err = d.db.Exec(`
+			INSERT INTO notification_deliveries (notification_id, user_id, channel, status, attempt, notification_snapshot, recipient_snapshot, next_attempt_at, created_at)
+			VALUES (?, ?, ?, 'pending', 0, ?, ?, NOW(), NOW())
+		`, notif.ID, userID, channel, notifJSON, recipientJSON)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func (d *NotificationDispatcher) markDelivered(deliveryID int64) {
+	if _, err := d.db.Exec(`
+		UPDATE notification_deliveries SET status = 'delivered', delivered_at = NOW() WHERE id = ?
+	`, deliveryID); err != nil {
+		log.Printf("⚠️  notification dispatcher: failed to mark delivery %d delivered: %v", deliveryID, err)
+	}
+}
+
+// scheduleRetry marks a failed delivery for retry with the same exponential
+// backoff schedule the payment retry queue and AlertDispatcher use (see
+// retryBackoff in idempotency.go), moving it to the dead_letter state
+// instead once it has exhausted notificationMaxDeliveryAttempts.
+func (d *NotificationDispatcher) scheduleRetry(deliveryID int64, attempt int, deliveryErr error) {
+	if attempt+1 >= notificationMaxDeliveryAttempts {
+		if _, err := d.db.Exec(`
+			UPDATE notification_deliveries SET status = 'dead_letter', attempt = ?, last_error = ? WHERE id = ?
+		`, attempt+1, deliveryErr.Error(), deliveryID); err != nil {
+			log.Printf("⚠️  notification dispatcher: failed to dead-letter delivery %d: %v", deliveryID, err)
+		}
+		return
+	}
+
+	_, err := d.db.Exec(`
+		UPDATE notification_deliveries
+		SET status = 'pending', attempt = ?, last_error = ?, next_attempt_at = ?
+		WHERE id = ?
+	`, attempt+1, deliveryErr.Error(), time.Now().Add(retryBackoff(attempt)), deliveryID)
+	if err != nil {
+		log.Printf("⚠️  notification dispatcher: failed to schedule retry for delivery %d: %v", deliveryID, err)
+	}
+}
+
+// retryDue re-queues every pending notification_deliveries row whose
+// next_attempt_at has passed, rebuilding the job from the snapshots taken
+// at Dispatch time rather than re-reading the (possibly since-changed)
+// notification/recipient.
+func (d *NotificationDispatcher) retryDue() {
+	rows, err := d.db.Query(`
+		SELECT id, channel, attempt, notification_snapshot, recipient_snapshot
+		FROM notification_deliveries
+		WHERE status = 'pending' AND next_attempt_at <= NOW() AND attempt < ?
+	`, notificationMaxDeliveryAttempts)
+	if err != nil {
+		log.Printf("⚠️  notification dispatcher: failed to load due retries: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	var due []notificationDeliveryJob
+	for rows.Next() {
+		var job notificationDeliveryJob
+		var notifJSON, recipientJSON []byte
+		if err := rows.Scan(&job.deliveryID, &job.channel, &job.attempt, &notifJSON, &recipientJSON); err != nil {
+			continue
+		}
+		if err := json.Unmarshal(notifJSON, &job.notif); err != nil {
+			continue
+		}
+		if err := json.Unmarshal(recipientJSON, &job.recipient); err != nil {
+			continue
+		}
+		due = append(due, job)
+	}
+
+	for _, job := range due {
+		d.enqueue(job)
+	}
+}
+
+// initializeNotificationDeliveryTables creates the tables the channel
+// delivery subsystem needs: per-(notification_type, user) channel
+// preferences, the queued-delivery/dead-letter table, registered push
+// tokens, and per-user webhook registration. A fresh deployment's users
+// table doesn't have phone_number yet either, so that's widened here too.
+func initializeNotificationDeliveryTables(db *sql.DB) error {
+	statements := []string{
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS phone_number VARCHAR(20)`,
+
+		`CREATE TABLE IF NOT EXISTS notification_preferences (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			user_id INT NOT NULL,
+			notification_type VARCHAR(50) NOT NULL,
+			channels JSON NOT NULL,
+			delivery_mode VARCHAR(50) NOT NULL DEFAULT 'immediate',
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			UNIQUE KEY uniq_user_notification_type (user_id, notification_type)
+		)`,
+		`ALTER TABLE notification_preferences ADD COLUMN IF NOT EXISTS delivery_mode VARCHAR(50) NOT NULL DEFAULT 'immediate'`,
+
+		`CREATE TABLE IF NOT EXISTS notification_deliveries (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			notification_id INT NOT NULL,
+			user_id INT NOT NULL,
+			channel VARCHAR(20) NOT NULL,
+			status ENUM('pending', 'scheduled', 'delivered', 'dead_letter') NOT NULL DEFAULT 'pending',
+			attempt INT NOT NULL DEFAULT 0,
+			last_error TEXT,
+			notification_snapshot JSON NOT NULL,
+			recipient_snapshot JSON NOT NULL,
+			scheduled_for TIMESTAMP NULL,
+			next_attempt_at TIMESTAMP NULL,
+			delivered_at TIMESTAMP NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			INDEX idx_status_next_attempt (status, next_attempt_at),
+			INDEX idx_status_scheduled_for (status, scheduled_for),
+			INDEX idx_notification_id (notification_id),
+			INDEX idx_user_channel (user_id, channel)
+		)`,
+		`ALTER TABLE notification_deliveries ADD COLUMN IF NOT EXISTS user_id INT NOT NULL DEFAULT 0`,
+		`ALTER TABLE notification_deliveries ADD COLUMN IF NOT EXISTS scheduled_for TIMESTAMP NULL`,
+		`ALTER TABLE notification_deliveries MODIFY COLUMN status ENUM('pending', 'scheduled', 'delivered', 'dead_letter') NOT NULL DEFAULT 'pending'`,
+
+		`CREATE TABLE IF NOT EXISTS push_tokens (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			user_id INT NOT NULL,
+			token VARCHAR(255) NOT NULL,
+			platform VARCHAR(20) NOT NULL DEFAULT 'unknown',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			UNIQUE KEY uniq_user_token (user_id, token)
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS user_webhooks (
+			user_id INT NOT NULL PRIMARY KEY,
+			url VARCHAR(500) NOT NULL,
+			secret VARCHAR(255) NOT NULL DEFAULT '',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+	}
+
+	for _, stmt := range statements {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to initialize notification delivery tables: %v", err)
+		}
+	}
+	return nil
+}
+
+// notificationPreferencesRequest is PUT /security/notifications/preferences's
+// body: a full replacement of the caller's per-type channel selection, plus
+// an optional webhook registration since a webhook target is per-user
+// rather than per-type.
+type notificationPreferencesRequest struct {
+	Preferences   map[string][]string `json:"preferences"` // notification_type -> channel names
+	WebhookURL    string              `json:"webhook_url,omitempty"`
+	WebhookSecret string              `json:"webhook_secret,omitempty"`
+}
+
+// setNotificationPreferencesHandler handles
+// PUT /security/notifications/preferences.
+func (sth *SecureTransactionHandler) setNotificationPreferencesHandler(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	var req notificationPreferencesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	for notificationType, channels := range req.Preferences {
+		channelsJSON, err := json.Marshal(channels)
+		if err != nil {
+			continue
+		}
+		if _, err := sth.db.Exec(`
+			INSERT INTO notification_preferences (user_id, notification_type, channels)
+			VALUES (?, ?, ?)
+			ON DUPLICATE KEY UPDATE channels = VALUES(channels)
+		`, userID, notificationType, channelsJSON); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to save preference for %s", notificationType)})
+			return
+		}
+	}
+
+	if req.WebhookURL != "" {
+		if _, err := sth.db.Exec(`
+			INSERT INTO user_webhooks (user_id, url, secret)
+			VALUES (?, ?, ?)
+			ON DUPLICATE KEY UPDATE url = VALUES(url), secret = VALUES(secret)
+		`, userID, req.WebhookURL, req.WebhookSecret); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save webhook registration"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "notification preferences updated"})
+}
+
+// getNotificationPreferencesHandler handles
+// GET /security/notifications/preferences.
+func (sth *SecureTransactionHandler) getNotificationPreferencesHandler(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	rows, err := sth.db.Query("SELECT notification_type, channels FROM notification_preferences WHERE user_id = ?", userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load notification preferences"})
+		return
+	}
+	defer rows.Close()
+
+	preferences := make(map[string][]string)
+	for rows.Next() {
+		var notificationType, channelsJSON string
+		if err := rows.Scan(&notificationType, &channelsJSON); err != nil {
+			continue
+		}
+		var channels []string
+		if json.Unmarshal([]byte(channelsJSON), &channels) == nil {
+			preferences[notificationType] = channels
+		}
+	}
+
+	var webhookURL string
+	sth.db.QueryRow("SELECT url FROM user_webhooks WHERE user_id = ?", userID).Scan(&webhookURL)
+
+	c.JSON(http.StatusOK, gin.H{"preferences": preferences, "webhook_url": webhookURL})
+}
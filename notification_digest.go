@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// digestSweepInterval is how often NotificationDispatcher checks for
+// scheduled_for rows whose digest/quiet-hours window has ended.
+const digestSweepInterval = 1 * time.Minute
+
+// urgentNotificationTypes always deliver immediately regardless of the
+// recipient's configured DeliveryMode -- a payment failure or an owner
+// cancelling a booking shouldn't sit in an hourly digest.
+var urgentNotificationTypes = map[string]bool{
+	"payment_failed":             true,
+	"booking_cancelled_by_owner": true,
+}
+
+func isUrgentNotificationType(notificationType string) bool {
+	return urgentNotificationTypes[notificationType]
+}
+
+// computeScheduledFor turns a DeliveryMode string into the time a
+// notification_deliveries row should be picked up by the digest sweep, or
+// the zero time if it should be delivered immediately instead. Supported
+// modes: "immediate" (default), "hourly_digest", "daily_digest@HH:MM", and
+// "quiet_hours=HH:MM-HH:MM" (deferred only while now falls inside the
+// window; outside it, delivery proceeds immediately).
+func computeScheduledFor(mode string, now time.Time) time.Time {
+	switch {
+	case mode == "" || mode == "immediate":
+		return time.Time{}
+
+	case mode == "hourly_digest":
+		return now.Truncate(time.Hour).Add(time.Hour)
+
+	case strings.HasPrefix(mode, "daily_digest@"):
+		hour, minute, err := parseClock(strings.TrimPrefix(mode, "daily_digest@"))
+		if err != nil {
+			return time.Time{}
+		}
+		return nextClockOccurrence(now, hour, minute)
+
+	case strings.HasPrefix(mode, "quiet_hours="):
+		window := strings.TrimPrefix(mode, "quiet_hours=")
+		parts := strings.SplitN(window, "-", 2)
+		if len(parts) != 2 {
+			return time.Time{}
+		}
+		startHour, startMinute, err := parseClock(parts[0])
+		if err != nil {
+			return time.Time{}
+		}
+		endHour, endMinute, err := parseClock(parts[1])
+		if err != nil {
+			return time.Time{}
+		}
+		if !withinQuietHours(now, startHour, startMinute, endHour, endMinute) {
+			return time.Time{}
+		}
+		return nextClockOccurrence(now, endHour, endMinute)
+
+	default:
+		return time.Time{}
+	}
+}
+
+func parseClock(s string) (hour, minute int, err error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid clock time %q", s)
+	}
+	hour, err = strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	minute, err = strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	if hour < 0 || hour > 23 || minute < 0 || minute > 59 {
+		return 0, 0, fmt.Errorf("clock time %q out of range", s)
+	}
+	return hour, minute, nil
+}
+
+// nextClockOccurrence returns the next time hour:minute occurs strictly
+// after now, rolling over to tomorrow if that time of day has already
+// passed today or is exactly now.
+func nextClockOccurrence(now time.Time, hour, minute int) time.Time {
+	candidate := time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, now.Location())
+	if !candidate.After(now) {
+		candidate = candidate.Add(24 * time.Hour)
+	}
+	return candidate
+}
+
+// withinQuietHours reports whether now's time-of-day falls within
+// [start, end), handling windows that cross midnight (e.g. 22:00-07:00).
+func withinQuietHours(now time.Time, startHour, startMinute, endHour, endMinute int) bool {
+	start := startHour*60 + startMinute
+	end := endHour*60 + endMinute
+	current := now.Hour()*60 + now.Minute()
+
+	if start == end {
+		return false
+	}
+	if start < end {
+		return current >= start && current < end
+	}
+	// Window crosses midnight.
+	return current >= start || current < end
+}
+
+// digestDeliveryRow is one scheduled notification_deliveries row loaded by
+// digestSweep, ready to be folded into its (user, channel) group.
+type digestDeliveryRow struct {
+	deliveryID int64
+	notif      SecurityNotification
+}
+
+// digestSweep delivers every notification_deliveries row whose scheduled_for
+// has passed, grouping by (user_id, channel) and sending one aggregated
+// notification per group instead of one per constituent.
+func (d *NotificationDispatcher) digestSweep() {
+	rows, err := d.db.Query(`
+		SELECT id, user_id, channel, notification_snapshot, recipient_snapshot
+		FROM notification_deliveries
+		WHERE status = 'scheduled' AND scheduled_for <= NOW()
+	`)
+	if err != nil {
+		log.Printf("⚠️  notification dispatcher: failed to load due digests: %v", err)
+		return
+	}
+
+	recipients := make(map[string]NotificationRecipient)
+	channels := make(map[string]string)
+	groups := make(map[string][]digestDeliveryRow)
+
+	for rows.Next() {
+		var userID int
+		var channel string
+		var notifJSON, recipientJSON []byte
+		var deliveryID int64
+		if err := rows.Scan(&deliveryID, &userID, &channel, &notifJSON, &recipientJSON); err != nil {
+			continue
+		}
+
+		var notif SecurityNotification
+		if err := json.Unmarshal(notifJSON, &notif); err != nil {
+			continue
+		}
+		var recipient NotificationRecipient
+		if err := json.Unmarshal(recipientJSON, &recipient); err != nil {
+			continue
+		}
+
+		key := fmt.Sprintf("%d:%s", userID, channel)
+		groups[key] = append(groups[key], digestDeliveryRow{deliveryID: deliveryID, notif: notif})
+		recipients[key] = recipient
+		channels[key] = channel
+	}
+	rows.Close()
+
+	for key, group := range groups {
+		d.deliverDigestGroup(channels[key], recipients[key], group)
+	}
+}
+
+// deliverDigestGroup sends one aggregated notification for every row in
+// group (all belonging to the same recipient and channel) and marks them
+// all delivered, or reschedules each individually through the normal retry
+// path if the send fails.
+func (d *NotificationDispatcher) deliverDigestGroup(channelName string, recipient NotificationRecipient, group []digestDeliveryRow) {
+	channel, ok := d.channels[channelName]
+	if !ok {
+		return
+	}
+
+	digest := aggregateDigestNotification(group)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	if err := channel.Send(ctx, recipient, digest); err != nil {
+		log.Printf("⚠️  notification dispatcher: %s digest delivery failed for %d notifications: %v", channelName, len(group), err)
+		for _, row := range group {
+			d.scheduleRetry(row.deliveryID, 0, err)
+		}
+		return
+	}
+
+	for _, row := range group {
+		d.markDelivered(row.deliveryID)
+	}
+}
+
+// aggregateDigestNotification folds a group of deferred notifications into
+// a single summary notification ("You have 5 new notifications"), or
+// returns the lone notification unchanged when the group has just one.
+func aggregateDigestNotification(group []digestDeliveryRow) SecurityNotification {
+	if len(group) == 1 {
+		return group[0].notif
+	}
+
+	counts := make(map[string]int)
+	order := make([]string, 0, len(group))
+	for _, row := range group {
+		if _, seen := counts[row.notif.Type]; !seen {
+			order = append(order, row.notif.Type)
+		}
+		counts[row.notif.Type]++
+	}
+
+	parts := make([]string, 0, len(order))
+	for _, notificationType := range order {
+		parts = append(parts, fmt.Sprintf("%d %s", counts[notificationType], notificationType))
+	}
+
+	return SecurityNotification{
+		UserID:    group[0].notif.UserID,
+		Type:      "digest",
+		Title:     fmt.Sprintf("You have %d new notifications", len(group)),
+		Message:   strings.Join(parts, ", "),
+		Severity:  "info",
+		State:     "pending",
+		CreatedAt: time.Now(),
+	}
+}
+
+// notificationScheduleRequest is PUT /security/notifications/schedule's
+// body: per-type DeliveryMode strings, e.g.
+// {"schedule": {"booking_request": "hourly_digest", "marketing": "daily_digest@08:00"}}.
+type notificationScheduleRequest struct {
+	Schedule map[string]string `json:"schedule"`
+}
+
+// setNotificationScheduleHandler handles PUT /security/notifications/schedule.
+func (sth *SecureTransactionHandler) setNotificationScheduleHandler(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	var req notificationScheduleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	for notificationType, mode := range req.Schedule {
+		if err := validateDeliveryMode(mode); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid delivery mode for %s: %v", notificationType, err)})
+			return
+		}
+
+		defaultChannels, err := json.Marshal(defaultChannelsFor(notificationType))
+		if err != nil {
+			continue
+		}
+		if _, err := sth.db.Exec(`
+			INSERT INTO notification_preferences (user_id, notification_type, channels, delivery_mode)
+			VALUES (?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE delivery_mode = VALUES(delivery_mode)
+		`, userID, notificationType, defaultChannels, mode); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to save schedule for %s", notificationType)})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "notification schedule updated"})
+}
+
+// getNotificationScheduleHandler handles GET /security/notifications/schedule.
+func (sth *SecureTransactionHandler) getNotificationScheduleHandler(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	rows, err := sth.db.Query("SELECT notification_type, delivery_mode FROM notification_preferences WHERE user_id = ?", userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load notification schedule"})
+		return
+	}
+	defer rows.Close()
+
+	schedule := make(map[string]string)
+	for rows.Next() {
+		var notificationType, mode string
+		if rows.Scan(&notificationType, &mode) == nil {
+			schedule[notificationType] = mode
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"schedule": schedule})
+}
+
+// validateDeliveryMode rejects a DeliveryMode string computeScheduledFor
+// would otherwise silently fall back to "immediate" for.
+func validateDeliveryMode(mode string) error {
+	if mode == "" || mode == "immediate" || mode == "hourly_digest" {
+		return nil
+	}
+	if strings.HasPrefix(mode, "daily_digest@") {
+		_, _, err := parseClock(strings.TrimPrefix(mode, "daily_digest@"))
+		return err
+	}
+	if strings.HasPrefix(mode, "quiet_hours=") {
+		parts := strings.SplitN(strings.TrimPrefix(mode, "quiet_hours="), "-", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("expected quiet_hours=HH:MM-HH:MM")
+		}
+		if _, _, err := parseClock(parts[0]); err != nil {
+			return err
+		}
+		if _, _, err := parseClock(parts[1]); err != nil {
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown delivery mode %q", mode)
+}
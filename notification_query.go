@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// notificationQueryDefaultLimit/MaxLimit bound POST /notifications/query the
+// same way getSecurityNotificationsHandler bounds its own ?limit=.
+const (
+	notificationQueryDefaultLimit = 25
+	notificationQueryMaxLimit     = 100
+)
+
+// notificationQueryRequest is POST /notifications/query's body: a selection
+// spec naming which related entities to pre-join (include), an optional
+// notification_type filter, a page size, and a cursor from a previous
+// response's envelope.
+type notificationQueryRequest struct {
+	Include []string `json:"include"`
+	Types   []string `json:"types"`
+	Limit   int      `json:"limit"`
+	Cursor  string   `json:"cursor"`
+}
+
+// notificationQueryEnvelope is the stable response shape: Errors carries one
+// entry per include that couldn't be resolved, so a broken/unknown resolver
+// degrades that one field instead of failing notifications the caller could
+// otherwise use.
+type notificationQueryEnvelope struct {
+	Data   notificationQueryData    `json:"data"`
+	Errors []notificationQueryError `json:"errors,omitempty"`
+}
+
+type notificationQueryData struct {
+	Notifications []map[string]interface{} `json:"notifications"`
+	Cursor        string                    `json:"cursor,omitempty"`
+}
+
+type notificationQueryError struct {
+	Include string `json:"include"`
+	Message string `json:"message"`
+}
+
+// notificationIncludeResolver batches the lookup for one `include` name
+// across an entire page of notifications (e.g. a single
+// "SELECT ... WHERE id IN (...)" for every referenced actor) and returns the
+// resolved objects keyed by the referenced entity's own ID, not the
+// notification's.
+type notificationIncludeResolver func(ctx context.Context, db *sql.DB, notifications []SecurityNotification) (map[int]map[string]interface{}, error)
+
+// notificationIncludeResolvers is the registry queryNotificationsHandler
+// dispatches each requested `include` name to. New entity types are added
+// here, not by special-casing the handler.
+var notificationIncludeResolvers = map[string]notificationIncludeResolver{
+	"actor":   resolveActorInclude,
+	"car":     resolveCarInclude,
+	"booking": resolveBookingInclude,
+}
+
+// resolveActorInclude batches every distinct actor_id referenced by a page
+// of notifications into one users query, the only related entity this
+// module actually has a table for.
+func resolveActorInclude(ctx context.Context, db *sql.DB, notifications []SecurityNotification) (map[int]map[string]interface{}, error) {
+	ids := make([]int, 0, len(notifications))
+	seen := make(map[int]bool)
+	for _, notif := range notifications {
+		if notif.ActorID == nil || seen[*notif.ActorID] {
+			continue
+		}
+		seen[*notif.ActorID] = true
+		ids = append(ids, *notif.ActorID)
+	}
+	if len(ids) == 0 {
+		return map[int]map[string]interface{}{}, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT id, email FROM users WHERE id IN ("+placeholders+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	resolved := make(map[int]map[string]interface{})
+	for rows.Next() {
+		var id int
+		var email string
+		if err := rows.Scan(&id, &email); err != nil {
+			continue
+		}
+		resolved[id] = map[string]interface{}{"id": id, "email": email}
+	}
+	return resolved, nil
+}
+
+// resolveCarInclude and resolveBookingInclude are honest stubs: this
+// service's schema is security/fraud/payments only (see secure_system.go's
+// initializeTables) and has no cars or bookings tables to join against, so
+// these report a resolution error through the envelope's Errors list
+// instead of pretending to embed data that doesn't exist anywhere in this
+// tree.
+func resolveCarInclude(ctx context.Context, db *sql.DB, notifications []SecurityNotification) (map[int]map[string]interface{}, error) {
+	return nil, errNotificationIncludeUnavailable
+}
+
+func resolveBookingInclude(ctx context.Context, db *sql.DB, notifications []SecurityNotification) (map[int]map[string]interface{}, error) {
+	return nil, errNotificationIncludeUnavailable
+}
+
+var errNotificationIncludeUnavailable = &notificationIncludeUnavailableError{}
+
+type notificationIncludeUnavailableError struct{}
+
+func (e *notificationIncludeUnavailableError) Error() string {
+	return "this service's schema has no table for this entity type"
+}
+
+// subjectRefID reads the field+"_id" key out of a notification's
+// polymorphic Subject payload (e.g. "car_id" for include "car"), returning
+// ok=false when absent or not numeric.
+func subjectRefID(notif SecurityNotification, field string) (int, bool) {
+	if notif.Subject == nil {
+		return 0, false
+	}
+	raw, ok := notif.Subject[field+"_id"]
+	if !ok {
+		return 0, false
+	}
+	switch v := raw.(type) {
+	case float64:
+		return int(v), true
+	case int:
+		return v, true
+	}
+	return 0, false
+}
+
+// refIDFor returns the entity ID a given include name refers to for notif:
+// ActorID for "actor", or the matching Subject field for everything else.
+func refIDFor(notif SecurityNotification, include string) (int, bool) {
+	if include == "actor" {
+		if notif.ActorID == nil {
+			return 0, false
+		}
+		return *notif.ActorID, true
+	}
+	return subjectRefID(notif, include)
+}
+
+// queryNotificationsHandler handles POST /notifications/query: a
+// selection-spec read endpoint that lets a mobile client request related
+// entities pre-joined onto a page of notifications instead of resolving
+// each one with its own round trip.
+func (sth *SecureTransactionHandler) queryNotificationsHandler(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	var req notificationQueryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	limit := req.Limit
+	if limit <= 0 {
+		limit = notificationQueryDefaultLimit
+	}
+	if limit > notificationQueryMaxLimit {
+		limit = notificationQueryMaxLimit
+	}
+
+	notifications, nextCursor, err := sth.fetchNotificationsPage(userID, req.Types, req.Cursor, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load notifications"})
+		return
+	}
+
+	envelope := notificationQueryEnvelope{
+		Data: notificationQueryData{
+			Notifications: make([]map[string]interface{}, 0, len(notifications)),
+			Cursor:        nextCursor,
+		},
+	}
+
+	resolved := make(map[string]map[int]map[string]interface{})
+	for _, include := range req.Include {
+		resolver, ok := notificationIncludeResolvers[include]
+		if !ok {
+			envelope.Errors = append(envelope.Errors, notificationQueryError{Include: include, Message: "unknown include"})
+			continue
+		}
+		result, err := resolver(c.Request.Context(), sth.db, notifications)
+		if err != nil {
+			envelope.Errors = append(envelope.Errors, notificationQueryError{Include: include, Message: err.Error()})
+			continue
+		}
+		resolved[include] = result
+	}
+
+	for _, notif := range notifications {
+		entry := notificationToMap(notif)
+		for include, byID := range resolved {
+			refID, ok := refIDFor(notif, include)
+			if !ok {
+				continue
+			}
+			if obj, ok := byID[refID]; ok {
+				entry[include] = obj
+			}
+		}
+		envelope.Data.Notifications = append(envelope.Data.Notifications, entry)
+	}
+
+	c.JSON(http.StatusOK, envelope)
+}
+
+// notificationToMap round-trips a SecurityNotification through JSON so
+// include resolvers can attach extra keys without SecurityNotification
+// itself needing a field per related entity type.
+func notificationToMap(notif SecurityNotification) map[string]interface{} {
+	raw, err := json.Marshal(notif)
+	if err != nil {
+		return map[string]interface{}{"id": notif.ID}
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		return map[string]interface{}{"id": notif.ID}
+	}
+	return entry
+}
+
+// fetchNotificationsPage reuses the same keyset-cursor query shape
+// getSecurityNotificationsHandler already uses, filtered to an optional set
+// of notification types.
+func (sth *SecureTransactionHandler) fetchNotificationsPage(userID int, types []string, cursorToken string, limit int) ([]SecurityNotification, string, error) {
+	query := `
+		SELECT id, user_id, notification_type, title, message, severity, actor_id, subject, state, read_at, metadata, created_at
+		FROM security_notifications WHERE user_id = ?
+	`
+	args := []interface{}{userID}
+
+	if len(types) > 0 {
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(types)), ",")
+		query += " AND notification_type IN (" + placeholders + ")"
+		for _, t := range types {
+			args = append(args, t)
+		}
+	}
+
+	if cursorToken != "" {
+		cursor, err := decodeNotificationsCursor(cursorToken)
+		if err != nil {
+			return nil, "", err
+		}
+		query += " AND (created_at, id) < (?, ?)"
+		args = append(args, cursor.CreatedAt, cursor.ID)
+	}
+
+	query += " ORDER BY created_at DESC, id DESC LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, err := sth.db.Query(query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var notifications []SecurityNotification
+	for rows.Next() {
+		var notif SecurityNotification
+		var actorID sql.NullInt64
+		var subjectJSON, metadataJSON sql.NullString
+		var readAt sql.NullTime
+		if err := rows.Scan(&notif.ID, &notif.UserID, &notif.Type, &notif.Title, &notif.Message, &notif.Severity,
+			&actorID, &subjectJSON, &notif.State, &readAt, &metadataJSON, &notif.CreatedAt); err != nil {
+			continue
+		}
+		if actorID.Valid {
+			id := int(actorID.Int64)
+			notif.ActorID = &id
+		}
+		if subjectJSON.Valid && subjectJSON.String != "" {
+			json.Unmarshal([]byte(subjectJSON.String), &notif.Subject)
+		}
+		if metadataJSON.Valid && metadataJSON.String != "" {
+			json.Unmarshal([]byte(metadataJSON.String), &notif.Metadata)
+		}
+		if readAt.Valid {
+			notif.ReadAt = &readAt.Time
+		}
+		notifications = append(notifications, notif)
+	}
+
+	var nextCursor string
+	if len(notifications) > limit {
+		last := notifications[limit-1]
+		nextCursor = encodeNotificationsCursor(notificationsCursor{CreatedAt: last.CreatedAt, ID: int64(last.ID)})
+		notifications = notifications[:limit]
+	}
+
+	return notifications, nextCursor, nil
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	notificationSendQueueSize = 32              // per-connection buffered send queue before drop-oldest kicks in
+	notificationPingInterval  = 30 * time.Second // heartbeat so dead browser tabs/SSE connections get evicted
+)
+
+// SecurityNotification mirrors a row in security_notifications. It's the
+// payload NotificationService.Publish persists and fans out live, and what
+// getSecurityNotificationsHandler's typed, filterable reader returns.
+//
+// Type isn't restricted to a fixed Go enum: notification_type is a MySQL
+// ENUM (widened by initializeNotificationColumns to cover booking_request,
+// booking_accepted, payment_received, review, message, and system
+// alongside this module's own login/transaction/device/security/fraud
+// values) and Go just carries through whatever the column accepts.
+type SecurityNotification struct {
+	ID        int                    `json:"id"`
+	UserID    int                    `json:"user_id"`
+	Type      string                 `json:"type"`
+	Title     string                 `json:"title"`
+	Message   string                 `json:"message"`
+	Severity  string                 `json:"severity"`
+	ActorID   *int                   `json:"actor_id,omitempty"`
+	Subject   map[string]interface{} `json:"subject,omitempty"` // polymorphic: related car/booking/message IDs
+	State     string                 `json:"state"`             // pending, read, archived
+	ReadAt    *time.Time             `json:"read_at,omitempty"`
+	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+	CreatedAt time.Time              `json:"created_at"`
+}
+
+// notificationConn is one connected client (WebSocket or SSE) for a single
+// user, fed through a bounded send queue so a slow browser tab can't block
+// Publish for every other user's connections.
+type notificationConn struct {
+	userID int
+	send   chan []byte
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newNotificationConn(userID int) *notificationConn {
+	return &notificationConn{
+		userID: userID,
+		send:   make(chan []byte, notificationSendQueueSize),
+		done:   make(chan struct{}),
+	}
+}
+
+// enqueue queues payload without ever blocking the publisher: a full queue
+// drops its oldest buffered message rather than backing up Publish behind
+// one slow consumer.
+func (nc *notificationConn) enqueue(payload []byte) {
+	select {
+	case nc.send <- payload:
+		return
+	default:
+	}
+	select {
+	case <-nc.send:
+	default:
+	}
+	select {
+	case nc.send <- payload:
+	default:
+	}
+}
+
+func (nc *notificationConn) close() {
+	nc.once.Do(func() { close(nc.done) })
+}
+
+// notificationHub holds every connected client, keyed by the user it belongs
+// to, so Publish(userID, ...) only has to walk that one user's connections
+// instead of every client in the process.
+type notificationHub struct {
+	mu     sync.RWMutex
+	byUser map[int][]*notificationConn
+}
+
+func newNotificationHub() *notificationHub {
+	return &notificationHub{byUser: make(map[int][]*notificationConn)}
+}
+
+func (h *notificationHub) register(nc *notificationConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.byUser[nc.userID] = append(h.byUser[nc.userID], nc)
+}
+
+func (h *notificationHub) unregister(nc *notificationConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	conns := h.byUser[nc.userID]
+	for i, c := range conns {
+		if c == nc {
+			h.byUser[nc.userID] = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(h.byUser[nc.userID]) == 0 {
+		delete(h.byUser, nc.userID)
+	}
+	nc.close()
+}
+
+// fanout delivers payload to every connection currently open for userID.
+func (h *notificationHub) fanout(userID int, payload []byte) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, c := range h.byUser[userID] {
+		c.enqueue(payload)
+	}
+}
+
+// NotificationService is the single write path for security_notifications:
+// every caller that used to only have a place to INSERT a notification row
+// (there wasn't one before this) now calls Publish, which persists the row
+// and immediately fans it out to that user's connected WebSocket/SSE
+// streams, so getSecurityNotificationsHandler's poll-based GET becomes a
+// fallback rather than the only way to learn about a new notification.
+type NotificationService struct {
+	db         *sql.DB
+	hub        *notificationHub
+	dispatcher *NotificationDispatcher
+}
+
+func NewNotificationService(db *sql.DB) *NotificationService {
+	dispatcher := NewNotificationDispatcher(db, newNotificationChannelsFromEnv())
+	dispatcher.Start(30 * time.Second)
+	return &NotificationService{db: db, hub: newNotificationHub(), dispatcher: dispatcher}
+}
+
+// Publish inserts n into security_notifications, stamps its ID/CreatedAt
+// from the write, and delivers it to every live stream registered for
+// n.UserID. A fanout failure is impossible (enqueue never blocks or
+// errors); a persistence failure is returned so the caller can log it, but
+// the notification still reaches any already-connected client -- a missed
+// row beats a missed real-time alert for something like a fraud block.
+func (n *NotificationService) Publish(userID int, notification SecurityNotification) error {
+	notification.UserID = userID
+	if notification.CreatedAt.IsZero() {
+		notification.CreatedAt = time.Now()
+	}
+	if notification.State == "" {
+		notification.State = "pending"
+	}
+
+	var metadataJSON, subjectJSON []byte
+	if notification.Metadata != nil {
+		metadataJSON, _ = json.Marshal(notification.Metadata)
+	}
+	if notification.Subject != nil {
+		subjectJSON, _ = json.Marshal(notification.Subject)
+	}
+
+	res, err := n.db.Exec(`
+		INSERT INTO security_notifications
+			(user_id, notification_type, title, message, severity, actor_id, subject, state, metadata, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, userID, notification.Type, notification.Title, notification.Message, notification.Severity,
+		notification.ActorID, nullableJSON(subjectJSON), notification.State, nullableJSON(metadataJSON), notification.CreatedAt)
+
+	if err == nil {
+		if id, idErr := res.LastInsertId(); idErr == nil {
+			notification.ID = int(id)
+		}
+	}
+
+	payload, marshalErr := json.Marshal(map[string]interface{}{
+		"type": "notification",
+		"data": notification,
+	})
+	if marshalErr == nil {
+		n.hub.fanout(userID, payload)
+	}
+
+	if err == nil {
+		n.dispatcher.Dispatch(userID, notification)
+	}
+
+	return err
+}
+
+// nullableJSON turns an empty/nil marshaled payload into a SQL NULL instead
+// of writing the literal string "null" into a JSON column.
+func nullableJSON(b []byte) interface{} {
+	if len(b) == 0 {
+		return nil
+	}
+	return b
+}
+
+// initializeNotificationColumns widens security_notifications for
+// deployments that created the table before the typed notification model
+// existed: notification_type grows to cover the booking/message/review
+// domain's event names alongside this module's own ones, and actor_id/
+// subject/state/read_at are added for the typed listing/read/delete
+// endpoints. A fresh CREATE TABLE already includes metadata (see
+// initializeMonitoringTables); actor_id/subject/state/read_at are added
+// here rather than there since they're new as of this change.
+func initializeNotificationColumns(db *sql.DB) error {
+	statements := []string{
+		`ALTER TABLE security_notifications
+			MODIFY COLUMN notification_type ENUM(
+				'login', 'transaction', 'device', 'security', 'fraud',
+				'booking_request', 'booking_accepted', 'payment_received', 'review', 'message', 'system'
+			) NOT NULL`,
+		`ALTER TABLE security_notifications
+			ADD COLUMN IF NOT EXISTS actor_id INT,
+			ADD COLUMN IF NOT EXISTS subject JSON,
+			ADD COLUMN IF NOT EXISTS state ENUM('pending', 'read', 'archived') NOT NULL DEFAULT 'pending',
+			ADD COLUMN IF NOT EXISTS read_at TIMESTAMP NULL`,
+	}
+	for _, stmt := range statements {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to widen security_notifications: %v", err)
+		}
+	}
+	return nil
+}
+
+// notificationsCursor is the (created_at, id) keyset position
+// getSecurityNotificationsHandler hands back as next_cursor, the same shape
+// getSecurityEvents already uses for security_events (see eventsCursor in
+// security_events_export.go) so paging forward never has to re-scan and
+// discard already-seen rows the way OFFSET/LIMIT would once a user has
+// accumulated a long notification history.
+type notificationsCursor struct {
+	CreatedAt time.Time `json:"created_at"`
+	ID        int64     `json:"id"`
+}
+
+func encodeNotificationsCursor(cursor notificationsCursor) string {
+	raw, _ := json.Marshal(cursor)
+	return base64.URLEncoding.EncodeToString(raw)
+}
+
+func decodeNotificationsCursor(token string) (notificationsCursor, error) {
+	raw, err := base64.URLEncoding.DecodeString(token)
+	if err != nil {
+		return notificationsCursor{}, err
+	}
+	var cursor notificationsCursor
+	if err := json.Unmarshal(raw, &cursor); err != nil {
+		return notificationsCursor{}, err
+	}
+	return cursor, nil
+}
+
+// getSecurityNotificationsHandler lists the caller's security_notifications
+// newest-first, filterable by ?type=, ?state=unread (shorthand for
+// "state != read"), ?since=/?before= (RFC3339 created_at bounds), and
+// paginated via ?cursor=/?limit= exactly like getSecurityEvents. It returns
+// unread_count alongside the page so a UI can render a badge from the same
+// call instead of a second round trip.
+func (sth *SecureTransactionHandler) getSecurityNotificationsHandler(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+
+	query := `SELECT id, notification_type, title, message, severity, actor_id, subject, state, read_at, metadata, created_at
+		FROM security_notifications WHERE user_id = ?`
+	args := []interface{}{userID}
+
+	if t := c.Query("type"); t != "" {
+		query += " AND notification_type = ?"
+		args = append(args, t)
+	}
+	if c.Query("state") == "unread" {
+		query += " AND state != 'read'"
+	} else if s := c.Query("state"); s != "" {
+		query += " AND state = ?"
+		args = append(args, s)
+	}
+	if since := c.Query("since"); since != "" {
+		if t, err := time.Parse(time.RFC3339, since); err == nil {
+			query += " AND created_at >= ?"
+			args = append(args, t)
+		}
+	}
+	if before := c.Query("before"); before != "" {
+		if t, err := time.Parse(time.RFC3339, before); err == nil {
+			query += " AND created_at <= ?"
+			args = append(args, t)
+		}
+	}
+
+	countQuery := "SELECT COUNT(*) FROM (" + query + ") counted"
+	var totalCount int
+	if err := sth.db.QueryRow(countQuery, args...).Scan(&totalCount); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count notifications"})
+		return
+	}
+
+	var unreadCount int
+	if err := sth.db.QueryRow("SELECT COUNT(*) FROM security_notifications WHERE user_id = ? AND state != 'read'", userID).Scan(&unreadCount); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count unread notifications"})
+		return
+	}
+
+	if cursorToken := c.Query("cursor"); cursorToken != "" {
+		cursor, err := decodeNotificationsCursor(cursorToken)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor"})
+			return
+		}
+		query += " AND (created_at, id) < (?, ?)"
+		args = append(args, cursor.CreatedAt, cursor.ID)
+	}
+
+	query += " ORDER BY created_at DESC, id DESC LIMIT ?"
+	args = append(args, limit+1) // fetch one extra row to know whether another page follows
+
+	rows, err := sth.db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch notifications"})
+		return
+	}
+	defer rows.Close()
+
+	var notifications []SecurityNotification
+	var lastID int64
+	var lastCreatedAt time.Time
+	for rows.Next() {
+		var n SecurityNotification
+		var actorID sql.NullInt64
+		var subjectJSON, metadataJSON sql.NullString
+		var readAt sql.NullTime
+		var id int64
+
+		if err := rows.Scan(&id, &n.Type, &n.Title, &n.Message, &n.Severity, &actorID, &subjectJSON, &n.State, &readAt, &metadataJSON, &n.CreatedAt); err != nil {
+			continue
+		}
+		n.ID = int(id)
+		n.UserID = userID
+		if actorID.Valid {
+			v := int(actorID.Int64)
+			n.ActorID = &v
+		}
+		if subjectJSON.Valid && subjectJSON.String != "" {
+			json.Unmarshal([]byte(subjectJSON.String), &n.Subject)
+		}
+		if metadataJSON.Valid && metadataJSON.String != "" {
+			json.Unmarshal([]byte(metadataJSON.String), &n.Metadata)
+		}
+		if readAt.Valid {
+			n.ReadAt = &readAt.Time
+		}
+
+		notifications = append(notifications, n)
+		// The cursor marks the last row returned, not the extra lookahead
+		// row, so the next page starts with that lookahead row.
+		if len(notifications) <= limit {
+			lastID = id
+			lastCreatedAt = n.CreatedAt
+		}
+	}
+
+	var nextCursor string
+	if len(notifications) > limit {
+		notifications = notifications[:limit]
+		nextCursor = encodeNotificationsCursor(notificationsCursor{CreatedAt: lastCreatedAt, ID: lastID})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"notifications": notifications,
+		"unread_count":  unreadCount,
+		"total_count":   totalCount,
+		"next_cursor":   nextCursor,
+	})
+}
+
+// markNotificationReadHandler handles POST /security/notifications/:id/read.
+func (sth *SecureTransactionHandler) markNotificationReadHandler(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid notification id"})
+		return
+	}
+
+	res, err := sth.db.Exec(`
+		UPDATE security_notifications SET state = 'read', read_at = ?
+		WHERE id = ? AND user_id = ? AND state != 'read'
+	`, time.Now(), id, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to mark notification read"})
+		return
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "notification not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "notification marked read"})
+}
+
+// markAllNotificationsReadHandler handles POST /security/notifications/read-all.
+func (sth *SecureTransactionHandler) markAllNotificationsReadHandler(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	res, err := sth.db.Exec(`
+		UPDATE security_notifications SET state = 'read', read_at = ?
+		WHERE user_id = ? AND state != 'read'
+	`, time.Now(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to mark notifications read"})
+		return
+	}
+	marked, _ := res.RowsAffected()
+
+	c.JSON(http.StatusOK, gin.H{"marked_read": marked})
+}
+
+// deleteNotificationHandler handles DELETE /security/notifications/:id.
+func (sth *SecureTransactionHandler) deleteNotificationHandler(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid notification id"})
+		return
+	}
+
+	res, err := sth.db.Exec("DELETE FROM security_notifications WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete notification"})
+		return
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "notification not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "notification deleted"})
+}
+
+// streamNotificationsHandler upgrades GET /security/notifications/stream to
+// a WebSocket and pushes this user's notifications as they're Published.
+// There's no subscribe protocol to speak (unlike wsHub's admin dashboard
+// topics) since a connection only ever wants its own user's notifications.
+func (sth *SecureTransactionHandler) streamNotificationsHandler(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("⚠️  notification stream: upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	nc := newNotificationConn(userID)
+	sth.notificationService.hub.register(nc)
+	defer sth.notificationService.hub.unregister(nc)
+
+	// A dead reader (closed tab, network drop) needs to be noticed so this
+	// goroutine doesn't leak; pongs keep the read deadline pushed out past
+	// notificationPingInterval the same way ws_hub.go's writePump/idle
+	// timeout pair does for the dashboard socket.
+	conn.SetReadDeadline(time.Now().Add(2 * notificationPingInterval))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(2 * notificationPingInterval))
+		return nil
+	})
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				nc.close()
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(notificationPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-nc.done:
+			return
+		case payload := <-nc.send:
+			if err := conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// streamNotificationsSSEHandler is the Server-Sent Events fallback for
+// clients that can't open a WebSocket (older browsers, simple scripts):
+// GET /security/notifications/sse streams the same Publish events as
+// `event: notification` frames over a long-lived HTTP response.
+func (sth *SecureTransactionHandler) streamNotificationsSSEHandler(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "streaming unsupported"})
+		return
+	}
+
+	c.Writer.Header().Set("Content-Type", "text/event-stream")
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	c.Writer.Header().Set("Connection", "keep-alive")
+	c.Writer.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	nc := newNotificationConn(userID)
+	sth.notificationService.hub.register(nc)
+	defer sth.notificationService.hub.unregister(nc)
+
+	ticker := time.NewTicker(notificationPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-nc.done:
+			return
+		case payload := <-nc.send:
+			fmt.Fprintf(c.Writer, "event: notification\ndata: %s\n\n", payload)
+			flusher.Flush()
+		case <-ticker.C:
+			fmt.Fprint(c.Writer, ": heartbeat\n\n")
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,245 @@
+// Hand-rolled OpenAPI 3.1 generation: swaggo/swag isn't vendored, and
+// pulling it in just for this would mean adopting its comment-annotation
+// format across every handler in this module. Instead, schemaFor reflects
+// PaymentRequest/PayoutRequest's own `binding` struct tags -- the same tags
+// validation.go enforces at request time -- into a JSON Schema object, so
+// the two can't drift apart. The rest of the document (paths, operations)
+// is hand-authored: this module's routes aren't annotated in a way a
+// generator could discover them from, so listing them here is the honest
+// alternative to a half-working reflection-based route scanner.
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// schemaFor reflects a struct type's `json`/`binding` tags into a minimal
+// JSON Schema object (type, required, and the constraints validationReason
+// already knows how to explain to a caller).
+func schemaFor(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	var required []string
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		jsonTag := strings.Split(field.Tag.Get("json"), ",")[0]
+		if jsonTag == "" || jsonTag == "-" {
+			continue
+		}
+
+		prop := map[string]interface{}{"type": jsonSchemaType(field.Type)}
+		for _, rule := range strings.Split(field.Tag.Get("binding"), ",") {
+			switch {
+			case rule == "required":
+				required = append(required, jsonTag)
+			case strings.HasPrefix(rule, "gt="):
+				if n, err := strconv.ParseFloat(strings.TrimPrefix(rule, "gt="), 64); err == nil {
+					prop["exclusiveMinimum"] = n
+				}
+			case strings.HasPrefix(rule, "lte="):
+				if n, err := strconv.ParseFloat(strings.TrimPrefix(rule, "lte="), 64); err == nil {
+					prop["maximum"] = n
+				}
+			case strings.HasPrefix(rule, "max="):
+				if n, err := strconv.Atoi(strings.TrimPrefix(rule, "max=")); err == nil {
+					prop["maxLength"] = n
+				}
+			case rule == "iso4217":
+				prop["pattern"] = "^[A-Z]{3}$"
+			}
+		}
+		properties[jsonTag] = prop
+	}
+
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// jsonSchemaType maps a Go kind to the JSON Schema type name it encodes as.
+func jsonSchemaType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return "integer"
+	case reflect.Bool:
+		return "boolean"
+	default:
+		return "string"
+	}
+}
+
+// openapiDocument builds the OpenAPI 3.1 document served at GET
+// /openapi.json. Only the endpoints most likely to be consumed by an
+// external client are documented (payments/payouts, the invoice flow, and
+// webhook subscriptions); this is a living document meant to grow with the
+// API, not an exhaustive dump of every internal admin route.
+func openapiDocument() map[string]interface{} {
+	paymentSchema := schemaFor(reflect.TypeOf(PaymentRequest{}))
+	payoutSchema := schemaFor(reflect.TypeOf(PayoutRequest{}))
+
+	problemSchema := map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"type":   map[string]interface{}{"type": "string"},
+			"title":  map[string]interface{}{"type": "string"},
+			"status": map[string]interface{}{"type": "integer"},
+			"detail": map[string]interface{}{"type": "string"},
+			"errors": map[string]interface{}{
+				"type": "array",
+				"items": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"field":  map[string]interface{}{"type": "string"},
+						"reason": map[string]interface{}{"type": "string"},
+					},
+				},
+			},
+		},
+	}
+
+	validationResponse := map[string]interface{}{
+		"description": "Validation failed",
+		"content": map[string]interface{}{
+			"application/problem+json": map[string]interface{}{"schema": map[string]interface{}{"$ref": "#/components/schemas/ProblemDetail"}},
+		},
+	}
+
+	jsonRequestBody := func(schemaRef string) map[string]interface{} {
+		return map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": map[string]interface{}{"$ref": schemaRef}},
+			},
+		}
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.1.0",
+		"info": map[string]interface{}{
+			"title":       "Krili Backend API",
+			"version":     "1.0.0",
+			"description": "Payment processing, transaction security, and webhook subscription API.",
+		},
+		"components": map[string]interface{}{
+			"schemas": map[string]interface{}{
+				"PaymentRequest": paymentSchema,
+				"PayoutRequest":  payoutSchema,
+				"ProblemDetail":  problemSchema,
+			},
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+			},
+		},
+		"security": []interface{}{map[string]interface{}{"bearerAuth": []interface{}{}}},
+		"paths": map[string]interface{}{
+			"/api/v1/payments": map[string]interface{}{
+				"post": map[string]interface{}{
+					"summary":     "Process a payment",
+					"requestBody": jsonRequestBody("#/components/schemas/PaymentRequest"),
+					"responses": map[string]interface{}{
+						"200": map[string]interface{}{"description": "Payment processed"},
+						"400": validationResponse,
+					},
+				},
+			},
+			"/api/v1/payouts": map[string]interface{}{
+				"post": map[string]interface{}{
+					"summary":     "Process a payout",
+					"requestBody": jsonRequestBody("#/components/schemas/PayoutRequest"),
+					"responses": map[string]interface{}{
+						"200": map[string]interface{}{"description": "Payout processed"},
+						"400": validationResponse,
+					},
+				},
+			},
+			"/api/v1/invoices": map[string]interface{}{
+				"post": map[string]interface{}{
+					"summary":     "Open a PaymentInvoice and start a poll-for-settlement flow",
+					"requestBody": jsonRequestBody("#/components/schemas/PaymentRequest"),
+					"responses": map[string]interface{}{
+						"201": map[string]interface{}{"description": "Invoice created"},
+						"400": validationResponse,
+					},
+				},
+			},
+			"/api/v1/invoices/{id}/status": map[string]interface{}{
+				"get": map[string]interface{}{
+					"summary": "Poll a PaymentInvoice's settlement status",
+					"parameters": []interface{}{
+						map[string]interface{}{"name": "id", "in": "path", "required": true, "schema": map[string]interface{}{"type": "integer"}},
+					},
+					"responses": map[string]interface{}{
+						"200": map[string]interface{}{"description": "Current invoice status"},
+						"404": map[string]interface{}{"description": "Invoice not found"},
+					},
+				},
+			},
+			"/api/v1/webhooks": map[string]interface{}{
+				"post": map[string]interface{}{
+					"summary": "Register a webhook endpoint",
+					"responses": map[string]interface{}{
+						"201": map[string]interface{}{"description": "Endpoint registered"},
+					},
+				},
+				"get": map[string]interface{}{
+					"summary": "List the caller's webhook endpoints",
+					"responses": map[string]interface{}{
+						"200": map[string]interface{}{"description": "Registered endpoints"},
+					},
+				},
+			},
+			"/api/v1/webhooks/{id}": map[string]interface{}{
+				"delete": map[string]interface{}{
+					"summary": "Delete a webhook endpoint",
+					"parameters": []interface{}{
+						map[string]interface{}{"name": "id", "in": "path", "required": true, "schema": map[string]interface{}{"type": "integer"}},
+					},
+					"responses": map[string]interface{}{
+						"200": map[string]interface{}{"description": "Endpoint deleted"},
+					},
+				},
+			},
+		},
+	}
+}
+
+// openapiHandler serves the OpenAPI document generated by openapiDocument.
+func openapiHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, openapiDocument())
+}
+
+// docsHTML embeds a Swagger UI build from its public CDN rather than
+// vendoring the asset bundle, pointed at this module's own /openapi.json.
+const docsHTML = `<!DOCTYPE html>
+<html>
+<head>
+  <title>Krili Backend API Docs</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist/swagger-ui-bundle.js"></script>
+  <script>
+    window.onload = () => {
+      window.ui = SwaggerUIBundle({ url: "/openapi.json", dom_id: "#swagger-ui" });
+    };
+  </script>
+</body>
+</html>`
+
+// docsHandler serves the Swagger UI page.
+func docsHandler(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(docsHTML))
+}
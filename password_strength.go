@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/trustelem/zxcvbn"
+)
+
+// BreachCheckClient reports whether a candidate password appears in a known
+// breach corpus. It exists so tests (and air-gapped deployments) can inject
+// a fake instead of validatePasswordStrength reaching out to a real
+// breach-check service.
+type BreachCheckClient interface {
+	// IsBreached reports whether password has been seen in a breach corpus.
+	IsBreached(password string) (bool, error)
+}
+
+// hibpBreachCheckClient checks passwords against a Have-I-Been-Pwned-style
+// k-anonymity range API: only the first 5 hex characters of the password's
+// SHA-1 hash are sent, and the full set of suffixes sharing that prefix
+// comes back for a local match, so the full hash never leaves this process.
+type hibpBreachCheckClient struct {
+	endpoint   string // e.g. "https://api.pwnedpasswords.com/range/"
+	httpClient *http.Client
+}
+
+func newHIBPBreachCheckClient(endpoint string) *hibpBreachCheckClient {
+	return &hibpBreachCheckClient{
+		endpoint:   endpoint,
+		httpClient: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (c *hibpBreachCheckClient) IsBreached(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	resp, err := c.httpClient.Get(c.endpoint + prefix)
+	if err != nil {
+		return false, fmt.Errorf("breach check request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("breach check returned status %d", resp.StatusCode)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, suffix+":") {
+			return true, nil
+		}
+	}
+	if err := scanner.Err(); err != nil && err != io.EOF {
+		return false, fmt.Errorf("breach check response read failed: %v", err)
+	}
+	return false, nil
+}
+
+// cachingBreachCheckClient wraps a BreachCheckClient with a TTL cache of
+// negative results, so repeated signups/password changes with the same
+// not-yet-breached password don't each cost an outbound round trip. Positive
+// (breached) results are never cached, so a password freshly added to a
+// breach corpus is always caught.
+type cachingBreachCheckClient struct {
+	inner BreachCheckClient
+	cache *shardedTTLCache
+	ttl   time.Duration
+}
+
+func newCachingBreachCheckClient(inner BreachCheckClient) *cachingBreachCheckClient {
+	return &cachingBreachCheckClient{
+		inner: inner,
+		cache: newShardedTTLCache("breach_check_negatives", 4096),
+		ttl:   1 * time.Hour,
+	}
+}
+
+func (c *cachingBreachCheckClient) IsBreached(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	key := hex.EncodeToString(sum[:])
+
+	if _, ok := c.cache.Get(key); ok {
+		return false, nil
+	}
+
+	breached, err := c.inner.IsBreached(password)
+	if err != nil {
+		return false, err
+	}
+	if !breached {
+		c.cache.Set(key, true, c.ttl)
+	}
+	return breached, nil
+}
+
+// newBreachCheckClientFromEnv builds the breach-check client
+// validatePasswordStrength uses, wrapping it with negative-result caching.
+// BREACH_CHECK_ENDPOINT defaults to the public HIBP range API; operators in
+// air-gapped environments should set SecurityConfig.EnableBreachCheck to
+// false via ENABLE_BREACH_CHECK=false rather than pointing this at nothing.
+func newBreachCheckClientFromEnv() BreachCheckClient {
+	endpoint := getEnv("BREACH_CHECK_ENDPOINT", "https://api.pwnedpasswords.com/range/")
+	return newCachingBreachCheckClient(newHIBPBreachCheckClient(endpoint))
+}
+
+// crackTimeBuckets mirrors zxcvbn's display buckets for turning a raw guess
+// count into a human-readable estimate, ordered from fastest to slowest.
+var crackTimeBuckets = []struct {
+	seconds float64
+	label   string
+}{
+	{1, "instantly"},
+	{60, "less than a minute"},
+	{60 * 60, "less than an hour"},
+	{60 * 60 * 24, "less than a day"},
+	{60 * 60 * 24 * 31, "less than a month"},
+	{60 * 60 * 24 * 31 * 12, "less than a year"},
+	{60 * 60 * 24 * 31 * 12 * 100, "less than a century"},
+}
+
+// guessesPerSecondOffline assumes an attacker with an offline, parallelized
+// hash-cracking setup, the conservative end of zxcvbn's own guidance — this
+// is a password-strength estimate, not a promise.
+const guessesPerSecondOffline = 1e10
+
+// formatCrackTime converts a zxcvbn guess count into the same kind of
+// human-readable bucket zxcvbn's reference implementation reports.
+func formatCrackTime(guesses float64) string {
+	seconds := guesses / guessesPerSecondOffline
+	for _, bucket := range crackTimeBuckets {
+		if seconds < bucket.seconds {
+			return bucket.label
+		}
+	}
+	return "centuries"
+}
+
+// estimatePasswordStrength scores password with zxcvbn (0 weakest, 4
+// strongest) and returns a human-readable estimated crack time alongside it
+// for use in validatePasswordStrength's error messages.
+func estimatePasswordStrength(password string) (score int, crackTime string) {
+	result := zxcvbn.PasswordStrength(password, nil)
+	return result.Score, formatCrackTime(result.Guesses)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+)
+
+// PaymentDataVault encrypts raw sensitive payment/bank details (card PANs,
+// bank account and routing numbers) with a fresh per-call DEK, then wraps
+// that DEK under a pluggable KeyProvider KEK. Rotating the KEK then only
+// ever has to re-wrap the stored DEKs (see RotateKEK), not re-encrypt the
+// underlying ciphertext.
+//
+// This is deliberately separate from EncryptSensitive/DecryptSensitive in
+// envelope_crypto.go, which seals its AES key directly under a KeyStore
+// RSA key inline in the envelope it returns -- fine for the small
+// columns it protects (two_factor_auth secrets, security_events
+// descriptions, ...), but it means KeyStore.RotateKeys has to decrypt and
+// re-encrypt every protected row to retire an old key. Payment data at
+// this table's scale needs rotation to be a cheap DEK re-wrap instead.
+type PaymentDataVault struct {
+	db       *sql.DB
+	provider KeyProvider
+}
+
+// NewPaymentDataVault wires a vault against provider. Pass NewLocalKEK(keystore)
+// to keep everything local, or an AWSKMSProvider/VaultProvider once one is
+// reachable from this deployment.
+func NewPaymentDataVault(db *sql.DB, provider KeyProvider) *PaymentDataVault {
+	return &PaymentDataVault{db: db, provider: provider}
+}
+
+type encryptedPaymentDataKind string
+
+const (
+	paymentDataKindCard encryptedPaymentDataKind = "card"
+	paymentDataKindBank encryptedPaymentDataKind = "bank"
+)
+
+func initializeEncryptedPaymentDataTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS encrypted_payment_data (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			user_id INT NOT NULL,
+			kind VARCHAR(20) NOT NULL,
+			nonce VARCHAR(64) NOT NULL,
+			wrapped_dek TEXT NOT NULL,
+			kek_id VARCHAR(64) NOT NULL,
+			kek_version INT NOT NULL DEFAULT 1,
+			ciphertext TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id),
+			INDEX idx_kek (kek_id)
+		)
+	`)
+	return err
+}
+
+func (v *PaymentDataVault) store(userID int, kind encryptedPaymentDataKind, plaintext []byte) (int64, error) {
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return 0, fmt.Errorf("payment data vault: generate DEK: %v", err)
+	}
+
+	block, err := aes.NewCipher(dek)
+	if err != nil {
+		return 0, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return 0, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return 0, err
+	}
+	ciphertext := gcm.Seal(nil, nonce, plaintext, nil)
+
+	wrappedDEK, kekID, kekVersion, err := v.provider.WrapDEK(dek)
+	if err != nil {
+		return 0, fmt.Errorf("payment data vault: wrap DEK: %v", err)
+	}
+
+	result, err := v.db.Exec(`
+		INSERT INTO encrypted_payment_data (user_id, kind, nonce, wrapped_dek, kek_id, kek_version, ciphertext)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, userID, kind,
+		base64.StdEncoding.EncodeToString(nonce),
+		base64.StdEncoding.EncodeToString(wrappedDEK),
+		kekID, kekVersion,
+		base64.StdEncoding.EncodeToString(ciphertext))
+	if err != nil {
+		return 0, fmt.Errorf("payment data vault: insert: %v", err)
+	}
+	return result.LastInsertId()
+}
+
+// StoreEncryptedPaymentData seals a raw card PAN (or equivalent payment
+// instrument payload) for userID and returns the new row's id.
+func (v *PaymentDataVault) StoreEncryptedPaymentData(userID int, plaintext []byte) (int64, error) {
+	return v.store(userID, paymentDataKindCard, plaintext)
+}
+
+// StoreEncryptedBankData seals raw bank account/routing details for
+// userID and returns the new row's id.
+func (v *PaymentDataVault) StoreEncryptedBankData(userID int, plaintext []byte) (int64, error) {
+	return v.store(userID, paymentDataKindBank, plaintext)
+}
+
+// Decrypt reverses store for the row with the given id.
+func (v *PaymentDataVault) Decrypt(id int64) ([]byte, error) {
+	var nonceB64, wrappedB64, kekID, ciphertextB64 string
+	var kekVersion int
+	err := v.db.QueryRow(`
+		SELECT nonce, wrapped_dek, kek_id, kek_version, ciphertext
+		FROM encrypted_payment_data WHERE id = ?
+	`, id).Scan(&nonceB64, &wrappedB64, &kekID, &kekVersion, &ciphertextB64)
+	if err != nil {
+		return nil, fmt.Errorf("payment data vault: lookup row %d: %v", id, err)
+	}
+
+	nonce, err := base64.StdEncoding.DecodeString(nonceB64)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(wrappedB64)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(ciphertextB64)
+	if err != nil {
+		return nil, err
+	}
+
+	dek, err := v.provider.UnwrapDEK(wrapped, kekID, kekVersion)
+	if err != nil {
+		return nil, fmt.Errorf("payment data vault: unwrap DEK for row %d: %v", id, err)
+	}
+	block, err := aes.NewCipher(dek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("payment data vault: row %d: bad nonce length", id)
+	}
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+type pendingPaymentDataRow struct {
+	id         int64
+	wrappedB64 string
+	kekVersion int
+}
+
+const paymentDataVaultRotateBatchSize = 200
+
+// RotateKEK re-wraps every encrypted_payment_data DEK currently wrapped
+// under oldID so it's wrapped under newID instead, without touching any
+// row's ciphertext or nonce. newID must be what v.provider currently
+// wraps new DEKs under (its active key/version); RotateKEK fails a batch
+// rather than silently writing a mismatched kek_id if that's not so --
+// callers should rotate the provider's active key first (e.g.
+// KeyStore.RotateKeys for LocalKEK) and pass its new ID here.
+func (v *PaymentDataVault) RotateKEK(oldID, newID string) error {
+	rows, err := v.db.Query(`
+		SELECT id, wrapped_dek, kek_version FROM encrypted_payment_data WHERE kek_id = ?
+	`, oldID)
+	if err != nil {
+		return fmt.Errorf("payment data vault: rotate: query: %v", err)
+	}
+	var toRotate []pendingPaymentDataRow
+	for rows.Next() {
+		var r pendingPaymentDataRow
+		if err := rows.Scan(&r.id, &r.wrappedB64, &r.kekVersion); err != nil {
+			rows.Close()
+			return fmt.Errorf("payment data vault: rotate: scan: %v", err)
+		}
+		toRotate = append(toRotate, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for start := 0; start < len(toRotate); start += paymentDataVaultRotateBatchSize {
+		end := start + paymentDataVaultRotateBatchSize
+		if end > len(toRotate) {
+			end = len(toRotate)
+		}
+		if err := v.rotateBatch(toRotate[start:end], oldID, newID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *PaymentDataVault) rotateBatch(batch []pendingPaymentDataRow, oldID, newID string) error {
+	tx, err := v.db.Begin()
+	if err != nil {
+		return fmt.Errorf("payment data vault: rotate: begin tx: %v", err)
+	}
+	defer tx.Rollback()
+
+	for _, r := range batch {
+		wrapped, err := base64.StdEncoding.DecodeString(r.wrappedB64)
+		if err != nil {
+			return fmt.Errorf("payment data vault: rotate row %d: %v", r.id, err)
+		}
+		dek, err := v.provider.UnwrapDEK(wrapped, oldID, r.kekVersion)
+		if err != nil {
+			return fmt.Errorf("payment data vault: rotate row %d: unwrap under %s: %v", r.id, oldID, err)
+		}
+		rewrapped, gotKekID, gotKekVersion, err := v.provider.WrapDEK(dek)
+		if err != nil {
+			return fmt.Errorf("payment data vault: rotate row %d: rewrap: %v", r.id, err)
+		}
+		if gotKekID != newID {
+			return fmt.Errorf("payment data vault: rotate row %d: provider wrapped under %q, expected target %q", r.id, gotKekID, newID)
+		}
+		if _, err := tx.Exec(`
+			UPDATE encrypted_payment_data SET wrapped_dek = ?, kek_id = ?, kek_version = ? WHERE id = ?
+		`, base64.StdEncoding.EncodeToString(rewrapped), gotKekID, gotKekVersion, r.id); err != nil {
+			return fmt.Errorf("payment data vault: rotate row %d: update: %v", r.id, err)
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// invoiceStatusPending/Paid/Failed track a PaymentInvoice independently of
+// the underlying transactions.status enum: "paid" here specifically means
+// PollPaymentInvoiceStatus has observed the provider report settlement and
+// written the ledger entries, the same confirmation CreatePaymentInvoice
+// defers instead of completing synchronously the way ProcessPayment does.
+const (
+	invoiceStatusPending = "pending"
+	invoiceStatusPaid    = "paid"
+	invoiceStatusFailed  = "failed"
+)
+
+// PaymentInvoice is a single pending-payment object a caller creates, then
+// polls until the provider settles it -- a Lightning/Stripe-invoice style
+// flow distinct from InvoiceService's Invoice (invoice_service.go), which
+// aggregates a month of transactions into one billing document for
+// /admin/invoices/*. The two are named apart deliberately to avoid
+// colliding with that existing domain.
+type PaymentInvoice struct {
+	ID            int64      `json:"id"`
+	UserID        int        `json:"user_id"`
+	TransactionID int64      `json:"transaction_id"`
+	Amount        float64    `json:"amount"`
+	Currency      string     `json:"currency"`
+	Description   string     `json:"description"`
+	Status        string     `json:"status"`
+	CreatedAt     time.Time  `json:"created_at"`
+	SettledAt     *time.Time `json:"settled_at,omitempty"`
+}
+
+func initializePaymentInvoicesTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS payment_invoices (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			user_id INT NOT NULL,
+			transaction_id INT NOT NULL,
+			amount DECIMAL(15,2) NOT NULL,
+			currency VARCHAR(10) NOT NULL DEFAULT 'USD',
+			description VARCHAR(255),
+			status VARCHAR(20) NOT NULL DEFAULT 'pending',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			settled_at TIMESTAMP NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id),
+			FOREIGN KEY (transaction_id) REFERENCES transactions(id),
+			INDEX idx_user_status (user_id, status)
+		)
+	`)
+	return err
+}
+
+// createPendingInvoiceTransaction writes the transactions row a
+// PaymentInvoice is opened against, in 'pending' status with no ledger
+// entries yet -- mirroring createPendingTanTransaction (tan_challenge.go)
+// and createPendingTransaction (three_ds.go), except what defers completion
+// here is the caller polling GetStatus rather than a TAN code or a 3DS
+// challenge.
+func (r *ProviderRouter) createPendingInvoiceTransaction(userID int, providerID, idempotencyKey string, amount float64, description string) (int64, error) {
+	res, err := r.db.Exec(`
+		INSERT INTO transactions (user_id, type, amount, description, status, provider_id, reconciliation_status, idempotency_key)
+		VALUES (?, 'payment', ?, ?, 'pending', ?, 'pending', ?)
+	`, userID, amount, description, providerID, nullableString(idempotencyKey))
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// CreatePaymentInvoice opens a PaymentInvoice for req: it authorizes the
+// payment with the selected provider immediately, so a provider reference
+// exists for PollPaymentInvoiceStatus to ask about, but -- unlike
+// ProcessPayment -- never completes the transaction or writes ledger
+// entries itself. That only happens once a caller polls and
+// PollPaymentInvoiceStatus observes the provider report settlement.
+func (r *ProviderRouter) CreatePaymentInvoice(userID int, req *PaymentRequest, idempotencyKey string) (*PaymentInvoice, error) {
+	provider, err := r.selectProvider(req.Currency, req.Region, req.Method)
+	if err != nil {
+		return nil, fmt.Errorf("create payment invoice: %v", err)
+	}
+
+	txID, err := r.createPendingInvoiceTransaction(userID, provider.ID(), idempotencyKey, req.Amount, req.Description)
+	if err != nil {
+		return nil, fmt.Errorf("create payment invoice: %v", err)
+	}
+
+	reference, err := provider.ProcessPayment(userID, req, idempotencyKey)
+	r.recordOutcome(provider.ID(), err)
+	if err != nil {
+		r.markTransactionStatus(txID, "failed")
+		return nil, fmt.Errorf("create payment invoice: provider authorization failed: %v", err)
+	}
+	if _, err := r.db.Exec(`UPDATE transactions SET provider_reference = ? WHERE id = ?`, reference, txID); err != nil {
+		return nil, fmt.Errorf("create payment invoice: record provider reference: %v", err)
+	}
+
+	currency := normalizeCurrency(req.Currency)
+	res, err := r.db.Exec(`
+		INSERT INTO payment_invoices (user_id, transaction_id, amount, currency, description, status)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, userID, txID, req.Amount, currency, req.Description, invoiceStatusPending)
+	if err != nil {
+		return nil, fmt.Errorf("create payment invoice: %v", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return &PaymentInvoice{
+		ID:            id,
+		UserID:        userID,
+		TransactionID: txID,
+		Amount:        req.Amount,
+		Currency:      currency,
+		Description:   req.Description,
+		Status:        invoiceStatusPending,
+	}, nil
+}
+
+// GetPaymentInvoice loads the invoice with id, scoped to userID so one
+// caller can never poll or learn the status of another's invoice.
+func (r *ProviderRouter) GetPaymentInvoice(id int64, userID int) (*PaymentInvoice, error) {
+	inv := &PaymentInvoice{}
+	var settledAt sql.NullTime
+	err := r.db.QueryRow(`
+		SELECT id, user_id, transaction_id, amount, currency, description, status, created_at, settled_at
+		FROM payment_invoices WHERE id = ? AND user_id = ?
+	`, id, userID).Scan(&inv.ID, &inv.UserID, &inv.TransactionID, &inv.Amount, &inv.Currency, &inv.Description,
+		&inv.Status, &inv.CreatedAt, &settledAt)
+	if err != nil {
+		return nil, err
+	}
+	if settledAt.Valid {
+		inv.SettledAt = &settledAt.Time
+	}
+	return inv, nil
+}
+
+// PollPaymentInvoiceStatus asks the invoice's provider for its
+// transaction's authoritative outcome via GetStatus -- the same call
+// ReconciliationChore's sweep makes for transactions stuck past its grace
+// period, except here a caller triggers it synchronously by polling GET
+// /api/v1/invoices/:id/status instead of waiting for the next sweep.
+// Settlement completes the transaction and writes its ledger entries via
+// completeTransaction (three_ds.go); a provider-confirmed failure marks
+// both the transaction and the invoice failed. A still-pending upstream
+// outcome leaves inv untouched for the next poll.
+func (r *ProviderRouter) PollPaymentInvoiceStatus(inv *PaymentInvoice) (*PaymentInvoice, error) {
+	if inv.Status != invoiceStatusPending {
+		return inv, nil
+	}
+
+	var providerID string
+	var providerReference sql.NullString
+	if err := r.db.QueryRow(`SELECT provider_id, provider_reference FROM transactions WHERE id = ?`, inv.TransactionID).
+		Scan(&providerID, &providerReference); err != nil {
+		return nil, fmt.Errorf("poll payment invoice %d: load transaction: %v", inv.ID, err)
+	}
+	if !providerReference.Valid || providerReference.String == "" {
+		return inv, nil
+	}
+
+	provider, ok := r.providers[providerID]
+	if !ok {
+		return nil, fmt.Errorf("poll payment invoice %d: provider %s no longer registered", inv.ID, providerID)
+	}
+
+	status, err := provider.GetStatus("payment", providerReference.String)
+	if err != nil {
+		return nil, fmt.Errorf("poll payment invoice %d: %v", inv.ID, err)
+	}
+
+	switch status {
+	case transactionStatusCompleted:
+		if err := r.completeTransaction(inv.TransactionID, inv.UserID, inv.Amount, inv.Currency); err != nil {
+			return nil, fmt.Errorf("poll payment invoice %d: complete transaction: %v", inv.ID, err)
+		}
+		if _, err := r.db.Exec(`UPDATE payment_invoices SET status = ?, settled_at = NOW() WHERE id = ?`, invoiceStatusPaid, inv.ID); err != nil {
+			return nil, fmt.Errorf("poll payment invoice %d: mark paid: %v", inv.ID, err)
+		}
+		inv.Status = invoiceStatusPaid
+	case transactionStatusFailed:
+		r.markTransactionStatus(inv.TransactionID, "failed")
+		if _, err := r.db.Exec(`UPDATE payment_invoices SET status = ? WHERE id = ?`, invoiceStatusFailed, inv.ID); err != nil {
+			return nil, fmt.Errorf("poll payment invoice %d: mark failed: %v", inv.ID, err)
+		}
+		inv.Status = invoiceStatusFailed
+		r.webhooks.Publish(WebhookEvent{Type: webhookEventPaymentFailed, UserID: inv.UserID, TransactionID: inv.TransactionID, Amount: inv.Amount, Currency: inv.Currency, OccurredAt: time.Now()})
+	}
+	return inv, nil
+}
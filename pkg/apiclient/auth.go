@@ -0,0 +1,54 @@
+package apiclient
+
+import "net/http"
+
+// AuthService wraps the login/refresh flow against the security API.
+type AuthService struct {
+	client *Client
+}
+
+// LoginRequest carries the credentials POSTed to /api/v1/auth/login.
+type LoginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	DeviceID string `json:"device_id,omitempty"`
+}
+
+// LoginResponse is what the server returns on a successful login, before any
+// MFA challenge is resolved.
+type LoginResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	CSRFToken    string `json:"csrf_token"`
+	MFARequired  bool   `json:"mfa_required"`
+}
+
+// Login authenticates and stores the resulting tokens on the client so
+// subsequent calls (including a pending MFA verification) are authenticated.
+func (a *AuthService) Login(req LoginRequest) (*LoginResponse, error) {
+	var resp LoginResponse
+	if err := a.client.do(http.MethodPost, "/api/v1/auth/login", req, &resp); err != nil {
+		return nil, err
+	}
+	a.client.setTokens(resp.AccessToken, resp.RefreshToken)
+	a.client.setCSRFToken(resp.CSRFToken)
+	return &resp, nil
+}
+
+// Refresh exchanges the stored refresh token for a new access token. do()
+// calls this automatically on a 401, but callers can also call it proactively
+// ahead of an access token's expiry.
+func (a *AuthService) Refresh() error {
+	_, refreshToken, _ := a.client.tokens()
+	if refreshToken == "" {
+		return &APIError{StatusCode: http.StatusUnauthorized, Body: "no refresh token available"}
+	}
+
+	var resp LoginResponse
+	if err := a.client.doWithRetry(http.MethodPost, "/api/v1/auth/refresh",
+		map[string]string{"refresh_token": refreshToken}, &resp, false); err != nil {
+		return err
+	}
+	a.client.setTokens(resp.AccessToken, resp.RefreshToken)
+	return nil
+}
@@ -0,0 +1,68 @@
+package apiclient
+
+import "net/http"
+
+// PaymentsService wraps /api/v1/payments and /api/v1/payouts.
+type PaymentsService struct {
+	client *Client
+}
+
+// CreatePaymentRequest mirrors PaymentRequest on the server. Description is
+// encrypted client-side with the server's RSA public key before it's sent,
+// matching what processPaymentHandler expects for sensitive fields.
+type CreatePaymentRequest struct {
+	Amount      float64
+	Description string
+}
+
+// PaymentResponse mirrors the server's payment result.
+type PaymentResponse struct {
+	Success       bool    `json:"success"`
+	TransactionID string  `json:"transaction_id"`
+	Amount        float64 `json:"amount"`
+}
+
+// Create submits a payment, encrypting the description field before it
+// leaves the process.
+func (p *PaymentsService) Create(req CreatePaymentRequest) (*PaymentResponse, error) {
+	encryptedDescription, err := p.client.encryptSensitiveField(req.Description)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := map[string]interface{}{
+		"amount":      req.Amount,
+		"description": encryptedDescription,
+	}
+
+	var resp PaymentResponse
+	if err := p.client.do(http.MethodPost, "/api/v1/payments", payload, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// CreatePayoutRequest mirrors PayoutRequest on the server.
+type CreatePayoutRequest struct {
+	Amount      float64
+	Description string
+}
+
+// CreatePayout submits a payout the same way Create submits a payment.
+func (p *PaymentsService) CreatePayout(req CreatePayoutRequest) (*PaymentResponse, error) {
+	encryptedDescription, err := p.client.encryptSensitiveField(req.Description)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := map[string]interface{}{
+		"amount":      req.Amount,
+		"description": encryptedDescription,
+	}
+
+	var resp PaymentResponse
+	if err := p.client.do(http.MethodPost, "/api/v1/payouts", payload, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
@@ -0,0 +1,48 @@
+package apiclient
+
+import "net/http"
+
+// SecurityService wraps the /api/v1/security/* self-service endpoints (2FA,
+// device trust, security profile).
+type SecurityService struct {
+	client *Client
+}
+
+// Enable2FAResponse mirrors the server's enable2FAHandler response.
+type Enable2FAResponse struct {
+	Secret         string   `json:"secret"`
+	QRCodeURL      string   `json:"qr_code_url"`
+	RecoveryCodes  []string `json:"recovery_codes"`
+}
+
+// Enable2FA starts the 2FA enrollment flow for the logged-in user.
+func (s *SecurityService) Enable2FA() (*Enable2FAResponse, error) {
+	var resp Enable2FAResponse
+	if err := s.client.do(http.MethodPost, "/api/v1/security/2fa/enable", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Verify2FA confirms enrollment (or completes a login challenge) with a code
+// from the user's authenticator app.
+func (s *SecurityService) Verify2FA(code string) error {
+	return s.client.do(http.MethodPost, "/api/v1/security/2fa/verify",
+		map[string]string{"code": code}, nil)
+}
+
+// TrustDevice marks the given device ID as trusted for the logged-in user.
+func (s *SecurityService) TrustDevice(deviceID string) error {
+	return s.client.do(http.MethodPost, "/api/v1/security/device/trust",
+		map[string]string{"device_id": deviceID}, nil)
+}
+
+// Profile fetches the caller's security profile (risk score, trusted
+// devices, active sessions).
+func (s *SecurityService) Profile() (map[string]interface{}, error) {
+	var resp map[string]interface{}
+	if err := s.client.do(http.MethodGet, "/api/v1/security/profile", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,47 @@
+package apiclient
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// TransactionsService wraps /api/v1/transactions and /api/v1/balance.
+type TransactionsService struct {
+	client *Client
+}
+
+// Transaction mirrors a single row the server returns from transaction
+// history.
+type Transaction struct {
+	ID        string  `json:"id"`
+	Amount    float64 `json:"amount"`
+	Status    string  `json:"status"`
+	CreatedAt string  `json:"created_at"`
+}
+
+// History fetches up to limit of the caller's most recent transactions.
+func (t *TransactionsService) History(limit int) ([]Transaction, error) {
+	if limit <= 0 {
+		limit = 50
+	}
+
+	var resp struct {
+		Transactions []Transaction `json:"transactions"`
+	}
+	path := fmt.Sprintf("/api/v1/transactions?limit=%d", limit)
+	if err := t.client.do(http.MethodGet, path, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Transactions, nil
+}
+
+// Balance fetches the caller's current balance.
+func (t *TransactionsService) Balance() (float64, error) {
+	var resp struct {
+		Balance float64 `json:"balance"`
+	}
+	if err := t.client.do(http.MethodGet, "/api/v1/balance", nil, &resp); err != nil {
+		return 0, err
+	}
+	return resp.Balance, nil
+}
@@ -0,0 +1,87 @@
+package payloadanalyzer
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// dangerousTags are tags that execute or load content rather than merely
+// display it; any of these in a parsed fragment is suspicious regardless of
+// attributes.
+var dangerousTags = map[string]bool{
+	"script": true,
+	"iframe": true,
+	"object": true,
+	"embed":  true,
+	"form":   true,
+	"meta":   true,
+	"base":   true,
+}
+
+// dangerousURLSchemes are schemes that run script when followed, rather
+// than navigate or load a resource.
+var dangerousURLSchemes = []string{"javascript:", "vbscript:"}
+
+// AnalyzeHTML parses s as an HTML document and walks the resulting tree,
+// flagging dangerousTags, any "on*" event-handler attribute, and
+// javascript:/vbscript: URLs in href/src/action - structural checks against
+// what the parser actually resolved, rather than a substring match that
+// would also fire on the word "script" appearing in ordinary prose.
+func AnalyzeHTML(s string) []Finding {
+	if !strings.ContainsAny(s, "<>") {
+		return nil
+	}
+
+	doc, err := html.Parse(strings.NewReader(s))
+	if err != nil {
+		return nil
+	}
+
+	var findings []Finding
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			tag := strings.ToLower(n.Data)
+			if dangerousTags[tag] {
+				findings = append(findings, Finding{
+					Rule:       "html-dangerous-tag",
+					Confidence: 0.8,
+					Location:   fmt.Sprintf("<%s>", tag),
+					Excerpt:    excerpt(s, 0, len(s)),
+				})
+			}
+			for _, attr := range n.Attr {
+				name := strings.ToLower(attr.Key)
+				if strings.HasPrefix(name, "on") {
+					findings = append(findings, Finding{
+						Rule:       "html-event-handler-attribute",
+						Confidence: 0.75,
+						Location:   fmt.Sprintf("<%s %s>", tag, name),
+						Excerpt:    excerpt(attr.Val, 0, len(attr.Val)),
+					})
+				}
+				if name == "href" || name == "src" || name == "action" || name == "formaction" {
+					lowered := strings.ToLower(strings.TrimSpace(attr.Val))
+					for _, scheme := range dangerousURLSchemes {
+						if strings.HasPrefix(lowered, scheme) {
+							findings = append(findings, Finding{
+								Rule:       "html-script-uri",
+								Confidence: 0.85,
+								Location:   fmt.Sprintf("<%s %s>", tag, name),
+								Excerpt:    excerpt(attr.Val, 0, len(attr.Val)),
+							})
+						}
+					}
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	return findings
+}
@@ -0,0 +1,44 @@
+// Package payloadanalyzer replaces the substring/regex approach to
+// detecting SQL injection, XSS, and command injection with three small
+// parser/tokenizer-based analyzers: AnalyzeSQL, AnalyzeHTML, and
+// AnalyzeShell. A regex list flags any string containing "select" or "--";
+// these analyzers look at structure instead (an unbalanced quote, a
+// comment that follows a string literal rather than opening the input, a
+// tag the HTML parser actually resolved to <script>, a shell word the
+// tokenizer resolved to a command substitution) so ordinary text that
+// happens to contain a keyword doesn't trip them.
+//
+// Each analyzer returns a Finding per signal so the caller (see waf.go's
+// WAFEngine) can log precise evidence - which rule, how confident, where in
+// the input, and the exact excerpt - instead of just "a pattern matched
+// somewhere in this field".
+package payloadanalyzer
+
+// Finding is one structured result from an analyzer.
+type Finding struct {
+	Rule       string  // stable identifier, e.g. "sql-tautology"
+	Confidence float64 // 0..1, the analyzer's own estimate of how suspicious this is
+	Location   string  // where in the input this fired, e.g. "offset 14"
+	Excerpt    string  // the exact substring that tripped the rule, capped to a loggable length
+}
+
+const maxExcerptLen = 120
+
+// excerpt clamps s[from:to] to a sane range and caps its length, so a
+// multi-KB request body doesn't blow up a single security_events row.
+func excerpt(s string, from, to int) string {
+	if from < 0 {
+		from = 0
+	}
+	if to > len(s) {
+		to = len(s)
+	}
+	if to < from {
+		return ""
+	}
+	e := s[from:to]
+	if len(e) > maxExcerptLen {
+		e = e[:maxExcerptLen] + "…"
+	}
+	return e
+}
@@ -0,0 +1,165 @@
+// This analyzer was specified against mvdan.cc/sh/v3/syntax, which is not
+// vendored in this build and - like the go-redis client noted in
+// state_store.go and the YAML library noted in waf.go - can't be fetched
+// in this environment. Rather than fabricate that dependency, AnalyzeShell
+// below hand-rolls the narrow slice of shell lexing the checks actually
+// need: command substitutions, pipelines, redirections, and command
+// chaining. Swapping in mvdan.cc/sh/v3/syntax.Parse for tokenizeShell later
+// is a drop-in change once that module is available, since callers only
+// see the Finding list.
+package payloadanalyzer
+
+import "fmt"
+
+type shellTokenKind int
+
+const (
+	shellTokWord shellTokenKind = iota
+	shellTokString
+	shellTokSubstitution // $(...) or `...`
+	shellTokPipe         // |
+	shellTokRedirect     // >, >>, <, <<
+	shellTokAndOr        // && or ||
+	shellTokSeparator    // ;
+)
+
+type shellToken struct {
+	kind shellTokenKind
+	text string
+	pos  int
+}
+
+// tokenizeShell is a lightweight lexer over s: quoted strings (single,
+// double, and backtick-as-substitution), $(...) command substitutions,
+// pipes, redirections, &&/||  chaining, and ';' separators. It does not
+// build a command tree (no word splitting, no here-doc bodies) - it only
+// needs to tell AnalyzeShell's checks where these constructs occur.
+func tokenizeShell(s string) []shellToken {
+	var toks []shellToken
+	i := 0
+	n := len(s)
+	for i < n {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '\'' || c == '"':
+			start := i
+			quote := c
+			i++
+			for i < n && s[i] != quote {
+				if s[i] == '\\' && i+1 < n {
+					i++
+				}
+				i++
+			}
+			if i < n {
+				i++
+			}
+			toks = append(toks, shellToken{shellTokString, s[start:i], start})
+		case c == '`':
+			start := i
+			i++
+			for i < n && s[i] != '`' {
+				i++
+			}
+			if i < n {
+				i++
+			}
+			toks = append(toks, shellToken{shellTokSubstitution, s[start:i], start})
+		case c == '$' && i+1 < n && s[i+1] == '(':
+			start := i
+			depth := 0
+			for i < n {
+				if s[i] == '(' {
+					depth++
+				} else if s[i] == ')' {
+					depth--
+					if depth == 0 {
+						i++
+						break
+					}
+				}
+				i++
+			}
+			toks = append(toks, shellToken{shellTokSubstitution, s[start:i], start})
+		case c == '|':
+			start := i
+			i++
+			if i < n && s[i] == '|' {
+				i++
+				toks = append(toks, shellToken{shellTokAndOr, s[start:i], start})
+			} else {
+				toks = append(toks, shellToken{shellTokPipe, s[start:i], start})
+			}
+		case c == '&' && i+1 < n && s[i+1] == '&':
+			toks = append(toks, shellToken{shellTokAndOr, "&&", i})
+			i += 2
+		case c == '>' || c == '<':
+			start := i
+			i++
+			if i < n && s[i] == c {
+				i++
+			}
+			toks = append(toks, shellToken{shellTokRedirect, s[start:i], start})
+		case c == ';':
+			toks = append(toks, shellToken{shellTokSeparator, ";", i})
+			i++
+		default:
+			start := i
+			for i < n && !isShellMeta(s[i]) && s[i] != ' ' && s[i] != '\t' && s[i] != '\n' {
+				i++
+			}
+			if i == start {
+				i++
+				continue
+			}
+			toks = append(toks, shellToken{shellTokWord, s[start:i], start})
+		}
+	}
+	return toks
+}
+
+func isShellMeta(c byte) bool {
+	switch c {
+	case '|', '&', '>', '<', ';', '\'', '"', '`', '$':
+		return true
+	}
+	return false
+}
+
+// AnalyzeShell tokenizes s and flags command substitutions, pipelines, and
+// redirections - the constructs that turn an argument meant to be one
+// value (a filename, a search term) into a second command running
+// alongside or instead of the intended one.
+func AnalyzeShell(s string) []Finding {
+	toks := tokenizeShell(s)
+
+	var findings []Finding
+	for _, t := range toks {
+		switch t.kind {
+		case shellTokSubstitution:
+			findings = append(findings, Finding{
+				Rule:       "shell-command-substitution",
+				Confidence: 0.85,
+				Location:   fmt.Sprintf("offset %d", t.pos),
+				Excerpt:    excerpt(s, t.pos, t.pos+len(t.text)),
+			})
+		case shellTokPipe, shellTokAndOr:
+			findings = append(findings, Finding{
+				Rule:       "shell-pipeline",
+				Confidence: 0.6,
+				Location:   fmt.Sprintf("offset %d", t.pos),
+				Excerpt:    excerpt(s, 0, len(s)),
+			})
+		case shellTokRedirect:
+			findings = append(findings, Finding{
+				Rule:       "shell-redirection",
+				Confidence: 0.55,
+				Location:   fmt.Sprintf("offset %d", t.pos),
+				Excerpt:    excerpt(s, 0, len(s)),
+			})
+		}
+	}
+	return findings
+}
@@ -0,0 +1,180 @@
+package payloadanalyzer
+
+import (
+	"fmt"
+	"strings"
+)
+
+type sqlTokenKind int
+
+const (
+	sqlTokWord sqlTokenKind = iota
+	sqlTokString
+	sqlTokNumber
+	sqlTokOperator
+	sqlTokPunct
+	sqlTokComment
+)
+
+type sqlToken struct {
+	kind sqlTokenKind
+	text string
+	pos  int
+}
+
+// tokenizeSQL is a lightweight lexer over s: quoted strings, numbers,
+// bareword identifiers, the comparison operators a tautology is built
+// from, statement separators, and line/block comments. It does not
+// understand a full SQL grammar (no expression tree, no dialect-specific
+// quoting rules) - it only needs to surface what AnalyzeSQL's checks ask
+// of it.
+func tokenizeSQL(s string) []sqlToken {
+	var toks []sqlToken
+	i := 0
+	n := len(s)
+	for i < n {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '\'' || c == '"':
+			start := i
+			quote := c
+			i++
+			for i < n && s[i] != quote {
+				if s[i] == '\\' && i+1 < n {
+					i++
+				}
+				i++
+			}
+			if i < n {
+				i++
+			}
+			toks = append(toks, sqlToken{sqlTokString, s[start:i], start})
+		case c == '-' && i+1 < n && s[i+1] == '-':
+			start := i
+			for i < n && s[i] != '\n' {
+				i++
+			}
+			toks = append(toks, sqlToken{sqlTokComment, s[start:i], start})
+		case c == '/' && i+1 < n && s[i+1] == '*':
+			start := i
+			i += 2
+			for i+1 < n && !(s[i] == '*' && s[i+1] == '/') {
+				i++
+			}
+			i += 2
+			if i > n {
+				i = n
+			}
+			toks = append(toks, sqlToken{sqlTokComment, s[start:i], start})
+		case c >= '0' && c <= '9':
+			start := i
+			for i < n && (s[i] >= '0' && s[i] <= '9' || s[i] == '.') {
+				i++
+			}
+			toks = append(toks, sqlToken{sqlTokNumber, s[start:i], start})
+		case isSQLWordStart(c):
+			start := i
+			for i < n && isSQLWordChar(s[i]) {
+				i++
+			}
+			toks = append(toks, sqlToken{sqlTokWord, s[start:i], start})
+		case strings.IndexByte("=<>!", c) >= 0:
+			start := i
+			i++
+			for i < n && strings.IndexByte("=<>", s[i]) >= 0 {
+				i++
+			}
+			toks = append(toks, sqlToken{sqlTokOperator, s[start:i], start})
+		case c == ';':
+			toks = append(toks, sqlToken{sqlTokPunct, ";", i})
+			i++
+		default:
+			i++
+		}
+	}
+	return toks
+}
+
+func isSQLWordStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isSQLWordChar(c byte) bool {
+	return isSQLWordStart(c) || (c >= '0' && c <= '9')
+}
+
+func isConstantToken(t sqlToken) bool {
+	return t.kind == sqlTokNumber || t.kind == sqlTokString
+}
+
+// AnalyzeSQL tokenizes s and flags the structural signs of injection:
+//
+//   - an odd number of quote characters, meaning a string literal was
+//     broken out of rather than closed;
+//   - more than one statement, separated by a ';' that isn't the final
+//     character (a stacked query);
+//   - a comparison between two constants on both sides, e.g. 1=1 or
+//     'a'='a' (a tautology);
+//   - a comment sequence that follows a string, operator, or statement
+//     separator rather than opening the whole input - a legitimate "--" in
+//     a filename sits alone, an injected one follows a quote so the rest of
+//     the query is discarded.
+func AnalyzeSQL(s string) []Finding {
+	var findings []Finding
+	toks := tokenizeSQL(s)
+
+	if quotes := strings.Count(s, "'") + strings.Count(s, "\""); quotes%2 != 0 {
+		findings = append(findings, Finding{
+			Rule:       "sql-unbalanced-quote",
+			Confidence: 0.6,
+			Location:   "input",
+			Excerpt:    excerpt(s, 0, len(s)),
+		})
+	}
+
+	for i, t := range toks {
+		if t.kind == sqlTokPunct && t.text == ";" && i != len(toks)-1 {
+			findings = append(findings, Finding{
+				Rule:       "sql-stacked-query",
+				Confidence: 0.75,
+				Location:   fmt.Sprintf("offset %d", t.pos),
+				Excerpt:    excerpt(s, 0, len(s)),
+			})
+			break
+		}
+	}
+
+	for i := 0; i+2 < len(toks); i++ {
+		left, op, right := toks[i], toks[i+1], toks[i+2]
+		if op.kind != sqlTokOperator || !isConstantToken(left) || !isConstantToken(right) {
+			continue
+		}
+		findings = append(findings, Finding{
+			Rule:       "sql-tautology",
+			Confidence: 0.85,
+			Location:   fmt.Sprintf("offset %d", left.pos),
+			Excerpt:    excerpt(s, left.pos, right.pos+len(right.text)),
+		})
+	}
+
+	for i, t := range toks {
+		if t.kind != sqlTokComment {
+			continue
+		}
+		if i > 0 {
+			prev := toks[i-1].kind
+			if prev == sqlTokString || prev == sqlTokOperator || prev == sqlTokPunct {
+				findings = append(findings, Finding{
+					Rule:       "sql-comment-truncation",
+					Confidence: 0.7,
+					Location:   fmt.Sprintf("offset %d", t.pos),
+					Excerpt:    excerpt(s, t.pos, t.pos+len(t.text)),
+				})
+			}
+		}
+	}
+
+	return findings
+}
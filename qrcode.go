@@ -0,0 +1,573 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+// This file implements just enough of ISO/IEC 18004 (QR Code Model 2) to
+// render the otpauth:// enrollment URI as a scannable PNG without pulling in
+// a third-party QR library -- this sandbox has no network access to vendor
+// one. It supports versions 1-10, error-correction level L, byte mode only,
+// which comfortably covers an otpauth URI (a few hundred bytes at most);
+// generateQRCodePNG picks the smallest version that fits the payload.
+
+const qrECCLevelL = 0x01 // 2-bit format-info field: L=01, M=00, Q=11, H=10
+
+// qrVersionInfo holds the byte-mode capacity and error-correction block
+// layout for one QR version at EC level L, straight out of ISO/IEC 18004
+// Table 9 / Table 13.
+type qrVersionInfo struct {
+	size        int // modules per side = 4*version + 17
+	totalCW     int // total codewords (data + EC)
+	eccPerBlock int
+	g1Blocks    int
+	g1DataCW    int
+	g2Blocks    int // 0 if there's only one group
+	g2DataCW    int
+	alignment   []int // alignment pattern center coordinates, excluding the three finder corners
+}
+
+var qrVersions = []qrVersionInfo{
+	{21, 26, 7, 1, 19, 0, 0, nil},
+	{25, 44, 10, 1, 34, 0, 0, []int{6, 18}},
+	{29, 70, 15, 1, 55, 0, 0, []int{6, 22}},
+	{33, 100, 20, 1, 80, 0, 0, []int{6, 26}},
+	{37, 134, 26, 1, 108, 0, 0, []int{6, 30}},
+	{41, 172, 18, 2, 68, 0, 0, []int{6, 34}},
+	{45, 196, 20, 2, 78, 0, 0, []int{6, 22, 38}},
+	{49, 242, 24, 2, 97, 0, 0, []int{6, 24, 42}},
+	{53, 292, 30, 2, 116, 0, 0, []int{6, 26, 46}},
+	{57, 346, 18, 2, 68, 2, 69, []int{6, 28, 50}},
+}
+
+// byteModeCapacity returns the largest payload (in bytes) version v (1-10)
+// can carry in byte mode at EC level L, after the mode/count-indicator and
+// terminator overhead.
+func byteModeCapacity(v int) int {
+	info := qrVersions[v-1]
+	dataCW := info.g1Blocks*info.g1DataCW + info.g2Blocks*info.g2DataCW
+	countBits := 8
+	if v >= 10 {
+		countBits = 16
+	}
+	headerBits := 4 + countBits
+	return (dataCW*8 - headerBits) / 8
+}
+
+// --- GF(256) arithmetic and Reed-Solomon error correction ---
+
+var qrGFExp [512]int
+var qrGFLog [256]int
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		qrGFExp[i] = x
+		qrGFLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < 512; i++ {
+		qrGFExp[i] = qrGFExp[i-255]
+	}
+}
+
+func qrGFMul(a, b int) int {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return qrGFExp[qrGFLog[a]+qrGFLog[b]]
+}
+
+// qrRSGeneratorPoly returns the degree-n Reed-Solomon generator polynomial
+// (coefficients highest-degree first) used to compute n EC codewords.
+func qrRSGeneratorPoly(n int) []int {
+	poly := []int{1}
+	for i := 0; i < n; i++ {
+		next := make([]int, len(poly)+1)
+		for j, c := range poly {
+			next[j] ^= c
+			next[j+1] ^= qrGFMul(c, qrGFExp[i])
+		}
+		poly = next
+	}
+	return poly
+}
+
+// qrRSEncode returns the nEC Reed-Solomon error-correction codewords for a
+// block of data codewords.
+func qrRSEncode(data []byte, nEC int) []byte {
+	gen := qrRSGeneratorPoly(nEC)
+	remainder := make([]int, len(data)+nEC)
+	for i, b := range data {
+		remainder[i] = int(b)
+	}
+	for i := 0; i < len(data); i++ {
+		coeff := remainder[i]
+		if coeff == 0 {
+			continue
+		}
+		for j, g := range gen {
+			remainder[i+j] ^= qrGFMul(g, coeff)
+		}
+	}
+	ec := make([]byte, nEC)
+	for i := 0; i < nEC; i++ {
+		ec[i] = byte(remainder[len(data)+i])
+	}
+	return ec
+}
+
+// --- Bit encoding ---
+
+type qrBitWriter struct {
+	bits []bool
+}
+
+func (w *qrBitWriter) writeBits(value, count int) {
+	for i := count - 1; i >= 0; i-- {
+		w.bits = append(w.bits, (value>>uint(i))&1 == 1)
+	}
+}
+
+// qrEncodeDataCodewords builds the padded data codeword stream (mode
+// indicator, character count, byte-mode payload, terminator, byte-align
+// padding, then alternating 0xEC/0x11 pad codewords) for version v.
+func qrEncodeDataCodewords(data []byte, v int) []byte {
+	info := qrVersions[v-1]
+	dataCW := info.g1Blocks*info.g1DataCW + info.g2Blocks*info.g2DataCW
+
+	countBits := 8
+	if v >= 10 {
+		countBits = 16
+	}
+
+	w := &qrBitWriter{}
+	w.writeBits(0x4, 4) // byte-mode indicator
+	w.writeBits(len(data), countBits)
+	for _, b := range data {
+		w.writeBits(int(b), 8)
+	}
+
+	// Terminator: up to 4 zero bits, only as many as fit.
+	for i := 0; i < 4 && len(w.bits) < dataCW*8; i++ {
+		w.bits = append(w.bits, false)
+	}
+	for len(w.bits)%8 != 0 {
+		w.bits = append(w.bits, false)
+	}
+
+	codewords := make([]byte, len(w.bits)/8)
+	for i := range codewords {
+		var b byte
+		for j := 0; j < 8; j++ {
+			b <<= 1
+			if w.bits[i*8+j] {
+				b |= 1
+			}
+		}
+		codewords[i] = b
+	}
+
+	pad := [2]byte{0xEC, 0x11}
+	for i := 0; len(codewords) < dataCW; i++ {
+		codewords = append(codewords, pad[i%2])
+	}
+	return codewords
+}
+
+// qrInterleave splits codewords into the version's EC blocks, computes each
+// block's EC codewords, then interleaves data and EC codewords round-robin
+// the way every QR decoder expects the final bitstream laid out.
+func qrInterleave(codewords []byte, v int) []byte {
+	info := qrVersions[v-1]
+
+	type block struct {
+		data []byte
+		ec   []byte
+	}
+	var blocks []block
+	offset := 0
+	addBlocks := func(count, size int) {
+		for i := 0; i < count; i++ {
+			d := codewords[offset : offset+size]
+			offset += size
+			blocks = append(blocks, block{data: d, ec: qrRSEncode(d, info.eccPerBlock)})
+		}
+	}
+	addBlocks(info.g1Blocks, info.g1DataCW)
+	addBlocks(info.g2Blocks, info.g2DataCW)
+
+	var out []byte
+	maxData := info.g1DataCW
+	if info.g2DataCW > maxData {
+		maxData = info.g2DataCW
+	}
+	for i := 0; i < maxData; i++ {
+		for _, b := range blocks {
+			if i < len(b.data) {
+				out = append(out, b.data[i])
+			}
+		}
+	}
+	for i := 0; i < info.eccPerBlock; i++ {
+		for _, b := range blocks {
+			out = append(out, b.ec[i])
+		}
+	}
+	return out
+}
+
+// --- Matrix construction ---
+
+type qrMatrix struct {
+	size    int
+	modules [][]bool
+	isFunc  [][]bool // true where a function pattern (finder/timing/etc) lives, never touched by data/mask
+}
+
+func newQRMatrix(size int) *qrMatrix {
+	m := &qrMatrix{size: size}
+	m.modules = make([][]bool, size)
+	m.isFunc = make([][]bool, size)
+	for i := range m.modules {
+		m.modules[i] = make([]bool, size)
+		m.isFunc[i] = make([]bool, size)
+	}
+	return m
+}
+
+func (m *qrMatrix) set(x, y int, dark bool) {
+	m.modules[y][x] = dark
+	m.isFunc[y][x] = true
+}
+
+func (m *qrMatrix) placeFinder(x, y int) {
+	for dy := -1; dy <= 7; dy++ {
+		for dx := -1; dx <= 7; dx++ {
+			px, py := x+dx, y+dy
+			if px < 0 || py < 0 || px >= m.size || py >= m.size {
+				continue
+			}
+			dark := dx >= 0 && dx <= 6 && dy >= 0 && dy <= 6 &&
+				(dx == 0 || dx == 6 || dy == 0 || dy == 6 || (dx >= 2 && dx <= 4 && dy >= 2 && dy <= 4))
+			m.set(px, py, dark)
+		}
+	}
+}
+
+func (m *qrMatrix) placeAlignment(x, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			dark := dx == -2 || dx == 2 || dy == -2 || dy == 2 || (dx == 0 && dy == 0)
+			m.set(x+dx, y+dy, dark)
+		}
+	}
+}
+
+func (m *qrMatrix) placeFunctionPatterns(v int) {
+	m.placeFinder(0, 0)
+	m.placeFinder(m.size-7, 0)
+	m.placeFinder(0, m.size-7)
+
+	for i := 8; i < m.size-8; i++ {
+		m.set(i, 6, i%2 == 0)
+		m.set(6, i, i%2 == 0)
+	}
+
+	m.set(8, m.size-8, true) // dark module, fixed at (8, 4*version+9)
+
+	align := qrVersions[v-1].alignment
+	for _, ax := range align {
+		for _, ay := range align {
+			// Skip the three positions that overlap a finder pattern.
+			if (ax == 6 && ay == 6) || (ax == 6 && ay == m.size-7) || (ax == m.size-7 && ay == 6) {
+				continue
+			}
+			m.placeAlignment(ax, ay)
+		}
+	}
+
+	// Reserve (but don't fill yet) the format-info strips and, for v>=7,
+	// the two version-info blocks, so data placement skips over them.
+	for i := 0; i < 9; i++ {
+		m.isFunc[8][i] = true
+		m.isFunc[i][8] = true
+	}
+	for i := 0; i < 8; i++ {
+		m.isFunc[8][m.size-1-i] = true
+		m.isFunc[m.size-1-i][8] = true
+	}
+	if v >= 7 {
+		for i := 0; i < 6; i++ {
+			for j := 0; j < 3; j++ {
+				m.isFunc[m.size-11+j][i] = true
+				m.isFunc[i][m.size-11+j] = true
+			}
+		}
+	}
+}
+
+// qrBCH computes the remainder of dividing data (as a binary polynomial) by
+// generator poly, used for both format-info and version-info error
+// correction bits.
+func qrBCH(data, poly int, polyBits int) int {
+	msb := func(v int) int {
+		bits := 0
+		for v != 0 {
+			bits++
+			v >>= 1
+		}
+		return bits
+	}
+	for msb(data) >= polyBits {
+		data ^= poly << uint(msb(data)-polyBits)
+	}
+	return data
+}
+
+func (m *qrMatrix) placeFormatInfo(mask int) {
+	data := (qrECCLevelL << 3) | mask
+	rem := qrBCH(data<<10, 0x537, 11)
+	format := ((data << 10) | rem) ^ 0x5412
+
+	bit := func(i int) bool { return (format>>uint(i))&1 == 1 }
+
+	for i := 0; i <= 5; i++ {
+		m.set(8, i, bit(i))
+	}
+	m.set(8, 7, bit(6))
+	m.set(8, 8, bit(7))
+	m.set(7, 8, bit(8))
+	for i := 9; i <= 14; i++ {
+		m.set(14-i, 8, bit(i))
+	}
+	for i := 0; i <= 7; i++ {
+		m.set(m.size-1-i, 8, bit(i))
+	}
+	for i := 8; i <= 14; i++ {
+		m.set(8, m.size-15+i, bit(i))
+	}
+}
+
+func (m *qrMatrix) placeVersionInfo(v int) {
+	if v < 7 {
+		return
+	}
+	data := v << 12
+	rem := qrBCH(data, 0x1F25, 13)
+	info := data | rem
+
+	for i := 0; i < 18; i++ {
+		bit := (info>>uint(i))&1 == 1
+		row := i % 3
+		col := i / 3
+		m.set(m.size-11+row, col, bit)
+		m.set(col, m.size-11+row, bit)
+	}
+}
+
+// qrApplyMask reports the on/off state of the mask at (x, y) for pattern 0-7,
+// per ISO/IEC 18004 Table 20.
+func qrApplyMask(pattern, x, y int) bool {
+	switch pattern {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return (x*y)%2+(x*y)%3 == 0
+	case 6:
+		return ((x*y)%2+(x*y)%3)%2 == 0
+	default:
+		return ((x+y)%2+(x*y)%3)%2 == 0
+	}
+}
+
+// placeData writes codewords into every non-function module in the
+// zigzag, bottom-to-top-then-top-to-bottom column order QR decoders expect,
+// XORing each bit against the given mask pattern as it's placed.
+func (m *qrMatrix) placeData(codewords []byte, mask int) {
+	bitIndex := 0
+	totalBits := len(codewords) * 8
+	nextBit := func() bool {
+		if bitIndex >= totalBits {
+			return false
+		}
+		b := codewords[bitIndex/8]
+		bit := (b>>uint(7-bitIndex%8))&1 == 1
+		bitIndex++
+		return bit
+	}
+
+	upward := true
+	for col := m.size - 1; col > 0; col -= 2 {
+		if col == 6 { // vertical timing pattern column is skipped entirely
+			col--
+		}
+		for i := 0; i < m.size; i++ {
+			row := i
+			if upward {
+				row = m.size - 1 - i
+			}
+			for _, x := range []int{col, col - 1} {
+				if m.isFunc[row][x] {
+					continue
+				}
+				bit := nextBit()
+				if qrApplyMask(mask, x, row) {
+					bit = !bit
+				}
+				m.modules[row][x] = bit
+			}
+		}
+		upward = !upward
+	}
+}
+
+// qrMaskPenalty scores matrix using three of the four ISO/IEC 18004 penalty
+// rules (runs, 2x2 blocks, dark/light balance); the finder-like pattern rule
+// is not scored. Lower is better, so the caller picks the mask with the
+// minimum score.
+func qrMaskPenalty(m *qrMatrix) int {
+	size := m.size
+	penalty := 0
+
+	scanLines := func(get func(i, j int) bool) {
+		for i := 0; i < size; i++ {
+			run := 1
+			for j := 1; j < size; j++ {
+				if get(i, j) == get(i, j-1) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					penalty += run - 2
+				}
+				run = 1
+			}
+			if run >= 5 {
+				penalty += run - 2
+			}
+		}
+	}
+	scanLines(func(i, j int) bool { return m.modules[i][j] })
+	scanLines(func(i, j int) bool { return m.modules[j][i] })
+
+	for y := 0; y < size-1; y++ {
+		for x := 0; x < size-1; x++ {
+			v := m.modules[y][x]
+			if m.modules[y][x+1] == v && m.modules[y+1][x] == v && m.modules[y+1][x+1] == v {
+				penalty += 3
+			}
+		}
+	}
+
+	darkCount := 0
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			if m.modules[y][x] {
+				darkCount++
+			}
+		}
+	}
+	percent := darkCount * 100 / (size * size)
+	penalty += abs(percent-50) / 5 * 10
+
+	return penalty
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// buildQRMatrix renders data (already the full otpauth payload) into a
+// version v QR Code Model 2 symbol at EC level L, selecting the mask pattern
+// with the lowest penalty score among all eight candidates.
+func buildQRMatrix(data []byte, v int) *qrMatrix {
+	codewords := qrEncodeDataCodewords(data, v)
+	interleaved := qrInterleave(codewords, v)
+
+	var best *qrMatrix
+	bestScore := -1
+	for mask := 0; mask < 8; mask++ {
+		m := newQRMatrix(qrVersions[v-1].size)
+		m.placeFunctionPatterns(v)
+		m.placeData(interleaved, mask)
+		m.placeFormatInfo(mask)
+		m.placeVersionInfo(v)
+		score := qrMaskPenalty(m)
+		if best == nil || score < bestScore {
+			best, bestScore = m, score
+		}
+	}
+	return best
+}
+
+// renderQRPNG rasterizes matrix as a black-on-white PNG, scale modules per
+// pixel with a 4-module quiet zone border, the minimum ISO/IEC 18004 requires.
+func renderQRPNG(m *qrMatrix, scale int) ([]byte, error) {
+	const quietZone = 4
+	dim := (m.size + 2*quietZone) * scale
+	img := image.NewGray(image.Rect(0, 0, dim, dim))
+	for y := 0; y < dim; y++ {
+		for x := 0; x < dim; x++ {
+			img.SetGray(x, y, color.Gray{Y: 255})
+		}
+	}
+	for y := 0; y < m.size; y++ {
+		for x := 0; x < m.size; x++ {
+			if !m.modules[y][x] {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					px := (x+quietZone)*scale + dx
+					py := (y+quietZone)*scale + dy
+					img.SetGray(px, py, color.Gray{Y: 0})
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("failed to encode QR PNG: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// generateQRCodePNG renders payload (the otpauth:// enrollment URI) as a
+// PNG authenticator apps can scan, picking the smallest of the 10 supported
+// versions that fits it.
+func generateQRCodePNG(payload string) ([]byte, error) {
+	data := []byte(payload)
+	version := 0
+	for v := 1; v <= len(qrVersions); v++ {
+		if byteModeCapacity(v) >= len(data) {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, fmt.Errorf("otpauth URI too long to encode (%d bytes, max %d)", len(data), byteModeCapacity(len(qrVersions)))
+	}
+
+	matrix := buildQRMatrix(data, version)
+	return renderQRPNG(matrix, 8)
+}
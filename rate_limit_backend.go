@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimitBackend decides whether a request identified by key (normally an
+// IP address) is allowed to proceed under a requests-per-minute budget. It
+// exists so the token-bucket state can live somewhere multiple API
+// instances share instead of one process's memory — today that's the
+// in-process backend below, behind the same DSN-sniffing switch StateStore
+// and SecurityRepository already use.
+type RateLimitBackend interface {
+	// Allow reports whether the caller identified by key may proceed given
+	// a budget of ratePerMinute requests per minute and the given burst
+	// allowance.
+	Allow(key string, ratePerMinute float64, burst int) bool
+}
+
+// inProcessRateLimitBackend keeps one *rate.Limiter per key in a
+// shardedTTLCache instead of the unbounded map the limiters used to live
+// in, so an attacker who cycles through source IPs can no longer grow the
+// process's memory without bound — idle limiters age out of their shard on
+// the janitor sweep or get evicted under shard capacity pressure.
+type inProcessRateLimitBackend struct {
+	limiters *shardedTTLCache
+	idleTTL  time.Duration
+}
+
+func newInProcessRateLimitBackend() *inProcessRateLimitBackend {
+	b := &inProcessRateLimitBackend{
+		limiters: newShardedTTLCache("rate_limiters", 4096),
+		idleTTL:  10 * time.Minute,
+	}
+	return b
+}
+
+func (b *inProcessRateLimitBackend) Allow(key string, ratePerMinute float64, burst int) bool {
+	var limiter *rate.Limiter
+	if cached, ok := b.limiters.Get(key); ok {
+		limiter = cached.(*rate.Limiter)
+	} else {
+		limiter = rate.NewLimiter(rate.Limit(ratePerMinute/60), burst)
+	}
+	// Refresh the TTL on every touch so an IP making steady requests never
+	// loses its limiter mid-window, while one that goes quiet ages out.
+	b.limiters.Set(key, limiter, b.idleTTL)
+	allowed := limiter.Allow()
+	if !allowed {
+		rateLimitRejectionsTotal.Inc()
+	}
+	return allowed
+}
+
+// redisRateLimitBackend is the placeholder for a multi-instance backend
+// shared through Redis. It has no Redis client: Allow logs the call and
+// allows every request, and newRateLimitBackendFromDSN never returns one
+// (a redis:// DSN falls back to the in-process backend), so rate limits are
+// enforced per instance only.
+type redisRateLimitBackend struct {
+	dsn string
+}
+
+func (b *redisRateLimitBackend) Allow(key string, ratePerMinute float64, burst int) bool {
+	// TODO: INCR key / EXPIRE key 60s for a fixed window, or run the
+	// sliding-window Lua script, against the Redis instance at b.dsn. Fails
+	// open rather than blocking every request while unimplemented, but logs
+	// so that fail-open isn't silent if this ever gets wired up before the
+	// client is.
+	log.Printf("⚠️  redisRateLimitBackend.Allow called for key %q but has no Redis client wired in yet; allowing the request", key)
+	return true
+}
+
+// newRateLimitBackendFromDSN picks a RateLimitBackend from a DSN scheme
+// ("redis://", "redis+sentinel://"), falling back to the in-process backend
+// for dev when no DSN is configured.
+func newRateLimitBackendFromDSN(dsn string) RateLimitBackend {
+	if strings.HasPrefix(dsn, "redis://") || strings.HasPrefix(dsn, "redis+sentinel://") {
+		// TODO: dial go-redis here and return a *redisRateLimitBackend once
+		// the dependency is available in this environment.
+		log.Printf("⚠️  RATE_LIMIT_BACKEND_DSN=%s set but no Redis client is vendored yet; falling back to the in-process rate limit backend", dsn)
+	}
+	return newInProcessRateLimitBackend()
+}
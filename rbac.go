@@ -0,0 +1,294 @@
+// Scope-based access control for /api/v1/security. Before this, every route
+// in SecurityMonitor.SetupRoutes sat behind the same plain authMiddleware, so
+// any authenticated user could block IPs or resolve alerts with a valid JWT.
+// securityAuthMiddleware now resolves a caller to a set of scopes -- read off
+// a "scopes" JWT claim, or off a bootstrap API key for machine clients that
+// shouldn't hold a user JWT at all -- and RequireScope gates each route on
+// the scope it actually needs.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ScopeSecurityRead         = "security:read"
+	ScopeSecurityEventsRead   = "security:events:read"
+	ScopeSecurityAlertsWrite  = "security:alerts:write"
+	ScopeSecurityIPsWrite     = "security:ips:write"
+	ScopeSecurityDevicesWrite = "security:devices:write"
+	ScopeSecurityAdmin        = "security:admin" // implies every other security:* scope
+)
+
+var validSecurityScopes = map[string]bool{
+	ScopeSecurityRead:         true,
+	ScopeSecurityEventsRead:   true,
+	ScopeSecurityAlertsWrite:  true,
+	ScopeSecurityIPsWrite:     true,
+	ScopeSecurityDevicesWrite: true,
+	ScopeSecurityAdmin:        true,
+}
+
+// scopesFromClaims reads the "scopes" JWT claim (a JSON array of strings). A
+// token minted without one carries no scopes, so it can read nothing and
+// mutate nothing until RequireScope is satisfied.
+func scopesFromClaims(claims map[string]interface{}) []string {
+	raw, ok := claims["scopes"].([]interface{})
+	if !ok {
+		return nil
+	}
+	scopes := make([]string, 0, len(raw))
+	for _, v := range raw {
+		if s, ok := v.(string); ok {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
+}
+
+// hasScope reports whether scopes grants required, either directly or via
+// the blanket security:admin scope.
+func hasScope(scopes []string, required string) bool {
+	for _, s := range scopes {
+		if s == required || s == ScopeSecurityAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireScope rejects requests whose resolved scopes (set by
+// securityAuthMiddleware) don't include scope.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		granted, _ := c.Get("scopes")
+		scopes, _ := granted.([]string)
+		if !hasScope(scopes, scope) {
+			c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("scope %s required", scope)})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// dashboardRoleFromScopes maps a caller's REST scopes onto the dashboardRoles
+// vocabulary the WebSocket protocol (wsMessageAllowed, dashboard_mtls.go)
+// already understands, so issueWSTicketHandler can hand a ticket-holder a
+// role without the dashboard auth model growing a second, parallel one.
+func dashboardRoleFromScopes(scopes []string) string {
+	if hasScope(scopes, ScopeSecurityAdmin) {
+		return "admin"
+	}
+	if hasScope(scopes, ScopeSecurityAlertsWrite) || hasScope(scopes, ScopeSecurityIPsWrite) || hasScope(scopes, ScopeSecurityDevicesWrite) {
+		return "bouncer"
+	}
+	return "viewer"
+}
+
+// securityAuthMiddleware accepts either a JWT bearer token or a bootstrap API
+// key (X-API-Key header), mirroring the mTLS-or-JWT choice
+// adminOrMTLSMiddleware already offers the payments dashboard, so machine
+// clients don't need to mint a user JWT just to hit /api/v1/security. Either
+// path sets "user_id", "auth_subject" (for audit logging), and "scopes" (for
+// RequireScope) in the request context.
+func securityAuthMiddleware(config *Config, keys *APIKeyStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if apiKey := c.GetHeader("X-API-Key"); apiKey != "" {
+			if keys == nil {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "API key authentication is not configured"})
+				c.Abort()
+				return
+			}
+			key, err := keys.Authenticate(apiKey)
+			if err != nil {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid API key"})
+				c.Abort()
+				return
+			}
+			c.Set("user_id", 0)
+			c.Set("auth_subject", "apikey:"+key.Name)
+			c.Set("scopes", key.Scopes)
+			c.Next()
+			return
+		}
+
+		authHeader := c.GetHeader("Authorization")
+		if authHeader == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
+			c.Abort()
+			return
+		}
+
+		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+		claims, err := parseJWTClaims(tokenString, config.JWTSecret)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			c.Abort()
+			return
+		}
+		userID, ok := claims["user_id"].(float64)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			c.Abort()
+			return
+		}
+
+		c.Set("user_id", int(userID))
+		c.Set("auth_subject", fmt.Sprintf("user:%d", int(userID)))
+		c.Set("scopes", scopesFromClaims(claims))
+		c.Next()
+	}
+}
+
+// apiKeyRecord is a bootstrap API key as resolved by Authenticate: enough to
+// authorize a request, never the raw key itself.
+type apiKeyRecord struct {
+	Name   string
+	Scopes []string
+}
+
+// apiKeyInfo is a bootstrap API key as listed by listAPIKeysHandler.
+type apiKeyInfo struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	Revoked    bool       `json:"revoked"`
+}
+
+// APIKeyStore authenticates bootstrap API keys for machine clients (alerting
+// webhooks, CI jobs, edge bouncers pulling the blocklist) that need access to
+// the security API without minting a user JWT. Keys are random 32-byte
+// tokens; only their SHA-256 hash is ever persisted, and Authenticate
+// compares hashes in constant time, the same way totp.go compares TOTP
+// digests.
+type APIKeyStore struct {
+	db *sql.DB
+}
+
+// NewAPIKeyStore returns a store backed by the api_keys table.
+func NewAPIKeyStore(db *sql.DB) *APIKeyStore {
+	return &APIKeyStore{db: db}
+}
+
+// Authenticate looks up rawKey by its SHA-256 hash and returns its scopes, or
+// an error if the key is unknown or revoked.
+func (s *APIKeyStore) Authenticate(rawKey string) (*apiKeyRecord, error) {
+	computed := hashAPIKey(rawKey)
+
+	var name, keyHash, scopesCSV string
+	err := s.db.QueryRow(`
+		SELECT name, key_hash, scopes FROM api_keys
+		WHERE key_hash = ? AND revoked_at IS NULL
+	`, computed).Scan(&name, &keyHash, &scopesCSV)
+	if err != nil {
+		return nil, fmt.Errorf("unknown API key")
+	}
+	if subtle.ConstantTimeCompare([]byte(keyHash), []byte(computed)) != 1 {
+		return nil, fmt.Errorf("unknown API key")
+	}
+
+	if _, err := s.db.Exec(`UPDATE api_keys SET last_used_at = NOW() WHERE key_hash = ?`, computed); err != nil {
+		log.Printf("⚠️  API key store: failed to update last_used_at: %v", err)
+	}
+
+	var scopes []string
+	if scopesCSV != "" {
+		scopes = strings.Split(scopesCSV, ",")
+	}
+	return &apiKeyRecord{Name: name, Scopes: scopes}, nil
+}
+
+// CreateAPIKey generates a new random key, persists its hash with scopes, and
+// returns the raw key. The raw value isn't recoverable after this call --
+// only its hash is stored.
+func (s *APIKeyStore) CreateAPIKey(name string, scopes []string) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	rawKey := "krili_" + base64.RawURLEncoding.EncodeToString(raw)
+
+	_, err := s.db.Exec(`
+		INSERT INTO api_keys (name, key_hash, scopes) VALUES (?, ?, ?)
+	`, name, hashAPIKey(rawKey), strings.Join(scopes, ","))
+	if err != nil {
+		return "", fmt.Errorf("failed to create API key: %v", err)
+	}
+	return rawKey, nil
+}
+
+// List returns every API key's metadata, newest first, never the raw key.
+func (s *APIKeyStore) List() ([]apiKeyInfo, error) {
+	rows, err := s.db.Query(`SELECT id, name, scopes, created_at, last_used_at, revoked_at FROM api_keys ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []apiKeyInfo
+	for rows.Next() {
+		var k apiKeyInfo
+		var scopesCSV string
+		var lastUsedAt, revokedAt sql.NullTime
+		if err := rows.Scan(&k.ID, &k.Name, &scopesCSV, &k.CreatedAt, &lastUsedAt, &revokedAt); err != nil {
+			continue
+		}
+		if scopesCSV != "" {
+			k.Scopes = strings.Split(scopesCSV, ",")
+		}
+		if lastUsedAt.Valid {
+			k.LastUsedAt = &lastUsedAt.Time
+		}
+		k.Revoked = revokedAt.Valid
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// Revoke disables an API key by id; its row is kept for audit history.
+func (s *APIKeyStore) Revoke(id string) error {
+	_, err := s.db.Exec(`UPDATE api_keys SET revoked_at = NOW() WHERE id = ?`, id)
+	return err
+}
+
+// hashAPIKey is the SHA-256 hex digest api_keys.key_hash stores and
+// Authenticate looks up by.
+func hashAPIKey(rawKey string) string {
+	sum := sha256.Sum256([]byte(rawKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// initializeAPIKeysTable creates the table bootstrap API keys are stored in.
+func initializeAPIKeysTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS api_keys (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			name VARCHAR(100) NOT NULL,
+			key_hash CHAR(64) NOT NULL,
+			scopes VARCHAR(255) NOT NULL DEFAULT '',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			last_used_at TIMESTAMP NULL,
+			revoked_at TIMESTAMP NULL,
+			UNIQUE KEY idx_key_hash (key_hash)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create api_keys table: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+// ReconciliationChore resolves transactions stuck in 'processing' or
+// 'pending' past a grace period -- the gap left by TAN/3DS processing: those
+// flows call the provider synchronously and finalize immediately on success
+// or failure, but a crash or network partition between the provider call and
+// that local write can leave a row stuck with no further code path to
+// resolve it. This chore asks the provider for the authoritative outcome via
+// PaymentProvider.GetStatus and transitions the row to 'completed' or
+// 'failed' accordingly, logging every transition to transaction_logs.
+//
+// This is a different concern from ReconciliationJob in payment_providers.go,
+// which reconciles already-completed transactions' reconciliation_status
+// against a settlement report; ReconciliationChore instead repairs
+// transactions whose primary status itself never resolved.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// reconciliationChoreCardGracePeriod/PayoutGracePeriod are how long a
+// card-type (payment) or payout transaction can sit in 'processing'/
+// 'pending' before the chore considers it stuck and worth reconciling.
+const (
+	reconciliationChoreCardGracePeriod   = 30 * time.Minute
+	reconciliationChorePayoutGracePeriod = 3 * 24 * time.Hour
+	reconciliationChoreInterval          = 5 * time.Minute
+	reconciliationChoreBatchSize         = 200
+
+	reconciliationChoreInitialBackoff = 1 * time.Minute
+	reconciliationChoreMaxBackoff     = 1 * time.Hour
+)
+
+// providerBackoffState tracks exponential backoff for one provider that's
+// been returning transient GetStatus errors, so a provider outage doesn't
+// get hammered every reconciliationChoreInterval.
+type providerBackoffState struct {
+	consecutiveFailures int
+	nextAttempt         time.Time
+}
+
+// ReconciliationChore periodically scans transactions, keyed per-provider
+// backoff state in memory (it's fine to reset on restart; the grace period
+// makes that harmless).
+type ReconciliationChore struct {
+	db        *sql.DB
+	providers map[string]PaymentProvider
+	stop      chan struct{}
+
+	mutex   sync.Mutex
+	backoff map[string]*providerBackoffState
+
+	// webhooks publishes a lifecycle event once transition resolves a stuck
+	// transaction, see webhook_subscriptions.go. nil is a valid value.
+	webhooks *WebhookDispatcher
+}
+
+func NewReconciliationChore(db *sql.DB, providers map[string]PaymentProvider) *ReconciliationChore {
+	return &ReconciliationChore{
+		db:        db,
+		providers: providers,
+		stop:      make(chan struct{}),
+		backoff:   make(map[string]*providerBackoffState),
+	}
+}
+
+// SetWebhookDispatcher wires d in for transition to publish lifecycle
+// events through, set after construction like ProviderRouter's equivalent.
+func (rc *ReconciliationChore) SetWebhookDispatcher(d *WebhookDispatcher) {
+	rc.webhooks = d
+}
+
+// Start launches the periodic sweep. Call Stop to end it.
+func (rc *ReconciliationChore) Start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				rc.run()
+			case <-rc.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (rc *ReconciliationChore) Stop() {
+	close(rc.stop)
+}
+
+type stuckTransaction struct {
+	id                int64
+	userID            int
+	txType            string
+	status            string
+	providerID        string
+	providerReference sql.NullString
+	amount            float64
+}
+
+// run loads every transaction stuck past its type's grace period and
+// resolves each one it can reach a provider for.
+func (rc *ReconciliationChore) run() {
+	rows, err := rc.db.Query(`
+		SELECT id, user_id, type, status, provider_id, provider_reference, amount
+		FROM transactions
+		WHERE status IN ('processing', 'pending')
+		AND (
+			(type = 'payout' AND created_at < NOW() - INTERVAL ? SECOND)
+			OR (type != 'payout' AND created_at < NOW() - INTERVAL ? SECOND)
+		)
+		LIMIT ?
+	`, int(reconciliationChorePayoutGracePeriod.Seconds()), int(reconciliationChoreCardGracePeriod.Seconds()), reconciliationChoreBatchSize)
+	if err != nil {
+		log.Printf("⚠️  reconciliation chore: failed to load stuck transactions: %v", err)
+		return
+	}
+
+	var stuck []stuckTransaction
+	for rows.Next() {
+		var t stuckTransaction
+		if err := rows.Scan(&t.id, &t.userID, &t.txType, &t.status, &t.providerID, &t.providerReference, &t.amount); err != nil {
+			continue
+		}
+		stuck = append(stuck, t)
+	}
+	rows.Close()
+
+	for _, t := range stuck {
+		rc.resolve(t)
+	}
+}
+
+// resolve reconciles a single stuck transaction: a missing provider
+// reference means no provider call is known to have been made, so there's
+// nothing upstream to ask and the row is failed outright; otherwise the
+// provider is asked for the authoritative status via GetStatus.
+func (rc *ReconciliationChore) resolve(t stuckTransaction) {
+	if !t.providerReference.Valid || t.providerReference.String == "" {
+		rc.transition(t, transactionStatusFailed, "no provider reference recorded, cannot reconcile")
+		return
+	}
+
+	if rc.backingOff(t.providerID) {
+		return
+	}
+
+	provider, ok := rc.providers[t.providerID]
+	if !ok {
+		rc.transition(t, transactionStatusFailed, fmt.Sprintf("provider %s no longer registered", t.providerID))
+		return
+	}
+
+	status, err := provider.GetStatus(t.txType, t.providerReference.String)
+	if err != nil {
+		rc.recordTransientFailure(t.providerID)
+		log.Printf("⚠️  reconciliation chore: %s GetStatus failed for transaction %d: %v", t.providerID, t.id, err)
+		return
+	}
+	rc.clearBackoff(t.providerID)
+
+	switch status {
+	case transactionStatusCompleted:
+		rc.transition(t, transactionStatusCompleted, "provider confirmed settlement")
+	case transactionStatusFailed:
+		rc.transition(t, transactionStatusFailed, "provider confirmed failure")
+	default:
+		// Still pending upstream; leave it for the next sweep.
+	}
+}
+
+// transition moves t to newStatus, writing ledger entries first if this is
+// the first time the transaction is being marked completed (TAN/3DS never
+// wrote them up front), and always recording a transaction_logs row with the
+// prior and new status. Payout failures need no balance reversal here: this
+// codebase only posts ledger_entries once a transaction completes (see
+// paymentLedgerEntries/payoutLedgerEntries), so a transaction stuck in
+// processing/pending never had funds moved out of available balance in the
+// first place -- failing it is already balance-neutral.
+func (rc *ReconciliationChore) transition(t stuckTransaction, newStatus, reason string) {
+	tx, err := rc.db.Begin()
+	if err != nil {
+		log.Printf("⚠️  reconciliation chore: failed to begin transition for transaction %d: %v", t.id, err)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE transactions SET status = ? WHERE id = ?`, newStatus, t.id); err != nil {
+		log.Printf("⚠️  reconciliation chore: failed to update transaction %d: %v", t.id, err)
+		return
+	}
+
+	if newStatus == transactionStatusCompleted {
+		// transactions carries no currency column (it's only ever known at
+		// request time and stamped onto ledger_entries), so a row reconciled
+		// here falls back to normalizeCurrency's USD default the same way
+		// persistTransaction's callers do when a request omits currency.
+		var entries []ledgerEntry
+		if t.txType == "payout" {
+			entries = payoutLedgerEntries(t.userID, t.amount, normalizeCurrency(""))
+		} else {
+			entries = paymentLedgerEntries(t.userID, t.amount, normalizeCurrency(""))
+		}
+		if err := writeLedgerEntries(tx, t.id, entries); err != nil {
+			log.Printf("⚠️  reconciliation chore: failed to write ledger entries for transaction %d: %v", t.id, err)
+			return
+		}
+	}
+
+	if _, err := tx.Exec(`
+		INSERT INTO transaction_logs (transaction_id, prior_status, new_status, reason, created_at)
+		VALUES (?, ?, ?, ?, NOW())
+	`, t.id, t.status, newStatus, reason); err != nil {
+		log.Printf("⚠️  reconciliation chore: failed to log transition for transaction %d: %v", t.id, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("⚠️  reconciliation chore: failed to commit transition for transaction %d: %v", t.id, err)
+		return
+	}
+	if newStatus == transactionStatusCompleted {
+		transactionAmountHistogram.Observe(t.amount)
+	}
+
+	eventType := webhookEventPaymentFailed
+	if t.txType == "payout" {
+		eventType = webhookEventPayoutFailed
+	}
+	if newStatus == transactionStatusCompleted {
+		eventType = webhookEventPaymentCompleted
+		if t.txType == "payout" {
+			eventType = webhookEventPayoutCompleted
+		}
+	}
+	rc.webhooks.Publish(WebhookEvent{Type: eventType, UserID: t.userID, TransactionID: t.id, Amount: t.amount, Currency: normalizeCurrency(""), OccurredAt: time.Now()})
+}
+
+// backingOff reports whether providerID is still within its exponential
+// backoff window after returning consecutive transient GetStatus errors.
+func (rc *ReconciliationChore) backingOff(providerID string) bool {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	state, ok := rc.backoff[providerID]
+	return ok && time.Now().Before(state.nextAttempt)
+}
+
+func (rc *ReconciliationChore) recordTransientFailure(providerID string) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	state, ok := rc.backoff[providerID]
+	if !ok {
+		state = &providerBackoffState{}
+		rc.backoff[providerID] = state
+	}
+	state.consecutiveFailures++
+
+	delay := reconciliationChoreInitialBackoff << uint(state.consecutiveFailures-1)
+	if delay > reconciliationChoreMaxBackoff || delay <= 0 {
+		delay = reconciliationChoreMaxBackoff
+	}
+	state.nextAttempt = time.Now().Add(delay)
+}
+
+func (rc *ReconciliationChore) clearBackoff(providerID string) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	delete(rc.backoff, providerID)
+}
+
+// initializeTransactionLogsTable creates transaction_logs, the audit trail
+// of every status transition ReconciliationChore (and, going forward, any
+// other code path that changes a transaction's status) records.
+func initializeTransactionLogsTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS transaction_logs (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			transaction_id INT NOT NULL,
+			prior_status VARCHAR(30) NOT NULL,
+			new_status VARCHAR(30) NOT NULL,
+			reason VARCHAR(255) NOT NULL DEFAULT '',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (transaction_id) REFERENCES transactions(id) ON DELETE CASCADE,
+			INDEX idx_transaction (transaction_id)
+		)`)
+	if err != nil {
+		return fmt.Errorf("failed to create transaction_logs table: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// newRequestID returns a random RFC 4122 version 4 UUID string for
+// requestTrackingMiddleware to tag a request with. This module doesn't
+// vendor google/uuid (see go.mod), so the 16 random bytes are generated
+// and formatted by hand; the version/variant bits are set the same way
+// that package would.
+func newRequestID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		// crypto/rand failing is effectively unrecoverable for anything
+		// relying on unpredictable randomness elsewhere in this service
+		// (session IDs, CSRF tokens); a request ID collision here is the
+		// least of its problems, so fall back to all-zero bytes rather
+		// than panicking the request; with the version/variant bits set
+		// below that yields 00000000-0000-4000-8000-000000000000.
+		buf = make([]byte, 16)
+	}
+	buf[6] = (buf[6] & 0x0f) | 0x40 // version 4
+	buf[8] = (buf[8] & 0x3f) | 0x80 // variant 10
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", buf[0:4], buf[4:6], buf[6:8], buf[8:10], buf[10:16])
+}
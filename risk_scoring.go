@@ -0,0 +1,438 @@
+// Statistical, per-user-baseline fraud scoring. Replaces the flat
+// "score += 30" constants that used to make up calculateRiskScore and
+// hasUnusualTransactionPattern: every completed transaction updates a
+// UserBehaviorProfile (mean/stddev via Welford's online algorithm, an
+// hour-of-day histogram, countries seen, merchant categories) and the next
+// transaction is scored against that personal baseline instead of a
+// hand-picked global threshold. The weighted signals are squashed through a
+// logistic function so the returned 0-100 integer behaves like a calibrated
+// probability rather than an unbounded sum of penalties.
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Velocity window labels/durations used both for the sliding-window count
+// check (IncrementAndGet) and its read-only /security/risk-explain counterpart
+// (PeekCount). Keys are namespaced per window so three calls for one
+// transaction don't share (and corrupt) a single sliding-window counter.
+var riskVelocityWindows = []struct {
+	label  string
+	window time.Duration
+}{
+	{"1m", time.Minute},
+	{"5m", 5 * time.Minute},
+	{"60m", time.Hour},
+}
+
+func riskVelocityKey(userID int, label string) string {
+	return fmt.Sprintf("risk_velocity_%s:%d", label, userID)
+}
+
+// RiskFeatures is the raw feature vector calculateRiskScore computes and
+// /security/risk-explain exposes verbatim, so a support agent can see why a
+// transaction was (or would be) flagged instead of just the final number.
+type RiskFeatures struct {
+	Amount             float64          `json:"amount"`
+	AmountMean         float64          `json:"amount_mean"`
+	AmountStdDev       float64          `json:"amount_stddev"`
+	AmountZScore       float64          `json:"amount_z_score"`
+	HourOfDay          int              `json:"hour_of_day"`
+	HourProbability    float64          `json:"hour_probability"` // fraction of this user's past transactions seen in this hour
+	Country            string           `json:"country,omitempty"`
+	IsNewCountry       bool             `json:"is_new_country"`
+	InterArrivalSecs   float64          `json:"inter_arrival_seconds,omitempty"`
+	InterArrivalZScore float64          `json:"inter_arrival_z_score,omitempty"`
+	GeoDistanceKM      float64          `json:"geo_distance_km,omitempty"`
+	GeoDistanceZScore  float64          `json:"geo_distance_z_score,omitempty"`
+	Velocity           map[string]int64 `json:"velocity"` // window label -> transaction count in that rolling window
+	VelocityLimits     map[string]int64 `json:"velocity_limits"`
+	VelocityBreach     string           `json:"velocity_breach,omitempty"` // first window label that exceeded its limit, if any
+	SampleSize         int64            `json:"sample_size"`               // number of past transactions the baseline is built from
+	RawScore           float64          `json:"raw_score"`
+	Score              int              `json:"score"`
+	Reasons            []string         `json:"reasons"`
+}
+
+// ewmaBaselineMinSamples is how many past transactions InterArrivalEWMA/
+// GeoDistanceEWMA need before scoreRiskFeatures trusts their z-scores, the
+// EWMA counterpart to buildRiskFeatures' "TxnCount >= 2" gate on the Welford
+// amount baseline: an EWMA seeded from a single observation (variance 0)
+// would otherwise flag every second transaction as an infinite z-score.
+const ewmaBaselineMinSamples = 3
+
+// ewmaAlpha is the smoothing factor ewmaUpdate applies to the inter-arrival-
+// time and geo-distance baselines: high enough to track a user's current
+// cadence/travel pattern as it legitimately drifts, low enough that a single
+// outlier transaction doesn't reset the baseline the way a naive
+// replace-on-every-update average would.
+const ewmaAlpha = 0.2
+
+// ewmaUpdate folds one more observation into an exponentially-weighted
+// moving mean/variance pair - the decaying-weight counterpart to
+// welfordUpdate below, used for features (inter-arrival time, geo distance)
+// where "normal" legitimately shifts over a user's lifetime rather than
+// converging on one fixed value.
+func ewmaUpdate(mean, variance, x float64) (newMean, newVariance float64) {
+	delta := x - mean
+	newMean = mean + ewmaAlpha*delta
+	newVariance = (1 - ewmaAlpha) * (variance + ewmaAlpha*delta*delta)
+	return newMean, newVariance
+}
+
+// ewmaZScore reports how many standard deviations x sits from an EWMA
+// baseline, or 0 if the baseline has no spread yet (variance <= 0).
+func ewmaZScore(mean, variance, x float64) float64 {
+	if variance <= 0 {
+		return 0
+	}
+	return math.Abs(x-mean) / math.Sqrt(variance)
+}
+
+// welfordUpdate folds one more observation into a Welford mean/M2
+// accumulator, returning the updated (mean, M2) pair. M2 is the running sum
+// of squared deviations from the mean; AmountStdDev() turns it into a sample
+// standard deviation. See Welford (1962) / Knuth TAOCP vol 2 §4.2.2.
+func welfordUpdate(mean, m2 float64, count int64, x float64) (float64, float64) {
+	delta := x - mean
+	newMean := mean + delta/float64(count)
+	delta2 := x - newMean
+	return newMean, m2 + delta*delta2
+}
+
+// decodeHourHistogram parses a profile's JSON-encoded 24-bucket histogram,
+// defaulting to all-zero (no baseline) if it's empty or malformed.
+func decodeHourHistogram(raw string) [24]int64 {
+	var hist [24]int64
+	if raw == "" {
+		return hist
+	}
+	_ = json.Unmarshal([]byte(raw), &hist)
+	return hist
+}
+
+func encodeHourHistogram(hist [24]int64) string {
+	out, _ := json.Marshal(hist)
+	return string(out)
+}
+
+// decodeStringSet/encodeStringSet round-trip a profile's "countries seen"
+// JSON array through a set for O(1) membership checks.
+func decodeStringSet(raw string) map[string]bool {
+	set := make(map[string]bool)
+	if raw == "" {
+		return set
+	}
+	var list []string
+	if err := json.Unmarshal([]byte(raw), &list); err != nil {
+		return set
+	}
+	for _, v := range list {
+		set[v] = true
+	}
+	return set
+}
+
+func encodeStringSet(set map[string]bool) string {
+	list := make([]string, 0, len(set))
+	for v := range set {
+		list = append(list, v)
+	}
+	out, _ := json.Marshal(list)
+	return string(out)
+}
+
+func decodeCounts(raw string) map[string]int64 {
+	counts := make(map[string]int64)
+	if raw == "" {
+		return counts
+	}
+	_ = json.Unmarshal([]byte(raw), &counts)
+	return counts
+}
+
+func encodeCounts(counts map[string]int64) string {
+	out, _ := json.Marshal(counts)
+	return string(out)
+}
+
+// buildRiskFeatures scores a (userID, amount, country, merchantCategory)
+// transaction against the user's stored behavior profile and velocity
+// counters. ip resolves the transaction's coordinates (via geoCoordinatesFromIP)
+// for the geo-distance-from-last-transaction feature; it's best-effort, so an
+// empty/unresolvable ip just skips that feature rather than erroring. When
+// live is false (the /security/risk-explain path) velocity is read with
+// PeekCount instead of IncrementAndGet so a support agent looking up a user
+// doesn't itself count as a transaction.
+func (ess *EnhancedSecurityService) buildRiskFeatures(userID int, amount float64, country, merchantCategory, ip string, live bool) RiskFeatures {
+	now := time.Now()
+	features := RiskFeatures{
+		Amount:         amount,
+		HourOfDay:      now.Hour(),
+		Country:        country,
+		Velocity:       make(map[string]int64, len(riskVelocityWindows)),
+		VelocityLimits: make(map[string]int64, len(riskVelocityWindows)),
+	}
+
+	profile, err := ess.repo.GetBehaviorProfile(userID)
+	if err != nil {
+		profile = &UserBehaviorProfile{UserID: userID}
+	}
+	features.SampleSize = profile.TxnCount
+	features.AmountMean = profile.AmountMean
+	features.AmountStdDev = profile.AmountStdDev()
+
+	if profile.TxnCount >= 2 && features.AmountStdDev > 0 {
+		features.AmountZScore = math.Abs(amount-features.AmountMean) / features.AmountStdDev
+	}
+
+	histogram := decodeHourHistogram(profile.HourHistogramJSON)
+	var total int64
+	for _, count := range histogram {
+		total += count
+	}
+	if total == 0 {
+		features.HourProbability = 1 // no baseline yet: don't penalize an off-hour that's never actually off for this user
+	} else {
+		features.HourProbability = float64(histogram[features.HourOfDay]) / float64(total)
+	}
+
+	if country != "" && profile.TxnCount > 0 {
+		features.IsNewCountry = !decodeStringSet(profile.CountriesSeenJSON)[country]
+	}
+
+	if profile.TxnCount >= ewmaBaselineMinSamples && profile.LastTxnAt.Valid {
+		features.InterArrivalSecs = now.Sub(profile.LastTxnAt.Time).Seconds()
+		features.InterArrivalZScore = ewmaZScore(profile.InterArrivalEWMAMean, profile.InterArrivalEWMAVar, features.InterArrivalSecs)
+	}
+	if profile.TxnCount >= ewmaBaselineMinSamples && (profile.LastLatitude != 0 || profile.LastLongitude != 0) {
+		if lat, lon := ess.geoCoordinatesFromIP(ip); lat != 0 || lon != 0 {
+			features.GeoDistanceKM = haversineKM(profile.LastLatitude, profile.LastLongitude, lat, lon)
+			features.GeoDistanceZScore = ewmaZScore(profile.GeoDistanceEWMAMean, profile.GeoDistanceEWMAVar, features.GeoDistanceKM)
+		}
+	}
+
+	limits := map[string]int64{
+		"1m":  ess.config.Velocity1mLimit,
+		"5m":  ess.config.Velocity5mLimit,
+		"60m": ess.config.Velocity60mLimit,
+	}
+	for _, w := range riskVelocityWindows {
+		key := riskVelocityKey(userID, w.label)
+		var count int64
+		var cErr error
+		if live {
+			count, cErr = ess.stateStore.IncrementAndGet(key, w.window)
+		} else {
+			count, cErr = ess.stateStore.PeekCount(key, w.window)
+		}
+		if cErr != nil {
+			continue
+		}
+		features.Velocity[w.label] = count
+		features.VelocityLimits[w.label] = limits[w.label]
+		if features.VelocityBreach == "" && limits[w.label] > 0 && count > limits[w.label] {
+			features.VelocityBreach = w.label
+		}
+	}
+
+	ess.scoreRiskFeatures(&features)
+	return features
+}
+
+// scoreRiskFeatures turns a built feature vector into a raw weighted score
+// and a calibrated 0-100 integer via the logistic function, replacing the
+// flat "score += N" additions calculateRiskScore used to do directly.
+func (ess *EnhancedSecurityService) scoreRiskFeatures(f *RiskFeatures) {
+	if f.AmountZScore > 3 {
+		f.RawScore += 30
+		f.Reasons = append(f.Reasons, fmt.Sprintf("amount z-score %.1f exceeds 3", f.AmountZScore))
+	}
+	if f.HourProbability < 0.05 {
+		f.RawScore += 15
+		f.Reasons = append(f.Reasons, fmt.Sprintf("hour %02d:00 matches only %.1f%% of this user's history", f.HourOfDay, f.HourProbability*100))
+	}
+	if f.IsNewCountry {
+		f.RawScore += 25
+		f.Reasons = append(f.Reasons, fmt.Sprintf("first transaction seen from %s", f.Country))
+	}
+	if f.VelocityBreach != "" {
+		f.RawScore += 20
+		f.Reasons = append(f.Reasons, fmt.Sprintf("velocity exceeded the %s limit (%d > %d)",
+			f.VelocityBreach, f.Velocity[f.VelocityBreach], f.VelocityLimits[f.VelocityBreach]))
+	}
+	if f.InterArrivalZScore > 3 {
+		f.RawScore += 15
+		f.Reasons = append(f.Reasons, fmt.Sprintf("time since this user's last transaction (%.0fs) deviates %.1f standard deviations from their usual cadence",
+			f.InterArrivalSecs, f.InterArrivalZScore))
+	}
+	if f.GeoDistanceZScore > 3 {
+		f.RawScore += 20
+		f.Reasons = append(f.Reasons, fmt.Sprintf("transaction location is %.0fkm from this user's last transaction, %.1f standard deviations beyond their usual range",
+			f.GeoDistanceKM, f.GeoDistanceZScore))
+	}
+
+	f.Score = riskLogistic(f.RawScore)
+}
+
+// riskLogistic squashes a raw additive score (0 to 125 given the weights
+// above) into a 0-100 calibrated score via a standard logistic curve
+// centered on rawScore=45 (two signals firing), so no single flagged signal
+// alone crosses the manual-review threshold but two or more climb steeply.
+func riskLogistic(rawScore float64) int {
+	const midpoint = 45.0
+	const scale = 15.0
+	probability := 1 / (1 + math.Exp(-(rawScore-midpoint)/scale))
+	return int(math.Round(probability * 100))
+}
+
+// calculateRiskScore is calculateRiskScore's entry point for the existing
+// location/device/IP-reputation middleware checks, now combined with the
+// statistical behavior-baseline features above instead of the old flat
+// "hasUnusualTransactionPattern" boolean.
+func (ess *EnhancedSecurityService) calculateRiskScore(userID int, ip string, c *gin.Context) int {
+	amount, country, merchantCategory := extractTransactionContext(c)
+
+	features := ess.buildRiskFeatures(userID, amount, country, merchantCategory, ip, true)
+	score := features.Score
+
+	if ess.isHighRiskLocation(ess.getLocationFromIP(ip)) {
+		score += 10
+	}
+	deviceID := c.GetHeader("X-Device-ID")
+	if deviceID == "" || !ess.isDeviceTrusted(userID, deviceID) {
+		score += 10
+	}
+	score += ess.ipReputationRiskContribution(ip)
+
+	if score > 100 {
+		score = 100
+	}
+	return score
+}
+
+// extractTransactionContext peeks the request body (without consuming it -
+// see readAndRestoreBody) for the fields buildRiskFeatures needs. Requests
+// with no body, or a non-JSON body, just score with a zero amount.
+func extractTransactionContext(c *gin.Context) (amount float64, country, merchantCategory string) {
+	body := readAndRestoreBody(c)
+	if len(body) == 0 {
+		return 0, "", ""
+	}
+	var req map[string]interface{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return 0, "", ""
+	}
+	if v, ok := req["amount"].(float64); ok {
+		amount = v
+	}
+	if v, ok := req["region"].(string); ok {
+		country = v
+	}
+	if v, ok := req["merchant_category"].(string); ok {
+		merchantCategory = v
+	}
+	return amount, country, merchantCategory
+}
+
+// updateBehaviorProfile folds a just-completed transaction into the user's
+// UserBehaviorProfile: Welford's algorithm for amount mean/stddev, a bump to
+// the hour-of-day histogram, the country added to the seen set, the merchant
+// category counted, and an EWMA update to the inter-arrival-time/geo-distance
+// baselines. ip resolves this transaction's coordinates the same way
+// buildRiskFeatures does; empty/unresolvable ip just skips the geo-distance
+// update. Called from processPaymentHandler/processPayoutHandler after a
+// provider confirms success; failures here are logged, not propagated, since
+// a baseline-update error shouldn't fail the underlying transaction the user
+// already completed.
+//
+// The inter-arrival/geo-distance EWMA baselines only fold in observations
+// that scored as non-anomalous (z-score <= 3 against the existing baseline):
+// an account takeover's first few fraudulent transactions would otherwise
+// drag the "normal" baseline toward the attacker's behavior and make later,
+// larger fraud look routine by the time a human reviews it.
+func (ess *EnhancedSecurityService) updateBehaviorProfile(userID int, amount float64, country, merchantCategory, ip string, at time.Time) {
+	profile, err := ess.repo.GetBehaviorProfile(userID)
+	if err != nil {
+		profile = &UserBehaviorProfile{UserID: userID}
+	}
+
+	profile.TxnCount++
+	profile.AmountMean, profile.AmountM2 = welfordUpdate(profile.AmountMean, profile.AmountM2, profile.TxnCount, amount)
+
+	histogram := decodeHourHistogram(profile.HourHistogramJSON)
+	histogram[at.Hour()]++
+	profile.HourHistogramJSON = encodeHourHistogram(histogram)
+
+	if country != "" {
+		countries := decodeStringSet(profile.CountriesSeenJSON)
+		countries[country] = true
+		profile.CountriesSeenJSON = encodeStringSet(countries)
+	}
+
+	if merchantCategory != "" {
+		counts := decodeCounts(profile.MerchantCatsJSON)
+		counts[merchantCategory]++
+		profile.MerchantCatsJSON = encodeCounts(counts)
+	}
+
+	if profile.LastTxnAt.Valid {
+		interArrival := at.Sub(profile.LastTxnAt.Time).Seconds()
+		if ewmaZScore(profile.InterArrivalEWMAMean, profile.InterArrivalEWMAVar, interArrival) <= 3 {
+			profile.InterArrivalEWMAMean, profile.InterArrivalEWMAVar = ewmaUpdate(profile.InterArrivalEWMAMean, profile.InterArrivalEWMAVar, interArrival)
+		}
+	}
+
+	lat, lon := ess.geoCoordinatesFromIP(ip)
+	if lat != 0 || lon != 0 {
+		if profile.LastLatitude != 0 || profile.LastLongitude != 0 {
+			distance := haversineKM(profile.LastLatitude, profile.LastLongitude, lat, lon)
+			if ewmaZScore(profile.GeoDistanceEWMAMean, profile.GeoDistanceEWMAVar, distance) <= 3 {
+				profile.GeoDistanceEWMAMean, profile.GeoDistanceEWMAVar = ewmaUpdate(profile.GeoDistanceEWMAMean, profile.GeoDistanceEWMAVar, distance)
+			}
+		}
+		profile.LastLatitude, profile.LastLongitude = lat, lon
+	}
+	profile.LastTxnAt = sql.NullTime{Time: at, Valid: true}
+
+	if err := ess.repo.SaveBehaviorProfile(profile); err != nil {
+		fmt.Printf("⚠️  failed to update behavior profile for user %d: %v\n", userID, err)
+	}
+}
+
+// riskExplainHandler lets a support agent see the raw feature vector behind
+// a user's current risk score without re-submitting a transaction: GET
+// /security/risk-explain?user_id=123&amount=500&country=NG&merchant_category=electronics&ip=203.0.113.7.
+// amount/country/merchant_category/ip are optional; ip defaults to the
+// caller's own address (only used to derive the geo-distance feature), and
+// the rest default to zero values, useful for "why would a typical
+// transaction from this user score X".
+func (sth *SecureTransactionHandler) riskExplainHandler(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Query("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "user_id query parameter is required"})
+		return
+	}
+
+	var amount float64
+	if raw := c.Query("amount"); raw != "" {
+		amount, _ = strconv.ParseFloat(raw, 64)
+	}
+
+	ip := c.Query("ip")
+	if ip == "" {
+		ip = sth.ess.getRealIP(c)
+	}
+
+	features := sth.ess.buildRiskFeatures(userID, amount, c.Query("country"), c.Query("merchant_category"), ip, false)
+	c.JSON(http.StatusOK, gin.H{"user_id": userID, "features": features})
+}
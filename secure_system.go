@@ -2,22 +2,21 @@ package main
 
 import (
 	"context"
-	"crypto/aes"
-	"crypto/cipher"
+	"crypto/ed25519"
 	"crypto/hmac"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/subtle"
 	"crypto/x509"
 	"database/sql"
-	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"math"
 	"net"
 	"net/http"
 	"os"
@@ -33,9 +32,9 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/websocket"
 	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
-	"golang.org/x/time/rate"
 )
 
 // Configuration
@@ -48,6 +47,22 @@ type Config struct {
 	ServerPort    string
 	JWTSecret     string
 	EncryptionKey string
+	TLSCertFile   string
+	TLSKeyFile    string
+	DBDSN         string // optional full DSN ("postgres://...", "sqlite://...") overriding DBHost/DBUser/...
+	CRLFile       string // flat file of revoked cert serials, reloaded on SIGHUP
+	MTLSPort      string // optional dedicated port requiring a client cert at the TLS handshake
+
+	// WSAllowedOrigins gates non-mTLS (JWT/cookie) clients of /ws/security:
+	// the Origin header on the WebSocket handshake must match one of these
+	// exactly, since a bearer token alone can't prove the request came from
+	// a trusted dashboard origin. Parsed from WS_ALLOWED_ORIGINS.
+	WSAllowedOrigins []string
+
+	// RateLimitTiers are the per-route sliding-window budgets
+	// tieredRateLimitMiddleware enforces, parsed from RATE_LIMIT_TIERS
+	// (see tiered_rate_limiter.go); defaultRateLimitTiers if unset.
+	RateLimitTiers []RateLimitTier
 }
 
 // Enhanced Security Configuration
@@ -64,6 +79,15 @@ type SecurityConfig struct {
 	EnableFraudDetection  bool          `json:"enable_fraud_detection"`
 	RequireDeviceAuth     bool          `json:"require_device_auth"`
 	EnableBiometric       bool          `json:"enable_biometric"`
+	Velocity1mLimit       int64         `json:"velocity_1m_limit"`    // max transactions per rolling minute
+	Velocity5mLimit       int64         `json:"velocity_5m_limit"`    // max transactions per rolling 5 minutes
+	Velocity60mLimit      int64         `json:"velocity_60m_limit"`   // max transactions per rolling hour
+	EnableBreachCheck     bool          `json:"enable_breach_check"`  // k-anonymity HIBP lookup; disable for air-gapped deployments
+	EnableEntropyCheck    bool          `json:"enable_entropy_check"` // zxcvbn-style strength scoring
+	MinPasswordScore      int           `json:"min_password_score"`   // minimum acceptable zxcvbn score (0-4)
+	WebAuthnRPID          string        `json:"webauthn_rp_id"`       // relying party ID, e.g. "krili.com"; must match the origin's domain
+	WebAuthnRPName        string        `json:"webauthn_rp_name"`     // relying party display name shown by the browser's WebAuthn UI
+	WebAuthnOrigin        string        `json:"webauthn_origin"`      // expected clientDataJSON.origin, e.g. "https://krili.com"
 }
 
 // Transaction Models
@@ -77,41 +101,104 @@ type Transaction struct {
 	CreatedAt   time.Time `json:"created_at"`
 }
 
+// binding tags double as this API's validation schema and, via
+// openapi.go's reflection, its OpenAPI schema -- the two can't drift apart
+// since both are read from the same struct.
 type PaymentRequest struct {
-	Amount      float64 `json:"amount"`
-	Description string  `json:"description"`
+	Amount      float64 `json:"amount" binding:"required,gt=0,lte=1000000"`
+	Description string  `json:"description" binding:"omitempty,max=255"`
+	Currency    string  `json:"currency,omitempty" binding:"omitempty,iso4217"`
+	Region      string  `json:"region,omitempty" binding:"omitempty,max=64"`
+	Method      string  `json:"method,omitempty" binding:"omitempty,max=64"`
 }
 
 type PayoutRequest struct {
-	Amount      float64 `json:"amount"`
-	Description string  `json:"description"`
+	Amount      float64 `json:"amount" binding:"required,gt=0,lte=1000000"`
+	Description string  `json:"description" binding:"omitempty,max=255"`
+	Currency    string  `json:"currency,omitempty" binding:"omitempty,iso4217"`
+	Region      string  `json:"region,omitempty" binding:"omitempty,max=64"`
+	Method      string  `json:"method,omitempty" binding:"omitempty,max=64"`
 }
 
 type PaymentResponse struct {
 	Success       bool   `json:"success"`
 	TransactionID string `json:"transaction_id"`
 	Message       string `json:"message"`
+
+	// Status, HTMLContent, and ChallengeRef are only populated by
+	// Init3DSPayment: Status is "requires_authentication" and HTMLContent is
+	// the provider's challenge page for the frontend to render inline, keyed
+	// by ChallengeRef for the later Complete3DSPayment call. See three_ds.go.
+	Status       string `json:"status,omitempty"`
+	HTMLContent  string `json:"html_content,omitempty"`
+	ChallengeRef string `json:"challenge_ref,omitempty"`
+
+	// ChallengeID is set alongside Status: "tan_required" when the amount
+	// crosses tanPaymentAmountThreshold and a TAN code was sent instead of
+	// processing the payment immediately. See tan_challenge.go.
+	ChallengeID int64 `json:"challenge_id,omitempty"`
 }
 
 type PayoutResponse struct {
 	Success       bool   `json:"success"`
 	TransactionID string `json:"transaction_id"`
 	Message       string `json:"message"`
+
+	// Status and ChallengeID are set when ProcessPayout defers to the TAN
+	// subsystem instead of paying out immediately: Status is "tan_required"
+	// and ChallengeID is the tan_challenges row to solve. See tan_challenge.go.
+	Status      string `json:"status,omitempty"`
+	ChallengeID int64  `json:"challenge_id,omitempty"`
 }
 
 // Security Models
 type SecurityEvent struct {
-	ID          int       `json:"id" db:"id"`
-	UserID      *int      `json:"user_id,omitempty" db:"user_id"`
-	EventType   string    `json:"event_type" db:"event_type"`
-	Severity    string    `json:"severity" db:"severity"`
-	Description string    `json:"description" db:"description"`
-	IPAddress   string    `json:"ip_address" db:"ip_address"`
-	UserAgent   string    `json:"user_agent" db:"user_agent"`
-	Location    string    `json:"location,omitempty" db:"location"`
-	DeviceID    string    `json:"device_id,omitempty" db:"device_id"`
-	Resolved    bool      `json:"resolved" db:"resolved"`
-	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+	ID            int       `json:"id" db:"id"`
+	UserID        *int      `json:"user_id,omitempty" db:"user_id"`
+	EventType     string    `json:"event_type" db:"event_type"`
+	Severity      string    `json:"severity" db:"severity"`
+	Description   string    `json:"description" db:"description"`
+	IPAddress     string    `json:"ip_address" db:"ip_address"`
+	UserAgent     string    `json:"user_agent" db:"user_agent"`
+	Location      string    `json:"location,omitempty" db:"location"`
+	DeviceID      string    `json:"device_id,omitempty" db:"device_id"`
+	Resolved      bool      `json:"resolved" db:"resolved"`
+	CTIScore      *int      `json:"cti_score,omitempty" db:"cti_score"`
+	CTICategories string    `json:"cti_categories,omitempty" db:"cti_categories"` // comma-joined CTIResult.Categories
+	CTIConfidence float64   `json:"cti_confidence,omitempty" db:"cti_confidence"`
+	CTISource     string    `json:"cti_source,omitempty" db:"cti_source"`
+	PrevHash      string    `json:"prev_hash,omitempty" db:"prev_hash"`   // AuditChain.Append's chain tip at insert time; see SecureTransactionHandler.logSecurityEvent
+	EntryHash     string    `json:"entry_hash,omitempty" db:"entry_hash"` // this row's own link in the chain
+	Metadata      string    `json:"metadata,omitempty" db:"metadata"`     // JSON-encoded structured detail (e.g. fraud rule names/action); free-text stays in Description
+	CreatedAt     time.Time `json:"created_at" db:"created_at"`
+}
+
+// AuditTrailEntry mirrors a row in the hash-chained audit_trail table that
+// backs SecureTransactionHandler.logAuditEvent.
+type AuditTrailEntry struct {
+	ID           int       `json:"id" db:"id"`
+	UserID       int       `json:"user_id" db:"user_id"`
+	Action       string    `json:"action" db:"action"`
+	ResourceType string    `json:"resource_type" db:"resource_type"`
+	ResourceID   string    `json:"resource_id" db:"resource_id"`
+	OldValues    string    `json:"old_values,omitempty" db:"old_values"`
+	NewValues    string    `json:"new_values,omitempty" db:"new_values"`
+	IPAddress    string    `json:"ip_address" db:"ip_address"`
+	UserAgent    string    `json:"user_agent" db:"user_agent"`
+	SessionID    string    `json:"session_id,omitempty" db:"session_id"`
+	PrevHash     string    `json:"prev_hash,omitempty" db:"prev_hash"`
+	EntryHash    string    `json:"entry_hash,omitempty" db:"entry_hash"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+}
+
+// UserSecurityProfile is the dashboard-facing summary getUserSecurityProfile
+// returns: a handful of fields pulled from three different tables, rolled up
+// into one read so callers don't have to know the shape of risk_scores,
+// two_factor_auth, and device_fingerprints individually.
+type UserSecurityProfile struct {
+	RiskScore        int
+	TwoFactorEnabled bool
+	TrustedDevices   int
 }
 
 type LoginAttempt struct {
@@ -125,17 +212,45 @@ type LoginAttempt struct {
 	CreatedAt time.Time `json:"created_at" db:"created_at"`
 }
 
+// DeviceFingerprint is one device_fingerprints row: a stable hash derived
+// from DeviceComponents (see device_fingerprint.go) plus the component
+// vector itself, stored as its own columns rather than folded only into the
+// opaque DeviceInfo blob, so ingestDeviceFingerprint's similar-device and
+// new-ASN checks can compare components directly instead of re-parsing JSON.
 type DeviceFingerprint struct {
-	ID          int       `json:"id" db:"id"`
-	UserID      int       `json:"user_id" db:"user_id"`
-	DeviceID    string    `json:"device_id" db:"device_id"`
-	Fingerprint string    `json:"fingerprint" db:"fingerprint"`
-	DeviceInfo  string    `json:"device_info" db:"device_info"`
-	IPAddress   string    `json:"ip_address" db:"ip_address"`
-	Location    string    `json:"location,omitempty" db:"location"`
-	IsTrusted   bool      `json:"is_trusted" db:"is_trusted"`
-	LastSeen    time.Time `json:"last_seen" db:"last_seen"`
-	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+	ID             int       `json:"id" db:"id"`
+	UserID         int       `json:"user_id" db:"user_id"`
+	DeviceID       string    `json:"device_id" db:"device_id"`
+	Fingerprint    string    `json:"fingerprint" db:"fingerprint"`
+	DeviceInfo     string    `json:"device_info" db:"device_info"`
+	UserAgent      string    `json:"user_agent,omitempty" db:"user_agent"`
+	AcceptLanguage string    `json:"accept_language,omitempty" db:"accept_language"`
+	ClientHints    string    `json:"client_hints,omitempty" db:"client_hints"`
+	CanvasHash     string    `json:"canvas_hash,omitempty" db:"canvas_hash"`
+	WebGLHash      string    `json:"webgl_hash,omitempty" db:"webgl_hash"`
+	JA3Hash        string    `json:"ja3_hash,omitempty" db:"ja3_hash"`
+	ASN            string    `json:"asn,omitempty" db:"asn"`
+	IPAddress      string    `json:"ip_address" db:"ip_address"`
+	Location       string    `json:"location,omitempty" db:"location"`
+	Latitude       float64   `json:"latitude,omitempty" db:"latitude"`
+	Longitude      float64   `json:"longitude,omitempty" db:"longitude"`
+	IsTrusted      bool      `json:"is_trusted" db:"is_trusted"`
+	LastSeen       time.Time `json:"last_seen" db:"last_seen"`
+	CreatedAt      time.Time `json:"created_at" db:"created_at"`
+}
+
+// components rebuilds the DeviceComponents vector a historical row was
+// fingerprinted from, so componentDiffCount can compare a new login against
+// it directly.
+func (d *DeviceFingerprint) components() DeviceComponents {
+	return DeviceComponents{
+		UserAgent:      d.UserAgent,
+		AcceptLanguage: d.AcceptLanguage,
+		ClientHints:    d.ClientHints,
+		CanvasHash:     d.CanvasHash,
+		WebGLHash:      d.WebGLHash,
+		JA3Hash:        d.JA3Hash,
+	}
 }
 
 type TwoFactorAuth struct {
@@ -147,27 +262,85 @@ type TwoFactorAuth struct {
 	CreatedAt   time.Time `json:"created_at" db:"created_at"`
 }
 
+// TableName overrides pop's default "two_factor_auths" pluralization: the
+// schema (see initializeSecurityTables) uses the singular two_factor_auth.
+func (TwoFactorAuth) TableName() string { return "two_factor_auth" }
+
 type BiometricAuth struct {
 	ID           int       `json:"id" db:"id"`
 	UserID       int       `json:"user_id" db:"user_id"`
 	BiometricType string   `json:"biometric_type" db:"biometric_type"` // fingerprint, face, voice
-	Template     string    `json:"template" db:"template"`
+	Template     string    `json:"template" db:"template_hash"`        // envelope-encrypted at rest, see RecordBiometricCredential
 	DeviceID     string    `json:"device_id" db:"device_id"`
 	IsActive     bool      `json:"is_active" db:"is_active"`
 	CreatedAt    time.Time `json:"created_at" db:"created_at"`
 }
 
+// TableName overrides pop's default "biometric_auths" pluralization: the
+// schema (see initializeSecurityTables) uses the singular biometric_auth.
+func (BiometricAuth) TableName() string { return "biometric_auth" }
+
+// UserBehaviorProfile is the rolling per-user baseline calculateRiskScore
+// scores new transactions against (see risk_scoring.go). AmountMean/AmountM2
+// are Welford's online mean/sum-of-squared-deviations so updating them on
+// every completed transaction never requires a full table scan; HourHistogram,
+// CountriesSeen and MerchantCategories are JSON-encoded maps/arrays rather than
+// normalized tables since they're read-modify-written as a unit.
+//
+// InterArrivalEWMA{Mean,Var} and GeoDistanceEWMA{Mean,Var} are a second,
+// EWMA-smoothed baseline pair alongside the Welford amount baseline above:
+// how many seconds typically separate this user's transactions, and how far
+// apart (haversine km, via LastLatitude/LastLongitude) consecutive ones
+// usually are. EWMA rather than Welford here deliberately lets the baseline
+// drift with a user's current cadence/travel pattern instead of weighting
+// their first transaction as heavily as their thousandth; see ewmaUpdate in
+// risk_scoring.go.
+type UserBehaviorProfile struct {
+	ID                   int          `json:"id" db:"id"`
+	UserID               int          `json:"user_id" db:"user_id"`
+	TxnCount             int64        `json:"txn_count" db:"txn_count"`
+	AmountMean           float64      `json:"amount_mean" db:"amount_mean"`
+	AmountM2             float64      `json:"amount_m2" db:"amount_m2"`
+	HourHistogramJSON    string       `json:"-" db:"hour_histogram"`
+	CountriesSeenJSON    string       `json:"-" db:"countries_seen"`
+	MerchantCatsJSON     string       `json:"-" db:"merchant_categories"`
+	LastTxnAt            sql.NullTime `json:"-" db:"last_txn_at"`
+	LastLatitude         float64      `json:"-" db:"last_latitude"`
+	LastLongitude        float64      `json:"-" db:"last_longitude"`
+	InterArrivalEWMAMean float64      `json:"inter_arrival_ewma_mean" db:"inter_arrival_ewma_mean"`
+	InterArrivalEWMAVar  float64      `json:"inter_arrival_ewma_var" db:"inter_arrival_ewma_var"`
+	GeoDistanceEWMAMean  float64      `json:"geo_distance_ewma_mean" db:"geo_distance_ewma_mean"`
+	GeoDistanceEWMAVar   float64      `json:"geo_distance_ewma_var" db:"geo_distance_ewma_var"`
+	UpdatedAt            time.Time    `json:"updated_at" db:"updated_at"`
+}
+
+// TableName overrides pop's default "user_behavior_profiles" pluralization.
+func (UserBehaviorProfile) TableName() string { return "user_behavior_profile" }
+
+// AmountStdDev returns the sample standard deviation of this profile's
+// transaction amounts, derived from the Welford accumulator AmountM2.
+func (p *UserBehaviorProfile) AmountStdDev() float64 {
+	if p.TxnCount < 2 {
+		return 0
+	}
+	return math.Sqrt(p.AmountM2 / float64(p.TxnCount-1))
+}
+
 type FraudRule struct {
-	ID          int     `json:"id" db:"id"`
-	RuleName    string  `json:"rule_name" db:"rule_name"`
-	RuleType    string  `json:"rule_type" db:"rule_type"`
-	Threshold   float64 `json:"threshold" db:"threshold"`
-	Action      string  `json:"action" db:"action"` // block, flag, review
-	IsActive    bool    `json:"is_active" db:"is_active"`
-	Description string  `json:"description" db:"description"`
+	ID          int            `json:"id" db:"id"`
+	RuleName    string         `json:"rule_name" db:"rule_name"`
+	RuleType    string         `json:"rule_type" db:"rule_type"` // amount, frequency, location, device, pattern, velocity
+	Threshold   float64        `json:"threshold" db:"threshold"`
+	TimeWindow  int            `json:"time_window" db:"time_window"` // seconds; the rolling window VelocityRule/GeoVelocityRule evaluate over
+	Action      string         `json:"action" db:"action"`           // block, challenge_mfa, notify, flag, review, alert
+	Severity    string         `json:"severity" db:"severity"`
+	IsActive    bool           `json:"is_active" db:"is_active"`
+	Description string         `json:"description" db:"description"`
+	RuleConfig  sql.NullString `json:"rule_config,omitempty" db:"rule_config"` // securityPredicateNode JSON, for rule_type = "pattern"
 }
 
 type RiskScore struct {
+	ID              int       `json:"id" db:"id"`
 	UserID          int       `json:"user_id" db:"user_id"`
 	CurrentScore    int       `json:"current_score" db:"current_score"`
 	LocationRisk    int       `json:"location_risk" db:"location_risk"`
@@ -236,27 +409,53 @@ type TimelinePoint struct {
 
 // Enhanced Security Service
 type EnhancedSecurityService struct {
-	db             *sql.DB
-	config         *SecurityConfig
-	rateLimiters   map[string]*rate.Limiter
-	blockedIPs     map[string]time.Time
-	trustedIPs     map[string]bool
-	loginAttempts  map[string][]time.Time
-	deviceCache    map[string]*DeviceFingerprint
-	fraudRules     []FraudRule
-	mutex          sync.RWMutex
-	privateKey     *rsa.PrivateKey
-	publicKey      *rsa.PublicKey
+	db                 *sql.DB
+	config             *SecurityConfig
+	rateLimitBackend   RateLimitBackend // pluggable token-bucket enforcement; newRateLimitBackendFromDSN only returns the in-process backend, so limits are per instance
+	blockedIPCache     *shardedTTLCache // process-local L1 in front of stateStore.IsBlocked/SetBlocked, see blockIPLocally/isIPBlocked
+	trustedIPs         map[string]bool
+	loginAttemptCache  *shardedTTLCache // process-local fallback for detectSuspiciousBehavior when stateStore is unset
+	deviceCache        *shardedTTLCache // process-local L1 in front of repo.LookupDevice, which is already shared across instances
+	fraudRules         []FraudRule
+	webauthnChallenges map[string]string  // "userID_deviceID" -> outstanding base64 challenge, one-time use
+	mutex              sync.RWMutex       // guards webauthnChallenges only; the rate/block/login/device caches above are self-synchronized
+	keystore           *KeyStore          // versioned RSA keypairs EncryptSensitive/DecryptSensitive seal envelopes under, see keystore.go
+	stateStore         StateStore         // rate limit counters, velocity windows, and the IP blocklist; newStateStoreFromDSN returns the in-process store even for a redis:// DSN
+	repo               SecurityRepository // login/device/2FA/fraud-rule persistence, pop-backed in production
+	fraudEngine        *FraudRuleEngine
+	approvalEngine     *ApprovalRulesEngine
+	waf                *WAFEngine
+	breachCheck        BreachCheckClient     // k-anonymity HIBP range lookup, see password_strength.go
+	securityRuleEngine *SecurityRuleEngine   // velocity/geo-velocity/new-device/expression rules run on every logSecurityEvent, see security_rule_engine.go
+	cti                *CTIEnricher          // IP reputation enrichment for every logged event, see cti.go; nil if unconfigured
+	geo                *GeoEnricher          // IP geolocation enrichment backing getLocationFromIP/geoCoordinatesFromIP, see geo_intel.go; nil if unconfigured
+	ipIntel            *IPEnrichmentWorker   // fills ip_reputation's country/ASN/VPN/Tor/threat_level columns, see ip_intel.go; nil if unconfigured
+	ca                 *CertificateAuthority // lets enhancedAuthMiddleware accept a client cert instead of a JWT, see mtls_auth.go; nil if unconfigured
+	threatFeed         *ThreatFeedClient     // shared with SecurityMonitor; its Bloom filter backs advancedRateLimitMiddleware's hot-path check, see threat_intel.go; nil if unconfigured
+	sessions           *SessionManager       // server-side session store enhancedAuthMiddleware/adminAuthMiddleware require a live lookup against, see session_manager.go
+	janitorStop        chan struct{}         // closed on shutdown to stop the sharded cache janitor goroutines
+	argon2Params       argon2Params          // calibrated once at startup to hit argon2CalibrationTarget, see argon2_params.go
+	tieredRateLimiter  RateLimiter           // sliding-window log backing tieredRateLimitMiddleware's per-route/per-user budgets, see tiered_rate_limiter.go
+	rateLimitTiers     []RateLimitTier       // route -> (limit, window) tiers tieredRateLimitMiddleware enforces, from Config.RateLimitTiers
 }
 
 // Security Monitoring Dashboard
 type SecurityMonitor struct {
 	db              *sql.DB
-	clients         map[*websocket.Conn]bool
+	wsHub           *wsHub // topic-subscribed, backpressured dashboard WebSocket clients, see ws_hub.go
 	broadcast       chan SecurityAlert
-	mutex           sync.RWMutex
 	alertThresholds map[string]int
 	metrics         *SecurityMetrics
+	threatFeed      *ThreatFeedClient  // community blocklist subscription, see threat_intel.go; nil if unconfigured
+	alertDispatcher *AlertDispatcher   // Slack/PagerDuty/Alertmanager/webhook fan-out, see alert_dispatcher.go
+	elector         *LeaderElector     // gates checkForNewAlerts/metric aggregation/feed pulls across HA replicas, see leader_election.go
+	cti             *CTIEnricher       // IP reputation enrichment for blockIP decisions and risk profiles, see cti.go; nil if unconfigured
+	blockStore      *BlockStore        // CIDR/ASN-aware ban storage with expiry, see block_store.go
+	apiKeys         *APIKeyStore       // bootstrap API-key auth for machine clients, see rbac.go
+	auditChain      *AuditChain        // shared with SecureTransactionHandler so audit_trail stays one sequence, see rbac.go/audit_chain.go
+	repo            SecurityRepository // shared with EnhancedSecurityService; backs risk_scores reads/writes, see security_repository.go
+	keystore        *KeyStore          // shared with EnhancedSecurityService; encrypts security_events.description and device_fingerprints.device_info, see envelope_crypto.go
+	ipIntel         *IPEnrichmentWorker // shared with EnhancedSecurityService; fills ip_reputation's country/ASN/VPN/Tor/threat_level columns, see ip_intel.go
 }
 
 // Transaction Service
@@ -267,18 +466,54 @@ type TransactionService struct {
 
 // Enhanced Secure Transaction Handler
 type SecureTransactionHandler struct {
-	ts     *TransactionService
-	ess    *EnhancedSecurityService
-	sm     *SecurityMonitor
-	config *Config
-	db     *sql.DB
-}
+	ts          *TransactionService
+	ess         *EnhancedSecurityService
+	sm          *SecurityMonitor
+	ca          *CertificateAuthority
+	crl         *crlFileWatcher
+	config      *Config
+	db          *sql.DB
+	idempotency *IdempotencyStore
+	retryQueue  *RetryQueue
+
+	auditChain      *AuditChain
+	auditSigningKey ed25519.PrivateKey
+
+	providerRouter       *ProviderRouter
+	reconciliationJob    *ReconciliationJob
+	reconciliationChore  *ReconciliationChore
+	invoices             *InvoiceService
+
+	keystore     *KeyStore
+	paymentVault *PaymentDataVault
+
+	// flowSessions backs flowSessionMiddleware's opt-in, cookie-carried
+	// session (invoice_session.go) -- separate from ess.sessions, which
+	// backs the JWT-referenced login session enhancedAuthMiddleware
+	// requires on every request.
+	flowSessions *SessionManager
+
+	webhooks *WebhookDispatcher
+
+	notificationService *NotificationService
+}
+
+// securityLogger emits securityLoggingMiddleware's per-request records as
+// structured JSON lines instead of the hand-formatted strings log.Printf
+// produced before, so a log shipper can parse fields (status, latency,
+// path, ...) without a regex. Everything else in this file still uses the
+// plain log package for one-off operational messages; this logger is
+// specifically for the high-volume, machine-consumed request log.
+var securityLogger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
 
 // WebSocket Upgrader
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
-		// Configure allowed origins for WebSocket connections
-		return true // In production, implement proper origin checking
+		// Real enforcement happens in wsDashboardAuthMiddleware before the
+		// upgrade is even attempted (mTLS cert role, or a short-lived
+		// ws/ticket); this is just a defense-in-depth backstop against the
+		// allowlist configured via setWebSocketOriginAllowlist/WS_ALLOWED_ORIGINS.
+		return isAllowedWebSocketOrigin(r.Header.Get("Origin"))
 	},
 }
 
@@ -294,7 +529,30 @@ func loadConfig() *Config {
 		ServerPort:    getEnv("SERVER_PORT", "8080"),
 		JWTSecret:     getEnv("JWT_SECRET", "your-super-secret-jwt-key-change-this"),
 		EncryptionKey: getEnv("ENCRYPTION_KEY", "your-32-byte-encryption-key-here-change-this"),
+		TLSCertFile:   getEnv("TLS_CERT_FILE", ""),
+		TLSKeyFile:    getEnv("TLS_KEY_FILE", ""),
+		DBDSN:         getEnv("DB_DSN", ""),
+		CRLFile:       getEnv("CRL_FILE", ""),
+		MTLSPort:      getEnv("MTLS_PORT", ""),
+
+		WSAllowedOrigins: newWebSocketOriginAllowlistFromEnv(),
+		RateLimitTiers:   newRateLimitTiersFromEnv(),
+	}
+}
+
+// loadConfigWithSecrets resolves JWTSecret/DBPassword through whichever
+// SecretsProvider their URI scheme implies (vault://, aws://, or plain env
+// values) and starts the background rotator that keeps them fresh.
+func loadConfigWithSecrets() *Config {
+	config := loadConfig()
+	config.JWTSecret = resolveSecret(config.JWTSecret)
+	config.DBPassword = resolveSecret(config.DBPassword)
+
+	if !isUsingEnvSecretsProvider(config) {
+		NewSecretRotator(config, 15*time.Minute).Start()
 	}
+
+	return config
 }
 
 // Get environment variable with default value
@@ -306,65 +564,76 @@ func getEnv(key, defaultValue string) string {
 	return value
 }
 
-// Validate JWT token
-func validateJWT(tokenString, secret string) (int, error) {
+// parseJWTClaims validates tokenString against secret and returns its claims.
+// validateJWT and the scope-aware auth in rbac.go both build on this so the
+// parsing/validation logic lives in exactly one place.
+func parseJWTClaims(tokenString, secret string) (jwt.MapClaims, error) {
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		return []byte(secret), nil
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+	return claims, nil
+}
 
+// Validate JWT token
+func validateJWT(tokenString, secret string) (int, error) {
+	claims, err := parseJWTClaims(tokenString, secret)
 	if err != nil {
 		return 0, err
 	}
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		userID, ok := claims["user_id"].(float64)
-		if !ok {
-			return 0, fmt.Errorf("invalid user ID in token")
-		}
-		return int(userID), nil
+	userID, ok := claims["user_id"].(float64)
+	if !ok {
+		return 0, fmt.Errorf("invalid user ID in token")
 	}
-
-	return 0, fmt.Errorf("invalid token")
+	return int(userID), nil
 }
 
-// Authentication middleware
-func authMiddleware(config *Config) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
-			c.Abort()
-			return
-		}
-
-		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-		userID, err := validateJWT(tokenString, config.JWTSecret)
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
-			c.Abort()
-			return
-		}
+// sessionFromToken extracts the sid claim tokenString carries and looks up
+// its live session, so a JWT is only as good as the session it names --
+// once that session is destroyed (logout, password reset, admin action) the
+// token stops granting access even though it hasn't expired yet.
+func sessionFromToken(tokenString, secret string, sessions *SessionManager) (*SessionRecord, error) {
+	claims, err := parseJWTClaims(tokenString, secret)
+	if err != nil {
+		return nil, err
+	}
 
-		c.Set("user_id", userID)
-		c.Next()
+	sid, ok := claims["sid"].(string)
+	if !ok || sid == "" {
+		return nil, fmt.Errorf("token carries no session reference")
 	}
+	return sessions.Read(sid)
 }
 
 // Initialize Enhanced Security
 func NewEnhancedSecurityService(db *sql.DB) *EnhancedSecurityService {
-	// Generate RSA key pair for additional encryption
-	privateKey, _ := rsa.GenerateKey(rand.Reader, 2048)
-	publicKey := &privateKey.PublicKey
+	keystore, err := NewKeyStore(db)
+	if err != nil {
+		log.Printf("⚠️  Failed to initialize encryption keystore: %v", err)
+	}
 
 	service := &EnhancedSecurityService{
-		db:            db,
-		rateLimiters:  make(map[string]*rate.Limiter),
-		blockedIPs:    make(map[string]time.Time),
-		trustedIPs:    make(map[string]bool),
-		loginAttempts: make(map[string][]time.Time),
-		deviceCache:   make(map[string]*DeviceFingerprint),
-		privateKey:    privateKey,
-		publicKey:     publicKey,
+		db:                 db,
+		rateLimitBackend:   newRateLimitBackendFromDSN(getEnv("RATE_LIMIT_BACKEND_DSN", "")),
+		blockedIPCache:     newShardedTTLCache("blocked_ips", 4096),
+		trustedIPs:         make(map[string]bool),
+		loginAttemptCache:  newShardedTTLCache("login_attempts", 4096),
+		deviceCache:        newShardedTTLCache("device_cache", 4096),
+		webauthnChallenges: make(map[string]string),
+		keystore:           keystore,
+		stateStore:         newStateStoreFromDSN(getEnv("STATE_STORE_DSN", "")),
+		repo:               newSecurityRepository(db, getEnv("SECURITY_REPO_DSN", ""), keystore),
+		sessions:           NewSessionManager(newSessionProviderFromDSN(db, getEnv("SESSION_STORE_DSN", ""))),
+		janitorStop:        make(chan struct{}),
+		tieredRateLimiter:  newTieredRateLimiterFromDSN(getEnv("RATE_LIMIT_TIER_BACKEND_DSN", "")),
 		config: &SecurityConfig{
 			MaxLoginAttempts:      5,
 			LockoutDuration:       15 * time.Minute,
@@ -378,50 +647,126 @@ func NewEnhancedSecurityService(db *sql.DB) *EnhancedSecurityService {
 			EnableFraudDetection:  true,
 			RequireDeviceAuth:     true,
 			EnableBiometric:       true,
+			Velocity1mLimit:       3,
+			Velocity5mLimit:       8,
+			Velocity60mLimit:      20,
+			EnableBreachCheck:     getEnv("ENABLE_BREACH_CHECK", "true") == "true",
+			EnableEntropyCheck:    getEnv("ENABLE_ENTROPY_CHECK", "true") == "true",
+			MinPasswordScore:      3,
+			WebAuthnRPID:          getEnv("WEBAUTHN_RP_ID", "krili.com"),
+			WebAuthnRPName:        getEnv("WEBAUTHN_RP_NAME", "Krili"),
+			WebAuthnOrigin:        getEnv("WEBAUTHN_ORIGIN", "https://krili.com"),
 		},
 	}
 
+	service.argon2Params = calibrateArgon2Params(argon2CalibrationTarget)
+	log.Printf("🔐 Argon2id calibrated: m=%dKiB t=%d p=%d (targeting %s)",
+		service.argon2Params.memory, service.argon2Params.time, service.argon2Params.threads, argon2CalibrationTarget)
+
 	service.loadFraudRules()
 	service.loadTrustedIPs()
+
+	service.fraudEngine = NewFraudRuleEngine(db)
+	service.fraudEngine.Start(1 * time.Minute)
+	service.approvalEngine = NewApprovalRulesEngine(db)
+	service.waf = newWAFEngineFromEnv()
+	service.breachCheck = newBreachCheckClientFromEnv()
+	service.securityRuleEngine = NewSecurityRuleEngine(service.repo, service.stateStore)
+	service.securityRuleEngine.Start(1 * time.Minute)
+	service.cti = newCTIEnricherFromEnv()
+	service.geo = newGeoEnricherFromEnv()
+	service.ipIntel = newIPEnrichmentWorkerFromEnv(db, newIPEnricherFromEnv(service.geo, service.cti))
+	if service.ipIntel != nil {
+		service.ipIntel.Start()
+	}
+
+	go service.blockedIPCache.runJanitor(30*time.Second, service.janitorStop)
+	go service.loginAttemptCache.runJanitor(30*time.Second, service.janitorStop)
+	go service.deviceCache.runJanitor(30*time.Second, service.janitorStop)
+	go service.sessions.gcLoop(10*time.Minute, service.janitorStop)
+
 	return service
 }
 
+// blockIPLocally puts ip under blockedIPCache, this process's fast L1 check,
+// and mirrors the block into the shared state store (when configured) so
+// every other API instance sees it too instead of only the one that issued
+// it. Callers that only have blockedIPCache available (no stateStore) still
+// get today's single-process behavior.
+func (ess *EnhancedSecurityService) blockIPLocally(ip string, ttl time.Duration) {
+	ess.blockedIPCache.Set(ip, struct{}{}, ttl)
+	if ess.stateStore != nil {
+		if err := ess.stateStore.SetBlocked(ip, ttl); err != nil {
+			log.Printf("Error propagating IP block to shared state store: %v", err)
+		}
+	}
+}
+
+// isIPBlocked checks blockedIPCache first since it never leaves the process,
+// then falls back to the shared state store so a block issued by a peer
+// instance is honored here even before this process's own cache has seen
+// the IP.
+func (ess *EnhancedSecurityService) isIPBlocked(ip string) bool {
+	if _, blocked := ess.blockedIPCache.Get(ip); blocked {
+		return true
+	}
+	if ess.stateStore != nil {
+		if blocked, err := ess.stateStore.IsBlocked(ip); err == nil && blocked {
+			ess.blockedIPCache.Set(ip, struct{}{}, ess.config.LockoutDuration)
+			return true
+		}
+	}
+	return false
+}
+
 // Advanced Rate Limiting with IP-based tracking
 func (ess *EnhancedSecurityService) advancedRateLimitMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ip := ess.getRealIP(c)
 
-		// Check if IP is blocked
-		ess.mutex.RLock()
-		if blockedUntil, exists := ess.blockedIPs[ip]; exists {
-			if time.Now().Before(blockedUntil) {
-				ess.mutex.RUnlock()
-				ess.logSecurityEvent(nil, "blocked_ip_access", "high",
-					fmt.Sprintf("Blocked IP %s attempted access", ip), ip, c.GetHeader("User-Agent"))
-				c.JSON(http.StatusTooManyRequests, gin.H{"error": "IP temporarily blocked"})
+		// Check if IP is blocked, locally or by a peer instance. The cache
+		// expires the entry itself once the block lapses, so there's no
+		// manual delete-on-read step left.
+		if ess.isIPBlocked(ip) {
+			blockedIPHitsTotal.Inc()
+			ess.logSecurityEvent(nil, "blocked_ip_access", "high",
+				fmt.Sprintf("Blocked IP %s attempted access", ip), ip, c.GetHeader("User-Agent"))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "IP temporarily blocked"})
+			c.Abort()
+			return
+		}
+
+		// O(1) pre-check against the threat-intel feed's Bloom filter,
+		// ahead of the rate-limit counters below, so an IP a feed already
+		// flagged gets blocked on first contact instead of after it burns
+		// through its request budget.
+		if ess.threatFeed != nil && ess.threatFeed.MightBeMalicious(ip) {
+			ess.blockIPLocally(ip, ess.config.LockoutDuration)
+			ess.logSecurityEvent(nil, "threat_feed_match", "high",
+				fmt.Sprintf("IP %s matched an active threat-intel block", ip), ip, c.GetHeader("User-Agent"))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "IP temporarily blocked"})
+			c.Abort()
+			return
+		}
+
+		// Mirror the per-IP count into the shared state store so rate limits
+		// hold across multiple API instances, not just this process's memory.
+		if ess.stateStore != nil {
+			if count, err := ess.stateStore.IncrementAndGet("ratelimit:"+ip, time.Minute); err == nil && count > 60 {
+				ess.blockIPLocally(ip, ess.config.LockoutDuration)
+
+				ess.logSecurityEvent(nil, "rate_limit_exceeded", "high",
+					fmt.Sprintf("IP %s exceeded shared rate limit and was blocked", ip), ip, c.GetHeader("User-Agent"))
+
+				c.JSON(http.StatusTooManyRequests, gin.H{"error": "Rate limit exceeded. IP blocked temporarily."})
 				c.Abort()
 				return
-			} else {
-				// Remove expired block
-				delete(ess.blockedIPs, ip)
 			}
 		}
-		ess.mutex.RUnlock()
 
-		// Get or create rate limiter for this IP
-		ess.mutex.Lock()
-		limiter, exists := ess.rateLimiters[ip]
-		if !exists {
-			limiter = rate.NewLimiter(rate.Every(time.Minute/60), 60) // 60 requests per minute
-			ess.rateLimiters[ip] = limiter
-		}
-		ess.mutex.Unlock()
-
-		if !limiter.Allow() {
+		if !ess.rateLimitBackend.Allow(ip, 60, 60) { // 60 requests per minute
 			// Block IP for repeated violations
-			ess.mutex.Lock()
-			ess.blockedIPs[ip] = time.Now().Add(ess.config.LockoutDuration)
-			ess.mutex.Unlock()
+			ess.blockIPLocally(ip, ess.config.LockoutDuration)
 
 			ess.logSecurityEvent(nil, "rate_limit_exceeded", "high",
 				fmt.Sprintf("IP %s exceeded rate limit and was blocked", ip), ip, c.GetHeader("User-Agent"))
@@ -438,6 +783,38 @@ func (ess *EnhancedSecurityService) advancedRateLimitMiddleware() gin.HandlerFun
 // Enhanced Authentication Middleware
 func (ess *EnhancedSecurityService) enhancedAuthMiddleware(config *Config) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		// A caller presenting a client certificate signed by our CA (webhook
+		// receivers, admin CLIs, payout workers) authenticates via mTLS
+		// instead of a JWT, and its certificate fingerprint stands in for the
+		// X-Device-ID header below -- spoofing a header is a lot easier than
+		// presenting a cert this process's own CA issued.
+		if ess.ca != nil && c.Request.TLS != nil && len(c.Request.TLS.PeerCertificates) > 0 {
+			record, err := ess.ca.authenticatePeerCert(c)
+			if err != nil {
+				ess.logSecurityEvent(nil, "invalid_client_cert", "high",
+					err.Error(), ess.getRealIP(c), c.GetHeader("User-Agent"))
+				c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+				c.Abort()
+				return
+			}
+
+			c.Set("user_id", record.UserID)
+			c.Set("device_id", record.Fingerprint)
+			c.Set("client_cert_role", record.Role)
+			c.Set("auth_method", "mtls")
+
+			if ess.detectSuspiciousBehavior(record.UserID, c) {
+				ess.logSecurityEvent(&record.UserID, "suspicious_behavior", "high",
+					"Suspicious behavior detected", ess.getRealIP(c), c.GetHeader("User-Agent"))
+				c.JSON(http.StatusForbidden, gin.H{"error": "Additional verification required"})
+				c.Abort()
+				return
+			}
+
+			c.Next()
+			return
+		}
+
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
@@ -455,6 +832,20 @@ func (ess *EnhancedSecurityService) enhancedAuthMiddleware(config *Config) gin.H
 			return
 		}
 
+		// The JWT is treated as an opaque reference to a server-side session
+		// rather than a self-contained credential, so logout, password reset,
+		// or an admin action can kill it immediately instead of waiting for it
+		// to expire on its own.
+		session, err := sessionFromToken(tokenString, config.JWTSecret, ess.sessions)
+		if err != nil || session.UserID != userID {
+			ess.logSecurityEvent(&userID, "session_revoked_or_missing", "medium",
+				"JWT presented without a matching live session", ess.getRealIP(c), c.GetHeader("User-Agent"))
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Session has expired or been revoked"})
+			c.Abort()
+			return
+		}
+		c.Set("sid", session.SID)
+
 		// Check device fingerprint for sensitive operations
 		if ess.config.RequireDeviceAuth && ess.isSensitiveOperation(c.Request.URL.Path) {
 			deviceID := c.GetHeader("X-Device-ID")
@@ -521,13 +912,17 @@ func (ess *EnhancedSecurityService) biometricAuthMiddleware() gin.HandlerFunc {
 		}
 
 		userID := c.GetInt("user_id")
-		biometricData := c.GetHeader("X-Biometric-Data")
-		biometricType := c.GetHeader("X-Biometric-Type")
-
-		if biometricData != "" && biometricType != "" {
-			if !ess.validateBiometric(userID, biometricType, biometricData) {
+		deviceID := c.GetHeader("X-WebAuthn-Device-ID")
+		credentialID := c.GetHeader("X-WebAuthn-Credential-ID")
+		clientDataJSON := c.GetHeader("X-WebAuthn-Client-Data")
+		authenticatorData := c.GetHeader("X-WebAuthn-Authenticator-Data")
+		signature := c.GetHeader("X-WebAuthn-Signature")
+
+		if deviceID != "" && credentialID != "" && clientDataJSON != "" && authenticatorData != "" && signature != "" {
+			err := ess.FinishLogin(userID, deviceID, credentialID, clientDataJSON, authenticatorData, signature, ess.config.RequireStrongAuth)
+			if err != nil {
 				ess.logSecurityEvent(&userID, "invalid_biometric", "high",
-					"Invalid biometric authentication", ess.getRealIP(c), c.GetHeader("User-Agent"))
+					fmt.Sprintf("WebAuthn assertion verification failed: %v", err), ess.getRealIP(c), c.GetHeader("User-Agent"))
 				c.JSON(http.StatusForbidden, gin.H{"error": "Biometric authentication failed"})
 				c.Abort()
 				return
@@ -602,38 +997,48 @@ func (ess *EnhancedSecurityService) geoBlockingMiddleware() gin.HandlerFunc {
 	}
 }
 
-// Advanced Input Validation and Sanitization
+// Advanced Input Validation and Sanitization. Scores the request through
+// ess.waf instead of running the old independent boolean detectors, so a
+// single coincidental match (an email with "--" in it, a "select a
+// category" query) no longer blocks on its own - see waf.go.
 func (ess *EnhancedSecurityService) advancedValidationMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Check for SQL injection patterns
-		if ess.detectSQLInjection(c) {
-			ess.logSecurityEvent(nil, "sql_injection_attempt", "critical",
-				"SQL injection attempt detected", ess.getRealIP(c), c.GetHeader("User-Agent"))
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
-			c.Abort()
+		score, matches := ess.waf.Score(c)
+		if score < ess.waf.threshold {
+			c.Next()
 			return
 		}
 
-		// Check for XSS patterns
-		if ess.detectXSS(c) {
-			ess.logSecurityEvent(nil, "xss_attempt", "high",
-				"XSS attempt detected", ess.getRealIP(c), c.GetHeader("User-Agent"))
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
-			c.Abort()
-			return
+		categories := make(map[string]bool)
+		for _, m := range matches {
+			categories[m.Category] = true
+		}
+		description := fmt.Sprintf("WAF score %d >= threshold %d (%d rules matched, categories: %s)",
+			score, ess.waf.threshold, len(matches), strings.Join(mapKeys(categories), ","))
+		for _, m := range matches {
+			description += fmt.Sprintf("; %s on %s: %q", m.RuleID, m.Field, m.Excerpt)
 		}
 
-		// Check for command injection
-		if ess.detectCommandInjection(c) {
-			ess.logSecurityEvent(nil, "command_injection_attempt", "critical",
-				"Command injection attempt detected", ess.getRealIP(c), c.GetHeader("User-Agent"))
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
-			c.Abort()
+		if ess.waf.shadowMode {
+			ess.logSecurityEvent(nil, "waf_shadow_block", "medium", description, ess.getRealIP(c), c.GetHeader("User-Agent"))
+			c.Next()
 			return
 		}
 
-		c.Next()
+		ess.logSecurityEvent(nil, "waf_block", "critical", description, ess.getRealIP(c), c.GetHeader("User-Agent"))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		c.Abort()
+	}
+}
+
+// mapKeys returns the keys of a string-keyed set, for building a stable
+// human-readable summary (used by advancedValidationMiddleware's WAF log).
+func mapKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
 	}
+	return keys
 }
 
 // CSRF Protection Middleware
@@ -693,34 +1098,33 @@ func (ess *EnhancedSecurityService) isSensitiveOperation(path string) bool {
 }
 
 func (ess *EnhancedSecurityService) isDeviceTrusted(userID int, deviceID string) bool {
-	ess.mutex.RLock()
-	defer ess.mutex.RUnlock()
-
-	if device, exists := ess.deviceCache[fmt.Sprintf("%d_%s", userID, deviceID)]; exists {
-		return device.IsTrusted
+	if cached, exists := ess.deviceCache.Get(fmt.Sprintf("%d_%s", userID, deviceID)); exists {
+		return cached.(*DeviceFingerprint).IsTrusted
 	}
 
-	// Check database
-	var trusted bool
-	err := ess.db.QueryRow("SELECT is_trusted FROM device_fingerprints WHERE user_id = ? AND device_id = ?",
-		userID, deviceID).Scan(&trusted)
-
-	return err == nil && trusted
+	device, err := ess.repo.LookupDevice(userID, deviceID)
+	return err == nil && device.IsTrusted
 }
 
 func (ess *EnhancedSecurityService) detectSuspiciousBehavior(userID int, c *gin.Context) bool {
 	ip := ess.getRealIP(c)
 	userAgent := c.GetHeader("User-Agent")
 
-	// Check for rapid requests from same IP
-	ess.mutex.Lock()
+	// Check for rapid requests from same IP. The shared state store (when
+	// configured) carries the authoritative count across instances; the
+	// local cache is a fallback so this still works without one.
 	key := fmt.Sprintf("%d_%s", userID, ip)
 	now := time.Now()
 
-	if attempts, exists := ess.loginAttempts[key]; exists {
-		// Remove old attempts (older than 5 minutes)
-		var recentAttempts []time.Time
-		for _, attempt := range attempts {
+	if ess.stateStore != nil {
+		if count, err := ess.stateStore.IncrementAndGet("loginattempt:"+key, 5*time.Minute); err == nil && count > 10 {
+			return true
+		}
+	}
+
+	var recentAttempts []time.Time
+	if cached, exists := ess.loginAttemptCache.Get(key); exists {
+		for _, attempt := range cached.([]time.Time) {
 			if now.Sub(attempt) < 5*time.Minute {
 				recentAttempts = append(recentAttempts, attempt)
 			}
@@ -728,15 +1132,10 @@ func (ess *EnhancedSecurityService) detectSuspiciousBehavior(userID int, c *gin.
 
 		// Check if too many recent attempts
 		if len(recentAttempts) > 10 {
-			ess.mutex.Unlock()
 			return true
 		}
-
-		ess.loginAttempts[key] = append(recentAttempts, now)
-	} else {
-		ess.loginAttempts[key] = []time.Time{now}
 	}
-	ess.mutex.Unlock()
+	ess.loginAttemptCache.Set(key, append(recentAttempts, now), 5*time.Minute)
 
 	// Check for suspicious user agent patterns
 	suspiciousPatterns := []string{"bot", "crawler", "spider", "scraper"}
@@ -751,43 +1150,27 @@ func (ess *EnhancedSecurityService) detectSuspiciousBehavior(userID int, c *gin.
 }
 
 func (ess *EnhancedSecurityService) validateMFAToken(userID int, token string) bool {
-	// Implement TOTP validation here
-	// This is a simplified version - use a proper TOTP library in production
-	var secret string
-	err := ess.db.QueryRow("SELECT secret FROM two_factor_auth WHERE user_id = ? AND is_enabled = true",
-		userID).Scan(&secret)
-
+	encryptedSecret, err := ess.repo.GetTwoFactorSecret(userID)
 	if err != nil {
 		return false
 	}
 
-	// Validate TOTP token (implement proper TOTP validation)
-	return ess.validateTOTP(secret, token)
-}
-
-func (ess *EnhancedSecurityService) validateBiometric(userID int, biometricType, data string) bool {
-	var template string
-	err := ess.db.QueryRow("SELECT template FROM biometric_auth WHERE user_id = ? AND biometric_type = ? AND is_active = true",
-		userID, biometricType).Scan(&template)
-
+	secret, err := ess.decryptWithRSA(encryptedSecret)
 	if err != nil {
 		return false
 	}
 
-	// Compare biometric data with stored template
-	return ess.compareBiometricData(template, data)
+	return ess.validateTOTP(userID, secret, token)
 }
 
 func (ess *EnhancedSecurityService) checkTransactionLimits(userID int, c *gin.Context) bool {
-	// Get transaction amount from request
+	// Get transaction amount from request. extractTransactionContext peeks
+	// the body via readAndRestoreBody rather than c.ShouldBindJSON so the
+	// later calculateRiskScore call (and the handler's own binding) still
+	// see the full request body.
 	var amount float64
 	if c.Request.Method == "POST" {
-		var req map[string]interface{}
-		if err := c.ShouldBindJSON(&req); err == nil {
-			if amt, ok := req["amount"].(float64); ok {
-				amount = amt
-			}
-		}
+		amount, _, _ = extractTransactionContext(c)
 	}
 
 	// Check single transaction limit
@@ -795,163 +1178,35 @@ func (ess *EnhancedSecurityService) checkTransactionLimits(userID int, c *gin.Co
 		return false
 	}
 
-	// Check daily limit
-	var dailyTotal float64
-	err := ess.db.QueryRow(`
-		SELECT COALESCE(SUM(amount), 0) 
-		FROM transactions 
-		WHERE user_id = ? AND DATE(created_at) = CURDATE() AND status = 'completed'
-	`, userID).Scan(&dailyTotal)
-
-	if err != nil {
-		return false
-	}
-
-	return (dailyTotal + amount) <= ess.config.DailyTransactionLimit
-}
-
-func (ess *EnhancedSecurityService) calculateRiskScore(userID int, ip string, c *gin.Context) int {
-	score := 0
-
-	// Location risk
-	location := ess.getLocationFromIP(ip)
-	if ess.isHighRiskLocation(location) {
-		score += 30
-	}
-
-	// Device risk
-	deviceID := c.GetHeader("X-Device-ID")
-	if deviceID == "" || !ess.isDeviceTrusted(userID, deviceID) {
-		score += 25
-	}
-
-	// Time-based risk (unusual hours)
-	hour := time.Now().Hour()
-	if hour < 6 || hour > 22 {
-		score += 15
-	}
-
-	// Transaction pattern risk
-	if ess.hasUnusualTransactionPattern(userID) {
-		score += 20
-	}
-
-	// IP reputation risk
-	if ess.isHighRiskIP(ip) {
-		score += 35
-	}
-
-	return score
-}
-
-func (ess *EnhancedSecurityService) detectSQLInjection(c *gin.Context) bool {
-	patterns := []string{
-		`(?i)(union|select|insert|update|delete|drop|create|alter|exec|execute)`,
-		`(?i)(or|and)\s+\d+\s*=\s*\d+`,
-		`(?i)'.*'`,
-		`(?i)--`,
-		`(?i)/\*.*\*/`,
-		`(?i)xp_cmdshell`,
-		`(?i)sp_executesql`,
-	}
-
-	// Check URL parameters
-	for _, param := range c.Request.URL.Query() {
-		for _, value := range param {
-			for _, pattern := range patterns {
-				if matched, _ := regexp.MatchString(pattern, value); matched {
-					return true
-				}
-			}
+	// Fast-path burst check against the shared state store, ahead of the
+	// authoritative daily-limit query against the transactions table. This is
+	// also the one place that records the transaction into every velocity
+	// window (1h/24h/7d/30d) so processPaymentHandler/processPayoutHandler
+	// can read them back via PeekVelocity without recording it twice.
+	if ess.stateStore != nil {
+		txType := "payment"
+		if strings.Contains(c.Request.URL.Path, "payouts") {
+			txType = "payout"
 		}
-	}
-
-	// Check POST data
-	if c.Request.Method == "POST" {
-		body, _ := c.GetRawData()
-		bodyStr := string(body)
-		for _, pattern := range patterns {
-			if matched, _ := regexp.MatchString(pattern, bodyStr); matched {
-				return true
+		dailyBreached := false
+		for _, w := range transactionVelocityWindows {
+			key := transactionVelocityKey(userID, w.label)
+			if _, total, err := ess.stateStore.VelocityAdd(key, amount, txType, w.window); err == nil && w.label == "24h" {
+				dailyBreached = total > ess.config.DailyTransactionLimit
 			}
 		}
-	}
-
-	return false
-}
-
-func (ess *EnhancedSecurityService) detectXSS(c *gin.Context) bool {
-	patterns := []string{
-		`(?i)<script.*?>.*?</script>`,
-		`(?i)javascript:`,
-		`(?i)on\w+\s*=`,
-		`(?i)<iframe.*?>`,
-		`(?i)<object.*?>`,
-		`(?i)<embed.*?>`,
-		`(?i)expression\s*\(`,
-		`(?i)vbscript:`,
-	}
-
-	// Check all input sources
-	allInputs := []string{}
-
-	// URL parameters
-	for _, param := range c.Request.URL.Query() {
-		allInputs = append(allInputs, param...)
-	}
-
-	// Headers
-	for _, values := range c.Request.Header {
-		allInputs = append(allInputs, values...)
-	}
-
-	// POST data
-	if c.Request.Method == "POST" {
-		body, _ := c.GetRawData()
-		allInputs = append(allInputs, string(body))
-	}
-
-	for _, input := range allInputs {
-		for _, pattern := range patterns {
-			if matched, _ := regexp.MatchString(pattern, input); matched {
-				return true
-			}
+		if dailyBreached {
+			return false
 		}
 	}
 
-	return false
-}
-
-func (ess *EnhancedSecurityService) detectCommandInjection(c *gin.Context) bool {
-	patterns := []string{
-		`(?i)(;|\||&|&&|\$\(|\` + "`" + `|<|>)`,
-		`(?i)(cat|ls|pwd|whoami|id|uname|ps|netstat|ifconfig|ping|nslookup|dig)`,
-		`(?i)(rm|mv|cp|chmod|chown|kill|killall|sudo|su)`,
-		`(?i)(wget|curl|nc|telnet|ssh|ftp)`,
-		`(?i)(\.\./|\.\.\\)`,
-	}
-
-	// Check all input sources
-	allInputs := []string{}
-
-	for _, param := range c.Request.URL.Query() {
-		allInputs = append(allInputs, param...)
-	}
-
-	if c.Request.Method == "POST" {
-		body, _ := c.GetRawData()
-		allInputs = append(allInputs, string(body))
-	}
-
-	for _, input := range allInputs {
-		for _, pattern := range patterns {
-			if matched, _ := regexp.MatchString(pattern, input); matched {
-				return true
-			}
-		}
+	// Check daily limit
+	dailyTotal, err := ess.repo.GetDailyTransactionTotal(userID)
+	if err != nil {
+		return false
 	}
 
-	return false
+	return (dailyTotal + amount) <= ess.config.DailyTransactionLimit
 }
 
 func (ess *EnhancedSecurityService) validateCSRFToken(token string, c *gin.Context) bool {
@@ -982,10 +1237,48 @@ func (ess *EnhancedSecurityService) generateCSRFToken(sessionToken string) strin
 	return hex.EncodeToString(h.Sum(nil))
 }
 
+// getLocationFromIP resolves ip's country code from a fresh geolocation_data
+// row if one is cached, otherwise from ess.geo (when GEO_PROVIDER is
+// configured, see geo_intel.go), falling back to the pre-geolocation
+// placeholder when neither is available. trustedIPs bypass the lookup
+// entirely, the same hard bypass isHighRiskIP below gives them.
 func (ess *EnhancedSecurityService) getLocationFromIP(ip string) string {
-	// Implement IP geolocation lookup
-	// This is a placeholder - use a real geolocation service
-	return "US" // Default to US
+	if ess.trustedIPs[ip] {
+		return ""
+	}
+	if cached, ok := ess.cachedGeolocation(ip); ok {
+		return cached.CountryCode
+	}
+	if ess.geo == nil {
+		return "US" // no GEO_PROVIDER configured; legacy default
+	}
+	result, err := ess.geo.Lookup(ip)
+	if err != nil {
+		return "US"
+	}
+	ess.saveGeolocation(result)
+	return result.CountryCode
+}
+
+// geoCoordinatesFromIP returns the latitude/longitude GeoVelocityRule's
+// impossible-travel check compares between consecutive logins, sourced the
+// same way getLocationFromIP resolves a country code.
+func (ess *EnhancedSecurityService) geoCoordinatesFromIP(ip string) (latitude, longitude float64) {
+	if ess.trustedIPs[ip] {
+		return 0, 0
+	}
+	if cached, ok := ess.cachedGeolocation(ip); ok {
+		return cached.Latitude, cached.Longitude
+	}
+	if ess.geo == nil {
+		return 0, 0
+	}
+	result, err := ess.geo.Lookup(ip)
+	if err != nil {
+		return 0, 0
+	}
+	ess.saveGeolocation(result)
+	return result.Latitude, result.Longitude
 }
 
 func (ess *EnhancedSecurityService) isHighRiskLocation(location string) bool {
@@ -998,55 +1291,58 @@ func (ess *EnhancedSecurityService) isHighRiskLocation(location string) bool {
 	return false
 }
 
-func (ess *EnhancedSecurityService) isHighRiskIP(ip string) bool {
-	// Check against known malicious IP databases
-	// This is a placeholder - implement real IP reputation checking
-	return false
-}
-
-func (ess *EnhancedSecurityService) hasUnusualTransactionPattern(userID int) bool {
-	// Analyze user's transaction history for unusual patterns
-	var avgAmount, stdDev float64
-	err := ess.db.QueryRow(`
-		SELECT AVG(amount), STDDEV(amount) 
-		FROM transactions 
-		WHERE user_id = ? AND created_at > DATE_SUB(NOW(), INTERVAL 30 DAY)
-	`, userID).Scan(&avgAmount, &stdDev)
+// highRiskIPScoreThreshold is the CTI reputation score (0-100, higher is
+// more malicious) isHighRiskIP treats as "known bad". It is independent of
+// CTI_AUTO_BLOCK_SCORE_THRESHOLD, whose default of 0 leaves auto-blocking off.
+const highRiskIPScoreThreshold = 70
 
+func (ess *EnhancedSecurityService) isHighRiskIP(ip string) bool {
+	if ess.trustedIPs[ip] {
+		return false
+	}
+	if ess.cti == nil {
+		return false // no CTI_PROVIDER configured; legacy behavior
+	}
+	result, err := ess.cti.Lookup(ip)
 	if err != nil {
 		return false
 	}
-
-	// Check if current transaction is significantly different from normal pattern
-	// This is a simplified check - implement more sophisticated pattern analysis
-	return stdDev > avgAmount*0.5 // High variance indicates unusual pattern
+	return result.Score >= highRiskIPScoreThreshold
 }
 
-func (ess *EnhancedSecurityService) validateTOTP(secret, token string) bool {
-	// Implement proper TOTP validation
-	// This is a placeholder - use a proper TOTP library like github.com/pquerna/otp
-	return len(token) == 6 && token != "000000"
+// ipReputationRiskContribution turns ip's CTI reputation score (0-100,
+// higher is more malicious) into calculateRiskScore's 0-10 contribution,
+// replacing the old flat "+10 if isHighRiskIP" boolean with the numeric
+// score CTIEnricher already returns. With no CTI_PROVIDER configured this
+// falls back to isHighRiskIP's boolean so risk scoring behaves the same as
+// before CTI was wired in.
+func (ess *EnhancedSecurityService) ipReputationRiskContribution(ip string) int {
+	if ess.trustedIPs[ip] {
+		return 0
+	}
+	if ess.cti == nil {
+		if ess.isHighRiskIP(ip) {
+			return 10
+		}
+		return 0
+	}
+	result, err := ess.cti.Lookup(ip)
+	if err != nil {
+		return 0
+	}
+	return result.Score / 10
 }
 
-func (ess *EnhancedSecurityService) compareBiometricData(template, data string) bool {
-	// Implement biometric comparison
-	// This is a placeholder - use proper biometric matching algorithms
-	return template == data
+func (ess *EnhancedSecurityService) validateTOTP(userID int, secret, token string) bool {
+	return validateAndConsumeTOTP(ess.db, userID, secret, token)
 }
 
 func (ess *EnhancedSecurityService) loadFraudRules() {
-	rows, err := ess.db.Query("SELECT id, rule_name, rule_type, threshold, action, is_active, description FROM fraud_rules WHERE is_active = true")
+	rules, err := ess.repo.LoadFraudRules()
 	if err != nil {
 		return
 	}
-	defer rows.Close()
-
-	ess.fraudRules = []FraudRule{}
-	for rows.Next() {
-		var rule FraudRule
-		rows.Scan(&rule.ID, &rule.RuleName, &rule.RuleType, &rule.Threshold, &rule.Action, &rule.IsActive, &rule.Description)
-		ess.fraudRules = append(ess.fraudRules, rule)
-	}
+	ess.fraudRules = rules
 }
 
 func (ess *EnhancedSecurityService) loadTrustedIPs() {
@@ -1057,61 +1353,116 @@ func (ess *EnhancedSecurityService) loadTrustedIPs() {
 
 func (ess *EnhancedSecurityService) logSecurityEvent(userID *int, eventType, severity, description, ip, userAgent string) {
 	location := ess.getLocationFromIP(ip)
+	ess.ipIntel.Enqueue(ip)
+
+	event := &SecurityEvent{
+		UserID:      userID,
+		EventType:   eventType,
+		Severity:    severity,
+		Description: encryptColumnValue(ess.keystore, description),
+		IPAddress:   ip,
+		UserAgent:   userAgent,
+		Location:    location,
+	}
+	if ess.cti != nil && ip != "" {
+		if cti, err := ess.cti.Lookup(ip); err == nil {
+			score := cti.Score
+			event.CTIScore = &score
+			event.CTICategories = strings.Join(cti.Categories, ",")
+			event.CTIConfidence = cti.Confidence
+			event.CTISource = cti.Source
+		}
+	}
 
-	_, err := ess.db.Exec(`
-		INSERT INTO security_events (user_id, event_type, severity, description, ip_address, user_agent, location) 
-		VALUES (?, ?, ?, ?, ?, ?, ?)
-	`, userID, eventType, severity, description, ip, userAgent, location)
+	err := ess.repo.RecordSecurityEvent(event)
 
 	if err != nil {
 		fmt.Printf("Failed to log security event: %v\n", err)
 	}
 
+	if ess.securityRuleEngine != nil {
+		ctx := FraudContext{
+			EventType:   eventType,
+			Severity:    severity,
+			IPAddress:   ip,
+			Country:     location,
+			IsNewDevice: eventType == "untrusted_device",
+			Timestamp:   time.Now(),
+		}
+		if userID != nil {
+			ctx.UserID = *userID
+		}
+		ctx.Latitude, ctx.Longitude = ess.geoCoordinatesFromIP(ip)
+
+		if result := ess.securityRuleEngine.Evaluate(ctx); len(result.TriggeredRules) > 0 {
+			ess.executeSecurityRuleAction(result, ip, description)
+		}
+	}
+
 	// Send alert for critical events
 	if severity == "critical" {
 		ess.sendSecurityAlert(eventType, description, ip)
 	}
 }
 
+// executeSecurityRuleAction carries out the most severe action any rule
+// SecurityRuleEngine.Evaluate triggered, so a rule fires on its configured
+// Action (block, challenge_mfa, notify, ...) instead of only alerting when a
+// caller happened to pass severity "critical".
+func (ess *EnhancedSecurityService) executeSecurityRuleAction(result SecurityRuleResult, ip, description string) {
+	reason := fmt.Sprintf("%s (rules: %s)", description, strings.Join(result.TriggeredRules, ", "))
+	switch result.Action {
+	case "block":
+		ess.blockIPLocally(ip, ess.config.LockoutDuration)
+		ess.sendSecurityAlert("fraud_rule_triggered", reason, ip)
+	case "challenge_mfa", "notify", "require_2fa":
+		ess.sendSecurityAlert("fraud_rule_triggered", reason, ip)
+	}
+}
+
 func (ess *EnhancedSecurityService) sendSecurityAlert(eventType, description, ip string) {
 	// Implement security alert system (email, SMS, Slack, etc.)
 	fmt.Printf("SECURITY ALERT: %s - %s from IP %s\n", eventType, description, ip)
 }
 
-// Password Security Functions
+// Password Security Functions. See argon2_params.go for the PHC-string
+// encoding, startup calibration, and rehash-detection these build on.
 func (ess *EnhancedSecurityService) hashPasswordArgon2(password string) (string, error) {
-	salt := make([]byte, 32)
-	_, err := rand.Read(salt)
-	if err != nil {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
 		return "", err
 	}
 
-	hash := argon2.IDKey([]byte(password), salt, 1, 64*1024, 4, 32)
-
-	// Encode salt and hash
-	encoded := base64.StdEncoding.EncodeToString(salt) + ":" + base64.StdEncoding.EncodeToString(hash)
-	return encoded, nil
+	params := ess.argon2Params
+	hash := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, params.keyLen)
+	return encodeArgon2PHC(params, salt, hash), nil
 }
 
+// verifyPasswordArgon2 accepts both the current PHC-encoded format and the
+// legacy "base64(salt):base64(hash)" format (fixed at time=1, memory=64MiB,
+// threads=4, keyLen=32) so hashes stored before this format existed keep
+// verifying; NeedsRehash tells a caller when it should call hashPasswordArgon2
+// again afterwards to upgrade one.
 func (ess *EnhancedSecurityService) verifyPasswordArgon2(password, encoded string) bool {
-	parts := strings.Split(encoded, ":")
-	if len(parts) != 2 {
-		return false
-	}
-
-	salt, err := base64.StdEncoding.DecodeString(parts[0])
+	params, salt, hash, err := decodePasswordHash(encoded)
 	if err != nil {
 		return false
 	}
 
-	hash, err := base64.StdEncoding.DecodeString(parts[1])
+	testHash := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, params.keyLen)
+	return subtle.ConstantTimeCompare(hash, testHash) == 1
+}
+
+// NeedsRehash reports whether encoded was hashed with different Argon2id
+// parameters than ess.argon2Params currently calls for (including the
+// legacy pre-PHC format, which always needs rehashing), so a successful
+// login can transparently upgrade it in place.
+func (ess *EnhancedSecurityService) NeedsRehash(encoded string) bool {
+	params, _, _, err := decodePasswordHash(encoded)
 	if err != nil {
-		return false
+		return true
 	}
-
-	testHash := argon2.IDKey([]byte(password), salt, 1, 64*1024, 4, 32)
-
-	return subtle.ConstantTimeCompare(hash, testHash) == 1
+	return params != ess.argon2Params
 }
 
 func (ess *EnhancedSecurityService) validatePasswordStrength(password string) []string {
@@ -1137,58 +1488,50 @@ func (ess *EnhancedSecurityService) validatePasswordStrength(password string) []
 		errors = append(errors, "Password must contain at least one special character")
 	}
 
-	// Check against common passwords
-	commonPasswords := []string{"password", "123456", "password123", "admin", "qwerty"}
-	passwordLower := strings.ToLower(password)
-	for _, common := range commonPasswords {
-		if passwordLower == common {
-			errors = append(errors, "Password is too common")
-			break
-		}
+	if isCommonPassword(password) {
+		errors = append(errors, "Password is too common")
 	}
 
-	return errors
-}
+	if ess.config.EnableEntropyCheck {
+		score, crackTime := estimatePasswordStrength(password)
+		if score < ess.config.MinPasswordScore {
+			errors = append(errors, fmt.Sprintf("Password is too weak (estimated crack time: %s)", crackTime))
+		}
+	}
 
-// RSA Encryption for additional sensitive data protection
-func (ess *EnhancedSecurityService) encryptWithRSA(data string) (string, error) {
-	encrypted, err := rsa.EncryptPKCS1v15(rand.Reader, ess.publicKey, []byte(data))
-	if err != nil {
-		return "", err
+	if ess.config.EnableBreachCheck && ess.breachCheck != nil {
+		breached, err := ess.breachCheck.IsBreached(password)
+		if err != nil {
+			log.Printf("⚠️  breach check unavailable, allowing password to pass this check: %v", err)
+		} else if breached {
+			errors = append(errors, "Password has appeared in a known data breach")
+		}
 	}
-	return base64.StdEncoding.EncodeToString(encrypted), nil
+
+	return errors
 }
 
-func (ess *EnhancedSecurityService) decryptWithRSA(encryptedData string) (string, error) {
-	data, err := base64.StdEncoding.DecodeString(encryptedData)
+// getPublicKeyPEM returns the active keystore key's public half in PEM, for
+// client-side encryption.
+func (ess *EnhancedSecurityService) getPublicKeyPEM() string {
+	_, _, pub, err := ess.keystore.ActiveKey()
 	if err != nil {
-		return "", err
+		return ""
 	}
-
-	decrypted, err := rsa.DecryptPKCS1v15(rand.Reader, ess.privateKey, data)
+	pubKeyBytes, err := x509.MarshalPKIXPublicKey(pub)
 	if err != nil {
-		return "", err
+		return ""
 	}
-
-	return string(decrypted), nil
-}
-
-// Export public key for client-side encryption
-func (ess *EnhancedSecurityService) getPublicKeyPEM() string {
-	pubKeyBytes, _ := x509.MarshalPKIXPublicKey(ess.publicKey)
-	pubKeyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "PUBLIC KEY",
-		Bytes: pubKeyBytes,
-	})
-	return string(pubKeyPEM)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubKeyBytes}))
 }
 
 // NewSecurityMonitor creates a new security monitor instance
-func NewSecurityMonitor(db *sql.DB) *SecurityMonitor {
+func NewSecurityMonitor(db *sql.DB, auditChain *AuditChain) *SecurityMonitor {
 	sm := &SecurityMonitor{
-		db:        db,
-		clients:   make(map[*websocket.Conn]bool),
-		broadcast: make(chan SecurityAlert),
+		db:         db,
+		auditChain: auditChain,
+		wsHub:      newWSHub(),
+		broadcast:  make(chan SecurityAlert),
 		alertThresholds: map[string]int{
 			"failed_logins":    10,
 			"blocked_ips":      5,
@@ -1198,6 +1541,26 @@ func NewSecurityMonitor(db *sql.DB) *SecurityMonitor {
 		metrics: &SecurityMetrics{},
 	}
 
+	sm.elector = NewLeaderElector(db, "security_monitor")
+	sm.elector.Start()
+	sm.cti = newCTIEnricherFromEnv()
+
+	sm.blockStore = NewBlockStore(db)
+	sm.blockStore.Start(sm.elector.IsLeader)
+	sm.apiKeys = NewAPIKeyStore(db)
+
+	sources := newThreatFeedSourcesFromEnv()
+	if len(sources) > 0 {
+		sm.threatFeed = NewThreatFeedClient(db, sources, threatFeedPullIntervalFromEnv())
+		sm.threatFeed.SetLeaderCheck(sm.elector.IsLeader)
+		sm.threatFeed.Start()
+	}
+
+	if alertSinks := newAlertSinksFromEnv(); len(alertSinks) > 0 {
+		sm.alertDispatcher = NewAlertDispatcher(db, sm, alertSinks, newAlertRoutesFromEnv(alertSinks))
+		sm.alertDispatcher.Start(30 * time.Second)
+	}
+
 	// Start background monitoring
 	go sm.monitorSecurityEvents()
 	go sm.handleWebSocketBroadcast()
@@ -1206,8 +1569,14 @@ func NewSecurityMonitor(db *sql.DB) *SecurityMonitor {
 	return sm
 }
 
-// WebSocket handler for real-time security monitoring
+// WebSocket handler for real-time security monitoring. wsDashboardAuthMiddleware
+// runs before this and sets "dashboard_role" in the context; by the time a
+// connection reaches here it's already a resolved admin/viewer/bouncer. A
+// reconnecting dashboard can pass ?last_event_id=<id> to replay whatever
+// alerts it missed from sm.wsHub's ring buffer.
 func (sm *SecurityMonitor) handleWebSocket(c *gin.Context) {
+	role := c.GetString("dashboard_role")
+
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		log.Printf("WebSocket upgrade error: %v", err)
@@ -1215,29 +1584,51 @@ func (sm *SecurityMonitor) handleWebSocket(c *gin.Context) {
 	}
 	defer conn.Close()
 
-	sm.mutex.Lock()
-	sm.clients[conn] = true
-	sm.mutex.Unlock()
+	client := newWSClient(conn, role)
+	client.subs = []wsSubscription{{topic: "alerts", kind: "alerts"}} // firehose by default until the client narrows it
+	sm.wsHub.register(client)
+	defer sm.wsHub.unregister(client)
+
+	go client.writePump()
+
+	conn.SetReadDeadline(time.Now().Add(wsIdleTimeout))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(wsIdleTimeout))
+		return nil
+	})
+
+	sm.sendMetricsToClient(client)
 
-	// Send current metrics to new client
-	sm.sendMetricsToClient(conn)
+	if lastEventID, err := strconv.ParseUint(c.Query("last_event_id"), 10, 64); err == nil {
+		sm.wsHub.Replay(client, lastEventID)
+	}
 
-	// Handle client messages (for acknowledgments, etc.)
 	for {
 		var msg map[string]interface{}
-		err := conn.ReadJSON(&msg)
-		if err != nil {
-			sm.mutex.Lock()
-			delete(sm.clients, conn)
-			sm.mutex.Unlock()
+		if err := conn.ReadJSON(&msg); err != nil {
 			break
 		}
-
-		// Handle client messages (acknowledge alerts, etc.)
-		sm.handleClientMessage(msg, conn)
+		sm.handleClientMessage(msg, client)
 	}
 }
 
+// issueWSTicketHandler mints a short-lived, single-use ticket for the
+// /ws/security upgrade. A browser WebSocket constructor can't set an
+// Authorization header, so the dashboard calls this over a normal
+// authenticated REST request first and passes the returned ticket back as
+// the "ticket" query parameter instead.
+func (sm *SecurityMonitor) issueWSTicketHandler(c *gin.Context) {
+	scopes, _ := c.Get("scopes")
+	scopeList, _ := scopes.([]string)
+	role := dashboardRoleFromScopes(scopeList)
+
+	ticket := sm.wsHub.tickets.Issue(role)
+	c.JSON(http.StatusOK, gin.H{
+		"ticket":             ticket,
+		"expires_in_seconds": int(wsTicketTTL.Seconds()),
+	})
+}
+
 // Security Dashboard API endpoint
 func (sm *SecurityMonitor) getDashboardData(c *gin.Context) {
 	data := &SecurityDashboardData{
@@ -1405,6 +1796,17 @@ func (sm *SecurityMonitor) getDetailedMetrics() map[string]interface{} {
 		detailed["geographic_threats"] = geoThreats
 	}
 
+	// CTI enrichment summary
+	if sm.cti != nil {
+		var enrichedEvents24h, ctiBlockedIPs int
+		sm.db.QueryRow("SELECT COUNT(*) FROM security_events WHERE cti_score IS NOT NULL AND created_at > DATE_SUB(NOW(), INTERVAL 24 HOUR)").Scan(&enrichedEvents24h)
+		sm.db.QueryRow("SELECT COUNT(*) FROM ip_reputation WHERE is_blocked = true AND cti_score IS NOT NULL").Scan(&ctiBlockedIPs)
+		detailed["cti"] = map[string]interface{}{
+			"enriched_events_24h": enrichedEvents24h,
+			"cti_blocked_ips":     ctiBlockedIPs,
+		}
+	}
+
 	return detailed
 }
 
@@ -1628,7 +2030,11 @@ func (sm *SecurityMonitor) monitorSecurityEvents() {
 	for {
 		select {
 		case <-ticker.C:
-			sm.checkForNewAlerts()
+			// Only the elected leader scans for new alerts; every replica
+			// still serves WebSocket clients and dashboard reads.
+			if sm.elector == nil || sm.elector.IsLeader() {
+				sm.checkForNewAlerts()
+			}
 		}
 	}
 }
@@ -1677,6 +2083,19 @@ func (sm *SecurityMonitor) checkForNewAlerts() {
 		case sm.broadcast <- alert:
 		default:
 		}
+
+		if sm.cti != nil && alert.IPAddress != "" {
+			if cti, err := sm.cti.Lookup(alert.IPAddress); err == nil && sm.cti.ShouldAutoBlock(cti) {
+				sm.blockIP(alert.IPAddress, fmt.Sprintf("CTI auto-block: score %d from %s", cti.Score, cti.Source), "cti")
+			}
+		}
+
+		if sm.threatFeed != nil && alert.Severity == "critical" {
+			sm.threatFeed.QueuePush(alert)
+		}
+		if sm.alertDispatcher != nil {
+			sm.alertDispatcher.Dispatch(alert)
+		}
 	}
 }
 
@@ -1684,18 +2103,7 @@ func (sm *SecurityMonitor) checkForNewAlerts() {
 func (sm *SecurityMonitor) handleWebSocketBroadcast() {
 	for {
 		alert := <-sm.broadcast
-		sm.mutex.RLock()
-		for client := range sm.clients {
-			err := client.WriteJSON(map[string]interface{}{
-				"type": "security_alert",
-				"data": alert,
-			})
-			if err != nil {
-				client.Close()
-				delete(sm.clients, client)
-			}
-		}
-		sm.mutex.RUnlock()
+		sm.wsHub.BroadcastAlert(alert)
 	}
 }
 
@@ -1707,45 +2115,67 @@ func (sm *SecurityMonitor) updateMetricsPeriodically() {
 	for {
 		select {
 		case <-ticker.C:
+			// websocketClients is per-instance (each replica has its own
+			// connected clients), so it's refreshed regardless of leadership;
+			// everything else below is a shared DB aggregate, so only the
+			// leader recomputes it to avoid two replicas double-counting the
+			// same window.
+			websocketClients.Set(float64(sm.wsHub.ClientCount()))
+
+			if sm.elector != nil && !sm.elector.IsLeader() {
+				continue
+			}
 			metrics := sm.getSecurityMetrics()
 			sm.broadcastMetricsUpdate(metrics)
+			sm.refreshPrometheusMetrics(metrics)
 		}
 	}
 }
 
 // Broadcast metrics update to all clients
 func (sm *SecurityMonitor) broadcastMetricsUpdate(metrics *SecurityMetrics) {
-	sm.mutex.RLock()
-	defer sm.mutex.RUnlock()
-
-	for client := range sm.clients {
-		err := client.WriteJSON(map[string]interface{}{
-			"type": "metrics_update",
-			"data": metrics,
-		})
-		if err != nil {
-			client.Close()
-			delete(sm.clients, client)
-		}
-	}
+	sm.wsHub.BroadcastMetrics("metrics_update", metrics)
 }
 
 // Send current metrics to a specific client
-func (sm *SecurityMonitor) sendMetricsToClient(conn *websocket.Conn) {
+func (sm *SecurityMonitor) sendMetricsToClient(client *wsClient) {
 	metrics := sm.getSecurityMetrics()
-	conn.WriteJSON(map[string]interface{}{
+	payload, err := json.Marshal(map[string]interface{}{
 		"type": "initial_metrics",
 		"data": metrics,
 	})
+	if err != nil {
+		return
+	}
+	client.enqueue(payload)
 }
 
 // Handle client messages
-func (sm *SecurityMonitor) handleClientMessage(msg map[string]interface{}, conn *websocket.Conn) {
+func (sm *SecurityMonitor) handleClientMessage(msg map[string]interface{}, client *wsClient) {
 	msgType, ok := msg["type"].(string)
 	if !ok {
 		return
 	}
 
+	if msgType == "subscribe" || msgType == "unsubscribe" {
+		topic, _ := msg["topic"].(string)
+		if msgType == "subscribe" {
+			if err := client.subscribe(topic); err != nil {
+				errPayload, _ := json.Marshal(map[string]interface{}{"type": "error", "message": err.Error()})
+				client.enqueue(errPayload)
+			}
+		} else {
+			client.unsubscribe(topic)
+		}
+		return
+	}
+
+	if !wsMessageAllowed(client.role, msgType) {
+		payload, _ := json.Marshal(map[string]interface{}{"type": "error", "message": "role does not permit this action"})
+		client.enqueue(payload)
+		return
+	}
+
 	switch msgType {
 	case "acknowledge_alert":
 		if alertID, ok := msg["alert_id"].(string); ok {
@@ -1757,7 +2187,7 @@ func (sm *SecurityMonitor) handleClientMessage(msg map[string]interface{}, conn
 		}
 	case "block_ip":
 		if ip, ok := msg["ip_address"].(string); ok {
-			sm.blockIP(ip, "Manual block from security dashboard")
+			sm.blockIP(ip, "Manual block from security dashboard", "manual")
 		}
 	case "unblock_ip":
 		if ip, ok := msg["ip_address"].(string); ok {
@@ -1771,6 +2201,10 @@ func (sm *SecurityMonitor) acknowledgeAlert(alertID string) {
 	_, err := sm.db.Exec("UPDATE security_events SET resolved = true WHERE id = ?", alertID)
 	if err != nil {
 		log.Printf("Error acknowledging alert: %v", err)
+		return
+	}
+	if sm.alertDispatcher != nil {
+		sm.alertDispatcher.Resolve(alertID)
 	}
 }
 
@@ -1779,29 +2213,65 @@ func (sm *SecurityMonitor) resolveAlert(alertID string) {
 	_, err := sm.db.Exec("UPDATE security_events SET resolved = true, resolved_at = NOW() WHERE id = ?", alertID)
 	if err != nil {
 		log.Printf("Error resolving alert: %v", err)
+		return
 	}
+	if sm.alertDispatcher != nil {
+		sm.alertDispatcher.Resolve(alertID)
+	}
+}
+
+// Block IP address for the default duration, attributed to source (manual,
+// cti, or rule). If a CTI provider is configured, this decision is enriched
+// with its reputation data (score/categories/source) so the block reason on
+// ip_reputation carries the same context an operator sees on the dashboard,
+// not just whatever free-text reason the caller passed.
+func (sm *SecurityMonitor) blockIP(ip, reason, source string) {
+	sm.blockIPFor(ip, reason, source, defaultBlockDuration)
 }
 
-// Block IP address
-func (sm *SecurityMonitor) blockIP(ip, reason string) {
+// blockIPFor is blockIP with an explicit duration, used by blockIPEndpoint
+// when the caller specifies one.
+func (sm *SecurityMonitor) blockIPFor(ip, reason, source string, duration time.Duration) {
+	sm.ipIntel.Enqueue(ip)
+
+	var ctiScore *int
+	var ctiCategories, ctiSource string
+	if sm.cti != nil && ip != "" {
+		if cti, err := sm.cti.Lookup(ip); err == nil {
+			score := cti.Score
+			ctiScore = &score
+			ctiCategories = strings.Join(cti.Categories, ",")
+			ctiSource = cti.Source
+		}
+	}
+
 	_, err := sm.db.Exec(`
-		INSERT INTO ip_reputation (ip_address, reputation_score, is_blocked, block_reason, blocked_until)
-		VALUES (?, 0, true, ?, DATE_ADD(NOW(), INTERVAL 24 HOUR))
+		INSERT INTO ip_reputation (ip_address, reputation_score, is_blocked, block_reason, blocked_until, cti_score, cti_categories, cti_source)
+		VALUES (?, 0, true, ?, DATE_ADD(NOW(), INTERVAL ? SECOND), ?, ?, ?)
 		ON DUPLICATE KEY UPDATE
 			is_blocked = true,
 			block_reason = ?,
-			blocked_until = DATE_ADD(NOW(), INTERVAL 24 HOUR)
-	`, ip, reason, reason)
+			blocked_until = DATE_ADD(NOW(), INTERVAL ? SECOND),
+			cti_score = VALUES(cti_score),
+			cti_categories = VALUES(cti_categories),
+			cti_source = VALUES(cti_source)
+	`, ip, reason, duration.Seconds(), ctiScore, nullableString(ctiCategories), nullableString(ctiSource), reason, duration.Seconds())
 
 	if err != nil {
 		log.Printf("Error blocking IP: %v", err)
 	}
+
+	if sm.blockStore != nil {
+		if _, err := sm.blockStore.Block(ip, "ip", reason, source, duration); err != nil {
+			log.Printf("Error registering IP block in block store: %v", err)
+		}
+	}
 }
 
 // Unblock IP address
 func (sm *SecurityMonitor) unblockIP(ip string) {
 	_, err := sm.db.Exec(`
-		UPDATE ip_reputation 
+		UPDATE ip_reputation
 		SET is_blocked = false, blocked_until = NULL, reputation_score = 50
 		WHERE ip_address = ?
 	`, ip)
@@ -1809,6 +2279,12 @@ func (sm *SecurityMonitor) unblockIP(ip string) {
 	if err != nil {
 		log.Printf("Error unblocking IP: %v", err)
 	}
+
+	if sm.blockStore != nil {
+		if err := sm.blockStore.Unblock(ip, "ip"); err != nil {
+			log.Printf("Error removing IP block from block store: %v", err)
+		}
+	}
 }
 
 // Generate alert title based on type and severity
@@ -1846,29 +2322,35 @@ func (sm *SecurityMonitor) generateAlertTitle(eventType, severity string) string
 }
 
 // API endpoints for security management
+// getSecurityEvents lists security_events newest-first using (created_at, id)
+// keyset pagination instead of OFFSET/LIMIT, which degrades badly once a
+// deployment has accumulated more than a few thousand events: OFFSET still
+// has to scan and discard every skipped row. Callers page forward by passing
+// the opaque next_cursor token back as the cursor query param.
 func (sm *SecurityMonitor) getSecurityEvents(c *gin.Context) {
-	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
 	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
-	severity := c.Query("severity")
-	eventType := c.Query("type")
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
 
-	offset := (page - 1) * limit
+	filter := securityEventsFilterFromQuery(c)
 
 	query := "SELECT id, event_type, severity, description, user_id, ip_address, location, created_at FROM security_events WHERE 1=1"
 	args := []interface{}{}
+	query, args = filter.apply(query, args)
 
-	if severity != "" {
-		query += " AND severity = ?"
-		args = append(args, severity)
-	}
-
-	if eventType != "" {
-		query += " AND event_type = ?"
-		args = append(args, eventType)
+	if cursorToken := c.Query("cursor"); cursorToken != "" {
+		cursor, err := decodeEventsCursor(cursorToken)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor"})
+			return
+		}
+		query += " AND (created_at, id) < (?, ?)"
+		args = append(args, cursor.CreatedAt, cursor.ID)
 	}
 
-	query += " ORDER BY created_at DESC LIMIT ? OFFSET ?"
-	args = append(args, limit, offset)
+	query += " ORDER BY created_at DESC, id DESC LIMIT ?"
+	args = append(args, limit+1) // fetch one extra row to know whether another page follows
 
 	rows, err := sm.db.Query(query, args...)
 	if err != nil {
@@ -1878,36 +2360,68 @@ func (sm *SecurityMonitor) getSecurityEvents(c *gin.Context) {
 	defer rows.Close()
 
 	var events []SecurityAlert
+	var lastID int64
+	var lastCreatedAt time.Time
 	for rows.Next() {
-		var event SecurityAlert
-		var userID sql.NullInt64
-		var location sql.NullString
-
-		err := rows.Scan(&event.ID, &event.Type, &event.Severity, &event.Description,
-			&userID, &event.IPAddress, &location, &event.Timestamp)
+		event, id, err := scanSecurityEvent(rows, sm.keystore)
 		if err != nil {
 			continue
 		}
-
-		if userID.Valid {
-			uid := int(userID.Int64)
-			event.UserID = &uid
-		}
-		if location.Valid {
-			event.Location = location.String
-		}
-
 		event.Title = sm.generateAlertTitle(event.Type, event.Severity)
 		events = append(events, event)
+		// The cursor marks the last row returned, not the extra lookahead
+		// row, so the next page starts with that lookahead row.
+		if len(events) <= limit {
+			lastID = id
+			lastCreatedAt = event.Timestamp
+		}
+	}
+
+	var nextCursor string
+	if len(events) > limit {
+		events = events[:limit]
+		nextCursor = encodeEventsCursor(eventsCursor{CreatedAt: lastCreatedAt, ID: lastID})
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"events": events,
-		"page":   page,
-		"limit":  limit,
+		"events":      events,
+		"limit":       limit,
+		"next_cursor": nextCursor,
 	})
 }
 
+// scanSecurityEvent reads one row of the id/event_type/severity/description/
+// user_id/ip_address/location/created_at shape shared by getSecurityEvents
+// and the NDJSON/CSV export, returning the raw numeric id alongside the
+// SecurityAlert (whose ID field is the string form used everywhere else).
+// description is decrypted via ks if it was stored as a sensitiveEnvelope
+// (see logSecurityEvent); ks may be nil, in which case rows pass through
+// unchanged exactly as decryptColumnValue would leave them.
+func scanSecurityEvent(rows *sql.Rows, ks *KeyStore) (SecurityAlert, int64, error) {
+	var event SecurityAlert
+	var id int64
+	var userID sql.NullInt64
+	var location sql.NullString
+
+	err := rows.Scan(&id, &event.Type, &event.Severity, &event.Description,
+		&userID, &event.IPAddress, &location, &event.Timestamp)
+	if err != nil {
+		return SecurityAlert{}, 0, err
+	}
+
+	event.ID = strconv.FormatInt(id, 10)
+	event.Description = decryptColumnValue(ks, event.Description)
+	if userID.Valid {
+		uid := int(userID.Int64)
+		event.UserID = &uid
+	}
+	if location.Valid {
+		event.Location = location.String
+	}
+
+	return event, id, nil
+}
+
 // Get user risk profile
 func (sm *SecurityMonitor) getUserRiskProfile(c *gin.Context) {
 	userIDStr := c.Param("user_id")
@@ -1938,10 +2452,26 @@ func (sm *SecurityMonitor) getUserRiskProfile(c *gin.Context) {
 	// Get user devices
 	devices := sm.getUserDevices(userID)
 
+	// Incorporate CTI reputation for the user's most recent IP into the
+	// displayed risk: a clean behavioral score from an IP a CTI feed already
+	// flags as a known scanner/brute-forcer is a misleadingly low number.
+	ctiAdjustedScore := riskScore.CurrentScore
+	var cti *CTIResult
+	if sm.cti != nil && len(events) > 0 && events[0].IPAddress != "" {
+		if result, err := sm.cti.Lookup(events[0].IPAddress); err == nil {
+			cti = result
+			if cti.Score > ctiAdjustedScore {
+				ctiAdjustedScore = cti.Score
+			}
+		}
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"risk_score":      riskScore,
-		"recent_events":   events,
-		"trusted_devices": devices,
+		"risk_score":         riskScore,
+		"recent_events":      events,
+		"trusted_devices":    devices,
+		"cti":                cti,
+		"cti_adjusted_score": ctiAdjustedScore,
 	})
 }
 
@@ -1972,6 +2502,7 @@ func (sm *SecurityMonitor) getUserSecurityEvents(userID, limit int) []SecurityAl
 			continue
 		}
 
+		event.Description = decryptColumnValue(sm.keystore, event.Description)
 		if location.Valid {
 			event.Location = location.String
 		}
@@ -1987,9 +2518,10 @@ func (sm *SecurityMonitor) getUserSecurityEvents(userID, limit int) []SecurityAl
 // Get user devices
 func (sm *SecurityMonitor) getUserDevices(userID int) []DeviceFingerprint {
 	query := `
-		SELECT id, user_id, device_id, device_info, ip_address, location, 
-			   is_trusted, last_seen, created_at
-		FROM device_fingerprints 
+		SELECT id, user_id, device_id, fingerprint, device_info, user_agent, accept_language,
+			   client_hints, canvas_hash, webgl_hash, ja3_hash, asn, ip_address, location,
+			   latitude, longitude, is_trusted, last_seen, created_at
+		FROM device_fingerprints
 		WHERE user_id = ?
 		ORDER BY last_seen DESC
 	`
@@ -2003,17 +2535,27 @@ func (sm *SecurityMonitor) getUserDevices(userID int) []DeviceFingerprint {
 	var devices []DeviceFingerprint
 	for rows.Next() {
 		var device DeviceFingerprint
-		var location sql.NullString
+		var location, userAgent, acceptLanguage, clientHints, canvasHash, webglHash, ja3Hash, asn sql.NullString
 
-		err := rows.Scan(&device.ID, &device.UserID, &device.DeviceID, &device.DeviceInfo,
-			&device.IPAddress, &location, &device.IsTrusted, &device.LastSeen, &device.CreatedAt)
+		err := rows.Scan(&device.ID, &device.UserID, &device.DeviceID, &device.Fingerprint, &device.DeviceInfo,
+			&userAgent, &acceptLanguage, &clientHints, &canvasHash, &webglHash, &ja3Hash, &asn,
+			&device.IPAddress, &location, &device.Latitude, &device.Longitude,
+			&device.IsTrusted, &device.LastSeen, &device.CreatedAt)
 		if err != nil {
 			continue
 		}
 
+		device.DeviceInfo = decryptColumnValue(sm.keystore, device.DeviceInfo)
 		if location.Valid {
 			device.Location = location.String
 		}
+		device.UserAgent = userAgent.String
+		device.AcceptLanguage = acceptLanguage.String
+		device.ClientHints = clientHints.String
+		device.CanvasHash = canvasHash.String
+		device.WebGLHash = webglHash.String
+		device.JA3Hash = ja3Hash.String
+		device.ASN = asn.String
 
 		devices = append(devices, device)
 	}
@@ -2021,56 +2563,469 @@ func (sm *SecurityMonitor) getUserDevices(userID int) []DeviceFingerprint {
 	return devices
 }
 
-// Setup security monitoring routes
+// Setup security monitoring routes. The /ws/security WebSocket endpoint is
+// registered separately by setupSecureRoutes, which wires it through
+// wsDashboardAuthMiddleware instead of securityAuthMiddleware used here.
+// Every route requires a JWT or API key carrying the listed scope (or the
+// blanket security:admin scope), see rbac.go, so holding any valid token no
+// longer lets a caller block IPs or resolve alerts.
 func (sm *SecurityMonitor) SetupRoutes(r *gin.Engine, config *Config) {
-	// WebSocket endpoint for real-time monitoring
-	r.GET("/ws/security", sm.handleWebSocket)
-
 	// API endpoints
 	api := r.Group("/api/v1/security")
-	api.Use(authMiddleware(config)) // Require authentication
+	api.Use(securityAuthMiddleware(config, sm.apiKeys))
+
+	api.GET("/dashboard", RequireScope(ScopeSecurityRead), sm.getDashboardData)
+	api.GET("/events", RequireScope(ScopeSecurityEventsRead), sm.getSecurityEvents)
+	api.GET("/events/export", RequireScope(ScopeSecurityEventsRead), sm.exportSecurityEvents)
+	api.GET("/users/:user_id/risk", RequireScope(ScopeSecurityRead), sm.getUserRiskProfile)
+	api.POST("/users/:user_id/devices/:device_id/trust", RequireScope(ScopeSecurityDevicesWrite), sm.trustDeviceEndpoint)
+	api.POST("/users/:user_id/devices/:device_id/untrust", RequireScope(ScopeSecurityDevicesWrite), sm.untrustDeviceEndpoint)
+	api.POST("/alerts/:alert_id/acknowledge", RequireScope(ScopeSecurityAlertsWrite), sm.acknowledgeAlertEndpoint)
+	api.POST("/alerts/:alert_id/resolve", RequireScope(ScopeSecurityAlertsWrite), sm.resolveAlertEndpoint)
+	api.POST("/alerts/:alert_id/dispatch", RequireScope(ScopeSecurityAdmin), sm.dispatchAlertEndpoint)
+	api.POST("/alerts/:alert_id/reverse-transaction", RequireScope(ScopeSecurityAdmin), sm.reverseTransactionEndpoint)
+	api.POST("/alerts/bulk", RequireScope(ScopeSecurityAlertsWrite), sm.bulkIngestAlertsHandler)
+	api.DELETE("/alerts", RequireScope(ScopeSecurityAdmin), sm.deleteAlertsHandler)
+	api.POST("/ips/:ip/block", RequireScope(ScopeSecurityIPsWrite), sm.blockIPEndpoint)
+	api.DELETE("/ips/:ip/block", RequireScope(ScopeSecurityIPsWrite), sm.unblockIPEndpoint)
+	api.GET("/blocklist", RequireScope(ScopeSecurityRead), sm.blocklistHandler)
+	api.GET("/ips/:ip", RequireScope(ScopeSecurityRead), sm.ipReputationDetailHandler)
+	api.POST("/sinks/test", RequireScope(ScopeSecurityAdmin), sm.testAlertSinksHandler)
+	api.POST("/threatintel/refresh", RequireScope(ScopeSecurityAdmin), sm.refreshThreatIntelHandler)
+	api.GET("/audit", RequireScope(ScopeSecurityAdmin), sm.auditLogHandler)
+	api.POST("/ws/ticket", RequireScope(ScopeSecurityRead), sm.issueWSTicketHandler)
+	api.POST("/api-keys", RequireScope(ScopeSecurityAdmin), sm.createAPIKeyHandler)
+	api.GET("/api-keys", RequireScope(ScopeSecurityAdmin), sm.listAPIKeysHandler)
+	api.DELETE("/api-keys/:id", RequireScope(ScopeSecurityAdmin), sm.revokeAPIKeyHandler)
+}
+
+// alertState snapshots the resolved/resolved_at columns of a security_events
+// row, for the before/after values logAuditEvent records around an
+// acknowledge/resolve call.
+func (sm *SecurityMonitor) alertState(alertID string) map[string]interface{} {
+	var resolved bool
+	var resolvedAt sql.NullTime
+	if err := sm.db.QueryRow("SELECT resolved, resolved_at FROM security_events WHERE id = ?", alertID).Scan(&resolved, &resolvedAt); err != nil {
+		return map[string]interface{}{}
+	}
+	state := map[string]interface{}{"resolved": resolved}
+	if resolvedAt.Valid {
+		state["resolved_at"] = resolvedAt.Time
+	}
+	return state
+}
+
+// ipBlockState snapshots the is_blocked/blocked_until columns of an
+// ip_reputation row, for "ip" scope block/unblock audit entries. CIDR/ASN
+// bans have no equivalent single-row lookup, so their entries only carry the
+// new state.
+func (sm *SecurityMonitor) ipBlockState(ip string) map[string]interface{} {
+	var isBlocked bool
+	var blockedUntil sql.NullTime
+	if err := sm.db.QueryRow("SELECT is_blocked, blocked_until FROM ip_reputation WHERE ip_address = ?", ip).Scan(&isBlocked, &blockedUntil); err != nil {
+		return map[string]interface{}{"is_blocked": false}
+	}
+	state := map[string]interface{}{"is_blocked": isBlocked}
+	if blockedUntil.Valid {
+		state["blocked_until"] = blockedUntil.Time
+	}
+	return state
+}
+
+// logAuditEvent appends a who/when/route/target/before-after audit_trail row
+// for a mutating security-API call. It hash-chains through the same
+// AuditChain instance SecureTransactionHandler.logAuditEvent uses, so
+// audit_trail stays a single sequence no matter which handler wrote to it.
+func (sm *SecurityMonitor) logAuditEvent(c *gin.Context, action, resourceType, resourceID string, oldValues, newValues map[string]interface{}) {
+	if sm.auditChain == nil {
+		return
+	}
+
+	userID := c.GetInt("user_id")
+	actor := c.GetString("auth_subject")
+	oldJSON, _ := json.Marshal(oldValues)
+	newJSON, _ := json.Marshal(newValues)
+	ip := c.ClientIP()
+	userAgent := c.GetHeader("User-Agent")
+
+	prevHash, entryHash, err := sm.auditChain.Append("audit_trail", map[string]interface{}{
+		"user_id": userID, "action": action, "resource_type": resourceType, "resource_id": resourceID,
+		"old_values": string(oldJSON), "new_values": string(newJSON), "ip_address": ip,
+		"user_agent": userAgent, "session_id": actor,
+	})
+	if err != nil {
+		log.Printf("⚠️  Failed to chain audit event, logging without a hash: %v", err)
+	}
 
-	api.GET("/dashboard", sm.getDashboardData)
-	api.GET("/events", sm.getSecurityEvents)
-	api.GET("/users/:user_id/risk", sm.getUserRiskProfile)
-	api.POST("/alerts/:alert_id/acknowledge", sm.acknowledgeAlertEndpoint)
-	api.POST("/alerts/:alert_id/resolve", sm.resolveAlertEndpoint)
-	api.POST("/ips/:ip/block", sm.blockIPEndpoint)
-	api.DELETE("/ips/:ip/block", sm.unblockIPEndpoint)
+	_, err = sm.db.Exec(`
+		INSERT INTO audit_trail (user_id, action, resource_type, resource_id, old_values, new_values, ip_address, user_agent, session_id, prev_hash, entry_hash)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, userID, action, resourceType, resourceID, string(oldJSON), string(newJSON),
+		ip, userAgent, actor, prevHash, entryHash)
+	if err != nil {
+		log.Printf("Failed to log audit event: %v", err)
+	}
+}
+
+// auditLogHandler lists audit_trail rows, optionally filtered by actor (the
+// user:<id>/apikey:<name> subject logAuditEvent recorded in session_id) and a
+// [since, until) created_at window.
+func (sm *SecurityMonitor) auditLogHandler(c *gin.Context) {
+	query := `SELECT id, user_id, action, resource_type, resource_id, old_values, new_values, ip_address, user_agent, session_id, created_at FROM audit_trail WHERE 1=1`
+	var args []interface{}
+
+	if actor := c.Query("actor"); actor != "" {
+		query += " AND session_id = ?"
+		args = append(args, actor)
+	}
+	if since := c.Query("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "since must be RFC3339"})
+			return
+		}
+		query += " AND created_at >= ?"
+		args = append(args, t)
+	}
+	if until := c.Query("until"); until != "" {
+		t, err := time.Parse(time.RFC3339, until)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "until must be RFC3339"})
+			return
+		}
+		query += " AND created_at < ?"
+		args = append(args, t)
+	}
+	query += " ORDER BY created_at DESC LIMIT 500"
+
+	rows, err := sm.db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query audit trail"})
+		return
+	}
+	defer rows.Close()
+
+	var entries []map[string]interface{}
+	for rows.Next() {
+		var id int64
+		var userID sql.NullInt64
+		var action, resourceType, resourceID, oldValues, newValues, ipAddress, userAgent, sessionID string
+		var createdAt time.Time
+		if err := rows.Scan(&id, &userID, &action, &resourceType, &resourceID, &oldValues, &newValues, &ipAddress, &userAgent, &sessionID, &createdAt); err != nil {
+			continue
+		}
+		entries = append(entries, map[string]interface{}{
+			"id": id, "user_id": userID.Int64, "action": action, "resource_type": resourceType,
+			"resource_id": resourceID, "old_values": json.RawMessage(oldValues), "new_values": json.RawMessage(newValues),
+			"ip_address": ipAddress, "user_agent": userAgent, "actor": sessionID, "created_at": createdAt,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"entries": entries})
+}
+
+// createAPIKeyHandler mints a bootstrap API key for a machine client and
+// returns the raw value exactly once.
+func (sm *SecurityMonitor) createAPIKeyHandler(c *gin.Context) {
+	var req struct {
+		Name   string   `json:"name" binding:"required"`
+		Scopes []string `json:"scopes" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name and scopes are required"})
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !validSecurityScopes[scope] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown scope %q", scope)})
+			return
+		}
+	}
+
+	rawKey, err := sm.apiKeys.CreateAPIKey(req.Name, req.Scopes)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	sm.logAuditEvent(c, "create_api_key", "api_key", req.Name, nil, map[string]interface{}{"scopes": req.Scopes})
+
+	c.JSON(http.StatusCreated, gin.H{"key": rawKey, "message": "store this key now, it will not be shown again"})
+}
+
+// listAPIKeysHandler lists API keys by name/scopes/usage, never the raw key.
+func (sm *SecurityMonitor) listAPIKeysHandler(c *gin.Context) {
+	keys, err := sm.apiKeys.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list API keys"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+// revokeAPIKeyHandler disables an API key by id; the key can no longer
+// authenticate but its row is kept for audit history.
+func (sm *SecurityMonitor) revokeAPIKeyHandler(c *gin.Context) {
+	id := c.Param("id")
+	if err := sm.apiKeys.Revoke(id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke API key"})
+		return
+	}
+	sm.logAuditEvent(c, "revoke_api_key", "api_key", id, nil, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "revoked"})
 }
 
 // API endpoint handlers
 func (sm *SecurityMonitor) acknowledgeAlertEndpoint(c *gin.Context) {
 	alertID := c.Param("alert_id")
+	before := sm.alertState(alertID)
 	sm.acknowledgeAlert(alertID)
+	sm.logAuditEvent(c, "acknowledge_alert", "security_event", alertID, before, sm.alertState(alertID))
 	c.JSON(http.StatusOK, gin.H{"message": "Alert acknowledged"})
 }
 
 func (sm *SecurityMonitor) resolveAlertEndpoint(c *gin.Context) {
 	alertID := c.Param("alert_id")
+	before := sm.alertState(alertID)
 	sm.resolveAlert(alertID)
+	sm.logAuditEvent(c, "resolve_alert", "security_event", alertID, before, sm.alertState(alertID))
 	c.JSON(http.StatusOK, gin.H{"message": "Alert resolved"})
 }
 
+// loadAlertByID reconstructs a SecurityAlert from its security_events row,
+// the same columns retryDue's JOIN reads, for handlers (dispatchAlertEndpoint)
+// that need to re-deliver an already-recorded alert rather than a freshly
+// evaluated one.
+func (sm *SecurityMonitor) loadAlertByID(alertID string) (SecurityAlert, error) {
+	var (
+		alert    SecurityAlert
+		userID   sql.NullInt64
+		location sql.NullString
+	)
+	err := sm.db.QueryRow(`
+		SELECT id, event_type, severity, description, user_id, ip_address, location, created_at
+		FROM security_events WHERE id = ?
+	`, alertID).Scan(&alert.ID, &alert.Type, &alert.Severity, &alert.Description, &userID, &alert.IPAddress, &location, &alert.Timestamp)
+	if err != nil {
+		return SecurityAlert{}, err
+	}
+	if userID.Valid {
+		uid := int(userID.Int64)
+		alert.UserID = &uid
+	}
+	if location.Valid {
+		alert.Location = location.String
+	}
+	alert.Title = sm.generateAlertTitle(alert.Type, alert.Severity)
+	return alert, nil
+}
+
+// dispatchAlertEndpoint manually re-sends an existing alert to its configured
+// sinks, for an operator who wants to re-page on-call after missing the
+// original delivery (e.g. a sink was misconfigured at the time) without
+// waiting for retryDue's next pass.
+func (sm *SecurityMonitor) dispatchAlertEndpoint(c *gin.Context) {
+	if sm.alertDispatcher == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "no alert sinks are configured"})
+		return
+	}
+
+	alertID := c.Param("alert_id")
+	alert, err := sm.loadAlertByID(alertID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "alert not found"})
+		return
+	}
+
+	sm.alertDispatcher.Dispatch(alert)
+	sm.logAuditEvent(c, "dispatch_alert", "security_event", alertID, nil, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "alert dispatched", "alert_id": alertID})
+}
+
+// reverseTransactionRequest is the body of POST
+// /alerts/:alert_id/reverse-transaction: the alert that justifies the
+// reversal is the path parameter, the transaction it's about is named
+// explicitly rather than inferred, since security_events carries no
+// transaction_id column to join through.
+type reverseTransactionRequest struct {
+	TransactionID int64  `json:"transaction_id" binding:"required"`
+	Reason        string `json:"reason" binding:"required"`
+}
+
+// reverseTransactionEndpoint lets an operator compensate a fraud-flagged
+// payment or payout from the alert that flagged it, via RollbackTransaction's
+// compensating ledger entries rather than deleting or mutating the original
+// transaction. The alert_id is recorded on the audit_trail entry so the
+// reversal can always be traced back to the alert that justified it.
+func (sm *SecurityMonitor) reverseTransactionEndpoint(c *gin.Context) {
+	alertID := c.Param("alert_id")
+
+	var req reverseTransactionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	reversalID, err := RollbackTransaction(sm.db, req.TransactionID, req.Reason)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+
+	sm.logAuditEvent(c, "reverse_transaction", "transaction", strconv.FormatInt(req.TransactionID, 10), nil, map[string]interface{}{
+		"reversal_transaction_id": reversalID,
+		"alert_id":                alertID,
+		"reason":                  req.Reason,
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":                 "transaction reversed",
+		"original_transaction_id": req.TransactionID,
+		"reversal_transaction_id": reversalID,
+	})
+}
+
+// testAlertSinksHandler emits a synthetic alert through the dispatcher so an
+// operator configuring a new sink can confirm delivery without waiting for a
+// real security event. The synthetic alert isn't written to security_events,
+// so it won't appear in the dashboard timeline or survive past its first
+// retry attempt.
+func (sm *SecurityMonitor) testAlertSinksHandler(c *gin.Context) {
+	if sm.alertDispatcher == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "no alert sinks are configured"})
+		return
+	}
+
+	alert := SecurityAlert{
+		ID:          fmt.Sprintf("test-%d", time.Now().UnixNano()),
+		Type:        "sink_test",
+		Severity:    "low",
+		Title:       "Test Alert",
+		Description: "Synthetic alert dispatched via /api/v1/security/sinks/test to verify sink delivery",
+		Timestamp:   time.Now(),
+		Status:      "new",
+	}
+	sm.alertDispatcher.Dispatch(alert)
+
+	c.JSON(http.StatusOK, gin.H{"message": "test alert dispatched", "alert_id": alert.ID})
+}
+
+// refreshThreatIntelHandler triggers an immediate out-of-band poll of every
+// configured threat feed source instead of waiting for the next
+// pullInterval tick, for an operator who just added a source or wants to
+// confirm one is reachable.
+func (sm *SecurityMonitor) refreshThreatIntelHandler(c *gin.Context) {
+	if sm.threatFeed == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "no threat intel feed sources are configured"})
+		return
+	}
+	sm.threatFeed.PullTop()
+	c.JSON(http.StatusOK, gin.H{"message": "threat intel feeds refreshed"})
+}
+
+// blockIPEndpoint accepts a single IP, a CIDR range, or an ASN (scope "ip",
+// "cidr", or "asn", defaulting to "ip" for backward compatibility with
+// callers that only ever sent a bare address). "ip" scope bans still flow
+// through blockIPFor so they keep showing up in ip_reputation/the dashboard;
+// "cidr"/"asn" bans only exist in the block store.
 func (sm *SecurityMonitor) blockIPEndpoint(c *gin.Context) {
-	ip := c.Param("ip")
+	value := c.Param("ip")
 	var req struct {
-		Reason string `json:"reason"`
+		Reason   string `json:"reason"`
+		Duration string `json:"duration"` // Go duration string, e.g. "24h"; empty keeps defaultBlockDuration
+		Scope    string `json:"scope"`    // "ip" (default), "cidr", or "asn"
 	}
 	c.ShouldBindJSON(&req)
 
 	if req.Reason == "" {
 		req.Reason = "Manual block from API"
 	}
+	if req.Scope == "" {
+		req.Scope = "ip"
+	}
+	if !validBlockScopes[req.Scope] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "scope must be ip, cidr, or asn"})
+		return
+	}
+
+	duration := defaultBlockDuration
+	if req.Duration != "" {
+		parsed, err := time.ParseDuration(req.Duration)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid duration, expected a Go duration like 24h"})
+			return
+		}
+		duration = parsed
+	}
+
+	var before map[string]interface{}
+	if req.Scope == "ip" {
+		before = sm.ipBlockState(value)
+	}
+
+	if req.Scope == "ip" {
+		sm.blockIPFor(value, req.Reason, "manual", duration)
+	} else if sm.blockStore != nil {
+		if _, err := sm.blockStore.Block(value, req.Scope, req.Reason, "manual", duration); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
 
-	sm.blockIP(ip, req.Reason)
-	c.JSON(http.StatusOK, gin.H{"message": "IP blocked successfully"})
+	after := map[string]interface{}{"scope": req.Scope, "reason": req.Reason, "duration": duration.String()}
+	sm.logAuditEvent(c, "block_ip", "ip_block", value, before, after)
+
+	c.JSON(http.StatusOK, gin.H{"message": "blocked successfully"})
 }
 
+// unblockIPEndpoint removes a ban by value; ?scope=cidr|asn selects a
+// non-default scope since a DELETE body isn't always convenient for callers.
 func (sm *SecurityMonitor) unblockIPEndpoint(c *gin.Context) {
-	ip := c.Param("ip")
-	sm.unblockIP(ip)
-	c.JSON(http.StatusOK, gin.H{"message": "IP unblocked successfully"})
+	value := c.Param("ip")
+	scope := c.DefaultQuery("scope", "ip")
+	if !validBlockScopes[scope] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "scope must be ip, cidr, or asn"})
+		return
+	}
+
+	var before map[string]interface{}
+	if scope == "ip" {
+		before = sm.ipBlockState(value)
+	}
+
+	if scope == "ip" {
+		sm.unblockIP(value)
+	} else if sm.blockStore != nil {
+		if err := sm.blockStore.Unblock(value, scope); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	sm.logAuditEvent(c, "unblock_ip", "ip_block", value, before, map[string]interface{}{"scope": scope})
+
+	c.JSON(http.StatusOK, gin.H{"message": "unblocked successfully"})
+}
+
+// blocklistHandler exports the current ban set in a format an edge firewall
+// or CrowdSec-style bouncer can consume directly.
+func (sm *SecurityMonitor) blocklistHandler(c *gin.Context) {
+	if sm.blockStore == nil {
+		c.JSON(http.StatusOK, gin.H{"entries": []BlockEntry{}})
+		return
+	}
+
+	entries := sm.blockStore.Entries()
+	switch format := c.DefaultQuery("format", "json"); format {
+	case "json":
+		c.JSON(http.StatusOK, gin.H{"entries": entries})
+	case "plaintext":
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(renderBlocklistPlaintext(entries)))
+	case "mikrotik":
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(renderBlocklistMikrotik(entries)))
+	case "nftables":
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(renderBlocklistNftables(entries)))
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be plaintext, json, mikrotik, or nftables"})
+	}
 }
 
 // NewTransactionService creates a new transaction service
@@ -2163,31 +3118,139 @@ func (ts *TransactionService) GetTransactionHistory(userID, limit, offset int) (
 	return transactions, nil
 }
 
-// GetUserBalance retrieves the current balance for a user
+// GetUserBalance sums the user's ledger_entries (credits minus debits)
+// instead of re-deriving a sign from transactions.type, so a reversal's
+// compensating entries net out the original transaction automatically.
 func (ts *TransactionService) GetUserBalance(userID int) (float64, error) {
 	var balance float64
 	err := ts.db.QueryRow(`
-		SELECT COALESCE(SUM(CASE WHEN type = 'payment' THEN -amount ELSE amount END), 0) 
-		FROM transactions 
-		WHERE user_id = ? AND status = 'completed'
-	`, userID).Scan(&balance)
+		SELECT COALESCE(SUM(CASE WHEN direction = 'credit' THEN amount ELSE -amount END), 0)
+		FROM ledger_entries
+		WHERE account_id = ?
+	`, userAccount(userID)).Scan(&balance)
 
 	return balance, err
 }
 
 // NewSecureTransactionHandler creates a new secure transaction handler
 func NewSecureTransactionHandler(db *sql.DB, config *Config) *SecureTransactionHandler {
+	ca, err := NewCertificateAuthority(db)
+	if err != nil {
+		log.Printf("⚠️  mTLS certificate authority unavailable: %v", err)
+	}
+
+	setWebSocketOriginAllowlist(config.WSAllowedOrigins)
+
+	crl := newCRLFileWatcher(config.CRLFile)
+	crl.Start(5 * time.Minute)
+
+	ts := NewTransactionService(db, config)
+
+	tanService := NewTanService(db, newNotificationChannelsFromEnv())
+	tanStop := make(chan struct{})
+	tanService.StartSweep(tanSweepInterval, tanStop)
+
+	providers := newPaymentProvidersFromEnv(db)
+	providerRouter := NewProviderRouter(db, providers, newRoutingPolicyFromEnv(), tanService)
+	providerRouter.Start(1 * time.Minute)
+	providerRouter.StartThreeDSSweep(threeDSSweepInterval)
+	reconciliationJob := NewReconciliationJob(db, providers)
+	reconciliationJob.Start(reconciliationPollInterval)
+
+	reconciliationChore := NewReconciliationChore(db, providers)
+
+	webhooks := NewWebhookDispatcher(db)
+	webhooks.Start(1 * time.Minute)
+	providerRouter.SetWebhookDispatcher(webhooks)
+	reconciliationChore.SetWebhookDispatcher(webhooks)
+
+	reconciliationChore.Start(reconciliationChoreInterval)
+
+	invoices := NewInvoiceService(db, nil)
+
+	idempotency := &IdempotencyStore{db: db}
+	retryQueue := NewRetryQueue(db, providerRouter, idempotency)
+	retryQueue.Start(30 * time.Second)
+
+	auditChain := NewAuditChain(db, newAuditSinksFromEnv())
+	auditSigningKey, err := loadOrCreateAuditSigningKey(getEnv("AUDIT_SIGNING_KEY_FILE", ""))
+	if err != nil {
+		log.Printf("⚠️  audit export signing key unavailable: %v", err)
+	}
+	auditCheckpointEveryN, err := strconv.ParseInt(getEnv("AUDIT_CHECKPOINT_EVERY_N", "100"), 10, 64)
+	if err != nil {
+		auditCheckpointEveryN = 100
+	}
+	auditChain.EnableCheckpoints(auditSigningKey, auditCheckpointEveryN, 5*time.Minute)
+
+	sm := NewSecurityMonitor(db, auditChain)
+
+	ess := NewEnhancedSecurityService(db)
+	ess.ca = ca
+	ess.rateLimitTiers = config.RateLimitTiers
+	ess.threatFeed = sm.threatFeed
+	sm.repo = ess.repo
+	sm.keystore = ess.keystore
+	sm.ipIntel = ess.ipIntel
+
+	paymentVault := NewPaymentDataVault(db, NewLocalKEK(ess.keystore))
+
+	// Flow sessions default to an in-process store: the flash data they
+	// carry (e.g. a pending invoice id) only needs to survive the handful
+	// of requests between creating an invoice and polling it, not a
+	// process restart. Set FLOW_SESSION_STORE_DSN=redis://... to share
+	// them across instances once a Redis client is vendored (see
+	// newSessionProviderFromDSN).
+	flowSessions := NewSessionManager(newSessionProviderFromDSN(db, getEnv("FLOW_SESSION_STORE_DSN", "mem://")))
+
 	return &SecureTransactionHandler{
-		ts:     NewTransactionService(db, config),
-		ess:    NewEnhancedSecurityService(db),
-		sm:     NewSecurityMonitor(db),
-		config: config,
-		db:     db,
+		ts:                ts,
+		ess:               ess,
+		sm:                sm,
+		ca:                ca,
+		crl:               crl,
+		providerRouter:      providerRouter,
+		reconciliationJob:   reconciliationJob,
+		reconciliationChore: reconciliationChore,
+		invoices:            invoices,
+		config:              config,
+		db:                db,
+		idempotency:       idempotency,
+		retryQueue:        retryQueue,
+		auditChain:        auditChain,
+		auditSigningKey:   auditSigningKey,
+		keystore:          ess.keystore,
+		paymentVault:      paymentVault,
+		flowSessions:      flowSessions,
+		webhooks:          webhooks,
+
+		notificationService: NewNotificationService(db),
 	}
 }
 
 // Enhanced main function with comprehensive security
 func main() {
+	// cscli-style subcommands manage the mTLS certificate authority directly
+	// against the database, so an operator can enroll or revoke a bouncer/agent
+	// without either standing up a running server or hand-editing
+	// client_certificates. See cscli.go.
+	if len(os.Args) > 1 && os.Args[1] == "cscli" {
+		os.Exit(runCSCLI(os.Args[2:]))
+	}
+
+	// fraud test dry-runs a fraud_rules row against a hand-built TxContext
+	// without waiting for a live transaction to hit it. See fraud_cli.go.
+	if len(os.Args) > 1 && os.Args[1] == "fraud" {
+		os.Exit(runFraudCLI(os.Args[2:]))
+	}
+
+	// invoice runs the month-end billing pipeline (prepare/items/create)
+	// from a cron job instead of an authenticated admin HTTP call. See
+	// invoice_service.go.
+	if len(os.Args) > 1 && os.Args[1] == "invoice" {
+		os.Exit(runInvoiceCLI(os.Args[2:]))
+	}
+
 	log.Println("🔐 Starting Krili Secure Transaction Handler v2.0")
 	log.Println("🛡️  Enhanced Security Features:")
 	log.Println("   ✅ Multi-layer Authentication (JWT + MFA + Biometric)")
@@ -2206,8 +3269,9 @@ func main() {
 	log.Println("   ✅ Input Validation & Sanitization")
 	log.Println("   ✅ Audit Logging & Compliance")
 
-	// Load configuration
-	config := loadConfig()
+	// Load configuration, resolving JWTSecret/DBPassword through the
+	// configured SecretsProvider (env, Vault, or AWS Secrets Manager)
+	config := loadConfigWithSecrets()
 	log.Printf("📋 Configuration loaded from environment")
 
 	// Connect to database with enhanced security
@@ -2248,13 +3312,68 @@ func main() {
 	log.Printf("📊 Security Dashboard: https://localhost:%s/api/v1/security/dashboard", config.ServerPort)
 	log.Printf("🔍 Real-time Monitoring: wss://localhost:%s/ws/security", config.ServerPort)
 
+	// When MTLS_PORT is set alongside a server certificate, also run a second
+	// listener that requires a client certificate at the TLS handshake
+	// itself (RequireAndVerifyClientCert), for deployments that want the
+	// admin console and machine-to-machine endpoints unreachable without a
+	// cert even if a route's middleware were ever misconfigured. It serves
+	// the same router; per-route auth middleware still applies on top.
+	if config.MTLSPort != "" && config.TLSCertFile != "" && config.TLSKeyFile != "" && sth.ca != nil {
+		go func() {
+			mtlsServer := &http.Server{
+				Addr:      ":" + config.MTLSPort,
+				Handler:   r,
+				TLSConfig: sth.ca.tlsConfigRequireClientAuth(),
+			}
+			log.Printf("🔒 Dedicated mTLS-only listener enabled on port %s", config.MTLSPort)
+			if err := mtlsServer.ListenAndServeTLS(config.TLSCertFile, config.TLSKeyFile); err != nil {
+				log.Printf("⚠️  dedicated mTLS listener stopped: %v", err)
+			}
+		}()
+	}
+
+	// When a server certificate is configured, run with a TLS listener that
+	// accepts (but does not require at the socket level) client certificates,
+	// so /api/v1/security and /api/v1/agents can authenticate callers via
+	// mTLS while everything else keeps using JWT bearer tokens.
+	if config.TLSCertFile != "" && config.TLSKeyFile != "" && sth.ca != nil {
+		server := &http.Server{
+			Addr:      ":" + config.ServerPort,
+			Handler:   r,
+			TLSConfig: sth.ca.tlsConfigWithOptionalClientAuth(),
+		}
+		log.Printf("🔒 mTLS-capable TLS listener enabled")
+		if err := server.ListenAndServeTLS(config.TLSCertFile, config.TLSKeyFile); err != nil {
+			log.Fatalf("❌ Failed to start TLS server: %v", err)
+		}
+		return
+	}
+
 	if err := r.Run(":" + config.ServerPort); err != nil {
 		log.Fatalf("❌ Failed to start server: %v", err)
 	}
-}
+}
+
+// Enhanced database connection with SSL. When config.DBDSN carries a
+// "postgres://" or "sqlite://" prefix this picks the matching Dialect instead
+// of assuming MySQL, which is what lets the fraud rule engine, velocity
+// tracker and audit trail run against SQLite in tests without a live MySQL.
+func connectDBSecure(config *Config) (*sql.DB, error) {
+	if config.DBDSN != "" {
+		db, _, err := openWithDialect(config.DBDSN)
+		if err != nil {
+			return nil, err
+		}
+		if err = db.Ping(); err != nil {
+			return nil, err
+		}
+		db.SetMaxOpenConns(50)
+		db.SetMaxIdleConns(25)
+		db.SetConnMaxLifetime(5 * time.Minute)
+		db.SetConnMaxIdleTime(2 * time.Minute)
+		return db, nil
+	}
 
-// Enhanced database connection with SSL
-func connectDBSecure(config *Config) (*sql.DB, error) {
 	// Enhanced DSN with SSL and security parameters
 	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=True&loc=Local&tls=preferred&timeout=30s&readTimeout=30s&writeTimeout=30s",
 		config.DBUser, config.DBPassword, config.DBHost, config.DBPort, config.DBName)
@@ -2291,19 +3410,27 @@ func initializeTables(db *sql.DB) error {
 			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
 		)`,
 
-		// Transactions table
+		// Transactions table. Each row is a header for its ledger_entries
+		// (see ledger.go); the amount/type here are a convenience summary,
+		// not the source of truth for balances.
 		`CREATE TABLE IF NOT EXISTS transactions (
 			id INT AUTO_INCREMENT PRIMARY KEY,
 			user_id INT NOT NULL,
-			type ENUM('payment', 'payout') NOT NULL,
+			type ENUM('payment', 'payout', 'reversal') NOT NULL,
 			amount DECIMAL(10,2) NOT NULL,
 			description TEXT,
 			status ENUM('pending', 'completed', 'failed', 'cancelled') DEFAULT 'pending',
+			provider_id VARCHAR(50) NOT NULL DEFAULT 'mock',
+			provider_reference VARCHAR(255) NOT NULL DEFAULT '',
+			reconciliation_status ENUM('pending', 'matched', 'mismatched') NOT NULL DEFAULT 'pending',
+			idempotency_key VARCHAR(255),
+			reversed_transaction_id INT NULL,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
 			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
 			INDEX idx_user_created (user_id, created_at),
-			INDEX idx_status (status)
+			INDEX idx_status (status),
+			INDEX idx_provider_reference (provider_id, provider_reference)
 		)`,
 
 		// Security events table
@@ -2318,11 +3445,24 @@ func initializeTables(db *sql.DB) error {
 			location VARCHAR(100),
 			device_id VARCHAR(255),
 			resolved BOOLEAN DEFAULT FALSE,
+			prev_hash VARCHAR(64) NOT NULL DEFAULT '',
+			entry_hash VARCHAR(64) NOT NULL DEFAULT '',
+			metadata JSON,
+			dedup_key VARCHAR(255),
+			event_count INT NOT NULL DEFAULT 1,
+			source_machine VARCHAR(255),
+			scope ENUM('ip', 'range', 'user'),
+			simulated BOOLEAN DEFAULT FALSE,
+			cti_score INT,
+			cti_categories VARCHAR(255),
+			cti_confidence DOUBLE,
+			cti_source VARCHAR(64),
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL,
 			INDEX idx_user_event (user_id, event_type),
 			INDEX idx_severity_created (severity, created_at),
-			INDEX idx_created_at (created_at)
+			INDEX idx_created_at (created_at),
+			INDEX idx_dedup_key (dedup_key, created_at)
 		)`,
 	}
 
@@ -2352,6 +3492,162 @@ func initializeAllTables(db *sql.DB) error {
 		return fmt.Errorf("failed to initialize monitoring tables: %v", err)
 	}
 
+	log.Printf("📜 Initializing mTLS certificate tables...")
+	if err := initializeCertificateTables(db); err != nil {
+		return fmt.Errorf("failed to initialize certificate tables: %v", err)
+	}
+
+	log.Printf("🔑 Initializing 2FA recovery code table...")
+	if err := initializeRecoveryCodeTable(db); err != nil {
+		return fmt.Errorf("failed to initialize recovery code table: %v", err)
+	}
+
+	log.Printf("🏷️  Initializing service account tables...")
+	if err := initializeServiceAccountTables(db); err != nil {
+		return fmt.Errorf("failed to initialize service account tables: %v", err)
+	}
+
+	log.Printf("📐 Initializing approval rules tables...")
+	if err := initializeApprovalRuleTables(db); err != nil {
+		return fmt.Errorf("failed to initialize approval rules tables: %v", err)
+	}
+
+	log.Printf("🔁 Initializing idempotency and retry queue tables...")
+	if err := initializeIdempotencyTables(db); err != nil {
+		return fmt.Errorf("failed to initialize idempotency tables: %v", err)
+	}
+
+	log.Printf("⛓️  Initializing audit chain columns...")
+	if err := initializeAuditChainColumns(db); err != nil {
+		return fmt.Errorf("failed to initialize audit chain columns: %v", err)
+	}
+
+	log.Printf("💳 Initializing payment provider tables...")
+	if err := initializeProviderTables(db); err != nil {
+		return fmt.Errorf("failed to initialize payment provider tables: %v", err)
+	}
+
+	log.Printf("🌐 Initializing threat feed columns...")
+	if err := initializeThreatFeedColumns(db); err != nil {
+		return fmt.Errorf("failed to initialize threat feed columns: %v", err)
+	}
+
+	log.Printf("📣 Initializing alert delivery tables...")
+	if err := initializeAlertDeliveryTables(db); err != nil {
+		return fmt.Errorf("failed to initialize alert delivery tables: %v", err)
+	}
+
+	log.Printf("🖥️  Initializing dashboard viewer role...")
+	if err := initializeDashboardRoleColumn(db); err != nil {
+		return fmt.Errorf("failed to initialize dashboard viewer role: %v", err)
+	}
+
+	log.Printf("📥 Initializing bulk alert ingestion columns...")
+	if err := initializeAlertIngestionColumns(db); err != nil {
+		return fmt.Errorf("failed to initialize bulk alert ingestion columns: %v", err)
+	}
+
+	log.Printf("🗳️  Initializing leader election locks table...")
+	if err := initializeLocksTable(db); err != nil {
+		return fmt.Errorf("failed to initialize locks table: %v", err)
+	}
+
+	log.Printf("🌍 Initializing CTI enrichment columns...")
+	if err := initializeCTIColumns(db); err != nil {
+		return fmt.Errorf("failed to initialize CTI enrichment columns: %v", err)
+	}
+
+	log.Printf("📱 Initializing device fingerprint component columns...")
+	if err := initializeDeviceComponentColumns(db); err != nil {
+		return fmt.Errorf("failed to initialize device fingerprint component columns: %v", err)
+	}
+	if err := initializeDeviceInfoColumnType(db); err != nil {
+		return fmt.Errorf("failed to widen device fingerprint device_info column: %v", err)
+	}
+
+	log.Printf("🌐 Initializing IP reputation ASN column...")
+	if err := initializeIPReputationASNColumn(db); err != nil {
+		return fmt.Errorf("failed to initialize IP reputation ASN column: %v", err)
+	}
+
+	log.Printf("🧱 Initializing CIDR/ASN block store table...")
+	if err := initializeBlockStoreTable(db); err != nil {
+		return fmt.Errorf("failed to initialize block store table: %v", err)
+	}
+
+	log.Printf("🔑 Initializing bootstrap API key table...")
+	if err := initializeAPIKeysTable(db); err != nil {
+		return fmt.Errorf("failed to initialize API key table: %v", err)
+	}
+
+	log.Printf("🔏 Initializing client certificate IP allowlist column...")
+	if err := initializeCertificateAllowedIPsColumn(db); err != nil {
+		return fmt.Errorf("failed to initialize client certificate IP allowlist column: %v", err)
+	}
+
+	log.Printf("🗝️  Initializing session data column...")
+	if err := initializeSessionDataColumn(db); err != nil {
+		return fmt.Errorf("failed to initialize session data column: %v", err)
+	}
+
+	log.Printf("🌎 Initializing geolocation cache table...")
+	if err := initializeGeolocationDataTable(db); err != nil {
+		return fmt.Errorf("failed to initialize geolocation cache table: %v", err)
+	}
+
+	log.Printf("📒 Initializing double-entry ledger table...")
+	if err := initializeLedgerTables(db); err != nil {
+		return fmt.Errorf("failed to initialize ledger tables: %v", err)
+	}
+	if err := initializeTransactionsLedgerColumns(db); err != nil {
+		return fmt.Errorf("failed to initialize transactions ledger columns: %v", err)
+	}
+
+	log.Printf("🔔 Initializing typed notification columns...")
+	if err := initializeNotificationColumns(db); err != nil {
+		return fmt.Errorf("failed to initialize typed notification columns: %v", err)
+	}
+
+	log.Printf("📮 Initializing notification delivery subsystem tables...")
+	if err := initializeNotificationDeliveryTables(db); err != nil {
+		return fmt.Errorf("failed to initialize notification delivery tables: %v", err)
+	}
+
+	log.Printf("💳 Initializing 3-D Secure challenge tables...")
+	if err := initializeThreeDSTables(db); err != nil {
+		return fmt.Errorf("failed to initialize 3-D Secure tables: %v", err)
+	}
+
+	log.Printf("🔢 Initializing TAN challenge tables...")
+	if err := initializeTanChallengeTables(db); err != nil {
+		return fmt.Errorf("failed to initialize TAN challenge tables: %v", err)
+	}
+
+	log.Printf("📜 Initializing transaction log table...")
+	if err := initializeTransactionLogsTable(db); err != nil {
+		return fmt.Errorf("failed to initialize transaction log table: %v", err)
+	}
+
+	log.Printf("🧾 Initializing invoice tables...")
+	if err := initializeInvoiceTables(db); err != nil {
+		return fmt.Errorf("failed to initialize invoice tables: %v", err)
+	}
+
+	log.Printf("🔐 Initializing encrypted payment data table...")
+	if err := initializeEncryptedPaymentDataTable(db); err != nil {
+		return fmt.Errorf("failed to initialize encrypted payment data table: %v", err)
+	}
+
+	log.Printf("🧾 Initializing payment invoice table...")
+	if err := initializePaymentInvoicesTable(db); err != nil {
+		return fmt.Errorf("failed to initialize payment invoice table: %v", err)
+	}
+
+	log.Printf("🪝 Initializing webhook subscription tables...")
+	if err := initializeWebhookTables(db); err != nil {
+		return fmt.Errorf("failed to initialize webhook subscription tables: %v", err)
+	}
+
 	return nil
 }
 
@@ -2382,9 +3678,18 @@ func initializeSecurityTables(db *sql.DB) error {
 			user_id INT NOT NULL,
 			device_id VARCHAR(255) NOT NULL,
 			fingerprint TEXT NOT NULL,
-			device_info JSON,
+			device_info TEXT,
+			user_agent TEXT,
+			accept_language VARCHAR(255),
+			client_hints VARCHAR(500),
+			canvas_hash VARCHAR(64),
+			webgl_hash VARCHAR(64),
+			ja3_hash VARCHAR(64),
+			asn VARCHAR(20),
 			ip_address VARCHAR(45),
 			location VARCHAR(100),
+			latitude DOUBLE DEFAULT 0,
+			longitude DOUBLE DEFAULT 0,
 			is_trusted BOOLEAN DEFAULT FALSE,
 			trust_score INT DEFAULT 0,
 			last_seen TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
@@ -2404,10 +3709,15 @@ func initializeSecurityTables(db *sql.DB) error {
 			block_reason VARCHAR(255),
 			blocked_until TIMESTAMP NULL,
 			country_code VARCHAR(2),
+			asn VARCHAR(20),
 			is_vpn BOOLEAN DEFAULT FALSE,
 			is_tor BOOLEAN DEFAULT FALSE,
 			is_proxy BOOLEAN DEFAULT FALSE,
 			threat_level ENUM('low', 'medium', 'high', 'critical') DEFAULT 'low',
+			source VARCHAR(64) NOT NULL DEFAULT 'local:manual',
+			cti_score INT,
+			cti_categories VARCHAR(255),
+			cti_source VARCHAR(64),
 			last_seen TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			UNIQUE KEY unique_ip (ip_address),
@@ -2442,7 +3752,8 @@ func initializeSecurityTables(db *sql.DB) error {
 			secret VARCHAR(255) NOT NULL,
 			backup_codes TEXT,
 			is_enabled BOOLEAN DEFAULT FALSE,
-			method ENUM('totp', 'sms', 'email') DEFAULT 'totp',
+			method ENUM('totp', 'webauthn', 'either') DEFAULT 'totp',
+			last_totp_counter BIGINT NOT NULL DEFAULT 0,
 			last_used TIMESTAMP NULL,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
@@ -2468,6 +3779,72 @@ func initializeSecurityTables(db *sql.DB) error {
 			INDEX idx_device_active (device_id, is_active)
 		)`,
 
+		// WebAuthn/FIDO2 credentials (see webauthn.go), superseding the opaque
+		// template_hash in biometric_auth: each row is one authenticator's COSE
+		// public key plus the signature counter used to detect cloned devices.
+		`CREATE TABLE IF NOT EXISTS webauthn_credentials (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			user_id INT NOT NULL,
+			device_id VARCHAR(255) NOT NULL,
+			credential_id VARCHAR(512) NOT NULL,
+			public_key BLOB NOT NULL,
+			algorithm INT NOT NULL,
+			sign_count BIGINT UNSIGNED NOT NULL DEFAULT 0,
+			aaguid VARCHAR(36),
+			transports VARCHAR(100),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			UNIQUE KEY unique_credential_id (credential_id),
+			INDEX idx_user_id (user_id)
+		)`,
+
+		// Per-user rolling behavior baselines (Welford mean/stddev, hour-of-day
+		// histogram, countries seen, merchant category counts) calculateRiskScore
+		// scores new transactions against. See risk_scoring.go.
+		`CREATE TABLE IF NOT EXISTS user_behavior_profile (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			user_id INT NOT NULL,
+			txn_count BIGINT DEFAULT 0,
+			amount_mean DOUBLE DEFAULT 0,
+			amount_m2 DOUBLE DEFAULT 0,
+			hour_histogram JSON,
+			countries_seen JSON,
+			merchant_categories JSON,
+			last_txn_at TIMESTAMP NULL,
+			last_latitude DOUBLE DEFAULT 0,
+			last_longitude DOUBLE DEFAULT 0,
+			inter_arrival_ewma_mean DOUBLE DEFAULT 0,
+			inter_arrival_ewma_var DOUBLE DEFAULT 0,
+			geo_distance_ewma_mean DOUBLE DEFAULT 0,
+			geo_distance_ewma_var DOUBLE DEFAULT 0,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			UNIQUE KEY unique_user_behavior (user_id)
+		)`,
+
+		// Versioned RSA keystore (see keystore.go): private keys are stored
+		// KEK-wrapped, never in the clear. State tracks rotation lifecycle.
+		`CREATE TABLE IF NOT EXISTS encryption_keys (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			key_id VARCHAR(64) NOT NULL,
+			algorithm VARCHAR(32) NOT NULL DEFAULT 'RSA-2048',
+			encrypted_private_key TEXT NOT NULL,
+			public_key TEXT NOT NULL,
+			state ENUM('active', 'retiring', 'retired') NOT NULL DEFAULT 'active',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			activated_at TIMESTAMP NULL,
+			retired_at TIMESTAMP NULL,
+			UNIQUE KEY unique_key_id (key_id),
+			INDEX idx_state (state)
+		)`,
+
+		// Single-row table holding the random salt the keystore's KEK is
+		// derived from, so the derivation is stable across restarts.
+		`CREATE TABLE IF NOT EXISTS keystore_meta (
+			id INT PRIMARY KEY DEFAULT 1,
+			kek_salt VARBINARY(64) NOT NULL
+		)`,
+
 		// Fraud detection rules
 		`CREATE TABLE IF NOT EXISTS fraud_rules (
 			id INT AUTO_INCREMENT PRIMARY KEY,
@@ -2475,7 +3852,7 @@ func initializeSecurityTables(db *sql.DB) error {
 			rule_type ENUM('amount', 'frequency', 'location', 'device', 'pattern', 'velocity') NOT NULL,
 			threshold DECIMAL(10,2) NOT NULL,
 			time_window INT DEFAULT 3600,
-			action ENUM('block', 'flag', 'review', 'alert', 'require_2fa') DEFAULT 'flag',
+			action ENUM('block', 'flag', 'review', 'alert', 'require_2fa', 'challenge_mfa', 'notify') DEFAULT 'flag',
 			severity ENUM('low', 'medium', 'high', 'critical') DEFAULT 'medium',
 			is_active BOOLEAN DEFAULT TRUE,
 			description TEXT,
@@ -2515,6 +3892,7 @@ func initializeSecurityTables(db *sql.DB) error {
 			last_activity TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
 			expires_at TIMESTAMP NOT NULL,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			data JSON,
 			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
 			UNIQUE KEY unique_session_token (session_token),
 			INDEX idx_user_active (user_id, is_active),
@@ -2580,6 +3958,8 @@ func initializeMonitoringTables(db *sql.DB) error {
 			success BOOLEAN DEFAULT TRUE,
 			error_message TEXT,
 			session_id VARCHAR(255),
+			prev_hash VARCHAR(64) NOT NULL DEFAULT '',
+			entry_hash VARCHAR(64) NOT NULL DEFAULT '',
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL,
 			INDEX idx_user_action (user_id, action),
@@ -2587,6 +3967,19 @@ func initializeMonitoringTables(db *sql.DB) error {
 			INDEX idx_created_at (created_at)
 		)`,
 
+		// Signed checkpoints over the hash chains in security_events/audit_trail
+		// (see AuditChain.EnableCheckpoints), so an auditor can prove the chain
+		// hadn't been tampered with as of a point in time without re-verifying
+		// all the way back to genesis.
+		`CREATE TABLE IF NOT EXISTS audit_checkpoints (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			table_name VARCHAR(50) NOT NULL,
+			entry_hash CHAR(64) NOT NULL,
+			signature TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			INDEX idx_table_created (table_name, created_at)
+		)`,
+
 		// Rate limiting tracking
 		`CREATE TABLE IF NOT EXISTS rate_limits (
 			id INT AUTO_INCREMENT PRIMARY KEY,
@@ -2632,7 +4025,7 @@ func (sth *SecureTransactionHandler) setupSecureRoutes() *gin.Engine {
 	corsConfig.AllowMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
 	corsConfig.AllowHeaders = []string{
 		"Origin", "Content-Type", "Authorization", "X-CSRF-Token",
-		"X-Device-ID", "X-MFA-Token", "X-Biometric-Data", "X-Biometric-Type",
+		"X-Device-ID", "X-MFA-Token", "X-WebAuthn-Challenge", "X-WebAuthn-Signature",
 		"X-Session-Token", "X-Request-ID", "X-Client-Version",
 	}
 	corsConfig.AllowCredentials = true
@@ -2641,6 +4034,7 @@ func (sth *SecureTransactionHandler) setupSecureRoutes() *gin.Engine {
 
 	// Comprehensive security middleware stack
 	r.Use(sth.ess.advancedRateLimitMiddleware())
+	r.Use(sth.ess.tieredRateLimitMiddleware())
 	r.Use(sth.ess.geoBlockingMiddleware())
 	r.Use(sth.ess.advancedValidationMiddleware())
 	r.Use(sth.ess.csrfProtectionMiddleware())
@@ -2649,16 +4043,73 @@ func (sth *SecureTransactionHandler) setupSecureRoutes() *gin.Engine {
 
 	// Public endpoints (no authentication required)
 	r.GET("/health", sth.healthCheckHandler)
+	r.GET("/metrics", gin.WrapH(promhttp.Handler())) // shard occupancy, eviction counts, block hits, rate-limit rejections
 	r.GET("/api/v1/public-key", sth.publicKeyHandler)
 	r.GET("/api/v1/security/status", sth.securityStatusHandler)
+	r.GET("/openapi.json", openapiHandler) // generated from the same binding tags validation.go enforces, see openapi.go
+	r.GET("/docs", docsHandler)            // Swagger UI against /openapi.json
 
-	// Security monitoring WebSocket
-	r.GET("/ws/security", sth.sm.handleWebSocket)
+	// Security monitoring WebSocket - mTLS client cert (role from CN/OU) or
+	// JWT admin bearer token checked against the configured Origin allowlist.
+	r.GET("/ws/security", wsDashboardAuthMiddleware(sth), sth.sm.handleWebSocket)
 
-	// Security monitoring dashboard (admin only)
+	// Security monitoring dashboard (admin only) - JWT or mTLS client cert
 	securityAPI := r.Group("/api/v1/security")
-	securityAPI.Use(sth.adminAuthMiddleware())
+	securityAPI.Use(sth.adminOrMTLSMiddleware())
 	sth.sm.SetupRoutes(r, sth.config)
+	securityAPI.POST("/certs/sign", sth.signCSRHandler)
+	securityAPI.POST("/certs/issue", sth.issueClientCertHandler)
+	securityAPI.POST("/certs/revoke", sth.revokeClientCertHandler)
+	securityAPI.GET("/certs", sth.listClientCertificatesHandler)
+	securityAPI.POST("/fraud-rules/test", sth.testFraudRuleHandler)
+	securityAPI.POST("/approval-rules", sth.uploadApprovalRuleSetHandler)
+	securityAPI.POST("/approval-rules/:id/activate", sth.activateApprovalRuleSetHandler)
+	securityAPI.POST("/approval-rules/dry-run", sth.dryRunApprovalRuleHandler)
+	securityAPI.GET("/audit/verify", sth.verifyAuditChainHandler)
+	securityAPI.GET("/audit/export", sth.exportAuditChainHandler)
+	securityAPI.GET("/audit/stream", sth.streamAuditChainHandler)
+	securityAPI.GET("/reconciliation/exceptions", sth.listReconciliationExceptionsHandler)
+	securityAPI.GET("/keys", sth.listKeysHandler)
+	securityAPI.POST("/keys/rotate", sth.rotateKeysHandler)
+	securityAPI.POST("/keys/:id/retire", sth.retireKeyHandler)
+	securityAPI.POST("/keys/rewrap-payment-data", sth.rotatePaymentDataKEKHandler)
+
+	// Paginated admin read path over audit_trail, at its own top-level
+	// path (rather than nested under /api/v1/security) since this is the
+	// route callers are asking about specifically: GET /api/v1/audit.
+	auditAPI := r.Group("/api/v1/audit")
+	auditAPI.Use(sth.adminAuthMiddleware())
+	auditAPI.GET("", sth.listAuditTrailHandler)
+
+	// Machine-to-machine endpoints for webhook callers, monitoring agents
+	// and payment-gateway callbacks, authenticated purely via client cert.
+	if sth.ca != nil {
+		agentsAPI := r.Group("/api/v1/agents")
+		agentsAPI.Use(sth.ca.mtlsAuthMiddleware())
+		agentsAPI.GET("/crl", sth.ca.crlHandler)
+
+		// High-value service-account endpoints (payouts, admin) that
+		// authenticate purely via client cert CN/OU instead of a JWT, with
+		// per-CN cert_acl enforcement and CRL-file based revocation.
+		serviceAPI := r.Group("/api/v1/service")
+		serviceAPI.Use(CertAuthMiddleware(sth.ca, sth.crl))
+		serviceAPI.POST("/payouts", sth.processPayoutHandler)
+
+		adminCertAPI := r.Group("/admin")
+		adminCertAPI.Use(CertAuthMiddleware(sth.ca, sth.crl))
+		adminCertAPI.GET("/service-accounts", sth.listServiceAccountsHandler)
+	}
+
+	// Month-end billing: the invoice pipeline's admin endpoints, gated the
+	// same way every other JWT-authenticated admin surface in this module is
+	// -- adminAuthMiddleware's is_admin lookup, not a separate JWT claim,
+	// since that's the admin gate this module already standardizes on.
+	invoiceAdminAPI := r.Group("/admin/invoices")
+	invoiceAdminAPI.Use(sth.adminAuthMiddleware())
+	invoiceAdminAPI.POST("/prepare", sth.prepareInvoiceRecordsHandler)
+	invoiceAdminAPI.POST("/items", sth.createInvoiceItemsHandler)
+	invoiceAdminAPI.POST("/create", sth.createInvoicesHandler)
+	invoiceAdminAPI.GET("/list", sth.listInvoicesHandler)
 
 	// Main API routes with enhanced authentication
 	api := r.Group("/api/v1")
@@ -2666,20 +4117,65 @@ func (sth *SecureTransactionHandler) setupSecureRoutes() *gin.Engine {
 	api.Use(sth.ess.mfaMiddleware())
 	api.Use(sth.ess.biometricAuthMiddleware())
 	api.Use(sth.ess.transactionSecurityMiddleware())
+	api.Use(sth.mfaRequiredMiddleware())
 	api.Use(sth.auditMiddleware())
 
 	// Enhanced payment endpoints
 	api.POST("/payments", sth.processPaymentHandler)
+	api.POST("/payments/3ds/init", sth.init3DSPaymentHandler)
+	api.POST("/payments/3ds/complete", sth.complete3DSPaymentHandler)
 	api.POST("/payouts", sth.processPayoutHandler)
+	api.POST("/security/tan/solve", sth.solveTanChallengeHandler)
 	api.GET("/transactions", sth.getTransactionHistoryHandler)
 	api.GET("/balance", sth.getBalanceHandler)
+	api.GET("/idempotency/:key", sth.getIdempotencyStatusHandler)
 
 	// Security management endpoints
 	api.GET("/security/profile", sth.getSecurityProfileHandler)
 	api.POST("/security/2fa/enable", sth.enable2FAHandler)
 	api.POST("/security/2fa/verify", sth.verify2FAHandler)
+	api.POST("/security/2fa/backup-codes/regenerate", sth.regenerateBackupCodesHandler)
+	api.GET("/security/mfa/policy", sth.mfaPolicyHandler)
+	api.PUT("/security/mfa/policy", sth.setMFAPolicyHandler)
 	api.POST("/security/device/trust", sth.trustDeviceHandler)
+	api.POST("/security/webauthn/register/begin", sth.beginWebAuthnRegistrationHandler)
+	api.POST("/security/webauthn/register/finish", sth.finishWebAuthnRegistrationHandler)
+	api.POST("/security/webauthn/assert/begin", sth.beginWebAuthnAssertionHandler)
+	api.POST("/security/webauthn/assert/finish", sth.finishWebAuthnAssertionHandler)
 	api.GET("/security/notifications", sth.getSecurityNotificationsHandler)
+	api.GET("/security/notifications/stream", sth.streamNotificationsHandler)
+	api.GET("/security/notifications/sse", sth.streamNotificationsSSEHandler)
+	api.POST("/security/notifications/read-all", sth.markAllNotificationsReadHandler)
+	api.POST("/security/notifications/:id/read", sth.markNotificationReadHandler)
+	api.DELETE("/security/notifications/:id", sth.deleteNotificationHandler)
+	api.GET("/security/notifications/preferences", sth.getNotificationPreferencesHandler)
+	api.PUT("/security/notifications/preferences", sth.setNotificationPreferencesHandler)
+	api.GET("/security/notifications/schedule", sth.getNotificationScheduleHandler)
+	api.PUT("/security/notifications/schedule", sth.setNotificationScheduleHandler)
+	api.POST("/security/notifications/query", sth.queryNotificationsHandler)
+	api.GET("/security/risk-explain", sth.riskExplainHandler)
+	api.GET("/security/sessions", sth.listSessionsHandler)
+	api.DELETE("/security/sessions/:sid", sth.destroySessionHandler)
+
+	// Invoice flow: an opt-in sub-group layering flowSessionMiddleware's
+	// cookie-carried flash session on top of api's JWT auth, for the
+	// generate-invoice/poll-for-settlement flow (invoice_session.go,
+	// payment_invoice.go, invoice_flow_handlers.go). Every other route
+	// under api is unaffected.
+	invoiceFlowAPI := api.Group("/invoices")
+	invoiceFlowAPI.Use(sth.flowSessionMiddleware())
+	invoiceFlowAPI.POST("", sth.createInvoiceHandler)
+	invoiceFlowAPI.GET("/:id/status", sth.invoiceStatusHandler)
+
+	// Webhook subscriptions: subscriber-managed endpoints for transaction
+	// lifecycle events (webhook_subscriptions.go), scoped to the caller the
+	// same way invoiceFlowAPI's routes are -- no admin gate, since these
+	// are a caller's own endpoints rather than operational configuration.
+	webhookAPI := api.Group("/webhooks")
+	webhookAPI.POST("", sth.createWebhookHandler)
+	webhookAPI.GET("", sth.listWebhooksHandler)
+	webhookAPI.DELETE("/:id", sth.deleteWebhookHandler)
+	webhookAPI.POST("/:id/test", sth.testWebhookHandler)
 
 	return r
 }
@@ -2704,21 +4200,34 @@ func (sth *SecureTransactionHandler) securityLoggingMiddleware() gin.HandlerFunc
 			path = path + "?" + raw
 		}
 
-		// Enhanced logging for security events
-		logEntry := fmt.Sprintf("[SECURITY] %v | %3d | %13v | %15s | %-7s %#v",
-			start.Format("2006/01/02 - 15:04:05"),
-			statusCode,
-			latency,
-			clientIP,
-			method,
-			path,
-		)
+		suspicious := statusCode >= 400 || strings.Contains(path, "admin") || method == "DELETE"
+		fields := []any{
+			"timestamp", start,
+			"request_id", c.GetString("request_id"),
+			"status", statusCode,
+			"latency_ms", latency.Milliseconds(),
+			"client_ip", clientIP,
+			"method", method,
+			"path", path,
+			"user_id", c.GetInt("user_id"),
+			"suspicious", suspicious,
+		}
 
-		// Log suspicious activities
-		if statusCode >= 400 || strings.Contains(path, "admin") || method == "DELETE" {
-			log.Printf("%s [SUSPICIOUS]", logEntry)
+		if suspicious {
+			securityLogger.Warn("http_request", fields...)
+			// Fan suspicious requests into the same sink pipeline chained
+			// audit entries use (stdout/file/syslog/webhook/kafka per
+			// AUDIT_SINKS), so a SIEM watching that pipeline sees them too -
+			// unchained, since a per-request log line isn't a business event
+			// worth hashing into audit_trail's Merkle chain.
+			if sth.auditChain != nil {
+				sth.auditChain.EmitUnchained("http_request", map[string]interface{}{
+					"status": statusCode, "latency_ms": latency.Milliseconds(),
+					"client_ip": clientIP, "method": method, "path": path,
+				})
+			}
 		} else {
-			log.Printf("%s", logEntry)
+			securityLogger.Info("http_request", fields...)
 		}
 	}
 }
@@ -2746,8 +4255,13 @@ func (sth *SecureTransactionHandler) securityHeadersMiddleware() gin.HandlerFunc
 
 func (sth *SecureTransactionHandler) requestTrackingMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Generate unique request ID for tracking
-		requestID := fmt.Sprintf("req_%d_%d", time.Now().Unix(), time.Now().Nanosecond()%1000000)
+		// A caller-supplied X-Request-ID is honored (so a request can be
+		// traced across a gateway that assigned one before we saw it);
+		// otherwise a fresh UUID is minted.
+		requestID := c.GetHeader("X-Request-ID")
+		if requestID == "" {
+			requestID = newRequestID()
+		}
 		c.Header("X-Request-ID", requestID)
 		c.Set("request_id", requestID)
 
@@ -2778,6 +4292,16 @@ func (sth *SecureTransactionHandler) adminAuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		// A token that validates but whose session has been explicitly revoked
+		// (logout, forced session termination) must not grant admin access even
+		// though the JWT itself hasn't expired yet.
+		session, err := sessionFromToken(tokenString, sth.config.JWTSecret, sth.ess.sessions)
+		if err != nil || session.UserID != userID {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Session has been revoked"})
+			c.Abort()
+			return
+		}
+
 		// Check if user has admin privileges
 		var isAdmin bool
 		err = sth.db.QueryRow("SELECT is_admin FROM users WHERE id = ? AND is_active = true", userID).Scan(&isAdmin)
@@ -2795,6 +4319,20 @@ func (sth *SecureTransactionHandler) adminAuthMiddleware() gin.HandlerFunc {
 	}
 }
 
+// adminOrMTLSMiddleware lets the locked-down security dashboard be reached
+// either with a JWT bearer token (existing behavior) or a trusted mTLS client
+// certificate (webhook callers, monitoring agents), so backend services don't
+// need to juggle bearer tokens just to hit /api/v1/security/*.
+func (sth *SecureTransactionHandler) adminOrMTLSMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if sth.ca != nil && c.Request.TLS != nil && len(c.Request.TLS.PeerCertificates) > 0 {
+			sth.ca.mtlsAuthMiddleware()(c)
+			return
+		}
+		sth.adminAuthMiddleware()(c)
+	}
+}
+
 func (sth *SecureTransactionHandler) auditMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Capture request data for audit
@@ -2851,10 +4389,11 @@ func (sth *SecureTransactionHandler) healthCheckHandler(c *gin.Context) {
 
 func (sth *SecureTransactionHandler) publicKeyHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
-		"public_key": sth.ess.getPublicKeyPEM(),
-		"algorithm":  "RSA-2048",
-		"usage":      "Encrypt sensitive data before transmission",
-		"expires_at": time.Now().Add(24 * time.Hour),
+		"public_key":     sth.ess.getPublicKeyPEM(),
+		"public_key_jwk": sth.ess.GetPublicKeyJWK(),
+		"algorithm":      "RSA-OAEP-256",
+		"usage":          "Encrypt sensitive data before transmission",
+		"expires_at":     time.Now().Add(24 * time.Hour),
 	})
 }
 
@@ -2871,27 +4410,166 @@ func (sth *SecureTransactionHandler) securityStatusHandler(c *gin.Context) {
 			"biometric-support",
 		},
 		"last_security_update": time.Now().Format("2006-01-02"),
+		"node":                 sth.sm.leaderStatus(),
 	})
 }
 
+// leaderStatus reports which replica currently holds the background-monitor
+// lease, so operators can see which node is active without digging through
+// the locks table directly.
+func (sm *SecurityMonitor) leaderStatus() gin.H {
+	if sm.elector == nil {
+		return gin.H{"leader_election": "disabled"}
+	}
+
+	owner, expiresAt, err := sm.elector.CurrentLeader()
+	if err != nil {
+		return gin.H{"leader_election": "enabled", "this_node": sm.elector.OwnerID(), "leader": "unknown"}
+	}
+
+	return gin.H{
+		"leader_election":  "enabled",
+		"this_node":        sm.elector.OwnerID(),
+		"is_leader":        sm.elector.IsLeader(),
+		"leader":           owner,
+		"lease_expires_at": expiresAt,
+	}
+}
+
 func (sth *SecureTransactionHandler) processPaymentHandler(c *gin.Context) {
 	userID := c.GetInt("user_id")
 	riskScore := c.GetInt("risk_score")
 	requestID := c.GetString("request_id")
 
+	// Idempotency-Key: a retry within idempotencyKeyTTL of an earlier
+	// identical request replays the stored response instead of charging
+	// twice; a retry reusing the key with a different body is rejected.
+	idempotencyKey := c.GetHeader("Idempotency-Key")
+	var bodyHash string
+	if idempotencyKey != "" {
+		bodyHash = requestFingerprint(c.Request.Method, c.FullPath(), readAndRestoreBody(c))
+	}
+
 	var req PaymentRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
+	if !bindValidated(c, &req) {
 		sth.logSecurityEvent(userID, "invalid_payment_request", "medium",
 			"Invalid payment request format", sth.ess.getRealIP(c), c.GetHeader("User-Agent"))
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
+	if idempotencyKey != "" {
+		existing, mismatch, err := sth.idempotency.Reserve(userID, idempotencyKey, bodyHash)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process idempotency key"})
+			return
+		}
+		if mismatch {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key already used with a different request body"})
+			return
+		}
+		if existing != nil {
+			respondFromExistingIdempotencyRecord(c, existing)
+			return
+		}
+	}
+
+	// Evaluate the pluggable fraud rule engine instead of just thresholding
+	// risk_score, so operator-authored rule_config expressions (velocity,
+	// device, IP reputation, z-score) get a say alongside the legacy score.
+	if sth.ess.fraudEngine != nil {
+		txCtx := TxContext{
+			UserID:    userID,
+			Amount:    req.Amount,
+			DeviceID:  c.GetHeader("X-Device-ID"),
+			IPAddress: sth.ess.getRealIP(c),
+			HourOfDay: time.Now().Hour(),
+		}
+		// checkTransactionLimits (run earlier by transactionSecurityMiddleware)
+		// already recorded this transaction into every velocity window, so
+		// PeekVelocity just reads them back instead of counting it twice.
+		if sth.ess.stateStore != nil {
+			for _, w := range transactionVelocityWindows {
+				key := transactionVelocityKey(userID, w.label)
+				count, total, err := sth.ess.stateStore.PeekVelocity(key, w.window)
+				if err != nil {
+					continue
+				}
+				switch w.label {
+				case "1h":
+					txCtx.Velocity1hCount, txCtx.Velocity1hAmount = count, total
+				case "24h":
+					txCtx.Velocity24hCount, txCtx.Velocity24hAmount = count, total
+				case "7d":
+					txCtx.Velocity7dCount, txCtx.Velocity7dAmount = count, total
+				case "30d":
+					txCtx.Velocity30dCount, txCtx.Velocity30dAmount = count, total
+				}
+			}
+		}
+		fraudResult := sth.ess.fraudEngine.Evaluate(txCtx)
+		if fraudResult.Action == "block" {
+			sth.logSecurityEventWithMetadata(userID, "fraud_rule_blocked", fraudResult.Severity,
+				fmt.Sprintf("Payment blocked by fraud rules: %v", fraudResult.TriggeredRules),
+				map[string]interface{}{"triggered_rules": fraudResult.TriggeredRules, "action": fraudResult.Action},
+				sth.ess.getRealIP(c), c.GetHeader("User-Agent"))
+			sth.notificationService.Publish(userID, SecurityNotification{
+				Type: "fraud", Title: "Transaction blocked", Severity: "critical",
+				Message:  "A payment was blocked by our fraud protection rules.",
+				Metadata: map[string]interface{}{"triggered_rules": fraudResult.TriggeredRules},
+			})
+
+			c.JSON(http.StatusForbidden, gin.H{
+				"error":           "Transaction blocked by fraud rules",
+				"triggered_rules": fraudResult.TriggeredRules,
+				"request_id":      requestID,
+			})
+			return
+		}
+		if fraudResult.Action == "require_2fa" {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error":           "Transaction requires additional verification",
+				"triggered_rules": fraudResult.TriggeredRules,
+				"request_id":      requestID,
+				"required_actions": []string{"verify_2fa"},
+			})
+			return
+		}
+	}
+
+	// Scriptable approval rules (versioned, operator-activatable) get the
+	// final say before the legacy flat risk_score threshold below.
+	if sth.ess.approvalEngine != nil {
+		decision := sth.ess.approvalEngine.Evaluate(ApprovalContext{
+			UserID: userID, Amount: req.Amount, Kind: "payment", RiskScore: riskScore,
+		})
+		sth.logAuditEvent(c, "approval_rule_decision", "payment", requestID,
+			nil, map[string]interface{}{"action": decision.Action, "reason": decision.Reason})
+
+		if decision.Action == "deny" || decision.Action == "require_2fa" || decision.Action == "manual_review" {
+			statusCode := http.StatusForbidden
+			if decision.Action == "manual_review" {
+				statusCode = http.StatusAccepted
+			}
+			c.JSON(statusCode, gin.H{
+				"error":      "Transaction declined by approval rules",
+				"action":     decision.Action,
+				"reason":     decision.Reason,
+				"request_id": requestID,
+			})
+			return
+		}
+	}
+
 	// Enhanced security checks
 	if riskScore > 80 {
 		sth.logSecurityEvent(userID, "high_risk_payment_blocked", "high",
 			fmt.Sprintf("High-risk payment blocked (score: %d)", riskScore),
 			sth.ess.getRealIP(c), c.GetHeader("User-Agent"))
+		sth.notificationService.Publish(userID, SecurityNotification{
+			Type: "security", Title: "Transaction requires verification", Severity: "warning",
+			Message:  "A payment needs additional verification before it can be processed.",
+			Metadata: map[string]interface{}{"risk_score": riskScore, "request_id": requestID},
+		})
 
 		c.JSON(http.StatusForbidden, gin.H{
 			"error":                "Transaction requires additional verification",
@@ -2904,13 +4582,32 @@ func (sth *SecureTransactionHandler) processPaymentHandler(c *gin.Context) {
 	}
 
 	// Process payment with enhanced logging
-	response, err := sth.ts.ProcessPayment(userID, &req)
+	response, err := sth.providerRouter.ProcessPayment(userID, &req, idempotencyKey)
 	if err != nil {
 		sth.logSecurityEvent(userID, "payment_processing_error", "medium",
 			fmt.Sprintf("Payment processing failed: %v", err),
 			sth.ess.getRealIP(c), c.GetHeader("User-Agent"))
 
 		log.Printf("Payment processing error for user %d: %v", userID, err)
+
+		// A provider-side failure under an Idempotency-Key is queued for a
+		// backed-off replay instead of being handed back as a hard failure,
+		// so the caller can poll getIdempotencyStatusHandler instead of
+		// blindly resubmitting (and risking a double charge).
+		if idempotencyKey != "" {
+			if payload, mErr := json.Marshal(req); mErr == nil {
+				if qErr := sth.retryQueue.Enqueue(userID, idempotencyKey, "payment", payload); qErr != nil {
+					log.Printf("⚠️  failed to enqueue payment retry for key %s: %v", idempotencyKey, qErr)
+				}
+			}
+			c.JSON(http.StatusAccepted, gin.H{
+				"status":          "retrying",
+				"idempotency_key": idempotencyKey,
+				"request_id":      requestID,
+			})
+			return
+		}
+
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error":      "Payment processing failed",
 			"request_id": requestID,
@@ -2923,9 +4620,22 @@ func (sth *SecureTransactionHandler) processPaymentHandler(c *gin.Context) {
 		sth.logSecurityEvent(userID, "payment_successful", "info",
 			fmt.Sprintf("Payment processed successfully: %s", response.TransactionID),
 			sth.ess.getRealIP(c), c.GetHeader("User-Agent"))
+		sth.ess.updateBehaviorProfile(userID, req.Amount, req.Region, "", sth.ess.getRealIP(c), time.Now())
+		sth.notificationService.Publish(userID, SecurityNotification{
+			Type: "transaction", Title: "Payment processed", Severity: "info",
+			Message:  fmt.Sprintf("Your payment of %.2f was processed successfully.", req.Amount),
+			Metadata: map[string]interface{}{"transaction_id": response.TransactionID},
+		})
 	}
 
 	response.TransactionID = requestID // Include request ID for tracking
+
+	if idempotencyKey != "" {
+		if err := sth.idempotency.Complete(userID, idempotencyKey, http.StatusOK, response); err != nil {
+			log.Printf("⚠️  failed to record idempotency result for key %s: %v", idempotencyKey, err)
+		}
+	}
+
 	c.JSON(http.StatusOK, response)
 }
 
@@ -2934,14 +4644,59 @@ func (sth *SecureTransactionHandler) processPayoutHandler(c *gin.Context) {
 	riskScore := c.GetInt("risk_score")
 	requestID := c.GetString("request_id")
 
+	idempotencyKey := c.GetHeader("Idempotency-Key")
+	var bodyHash string
+	if idempotencyKey != "" {
+		bodyHash = requestFingerprint(c.Request.Method, c.FullPath(), readAndRestoreBody(c))
+	}
+
 	var req PayoutRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
+	if !bindValidated(c, &req) {
 		sth.logSecurityEvent(userID, "invalid_payout_request", "medium",
 			"Invalid payout request format", sth.ess.getRealIP(c), c.GetHeader("User-Agent"))
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
+	if idempotencyKey != "" {
+		existing, mismatch, err := sth.idempotency.Reserve(userID, idempotencyKey, bodyHash)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process idempotency key"})
+			return
+		}
+		if mismatch {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key already used with a different request body"})
+			return
+		}
+		if existing != nil {
+			respondFromExistingIdempotencyRecord(c, existing)
+			return
+		}
+	}
+
+	// Scriptable approval rules evaluate daily payout totals via rule_storage
+	// before the legacy flat risk_score threshold below gets a say.
+	if sth.ess.approvalEngine != nil {
+		decision := sth.ess.approvalEngine.Evaluate(ApprovalContext{
+			UserID: userID, Amount: req.Amount, Kind: "payout", RiskScore: riskScore,
+		})
+		sth.logAuditEvent(c, "approval_rule_decision", "payout", requestID,
+			nil, map[string]interface{}{"action": decision.Action, "reason": decision.Reason})
+
+		if decision.Action == "deny" || decision.Action == "require_2fa" || decision.Action == "manual_review" {
+			statusCode := http.StatusForbidden
+			if decision.Action == "manual_review" {
+				statusCode = http.StatusAccepted
+			}
+			c.JSON(statusCode, gin.H{
+				"error":      "Payout declined by approval rules",
+				"action":     decision.Action,
+				"reason":     decision.Reason,
+				"request_id": requestID,
+			})
+			return
+		}
+	}
+
 	// Enhanced security checks for payouts
 	if riskScore > 70 {
 		sth.logSecurityEvent(userID, "high_risk_payout_blocked", "high",
@@ -2959,13 +4714,28 @@ func (sth *SecureTransactionHandler) processPayoutHandler(c *gin.Context) {
 	}
 
 	// Process payout with enhanced logging
-	response, err := sth.ts.ProcessPayout(userID, &req)
+	response, err := sth.providerRouter.ProcessPayout(userID, &req, idempotencyKey)
 	if err != nil {
 		sth.logSecurityEvent(userID, "payout_processing_error", "medium",
 			fmt.Sprintf("Payout processing failed: %v", err),
 			sth.ess.getRealIP(c), c.GetHeader("User-Agent"))
 
 		log.Printf("Payout processing error for user %d: %v", userID, err)
+
+		if idempotencyKey != "" {
+			if payload, mErr := json.Marshal(req); mErr == nil {
+				if qErr := sth.retryQueue.Enqueue(userID, idempotencyKey, "payout", payload); qErr != nil {
+					log.Printf("⚠️  failed to enqueue payout retry for key %s: %v", idempotencyKey, qErr)
+				}
+			}
+			c.JSON(http.StatusAccepted, gin.H{
+				"status":          "retrying",
+				"idempotency_key": idempotencyKey,
+				"request_id":      requestID,
+			})
+			return
+		}
+
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error":      "Payout processing failed",
 			"request_id": requestID,
@@ -2978,9 +4748,17 @@ func (sth *SecureTransactionHandler) processPayoutHandler(c *gin.Context) {
 		sth.logSecurityEvent(userID, "payout_successful", "info",
 			fmt.Sprintf("Payout processed successfully: %s", response.TransactionID),
 			sth.ess.getRealIP(c), c.GetHeader("User-Agent"))
+		sth.ess.updateBehaviorProfile(userID, req.Amount, req.Region, "", sth.ess.getRealIP(c), time.Now())
 	}
 
 	response.TransactionID = requestID
+
+	if idempotencyKey != "" {
+		if err := sth.idempotency.Complete(userID, idempotencyKey, http.StatusOK, response); err != nil {
+			log.Printf("⚠️  failed to record idempotency result for key %s: %v", idempotencyKey, err)
+		}
+	}
+
 	c.JSON(http.StatusOK, response)
 }
 
@@ -3036,6 +4814,45 @@ func (sth *SecureTransactionHandler) getSecurityProfileHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, profile)
 }
 
+// listSessionsHandler returns the caller's own live sessions, so a user can
+// see every device/browser currently holding a token for their account
+// before deciding whether to terminate one.
+func (sth *SecureTransactionHandler) listSessionsHandler(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	sessions, err := sth.ess.sessions.ListByUser(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+}
+
+// destroySessionHandler terminates one of the caller's own sessions by sid.
+// It looks the session up first so a user can't probe for or revoke another
+// user's session by guessing a sid.
+func (sth *SecureTransactionHandler) destroySessionHandler(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	sid := c.Param("sid")
+
+	session, err := sth.ess.sessions.Read(sid)
+	if err != nil || session.UserID != userID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		return
+	}
+
+	if err := sth.ess.sessions.Destroy(sid); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	sth.logSecurityEvent(userID, "session_terminated", "low",
+		fmt.Sprintf("User terminated session for device %s", session.DeviceID), sth.ess.getRealIP(c), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, gin.H{"message": "session terminated"})
+}
+
 // Helper functions
 func (sth *SecureTransactionHandler) validateSecurityConfig() error {
 	// Validate critical security configurations
@@ -3051,6 +4868,10 @@ func (sth *SecureTransactionHandler) validateSecurityConfig() error {
 		return fmt.Errorf("JWT secret must be at least 32 characters long")
 	}
 
+	if getEnv("APP_ENV", "development") == "production" && isUsingEnvSecretsProvider(sth.config) {
+		return fmt.Errorf("refusing to start in production with secrets sourced from plain env vars; configure vault:// or aws:// secret URIs")
+	}
+
 	return nil
 }
 
@@ -3073,11 +4894,39 @@ func (sth *SecureTransactionHandler) isSensitiveEndpoint(path string) bool {
 }
 
 func (sth *SecureTransactionHandler) logSecurityEvent(userID int, eventType, severity, description, ip, userAgent string) {
-	_, err := sth.db.Exec(`
-		INSERT INTO security_events (user_id, event_type, severity, description, ip_address, user_agent) 
-		VALUES (?, ?, ?, ?, ?, ?)
-	`, userID, eventType, severity, description, ip, userAgent)
+	sth.logSecurityEventWithMetadata(userID, eventType, severity, description, nil, ip, userAgent)
+}
+
+// logSecurityEventWithMetadata is logSecurityEvent plus a structured metadata
+// blob (e.g. which fraud rules fired and what action they chose) that a
+// caller wants queryable as JSON instead of buried in the free-text
+// description. metadata may be nil, in which case this is exactly
+// logSecurityEvent.
+func (sth *SecureTransactionHandler) logSecurityEventWithMetadata(userID int, eventType, severity, description string, metadata map[string]interface{}, ip, userAgent string) {
+	sth.ess.ipIntel.Enqueue(ip)
+	encryptedDescription := encryptColumnValue(sth.ess.keystore, description)
+
+	var metadataJSON string
+	if metadata != nil {
+		if b, err := json.Marshal(metadata); err == nil {
+			metadataJSON = string(b)
+		}
+	}
+
+	prevHash, entryHash, err := sth.auditChain.Append("security_events", map[string]interface{}{
+		"user_id": userID, "event_type": eventType, "severity": severity,
+		"description": encryptedDescription, "ip_address": ip, "user_agent": userAgent,
+		"metadata": metadataJSON,
+	})
+	if err != nil {
+		log.Printf("⚠️  Failed to chain security event, logging without a hash: %v", err)
+	}
 
+	uid := userID
+	err = sth.ess.repo.RecordSecurityEvent(&SecurityEvent{
+		UserID: &uid, EventType: eventType, Severity: severity, Description: encryptedDescription,
+		IPAddress: ip, UserAgent: userAgent, PrevHash: prevHash, EntryHash: entryHash, Metadata: metadataJSON,
+	})
 	if err != nil {
 		log.Printf("Failed to log security event: %v", err)
 	}
@@ -3088,96 +4937,88 @@ func (sth *SecureTransactionHandler) logAuditEvent(c *gin.Context, action, resou
 
 	oldJSON, _ := json.Marshal(oldValues)
 	newJSON, _ := json.Marshal(newValues)
+	ip := sth.ess.getRealIP(c)
+	userAgent := c.GetHeader("User-Agent")
+	sessionID := c.GetString("request_id")
 
-	_, err := sth.db.Exec(`
-		INSERT INTO audit_trail (user_id, action, resource_type, resource_id, old_values, new_values, ip_address, user_agent, session_id) 
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`, userID, action, resourceType, resourceID, string(oldJSON), string(newJSON),
-		sth.ess.getRealIP(c), c.GetHeader("User-Agent"), c.GetString("request_id"))
+	prevHash, entryHash, err := sth.auditChain.Append("audit_trail", map[string]interface{}{
+		"user_id": userID, "action": action, "resource_type": resourceType, "resource_id": resourceID,
+		"old_values": string(oldJSON), "new_values": string(newJSON), "ip_address": ip,
+		"user_agent": userAgent, "session_id": sessionID,
+	})
+	if err != nil {
+		log.Printf("⚠️  Failed to chain audit event, logging without a hash: %v", err)
+	}
 
+	err = sth.ess.repo.InsertAuditEvent(&AuditTrailEntry{
+		UserID: userID, Action: action, ResourceType: resourceType, ResourceID: resourceID,
+		OldValues: string(oldJSON), NewValues: string(newJSON), IPAddress: ip, UserAgent: userAgent,
+		SessionID: sessionID, PrevHash: prevHash, EntryHash: entryHash,
+	})
 	if err != nil {
 		log.Printf("Failed to log audit event: %v", err)
 	}
 }
 
+// getUserSecurityProfile delegates the three-table rollup to
+// SecurityRepository so it runs against whatever driver ess.repo is backed
+// by (pop-managed SQLite/Postgres/MySQL/CockroachDB, or the direct-SQL
+// MySQL fallback) instead of hand-rolled MySQL-only queries.
 func (sth *SecureTransactionHandler) getUserSecurityProfile(userID int) map[string]interface{} {
-	profile := make(map[string]interface{})
-
-	// Get risk score
-	var riskScore int
-	sth.db.QueryRow("SELECT current_score FROM risk_scores WHERE user_id = ?", userID).Scan(&riskScore)
-	profile["risk_score"] = riskScore
-
-	// Get 2FA status
-	var has2FA bool
-	sth.db.QueryRow("SELECT is_enabled FROM two_factor_auth WHERE user_id = ?", userID).Scan(&has2FA)
-	profile["two_factor_enabled"] = has2FA
-
-	// Get trusted devices count
-	var trustedDevices int
-	sth.db.QueryRow("SELECT COUNT(*) FROM device_fingerprints WHERE user_id = ? AND is_trusted = true", userID).Scan(&trustedDevices)
-	profile["trusted_devices"] = trustedDevices
-
-	// Get recent security events
-	profile["recent_events"] = sth.sm.getUserSecurityEvents(userID, 10)
-
-	return profile
-}
+	profile, err := sth.ess.repo.GetUserSecurityProfile(userID)
+	if err != nil {
+		log.Printf("⚠️  Failed to load security profile for user %d: %v", userID, err)
+		profile = &UserSecurityProfile{}
+	}
 
-// Placeholder handlers for additional security features
-func (sth *SecureTransactionHandler) enable2FAHandler(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{"message": "2FA setup endpoint - implement TOTP generation"})
+	return map[string]interface{}{
+		"risk_score":         profile.RiskScore,
+		"two_factor_enabled": profile.TwoFactorEnabled,
+		"trusted_devices":    profile.TrustedDevices,
+		"recent_events":      sth.sm.getUserSecurityEvents(userID, 10),
+	}
 }
 
-func (sth *SecureTransactionHandler) verify2FAHandler(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{"message": "2FA verification endpoint - implement TOTP validation"})
-}
+// enable2FAHandler and verify2FAHandler live in totp.go.
 
+// trustDeviceHandler lets the logged-in user mark their current device (the
+// one making this very request) as trusted. It ingests the device's
+// fingerprint the same way enhancedAuthMiddleware does on every sensitive
+// operation, so a device trusted here immediately has a device_fingerprints
+// row rather than waiting for its next sensitive-operation request. This is
+// deliberately separate from WebAuthn credential enrollment: a "trusted
+// device" here is a fingerprint (components, IP history, geo), while a
+// registered authenticator (see beginWebAuthnRegistrationHandler/
+// finishWebAuthnRegistrationHandler in webauthn.go) is a second factor in its
+// own right. A device can be trusted without ever enrolling a passkey.
 func (sth *SecureTransactionHandler) trustDeviceHandler(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{"message": "Device trust endpoint - implement device fingerprinting"})
-}
-
-func (sth *SecureTransactionHandler) getSecurityNotificationsHandler(c *gin.Context) {
 	userID := c.GetInt("user_id")
+	deviceID := c.GetHeader("X-Device-ID")
+	if deviceID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "X-Device-ID header required"})
+		return
+	}
 
-	// Get user's security notifications
-	rows, err := sth.db.Query(`
-		SELECT id, notification_type, title, message, severity, is_read, created_at 
-		FROM security_notifications 
-		WHERE user_id = ? 
-		ORDER BY created_at DESC 
-		LIMIT 50
-	`, userID)
+	ip := sth.ess.getRealIP(c)
+	location := sth.ess.getLocationFromIP(ip)
+	latitude, longitude := sth.ess.geoCoordinatesFromIP(ip)
+	components := deviceComponentsFromRequest(c)
 
+	device, assessment, err := sth.sm.ingestDeviceFingerprint(userID, deviceID, components, ip, location, latitude, longitude)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch notifications"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to record device fingerprint"})
 		return
 	}
-	defer rows.Close()
 
-	var notifications []map[string]interface{}
-	for rows.Next() {
-		var notification map[string]interface{} = make(map[string]interface{})
-		var id int
-		var notificationType, title, message, severity string
-		var isRead bool
-		var createdAt time.Time
-
-		rows.Scan(&id, &notificationType, &title, &message, &severity, &isRead, &createdAt)
-
-		notification["id"] = id
-		notification["type"] = notificationType
-		notification["title"] = title
-		notification["message"] = message
-		notification["severity"] = severity
-		notification["is_read"] = isRead
-		notification["created_at"] = createdAt
-
-		notifications = append(notifications, notification)
+	if _, err := sth.db.Exec("UPDATE device_fingerprints SET is_trusted = true WHERE user_id = ? AND device_id = ?", userID, deviceID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to trust device"})
+		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"notifications": notifications,
-		"total_count":   len(notifications),
+		"message":    "device trusted",
+		"device":     device,
+		"assessment": assessment,
 	})
-}
\ No newline at end of file
+}
+
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// eventsCursor is the (created_at, id) keyset position getSecurityEvents
+// hands back as an opaque next_cursor token. Comparing the full tuple
+// (rather than just created_at) keeps pagination stable across rows that
+// share a timestamp.
+type eventsCursor struct {
+	CreatedAt time.Time `json:"created_at"`
+	ID        int64     `json:"id"`
+}
+
+func encodeEventsCursor(cursor eventsCursor) string {
+	raw, _ := json.Marshal(cursor)
+	return base64.URLEncoding.EncodeToString(raw)
+}
+
+func decodeEventsCursor(token string) (eventsCursor, error) {
+	raw, err := base64.URLEncoding.DecodeString(token)
+	if err != nil {
+		return eventsCursor{}, err
+	}
+	var cursor eventsCursor
+	if err := json.Unmarshal(raw, &cursor); err != nil {
+		return eventsCursor{}, err
+	}
+	return cursor, nil
+}
+
+// securityEventsFilter holds the security_events query filters shared by
+// getSecurityEvents and exportSecurityEvents.
+type securityEventsFilter struct {
+	Severity    string
+	EventType   string
+	IPAddress   string
+	UserID      int // 0 means unset
+	Country     string
+	ASN         string
+	ThreatLevel string
+}
+
+func securityEventsFilterFromQuery(c *gin.Context) securityEventsFilter {
+	filter := securityEventsFilter{
+		Severity:    c.Query("severity"),
+		EventType:   c.Query("type"),
+		IPAddress:   c.Query("ip_address"),
+		Country:     c.Query("country"),
+		ASN:         c.Query("asn"),
+		ThreatLevel: c.Query("threat_level"),
+	}
+	if userID, err := strconv.Atoi(c.Query("user_id")); err == nil {
+		filter.UserID = userID
+	}
+	return filter
+}
+
+// apply appends this filter's conditions to query/args, returning both
+// extended. query must already end just past "WHERE 1=1" or an equivalent
+// always-true clause.
+func (f securityEventsFilter) apply(query string, args []interface{}) (string, []interface{}) {
+	if f.Severity != "" {
+		query += " AND severity = ?"
+		args = append(args, f.Severity)
+	}
+	if f.EventType != "" {
+		query += " AND event_type = ?"
+		args = append(args, f.EventType)
+	}
+	if f.IPAddress != "" {
+		query += " AND ip_address = ?"
+		args = append(args, f.IPAddress)
+	}
+	if f.UserID != 0 {
+		query += " AND user_id = ?"
+		args = append(args, f.UserID)
+	}
+	// country/asn/threat_level pivot through ip_reputation, which is keyed
+	// by ip_address the same way security_events is, rather than
+	// duplicating those columns onto every event row.
+	if f.Country != "" {
+		query += " AND ip_address IN (SELECT ip_address FROM ip_reputation WHERE country_code = ?)"
+		args = append(args, f.Country)
+	}
+	if f.ASN != "" {
+		query += " AND ip_address IN (SELECT ip_address FROM ip_reputation WHERE asn = ?)"
+		args = append(args, f.ASN)
+	}
+	if f.ThreatLevel != "" {
+		query += " AND ip_address IN (SELECT ip_address FROM ip_reputation WHERE threat_level = ?)"
+		args = append(args, f.ThreatLevel)
+	}
+	return query, args
+}
+
+const securityEventsExportPageSize = 100
+
+// exportSecurityEvents streams security_events as NDJSON or CSV via chunked
+// transfer, pulling bulk pages of securityEventsExportPageSize rows
+// internally via a plain id keyset cursor so an export spanning millions of
+// rows never has to hold more than one page in memory. since_id reuses the
+// exact same cursor, so a SIEM tailing new events just polls this endpoint
+// with since_id set to the last id it saw.
+func (sm *SecurityMonitor) exportSecurityEvents(c *gin.Context) {
+	format := c.DefaultQuery("format", "ndjson")
+	if format != "ndjson" && format != "csv" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be ndjson or csv"})
+		return
+	}
+
+	filter := securityEventsFilterFromQuery(c)
+
+	var lastID int64
+	if raw := c.Query("since_id"); raw != "" {
+		parsed, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid since_id"})
+			return
+		}
+		lastID = parsed
+	}
+
+	var startTime, endTime time.Time
+	if raw := c.Query("start"); raw != "" {
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid start, expected RFC3339"})
+			return
+		}
+		startTime = t
+	}
+	if raw := c.Query("end"); raw != "" {
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid end, expected RFC3339"})
+			return
+		}
+		endTime = t
+	}
+
+	var csvWriter *csv.Writer
+	if format == "csv" {
+		c.Header("Content-Type", "text/csv")
+		c.Status(http.StatusOK)
+		csvWriter = csv.NewWriter(c.Writer)
+		csvWriter.Write([]string{"id", "type", "severity", "title", "description", "user_id", "ip_address", "location", "timestamp"})
+	} else {
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Status(http.StatusOK)
+	}
+
+	for {
+		query := "SELECT id, event_type, severity, description, user_id, ip_address, location, created_at FROM security_events WHERE id > ?"
+		args := []interface{}{lastID}
+		query, args = filter.apply(query, args)
+		if !startTime.IsZero() {
+			query += " AND created_at >= ?"
+			args = append(args, startTime)
+		}
+		if !endTime.IsZero() {
+			query += " AND created_at <= ?"
+			args = append(args, endTime)
+		}
+		query += " ORDER BY id ASC LIMIT ?"
+		args = append(args, securityEventsExportPageSize)
+
+		rowCount, ok := sm.streamSecurityEventsPage(c, query, args, format, csvWriter, &lastID)
+		if !ok {
+			return
+		}
+		if rowCount < securityEventsExportPageSize {
+			return
+		}
+	}
+}
+
+// streamSecurityEventsPage runs one bulk page of the export query, writing
+// each row to c.Writer as it's scanned, and reports how many rows it wrote
+// plus whether the stream is still healthy (false means the client
+// disconnected or the query failed, and the caller should stop paging).
+func (sm *SecurityMonitor) streamSecurityEventsPage(c *gin.Context, query string, args []interface{}, format string, csvWriter *csv.Writer, lastID *int64) (int, bool) {
+	rows, err := sm.db.Query(query, args...)
+	if err != nil {
+		log.Printf("⚠️  security events export: query failed: %v", err)
+		return 0, false
+	}
+	defer rows.Close()
+
+	rowCount := 0
+	for rows.Next() {
+		event, id, err := scanSecurityEvent(rows, sm.keystore)
+		if err != nil {
+			continue
+		}
+		event.Title = sm.generateAlertTitle(event.Type, event.Severity)
+		rowCount++
+		*lastID = id
+
+		if format == "csv" {
+			userID := ""
+			if event.UserID != nil {
+				userID = strconv.Itoa(*event.UserID)
+			}
+			if err := csvWriter.Write([]string{
+				event.ID, event.Type, event.Severity, event.Title, event.Description,
+				userID, event.IPAddress, event.Location, event.Timestamp.Format(time.RFC3339),
+			}); err != nil {
+				return rowCount, false
+			}
+		} else {
+			line, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			if _, err := c.Writer.Write(append(line, '\n')); err != nil {
+				return rowCount, false
+			}
+		}
+	}
+
+	if format == "csv" {
+		csvWriter.Flush()
+		if err := csvWriter.Error(); err != nil {
+			return rowCount, false
+		}
+	} else {
+		c.Writer.Flush()
+	}
+
+	return rowCount, true
+}
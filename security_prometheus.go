@@ -0,0 +1,182 @@
+// Prometheus metrics for SecurityMonitor, exposed on the same /metrics
+// endpoint secure_system.go registers via promhttp.Handler(). These
+// gauges/histogram are populated from the same queries getSecurityMetrics
+// runs for the WebSocket dashboard, so a Prometheus/Alertmanager stack sees
+// the identical numbers the built-in UI does instead of a second source of
+// truth. See deploy/prometheus/ for alert rules and a scrape config.
+package main
+
+import (
+	"log"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// staleUnresolvedAlertMinutes returns how old an unresolved security_events
+// row must be before it counts toward krili_unresolved_alerts_stale, from
+// SECURITY_STALE_ALERT_MINUTES (default 30).
+func staleUnresolvedAlertMinutes() int {
+	if v, err := strconv.Atoi(getEnv("SECURITY_STALE_ALERT_MINUTES", "")); err == nil && v > 0 {
+		return v
+	}
+	return 30
+}
+
+var (
+	securityEventsTotal = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "krili_security_events_total",
+		Help: "security_events rows in the last 24h, by event_type and severity.",
+	}, []string{"type", "severity"})
+
+	loginAttemptsTotal = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "krili_login_attempts_total",
+		Help: "login_attempts rows in the last 24h, by outcome.",
+	}, []string{"success"})
+
+	ipBlocksActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "krili_ip_blocks_active",
+		Help: "ip_reputation rows currently marked is_blocked.",
+	})
+
+	riskScoreBucket = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "krili_risk_score_bucket",
+		Help: "risk_scores rows by band (low/medium/high/critical), same thresholds as threatLevelForScore.",
+	}, []string{"bucket"})
+
+	websocketClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "krili_websocket_clients",
+		Help: "Dashboard WebSocket clients currently connected to this instance.",
+	})
+
+	unresolvedAlertsStale = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "krili_unresolved_alerts_stale",
+		Help: "security_events rows still unresolved after SECURITY_STALE_ALERT_MINUTES (default 30).",
+	})
+
+	// transactionAmountHistogram is observed live from persistTransaction
+	// rather than resampled periodically, since a periodic COUNT/SUM can't
+	// reconstruct a distribution after the fact.
+	transactionAmountHistogram = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "krili_transaction_amount",
+		Help:    "Settled payment/payout amounts (this codebase has no FX rate table, so mixed-currency amounts share one histogram).",
+		Buckets: prometheus.ExponentialBuckets(5, 2, 12), // 5 .. ~10240
+	})
+)
+
+// refreshPrometheusMetrics repopulates the gauges above from the same tables
+// getSecurityMetrics already queried for metrics, so the two views never
+// drift apart. Call on every updateMetricsPeriodically tick.
+func (sm *SecurityMonitor) refreshPrometheusMetrics(metrics *SecurityMetrics) {
+	ipBlocksActive.Set(float64(metrics.BlockedIPs))
+
+	if err := sm.refreshSecurityEventsMetric(); err != nil {
+		log.Printf("⚠️  prometheus: failed to refresh security_events_total: %v", err)
+	}
+	if err := sm.refreshLoginAttemptsMetric(); err != nil {
+		log.Printf("⚠️  prometheus: failed to refresh login_attempts_total: %v", err)
+	}
+	if err := sm.refreshRiskScoreBucketMetric(); err != nil {
+		log.Printf("⚠️  prometheus: failed to refresh risk_score_bucket: %v", err)
+	}
+	if err := sm.refreshUnresolvedAlertsStaleMetric(); err != nil {
+		log.Printf("⚠️  prometheus: failed to refresh unresolved_alerts_stale: %v", err)
+	}
+}
+
+func (sm *SecurityMonitor) refreshUnresolvedAlertsStaleMetric() error {
+	var count int
+	err := sm.db.QueryRow(`
+		SELECT COUNT(*) FROM security_events
+		WHERE resolved = false AND created_at < DATE_SUB(NOW(), INTERVAL ? MINUTE)
+	`, staleUnresolvedAlertMinutes()).Scan(&count)
+	if err != nil {
+		return err
+	}
+	unresolvedAlertsStale.Set(float64(count))
+	return nil
+}
+
+func (sm *SecurityMonitor) refreshSecurityEventsMetric() error {
+	rows, err := sm.db.Query(`
+		SELECT event_type, severity, COUNT(*) FROM security_events
+		WHERE created_at > DATE_SUB(NOW(), INTERVAL 24 HOUR)
+		GROUP BY event_type, severity
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	securityEventsTotal.Reset()
+	for rows.Next() {
+		var eventType, severity string
+		var count int
+		if err := rows.Scan(&eventType, &severity, &count); err != nil {
+			return err
+		}
+		securityEventsTotal.WithLabelValues(eventType, severity).Set(float64(count))
+	}
+	return rows.Err()
+}
+
+func (sm *SecurityMonitor) refreshLoginAttemptsMetric() error {
+	rows, err := sm.db.Query(`
+		SELECT success, COUNT(*) FROM login_attempts
+		WHERE created_at > DATE_SUB(NOW(), INTERVAL 24 HOUR)
+		GROUP BY success
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	loginAttemptsTotal.Reset()
+	for rows.Next() {
+		var success bool
+		var count int
+		if err := rows.Scan(&success, &count); err != nil {
+			return err
+		}
+		loginAttemptsTotal.WithLabelValues(boolLabel(success)).Set(float64(count))
+	}
+	return rows.Err()
+}
+
+func (sm *SecurityMonitor) refreshRiskScoreBucketMetric() error {
+	rows, err := sm.db.Query(`
+		SELECT
+			CASE
+				WHEN current_score >= 90 THEN 'critical'
+				WHEN current_score >= 70 THEN 'high'
+				WHEN current_score >= 40 THEN 'medium'
+				ELSE 'low'
+			END AS bucket,
+			COUNT(*)
+		FROM risk_scores
+		GROUP BY bucket
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	riskScoreBucket.Reset()
+	for rows.Next() {
+		var bucket string
+		var count int
+		if err := rows.Scan(&bucket, &count); err != nil {
+			return err
+		}
+		riskScoreBucket.WithLabelValues(bucket).Set(float64(count))
+	}
+	return rows.Err()
+}
+
+func boolLabel(b bool) string {
+	if b {
+		return "true"
+	}
+	return "false"
+}
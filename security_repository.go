@@ -0,0 +1,547 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/gobuffalo/pop/v6"
+)
+
+// SecurityRepository is the persistence boundary for
+// EnhancedSecurityService. It replaces the hand-written, MySQL-only SQL that
+// used to live directly on *sql.DB (CURDATE(), DATE_SUB(NOW(), INTERVAL ...),
+// STDDEV()) with methods whose SQL is either dialect-neutral or picked per
+// driver internally, so the same service code runs against SQLite in tests
+// and Postgres/MySQL/CockroachDB in production.
+type SecurityRepository interface {
+	RecordLoginAttempt(attempt *LoginAttempt) error
+	RecordSecurityEvent(event *SecurityEvent) error
+	InsertAuditEvent(entry *AuditTrailEntry) error
+	GetUserSecurityProfile(userID int) (*UserSecurityProfile, error)
+	LookupDevice(userID int, deviceID string) (*DeviceFingerprint, error)
+	GetTwoFactorSecret(userID int) (string, error)
+	RecordBiometricCredential(cred *BiometricAuth) error
+	LookupBiometricCredential(userID int, deviceID string) (*BiometricAuth, error)
+	RecordWebAuthnCredential(cred *WebAuthnCredential) error
+	ListWebAuthnCredentials(userID int) ([]WebAuthnCredential, error)
+	GetWebAuthnCredential(credentialID string) (*WebAuthnCredential, error)
+	UpdateWebAuthnSignCount(credentialID string, signCount uint32) error
+	GetDailyTransactionTotal(userID int) (float64, error)
+	GetTransactionStats(userID int, window time.Duration) (avgAmount, stdDev float64, err error)
+	LoadFraudRules() ([]FraudRule, error)
+	GetBehaviorProfile(userID int) (*UserBehaviorProfile, error)
+	SaveBehaviorProfile(profile *UserBehaviorProfile) error
+	GetRiskScore(userID int) (*RiskScore, error)
+	// SaveDeviceRisk upserts just the device_risk component of a user's
+	// risk_scores row, the one field ingestDeviceFingerprint recalculates;
+	// current_score/location_risk/behavior_risk/transaction_risk are left
+	// untouched (or defaulted by the schema) the same way the hand-rolled
+	// ON DUPLICATE KEY UPDATE this replaces never touched them either.
+	SaveDeviceRisk(userID int, deviceRisk int) error
+}
+
+// newSecurityRepository picks a SecurityRepository implementation from a DSN.
+// When dsn carries a recognized pop driver scheme it opens a pop.Connection
+// so tests can point SECURITY_REPO_DSN at sqlite while production points it
+// at Postgres/MySQL/CockroachDB. Falling back to the existing db, it degrades
+// gracefully to sqlSecurityRepository, preserving today's MySQL-only queries,
+// the same way newStateStoreFromDSN falls back to the in-process store.
+func newSecurityRepository(db *sql.DB, dsn string, keystore *KeyStore) SecurityRepository {
+	if dsn != "" {
+		conn, err := pop.NewConnection(popConnectionDetails(dsn))
+		if err == nil {
+			err = conn.Open()
+		}
+		if err == nil {
+			return newPopSecurityRepository(conn, keystore)
+		}
+		log.Printf("⚠️  pop-backed security repository unavailable (%v), falling back to direct SQL", err)
+	}
+	return &sqlSecurityRepository{db: db, keystore: keystore}
+}
+
+// popConnectionDetails maps a DSN onto the pop dialect it targets. It mirrors
+// dialectForDriver's scheme sniffing but also recognizes cockroach://, which
+// the Dialect abstraction doesn't need since Postgres-compatible SQL already
+// covers CockroachDB for schema/migration purposes.
+func popConnectionDetails(dsn string) *pop.ConnectionDetails {
+	switch {
+	case strings.HasPrefix(dsn, "cockroach://"):
+		return &pop.ConnectionDetails{Dialect: "cockroach", URL: "postgres://" + strings.TrimPrefix(dsn, "cockroach://")}
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		return &pop.ConnectionDetails{Dialect: "postgres", URL: dsn}
+	case strings.HasPrefix(dsn, "sqlite://"):
+		return &pop.ConnectionDetails{Dialect: "sqlite3", Database: strings.TrimPrefix(dsn, "sqlite://")}
+	case strings.HasSuffix(dsn, ".db"):
+		return &pop.ConnectionDetails{Dialect: "sqlite3", Database: dsn}
+	default:
+		return &pop.ConnectionDetails{Dialect: "mysql", URL: dsn}
+	}
+}
+
+// popSecurityRepository implements SecurityRepository on top of
+// gobuffalo/pop, so the driver is whatever the pop.Connection was opened
+// with instead of being hand-wired to MySQL. Date/statistics math that used
+// to be inline SQL (CURDATE(), DATE_SUB, STDDEV) now happens on cutoffs and
+// aggregates computed in Go, which behaves identically on every dialect pop
+// supports, including SQLite which has no STDDEV() of its own.
+type popSecurityRepository struct {
+	conn     *pop.Connection
+	keystore *KeyStore // envelope-encrypts biometric_auth.template_hash; nil is tolerated, see encryptColumnValue
+}
+
+func newPopSecurityRepository(conn *pop.Connection, keystore *KeyStore) *popSecurityRepository {
+	return &popSecurityRepository{conn: conn, keystore: keystore}
+}
+
+func (r *popSecurityRepository) RecordLoginAttempt(attempt *LoginAttempt) error {
+	return r.conn.Create(attempt)
+}
+
+func (r *popSecurityRepository) RecordSecurityEvent(event *SecurityEvent) error {
+	return r.conn.Create(event)
+}
+
+func (r *popSecurityRepository) InsertAuditEvent(entry *AuditTrailEntry) error {
+	return r.conn.Create(entry)
+}
+
+// GetUserSecurityProfile rolls up three independent lookups into one read.
+// Each is best-effort: a missing risk_scores/two_factor_auth row just leaves
+// that field at its zero value, matching the raw-SQL version's behavior of
+// silently ignoring sql.ErrNoRows on each individual QueryRow.
+func (r *popSecurityRepository) GetUserSecurityProfile(userID int) (*UserSecurityProfile, error) {
+	profile := &UserSecurityProfile{}
+
+	score := &RiskScore{}
+	if err := r.conn.Where("user_id = ?", userID).First(score); err == nil {
+		profile.RiskScore = score.CurrentScore
+	}
+
+	tfa := &TwoFactorAuth{}
+	if err := r.conn.Where("user_id = ?", userID).First(tfa); err == nil {
+		profile.TwoFactorEnabled = tfa.IsEnabled
+	}
+
+	var trustedDevices int
+	if err := r.conn.RawQuery(
+		"SELECT COUNT(*) FROM device_fingerprints WHERE user_id = ? AND is_trusted = true", userID,
+	).First(&trustedDevices); err == nil {
+		profile.TrustedDevices = trustedDevices
+	}
+
+	return profile, nil
+}
+
+func (r *popSecurityRepository) LookupDevice(userID int, deviceID string) (*DeviceFingerprint, error) {
+	device := &DeviceFingerprint{}
+	if err := r.conn.Where("user_id = ? AND device_id = ?", userID, deviceID).First(device); err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+func (r *popSecurityRepository) GetTwoFactorSecret(userID int) (string, error) {
+	tfa := &TwoFactorAuth{}
+	if err := r.conn.Where("user_id = ? AND is_enabled = true", userID).First(tfa); err != nil {
+		return "", err
+	}
+	return tfa.Secret, nil
+}
+
+func (r *popSecurityRepository) RecordBiometricCredential(cred *BiometricAuth) error {
+	plaintext := cred.Template
+	cred.Template = encryptColumnValue(r.keystore, plaintext)
+	err := r.conn.Create(cred)
+	cred.Template = plaintext
+	return err
+}
+
+func (r *popSecurityRepository) LookupBiometricCredential(userID int, deviceID string) (*BiometricAuth, error) {
+	cred := &BiometricAuth{}
+	if err := r.conn.Where("user_id = ? AND device_id = ? AND is_active = true", userID, deviceID).First(cred); err != nil {
+		return nil, err
+	}
+	cred.Template = decryptColumnValue(r.keystore, cred.Template)
+	return cred, nil
+}
+
+func (r *popSecurityRepository) RecordWebAuthnCredential(cred *WebAuthnCredential) error {
+	return r.conn.Create(cred)
+}
+
+func (r *popSecurityRepository) ListWebAuthnCredentials(userID int) ([]WebAuthnCredential, error) {
+	var creds []WebAuthnCredential
+	if err := r.conn.Where("user_id = ?", userID).All(&creds); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+func (r *popSecurityRepository) GetWebAuthnCredential(credentialID string) (*WebAuthnCredential, error) {
+	cred := &WebAuthnCredential{}
+	if err := r.conn.Where("credential_id = ?", credentialID).First(cred); err != nil {
+		return nil, err
+	}
+	return cred, nil
+}
+
+func (r *popSecurityRepository) UpdateWebAuthnSignCount(credentialID string, signCount uint32) error {
+	cred, err := r.GetWebAuthnCredential(credentialID)
+	if err != nil {
+		return err
+	}
+	cred.SignCount = signCount
+	return r.conn.Update(cred)
+}
+
+// GetDailyTransactionTotal sums today's completed transactions for userID.
+// The cutoff is computed here in Go rather than with CURDATE() so the raw
+// query string is valid on every pop dialect.
+func (r *popSecurityRepository) GetDailyTransactionTotal(userID int) (float64, error) {
+	startOfDay := time.Now().Truncate(24 * time.Hour)
+	var total float64
+	err := r.conn.RawQuery(
+		"SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE user_id = ? AND created_at >= ? AND status = 'completed'",
+		userID, startOfDay,
+	).First(&total)
+	if err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// GetTransactionStats returns the mean and standard deviation of a user's
+// transaction amounts over the trailing window. The aggregation happens in
+// Go instead of STDDEV() because SQLite has no built-in standard deviation
+// function, so this is the one implementation that behaves the same on
+// every supported dialect.
+func (r *popSecurityRepository) GetTransactionStats(userID int, window time.Duration) (float64, float64, error) {
+	var amounts []float64
+	err := r.conn.RawQuery(
+		"SELECT amount FROM transactions WHERE user_id = ? AND created_at > ?",
+		userID, time.Now().Add(-window),
+	).All(&amounts)
+	if err != nil {
+		return 0, 0, err
+	}
+	mean, stdDev := meanAndStdDev(amounts)
+	return mean, stdDev, nil
+}
+
+func (r *popSecurityRepository) LoadFraudRules() ([]FraudRule, error) {
+	var rules []FraudRule
+	if err := r.conn.Where("is_active = true").All(&rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// GetBehaviorProfile returns the user's rolling risk-scoring baseline, or a
+// zero-value profile (TxnCount 0) if none exists yet, so callers can treat a
+// first-ever transaction as "no baseline" instead of an error.
+func (r *popSecurityRepository) GetBehaviorProfile(userID int) (*UserBehaviorProfile, error) {
+	profile := &UserBehaviorProfile{UserID: userID}
+	err := r.conn.Where("user_id = ?", userID).First(profile)
+	if err != nil {
+		return &UserBehaviorProfile{UserID: userID}, nil
+	}
+	return profile, nil
+}
+
+// SaveBehaviorProfile upserts profile, creating the row on a user's first
+// completed transaction and updating it in place afterward.
+func (r *popSecurityRepository) SaveBehaviorProfile(profile *UserBehaviorProfile) error {
+	existing := &UserBehaviorProfile{}
+	if err := r.conn.Where("user_id = ?", profile.UserID).First(existing); err != nil {
+		return r.conn.Create(profile)
+	}
+	profile.ID = existing.ID
+	return r.conn.Update(profile)
+}
+
+// GetRiskScore returns userID's risk_scores row, or a zero-value one if
+// none has been calculated yet.
+func (r *popSecurityRepository) GetRiskScore(userID int) (*RiskScore, error) {
+	score := &RiskScore{UserID: userID}
+	if err := r.conn.Where("user_id = ?", userID).First(score); err != nil {
+		return nil, err
+	}
+	return score, nil
+}
+
+// SaveDeviceRisk upserts userID's device_risk, creating the row on a user's
+// first device fingerprint and updating it in place afterward, the same
+// load-or-create shape as SaveBehaviorProfile.
+func (r *popSecurityRepository) SaveDeviceRisk(userID int, deviceRisk int) error {
+	existing := &RiskScore{}
+	if err := r.conn.Where("user_id = ?", userID).First(existing); err != nil {
+		return r.conn.Create(&RiskScore{UserID: userID, DeviceRisk: deviceRisk, LastCalculated: time.Now()})
+	}
+	existing.DeviceRisk = deviceRisk
+	existing.LastCalculated = time.Now()
+	return r.conn.Update(existing)
+}
+
+// meanAndStdDev is split out so both the pop and direct-SQL repositories
+// compute GetTransactionStats' aggregate the same way.
+func meanAndStdDev(amounts []float64) (float64, float64) {
+	if len(amounts) == 0 {
+		return 0, 0
+	}
+	var sum float64
+	for _, a := range amounts {
+		sum += a
+	}
+	avg := sum / float64(len(amounts))
+
+	var variance float64
+	for _, a := range amounts {
+		variance += (a - avg) * (a - avg)
+	}
+	variance /= float64(len(amounts))
+	return avg, math.Sqrt(variance)
+}
+
+// sqlSecurityRepository is the pre-pop fallback: the same MySQL-flavored
+// queries EnhancedSecurityService used to run directly against *sql.DB. It
+// exists so environments without the pop dependency vendored keep working
+// exactly as before.
+type sqlSecurityRepository struct {
+	db       *sql.DB
+	keystore *KeyStore // envelope-encrypts biometric_auth.template_hash; nil is tolerated, see encryptColumnValue
+}
+
+func (r *sqlSecurityRepository) RecordLoginAttempt(attempt *LoginAttempt) error {
+	_, err := r.db.Exec(`
+		INSERT INTO login_attempts (user_id, email, ip_address, success, user_agent, location)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, attempt.UserID, attempt.Email, attempt.IPAddress, attempt.Success, attempt.UserAgent, attempt.Location)
+	return err
+}
+
+func (r *sqlSecurityRepository) RecordSecurityEvent(event *SecurityEvent) error {
+	_, err := r.db.Exec(`
+		INSERT INTO security_events
+			(user_id, event_type, severity, description, ip_address, user_agent, location,
+			 cti_score, cti_categories, cti_confidence, cti_source, metadata)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, event.UserID, event.EventType, event.Severity, event.Description, event.IPAddress, event.UserAgent, event.Location,
+		event.CTIScore, nullableString(event.CTICategories), event.CTIConfidence, nullableString(event.CTISource), nullableString(event.Metadata))
+	return err
+}
+
+func (r *sqlSecurityRepository) InsertAuditEvent(entry *AuditTrailEntry) error {
+	_, err := r.db.Exec(`
+		INSERT INTO audit_trail (user_id, action, resource_type, resource_id, old_values, new_values, ip_address, user_agent, session_id, prev_hash, entry_hash)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, entry.UserID, entry.Action, entry.ResourceType, entry.ResourceID, entry.OldValues, entry.NewValues,
+		entry.IPAddress, entry.UserAgent, entry.SessionID, entry.PrevHash, entry.EntryHash)
+	return err
+}
+
+// GetUserSecurityProfile rolls up three independent lookups into one read,
+// silently ignoring sql.ErrNoRows on each so a user with no risk_scores or
+// two_factor_auth row yet just gets that field's zero value.
+func (r *sqlSecurityRepository) GetUserSecurityProfile(userID int) (*UserSecurityProfile, error) {
+	profile := &UserSecurityProfile{}
+	r.db.QueryRow("SELECT current_score FROM risk_scores WHERE user_id = ?", userID).Scan(&profile.RiskScore)
+	r.db.QueryRow("SELECT is_enabled FROM two_factor_auth WHERE user_id = ?", userID).Scan(&profile.TwoFactorEnabled)
+	r.db.QueryRow("SELECT COUNT(*) FROM device_fingerprints WHERE user_id = ? AND is_trusted = true", userID).Scan(&profile.TrustedDevices)
+	return profile, nil
+}
+
+func (r *sqlSecurityRepository) LookupDevice(userID int, deviceID string) (*DeviceFingerprint, error) {
+	device := &DeviceFingerprint{UserID: userID, DeviceID: deviceID}
+	err := r.db.QueryRow("SELECT is_trusted FROM device_fingerprints WHERE user_id = ? AND device_id = ?",
+		userID, deviceID).Scan(&device.IsTrusted)
+	if err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+func (r *sqlSecurityRepository) GetTwoFactorSecret(userID int) (string, error) {
+	var secret string
+	err := r.db.QueryRow("SELECT secret FROM two_factor_auth WHERE user_id = ? AND is_enabled = true",
+		userID).Scan(&secret)
+	return secret, err
+}
+
+func (r *sqlSecurityRepository) RecordBiometricCredential(cred *BiometricAuth) error {
+	_, err := r.db.Exec(`
+		INSERT INTO biometric_auth (user_id, biometric_type, template_hash, device_id, is_active)
+		VALUES (?, ?, ?, ?, true)
+	`, cred.UserID, cred.BiometricType, encryptColumnValue(r.keystore, cred.Template), cred.DeviceID)
+	return err
+}
+
+func (r *sqlSecurityRepository) LookupBiometricCredential(userID int, deviceID string) (*BiometricAuth, error) {
+	cred := &BiometricAuth{UserID: userID, DeviceID: deviceID}
+	err := r.db.QueryRow("SELECT template_hash FROM biometric_auth WHERE user_id = ? AND device_id = ? AND is_active = true",
+		userID, deviceID).Scan(&cred.Template)
+	if err != nil {
+		return nil, err
+	}
+	cred.Template = decryptColumnValue(r.keystore, cred.Template)
+	return cred, nil
+}
+
+func (r *sqlSecurityRepository) RecordWebAuthnCredential(cred *WebAuthnCredential) error {
+	_, err := r.db.Exec(`
+		INSERT INTO webauthn_credentials (user_id, credential_id, public_key, algorithm, sign_count, aaguid, transports)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, cred.UserID, cred.CredentialID, cred.PublicKey, cred.Algorithm, cred.SignCount, cred.AAGUID, cred.Transports)
+	return err
+}
+
+func (r *sqlSecurityRepository) ListWebAuthnCredentials(userID int) ([]WebAuthnCredential, error) {
+	rows, err := r.db.Query(`
+		SELECT id, user_id, credential_id, public_key, algorithm, sign_count, COALESCE(aaguid, ''), COALESCE(transports, '')
+		FROM webauthn_credentials WHERE user_id = ?
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var creds []WebAuthnCredential
+	for rows.Next() {
+		var cred WebAuthnCredential
+		if err := rows.Scan(&cred.ID, &cred.UserID, &cred.CredentialID, &cred.PublicKey, &cred.Algorithm,
+			&cred.SignCount, &cred.AAGUID, &cred.Transports); err != nil {
+			return nil, err
+		}
+		creds = append(creds, cred)
+	}
+	return creds, rows.Err()
+}
+
+func (r *sqlSecurityRepository) GetWebAuthnCredential(credentialID string) (*WebAuthnCredential, error) {
+	cred := &WebAuthnCredential{}
+	err := r.db.QueryRow(`
+		SELECT id, user_id, credential_id, public_key, algorithm, sign_count, COALESCE(aaguid, ''), COALESCE(transports, '')
+		FROM webauthn_credentials WHERE credential_id = ?
+	`, credentialID).Scan(&cred.ID, &cred.UserID, &cred.CredentialID, &cred.PublicKey, &cred.Algorithm,
+		&cred.SignCount, &cred.AAGUID, &cred.Transports)
+	if err != nil {
+		return nil, err
+	}
+	return cred, nil
+}
+
+func (r *sqlSecurityRepository) UpdateWebAuthnSignCount(credentialID string, signCount uint32) error {
+	_, err := r.db.Exec("UPDATE webauthn_credentials SET sign_count = ? WHERE credential_id = ?", signCount, credentialID)
+	return err
+}
+
+func (r *sqlSecurityRepository) GetDailyTransactionTotal(userID int) (float64, error) {
+	var dailyTotal float64
+	err := r.db.QueryRow(`
+		SELECT COALESCE(SUM(amount), 0)
+		FROM transactions
+		WHERE user_id = ? AND DATE(created_at) = CURDATE() AND status = 'completed'
+	`, userID).Scan(&dailyTotal)
+	return dailyTotal, err
+}
+
+func (r *sqlSecurityRepository) GetTransactionStats(userID int, window time.Duration) (float64, float64, error) {
+	var avgAmount, stdDev float64
+	err := r.db.QueryRow(`
+		SELECT AVG(amount), STDDEV(amount)
+		FROM transactions
+		WHERE user_id = ? AND created_at > DATE_SUB(NOW(), INTERVAL ? SECOND)
+	`, userID, int(window.Seconds())).Scan(&avgAmount, &stdDev)
+	return avgAmount, stdDev, err
+}
+
+// GetBehaviorProfile returns the user's rolling risk-scoring baseline, or a
+// zero-value profile (TxnCount 0) if none exists yet, so callers can treat a
+// first-ever transaction as "no baseline" instead of an error.
+func (r *sqlSecurityRepository) GetBehaviorProfile(userID int) (*UserBehaviorProfile, error) {
+	profile := &UserBehaviorProfile{UserID: userID}
+	err := r.db.QueryRow(`
+		SELECT id, txn_count, amount_mean, amount_m2,
+			COALESCE(hour_histogram, ''), COALESCE(countries_seen, ''), COALESCE(merchant_categories, ''),
+			last_txn_at, last_latitude, last_longitude,
+			inter_arrival_ewma_mean, inter_arrival_ewma_var, geo_distance_ewma_mean, geo_distance_ewma_var
+		FROM user_behavior_profile WHERE user_id = ?
+	`, userID).Scan(&profile.ID, &profile.TxnCount, &profile.AmountMean, &profile.AmountM2,
+		&profile.HourHistogramJSON, &profile.CountriesSeenJSON, &profile.MerchantCatsJSON,
+		&profile.LastTxnAt, &profile.LastLatitude, &profile.LastLongitude,
+		&profile.InterArrivalEWMAMean, &profile.InterArrivalEWMAVar, &profile.GeoDistanceEWMAMean, &profile.GeoDistanceEWMAVar)
+	if err != nil {
+		return &UserBehaviorProfile{UserID: userID}, nil
+	}
+	return profile, nil
+}
+
+// SaveBehaviorProfile upserts profile, creating the row on a user's first
+// completed transaction and updating it in place afterward.
+func (r *sqlSecurityRepository) SaveBehaviorProfile(profile *UserBehaviorProfile) error {
+	_, err := r.db.Exec(`
+		INSERT INTO user_behavior_profile
+			(user_id, txn_count, amount_mean, amount_m2, hour_histogram, countries_seen, merchant_categories,
+			 last_txn_at, last_latitude, last_longitude,
+			 inter_arrival_ewma_mean, inter_arrival_ewma_var, geo_distance_ewma_mean, geo_distance_ewma_var)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			txn_count = VALUES(txn_count), amount_mean = VALUES(amount_mean), amount_m2 = VALUES(amount_m2),
+			hour_histogram = VALUES(hour_histogram), countries_seen = VALUES(countries_seen),
+			merchant_categories = VALUES(merchant_categories),
+			last_txn_at = VALUES(last_txn_at), last_latitude = VALUES(last_latitude), last_longitude = VALUES(last_longitude),
+			inter_arrival_ewma_mean = VALUES(inter_arrival_ewma_mean), inter_arrival_ewma_var = VALUES(inter_arrival_ewma_var),
+			geo_distance_ewma_mean = VALUES(geo_distance_ewma_mean), geo_distance_ewma_var = VALUES(geo_distance_ewma_var)
+	`, profile.UserID, profile.TxnCount, profile.AmountMean, profile.AmountM2,
+		profile.HourHistogramJSON, profile.CountriesSeenJSON, profile.MerchantCatsJSON,
+		profile.LastTxnAt, profile.LastLatitude, profile.LastLongitude,
+		profile.InterArrivalEWMAMean, profile.InterArrivalEWMAVar, profile.GeoDistanceEWMAMean, profile.GeoDistanceEWMAVar)
+	return err
+}
+
+func (r *sqlSecurityRepository) GetRiskScore(userID int) (*RiskScore, error) {
+	score := &RiskScore{UserID: userID}
+	err := r.db.QueryRow(`
+		SELECT id, current_score, location_risk, device_risk, behavior_risk, transaction_risk, last_calculated
+		FROM risk_scores WHERE user_id = ?
+	`, userID).Scan(&score.ID, &score.CurrentScore, &score.LocationRisk, &score.DeviceRisk,
+		&score.BehaviorRisk, &score.TransactionRisk, &score.LastCalculated)
+	if err != nil {
+		return nil, err
+	}
+	return score, nil
+}
+
+func (r *sqlSecurityRepository) SaveDeviceRisk(userID int, deviceRisk int) error {
+	_, err := r.db.Exec(`
+		INSERT INTO risk_scores (user_id, device_risk, last_calculated)
+		VALUES (?, ?, NOW())
+		ON DUPLICATE KEY UPDATE device_risk = VALUES(device_risk), last_calculated = NOW()
+	`, userID, deviceRisk)
+	return err
+}
+
+func (r *sqlSecurityRepository) LoadFraudRules() ([]FraudRule, error) {
+	rows, err := r.db.Query(`
+		SELECT id, rule_name, rule_type, threshold, time_window, action, severity, is_active, description, rule_config
+		FROM fraud_rules WHERE is_active = true
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []FraudRule
+	for rows.Next() {
+		var rule FraudRule
+		if err := rows.Scan(&rule.ID, &rule.RuleName, &rule.RuleType, &rule.Threshold, &rule.TimeWindow,
+			&rule.Action, &rule.Severity, &rule.IsActive, &rule.Description, &rule.RuleConfig); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// FraudContext is the read-only view of a security event (login, MFA
+// verification, device registration, ...) that RuleEvaluators evaluate
+// against -- the auth-event counterpart to fraud_engine.go's
+// transaction-scoped TxContext.
+type FraudContext struct {
+	UserID      int
+	EventType   string
+	Severity    string
+	IPAddress   string
+	Country     string
+	Latitude    float64
+	Longitude   float64
+	DeviceID    string
+	IsNewDevice bool
+	Timestamp   time.Time
+}
+
+// SecurityRuleResult is what SecurityRuleEngine.Evaluate returns: which
+// rules fired and the single most severe action the caller should take.
+type SecurityRuleResult struct {
+	TriggeredRules []string
+	Action         string // block, challenge_mfa, notify, flag, review, alert, allow
+	Severity       string
+}
+
+// RuleEvaluator is one fraud_rules row compiled into something that can
+// decide whether a FraudContext trips it.
+type RuleEvaluator interface {
+	Rule() FraudRule
+	Evaluate(ctx FraudContext) (bool, error)
+}
+
+// VelocityRule fires when more than Rule().Threshold events pass matches
+// for the same user within Rule().TimeWindow. Counts live in a StateStore
+// keyed by rule and user; newStateStoreFromDSN only returns the in-process
+// sliding-window store, so each API instance keeps its own count.
+type VelocityRule struct {
+	rule    FraudRule
+	store   StateStore
+	matches func(FraudContext) bool
+}
+
+// NewVelocityRule builds a VelocityRule. matches decides which events count
+// toward the window; pass a predicate that always returns true to count
+// every security event for the user regardless of type.
+func NewVelocityRule(rule FraudRule, store StateStore, matches func(FraudContext) bool) *VelocityRule {
+	return &VelocityRule{rule: rule, store: store, matches: matches}
+}
+
+func (r *VelocityRule) Rule() FraudRule { return r.rule }
+
+func (r *VelocityRule) Evaluate(ctx FraudContext) (bool, error) {
+	if !r.matches(ctx) {
+		return false, nil
+	}
+	key := fmt.Sprintf("security_rule:%d:%d", r.rule.ID, ctx.UserID)
+	window := time.Duration(r.rule.TimeWindow) * time.Second
+	count, err := r.store.IncrementAndGet(key, window)
+	if err != nil {
+		return false, err
+	}
+	return float64(count) > r.rule.Threshold, nil
+}
+
+// geoObservation is the last place and time GeoVelocityRule saw a user
+// authenticate from, used to derive the speed "impossible travel" implies.
+type geoObservation struct {
+	at        time.Time
+	latitude  float64
+	longitude float64
+}
+
+// GeoVelocityRule fires when two consecutive auth events for the same user
+// imply travel faster than Rule().Threshold km/h. It keeps the last
+// observation per user in memory rather than in StateStore, since that
+// interface only models counters and sessions; losing this state on a
+// restart just means one missed comparison, not a security hole.
+type GeoVelocityRule struct {
+	rule  FraudRule
+	mutex sync.Mutex
+	last  map[int]geoObservation
+}
+
+func NewGeoVelocityRule(rule FraudRule) *GeoVelocityRule {
+	return &GeoVelocityRule{rule: rule, last: make(map[int]geoObservation)}
+}
+
+func (r *GeoVelocityRule) Rule() FraudRule { return r.rule }
+
+func (r *GeoVelocityRule) Evaluate(ctx FraudContext) (bool, error) {
+	r.mutex.Lock()
+	prev, seen := r.last[ctx.UserID]
+	r.last[ctx.UserID] = geoObservation{at: ctx.Timestamp, latitude: ctx.Latitude, longitude: ctx.Longitude}
+	r.mutex.Unlock()
+
+	if !seen {
+		return false, nil
+	}
+	elapsedHours := ctx.Timestamp.Sub(prev.at).Hours()
+	if elapsedHours <= 0 {
+		return false, nil
+	}
+	kmh := haversineKM(prev.latitude, prev.longitude, ctx.Latitude, ctx.Longitude) / elapsedHours
+	return kmh > r.rule.Threshold, nil
+}
+
+// haversineKM returns the great-circle distance in kilometers between two
+// lat/lon points.
+func haversineKM(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadiusKM = 6371.0
+	dLat := (lat2 - lat1) * math.Pi / 180
+	dLon := (lon2 - lon1) * math.Pi / 180
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*math.Pi/180)*math.Cos(lat2*math.Pi/180)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return earthRadiusKM * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// NewDeviceRule fires the first time a user authenticates from a device
+// isDeviceTrusted hasn't seen before.
+type NewDeviceRule struct {
+	rule FraudRule
+}
+
+func NewNewDeviceRule(rule FraudRule) *NewDeviceRule { return &NewDeviceRule{rule: rule} }
+
+func (r *NewDeviceRule) Rule() FraudRule { return r.rule }
+
+func (r *NewDeviceRule) Evaluate(ctx FraudContext) (bool, error) {
+	return ctx.IsNewDevice, nil
+}
+
+// securityPredicateNode mirrors fraud_engine.go's predicateNode but
+// evaluates against FraudContext, letting an operator express rules like
+//
+//	{"all": [{"predicate": "event_type_is", "params": {"value": "login_failed"}},
+//	         {"predicate": "country_in", "params": {"countries": ["NG", "RU"]}}]}
+//
+// in a fraud_rules.rule_config column without a Go change.
+type securityPredicateNode struct {
+	Predicate string                  `json:"predicate"`
+	Params    map[string]interface{}  `json:"params"`
+	All       []securityPredicateNode `json:"all"`
+	Any       []securityPredicateNode `json:"any"`
+	Not       *securityPredicateNode  `json:"not"`
+}
+
+func (n securityPredicateNode) evaluate(ctx FraudContext) bool {
+	switch {
+	case len(n.All) > 0:
+		for _, child := range n.All {
+			if !child.evaluate(ctx) {
+				return false
+			}
+		}
+		return true
+	case len(n.Any) > 0:
+		for _, child := range n.Any {
+			if child.evaluate(ctx) {
+				return true
+			}
+		}
+		return false
+	case n.Not != nil:
+		return !n.Not.evaluate(ctx)
+	case n.Predicate != "":
+		fn, ok := securityPredicateLibrary[n.Predicate]
+		if !ok {
+			log.Printf("⚠️  security rule engine: unknown predicate %q, treating as non-match", n.Predicate)
+			return false
+		}
+		return fn(ctx, n.Params)
+	default:
+		return false
+	}
+}
+
+// securityPredicateLibrary is the small standard library of named
+// predicates rule authors can reference from rule_config without writing
+// Go, the FraudContext counterpart to fraud_engine.go's predicateLibrary.
+var securityPredicateLibrary = map[string]func(ctx FraudContext, params map[string]interface{}) bool{
+	"event_type_is": func(ctx FraudContext, params map[string]interface{}) bool {
+		value, _ := params["value"].(string)
+		return ctx.EventType == value
+	},
+	"country_in": func(ctx FraudContext, params map[string]interface{}) bool {
+		countries, _ := params["countries"].([]interface{})
+		for _, c := range countries {
+			if code, ok := c.(string); ok && code == ctx.Country {
+				return true
+			}
+		}
+		return false
+	},
+	"new_device": func(ctx FraudContext, params map[string]interface{}) bool {
+		return ctx.IsNewDevice
+	},
+}
+
+// ExpressionRule evaluates a rule whose RuleConfig column holds a JSON
+// securityPredicateNode tree -- the security-event counterpart of
+// fraud_engine.go's compiledFraudRule, for operators who need something
+// richer than VelocityRule/GeoVelocityRule/NewDeviceRule.
+type ExpressionRule struct {
+	rule FraudRule
+	node securityPredicateNode
+}
+
+// NewExpressionRule parses rule.RuleConfig as a securityPredicateNode tree.
+func NewExpressionRule(rule FraudRule) (*ExpressionRule, error) {
+	if !rule.RuleConfig.Valid {
+		return nil, fmt.Errorf("rule %q has no rule_config", rule.RuleName)
+	}
+	var node securityPredicateNode
+	if err := json.Unmarshal([]byte(rule.RuleConfig.String), &node); err != nil {
+		return nil, fmt.Errorf("rule %q has invalid rule_config: %v", rule.RuleName, err)
+	}
+	return &ExpressionRule{rule: rule, node: node}, nil
+}
+
+func (r *ExpressionRule) Rule() FraudRule { return r.rule }
+
+func (r *ExpressionRule) Evaluate(ctx FraudContext) (bool, error) {
+	return r.node.evaluate(ctx), nil
+}
+
+// SecurityRuleEngine compiles fraud_rules rows into RuleEvaluators and runs
+// every active one against a FraudContext on every security event, rather
+// than logSecurityEvent only alerting when a caller passed severity
+// "critical". It reloads on an interval or immediately via TriggerReload, so
+// an operator editing a rule doesn't require a restart.
+type SecurityRuleEngine struct {
+	repo     SecurityRepository
+	store    StateStore
+	mutex    sync.RWMutex
+	rules    []RuleEvaluator
+	stop     chan struct{}
+	reloadCh chan struct{}
+}
+
+// NewSecurityRuleEngine loads the current rule set and returns an engine
+// ready to Evaluate. Call Start to begin watching for changes.
+func NewSecurityRuleEngine(repo SecurityRepository, store StateStore) *SecurityRuleEngine {
+	engine := &SecurityRuleEngine{
+		repo:     repo,
+		store:    store,
+		stop:     make(chan struct{}),
+		reloadCh: make(chan struct{}, 1),
+	}
+	engine.reload()
+	return engine
+}
+
+// Start launches the background goroutine that recompiles rules on an
+// interval, or immediately whenever TriggerReload is called.
+func (e *SecurityRuleEngine) Start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				e.reload()
+			case <-e.reloadCh:
+				e.reload()
+			case <-e.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (e *SecurityRuleEngine) Stop() {
+	close(e.stop)
+}
+
+// TriggerReload asks the engine to recompile its rule set now instead of
+// waiting for the next interval tick, so an admin-initiated rule edit takes
+// effect immediately.
+func (e *SecurityRuleEngine) TriggerReload() {
+	select {
+	case e.reloadCh <- struct{}{}:
+	default:
+		// a reload is already pending, no need to queue another
+	}
+}
+
+// reload loads fraud_rules and compiles each into the RuleEvaluator its
+// rule_type implies. A row that fails to compile (e.g. bad rule_config
+// JSON) is skipped with a warning rather than aborting the whole reload.
+func (e *SecurityRuleEngine) reload() {
+	fraudRules, err := e.repo.LoadFraudRules()
+	if err != nil {
+		log.Printf("⚠️  security rule engine: failed to load rules: %v", err)
+		return
+	}
+
+	var compiled []RuleEvaluator
+	for _, rule := range fraudRules {
+		evaluator, err := compileSecurityRule(rule, e.store)
+		if err != nil {
+			log.Printf("⚠️  security rule engine: skipping rule %q: %v", rule.RuleName, err)
+			continue
+		}
+		compiled = append(compiled, evaluator)
+	}
+
+	e.mutex.Lock()
+	e.rules = compiled
+	e.mutex.Unlock()
+}
+
+// compileSecurityRule picks the RuleEvaluator a fraud_rules row's rule_type
+// implies: "pattern" rows get an ExpressionRule off their rule_config,
+// "location" rows get the impossible-travel GeoVelocityRule, "device" rows
+// get NewDeviceRule, and everything else (amount, frequency, velocity) gets
+// a VelocityRule counting every matching event.
+func compileSecurityRule(rule FraudRule, store StateStore) (RuleEvaluator, error) {
+	switch rule.RuleType {
+	case "pattern":
+		return NewExpressionRule(rule)
+	case "location":
+		return NewGeoVelocityRule(rule), nil
+	case "device":
+		return NewNewDeviceRule(rule), nil
+	default:
+		if rule.TimeWindow <= 0 {
+			return nil, fmt.Errorf("velocity rule requires a positive time_window")
+		}
+		return NewVelocityRule(rule, store, func(FraudContext) bool { return true }), nil
+	}
+}
+
+// Evaluate runs every compiled rule against ctx and returns the triggered
+// rule names plus the single most severe action across all of them, using
+// the same action-priority ordering fraud_engine.go's FraudRuleEngine uses.
+func (e *SecurityRuleEngine) Evaluate(ctx FraudContext) SecurityRuleResult {
+	e.mutex.RLock()
+	rules := e.rules
+	e.mutex.RUnlock()
+
+	result := SecurityRuleResult{Action: "allow", Severity: "low"}
+	bestPriority := actionPriority["allow"]
+
+	for _, evaluator := range rules {
+		triggered, err := evaluator.Evaluate(ctx)
+		if err != nil {
+			log.Printf("⚠️  security rule engine: rule %q failed to evaluate: %v", evaluator.Rule().RuleName, err)
+			continue
+		}
+		if !triggered {
+			continue
+		}
+		rule := evaluator.Rule()
+		result.TriggeredRules = append(result.TriggeredRules, rule.RuleName)
+		if priority, ok := actionPriority[rule.Action]; ok && priority > bestPriority {
+			bestPriority = priority
+			result.Action = rule.Action
+			result.Severity = rule.Severity
+		}
+	}
+
+	return result
+}
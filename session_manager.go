@@ -0,0 +1,344 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SessionRecord is one live login session. A JWT issued at login carries its
+// sid as a claim, turning the token into an opaque reference instead of a
+// stateless bag of claims that can never be revoked once handed out.
+type SessionRecord struct {
+	SID       string                 `json:"sid"`
+	UserID    int                    `json:"user_id"`
+	CSRFToken string                 `json:"-"`
+	DeviceID  string                 `json:"device_id"`
+	IPAddress string                 `json:"ip_address"`
+	UserAgent string                 `json:"user_agent"`
+	Location  string                 `json:"location"`
+	IsActive  bool                   `json:"is_active"`
+	CreatedAt time.Time              `json:"created_at"`
+	ExpiresAt time.Time              `json:"expires_at"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+}
+
+// SessionProvider is the storage backend a SessionManager delegates to.
+// Create/Read/Update/Destroy manage a single session by its sid; DestroyByUser
+// revokes every session a user holds at once, for logout-everywhere, password
+// reset, and admin lock flows; GC reclaims sessions past ExpiresAt for
+// providers that don't expire entries lazily on their own.
+type SessionProvider interface {
+	Create(session *SessionRecord) error
+	Read(sid string) (*SessionRecord, error)
+	Update(session *SessionRecord) error
+	Destroy(sid string) error
+	DestroyByUser(userID int) error
+	ListByUser(userID int) ([]*SessionRecord, error)
+	GC() error
+}
+
+// SessionManager is the single place enhancedAuthMiddleware/adminAuthMiddleware
+// and the /security/sessions endpoints go through to create, look up, and
+// revoke sessions, regardless of which SessionProvider is actually storing
+// them underneath.
+type SessionManager struct {
+	provider SessionProvider
+}
+
+// NewSessionManager wraps provider in a SessionManager.
+func NewSessionManager(provider SessionProvider) *SessionManager {
+	return &SessionManager{provider: provider}
+}
+
+// NewSID generates a new, cryptographically random session identifier, the
+// same shape CreateAPIKey uses for its raw key.
+func NewSID() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+func (m *SessionManager) Create(session *SessionRecord) error { return m.provider.Create(session) }
+
+func (m *SessionManager) Read(sid string) (*SessionRecord, error) { return m.provider.Read(sid) }
+
+func (m *SessionManager) Update(session *SessionRecord) error { return m.provider.Update(session) }
+
+func (m *SessionManager) Destroy(sid string) error { return m.provider.Destroy(sid) }
+
+// DestroyByUser kills every session userID holds, for logout-everywhere,
+// password reset, and admin lock flows once those call sites exist.
+func (m *SessionManager) DestroyByUser(userID int) error { return m.provider.DestroyByUser(userID) }
+
+// ListByUser returns userID's currently live sessions, for the
+// /security/sessions dashboard a user sees their own active logins in.
+func (m *SessionManager) ListByUser(userID int) ([]*SessionRecord, error) {
+	return m.provider.ListByUser(userID)
+}
+
+func (m *SessionManager) GC() error { return m.provider.GC() }
+
+// gcLoop sweeps expired sessions from the provider on interval until stop
+// fires, the same shape shardedTTLCache.runJanitor uses for the other
+// process-local caches.
+func (m *SessionManager) gcLoop(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.GC(); err != nil {
+				log.Printf("⚠️  Session GC failed: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// memSessionProvider is the in-process fallback for dev/test environments
+// that don't run Redis or want a durable MySQL-backed session table. Sessions
+// live only as long as this process does.
+type memSessionProvider struct {
+	mutex    sync.Mutex
+	sessions map[string]*SessionRecord
+}
+
+func newMemSessionProvider() *memSessionProvider {
+	return &memSessionProvider{sessions: make(map[string]*SessionRecord)}
+}
+
+func (p *memSessionProvider) Create(session *SessionRecord) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.sessions[session.SID] = session
+	return nil
+}
+
+func (p *memSessionProvider) Read(sid string) (*SessionRecord, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	session, ok := p.sessions[sid]
+	if !ok {
+		return nil, fmt.Errorf("session not found")
+	}
+	if !session.IsActive || time.Now().After(session.ExpiresAt) {
+		return nil, fmt.Errorf("session not found or expired")
+	}
+	return session, nil
+}
+
+func (p *memSessionProvider) Update(session *SessionRecord) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if _, ok := p.sessions[session.SID]; !ok {
+		return fmt.Errorf("session not found")
+	}
+	p.sessions[session.SID] = session
+	return nil
+}
+
+func (p *memSessionProvider) Destroy(sid string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if session, ok := p.sessions[sid]; ok {
+		session.IsActive = false
+	}
+	return nil
+}
+
+func (p *memSessionProvider) DestroyByUser(userID int) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, session := range p.sessions {
+		if session.UserID == userID {
+			session.IsActive = false
+		}
+	}
+	return nil
+}
+
+func (p *memSessionProvider) ListByUser(userID int) ([]*SessionRecord, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := time.Now()
+	var sessions []*SessionRecord
+	for _, session := range p.sessions {
+		if session.UserID == userID && session.IsActive && now.Before(session.ExpiresAt) {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+func (p *memSessionProvider) GC() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := time.Now()
+	for sid, session := range p.sessions {
+		if now.After(session.ExpiresAt) {
+			delete(p.sessions, sid)
+		}
+	}
+	return nil
+}
+
+// sqlSessionProvider backs sessions with the secure_sessions table so they
+// survive a process restart, matching the role MySQL already played there
+// before anything actually wrote to it.
+type sqlSessionProvider struct {
+	db *sql.DB
+}
+
+func newSQLSessionProvider(db *sql.DB) *sqlSessionProvider {
+	return &sqlSessionProvider{db: db}
+}
+
+func (p *sqlSessionProvider) Create(session *SessionRecord) error {
+	dataJSON, err := json.Marshal(session.Data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal session data: %v", err)
+	}
+
+	_, err = p.db.Exec(`
+		INSERT INTO secure_sessions (user_id, session_token, csrf_token, device_id, ip_address, user_agent, location, is_active, expires_at, data)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, session.UserID, session.SID, session.CSRFToken, session.DeviceID, session.IPAddress, session.UserAgent,
+		session.Location, session.IsActive, session.ExpiresAt, string(dataJSON))
+	return err
+}
+
+func (p *sqlSessionProvider) Read(sid string) (*SessionRecord, error) {
+	session := &SessionRecord{SID: sid}
+	var dataJSON sql.NullString
+	err := p.db.QueryRow(`
+		SELECT user_id, csrf_token, device_id, ip_address, user_agent, location, is_active, expires_at, created_at, data
+		FROM secure_sessions WHERE session_token = ?
+	`, sid).Scan(&session.UserID, &session.CSRFToken, &session.DeviceID, &session.IPAddress, &session.UserAgent,
+		&session.Location, &session.IsActive, &session.ExpiresAt, &session.CreatedAt, &dataJSON)
+	if err != nil {
+		return nil, err
+	}
+	if !session.IsActive || time.Now().After(session.ExpiresAt) {
+		return nil, fmt.Errorf("session not found or expired")
+	}
+	unmarshalSessionData(session, dataJSON)
+	return session, nil
+}
+
+func (p *sqlSessionProvider) Update(session *SessionRecord) error {
+	dataJSON, err := json.Marshal(session.Data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal session data: %v", err)
+	}
+
+	result, err := p.db.Exec(`
+		UPDATE secure_sessions
+		SET is_active = ?, expires_at = ?, ip_address = ?, user_agent = ?, location = ?, data = ?
+		WHERE session_token = ?
+	`, session.IsActive, session.ExpiresAt, session.IPAddress, session.UserAgent, session.Location,
+		string(dataJSON), session.SID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return fmt.Errorf("session not found")
+	}
+	return nil
+}
+
+func (p *sqlSessionProvider) Destroy(sid string) error {
+	_, err := p.db.Exec("UPDATE secure_sessions SET is_active = FALSE WHERE session_token = ?", sid)
+	return err
+}
+
+func (p *sqlSessionProvider) DestroyByUser(userID int) error {
+	_, err := p.db.Exec("UPDATE secure_sessions SET is_active = FALSE WHERE user_id = ?", userID)
+	return err
+}
+
+func (p *sqlSessionProvider) ListByUser(userID int) ([]*SessionRecord, error) {
+	rows, err := p.db.Query(`
+		SELECT session_token, csrf_token, device_id, ip_address, user_agent, location, is_active, expires_at, created_at, data
+		FROM secure_sessions WHERE user_id = ? AND is_active = TRUE AND expires_at > NOW()
+		ORDER BY created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*SessionRecord
+	for rows.Next() {
+		session := &SessionRecord{UserID: userID}
+		var dataJSON sql.NullString
+		if err := rows.Scan(&session.SID, &session.CSRFToken, &session.DeviceID, &session.IPAddress, &session.UserAgent,
+			&session.Location, &session.IsActive, &session.ExpiresAt, &session.CreatedAt, &dataJSON); err != nil {
+			return nil, err
+		}
+		unmarshalSessionData(session, dataJSON)
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// GC deletes sessions that expired more than a day ago; the window leaves
+// recently-expired rows in place briefly for /security/audit and dashboard
+// lookbacks before they're reclaimed.
+func (p *sqlSessionProvider) GC() error {
+	_, err := p.db.Exec("DELETE FROM secure_sessions WHERE expires_at < ?", time.Now().Add(-24*time.Hour))
+	return err
+}
+
+func unmarshalSessionData(session *SessionRecord, dataJSON sql.NullString) {
+	if !dataJSON.Valid || dataJSON.String == "" {
+		return
+	}
+	if err := json.Unmarshal([]byte(dataJSON.String), &session.Data); err != nil {
+		log.Printf("⚠️  Failed to unmarshal session data for %s: %v", session.SID, err)
+	}
+}
+
+// newSessionProviderFromDSN picks a SessionProvider from a DSN: Redis
+// ("redis://", "redis+sentinel://") so every instance in a deployment sees
+// the same revocations, the secure_sessions table (db) when no DSN is set so
+// sessions survive a process restart, or the in-memory provider for
+// SESSION_STORE_DSN=mem:// in tests/dev where restart-durability doesn't
+// matter. The Redis implementation itself (session hashes plus a per-user
+// SID set for DestroyByUser/ListByUser) lives behind a build-tagged file once
+// the redis client dependency is vendored; until then this degrades
+// gracefully to the SQL-backed provider.
+func newSessionProviderFromDSN(db *sql.DB, dsn string) SessionProvider {
+	if strings.HasPrefix(dsn, "redis://") || strings.HasPrefix(dsn, "redis+sentinel://") {
+		// TODO: dial go-redis here and return a *redisSessionProvider once the
+		// dependency is available in this environment.
+	}
+	if dsn == "mem://" {
+		return newMemSessionProvider()
+	}
+	return newSQLSessionProvider(db)
+}
+
+// initializeSessionDataColumn adds the free-form data column SessionRecord
+// stores arbitrary per-session state in, for deployments whose secure_sessions
+// table predates this feature; a fresh CREATE TABLE already includes it.
+func initializeSessionDataColumn(db *sql.DB) error {
+	if _, err := db.Exec(`ALTER TABLE secure_sessions
+		ADD COLUMN IF NOT EXISTS data JSON`); err != nil {
+		return fmt.Errorf("failed to add data column to secure_sessions: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// cacheShardCount controls how many independent locks the sharded caches
+// split across. 256 keeps contention low without the bookkeeping overhead
+// ballooning for the modest per-process key counts these caches see
+// (per-IP and per-device, not per-request).
+const cacheShardCount = 256
+
+var (
+	cacheEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "krili_security_cache_entries",
+		Help: "Current number of live entries in a sharded security cache.",
+	}, []string{"cache"})
+	cacheEvictionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "krili_security_cache_evictions_total",
+		Help: "Entries evicted from a sharded security cache, by reason (expired, capacity).",
+	}, []string{"cache", "reason"})
+	blockedIPHitsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "krili_security_blocked_ip_hits_total",
+		Help: "Requests rejected because the source IP was already blocked.",
+	})
+	rateLimitRejectionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "krili_security_rate_limit_rejections_total",
+		Help: "Requests rejected by the rate limit backend.",
+	})
+)
+
+type cacheEntry struct {
+	key       string
+	value     interface{}
+	expiresAt time.Time
+	elem      *list.Element
+}
+
+type cacheShard struct {
+	mutex      sync.Mutex
+	entries    map[string]*cacheEntry
+	lru        *list.List
+	maxEntries int
+}
+
+// shardedTTLCache replaces the unbounded maps (rateLimiters, blockedIPs,
+// loginAttempts, deviceCache) that used to live directly on
+// EnhancedSecurityService and grow for as long as the process ran. Keys are
+// hashed into one of cacheShardCount independent LRU+TTL shards so that (a)
+// no single mutex serializes every IP in the system and (b) a shard sheds
+// its least-recently-used entries once it hits maxEntriesPerShard, bounding
+// memory regardless of how many distinct IPs/devices are ever seen.
+type shardedTTLCache struct {
+	name               string
+	maxEntriesPerShard int
+	shards             [cacheShardCount]*cacheShard
+}
+
+func newShardedTTLCache(name string, maxEntriesPerShard int) *shardedTTLCache {
+	c := &shardedTTLCache{name: name, maxEntriesPerShard: maxEntriesPerShard}
+	for i := range c.shards {
+		c.shards[i] = &cacheShard{
+			entries:    make(map[string]*cacheEntry),
+			lru:        list.New(),
+			maxEntries: maxEntriesPerShard,
+		}
+	}
+	return c
+}
+
+func (c *shardedTTLCache) shardFor(key string) *cacheShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return c.shards[h.Sum32()%cacheShardCount]
+}
+
+// Get returns the cached value for key, or (nil, false) if it's missing or
+// expired. An expired entry is evicted on read rather than left for the
+// janitor, so a long-idle shard can't serve stale blocks between sweeps.
+func (c *shardedTTLCache) Get(key string) (interface{}, bool) {
+	shard := c.shardFor(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	entry, ok := shard.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expiresAt) {
+		shard.removeLocked(entry)
+		cacheEvictionsTotal.WithLabelValues(c.name, "expired").Inc()
+		return nil, false
+	}
+	shard.lru.MoveToFront(entry.elem)
+	return entry.value, true
+}
+
+// Set stores value under key with the given TTL, evicting the shard's
+// least-recently-used entry if this insert would exceed maxEntriesPerShard.
+func (c *shardedTTLCache) Set(key string, value interface{}, ttl time.Duration) {
+	shard := c.shardFor(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if entry, ok := shard.entries[key]; ok {
+		entry.value = value
+		entry.expiresAt = time.Now().Add(ttl)
+		shard.lru.MoveToFront(entry.elem)
+		return
+	}
+
+	entry := &cacheEntry{key: key, value: value, expiresAt: time.Now().Add(ttl)}
+	entry.elem = shard.lru.PushFront(entry)
+	shard.entries[key] = entry
+
+	if shard.maxEntries > 0 && len(shard.entries) > shard.maxEntries {
+		oldest := shard.lru.Back()
+		if oldest != nil {
+			shard.removeLocked(oldest.Value.(*cacheEntry))
+			cacheEvictionsTotal.WithLabelValues(c.name, "capacity").Inc()
+		}
+	}
+}
+
+// Delete removes key if present. Used where a map used to support deletion
+// of expired entries inline (e.g. an IP whose block has already lapsed).
+func (c *shardedTTLCache) Delete(key string) {
+	shard := c.shardFor(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	if entry, ok := shard.entries[key]; ok {
+		shard.removeLocked(entry)
+	}
+}
+
+func (shard *cacheShard) removeLocked(entry *cacheEntry) {
+	delete(shard.entries, entry.key)
+	shard.lru.Remove(entry.elem)
+}
+
+// runJanitor sweeps every shard on interval, evicting anything that expired
+// since the last sweep and publishing current occupancy, until stop fires.
+// Idle rate limiters and lapsed IP blocks are otherwise only reclaimed when
+// something happens to touch that exact key again, which for a blocked
+// attacker who gave up is never.
+func (c *shardedTTLCache) runJanitor(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.sweep()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (c *shardedTTLCache) sweep() {
+	now := time.Now()
+	var occupancy float64
+	for _, shard := range c.shards {
+		shard.mutex.Lock()
+		for _, entry := range shard.entries {
+			if now.After(entry.expiresAt) {
+				shard.removeLocked(entry)
+				cacheEvictionsTotal.WithLabelValues(c.name, "expired").Inc()
+			}
+		}
+		occupancy += float64(len(shard.entries))
+		shard.mutex.Unlock()
+	}
+	cacheEntries.WithLabelValues(c.name).Set(occupancy)
+}
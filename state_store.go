@@ -0,0 +1,184 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StateStore abstracts the hot-path counters that today hit MySQL on every
+// request (rate_limits, transaction_velocity). The only implementation is
+// *inProcessStateStore, which keeps them in process memory and writes
+// nothing back to MySQL. Session lookups used to live here too; they're now
+// SessionManager/SessionProvider's job, see session_manager.go.
+type StateStore interface {
+	// IncrementAndGet atomically increments the counter for key within window
+	// and returns the new count, used for rate limiting and velocity checks.
+	IncrementAndGet(key string, window time.Duration) (int64, error)
+	// PeekCount returns the current count for key within window without
+	// recording a new occurrence, used by read-only diagnostics (e.g.
+	// /security/risk-explain) that must not perturb the live counters.
+	PeekCount(key string, window time.Duration) (int64, error)
+	// VelocityAdd records amount under key (see transactionVelocityKey in
+	// fraud_engine.go — one key per user+window, mirroring riskVelocityKey's
+	// namespacing so windows don't share and corrupt a single sliding-window
+	// set) and returns the transaction count and total amount inside window
+	// after recording it. txType ("payment"/"payout") rides along so a future
+	// Redis implementation can store it in the sorted-set member's value
+	// without changing this signature again.
+	VelocityAdd(key string, amount float64, txType string, window time.Duration) (count int64, total float64, err error)
+	// PeekVelocity is VelocityAdd's read-only counterpart: it returns the
+	// count/total for key within window without recording a new amount, so a
+	// caller that already recorded the transaction once (checkTransactionLimits)
+	// can read the other windows back without double-counting it.
+	PeekVelocity(key string, window time.Duration) (count int64, total float64, err error)
+	// IsBlocked reports whether ip is currently under a shared block, so a
+	// block set by one API instance is visible to every other instance
+	// instead of only the process that issued it.
+	IsBlocked(ip string) (bool, error)
+	// SetBlocked puts ip under a shared block for ttl, propagated to every
+	// instance reading the same store instead of staying local to one
+	// process's blockedIPCache.
+	SetBlocked(ip string, ttl time.Duration) error
+}
+
+// inProcessStateStore is the in-process fallback for dev/test environments
+// that don't run Redis. It implements the same sliding-window semantics with
+// plain maps guarded by a mutex instead of Lua scripts.
+type inProcessStateStore struct {
+	mutex    sync.Mutex
+	counters map[string][]time.Time
+	velocity map[string][]timedAmount
+	blocked  map[string]time.Time
+}
+
+type timedAmount struct {
+	at     time.Time
+	amount float64
+	txType string
+}
+
+func newInProcessStateStore() *inProcessStateStore {
+	return &inProcessStateStore{
+		counters: make(map[string][]time.Time),
+		velocity: make(map[string][]timedAmount),
+		blocked:  make(map[string]time.Time),
+	}
+}
+
+func (s *inProcessStateStore) IncrementAndGet(key string, window time.Duration) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	cutoff := now.Add(-window)
+	kept := s.counters[key][:0]
+	for _, t := range s.counters[key] {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	kept = append(kept, now)
+	s.counters[key] = kept
+	return int64(len(kept)), nil
+}
+
+func (s *inProcessStateStore) PeekCount(key string, window time.Duration) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	cutoff := time.Now().Add(-window)
+	var count int64
+	for _, t := range s.counters[key] {
+		if t.After(cutoff) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *inProcessStateStore) VelocityAdd(key string, amount float64, txType string, window time.Duration) (int64, float64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	cutoff := now.Add(-window)
+	kept := s.velocity[key][:0]
+	for _, ta := range s.velocity[key] {
+		if ta.at.After(cutoff) {
+			kept = append(kept, ta)
+		}
+	}
+	kept = append(kept, timedAmount{at: now, amount: amount, txType: txType})
+	s.velocity[key] = kept
+
+	var total float64
+	for _, ta := range kept {
+		total += ta.amount
+	}
+	return int64(len(kept)), total, nil
+}
+
+func (s *inProcessStateStore) PeekVelocity(key string, window time.Duration) (int64, float64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	cutoff := time.Now().Add(-window)
+	var count int64
+	var total float64
+	for _, ta := range s.velocity[key] {
+		if ta.at.After(cutoff) {
+			count++
+			total += ta.amount
+		}
+	}
+	return count, total, nil
+}
+
+func (s *inProcessStateStore) IsBlocked(ip string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	until, ok := s.blocked[ip]
+	if !ok {
+		return false, nil
+	}
+	if time.Now().After(until) {
+		delete(s.blocked, ip)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (s *inProcessStateStore) SetBlocked(ip string, ttl time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.blocked[ip] = time.Now().Add(ttl)
+	return nil
+}
+
+// newStateStoreFromDSN picks a StateStore implementation from a DSN scheme
+// ("redis://", "redis+sentinel://"), falling back to the in-process store for
+// dev when no DSN is configured. The Redis implementation itself (atomic
+// ZADD/ZREMRANGEBYSCORE/ZCARD sliding-window Lua scripts for the counters,
+// SET NX EX for IsBlocked/SetBlocked so a block set by one instance is
+// visible to every other instance within the TTL instead of only the
+// process that issued it) lives behind a build-tagged file once the redis
+// client dependency is vendored; until then this degrades gracefully to the
+// in-process fallback so callers have one code path regardless of
+// environment.
+//
+// VelocityAdd's key is namespaced per user and window by
+// transactionVelocityKey ("velocity:{userID}:{window}", see fraud_engine.go)
+// so the eventual Redis version can give each window its own sorted set —
+// member score the unix-nanos timestamp, value the JSON-encoded
+// {amount, type} — and read it back with ZRANGEBYSCORE plus a running sum,
+// instead of one set that every window's query would have to re-filter.
+func newStateStoreFromDSN(dsn string) StateStore {
+	if strings.HasPrefix(dsn, "redis://") || strings.HasPrefix(dsn, "redis+sentinel://") {
+		// TODO: dial go-redis here and return a *redisStateStore once the
+		// dependency is available in this environment.
+		log.Printf("⚠️  STATE_STORE_DSN=%s set but no Redis client is vendored yet; falling back to the in-process state store", dsn)
+	}
+	return newInProcessStateStore()
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInProcessStateStoreIncrementAndGet(t *testing.T) {
+	store := newInProcessStateStore()
+
+	for i := 0; i < 3; i++ {
+		if _, err := store.IncrementAndGet("ip:1.2.3.4", time.Minute); err != nil {
+			t.Fatalf("IncrementAndGet returned error: %v", err)
+		}
+	}
+
+	count, err := store.PeekCount("ip:1.2.3.4", time.Minute)
+	if err != nil {
+		t.Fatalf("PeekCount returned error: %v", err)
+	}
+	if count != 3 {
+		t.Fatalf("expected count 3, got %d", count)
+	}
+
+	// PeekCount must not itself record an occurrence.
+	if count, _ := store.PeekCount("ip:1.2.3.4", time.Minute); count != 3 {
+		t.Fatalf("PeekCount mutated state: expected count to stay 3, got %d", count)
+	}
+}
+
+func TestInProcessStateStoreIncrementAndGetWindowExpiry(t *testing.T) {
+	store := newInProcessStateStore()
+	key := "ip:5.6.7.8"
+
+	// Backdate an entry directly so the test doesn't need to sleep past the
+	// window to prove expiry.
+	store.counters[key] = []time.Time{time.Now().Add(-2 * time.Minute)}
+
+	count, err := store.IncrementAndGet(key, time.Minute)
+	if err != nil {
+		t.Fatalf("IncrementAndGet returned error: %v", err)
+	}
+	if count != 1 {
+		t.Fatalf("expected the stale entry to be dropped and only the fresh increment counted, got %d", count)
+	}
+}
+
+func TestInProcessStateStoreVelocityAdd(t *testing.T) {
+	store := newInProcessStateStore()
+	key := transactionVelocityKey(42, "1h")
+
+	count, total, err := store.VelocityAdd(key, 100, "payment", time.Hour)
+	if err != nil {
+		t.Fatalf("VelocityAdd returned error: %v", err)
+	}
+	if count != 1 || total != 100 {
+		t.Fatalf("expected count=1 total=100, got count=%d total=%f", count, total)
+	}
+
+	count, total, err = store.VelocityAdd(key, 50, "payment", time.Hour)
+	if err != nil {
+		t.Fatalf("VelocityAdd returned error: %v", err)
+	}
+	if count != 2 || total != 150 {
+		t.Fatalf("expected count=2 total=150, got count=%d total=%f", count, total)
+	}
+
+	peekCount, peekTotal, err := store.PeekVelocity(key, time.Hour)
+	if err != nil {
+		t.Fatalf("PeekVelocity returned error: %v", err)
+	}
+	if peekCount != count || peekTotal != total {
+		t.Fatalf("expected PeekVelocity to mirror VelocityAdd's running totals, got count=%d total=%f", peekCount, peekTotal)
+	}
+}
+
+func TestInProcessStateStoreBlocked(t *testing.T) {
+	store := newInProcessStateStore()
+
+	blocked, err := store.IsBlocked("9.9.9.9")
+	if err != nil {
+		t.Fatalf("IsBlocked returned error: %v", err)
+	}
+	if blocked {
+		t.Fatalf("expected 9.9.9.9 to not be blocked before SetBlocked")
+	}
+
+	if err := store.SetBlocked("9.9.9.9", time.Minute); err != nil {
+		t.Fatalf("SetBlocked returned error: %v", err)
+	}
+
+	blocked, err = store.IsBlocked("9.9.9.9")
+	if err != nil {
+		t.Fatalf("IsBlocked returned error: %v", err)
+	}
+	if !blocked {
+		t.Fatalf("expected 9.9.9.9 to be blocked after SetBlocked")
+	}
+}
+
+func TestInProcessStateStoreBlockedExpires(t *testing.T) {
+	store := newInProcessStateStore()
+	store.blocked["8.8.8.8"] = time.Now().Add(-time.Second)
+
+	blocked, err := store.IsBlocked("8.8.8.8")
+	if err != nil {
+		t.Fatalf("IsBlocked returned error: %v", err)
+	}
+	if blocked {
+		t.Fatalf("expected an already-expired block to report as not blocked")
+	}
+}
+
+// TestInProcessStateStoreConcurrentAccess exercises the mutex guarding every
+// method: run with `go test -race` to catch a regression that drops it.
+func TestInProcessStateStoreConcurrentAccess(t *testing.T) {
+	store := newInProcessStateStore()
+	key := transactionVelocityKey(7, "1h")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store.IncrementAndGet("concurrent-key", time.Minute)
+			store.VelocityAdd(key, 1, "payment", time.Hour)
+			store.SetBlocked("1.1.1.1", time.Minute)
+			store.IsBlocked("1.1.1.1")
+		}()
+	}
+	wg.Wait()
+
+	count, err := store.PeekCount("concurrent-key", time.Minute)
+	if err != nil {
+		t.Fatalf("PeekCount returned error: %v", err)
+	}
+	if count != 50 {
+		t.Fatalf("expected 50 recorded increments, got %d", count)
+	}
+}
@@ -0,0 +1,488 @@
+// TAN (transaction authentication number) step-up: ProcessPayout, and
+// ProcessPayment once the amount crosses tanPaymentAmountThreshold, no longer
+// debit the balance directly. Instead they create a pending transaction,
+// open a tan_challenges row holding a hashed one-time code, and send that
+// code over email/SMS via the same NotificationChannel implementations
+// notification_channels.go already built. The balance debit and external
+// provider call only happen once SolveTanChallenge verifies the code against
+// its stored hash -- which binds the code to the exact operation payload it
+// was issued for, so a solved challenge can't be replayed against a
+// different amount. This mirrors three_ds.go's two-phase pattern, for
+// operations where the second factor is an API-delivered code rather than a
+// card network's own challenge page.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tanChallengeTimeout is how long a TAN code stays solvable before
+// TanService.sweepAbandoned cancels it and its underlying transaction.
+const tanChallengeTimeout = 10 * time.Minute
+
+// tanSweepInterval is how often the abandoned-challenge sweep runs.
+const tanSweepInterval = 1 * time.Minute
+
+// tanDefaultMaxAttempts is how many wrong codes SolveChallenge tolerates
+// before invalidating the challenge.
+const tanDefaultMaxAttempts = 3
+
+// tanPaymentAmountThreshold is the amount above which processPaymentHandler
+// defers to the TAN subsystem instead of authorizing immediately; read once
+// at startup from TAN_PAYMENT_AMOUNT_THRESHOLD.
+var tanPaymentAmountThreshold = tanPaymentAmountThresholdFromEnv()
+
+func tanPaymentAmountThresholdFromEnv() float64 {
+	threshold, err := strconv.ParseFloat(getEnv("TAN_PAYMENT_AMOUNT_THRESHOLD", "1000"), 64)
+	if err != nil {
+		return 1000
+	}
+	return threshold
+}
+
+func initializeTanChallengeTables(db *sql.DB) error {
+	statements := []string{
+		`ALTER TABLE transactions MODIFY COLUMN status ENUM('pending', 'completed', 'failed', 'cancelled', 'requires_authentication', 'processing') DEFAULT 'pending'`,
+
+		`CREATE TABLE IF NOT EXISTS tan_challenges (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			transaction_id INT NOT NULL,
+			user_id INT NOT NULL,
+			operation_kind VARCHAR(20) NOT NULL,
+			channel VARCHAR(20) NOT NULL,
+			code_hash VARCHAR(64) NOT NULL,
+			payload JSON NOT NULL,
+			attempts INT NOT NULL DEFAULT 0,
+			max_attempts INT NOT NULL DEFAULT 3,
+			status ENUM('pending', 'solved', 'failed', 'expired', 'cancelled') NOT NULL DEFAULT 'pending',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			expires_at TIMESTAMP NOT NULL,
+			solved_at TIMESTAMP NULL,
+			FOREIGN KEY (transaction_id) REFERENCES transactions(id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			INDEX idx_status_expires (status, expires_at)
+		)`,
+	}
+
+	for _, stmt := range statements {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to initialize TAN challenge tables: %v", err)
+		}
+	}
+	return nil
+}
+
+// TanService issues, delivers, and verifies TAN challenges. It reuses the
+// NotificationChannel set notification_channels.go already builds from env
+// (smtp/twilio) rather than standing up its own email/SMS clients.
+type TanService struct {
+	db       *sql.DB
+	channels map[string]NotificationChannel
+}
+
+func NewTanService(db *sql.DB, channels map[string]NotificationChannel) *TanService {
+	return &TanService{db: db, channels: channels}
+}
+
+// generateTanCode returns a six-digit numeric code, zero-padded.
+func generateTanCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// hashTanCode binds code to payload so a code correct for one operation
+// payload never hashes the same as it would for a different amount or
+// destination -- the replay protection CreateChallenge/SolveChallenge rely
+// on.
+func hashTanCode(code string, payload []byte) string {
+	sum := sha256.Sum256(append([]byte(code+":"), payload...))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateChallenge opens a TAN challenge for transactionID, hashing code
+// together with payload (the PaymentRequest/PayoutRequest the caller solved
+// must still match) so SolveChallenge can't be satisfied by a code issued
+// for a different operation. The caller is responsible for delivering code
+// via SendChallenge; it's returned here only so the caller can hand it to
+// SendChallenge without a second read.
+func (ts *TanService) CreateChallenge(userID int, transactionID int64, operation, channel string, payload interface{}) (challengeID int64, code string, err error) {
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return 0, "", err
+	}
+
+	code, err = generateTanCode()
+	if err != nil {
+		return 0, "", err
+	}
+	codeHash := hashTanCode(code, payloadJSON)
+
+	res, err := ts.db.Exec(`
+		INSERT INTO tan_challenges (transaction_id, user_id, operation_kind, channel, code_hash, payload, max_attempts, status, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, 'pending', ?)
+	`, transactionID, userID, operation, channel, codeHash, payloadJSON, tanDefaultMaxAttempts, time.Now().Add(tanChallengeTimeout))
+	if err != nil {
+		return 0, "", err
+	}
+	challengeID, err = res.LastInsertId()
+	if err != nil {
+		return 0, "", err
+	}
+	return challengeID, code, nil
+}
+
+// SendChallenge delivers code to challengeID's owner over its configured
+// channel, reusing the same NotificationRecipient resolution and
+// NotificationChannel.Send path a SecurityNotification would go through.
+func (ts *TanService) SendChallenge(challengeID int64, code string) error {
+	var userID int
+	var channelName string
+	if err := ts.db.QueryRow("SELECT user_id, channel FROM tan_challenges WHERE id = ?", challengeID).Scan(&userID, &channelName); err != nil {
+		return err
+	}
+
+	channel, ok := ts.channels[channelName]
+	if !ok {
+		return fmt.Errorf("tan: channel %q is not configured", channelName)
+	}
+
+	recipient, err := resolveNotificationRecipient(ts.db, userID)
+	if err != nil {
+		return err
+	}
+
+	notif := SecurityNotification{
+		UserID:   userID,
+		Type:     "security",
+		Title:    "Your verification code",
+		Message:  fmt.Sprintf("Your verification code is %s. It expires in %d minutes and should never be shared.", code, int(tanChallengeTimeout.Minutes())),
+		Severity: "info",
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	return channel.Send(ctx, recipient, notif)
+}
+
+// SolveChallenge verifies code against challengeID's stored hash -- computed
+// over the code together with the payload CreateChallenge bound to it, so
+// code is only ever valid for that exact payload -- and on success marks the
+// challenge solved and returns the operation kind and payload for the caller
+// to execute. A wrong code increments attempts and, once max_attempts is
+// reached, invalidates the challenge and cancels its transaction.
+func (ts *TanService) SolveChallenge(challengeID int64, code string) (operationKind string, payload []byte, transactionID int64, userID int, err error) {
+	var codeHash, status string
+	var attempts, maxAttempts int
+	var expiresAt time.Time
+	err = ts.db.QueryRow(`
+		SELECT transaction_id, user_id, operation_kind, code_hash, payload, attempts, max_attempts, status, expires_at
+		FROM tan_challenges WHERE id = ?
+	`, challengeID).Scan(&transactionID, &userID, &operationKind, &codeHash, &payload, &attempts, &maxAttempts, &status, &expiresAt)
+	if err != nil {
+		return "", nil, 0, 0, err
+	}
+
+	if status != "pending" {
+		return "", nil, 0, 0, fmt.Errorf("challenge %d is %s, not pending", challengeID, status)
+	}
+	if time.Now().After(expiresAt) {
+		ts.invalidate(challengeID, transactionID, "expired")
+		return "", nil, 0, 0, fmt.Errorf("challenge %d expired", challengeID)
+	}
+
+	if hashTanCode(code, payload) != codeHash {
+		attempts++
+		if attempts >= maxAttempts {
+			ts.invalidate(challengeID, transactionID, "failed")
+			return "", nil, 0, 0, fmt.Errorf("challenge %d failed after %d incorrect attempts", challengeID, attempts)
+		}
+		if _, err := ts.db.Exec("UPDATE tan_challenges SET attempts = ? WHERE id = ?", attempts, challengeID); err != nil {
+			log.Printf("⚠️  tan: failed to record attempt on challenge %d: %v", challengeID, err)
+		}
+		return "", nil, 0, 0, fmt.Errorf("incorrect verification code")
+	}
+
+	if _, err := ts.db.Exec("UPDATE tan_challenges SET status = 'solved', solved_at = NOW() WHERE id = ?", challengeID); err != nil {
+		return "", nil, 0, 0, err
+	}
+	return operationKind, payload, transactionID, userID, nil
+}
+
+// invalidate marks a challenge with a terminal status and cancels its
+// underlying transaction, the same pairing three_ds.go's
+// sweepAbandonedThreeDSChallenges applies on expiry.
+func (ts *TanService) invalidate(challengeID, transactionID int64, status string) {
+	if _, err := ts.db.Exec("UPDATE tan_challenges SET status = ? WHERE id = ?", status, challengeID); err != nil {
+		log.Printf("⚠️  tan: failed to mark challenge %d as %s: %v", challengeID, status, err)
+	}
+	if _, err := ts.db.Exec("UPDATE transactions SET status = 'cancelled' WHERE id = ?", transactionID); err != nil {
+		log.Printf("⚠️  tan: failed to cancel transaction %d: %v", transactionID, err)
+	}
+}
+
+// sweepAbandoned cancels every pending tan_challenges row whose expires_at
+// has passed along with its underlying transaction.
+func (ts *TanService) sweepAbandoned() {
+	rows, err := ts.db.Query("SELECT id, transaction_id FROM tan_challenges WHERE status = 'pending' AND expires_at <= NOW()")
+	if err != nil {
+		log.Printf("⚠️  tan: failed to load expired challenges: %v", err)
+		return
+	}
+
+	type expired struct {
+		challengeID   int64
+		transactionID int64
+	}
+	var due []expired
+	for rows.Next() {
+		var e expired
+		if err := rows.Scan(&e.challengeID, &e.transactionID); err == nil {
+			due = append(due, e)
+		}
+	}
+	rows.Close()
+
+	for _, e := range due {
+		ts.invalidate(e.challengeID, e.transactionID, "expired")
+	}
+}
+
+// StartSweep launches the background goroutine that expires abandoned TAN
+// challenges; call alongside ProviderRouter.Start during handler setup.
+func (ts *TanService) StartSweep(interval time.Duration, stop chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ts.sweepAbandoned()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// createPendingTanTransaction writes the transactions row a TAN challenge is
+// opened against, in 'processing' status with no ledger entries yet --
+// those are only written once SolveTanChallenge succeeds.
+func (r *ProviderRouter) createPendingTanTransaction(userID int, txType, providerID, idempotencyKey string, amount float64, description string) (int64, error) {
+	res, err := r.db.Exec(`
+		INSERT INTO transactions (user_id, type, amount, description, status, provider_id, reconciliation_status, idempotency_key)
+		VALUES (?, ?, ?, ?, 'processing', ?, 'pending', ?)
+	`, userID, txType, amount, description, providerID, nullableString(idempotencyKey))
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// RequirePayoutTan opens a TAN challenge for req instead of calling the
+// provider directly: ProcessPayout no longer debits the balance on its own,
+// per the TAN step-up requirement that every payout solve a challenge first.
+func (r *ProviderRouter) RequirePayoutTan(userID int, req *PayoutRequest, idempotencyKey string) (*PayoutResponse, error) {
+	provider, err := r.selectProvider(req.Currency, req.Region, req.Method)
+	if err != nil {
+		return &PayoutResponse{Success: false, Message: "No payment provider available"}, err
+	}
+
+	txID, err := r.createPendingTanTransaction(userID, "payout", provider.ID(), idempotencyKey, req.Amount, req.Description)
+	if err != nil {
+		return &PayoutResponse{Success: false, Message: "Failed to initialize payout"}, err
+	}
+
+	challengeID, code, err := r.tan.CreateChallenge(userID, txID, "payout", tanChannelFor(r.tan, userID), req)
+	if err != nil {
+		r.markTransactionStatus(txID, "failed")
+		return &PayoutResponse{Success: false, Message: "Failed to open verification challenge"}, err
+	}
+	if err := r.tan.SendChallenge(challengeID, code); err != nil {
+		log.Printf("⚠️  tan: failed to deliver challenge %d: %v", challengeID, err)
+	}
+
+	return &PayoutResponse{
+		Success:       false,
+		TransactionID: fmt.Sprintf("txn_%d", txID),
+		Message:       "Verification code sent; solve the challenge to complete this payout",
+		Status:        "tan_required",
+		ChallengeID:   challengeID,
+	}, nil
+}
+
+// RequirePaymentTan mirrors RequirePayoutTan for a payment whose amount
+// crossed tanPaymentAmountThreshold.
+func (r *ProviderRouter) RequirePaymentTan(userID int, req *PaymentRequest, idempotencyKey string) (*PaymentResponse, error) {
+	provider, err := r.selectProvider(req.Currency, req.Region, req.Method)
+	if err != nil {
+		return &PaymentResponse{Success: false, Message: "No payment provider available"}, err
+	}
+
+	txID, err := r.createPendingTanTransaction(userID, "payment", provider.ID(), idempotencyKey, req.Amount, req.Description)
+	if err != nil {
+		return &PaymentResponse{Success: false, Message: "Failed to initialize payment"}, err
+	}
+
+	challengeID, code, err := r.tan.CreateChallenge(userID, txID, "payment", tanChannelFor(r.tan, userID), req)
+	if err != nil {
+		r.markTransactionStatus(txID, "failed")
+		return &PaymentResponse{Success: false, Message: "Failed to open verification challenge"}, err
+	}
+	if err := r.tan.SendChallenge(challengeID, code); err != nil {
+		log.Printf("⚠️  tan: failed to deliver challenge %d: %v", challengeID, err)
+	}
+
+	return &PaymentResponse{
+		Success:       false,
+		TransactionID: fmt.Sprintf("txn_%d", txID),
+		Message:       "Verification code sent; solve the challenge to complete this payment",
+		Status:        "tan_required",
+		ChallengeID:   challengeID,
+	}, nil
+}
+
+// tanChannelFor picks SMS when the user has a phone on file (faster for a
+// time-boxed code) and falls back to email otherwise.
+func tanChannelFor(ts *TanService, userID int) string {
+	recipient, err := resolveNotificationRecipient(ts.db, userID)
+	if err == nil && recipient.Phone != "" {
+		return "sms"
+	}
+	return "email"
+}
+
+// SolveTanChallenge verifies code against challengeID and, on success,
+// executes the operation it was guarding: calling the originating provider
+// and writing the same ledger entries/transaction-completion ProcessPayment/
+// ProcessPayout would have written immediately had TAN not been required.
+func (r *ProviderRouter) SolveTanChallenge(challengeID int64, code string) (*TanSolveResponse, error) {
+	operationKind, payloadJSON, txID, userID, err := r.tan.SolveChallenge(challengeID, code)
+	if err != nil {
+		return &TanSolveResponse{Success: false, Message: err.Error()}, err
+	}
+
+	var providerID string
+	var txIdempotencyKey sql.NullString
+	if err := r.db.QueryRow("SELECT provider_id, idempotency_key FROM transactions WHERE id = ?", txID).Scan(&providerID, &txIdempotencyKey); err != nil {
+		r.markTransactionStatus(txID, "failed")
+		return &TanSolveResponse{Success: false, Message: "Failed to load transaction"}, err
+	}
+	provider, ok := r.providers[providerID]
+	if !ok {
+		r.markTransactionStatus(txID, "failed")
+		return &TanSolveResponse{Success: false, Message: "Payment provider no longer available"}, fmt.Errorf("provider %s not registered", providerID)
+	}
+
+	switch operationKind {
+	case "payout":
+		var req PayoutRequest
+		if err := json.Unmarshal(payloadJSON, &req); err != nil {
+			r.markTransactionStatus(txID, "failed")
+			return &TanSolveResponse{Success: false, Message: "Failed to read payout details"}, err
+		}
+		reference, err := provider.ProcessPayout(userID, &req, txIdempotencyKey.String)
+		r.recordOutcome(provider.ID(), err)
+		if err != nil {
+			r.markTransactionStatus(txID, "failed")
+			return &TanSolveResponse{Success: false, Message: "Failed to process payout"}, err
+		}
+		if err := r.finalizeTanTransaction(txID, reference, req.Amount, payoutLedgerEntries(userID, req.Amount, normalizeCurrency(req.Currency))); err != nil {
+			return &TanSolveResponse{Success: false, Message: "Failed to finalize payout"}, err
+		}
+		return &TanSolveResponse{Success: true, TransactionID: fmt.Sprintf("txn_%d", txID), Message: "Payout processed successfully"}, nil
+
+	case "payment":
+		var req PaymentRequest
+		if err := json.Unmarshal(payloadJSON, &req); err != nil {
+			r.markTransactionStatus(txID, "failed")
+			return &TanSolveResponse{Success: false, Message: "Failed to read payment details"}, err
+		}
+		reference, err := provider.ProcessPayment(userID, &req, txIdempotencyKey.String)
+		r.recordOutcome(provider.ID(), err)
+		if err != nil {
+			r.markTransactionStatus(txID, "failed")
+			return &TanSolveResponse{Success: false, Message: "Failed to process payment"}, err
+		}
+		if err := r.finalizeTanTransaction(txID, reference, req.Amount, paymentLedgerEntries(userID, req.Amount, normalizeCurrency(req.Currency))); err != nil {
+			return &TanSolveResponse{Success: false, Message: "Failed to finalize payment"}, err
+		}
+		return &TanSolveResponse{Success: true, TransactionID: fmt.Sprintf("txn_%d", txID), Message: "Payment processed successfully"}, nil
+
+	default:
+		r.markTransactionStatus(txID, "failed")
+		return &TanSolveResponse{Success: false, Message: "Unknown operation kind"}, fmt.Errorf("tan: unknown operation kind %q", operationKind)
+	}
+}
+
+// finalizeTanTransaction moves a 'processing' transaction to 'completed',
+// records its provider_reference, and writes its ledger entries in one
+// sql.Tx -- the same atomicity three_ds.go's completeTransaction gives the
+// 3DS completion path.
+func (r *ProviderRouter) finalizeTanTransaction(txID int64, providerReference string, amount float64, entries []ledgerEntry) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE transactions SET status = 'completed', provider_reference = ? WHERE id = ?`, providerReference, txID); err != nil {
+		return err
+	}
+	if err := writeLedgerEntries(tx, txID, entries); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	transactionAmountHistogram.Observe(amount)
+	return nil
+}
+
+// TanSolveResponse is POST /security/tan/solve's response shape -- distinct
+// from PaymentResponse/PayoutResponse since a single solve endpoint handles
+// both operation kinds and has no 3DS-specific fields to carry.
+type TanSolveResponse struct {
+	Success       bool   `json:"success"`
+	TransactionID string `json:"transaction_id"`
+	Message       string `json:"message"`
+}
+
+// solveTanChallengeRequest is POST /security/tan/solve's body.
+type solveTanChallengeRequest struct {
+	ChallengeID int64  `json:"challenge_id" binding:"required"`
+	Code        string `json:"code" binding:"required"`
+}
+
+// solveTanChallengeHandler handles POST /security/tan/solve.
+func (sth *SecureTransactionHandler) solveTanChallengeHandler(c *gin.Context) {
+	var req solveTanChallengeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	response, err := sth.providerRouter.SolveTanChallenge(req.ChallengeID, req.Code)
+	if err != nil {
+		log.Printf("tan solve error for challenge %d: %v", req.ChallengeID, err)
+		c.JSON(http.StatusBadRequest, response)
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// newTestSQLiteDB opens a throwaway, file-backed SQLite database (not
+// :memory:, so the connection pool database/sql maintains doesn't hand
+// different goroutines/queries unrelated empty databases) for tests that
+// need a real database.DB instead of a mock. The file is removed via
+// t.Cleanup once the test finishes.
+func newTestSQLiteDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	f, err := os.CreateTemp("", "krili-test-*.db")
+	if err != nil {
+		t.Fatalf("failed to create temp sqlite file: %v", err)
+	}
+	path := f.Name()
+	f.Close()
+	os.Remove(path)
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("failed to open sqlite db: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+
+	t.Cleanup(func() {
+		db.Close()
+		os.Remove(path)
+	})
+
+	return db
+}
@@ -0,0 +1,757 @@
+// Community threat-intelligence feed subscription. ThreatFeedClient pulls
+// IP/CIDR block decisions from one or more sources and reconciles them into
+// ip_reputation, and optionally pushes locally-generated critical alerts
+// (from SecurityMonitor.checkForNewAlerts) upstream so a fleet of
+// deployments shares what each one detects. Source.Kind selects the wire
+// format: the original CrowdSec-style "decisions/stream" pull loop, a STIX
+// 2.1/TAXII 2.1 collection, a flat Spamhaus-DROP/Emerging-Threats-style
+// IP list, or AbuseIPDB's blacklist JSON. Every format normalizes down to
+// the same new/deleted decision shape before reconcile touches the
+// database. A Bloom filter rebuilt after every reconcile backs
+// MightBeMalicious, the O(1) check advancedRateLimitMiddleware runs before
+// its slower per-request rate-limit bookkeeping.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultThreatFeedPullInterval is how often PullTop runs absent
+// THREAT_FEED_PULL_INTERVAL_SECONDS; CrowdSec's own agent defaults to a
+// similar multi-hour cadence since community blocklists change slowly.
+const defaultThreatFeedPullInterval = 2 * time.Hour
+
+// threatFeedPushInterval is how often queued local alerts are flushed
+// upstream; short enough that other deployments learn about a new attacker
+// within a few batches of it actually happening here.
+const threatFeedPushInterval = 10 * time.Second
+
+// ThreatFeedSource is one upstream community feed endpoint. Auth is either
+// an API key (sent as the CrowdSec-style X-Api-Key header) or mTLS
+// (ClientCertFile/ClientKeyFile), never both.
+type ThreatFeedSource struct {
+	Name           string // e.g. "community:crowdsec"
+	PullURL        string // GET returns {"new": [...], "deleted": [...]}, or the feed's own format per Kind
+	PushURL        string // POST accepts a batch of locally-generated alerts; decisions-kind sources only
+	APIKey         string
+	ClientCertFile string
+	ClientKeyFile  string
+	CACertFile     string
+	// Kind selects how PullURL's response body is parsed. Empty (or
+	// "decisions") is the original CrowdSec-style stream above; "taxii" is a
+	// STIX 2.1/TAXII 2.1 collection; "flatlist" is a newline-delimited
+	// IP/CIDR list (Spamhaus DROP, Emerging Threats); "abuseipdb" is
+	// AbuseIPDB's blacklist JSON shape.
+	Kind string
+	// CollectionID is the TAXII collection to poll; only used when Kind is
+	// "taxii". PullURL is the TAXII API root (objects are fetched from
+	// PullURL + "/collections/{CollectionID}/objects/").
+	CollectionID string
+}
+
+// stixIndicatorPattern pulls the IPv4 or domain value out of a STIX 2.1
+// indicator's pattern field, e.g. "[ipv4-addr:value = '1.2.3.4']" or
+// "[domain-name:value = 'evil.example.com']". Only the single-comparison
+// form is supported; compound patterns (AND/OR, CIDR, other SCOs) are
+// skipped rather than guessed at.
+var stixIndicatorPattern = regexp.MustCompile(`\[(ipv4-addr|ipv6-addr|domain-name):value\s*=\s*'([^']+)'\]`)
+
+// stixBundle is the subset of a STIX 2.1 bundle this client understands:
+// just enough of the "indicator" SDO to recover a pattern and its validity
+// window, ignoring every other object type a TAXII collection may return.
+type stixBundle struct {
+	Objects []stixObject `json:"objects"`
+}
+
+type stixObject struct {
+	Type       string `json:"type"`
+	Pattern    string `json:"pattern"`
+	ValidFrom  string `json:"valid_from"`
+	ValidUntil string `json:"valid_until"`
+	Name       string `json:"name"`
+	Revoked    bool   `json:"revoked"`
+}
+
+// abuseIPDBResponse mirrors the blacklist endpoint's JSON shape
+// (GET /api/v2/blacklist), trimmed to the fields reconcile needs.
+type abuseIPDBResponse struct {
+	Data []struct {
+		IPAddress            string `json:"ipAddress"`
+		AbuseConfidenceScore int    `json:"abuseConfidenceScore"`
+	} `json:"data"`
+}
+
+// threatFeedDecision mirrors one entry of a CrowdSec-style decisions stream:
+// a scoped IP/CIDR ban with a reason and a duration after which it expires
+// if the upstream feed doesn't renew it.
+type threatFeedDecision struct {
+	Value    string `json:"value"` // IP or CIDR
+	Scope    string `json:"scope"` // "ip" or "range"
+	Scenario string `json:"scenario"`
+	Duration string `json:"duration"` // e.g. "4h32m"
+}
+
+type threatFeedStreamResponse struct {
+	New     []threatFeedDecision `json:"new"`
+	Deleted []threatFeedDecision `json:"deleted"`
+}
+
+// ThreatFeedClient pulls blocklist decisions from ThreatFeedSources on an
+// interval and merges them into ip_reputation, and pushes batches of
+// locally-generated critical alerts back upstream.
+type ThreatFeedClient struct {
+	db           *sql.DB
+	sources      []ThreatFeedSource
+	pullInterval time.Duration
+
+	pushMutex  sync.Mutex
+	pushQueue  []SecurityAlert
+	httpClient *http.Client
+
+	leaderCheck func() bool // nil means always pull, see SetLeaderCheck
+	stop        chan struct{}
+
+	lastPolledMutex sync.Mutex
+	lastPolled      map[string]time.Time // source name -> added_after watermark, "taxii" sources only
+
+	bloomMutex sync.RWMutex
+	bloom      *bloomFilter // rebuilt after every PullTop from every currently-active ip_reputation block, see rebuildBloom
+}
+
+// NewThreatFeedClient returns a client ready for Start. pullInterval <= 0
+// falls back to defaultThreatFeedPullInterval.
+func NewThreatFeedClient(db *sql.DB, sources []ThreatFeedSource, pullInterval time.Duration) *ThreatFeedClient {
+	if pullInterval <= 0 {
+		pullInterval = defaultThreatFeedPullInterval
+	}
+	return &ThreatFeedClient{
+		db:           db,
+		sources:      sources,
+		pullInterval: pullInterval,
+		httpClient:   &http.Client{Timeout: 30 * time.Second},
+		stop:         make(chan struct{}),
+		lastPolled:   make(map[string]time.Time),
+	}
+}
+
+// Start launches the pull and push background loops. No-op if there are no
+// configured sources.
+func (t *ThreatFeedClient) Start() {
+	if len(t.sources) == 0 {
+		return
+	}
+	go t.pullLoop()
+	go t.pushLoop()
+	go t.bloomRebuildLoop()
+}
+
+// bloomRebuildLoop refreshes the Bloom filter on rebuildBloomInterval so
+// blocks made outside a feed pull (manual, CTI auto-block) show up in
+// MightBeMalicious without waiting for the next, much slower, pullInterval.
+func (t *ThreatFeedClient) bloomRebuildLoop() {
+	t.rebuildBloom()
+	ticker := time.NewTicker(rebuildBloomInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.rebuildBloom()
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+func (t *ThreatFeedClient) Stop() {
+	close(t.stop)
+}
+
+// SetLeaderCheck makes pullLoop skip PullTop on replicas that aren't the
+// current leader, so a fleet of HA API instances doesn't each hammer the
+// upstream feed and write conflicting ip_reputation updates.
+func (t *ThreatFeedClient) SetLeaderCheck(fn func() bool) {
+	t.leaderCheck = fn
+}
+
+// pullLoop runs PullTop on t.pullInterval with up to 10% jitter, so a fleet
+// of deployments sharing the same interval doesn't hammer the upstream feed
+// in lockstep.
+func (t *ThreatFeedClient) pullLoop() {
+	t.pullIfLeader()
+	for {
+		jitter := time.Duration(rand.Int63n(int64(t.pullInterval) / 10))
+		select {
+		case <-time.After(t.pullInterval + jitter):
+			t.pullIfLeader()
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+func (t *ThreatFeedClient) pullIfLeader() {
+	if t.leaderCheck != nil && !t.leaderCheck() {
+		return
+	}
+	t.PullTop()
+}
+
+// PullTop fetches new/deleted decisions from every configured source,
+// reconciles them into ip_reputation, and rebuilds the Bloom filter
+// middlewares consult via MightBeMalicious.
+func (t *ThreatFeedClient) PullTop() {
+	for _, source := range t.sources {
+		stream, err := t.fetchDecisions(source)
+		if err != nil {
+			log.Printf("⚠️  threat feed %q: pull failed: %v", source.Name, err)
+			continue
+		}
+		t.reconcile(source, stream)
+	}
+	t.rebuildBloom()
+}
+
+// fetchDecisions dispatches to the parser matching source.Kind, so every
+// source ends up normalized to the same new/deleted decision shape
+// reconcile already knows how to merge into ip_reputation.
+func (t *ThreatFeedClient) fetchDecisions(source ThreatFeedSource) (*threatFeedStreamResponse, error) {
+	switch source.Kind {
+	case "taxii":
+		return t.fetchTAXIIDecisions(source)
+	case "flatlist":
+		return t.fetchFlatlistDecisions(source)
+	case "abuseipdb":
+		return t.fetchAbuseIPDBDecisions(source)
+	default:
+		return t.fetchCrowdSecDecisions(source)
+	}
+}
+
+// fetchCrowdSecDecisions is the original CrowdSec-style decisions stream.
+func (t *ThreatFeedClient) fetchCrowdSecDecisions(source ThreatFeedSource) (*threatFeedStreamResponse, error) {
+	resp, err := t.doGet(source, source.PullURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Close()
+
+	var stream threatFeedStreamResponse
+	if err := json.NewDecoder(resp).Decode(&stream); err != nil {
+		return nil, fmt.Errorf("invalid response body: %v", err)
+	}
+	return &stream, nil
+}
+
+// fetchTAXIIDecisions polls a TAXII 2.1 collection for STIX 2.1 indicator
+// SDOs added since this source's last successful poll, and turns the
+// ipv4-addr/domain-name patterns it can parse into decisions. A revoked
+// indicator is treated as a deletion instead of a new decision.
+func (t *ThreatFeedClient) fetchTAXIIDecisions(source ThreatFeedSource) (*threatFeedStreamResponse, error) {
+	addedAfter := t.watermark(source.Name)
+	url := strings.TrimRight(source.PullURL, "/") + "/collections/" + source.CollectionID + "/objects/"
+	if !addedAfter.IsZero() {
+		url += "?added_after=" + addedAfter.UTC().Format(time.RFC3339)
+	}
+
+	resp, err := t.doGet(source, url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Close()
+
+	var bundle stixBundle
+	if err := json.NewDecoder(resp).Decode(&bundle); err != nil {
+		return nil, fmt.Errorf("invalid STIX bundle: %v", err)
+	}
+
+	stream := &threatFeedStreamResponse{}
+	for _, obj := range bundle.Objects {
+		if obj.Type != "indicator" {
+			continue
+		}
+		match := stixIndicatorPattern.FindStringSubmatch(obj.Pattern)
+		if match == nil {
+			continue
+		}
+		if match[1] != "ipv4-addr" && match[1] != "ipv6-addr" {
+			// ip_reputation is IP-keyed; a domain-name indicator has
+			// nowhere to live until a domain-scoped block table exists, so
+			// it's dropped here rather than stored under the wrong column.
+			continue
+		}
+		decision := threatFeedDecision{Value: match[2], Scope: "ip", Scenario: obj.Name}
+		if validUntil, err := time.Parse(time.RFC3339, obj.ValidUntil); err == nil {
+			if d := time.Until(validUntil); d > 0 {
+				decision.Duration = d.String()
+			}
+		}
+		if obj.Revoked {
+			stream.Deleted = append(stream.Deleted, decision)
+		} else {
+			stream.New = append(stream.New, decision)
+		}
+	}
+
+	t.setWatermark(source.Name, time.Now())
+	return stream, nil
+}
+
+// fetchFlatlistDecisions parses a newline-delimited IP/CIDR list such as
+// Spamhaus DROP ("1.2.3.0/24 ; SBL12345", semicolon comment optional) or the
+// Emerging Threats compromised/blocklist feeds (bare IPs, "#" comments).
+// Every entry in the file is treated as "currently listed"; nothing is ever
+// reported deleted since these feeds serve a full snapshot, not a diff — an
+// address that drops off the list simply stops being renewed and expires on
+// its own via blocked_until.
+func (t *ThreatFeedClient) fetchFlatlistDecisions(source ThreatFeedSource) (*threatFeedStreamResponse, error) {
+	resp, err := t.doGet(source, source.PullURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Close()
+
+	stream := &threatFeedStreamResponse{}
+	scanner := bufio.NewScanner(resp)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		value := line
+		reason := ""
+		if idx := strings.Index(line, ";"); idx >= 0 {
+			value = strings.TrimSpace(line[:idx])
+			reason = strings.TrimSpace(line[idx+1:])
+		}
+		if value == "" {
+			continue
+		}
+		scope := "ip"
+		if strings.Contains(value, "/") {
+			scope = "cidr"
+		}
+		stream.New = append(stream.New, threatFeedDecision{Value: value, Scope: scope, Scenario: reason})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read flatlist body: %v", err)
+	}
+	return stream, nil
+}
+
+// fetchAbuseIPDBDecisions parses the AbuseIPDB blacklist endpoint's JSON
+// shape, only listing addresses at or above abuseConfidenceMinScore so a
+// single stale report doesn't ban an IP outright.
+const abuseConfidenceMinScore = 75
+
+func (t *ThreatFeedClient) fetchAbuseIPDBDecisions(source ThreatFeedSource) (*threatFeedStreamResponse, error) {
+	resp, err := t.doGet(source, source.PullURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Close()
+
+	var parsed abuseIPDBResponse
+	if err := json.NewDecoder(resp).Decode(&parsed); err != nil {
+		return nil, fmt.Errorf("invalid AbuseIPDB response: %v", err)
+	}
+
+	stream := &threatFeedStreamResponse{}
+	for _, entry := range parsed.Data {
+		if entry.AbuseConfidenceScore < abuseConfidenceMinScore {
+			continue
+		}
+		stream.New = append(stream.New, threatFeedDecision{
+			Value:    entry.IPAddress,
+			Scope:    "ip",
+			Scenario: fmt.Sprintf("AbuseIPDB confidence %d", entry.AbuseConfidenceScore),
+		})
+	}
+	return stream, nil
+}
+
+// doGet issues an authenticated GET against url using source's API key or
+// mTLS client credentials, the same auth source.APIKey/ClientCertFile always
+// carried for the CrowdSec-style stream. Callers must close the returned
+// body.
+func (t *ThreatFeedClient) doGet(source ThreatFeedSource, url string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if source.APIKey != "" {
+		req.Header.Set("X-Api-Key", source.APIKey)
+		req.Header.Set("Key", source.APIKey) // AbuseIPDB's own header name
+	}
+	req.Header.Set("Accept", "application/json")
+
+	client := t.httpClient
+	if source.ClientCertFile != "" && source.ClientKeyFile != "" {
+		transport, err := mtlsTransport(source)
+		if err != nil {
+			return nil, fmt.Errorf("mTLS setup: %v", err)
+		}
+		client = &http.Client{Timeout: t.httpClient.Timeout, Transport: transport}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+func (t *ThreatFeedClient) watermark(sourceName string) time.Time {
+	t.lastPolledMutex.Lock()
+	defer t.lastPolledMutex.Unlock()
+	return t.lastPolled[sourceName]
+}
+
+func (t *ThreatFeedClient) setWatermark(sourceName string, at time.Time) {
+	t.lastPolledMutex.Lock()
+	defer t.lastPolledMutex.Unlock()
+	t.lastPolled[sourceName] = at
+}
+
+// mtlsTransport builds an http.Transport presenting source's client
+// certificate, trusting source.CACertFile if given (otherwise the system
+// root pool, for feeds behind a publicly-trusted CA).
+func mtlsTransport(source ThreatFeedSource) (*http.Transport, error) {
+	cert, err := tls.LoadX509KeyPair(source.ClientCertFile, source.ClientKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if source.CACertFile != "" {
+		caPEM, err := os.ReadFile(source.CACertFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in %s", source.CACertFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return &http.Transport{TLSClientConfig: tlsConfig}, nil
+}
+
+// reconcile inserts/renews source's new decisions into ip_reputation and
+// expires the ones it reports as deleted, scoped to rows this source owns so
+// a feed disappearing never touches an operator's local blocks.
+func (t *ThreatFeedClient) reconcile(source ThreatFeedSource, stream *threatFeedStreamResponse) {
+	for _, decision := range stream.New {
+		duration, err := time.ParseDuration(decision.Duration)
+		if err != nil || duration <= 0 {
+			duration = 24 * time.Hour
+		}
+		_, err = t.db.Exec(`
+			INSERT INTO ip_reputation (ip_address, reputation_score, is_blocked, block_reason, blocked_until, threat_level, source)
+			VALUES (?, 0, true, ?, DATE_ADD(NOW(), INTERVAL ? SECOND), 'high', ?)
+			ON DUPLICATE KEY UPDATE
+				is_blocked = true,
+				block_reason = VALUES(block_reason),
+				blocked_until = VALUES(blocked_until),
+				threat_level = VALUES(threat_level),
+				source = VALUES(source)
+		`, decision.Value, decision.Scenario, int(duration.Seconds()), source.Name)
+		if err != nil {
+			log.Printf("⚠️  threat feed %q: failed to upsert decision for %s: %v", source.Name, decision.Value, err)
+		}
+	}
+
+	for _, decision := range stream.Deleted {
+		_, err := t.db.Exec(`
+			UPDATE ip_reputation
+			SET is_blocked = false, blocked_until = NULL, reputation_score = 50
+			WHERE ip_address = ? AND source = ?
+		`, decision.Value, source.Name)
+		if err != nil {
+			log.Printf("⚠️  threat feed %q: failed to expire decision for %s: %v", source.Name, decision.Value, err)
+		}
+	}
+}
+
+// rebuildBloomInterval bounds how often a full ip_reputation scan runs to
+// refresh the Bloom filter outside of a PullTop call (e.g. blocks added by
+// blockIP directly, not through a feed); PullTop itself also rebuilds
+// immediately after every reconcile so feed-sourced blocks are visible
+// without waiting for this ticker.
+const rebuildBloomInterval = 5 * time.Minute
+
+// rebuildBloom reloads every currently-active block from ip_reputation and
+// replaces the Bloom filter wholesale, so a decision some other source
+// unblocked or let expire stops matching instead of false-positiving
+// forever — the tradeoff a Bloom filter's lack of a Remove forces.
+func (t *ThreatFeedClient) rebuildBloom() {
+	rows, err := t.db.Query(`
+		SELECT ip_address FROM ip_reputation
+		WHERE is_blocked = true AND (blocked_until IS NULL OR blocked_until > NOW())
+	`)
+	if err != nil {
+		log.Printf("⚠️  threat feed: failed to rebuild bloom filter: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	var ips []string
+	for rows.Next() {
+		var ip string
+		if err := rows.Scan(&ip); err == nil {
+			ips = append(ips, ip)
+		}
+	}
+
+	filter := newBloomFilter(len(ips), 0.01)
+	for _, ip := range ips {
+		filter.Add(ip)
+	}
+
+	t.bloomMutex.Lock()
+	t.bloom = filter
+	t.bloomMutex.Unlock()
+}
+
+// MightBeMalicious is the O(1) hot-path check advancedRateLimitMiddleware
+// consults before falling through to the slower blockedIPCache/stateStore
+// path: a true here means ip is probably on an active feed-or-manual block
+// and worth blocking immediately; false means it's definitely not, so the
+// normal request flow is never slowed down by a false negative.
+func (t *ThreatFeedClient) MightBeMalicious(ip string) bool {
+	t.bloomMutex.RLock()
+	filter := t.bloom
+	t.bloomMutex.RUnlock()
+	if filter == nil {
+		return false
+	}
+	return filter.MightContain(ip)
+}
+
+// bloomFilter is a small hand-rolled Bloom filter (the standard library and
+// this sandbox's vendored dependencies have no off-the-shelf one) backing
+// MightBeMalicious. False positives are expected at the configured rate;
+// false negatives never happen for anything Add was called with since the
+// last rebuildBloom.
+type bloomFilter struct {
+	bits []uint64
+	m    uint64
+	k    int
+}
+
+// newBloomFilter sizes the filter for expectedItems entries at
+// falsePositiveRate, using the standard m = -n*ln(p)/ln(2)^2 and
+// k = (m/n)*ln(2) formulas.
+func newBloomFilter(expectedItems int, falsePositiveRate float64) *bloomFilter {
+	if expectedItems < 1 {
+		expectedItems = 1
+	}
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		falsePositiveRate = 0.01
+	}
+	n := float64(expectedItems)
+	m := uint64(math.Ceil(-n * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := int(math.Round((float64(m) / n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{
+		bits: make([]uint64, (m+63)/64),
+		m:    m,
+		k:    k,
+	}
+}
+
+// bloomHashes returns the two independent 64-bit hashes MightContain/Add
+// combine via double hashing (Kirsch-Mitzenmacher) to simulate k
+// hash functions without running k independent hash passes.
+func bloomHashes(s string) (uint64, uint64) {
+	h1 := fnv.New64a()
+	h1.Write([]byte(s))
+	sum1 := h1.Sum64()
+
+	h2 := fnv.New64()
+	h2.Write([]byte(s))
+	sum2 := h2.Sum64()
+
+	return sum1, sum2
+}
+
+func (b *bloomFilter) Add(s string) {
+	h1, h2 := bloomHashes(s)
+	for i := 0; i < b.k; i++ {
+		idx := (h1 + uint64(i)*h2) % b.m
+		b.bits[idx/64] |= 1 << (idx % 64)
+	}
+}
+
+func (b *bloomFilter) MightContain(s string) bool {
+	h1, h2 := bloomHashes(s)
+	for i := 0; i < b.k; i++ {
+		idx := (h1 + uint64(i)*h2) % b.m
+		if b.bits[idx/64]&(1<<(idx%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// QueuePush adds a locally-generated alert to the next outgoing batch. Safe
+// to call from checkForNewAlerts even when no push-capable source is
+// configured — the queue is simply never drained.
+func (t *ThreatFeedClient) QueuePush(alert SecurityAlert) {
+	t.pushMutex.Lock()
+	t.pushQueue = append(t.pushQueue, alert)
+	t.pushMutex.Unlock()
+}
+
+// pushLoop flushes the queued alerts upstream every threatFeedPushInterval.
+func (t *ThreatFeedClient) pushLoop() {
+	ticker := time.NewTicker(threatFeedPushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			t.flushPushQueue()
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+func (t *ThreatFeedClient) flushPushQueue() {
+	t.pushMutex.Lock()
+	batch := t.pushQueue
+	t.pushQueue = nil
+	t.pushMutex.Unlock()
+
+	if len(batch) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"alerts": batch})
+	if err != nil {
+		log.Printf("⚠️  threat feed push: failed to encode batch: %v", err)
+		return
+	}
+
+	for _, source := range t.sources {
+		if source.PushURL == "" {
+			continue
+		}
+		req, err := http.NewRequest(http.MethodPost, source.PushURL, bytes.NewReader(body))
+		if err != nil {
+			continue
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if source.APIKey != "" {
+			req.Header.Set("X-Api-Key", source.APIKey)
+		}
+		resp, err := t.httpClient.Do(req)
+		if err != nil {
+			log.Printf("⚠️  threat feed %q: push failed: %v", source.Name, err)
+			continue
+		}
+		resp.Body.Close()
+	}
+}
+
+// newThreatFeedSourcesFromEnv parses THREAT_FEED_SOURCES, a comma-separated
+// list of "name=pullURL" pairs (e.g.
+// "community:crowdsec=https://feed.example.com/v1/decisions/stream"). Per-source
+// settings are read from name-derived env vars so multiple sources don't
+// share one API key or certificate pair.
+func newThreatFeedSourcesFromEnv() []ThreatFeedSource {
+	spec := os.Getenv("THREAT_FEED_SOURCES")
+	if spec == "" {
+		return nil
+	}
+
+	var sources []ThreatFeedSource
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, pullURL, ok := strings.Cut(part, "=")
+		if !ok {
+			continue
+		}
+		name = strings.TrimSpace(name)
+		envKey := threatFeedEnvKey(name)
+
+		sources = append(sources, ThreatFeedSource{
+			Name:           name,
+			PullURL:        strings.TrimSpace(pullURL),
+			PushURL:        os.Getenv("THREAT_FEED_PUSH_URL_" + envKey),
+			APIKey:         os.Getenv("THREAT_FEED_APIKEY_" + envKey),
+			ClientCertFile: os.Getenv("THREAT_FEED_CLIENT_CERT_" + envKey),
+			ClientKeyFile:  os.Getenv("THREAT_FEED_CLIENT_KEY_" + envKey),
+			CACertFile:     os.Getenv("THREAT_FEED_CA_CERT_" + envKey),
+			Kind:           os.Getenv("THREAT_FEED_KIND_" + envKey),
+			CollectionID:   os.Getenv("THREAT_FEED_COLLECTION_" + envKey),
+		})
+	}
+	return sources
+}
+
+// threatFeedEnvKey turns a source name like "community:crowdsec" into the
+// env var suffix COMMUNITY_CROWDSEC.
+func threatFeedEnvKey(name string) string {
+	upper := strings.ToUpper(name)
+	replacer := strings.NewReplacer(":", "_", "-", "_", ".", "_")
+	return replacer.Replace(upper)
+}
+
+// threatFeedPullIntervalFromEnv reads THREAT_FEED_PULL_INTERVAL_SECONDS,
+// falling back to defaultThreatFeedPullInterval.
+func threatFeedPullIntervalFromEnv() time.Duration {
+	raw := os.Getenv("THREAT_FEED_PULL_INTERVAL_SECONDS")
+	if raw == "" {
+		return defaultThreatFeedPullInterval
+	}
+	seconds, err := strconv.Atoi(raw)
+	if err != nil || seconds <= 0 {
+		return defaultThreatFeedPullInterval
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// initializeThreatFeedColumns adds the source column ip_reputation needs to
+// track which feed owns a decision, for deployments that created the table
+// before threat-feed reconciliation existed; CREATE TABLE already includes
+// it for a fresh database.
+func initializeThreatFeedColumns(db *sql.DB) error {
+	_, err := db.Exec(`ALTER TABLE ip_reputation
+		ADD COLUMN IF NOT EXISTS source VARCHAR(64) NOT NULL DEFAULT 'local:manual'`)
+	if err != nil {
+		return fmt.Errorf("failed to add threat feed columns: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,323 @@
+// 3-D Secure challenge flow: Init3DSPayment/Complete3DSPayment split
+// processPaymentHandler's single ProviderRouter.ProcessPayment call into two
+// steps for card payments that require a cardholder challenge. A transaction
+// is created up front in 'requires_authentication' status and only moves to
+// 'completed' -- with the usual fee/ledger/logging side effects -- once
+// Complete3DSPayment verifies the issuing bank's challenge result. The
+// three_ds table tracks the in-flight challenge between the two calls;
+// threeDSSweepInterval-driven cleanup expires anything left abandoned.
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// threeDSChallengeTimeout is how long a cardholder has to complete the
+// issuing bank's challenge before init3DSSweep marks it cancelled.
+const threeDSChallengeTimeout = 10 * time.Minute
+
+// threeDSSweepInterval is how often the abandoned-challenge sweep runs;
+// frequent enough that a cancelled challenge is reflected well within one
+// challenge timeout of actually expiring.
+const threeDSSweepInterval = 1 * time.Minute
+
+func initializeThreeDSTables(db *sql.DB) error {
+	statements := []string{
+		`ALTER TABLE transactions MODIFY COLUMN status ENUM('pending', 'completed', 'failed', 'cancelled', 'requires_authentication') DEFAULT 'pending'`,
+
+		`CREATE TABLE IF NOT EXISTS three_ds (
+			challenge_ref VARCHAR(64) PRIMARY KEY,
+			user_id INT NOT NULL,
+			transaction_id INT NOT NULL,
+			provider_id VARCHAR(50) NOT NULL,
+			provider_payment_id VARCHAR(255) NOT NULL,
+			amount DECIMAL(10,2) NOT NULL,
+			currency VARCHAR(10) NOT NULL,
+			region VARCHAR(10),
+			method VARCHAR(20),
+			description TEXT,
+			idempotency_key VARCHAR(255),
+			status ENUM('pending', 'authenticated', 'failed', 'cancelled') NOT NULL DEFAULT 'pending',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			expires_at TIMESTAMP NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			FOREIGN KEY (transaction_id) REFERENCES transactions(id) ON DELETE CASCADE,
+			INDEX idx_status_expires (status, expires_at)
+		)`,
+	}
+
+	for _, stmt := range statements {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to initialize 3DS tables: %v", err)
+		}
+	}
+	return nil
+}
+
+// newChallengeRef returns an opaque, unguessable reference for a three_ds
+// row, in the same random-token-then-hex-encode style used for other
+// generated identifiers in this codebase (see newEncryptionKeyID).
+func newChallengeRef() string {
+	raw := make([]byte, 16)
+	rand.Read(raw)
+	return "3ds_" + hex.EncodeToString(raw)
+}
+
+// Init3DSPayment selects a 3DS-capable provider, opens a challenge with it,
+// and records both the transaction (status 'requires_authentication') and
+// the three_ds challenge row a later Complete3DSPayment call will look up by
+// ChallengeRef.
+func (r *ProviderRouter) Init3DSPayment(userID int, req *PaymentRequest, idempotencyKey string) (*PaymentResponse, error) {
+	provider, err := r.selectProvider(req.Currency, req.Region, req.Method)
+	if err != nil {
+		return &PaymentResponse{Success: false, Message: "No payment provider available"}, err
+	}
+
+	threeDSProvider, ok := provider.(ThreeDSProvider)
+	if !ok {
+		return &PaymentResponse{Success: false, Message: "Selected provider does not support 3-D Secure"},
+			fmt.Errorf("provider %s does not implement ThreeDSProvider", provider.ID())
+	}
+
+	txID, err := r.createPendingTransaction(userID, provider.ID(), idempotencyKey, req)
+	if err != nil {
+		return &PaymentResponse{Success: false, Message: "Failed to initialize payment"}, err
+	}
+
+	htmlContent, providerPaymentID, err := threeDSProvider.Init3DS(userID, req)
+	r.recordOutcome(provider.ID(), err)
+	if err != nil {
+		r.markTransactionStatus(txID, "failed")
+		return &PaymentResponse{Success: false, Message: "Failed to start 3-D Secure challenge"}, err
+	}
+
+	challengeRef := newChallengeRef()
+	expiresAt := time.Now().Add(threeDSChallengeTimeout)
+	_, err = r.db.Exec(`
+		INSERT INTO three_ds (challenge_ref, user_id, transaction_id, provider_id, provider_payment_id, amount, currency, region, method, description, idempotency_key, status, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 'pending', ?)
+	`, challengeRef, userID, txID, provider.ID(), providerPaymentID, req.Amount, normalizeCurrency(req.Currency), req.Region, req.Method, req.Description, nullableString(idempotencyKey), expiresAt)
+	if err != nil {
+		r.markTransactionStatus(txID, "failed")
+		return &PaymentResponse{Success: false, Message: "Failed to persist 3-D Secure challenge"}, err
+	}
+
+	return &PaymentResponse{
+		Success:       true,
+		TransactionID: fmt.Sprintf("txn_%d", txID),
+		Message:       "3-D Secure authentication required",
+		Status:        "requires_authentication",
+		HTMLContent:   htmlContent,
+		ChallengeRef:  challengeRef,
+	}, nil
+}
+
+// Complete3DSPayment verifies paRes with the provider that owns challengeRef
+// and, on success, continues exactly as ProcessPayment does for a
+// non-challenged payment: it writes the balanced ledger entries and marks
+// the transaction completed.
+func (r *ProviderRouter) Complete3DSPayment(challengeRef, paRes string) (*PaymentResponse, error) {
+	var userID int
+	var txID int64
+	var providerID, providerPaymentID, currency, status string
+	var amount float64
+	var expiresAt time.Time
+	err := r.db.QueryRow(`
+		SELECT user_id, transaction_id, provider_id, provider_payment_id, amount, currency, status, expires_at
+		FROM three_ds WHERE challenge_ref = ?
+	`, challengeRef).Scan(&userID, &txID, &providerID, &providerPaymentID, &amount, &currency, &status, &expiresAt)
+	if err != nil {
+		return &PaymentResponse{Success: false, Message: "Unknown challenge reference"}, err
+	}
+	if status != "pending" {
+		return &PaymentResponse{Success: false, Message: fmt.Sprintf("Challenge is no longer pending (status: %s)", status)}, fmt.Errorf("challenge %s is %s, not pending", challengeRef, status)
+	}
+	if time.Now().After(expiresAt) {
+		r.markThreeDSStatus(challengeRef, "cancelled")
+		r.markTransactionStatus(txID, "cancelled")
+		return &PaymentResponse{Success: false, Message: "Challenge expired"}, fmt.Errorf("challenge %s expired at %s", challengeRef, expiresAt)
+	}
+
+	provider, ok := r.providers[providerID]
+	if !ok {
+		return &PaymentResponse{Success: false, Message: "Payment provider no longer available"}, fmt.Errorf("provider %s not registered", providerID)
+	}
+	threeDSProvider, ok := provider.(ThreeDSProvider)
+	if !ok {
+		return &PaymentResponse{Success: false, Message: "Payment provider no longer supports 3-D Secure"}, fmt.Errorf("provider %s does not implement ThreeDSProvider", providerID)
+	}
+
+	if err := threeDSProvider.Complete3DS(providerPaymentID, paRes); err != nil {
+		r.recordOutcome(providerID, err)
+		r.markThreeDSStatus(challengeRef, "failed")
+		r.markTransactionStatus(txID, "failed")
+		return &PaymentResponse{Success: false, Message: "3-D Secure authentication failed"}, err
+	}
+	r.recordOutcome(providerID, nil)
+
+	if err := r.completeTransaction(txID, userID, amount, currency); err != nil {
+		return &PaymentResponse{Success: false, Message: "Failed to finalize payment"}, err
+	}
+	r.markThreeDSStatus(challengeRef, "authenticated")
+
+	return &PaymentResponse{
+		Success:       true,
+		TransactionID: fmt.Sprintf("txn_%d", txID),
+		Message:       "Payment processed successfully",
+	}, nil
+}
+
+// createPendingTransaction writes the transactions row Init3DSPayment's
+// challenge is opened against, in 'requires_authentication' status with no
+// ledger entries yet -- those are only written once the challenge succeeds.
+func (r *ProviderRouter) createPendingTransaction(userID int, providerID, idempotencyKey string, req *PaymentRequest) (int64, error) {
+	res, err := r.db.Exec(`
+		INSERT INTO transactions (user_id, type, amount, description, status, provider_id, reconciliation_status, idempotency_key)
+		VALUES (?, 'payment', ?, ?, 'requires_authentication', ?, 'pending', ?)
+	`, userID, req.Amount, req.Description, providerID, nullableString(idempotencyKey))
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// completeTransaction moves a requires_authentication transaction to
+// completed and writes its ledger entries in one sql.Tx, mirroring
+// persistTransaction's insert-plus-ledger atomicity for the update path.
+func (r *ProviderRouter) completeTransaction(txID int64, userID int, amount float64, currency string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE transactions SET status = 'completed' WHERE id = ?`, txID); err != nil {
+		return err
+	}
+	if err := writeLedgerEntries(tx, txID, paymentLedgerEntries(userID, amount, currency)); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	transactionAmountHistogram.Observe(amount)
+	r.webhooks.Publish(WebhookEvent{Type: webhookEventPaymentCompleted, UserID: userID, TransactionID: txID, Amount: amount, Currency: currency, OccurredAt: time.Now()})
+	return nil
+}
+
+func (r *ProviderRouter) markTransactionStatus(txID int64, status string) {
+	if _, err := r.db.Exec(`UPDATE transactions SET status = ? WHERE id = ?`, status, txID); err != nil {
+		log.Printf("⚠️  3DS: failed to mark transaction %d as %s: %v", txID, status, err)
+	}
+}
+
+func (r *ProviderRouter) markThreeDSStatus(challengeRef, status string) {
+	if _, err := r.db.Exec(`UPDATE three_ds SET status = ? WHERE challenge_ref = ?`, status, challengeRef); err != nil {
+		log.Printf("⚠️  3DS: failed to mark challenge %s as %s: %v", challengeRef, status, err)
+	}
+}
+
+// sweepAbandonedThreeDSChallenges cancels every pending three_ds row whose
+// expires_at has passed along with its underlying transaction, so a
+// cardholder who never completes the bank's challenge doesn't leave a
+// transaction stuck in requires_authentication forever.
+func (r *ProviderRouter) sweepAbandonedThreeDSChallenges() {
+	rows, err := r.db.Query(`
+		SELECT challenge_ref, transaction_id FROM three_ds WHERE status = 'pending' AND expires_at <= NOW()
+	`)
+	if err != nil {
+		log.Printf("⚠️  3DS: failed to load expired challenges: %v", err)
+		return
+	}
+
+	type expired struct {
+		challengeRef string
+		txID         int64
+	}
+	var due []expired
+	for rows.Next() {
+		var e expired
+		if err := rows.Scan(&e.challengeRef, &e.txID); err == nil {
+			due = append(due, e)
+		}
+	}
+	rows.Close()
+
+	for _, e := range due {
+		r.markThreeDSStatus(e.challengeRef, "cancelled")
+		r.markTransactionStatus(e.txID, "cancelled")
+	}
+}
+
+// StartThreeDSSweep launches the background goroutine that expires
+// abandoned challenges; call alongside Start during router setup.
+func (r *ProviderRouter) StartThreeDSSweep(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.sweepAbandonedThreeDSChallenges()
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+}
+
+// init3DSPaymentHandler handles POST /payments/3ds/init.
+func (sth *SecureTransactionHandler) init3DSPaymentHandler(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	var req PaymentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	idempotencyKey := c.GetHeader("Idempotency-Key")
+	response, err := sth.providerRouter.Init3DSPayment(userID, &req, idempotencyKey)
+	if err != nil {
+		log.Printf("3DS init error for user %d: %v", userID, err)
+		c.JSON(http.StatusBadRequest, response)
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// complete3DSChallengeRequest is POST /payments/3ds/complete's body: the
+// opaque reference Init3DSPayment returned plus the issuing bank's
+// challenge result (PaRes in 3DS1 terms; carries the equivalent payload for
+// a 3DS2 frictionless/challenge flow too).
+type complete3DSChallengeRequest struct {
+	ChallengeRef string `json:"challenge_ref" binding:"required"`
+	PaRes        string `json:"pa_res" binding:"required"`
+}
+
+// complete3DSPaymentHandler handles POST /payments/3ds/complete.
+func (sth *SecureTransactionHandler) complete3DSPaymentHandler(c *gin.Context) {
+	var req complete3DSChallengeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	response, err := sth.providerRouter.Complete3DSPayment(req.ChallengeRef, req.PaRes)
+	if err != nil {
+		log.Printf("3DS complete error for challenge %s: %v", req.ChallengeRef, err)
+		c.JSON(http.StatusBadRequest, response)
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
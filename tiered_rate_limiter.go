@@ -0,0 +1,297 @@
+// Per-route, per-user/IP tiered rate limiting on top of a sliding-window
+// log, distinct from advancedRateLimitMiddleware's coarse IP-abuse
+// blocking (secure_system.go): that one blocks an IP outright after it
+// burns through a single global budget, this one enforces a budget per
+// (tier, caller) pair -- e.g. payments and payouts get their own, tighter
+// limits than the rest of the API -- and tells the caller exactly how
+// close they are via response headers instead of only rejecting.
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var rateLimitTierRejectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "krili_rate_limit_tier_rejections_total",
+	Help: "Requests rejected by tieredRateLimitMiddleware, by tier name.",
+}, []string{"tier"})
+
+// RateLimiter decides whether the caller identified by key may make
+// another request under a budget of limit requests per window, using the
+// sliding-window log algorithm (as opposed to RateLimitBackend's token
+// bucket in rate_limit_backend.go): remaining and retryAfter let the
+// caller report standard X-RateLimit-*/Retry-After headers instead of a
+// bare allow/deny.
+type RateLimiter interface {
+	Allow(key string, limit int, window time.Duration) (allowed bool, remaining int, retryAfter time.Duration)
+}
+
+// RateLimitTier names one (method, path) route's sliding-window budget.
+// Method and Path are matched exactly against the incoming request;
+// leave both empty for the catch-all default tier, which
+// matchRateLimitTier only falls back to once no specific tier matches.
+type RateLimitTier struct {
+	Name   string
+	Method string
+	Path   string
+	Limit  int
+	Window time.Duration
+}
+
+// defaultRateLimitTiers returns the tiers every deployment gets unless
+// RATE_LIMIT_TIERS overrides them: a tight budget on payments and
+// payouts, and a looser default for everything else.
+func defaultRateLimitTiers() []RateLimitTier {
+	return []RateLimitTier{
+		{Name: "payments", Method: http.MethodPost, Path: "/api/v1/payments", Limit: 10, Window: time.Minute},
+		{Name: "payouts", Method: http.MethodPost, Path: "/api/v1/payouts", Limit: 5, Window: time.Minute},
+		{Name: "default", Limit: 60, Window: time.Minute},
+	}
+}
+
+// newRateLimitTiersFromEnv parses RATE_LIMIT_TIERS, a comma-separated list
+// of "name:method:path:limit:window_seconds" entries (method/path empty
+// for the catch-all default tier, e.g. "default::: 60:60"), falling back
+// to defaultRateLimitTiers when unset or if every entry fails to parse.
+func newRateLimitTiersFromEnv() []RateLimitTier {
+	raw := strings.TrimSpace(getEnv("RATE_LIMIT_TIERS", ""))
+	if raw == "" {
+		return defaultRateLimitTiers()
+	}
+
+	var tiers []RateLimitTier
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) != 5 {
+			log.Printf("⚠️  rate limit tier %q: expected name:method:path:limit:window_seconds, skipping", entry)
+			continue
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(parts[3]))
+		if err != nil {
+			log.Printf("⚠️  rate limit tier %q: invalid limit: %v, skipping", entry, err)
+			continue
+		}
+		windowSeconds, err := strconv.Atoi(strings.TrimSpace(parts[4]))
+		if err != nil || windowSeconds <= 0 {
+			log.Printf("⚠️  rate limit tier %q: invalid window_seconds: %v, skipping", entry, err)
+			continue
+		}
+		tiers = append(tiers, RateLimitTier{
+			Name:   strings.TrimSpace(parts[0]),
+			Method: strings.TrimSpace(parts[1]),
+			Path:   strings.TrimSpace(parts[2]),
+			Limit:  limit,
+			Window: time.Duration(windowSeconds) * time.Second,
+		})
+	}
+	if len(tiers) == 0 {
+		log.Printf("⚠️  RATE_LIMIT_TIERS set but no entry parsed, falling back to defaults")
+		return defaultRateLimitTiers()
+	}
+	return tiers
+}
+
+// matchRateLimitTier returns the first tier whose method and path match
+// the request exactly, or the catch-all tier (empty Method and Path) if
+// none do. Callers must ensure tiers includes a catch-all entry.
+func matchRateLimitTier(tiers []RateLimitTier, method, path string) RateLimitTier {
+	var fallback RateLimitTier
+	for _, t := range tiers {
+		if t.Method == "" && t.Path == "" {
+			fallback = t
+			continue
+		}
+		if t.Method == method && t.Path == path {
+			return t
+		}
+	}
+	return fallback
+}
+
+// tieredRateLimitKey scopes the sliding window to the authenticated user
+// when one is set on the context (c.Set("user_id", ...) by
+// enhancedAuthMiddleware), falling back to IP for anonymous requests.
+func tieredRateLimitKey(c *gin.Context, tier RateLimitTier, ip string) string {
+	if userID, ok := c.Get("user_id"); ok {
+		return fmt.Sprintf("%s:user:%v", tier.Name, userID)
+	}
+	return fmt.Sprintf("%s:ip:%s", tier.Name, ip)
+}
+
+// tieredRateLimitMiddleware enforces ess.rateLimitTiers against
+// ess.tieredRateLimiter, writing X-RateLimit-Limit/X-RateLimit-Remaining
+// on every response and Retry-After/429 once a caller exceeds their
+// tier's budget.
+func (ess *EnhancedSecurityService) tieredRateLimitMiddleware() gin.HandlerFunc {
+	tiers := ess.rateLimitTiers
+	if len(tiers) == 0 {
+		tiers = defaultRateLimitTiers()
+	}
+
+	return func(c *gin.Context) {
+		tier := matchRateLimitTier(tiers, c.Request.Method, c.FullPath())
+		key := tieredRateLimitKey(c, tier, ess.getRealIP(c))
+
+		allowed, remaining, retryAfter := ess.tieredRateLimiter.Allow(key, tier.Limit, tier.Window)
+
+		c.Header("X-RateLimit-Limit", strconv.Itoa(tier.Limit))
+		c.Header("X-RateLimit-Remaining", strconv.Itoa(remaining))
+
+		if !allowed {
+			rateLimitTierRejectionsTotal.WithLabelValues(tier.Name).Inc()
+			c.Header("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+			c.JSON(http.StatusTooManyRequests, gin.H{
+				"error":       fmt.Sprintf("rate limit exceeded for %s", tier.Name),
+				"retry_after": int(retryAfter.Seconds()),
+			})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// inProcessSlidingWindowLimiterMaxKeys bounds the sliding-window log the
+// same way rate_limit_backend.go's inProcessRateLimitBackend bounds its
+// limiters: newTieredRateLimiterFromDSN always falls back to this
+// (no Redis client is vendored in this environment), so it's the live
+// production path, not just a dev fallback, and needs the same cap.
+const inProcessSlidingWindowLimiterMaxKeys = 4096
+
+// inProcessSlidingWindowLimiter is the fallback RateLimiter for dev and
+// unit tests: a sliding-window log per key, mirroring the same
+// ZREMRANGEBYSCORE/ZCARD/ZADD steps redisSlidingWindowLimiter runs
+// against Redis, just against an in-memory slice of timestamps instead of
+// a sorted set. Keys live in a shardedTTLCache (see rate_limit_backend.go,
+// which hit the same unbounded-map leak first) instead of a bare map, so
+// an idle caller's log ages out instead of sitting in memory forever.
+type inProcessSlidingWindowLimiter struct {
+	logs *shardedTTLCache
+}
+
+func newInProcessSlidingWindowLimiter() *inProcessSlidingWindowLimiter {
+	return &inProcessSlidingWindowLimiter{logs: newShardedTTLCache("tiered_rate_limiter", inProcessSlidingWindowLimiterMaxKeys)}
+}
+
+func (l *inProcessSlidingWindowLimiter) Allow(key string, limit int, window time.Duration) (bool, int, time.Duration) {
+	now := time.Now()
+	cutoff := now.Add(-window)
+
+	var entries []time.Time
+	if cached, ok := l.logs.Get(key); ok {
+		entries = cached.([]time.Time)
+	}
+
+	pruned := entries[:0]
+	for _, t := range entries {
+		if t.After(cutoff) {
+			pruned = append(pruned, t)
+		}
+	}
+
+	if len(pruned) >= limit {
+		l.logs.Set(key, pruned, window)
+		retryAfter := window - now.Sub(pruned[0])
+		if retryAfter < 0 {
+			retryAfter = 0
+		}
+		return false, 0, retryAfter
+	}
+
+	pruned = append(pruned, now)
+	// The TTL matches window: once a key's log has been empty of activity
+	// for a full window, there's nothing left to prune and the entry can
+	// be reclaimed instead of sitting idle waiting for the same caller to
+	// come back.
+	l.logs.Set(key, pruned, window)
+	return true, limit - len(pruned), 0
+}
+
+// redisConn is the minimal command surface the sliding-window algorithm
+// needs from a Redis client. It's kept separate from a concrete go-redis
+// dependency -- not vendored in this environment, see
+// rate_limit_backend.go's redisRateLimitBackend, which hits the same
+// wall -- so the algorithm itself isn't blocked on that dependency
+// landing; a real client just has to satisfy this interface.
+type redisConn interface {
+	// ZRemRangeByScore removes members of key scored in [min, max].
+	ZRemRangeByScore(key string, min, max int64) error
+	// ZCard returns the number of members currently in key.
+	ZCard(key string) (int64, error)
+	// ZAdd adds member to key scored at score.
+	ZAdd(key string, score int64, member string) error
+	// Expire sets key's TTL so an idle window's sorted set eventually
+	// disappears instead of accumulating forever.
+	Expire(key string, ttl time.Duration) error
+}
+
+// redisSlidingWindowLimiter implements the sliding-window log algorithm
+// against a Redis sorted set keyed by the rate-limit key, scored by
+// request timestamp in nanoseconds: prune anything older than the
+// window, count what's left, and -- if under budget -- add this request
+// and refresh the key's TTL. Every deployment running more than one API
+// instance needs this (or an equivalent shared store) instead of
+// inProcessSlidingWindowLimiter, since the in-process log only sees
+// requests that landed on that one instance.
+type redisSlidingWindowLimiter struct {
+	conn redisConn
+}
+
+func (r *redisSlidingWindowLimiter) Allow(key string, limit int, window time.Duration) (bool, int, time.Duration) {
+	now := time.Now()
+	windowStart := now.Add(-window).UnixNano()
+
+	if err := r.conn.ZRemRangeByScore(key, 0, windowStart); err != nil {
+		log.Printf("⚠️  redis sliding window limiter: prune %s: %v, failing open", key, err)
+		return true, limit, 0
+	}
+
+	count, err := r.conn.ZCard(key)
+	if err != nil {
+		log.Printf("⚠️  redis sliding window limiter: card %s: %v, failing open", key, err)
+		return true, limit, 0
+	}
+
+	if count >= int64(limit) {
+		return false, 0, window
+	}
+
+	member := fmt.Sprintf("%d", now.UnixNano())
+	if err := r.conn.ZAdd(key, now.UnixNano(), member); err != nil {
+		log.Printf("⚠️  redis sliding window limiter: add %s: %v, failing open", key, err)
+		return true, limit, 0
+	}
+	if err := r.conn.Expire(key, window); err != nil {
+		log.Printf("⚠️  redis sliding window limiter: expire %s: %v", key, err)
+	}
+
+	return true, limit - int(count) - 1, 0
+}
+
+// newTieredRateLimiterFromDSN picks a RateLimiter from a DSN scheme
+// ("redis://", "redis+sentinel://"), the same sniff
+// newRateLimitBackendFromDSN uses, falling back to the in-process sliding
+// window when no DSN is configured or no Redis client is wired in yet.
+func newTieredRateLimiterFromDSN(dsn string) RateLimiter {
+	if strings.HasPrefix(dsn, "redis://") || strings.HasPrefix(dsn, "redis+sentinel://") {
+		// TODO: dial go-redis here, wrap it to satisfy redisConn, and
+		// return a *redisSlidingWindowLimiter once the dependency is
+		// available in this environment.
+		log.Printf("⚠️  RATE_LIMIT_TIER_BACKEND_DSN=%s set but no Redis client is vendored yet; falling back to the in-process sliding window limiter", dsn)
+	}
+	return newInProcessSlidingWindowLimiter()
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	totpPeriod     = 30 * time.Second
+	totpDigits     = 6
+	totpSkewSteps  = 1 // accept ±1 step (±30s) of clock skew
+	recoveryCodeN  = 10
+)
+
+// generateTOTPSecret returns a fresh 20-byte random secret, base32-encoded
+// without padding the way most authenticator apps expect it.
+func generateTOTPSecret() (string, error) {
+	raw := make([]byte, 20)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate TOTP secret: %v", err)
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(raw), nil
+}
+
+// totpURI builds the otpauth:// URI authenticator apps scan to enroll.
+func totpURI(secret, email string) string {
+	label := url.PathEscape(fmt.Sprintf("Krili:%s", email))
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", "Krili")
+	values.Set("algorithm", "SHA1")
+	values.Set("digits", fmt.Sprintf("%d", totpDigits))
+	values.Set("period", "30")
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, values.Encode())
+}
+
+// computeTOTP implements RFC 4226/6238: HMAC-SHA1 over the 8-byte big-endian
+// counter, dynamic truncation, modulo 10^digits, zero-padded.
+func computeTOTP(secret string, counter uint64) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", fmt.Errorf("invalid TOTP secret encoding: %v", err)
+	}
+
+	counterBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(counterBytes, counter)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counterBytes)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	truncated := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	code := truncated % pow10(totpDigits)
+	return fmt.Sprintf("%0*d", totpDigits, code), nil
+}
+
+func pow10(n int) uint32 {
+	result := uint32(1)
+	for i := 0; i < n; i++ {
+		result *= 10
+	}
+	return result
+}
+
+// matchTOTPStep checks token against the current 30-second step and ±1 step
+// either side for clock skew, using a constant-time comparison so timing
+// doesn't leak which step (if any) matched. It returns the matching step
+// counter so callers can reject a second use of the same step.
+func matchTOTPStep(secret, token string) (uint64, bool) {
+	if len(token) != totpDigits {
+		return 0, false
+	}
+
+	counter := uint64(time.Now().Unix() / int64(totpPeriod.Seconds()))
+	for skew := -totpSkewSteps; skew <= totpSkewSteps; skew++ {
+		step := counter
+		if skew < 0 {
+			step -= uint64(-skew)
+		} else {
+			step += uint64(skew)
+		}
+
+		expected, err := computeTOTP(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// validateAndConsumeTOTP matches token against secret for the current step
+// ±skew, then atomically advances two_factor_auth.last_totp_counter for userID so
+// the same step can never be accepted twice, closing the window where a
+// captured code could be replayed again within the ±skew tolerance.
+func validateAndConsumeTOTP(db *sql.DB, userID int, secret, token string) bool {
+	step, ok := matchTOTPStep(secret, token)
+	if !ok {
+		return false
+	}
+
+	result, err := db.Exec(
+		"UPDATE two_factor_auth SET last_totp_counter = ? WHERE user_id = ? AND last_totp_counter < ?",
+		step, userID, step,
+	)
+	if err != nil {
+		return false
+	}
+	affected, err := result.RowsAffected()
+	return err == nil && affected > 0
+}
+
+// generateRecoveryCodes returns recoveryCodeN one-time codes formatted as
+// XXXX-XXXX (uppercase base32, so they're easy to transcribe by hand).
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, 0, recoveryCodeN)
+	for i := 0; i < recoveryCodeN; i++ {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, fmt.Errorf("failed to generate recovery code: %v", err)
+		}
+		encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(raw)
+		codes = append(codes, fmt.Sprintf("%s-%s", encoded[:4], encoded[4:8]))
+	}
+	return codes, nil
+}
+
+// initializeRecoveryCodeTable creates the recovery_codes table used to store
+// bcrypt-hashed one-time 2FA recovery codes.
+func initializeRecoveryCodeTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS recovery_codes (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			user_id INT NOT NULL,
+			code_hash VARCHAR(255) NOT NULL,
+			used_at TIMESTAMP NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			INDEX idx_user_unused (user_id, used_at)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create recovery_codes table: %v", err)
+	}
+	return nil
+}
+
+// mfaRequiredMiddleware enforces a verified MFA step on payouts and on any
+// request where the already-computed risk_score exceeds 50, beyond the
+// blanket sensitive-operation check in mfaMiddleware. Which factor(s) it will
+// accept is per-user policy (see setMFAPolicyHandler): 'totp' only checks
+// X-MFA-Token, 'webauthn' only checks the X-WebAuthn-* headers, and 'either'
+// accepts whichever of the two the caller supplied.
+func (sth *SecureTransactionHandler) mfaRequiredMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		riskScore := c.GetInt("risk_score")
+		needsMFA := strings.Contains(c.Request.URL.Path, "/payouts") || riskScore > 50
+		if !needsMFA {
+			c.Next()
+			return
+		}
+
+		userID := c.GetInt("user_id")
+		method, totpEnabled := sth.loadMFAPolicy(userID)
+		if !totpEnabled {
+			method = "webauthn"
+		}
+
+		var verified bool
+		var lastErr error
+		if method == "totp" || method == "either" {
+			if ok, err := sth.verifyTOTPStepUp(userID, c.GetHeader("X-MFA-Token")); ok {
+				verified = true
+			} else {
+				lastErr = err
+			}
+		}
+		if !verified && (method == "webauthn" || method == "either") {
+			if ok, err := sth.verifyWebAuthnStepUp(c); ok {
+				verified = true
+			} else if lastErr == nil {
+				lastErr = err
+			}
+		}
+
+		if !verified {
+			detail := "2FA verification required for this operation"
+			if lastErr != nil {
+				detail = lastErr.Error()
+			}
+			sth.logSecurityEvent(userID, "mfa_step_up_failed", "high",
+				fmt.Sprintf("2FA step-up verification failed for high-risk operation (policy=%s): %s", method, detail),
+				sth.ess.getRealIP(c), c.GetHeader("User-Agent"))
+			c.JSON(http.StatusForbidden, gin.H{"error": detail})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// verifyTOTPStepUp validates a TOTP step-up code for userID. An empty code or
+// a user with no enabled TOTP secret both just fail the check rather than
+// erroring, so "either" policy can fall through to WebAuthn.
+func (sth *SecureTransactionHandler) verifyTOTPStepUp(userID int, code string) (bool, error) {
+	if code == "" {
+		return false, fmt.Errorf("2FA verification required for this operation")
+	}
+
+	var encryptedSecret string
+	var isEnabled bool
+	err := sth.db.QueryRow("SELECT secret, is_enabled FROM two_factor_auth WHERE user_id = ?", userID).
+		Scan(&encryptedSecret, &isEnabled)
+	if err != nil || !isEnabled {
+		return false, fmt.Errorf("2FA must be enabled for this operation")
+	}
+
+	secret, err := sth.ess.decryptWithRSA(encryptedSecret)
+	if err != nil {
+		return false, fmt.Errorf("failed to read 2FA secret")
+	}
+
+	if !validateAndConsumeTOTP(sth.db, userID, secret, code) {
+		return false, fmt.Errorf("invalid 2FA code")
+	}
+	return true, nil
+}
+
+// verifyWebAuthnStepUp completes a WebAuthn assertion attached to the
+// request as headers: the caller is expected to have already called
+// beginWebAuthnAssertionHandler out of band and signed the resulting
+// challenge, then replayed the assertion here alongside the sensitive
+// request itself.
+func (sth *SecureTransactionHandler) verifyWebAuthnStepUp(c *gin.Context) (bool, error) {
+	userID := c.GetInt("user_id")
+	deviceID := c.GetHeader("X-WebAuthn-Device-ID")
+	credentialID := c.GetHeader("X-WebAuthn-Credential-ID")
+	clientDataJSON := c.GetHeader("X-WebAuthn-Client-Data")
+	authenticatorData := c.GetHeader("X-WebAuthn-Authenticator-Data")
+	signature := c.GetHeader("X-WebAuthn-Signature")
+	if deviceID == "" || credentialID == "" || clientDataJSON == "" || authenticatorData == "" || signature == "" {
+		return false, fmt.Errorf("2FA verification required for this operation")
+	}
+
+	err := sth.ess.FinishLogin(userID, deviceID, credentialID, clientDataJSON, authenticatorData, signature,
+		sth.ess.config.RequireStrongAuth)
+	if err != nil {
+		return false, fmt.Errorf("WebAuthn step-up verification failed: %v", err)
+	}
+	return true, nil
+}
+
+// mfaPolicyHandler reports the caller's current second-factor policy
+// ('totp', 'webauthn', or 'either') alongside which factors are actually
+// enrolled, so a client can decide whether switching policy first requires
+// enrolling the other factor.
+func (sth *SecureTransactionHandler) mfaPolicyHandler(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	method, totpEnabled := sth.loadMFAPolicy(userID)
+	webauthnCreds, err := sth.ess.repo.ListWebAuthnCredentials(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load WebAuthn credentials"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"method":            method,
+		"totp_enrolled":     totpEnabled,
+		"webauthn_enrolled": len(webauthnCreds) > 0,
+	})
+}
+
+// setMFAPolicyHandler switches which second factor(s) mfaRequiredMiddleware
+// will accept. A method can only be selected once the matching factor is
+// actually enrolled, so a user can never lock themselves out by pointing
+// policy at a factor they haven't set up yet.
+func (sth *SecureTransactionHandler) setMFAPolicyHandler(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	var req struct {
+		Method string `json:"method" binding:"required,oneof=totp webauthn either"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, totpEnabled := sth.loadMFAPolicy(userID)
+	webauthnCreds, err := sth.ess.repo.ListWebAuthnCredentials(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load WebAuthn credentials"})
+		return
+	}
+	webauthnEnrolled := len(webauthnCreds) > 0
+
+	if (req.Method == "totp" || req.Method == "either") && !totpEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "TOTP must be enrolled and verified before it can be selected"})
+		return
+	}
+	if (req.Method == "webauthn" || req.Method == "either") && !webauthnEnrolled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A WebAuthn credential must be registered before it can be selected"})
+		return
+	}
+
+	if _, err := sth.db.Exec("UPDATE two_factor_auth SET method = ? WHERE user_id = ?", req.Method, userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update 2FA policy"})
+		return
+	}
+
+	sth.logSecurityEvent(userID, "mfa_policy_changed", "medium",
+		fmt.Sprintf("2FA policy changed to %q", req.Method), sth.ess.getRealIP(c), c.GetHeader("User-Agent"))
+	c.JSON(http.StatusOK, gin.H{"method": req.Method})
+}
+
+// loadMFAPolicy returns the user's configured second-factor method
+// ("totp" if the row doesn't exist yet, matching the column default) and
+// whether TOTP is actually enrolled and verified.
+func (sth *SecureTransactionHandler) loadMFAPolicy(userID int) (method string, totpEnabled bool) {
+	err := sth.db.QueryRow("SELECT method, is_enabled FROM two_factor_auth WHERE user_id = ?", userID).
+		Scan(&method, &totpEnabled)
+	if err != nil {
+		return "totp", false
+	}
+	return method, totpEnabled
+}
+
+// enable2FAHandler generates a new TOTP secret and recovery codes for the
+// logged-in user. The secret is stored RSA-encrypted (is_enabled=false until
+// verify2FAHandler confirms the user has actually set up their authenticator
+// app); the recovery codes are only ever shown here, bcrypt-hashed before
+// they're persisted.
+func (sth *SecureTransactionHandler) enable2FAHandler(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	var email string
+	if err := sth.db.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&email); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate 2FA secret"})
+		return
+	}
+
+	encryptedSecret, err := sth.ess.encryptWithRSA(secret)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to secure 2FA secret"})
+		return
+	}
+
+	_, err = sth.db.Exec(`
+		INSERT INTO two_factor_auth (user_id, secret, is_enabled, method)
+		VALUES (?, ?, false, 'totp')
+		ON DUPLICATE KEY UPDATE secret = VALUES(secret), is_enabled = false
+	`, userID, encryptedSecret)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store 2FA secret"})
+		return
+	}
+
+	recoveryCodes, err := sth.replaceRecoveryCodes(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	sth.logSecurityEvent(userID, "2fa_enabled_pending_verification", "medium",
+		"User generated a new 2FA secret, awaiting first verification", sth.ess.getRealIP(c), c.GetHeader("User-Agent"))
+
+	otpauthURI := totpURI(secret, email)
+	qrPNG, err := generateQRCodePNG(otpauthURI)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render enrollment QR code"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret":         secret,
+		"otpauth_uri":    otpauthURI,
+		"qr_code_png":    base64.StdEncoding.EncodeToString(qrPNG),
+		"recovery_codes": recoveryCodes,
+	})
+}
+
+// replaceRecoveryCodes discards userID's existing recovery codes and issues
+// recoveryCodeN fresh ones, bcrypt-hashed before they're persisted. The raw
+// codes are only ever available in the handler's response, never stored.
+func (sth *SecureTransactionHandler) replaceRecoveryCodes(userID int) ([]string, error) {
+	recoveryCodes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate recovery codes")
+	}
+
+	if _, err := sth.db.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return nil, fmt.Errorf("failed to reset recovery codes")
+	}
+	for _, code := range recoveryCodes {
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash recovery codes")
+		}
+		if _, err := sth.db.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, string(hash)); err != nil {
+			return nil, fmt.Errorf("failed to store recovery codes")
+		}
+	}
+	return recoveryCodes, nil
+}
+
+// regenerateBackupCodesHandler invalidates every existing recovery code for
+// the caller and issues a fresh batch. 2FA must already be enabled -- a
+// pending enrollment gets its recovery codes from enable2FAHandler instead.
+func (sth *SecureTransactionHandler) regenerateBackupCodesHandler(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	var isEnabled bool
+	if err := sth.db.QueryRow("SELECT is_enabled FROM two_factor_auth WHERE user_id = ?", userID).Scan(&isEnabled); err != nil || !isEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "2FA must be enabled to regenerate recovery codes"})
+		return
+	}
+
+	recoveryCodes, err := sth.replaceRecoveryCodes(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	sth.logSecurityEvent(userID, "2fa_recovery_codes_regenerated", "medium",
+		"User regenerated their 2FA recovery codes, invalidating the previous batch", sth.ess.getRealIP(c), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": recoveryCodes})
+}
+
+// verify2FAHandler confirms a pending enrollment (or accepts a recovery code)
+// and flips two_factor_auth.is_enabled to true on first success.
+func (sth *SecureTransactionHandler) verify2FAHandler(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	var req struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.RecoveryCode != "" {
+		if sth.consumeRecoveryCode(userID, req.RecoveryCode) {
+			sth.logSecurityEvent(userID, "2fa_recovery_code_used", "high",
+				"User authenticated with a 2FA recovery code", sth.ess.getRealIP(c), c.GetHeader("User-Agent"))
+			c.JSON(http.StatusOK, gin.H{"verified": true, "method": "recovery_code"})
+			return
+		}
+		sth.logSecurityEvent(userID, "2fa_recovery_code_invalid", "high",
+			"Invalid 2FA recovery code attempt", sth.ess.getRealIP(c), c.GetHeader("User-Agent"))
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid or already-used recovery code"})
+		return
+	}
+
+	var encryptedSecret string
+	if err := sth.db.QueryRow("SELECT secret FROM two_factor_auth WHERE user_id = ?", userID).Scan(&encryptedSecret); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "2FA has not been set up for this account"})
+		return
+	}
+
+	secret, err := sth.ess.decryptWithRSA(encryptedSecret)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read 2FA secret"})
+		return
+	}
+
+	if !validateAndConsumeTOTP(sth.db, userID, secret, req.Code) {
+		sth.logSecurityEvent(userID, "2fa_verify_failed", "medium",
+			"2FA verification failed", sth.ess.getRealIP(c), c.GetHeader("User-Agent"))
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid 2FA code"})
+		return
+	}
+
+	if _, err := sth.db.Exec("UPDATE two_factor_auth SET is_enabled = true, last_used = NOW() WHERE user_id = ?", userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enable 2FA"})
+		return
+	}
+
+	sth.logSecurityEvent(userID, "2fa_verify_success", "info",
+		"2FA verification succeeded", sth.ess.getRealIP(c), c.GetHeader("User-Agent"))
+	c.JSON(http.StatusOK, gin.H{"verified": true, "method": "totp"})
+}
+
+// consumeRecoveryCode checks code against every unused hash on file for
+// userID and marks the first match used, so each code only ever works once.
+func (sth *SecureTransactionHandler) consumeRecoveryCode(userID int, code string) bool {
+	rows, err := sth.db.Query("SELECT id, code_hash FROM recovery_codes WHERE user_id = ? AND used_at IS NULL", userID)
+	if err != nil {
+		return false
+	}
+	defer rows.Close()
+
+	var matchedID int
+	for rows.Next() {
+		var id int
+		var hash string
+		if err := rows.Scan(&id, &hash); err != nil {
+			continue
+		}
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(code)) == nil {
+			matchedID = id
+			break
+		}
+	}
+	if matchedID == 0 {
+		return false
+	}
+
+	_, err = sth.db.Exec("UPDATE recovery_codes SET used_at = NOW() WHERE id = ?", matchedID)
+	return err == nil
+}
@@ -0,0 +1,103 @@
+// Typed request validation, layered on top of gin's existing binding
+// instead of replacing it: PaymentRequest/PayoutRequest (secure_system.go)
+// already carry `binding:"..."` struct tags go-playground/validator
+// enforces during ShouldBindJSON (validator/v10 was already an indirect
+// dependency, pulled in by gin's own binding package, so this makes it a
+// direct one rather than vendoring anything new). What's new here is
+// turning a failed validation into an RFC 7807 problem+json body with
+// per-field errors, instead of the opaque {"error": err.Error()} most
+// handlers in this file return today.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+// fieldViolation is one field's validation failure, in the shape callers of
+// problemDetail's "errors" extension member can walk without parsing the
+// validator's own error strings.
+type fieldViolation struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// problemDetail is an RFC 7807 application/problem+json body. Errors is an
+// extension member (RFC 7807 explicitly allows additional members) carrying
+// the per-field breakdown a plain "detail" string can't.
+type problemDetail struct {
+	Type   string           `json:"type"`
+	Title  string           `json:"title"`
+	Status int              `json:"status"`
+	Detail string           `json:"detail"`
+	Errors []fieldViolation `json:"errors,omitempty"`
+}
+
+// bindValidated binds c's JSON body into req, writing an RFC 7807
+// problem+json response and returning false on failure so the caller can
+// just `if !bindValidated(c, &req) { return }`. This is opt-in per handler,
+// not gin middleware: it only runs for routes whose handler calls it
+// explicitly (today, PaymentRequest/PayoutRequest in secure_system.go). A
+// new endpoint gets the old {"error": err.Error()} shape from
+// c.ShouldBindJSON unless its handler is written to call this instead.
+func bindValidated(c *gin.Context, req interface{}) bool {
+	if err := c.ShouldBindJSON(req); err != nil {
+		writeValidationProblem(c, err)
+		return false
+	}
+	return true
+}
+
+// writeValidationProblem responds with a 400 problem+json body. A
+// validator.ValidationErrors is expanded into one fieldViolation per failed
+// tag; any other bind error (malformed JSON, type mismatch) is reported as
+// a single, bodyless-detail violation since validator has nothing to say
+// about it.
+func writeValidationProblem(c *gin.Context, err error) {
+	problem := problemDetail{
+		Type:   "about:blank",
+		Title:  "Validation failed",
+		Status: http.StatusBadRequest,
+		Detail: "One or more fields failed validation",
+	}
+
+	if verrs, ok := err.(validator.ValidationErrors); ok {
+		for _, fe := range verrs {
+			problem.Errors = append(problem.Errors, fieldViolation{
+				Field:  fe.Field(),
+				Reason: validationReason(fe),
+			})
+		}
+	} else {
+		problem.Detail = err.Error()
+	}
+
+	body, err := json.Marshal(problem)
+	if err != nil {
+		body = []byte(`{"title":"Validation failed","status":400}`)
+	}
+	c.Data(http.StatusBadRequest, "application/problem+json", body)
+}
+
+// validationReason turns one validator.FieldError into a human-readable
+// reason, covering the tags PaymentRequest/PayoutRequest use; anything else
+// falls back to the tag name itself.
+func validationReason(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "gt":
+		return "must be greater than " + fe.Param()
+	case "lte":
+		return "must be at most " + fe.Param()
+	case "max":
+		return "must be at most " + fe.Param() + " characters"
+	case "iso4217":
+		return "must be a valid ISO 4217 currency code"
+	default:
+		return "failed validation: " + fe.Tag()
+	}
+}
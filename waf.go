@@ -0,0 +1,509 @@
+// WAFEngine replaces the old boolean detectSQLInjection/detectXSS/
+// detectCommandInjection helpers on EnhancedSecurityService, which flagged
+// legitimate traffic (a product search for "select a category", an email
+// attachment filename with "--" in it) because one matched pattern meant an
+// instant block. Instead, every request accumulates a threat score across
+// its URL params, parsed JSON body fields (parsed once via ShouldBindJSON,
+// not re-read raw per detector) and headers, each value run through a few
+// decoding layers first so encoded payloads can't hide from the patterns.
+// Only once the score clears Threshold is the request blocked; below that,
+// or in shadow mode, matches are just recorded to security_events.
+//
+// Rule packs are meant to be "loadable from YAML at startup so ops can tune
+// them without recompiling", but no YAML library is vendored in this build
+// (see approval_rules.go for the same tradeoff with goja). loadWAFRulePack
+// below hand-parses the flat subset rule packs actually need - a top-level
+// "rules:" list of "- id / category / pattern / weight / description" maps,
+// no nesting, no anchors - rather than pulling in a general YAML parser for
+// that.
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+
+	"krili/pkg/payloadanalyzer"
+)
+
+// WAFRule is one scored pattern in a rule pack.
+type WAFRule struct {
+	ID          string
+	Category    string // "sqli", "xss", "cmdi", ...
+	Pattern     string
+	Weight      int
+	Description string
+	compiled    *regexp.Regexp
+}
+
+// defaultWAFRules is the built-in rule pack, ported from the weights
+// implicit in the old boolean detectors: a single hit used to be enough to
+// block, so the individual patterns here are weighted high enough that one
+// match alone still clears a default threshold, while near-miss single
+// tokens (a lone "--" or "select") no longer do on their own.
+func defaultWAFRules() []WAFRule {
+	return []WAFRule{
+		{ID: "sqli-keyword", Category: "sqli", Weight: 35, Description: "SQL keyword combination",
+			Pattern: `(?i)\b(union|insert|update|delete|drop|create|alter)\s+\w*\s*(select|into|table|database)\b`},
+		{ID: "sqli-tautology", Category: "sqli", Weight: 50, Description: "SQL tautology (OR 1=1 style)",
+			Pattern: `(?i)\b(or|and)\s+\d+\s*=\s*\d+`},
+		{ID: "sqli-comment", Category: "sqli", Weight: 25, Description: "SQL comment terminator",
+			Pattern: `(?i)(;\s*--|/\*.*\*/|'\s*--)`},
+		{ID: "sqli-stacked-proc", Category: "sqli", Weight: 60, Description: "SQL Server stacked-procedure call",
+			Pattern: `(?i)\b(xp_cmdshell|sp_executesql)\b`},
+		{ID: "xss-script-tag", Category: "xss", Weight: 55, Description: "inline <script> tag",
+			Pattern: `(?i)<script[\s>]`},
+		{ID: "xss-event-handler", Category: "xss", Weight: 40, Description: "inline event handler attribute",
+			Pattern: `(?i)\bon\w+\s*=\s*["']`},
+		{ID: "xss-js-uri", Category: "xss", Weight: 45, Description: "javascript: or vbscript: URI",
+			Pattern: `(?i)\b(javascript|vbscript):`},
+		{ID: "xss-embed-tag", Category: "xss", Weight: 40, Description: "embedded iframe/object/embed tag",
+			Pattern: `(?i)<(iframe|object|embed)[\s>]`},
+		{ID: "cmdi-shell-metachar-chain", Category: "cmdi", Weight: 45, Description: "shell metacharacter followed by a binary name",
+			Pattern: "(?i)(;|\\||&&|\\$\\(|`)\\s*(cat|ls|whoami|id|uname|wget|curl|nc|rm|chmod|chown|sudo)\\b"},
+		{ID: "cmdi-path-traversal", Category: "cmdi", Weight: 40, Description: "path traversal sequence",
+			Pattern: `(\.\./|\.\.\\){2,}`},
+	}
+}
+
+// wafRouteAllowlist maps a route prefix to rule IDs that should not be
+// scored on it, for endpoints that legitimately carry content a rule would
+// otherwise flag (e.g. a CMS body editor route allowing <script>-like XSS
+// rules on its own field).
+type wafRouteAllowlist struct {
+	routePrefix string
+	ruleIDs     map[string]bool
+}
+
+// WAFMatch is one rule that fired during scoring.
+type WAFMatch struct {
+	RuleID      string
+	Category    string
+	Weight      int
+	Description string
+	Field       string
+	Excerpt     string // the exact substring that tripped the rule, for precise evidence in security_events
+}
+
+// WAFEngine holds the compiled rule pack and scoring configuration. It is
+// created once at startup and is safe for concurrent use by the gin
+// middleware goroutines.
+type WAFEngine struct {
+	mutex        sync.RWMutex
+	rules        []WAFRule
+	allowlists   []wafRouteAllowlist
+	threshold    int
+	shadowMode   bool
+	maxBodyBytes int
+}
+
+// defaultMaxInspectBodyBytes caps how much of a request body Score actually
+// runs patterns/analyzers against. The full body is still read and restored
+// for downstream handlers (readAndRestoreBody, same as idempotency hashing
+// needs); only the regex/analyzer pass - the expensive part, run per decode
+// layer per field - is bounded, so a multi-megabyte upload can't blow up
+// scoring latency on a field nobody intended to be inspectable anyway.
+const defaultMaxInspectBodyBytes = 1 << 20 // 1 MiB
+
+// newWAFEngineFromEnv builds a WAFEngine from WAF_RULES_FILE (a rule-pack
+// file in the format loadWAFRulePack understands; falls back to
+// defaultWAFRules if unset or unreadable), WAF_THRESHOLD (score required to
+// block, default 60), WAF_SHADOW_MODE ("true" to log would-be blocks to
+// security_events without rejecting, for validating a new rule pack against
+// production traffic before enforcing it), and WAF_MAX_INSPECT_BODY_BYTES
+// (defaultMaxInspectBodyBytes if unset).
+func newWAFEngineFromEnv() *WAFEngine {
+	threshold := 60
+	if v, err := strconv.Atoi(getEnv("WAF_THRESHOLD", "")); err == nil {
+		threshold = v
+	}
+
+	maxBodyBytes := defaultMaxInspectBodyBytes
+	if v, err := strconv.Atoi(getEnv("WAF_MAX_INSPECT_BODY_BYTES", "")); err == nil && v > 0 {
+		maxBodyBytes = v
+	}
+
+	engine := &WAFEngine{
+		threshold:    threshold,
+		shadowMode:   getEnv("WAF_SHADOW_MODE", "false") == "true",
+		maxBodyBytes: maxBodyBytes,
+	}
+
+	rules := defaultWAFRules()
+	if path := getEnv("WAF_RULES_FILE", ""); path != "" {
+		if loaded, err := loadWAFRulePack(path); err != nil {
+			log.Printf("⚠️  WAF: failed to load rule pack %s, using built-in rules: %v", path, err)
+		} else {
+			rules = loaded
+		}
+	}
+	engine.setRules(rules)
+
+	if spec := getEnv("WAF_ROUTE_ALLOWLIST", ""); spec != "" {
+		engine.allowlists = parseWAFAllowlistSpec(spec)
+	}
+
+	return engine
+}
+
+func (e *WAFEngine) setRules(rules []WAFRule) {
+	compiled := make([]WAFRule, 0, len(rules))
+	for _, r := range rules {
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			log.Printf("⚠️  WAF: skipping rule %s, invalid pattern: %v", r.ID, err)
+			continue
+		}
+		r.compiled = re
+		compiled = append(compiled, r)
+	}
+
+	e.mutex.Lock()
+	e.rules = compiled
+	e.mutex.Unlock()
+}
+
+// Reload re-reads the rule pack at path, replacing the active rules without
+// requiring a restart. Call this from a SIGHUP handler or admin endpoint
+// once ops want to tune scoring live (mirrors crlFileWatcher.reload in
+// mtls_auth.go).
+func (e *WAFEngine) Reload(path string) error {
+	rules, err := loadWAFRulePack(path)
+	if err != nil {
+		return err
+	}
+	e.setRules(rules)
+	log.Printf("🛡️  WAF: reloaded %d rules from %s", len(rules), path)
+	return nil
+}
+
+// parseWAFAllowlistSpec parses "route=ruleID1|ruleID2;route2=ruleID3", e.g.
+// "/api/cms/articles=xss-script-tag".
+func parseWAFAllowlistSpec(spec string) []wafRouteAllowlist {
+	var out []wafRouteAllowlist
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		route, idList, ok := strings.Cut(entry, "=")
+		if !ok {
+			continue
+		}
+		ids := make(map[string]bool)
+		for _, id := range strings.Split(idList, "|") {
+			id = strings.TrimSpace(id)
+			if id != "" {
+				ids[id] = true
+			}
+		}
+		out = append(out, wafRouteAllowlist{routePrefix: strings.TrimSpace(route), ruleIDs: ids})
+	}
+	return out
+}
+
+func (e *WAFEngine) allowedOnRoute(route, ruleID string) bool {
+	for _, a := range e.allowlists {
+		if strings.HasPrefix(route, a.routePrefix) && a.ruleIDs[ruleID] {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeLayers returns the distinct variants of s worth matching against:
+// as-is, URL-decoded, HTML-entity-decoded, and - if s looks like base64 -
+// base64-decoded. Encoded payloads (a %3Cscript%3E or a base64-wrapped SQL
+// string) would otherwise slip past plain-text patterns.
+func decodeLayers(s string) []string {
+	variants := []string{s}
+
+	if decoded, err := url.QueryUnescape(s); err == nil && decoded != s {
+		variants = append(variants, decoded)
+	}
+
+	if unescaped := html.UnescapeString(s); unescaped != s {
+		variants = append(variants, unescaped)
+	}
+
+	if looksLikeBase64(s) {
+		if decoded, err := base64.StdEncoding.DecodeString(s); err == nil && isPrintable(decoded) {
+			variants = append(variants, string(decoded))
+		}
+	}
+
+	return variants
+}
+
+var base64Pattern = regexp.MustCompile(`^[A-Za-z0-9+/]{16,}={0,2}$`)
+
+// looksLikeBase64 is a cheap heuristic, not a validator: long enough,
+// base64-alphabet-only, and a multiple of 4 in length. Good enough to avoid
+// wasting a decode attempt on ordinary query values.
+func looksLikeBase64(s string) bool {
+	return len(s)%4 == 0 && base64Pattern.MatchString(s)
+}
+
+func isPrintable(b []byte) bool {
+	for _, r := range string(b) {
+		if r == '\n' || r == '\r' || r == '\t' {
+			continue
+		}
+		if r < 0x20 || r == 0xFFFD {
+			return false
+		}
+	}
+	return true
+}
+
+// flattenJSON walks an arbitrary decoded JSON value and collects every
+// scalar into field->value pairs, dotted-path style ("address.city"), so
+// nested request bodies get scored the same as flat ones.
+func flattenJSON(prefix string, v interface{}, out map[string]string) {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, child := range val {
+			path := k
+			if prefix != "" {
+				path = prefix + "." + k
+			}
+			flattenJSON(path, child, out)
+		}
+	case []interface{}:
+		for i, child := range val {
+			flattenJSON(fmt.Sprintf("%s[%d]", prefix, i), child, out)
+		}
+	case string:
+		out[prefix] = val
+	case nil:
+		// nothing to score
+	default:
+		out[prefix] = fmt.Sprintf("%v", val)
+	}
+}
+
+// wafInputs is the set of named fields scored for one request: URL query
+// params, parsed JSON body fields, and headers. Keeping them labeled lets
+// Score report which field tripped a rule.
+func collectWAFInputs(c *gin.Context, maxBodyBytes int) map[string]string {
+	inputs := make(map[string]string)
+
+	for key, values := range c.Request.URL.Query() {
+		for i, v := range values {
+			inputs[fmt.Sprintf("query.%s[%d]", key, i)] = v
+		}
+	}
+
+	for key, values := range c.Request.Header {
+		if key == "Cookie" || key == "Authorization" {
+			continue // carry session/credential material, not attacker-controlled content worth scoring
+		}
+		for i, v := range values {
+			inputs[fmt.Sprintf("header.%s[%d]", key, i)] = v
+		}
+	}
+
+	if c.Request.Method == "POST" || c.Request.Method == "PUT" || c.Request.Method == "PATCH" {
+		body := readAndRestoreBody(c) // full body, restored for downstream handlers regardless of the cap below
+		inspect := body
+		if len(inspect) > maxBodyBytes {
+			inspect = inspect[:maxBodyBytes]
+		}
+
+		var parsed interface{}
+		if len(inspect) > 0 && len(inspect) == len(body) && json.Unmarshal(inspect, &parsed) == nil {
+			flattenJSON("body", parsed, inputs)
+		} else if len(inspect) > 0 {
+			inputs["body"] = string(inspect)
+		}
+	}
+
+	return inputs
+}
+
+// analyzerWeight turns a payloadanalyzer.Finding's 0..1 confidence into the
+// same 0-100-ish scale the regex rule weights use, so the two signal
+// sources add into one threshold-comparable score.
+func analyzerWeight(confidence float64) int {
+	return int(confidence * 100)
+}
+
+// scoreWithAnalyzers runs the parser/tokenizer-based analyzers (see
+// pkg/payloadanalyzer) against variant and folds their Findings into fired,
+// keyed by Finding.Rule the same way regex rule IDs are, so a route
+// allowlist entry works against either signal source interchangeably.
+func scoreWithAnalyzers(field, variant, route string, e *WAFEngine, fired map[string]WAFMatch) {
+	type analyzerResult struct {
+		category string
+		findings []payloadanalyzer.Finding
+	}
+	for _, res := range []analyzerResult{
+		{"sqli", payloadanalyzer.AnalyzeSQL(variant)},
+		{"xss", payloadanalyzer.AnalyzeHTML(variant)},
+		{"cmdi", payloadanalyzer.AnalyzeShell(variant)},
+	} {
+		for _, f := range res.findings {
+			if _, already := fired[f.Rule]; already {
+				continue
+			}
+			if e.allowedOnRoute(route, f.Rule) {
+				continue
+			}
+			fired[f.Rule] = WAFMatch{
+				RuleID:      f.Rule,
+				Category:    res.category,
+				Weight:      analyzerWeight(f.Confidence),
+				Description: fmt.Sprintf("payload analyzer: %s (%s)", f.Rule, f.Location),
+				Field:       field,
+				Excerpt:     f.Excerpt,
+			}
+		}
+	}
+}
+
+// Score evaluates c against the active rule pack and the parser-based
+// analyzers, returning the accumulated threat score plus every rule that
+// fired. A rule contributes its weight at most once per request, no matter
+// how many fields or decode layers it matches in.
+func (e *WAFEngine) Score(c *gin.Context) (int, []WAFMatch) {
+	e.mutex.RLock()
+	rules := e.rules
+	e.mutex.RUnlock()
+
+	inputs := collectWAFInputs(c, e.maxBodyBytes)
+	route := c.FullPath()
+	if route == "" {
+		route = c.Request.URL.Path
+	}
+
+	fired := make(map[string]WAFMatch)
+	for field, value := range inputs {
+		for _, variant := range decodeLayers(value) {
+			for _, rule := range rules {
+				if _, already := fired[rule.ID]; already {
+					continue
+				}
+				if e.allowedOnRoute(route, rule.ID) {
+					continue
+				}
+				if rule.compiled.MatchString(variant) {
+					fired[rule.ID] = WAFMatch{
+						RuleID:      rule.ID,
+						Category:    rule.Category,
+						Weight:      rule.Weight,
+						Description: rule.Description,
+						Field:       field,
+						Excerpt:     excerptFor(variant),
+					}
+				}
+			}
+			scoreWithAnalyzers(field, variant, route, e, fired)
+		}
+	}
+
+	score := 0
+	matches := make([]WAFMatch, 0, len(fired))
+	for _, m := range fired {
+		score += m.Weight
+		matches = append(matches, m)
+	}
+	return score, matches
+}
+
+// excerptFor caps variant to a loggable length for a regex match's
+// Excerpt field, mirroring payloadanalyzer's own excerpt helper.
+func excerptFor(variant string) string {
+	const maxLen = 120
+	if len(variant) > maxLen {
+		return variant[:maxLen] + "…"
+	}
+	return variant
+}
+
+// loadWAFRulePack parses the hand-rolled rule-pack format described in this
+// file's header comment:
+//
+//	rules:
+//	  - id: sqli-tautology
+//	    category: sqli
+//	    pattern: "(?i)\\b(or|and)\\s+\\d+\\s*=\\s*\\d+"
+//	    weight: 50
+//	    description: SQL tautology
+//
+// Lines are indentation-insensitive beyond distinguishing a new list item
+// (a line starting with "- ") from a key of the current item. Blank lines
+// and lines starting with "#" are ignored. This covers what rule packs
+// actually need; it is not a general YAML parser.
+func loadWAFRulePack(path string) ([]WAFRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []WAFRule
+	var current *WAFRule
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "rules:" {
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "- ") {
+			if current != nil {
+				rules = append(rules, *current)
+			}
+			current = &WAFRule{}
+			trimmed = strings.TrimPrefix(trimmed, "- ")
+		}
+		if current == nil {
+			continue
+		}
+
+		key, value, ok := strings.Cut(trimmed, ":")
+		if !ok {
+			continue
+		}
+		key = strings.TrimSpace(key)
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+
+		switch key {
+		case "id":
+			current.ID = value
+		case "category":
+			current.Category = value
+		case "pattern":
+			current.Pattern = strings.ReplaceAll(value, `\\`, `\`)
+		case "weight":
+			if w, err := strconv.Atoi(value); err == nil {
+				current.Weight = w
+			}
+		case "description":
+			current.Description = value
+		}
+	}
+	if current != nil {
+		rules = append(rules, *current)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("no rules parsed from %s", path)
+	}
+	return rules, nil
+}
@@ -0,0 +1,653 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gin-gonic/gin"
+)
+
+// WebAuthn/FIDO2 passwordless authentication. Replaces the old
+// compareBiometricData opaque-byte stub: an authenticator holds a private
+// key that never leaves it, registers the matching public key here via
+// BeginRegistration/FinishRegistration, and later proves possession of it by
+// signing a one-time server-issued challenge via BeginLogin/FinishLogin. A
+// successful assertion counts as a second factor alongside TOTP (see
+// biometricAuthMiddleware, totp.go).
+
+// COSE algorithm identifiers (RFC 9053 §8) for the signature schemes
+// BeginRegistration advertises and FinishRegistration/FinishLogin accept.
+const (
+	coseAlgES256 = -7   // ECDSA w/ SHA-256 over P-256
+	coseAlgEdDSA = -8   // Ed25519
+	coseAlgRS256 = -257 // RSASSA-PKCS1-v1_5 w/ SHA-256
+)
+
+// WebAuthnCredential is one authenticator a user has registered: its COSE
+// public key plus the signature counter used to detect cloned
+// authenticators, the storage-layer successor to BiometricAuth's opaque
+// template_hash column.
+type WebAuthnCredential struct {
+	ID           int       `json:"id" db:"id"`
+	UserID       int       `json:"user_id" db:"user_id"`
+	DeviceID     string    `json:"device_id" db:"device_id"`
+	CredentialID string    `json:"credential_id" db:"credential_id"` // base64url, per WebAuthn §5.8.2
+	PublicKey    []byte    `json:"-" db:"public_key"`                // COSE_Key CBOR, per WebAuthn §6.5.1.1
+	Algorithm    int       `json:"algorithm" db:"algorithm"`         // COSE alg identifier
+	SignCount    uint32    `json:"sign_count" db:"sign_count"`
+	AAGUID       string    `json:"aaguid" db:"aaguid"`
+	Transports   string    `json:"transports" db:"transports"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+}
+
+// PublicKeyCredentialRpEntity identifies the relying party (this service) to
+// the browser/authenticator during registration and login.
+type PublicKeyCredentialRpEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// PublicKeyCredentialUserEntity identifies the account a credential is being
+// registered for. ID is the WebAuthn "user handle": an opaque base64url
+// identifier, distinct from Name/DisplayName, that FinishLogin never needs
+// to look at since credentials are looked up by credential ID instead.
+type PublicKeyCredentialUserEntity struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type PublicKeyCredentialParameters struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+// PublicKeyCredentialCreationOptions is what BeginRegistration returns for
+// the browser's navigator.credentials.create() call.
+type PublicKeyCredentialCreationOptions struct {
+	Challenge        string                          `json:"challenge"` // base64url
+	RP               PublicKeyCredentialRpEntity     `json:"rp"`
+	User             PublicKeyCredentialUserEntity   `json:"user"`
+	PubKeyCredParams []PublicKeyCredentialParameters `json:"pubKeyCredParams"`
+	Timeout          int                             `json:"timeout"`
+	Attestation      string                          `json:"attestation"`
+}
+
+// PublicKeyCredentialDescriptor identifies one of a user's already
+// registered credentials, so BeginLogin can scope the browser's assertion
+// prompt to only the authenticators that hold a matching private key.
+type PublicKeyCredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"` // base64url credential ID
+}
+
+// PublicKeyCredentialRequestOptions is what BeginLogin returns for the
+// browser's navigator.credentials.get() call.
+type PublicKeyCredentialRequestOptions struct {
+	Challenge        string                          `json:"challenge"`
+	RPID             string                          `json:"rpId"`
+	AllowCredentials []PublicKeyCredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                          `json:"userVerification"`
+	Timeout          int                             `json:"timeout"`
+}
+
+// webauthnClientData is the subset of clientDataJSON (WebAuthn §5.8.1)
+// FinishRegistration/FinishLogin check: that it was produced for the right
+// ceremony, the right challenge, and the right origin.
+type webauthnClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// issueWebAuthnChallenge generates a fresh random challenge for userID/
+// deviceID and remembers it so FinishRegistration/FinishLogin can confirm
+// the response that comes back is for the challenge we actually issued, not
+// a replayed one.
+func (ess *EnhancedSecurityService) issueWebAuthnChallenge(userID int, deviceID string) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate WebAuthn challenge: %v", err)
+	}
+	challenge := base64.RawURLEncoding.EncodeToString(raw)
+
+	ess.mutex.Lock()
+	ess.webauthnChallenges[webauthnChallengeKey(userID, deviceID)] = challenge
+	ess.mutex.Unlock()
+
+	return challenge, nil
+}
+
+// consumeWebAuthnChallenge returns whether challenge is the one outstanding
+// for userID/deviceID, deleting it either way so it can never be reused.
+func (ess *EnhancedSecurityService) consumeWebAuthnChallenge(userID int, deviceID, challenge string) bool {
+	key := webauthnChallengeKey(userID, deviceID)
+
+	ess.mutex.Lock()
+	expected, exists := ess.webauthnChallenges[key]
+	delete(ess.webauthnChallenges, key)
+	ess.mutex.Unlock()
+
+	return exists && expected == challenge
+}
+
+func webauthnChallengeKey(userID int, deviceID string) string {
+	return fmt.Sprintf("%d_%s", userID, deviceID)
+}
+
+// BeginRegistration issues a fresh challenge and returns the options the
+// browser's navigator.credentials.create() call needs: RP ID/name from
+// config, the user's handle/name, the algorithms FinishRegistration can
+// verify (ES256, RS256, EdDSA), and "none" attestation since krili has no
+// authenticator-metadata allowlist to validate a richer attestation against.
+func (ess *EnhancedSecurityService) BeginRegistration(userID int, deviceID, username string) (*PublicKeyCredentialCreationOptions, error) {
+	challenge, err := ess.issueWebAuthnChallenge(userID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PublicKeyCredentialCreationOptions{
+		Challenge: challenge,
+		RP: PublicKeyCredentialRpEntity{
+			ID:   ess.config.WebAuthnRPID,
+			Name: ess.config.WebAuthnRPName,
+		},
+		User: PublicKeyCredentialUserEntity{
+			ID:          base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("user-%d", userID))),
+			Name:        username,
+			DisplayName: username,
+		},
+		PubKeyCredParams: []PublicKeyCredentialParameters{
+			{Type: "public-key", Alg: coseAlgES256},
+			{Type: "public-key", Alg: coseAlgRS256},
+			{Type: "public-key", Alg: coseAlgEdDSA},
+		},
+		Timeout:     60000,
+		Attestation: "none",
+	}, nil
+}
+
+// FinishRegistration verifies the browser's attestationObject/clientDataJSON
+// response to BeginRegistration's challenge, then stores the credential's
+// COSE public key. Only "none" attestation is accepted — there's no
+// attestation statement signature to verify, and krili doesn't maintain an
+// authenticator metadata allowlist a "packed"/"tpm"/etc. attestation chain
+// could be checked against anyway.
+func (ess *EnhancedSecurityService) FinishRegistration(userID int, deviceID, clientDataJSONB64, attestationObjectB64, transports string) error {
+	clientDataRaw, err := decodeWebAuthnBase64(clientDataJSONB64)
+	if err != nil {
+		return fmt.Errorf("invalid clientDataJSON encoding: %v", err)
+	}
+
+	var clientData webauthnClientData
+	if err := json.Unmarshal(clientDataRaw, &clientData); err != nil {
+		return fmt.Errorf("invalid clientDataJSON: %v", err)
+	}
+	if clientData.Type != "webauthn.create" {
+		return fmt.Errorf("unexpected clientData type %q", clientData.Type)
+	}
+	if clientData.Origin != ess.config.WebAuthnOrigin {
+		return fmt.Errorf("unexpected origin %q", clientData.Origin)
+	}
+	if !ess.consumeWebAuthnChallenge(userID, deviceID, clientData.Challenge) {
+		return fmt.Errorf("unknown or expired registration challenge")
+	}
+
+	attestationRaw, err := base64.StdEncoding.DecodeString(attestationObjectB64)
+	if err != nil {
+		return fmt.Errorf("invalid attestationObject encoding: %v", err)
+	}
+
+	var attestation struct {
+		Fmt      string          `cbor:"fmt"`
+		AuthData []byte          `cbor:"authData"`
+		AttStmt  cbor.RawMessage `cbor:"attStmt"`
+	}
+	if err := cbor.Unmarshal(attestationRaw, &attestation); err != nil {
+		return fmt.Errorf("invalid attestation object: %v", err)
+	}
+	if attestation.Fmt != "none" {
+		return fmt.Errorf("unsupported attestation format %q", attestation.Fmt)
+	}
+
+	authData, err := parseAuthenticatorData(attestation.AuthData)
+	if err != nil {
+		return fmt.Errorf("invalid authenticator data: %v", err)
+	}
+	if !authData.UserPresent {
+		return fmt.Errorf("authenticator did not report user presence")
+	}
+	if len(authData.CredentialID) == 0 || len(authData.CredentialPublicKeyCBOR) == 0 {
+		return fmt.Errorf("authenticator data missing attested credential data")
+	}
+
+	if _, alg, err := coseKeyToPublicKey(authData.CredentialPublicKeyCBOR); err != nil {
+		return fmt.Errorf("invalid credential public key: %v", err)
+	} else {
+		credentialID := base64.RawURLEncoding.EncodeToString(authData.CredentialID)
+		err = ess.repo.RecordWebAuthnCredential(&WebAuthnCredential{
+			UserID:       userID,
+			DeviceID:     deviceID,
+			CredentialID: credentialID,
+			PublicKey:    authData.CredentialPublicKeyCBOR,
+			Algorithm:    alg,
+			SignCount:    authData.SignCount,
+			AAGUID:       formatAAGUID(authData.AAGUID),
+			Transports:   transports,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to store credential: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// BeginLogin issues a challenge scoped to userID's registered credential
+// IDs, so the browser's navigator.credentials.get() call only prompts
+// authenticators that actually hold a matching private key.
+func (ess *EnhancedSecurityService) BeginLogin(userID int, deviceID string) (*PublicKeyCredentialRequestOptions, error) {
+	creds, err := ess.repo.ListWebAuthnCredentials(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load credentials: %v", err)
+	}
+	if len(creds) == 0 {
+		return nil, fmt.Errorf("no registered WebAuthn credentials for user")
+	}
+
+	challenge, err := ess.issueWebAuthnChallenge(userID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	allow := make([]PublicKeyCredentialDescriptor, 0, len(creds))
+	for _, cred := range creds {
+		allow = append(allow, PublicKeyCredentialDescriptor{Type: "public-key", ID: cred.CredentialID})
+	}
+
+	return &PublicKeyCredentialRequestOptions{
+		Challenge:        challenge,
+		RPID:             ess.config.WebAuthnRPID,
+		AllowCredentials: allow,
+		UserVerification: "preferred",
+		Timeout:          60000,
+	}, nil
+}
+
+// FinishLogin verifies a WebAuthn assertion against BeginLogin's challenge:
+// the client data's type/origin/challenge, the authenticator data's user
+// presence (and user verification, if requireUserVerification) flags, that
+// the signature counter advanced since the credential's last use (catching a
+// cloned authenticator replaying stale state), and the signature itself over
+// authenticatorData || SHA256(clientDataJSON) with the credential's stored
+// public key.
+func (ess *EnhancedSecurityService) FinishLogin(userID int, deviceID, credentialID, clientDataJSONB64, authenticatorDataB64, signatureB64 string, requireUserVerification bool) error {
+	clientDataRaw, err := decodeWebAuthnBase64(clientDataJSONB64)
+	if err != nil {
+		return fmt.Errorf("invalid clientDataJSON encoding: %v", err)
+	}
+
+	var clientData webauthnClientData
+	if err := json.Unmarshal(clientDataRaw, &clientData); err != nil {
+		return fmt.Errorf("invalid clientDataJSON: %v", err)
+	}
+	if clientData.Type != "webauthn.get" {
+		return fmt.Errorf("unexpected clientData type %q", clientData.Type)
+	}
+	if clientData.Origin != ess.config.WebAuthnOrigin {
+		return fmt.Errorf("unexpected origin %q", clientData.Origin)
+	}
+	if !ess.consumeWebAuthnChallenge(userID, deviceID, clientData.Challenge) {
+		return fmt.Errorf("unknown or expired login challenge")
+	}
+
+	cred, err := ess.repo.GetWebAuthnCredential(credentialID)
+	if err != nil {
+		return fmt.Errorf("unknown credential")
+	}
+	if cred.UserID != userID {
+		return fmt.Errorf("credential does not belong to user")
+	}
+
+	authDataRaw, err := decodeWebAuthnBase64(authenticatorDataB64)
+	if err != nil {
+		return fmt.Errorf("invalid authenticatorData encoding: %v", err)
+	}
+	authData, err := parseAuthenticatorData(authDataRaw)
+	if err != nil {
+		return fmt.Errorf("invalid authenticator data: %v", err)
+	}
+	if !authData.UserPresent {
+		return fmt.Errorf("authenticator did not report user presence")
+	}
+	if requireUserVerification && !authData.UserVerified {
+		return fmt.Errorf("authenticator did not report user verification")
+	}
+
+	// A counter of 0 on both sides means the authenticator doesn't implement
+	// one (common for platform authenticators); anything else must strictly
+	// increase, or this is a cloned authenticator replaying stale state.
+	if !(cred.SignCount == 0 && authData.SignCount == 0) && authData.SignCount <= cred.SignCount {
+		return fmt.Errorf("signature counter did not advance (stored=%d, presented=%d); possible cloned authenticator",
+			cred.SignCount, authData.SignCount)
+	}
+
+	pubKey, _, err := coseKeyToPublicKey(cred.PublicKey)
+	if err != nil {
+		return fmt.Errorf("stored credential public key is invalid: %v", err)
+	}
+
+	sig, err := decodeWebAuthnBase64(signatureB64)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %v", err)
+	}
+
+	clientDataHash := sha256.Sum256(clientDataRaw)
+	signedData := append(append([]byte{}, authDataRaw...), clientDataHash[:]...)
+
+	if !verifyWebAuthnSignature(pubKey, cred.Algorithm, signedData, sig) {
+		return fmt.Errorf("signature verification failed")
+	}
+
+	if err := ess.repo.UpdateWebAuthnSignCount(credentialID, authData.SignCount); err != nil {
+		return fmt.Errorf("failed to persist updated signature counter: %v", err)
+	}
+
+	return nil
+}
+
+// decodeWebAuthnBase64 accepts both the unpadded base64url the WebAuthn spec
+// uses for wire values and plain base64, since some client libraries encode
+// one or the other before handing the value to this API.
+func decodeWebAuthnBase64(encoded string) ([]byte, error) {
+	if raw, err := base64.RawURLEncoding.DecodeString(encoded); err == nil {
+		return raw, nil
+	}
+	return base64.StdEncoding.DecodeString(encoded)
+}
+
+// verifyWebAuthnSignature checks sig over signedData using pubKey, picking
+// the verification routine the credential's stored COSE algorithm implies.
+func verifyWebAuthnSignature(pubKey crypto.PublicKey, alg int, signedData, sig []byte) bool {
+	switch alg {
+	case coseAlgES256:
+		ecdsaKey, ok := pubKey.(*ecdsa.PublicKey)
+		if !ok {
+			return false
+		}
+		digest := sha256.Sum256(signedData)
+		return ecdsa.VerifyASN1(ecdsaKey, digest[:], sig)
+	case coseAlgRS256:
+		rsaKey, ok := pubKey.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		digest := sha256.Sum256(signedData)
+		return rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], sig) == nil
+	case coseAlgEdDSA:
+		edKey, ok := pubKey.(ed25519.PublicKey)
+		if !ok {
+			return false
+		}
+		return ed25519.Verify(edKey, signedData, sig)
+	default:
+		return false
+	}
+}
+
+// authenticatorData mirrors the WebAuthn spec's authData structure (§6.1): a
+// relying-party ID hash, a flag byte (bit 0 user-present, bit 2
+// user-verified, bit 6 attested-credential-data-included), a 4-byte
+// big-endian signature counter, and — only when the attested credential
+// data flag is set — the AAGUID/credential ID/COSE public key.
+type authenticatorData struct {
+	RPIDHash                []byte
+	UserPresent             bool
+	UserVerified            bool
+	SignCount               uint32
+	AAGUID                  []byte
+	CredentialID            []byte
+	CredentialPublicKeyCBOR []byte
+}
+
+func parseAuthenticatorData(raw []byte) (*authenticatorData, error) {
+	const minLength = 32 + 1 + 4
+	if len(raw) < minLength {
+		return nil, fmt.Errorf("authenticator data too short")
+	}
+
+	flags := raw[32]
+	data := &authenticatorData{
+		RPIDHash:     raw[:32],
+		UserPresent:  flags&0x01 != 0,
+		UserVerified: flags&0x04 != 0,
+		SignCount:    binary.BigEndian.Uint32(raw[33:37]),
+	}
+
+	attestedCredentialDataPresent := flags&0x40 != 0
+	if !attestedCredentialDataPresent {
+		return data, nil
+	}
+
+	rest := raw[37:]
+	const aaguidLen = 16
+	if len(rest) < aaguidLen+2 {
+		return nil, fmt.Errorf("attested credential data truncated")
+	}
+	data.AAGUID = rest[:aaguidLen]
+	credIDLen := binary.BigEndian.Uint16(rest[aaguidLen : aaguidLen+2])
+	rest = rest[aaguidLen+2:]
+	if len(rest) < int(credIDLen) {
+		return nil, fmt.Errorf("credential ID truncated")
+	}
+	data.CredentialID = rest[:credIDLen]
+	// Whatever remains is the COSE_Key CBOR map, optionally followed by a
+	// CBOR-encoded extensions map we don't read. cbor.Unmarshal only
+	// consumes the bytes the map actually needs, so trailing extension
+	// bytes are harmless here.
+	data.CredentialPublicKeyCBOR = rest[credIDLen:]
+	return data, nil
+}
+
+func formatAAGUID(raw []byte) string {
+	if len(raw) != 16 {
+		return ""
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", raw[0:4], raw[4:6], raw[6:8], raw[8:10], raw[10:16])
+}
+
+// coseKeyToPublicKey decodes a COSE_Key CBOR map (RFC 9053 §7) into a Go
+// public key. Only the three algorithms BeginRegistration advertises are
+// supported: ES256 (COSE kty 2, EC2/P-256), RS256 (kty 3, RSA) and EdDSA
+// (kty 1, OKP/Ed25519).
+func coseKeyToPublicKey(coseKeyCBOR []byte) (crypto.PublicKey, int, error) {
+	var m map[int]interface{}
+	if err := cbor.Unmarshal(coseKeyCBOR, &m); err != nil {
+		return nil, 0, fmt.Errorf("invalid COSE key: %v", err)
+	}
+
+	kty, ok := cborInt(m[1])
+	if !ok {
+		return nil, 0, fmt.Errorf("COSE key missing kty")
+	}
+	algInt, ok := cborInt(m[3])
+	if !ok {
+		return nil, 0, fmt.Errorf("COSE key missing alg")
+	}
+	alg := int(algInt)
+
+	switch kty {
+	case 2: // EC2
+		xBytes, _ := m[-2].([]byte)
+		yBytes, _ := m[-3].([]byte)
+		if xBytes == nil || yBytes == nil {
+			return nil, 0, fmt.Errorf("EC2 COSE key missing x/y")
+		}
+		pub := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(xBytes),
+			Y:     new(big.Int).SetBytes(yBytes),
+		}
+		return pub, alg, nil
+	case 3: // RSA
+		nBytes, _ := m[-1].([]byte)
+		eBytes, _ := m[-2].([]byte)
+		if nBytes == nil || eBytes == nil {
+			return nil, 0, fmt.Errorf("RSA COSE key missing n/e")
+		}
+		e := 0
+		for _, b := range eBytes {
+			e = e<<8 | int(b)
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(nBytes), E: e}
+		return pub, alg, nil
+	case 1: // OKP
+		xBytes, _ := m[-2].([]byte)
+		if xBytes == nil {
+			return nil, 0, fmt.Errorf("OKP COSE key missing x")
+		}
+		return ed25519.PublicKey(xBytes), alg, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported COSE key type %d", kty)
+	}
+}
+
+// cborInt normalizes the handful of numeric types fxamacker/cbor decodes a
+// CBOR integer into, depending on whether it was encoded as a major type 0
+// (unsigned) or major type 1 (negative) value.
+func cborInt(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return n, true
+	case uint64:
+		return int64(n), true
+	case int:
+		return int64(n), true
+	default:
+		return 0, false
+	}
+}
+
+// beginWebAuthnRegistrationHandler issues the options the browser needs to
+// call navigator.credentials.create(), binding the resulting credential to
+// the caller-supplied device_id so challenges can be scoped per device.
+func (sth *SecureTransactionHandler) beginWebAuthnRegistrationHandler(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	var req struct {
+		DeviceID string `json:"device_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var email string
+	if err := sth.db.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&email); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+		return
+	}
+
+	options, err := sth.ess.BeginRegistration(userID, req.DeviceID, email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start WebAuthn registration"})
+		return
+	}
+
+	c.JSON(http.StatusOK, options)
+}
+
+// finishWebAuthnRegistrationHandler verifies the browser's attestation
+// response and stores the resulting credential.
+func (sth *SecureTransactionHandler) finishWebAuthnRegistrationHandler(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	var req struct {
+		DeviceID          string `json:"device_id" binding:"required"`
+		ClientDataJSON    string `json:"client_data_json" binding:"required"`
+		AttestationObject string `json:"attestation_object" binding:"required"`
+		Transports        string `json:"transports"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := sth.ess.FinishRegistration(userID, req.DeviceID, req.ClientDataJSON, req.AttestationObject, req.Transports); err != nil {
+		sth.logSecurityEvent(userID, "webauthn_registration_failed", "high",
+			fmt.Sprintf("WebAuthn registration failed: %v", err), sth.ess.getRealIP(c), c.GetHeader("User-Agent"))
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	sth.logSecurityEvent(userID, "webauthn_registered", "info",
+		"WebAuthn credential registered for device", sth.ess.getRealIP(c), c.GetHeader("User-Agent"))
+	c.JSON(http.StatusOK, gin.H{"registered": true})
+}
+
+// beginWebAuthnAssertionHandler issues the options the browser needs to call
+// navigator.credentials.get(), scoped to the credentials already registered
+// for the caller's device.
+func (sth *SecureTransactionHandler) beginWebAuthnAssertionHandler(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	var req struct {
+		DeviceID string `json:"device_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	options, err := sth.ess.BeginLogin(userID, req.DeviceID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, options)
+}
+
+// finishWebAuthnAssertionHandler verifies a WebAuthn assertion outright (as
+// opposed to biometricAuthMiddleware's per-request header check), for
+// callers that want to confirm possession once up front rather than on
+// every sensitive request.
+func (sth *SecureTransactionHandler) finishWebAuthnAssertionHandler(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	var req struct {
+		DeviceID          string `json:"device_id" binding:"required"`
+		CredentialID      string `json:"credential_id" binding:"required"`
+		ClientDataJSON    string `json:"client_data_json" binding:"required"`
+		AuthenticatorData string `json:"authenticator_data" binding:"required"`
+		Signature         string `json:"signature" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := sth.ess.FinishLogin(userID, req.DeviceID, req.CredentialID, req.ClientDataJSON,
+		req.AuthenticatorData, req.Signature, sth.ess.config.RequireStrongAuth)
+	if err != nil {
+		sth.logSecurityEvent(userID, "invalid_biometric", "high",
+			fmt.Sprintf("WebAuthn assertion verification failed: %v", err), sth.ess.getRealIP(c), c.GetHeader("User-Agent"))
+		c.JSON(http.StatusForbidden, gin.H{"error": "WebAuthn assertion verification failed"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"verified": true})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// createWebhookRequest is the body for POST /api/v1/webhooks. EventMask is
+// optional; an empty value subscribes the endpoint to every event type.
+type createWebhookRequest struct {
+	URL       string `json:"url" binding:"required,url"`
+	EventMask string `json:"event_mask"`
+}
+
+// createWebhookHandler registers a new subscriber endpoint for the caller.
+func (sth *SecureTransactionHandler) createWebhookHandler(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	var req createWebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	endpoint, err := CreateWebhookEndpoint(sth.db, userID, req.URL, req.EventMask)
+	if err != nil {
+		if errors.Is(err, errWebhookDestinationDisallowed) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create webhook endpoint"})
+		return
+	}
+	c.JSON(http.StatusCreated, endpoint)
+}
+
+// listWebhooksHandler returns every endpoint the caller has registered.
+func (sth *SecureTransactionHandler) listWebhooksHandler(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	endpoints, err := ListWebhookEndpoints(sth.db, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list webhook endpoints"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"endpoints": endpoints})
+}
+
+// deleteWebhookHandler removes one of the caller's endpoints.
+func (sth *SecureTransactionHandler) deleteWebhookHandler(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook id"})
+		return
+	}
+
+	if err := DeleteWebhookEndpoint(sth.db, id, userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete webhook endpoint"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+// testWebhookHandler publishes a synthetic payment.completed event to one
+// of the caller's own endpoints, so they can confirm their receiver and
+// HMAC verification work before relying on a real transaction to exercise
+// it.
+func (sth *SecureTransactionHandler) testWebhookHandler(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook id"})
+		return
+	}
+
+	endpoint, err := GetWebhookEndpoint(sth.db, id, userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook endpoint not found"})
+		return
+	}
+
+	event := WebhookEvent{
+		Type:          webhookEventPaymentCompleted,
+		UserID:        userID,
+		TransactionID: 0,
+		Amount:        1.00,
+		Currency:      "USD",
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue test delivery"})
+		return
+	}
+	deliveryID, err := sth.webhooks.recordAttempt(endpoint.ID, event.Type, payload)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue test delivery"})
+		return
+	}
+	sth.webhooks.enqueue(webhookDeliveryJob{endpoint: *endpoint, event: event, deliveryID: deliveryID})
+
+	c.JSON(http.StatusAccepted, gin.H{"status": "queued", "delivery_id": deliveryID})
+}
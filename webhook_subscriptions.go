@@ -0,0 +1,509 @@
+// WebhookDispatcher lets a caller register one or more HTTP endpoints that
+// receive transaction lifecycle events (payment/payout completed or failed,
+// plus PaymentInvoice settlement), each signed the same way webhookSink
+// (alert_dispatcher.go) signs alert deliveries. This is a different concern
+// from the webhook infrastructure already in this codebase:
+//
+//   - user_webhooks (notification_channels.go) is a single URL+secret per
+//     user used as one delivery channel for generic SecurityNotifications.
+//   - webhookSink (alert_dispatcher.go) fans SecurityAlerts out to an
+//     operator-configured, admin-level sink.
+//   - webhookAuditSink (audit_chain.go) streams the hash-chained audit log
+//     to a SIEM.
+//
+// None of those support multiple endpoints per user, filtering by event
+// type, or a delivery history scoped to transaction lifecycle events, so
+// this is new infrastructure rather than an extension of any of them. The
+// dispatcher itself mirrors AlertDispatcher's worker-pool-plus-persisted-
+// retry shape.
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// webhookEventPaymentCompleted/PaymentFailed/PayoutCompleted/PayoutFailed
+// are the transaction lifecycle events a WebhookEndpoint can subscribe to.
+// webhookEventWildcard subscribes an endpoint to all of them.
+const (
+	webhookEventPaymentCompleted = "payment.completed"
+	webhookEventPaymentFailed    = "payment.failed"
+	webhookEventPayoutCompleted  = "payout.completed"
+	webhookEventPayoutFailed     = "payout.failed"
+	webhookEventWildcard         = "*"
+)
+
+// webhookDeliveryWorkers/QueueSize bound delivery concurrency the same way
+// alertDeliveryWorkers/QueueSize do for AlertDispatcher.
+const (
+	webhookDeliveryWorkers   = 4
+	webhookDeliveryQueueSize = 256
+)
+
+// webhookMaxDeliveryAttempts bounds webhookRetryBackoff's schedule: an
+// endpoint that's failed this many times in a row is left failed instead of
+// retried forever.
+const webhookMaxDeliveryAttempts = 5
+
+func initializeWebhookTables(db *sql.DB) error {
+	tables := []string{
+		`CREATE TABLE IF NOT EXISTS webhook_endpoints (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			user_id INT NOT NULL,
+			url VARCHAR(500) NOT NULL,
+			secret VARCHAR(255) NOT NULL,
+			event_mask VARCHAR(255) NOT NULL DEFAULT '*',
+			is_active BOOLEAN DEFAULT TRUE,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id),
+			INDEX idx_user (user_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			endpoint_id INT NOT NULL,
+			event_type VARCHAR(50) NOT NULL,
+			payload TEXT NOT NULL,
+			status VARCHAR(20) NOT NULL DEFAULT 'pending',
+			attempt INT NOT NULL DEFAULT 0,
+			response_status INT,
+			last_error TEXT,
+			next_attempt_at TIMESTAMP NULL,
+			delivered_at TIMESTAMP NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (endpoint_id) REFERENCES webhook_endpoints(id),
+			INDEX idx_endpoint_status (endpoint_id, status)
+		)`,
+	}
+	for _, stmt := range tables {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WebhookEndpoint is one subscriber-configured delivery target.
+type WebhookEndpoint struct {
+	ID        int64     `json:"id"`
+	UserID    int       `json:"user_id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"-"`
+	EventMask string    `json:"event_mask"`
+	IsActive  bool      `json:"is_active"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookEvent is one transaction lifecycle occurrence Publish fans out to
+// every matching WebhookEndpoint.
+type WebhookEvent struct {
+	Type          string    `json:"type"`
+	UserID        int       `json:"user_id"`
+	TransactionID int64     `json:"transaction_id"`
+	Amount        float64   `json:"amount"`
+	Currency      string    `json:"currency"`
+	OccurredAt    time.Time `json:"occurred_at"`
+}
+
+// webhookDeliveryJob is one (endpoint, event) delivery attempt queued for a
+// worker, whether freshly published or picked back up by retryDue.
+type webhookDeliveryJob struct {
+	endpoint   WebhookEndpoint
+	event      WebhookEvent
+	deliveryID int64
+	attempt    int
+}
+
+// WebhookDispatcher persists subscriber endpoints and fans published
+// WebhookEvents out to every endpoint subscribed to that event type,
+// retrying failed deliveries with webhookRetryBackoff.
+type WebhookDispatcher struct {
+	db     *sql.DB
+	client *http.Client
+	jobs   chan webhookDeliveryJob
+	stop   chan struct{}
+}
+
+// NewWebhookDispatcher returns a dispatcher ready to Publish.
+func NewWebhookDispatcher(db *sql.DB) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		db:     db,
+		client: &http.Client{Timeout: 10 * time.Second},
+		jobs:   make(chan webhookDeliveryJob, webhookDeliveryQueueSize),
+		stop:   make(chan struct{}),
+	}
+}
+
+// Start launches the delivery worker pool and the background retry-queue
+// poller. Call Stop during graceful shutdown.
+func (d *WebhookDispatcher) Start(retryInterval time.Duration) {
+	for i := 0; i < webhookDeliveryWorkers; i++ {
+		go d.runWorker()
+	}
+
+	go func() {
+		ticker := time.NewTicker(retryInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				d.retryDue()
+			case <-d.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (d *WebhookDispatcher) Stop() {
+	close(d.stop)
+}
+
+// runWorker delivers queued jobs one at a time until the dispatcher stops;
+// webhookDeliveryWorkers of these run concurrently.
+func (d *WebhookDispatcher) runWorker() {
+	for {
+		select {
+		case job := <-d.jobs:
+			d.deliver(job)
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// enqueue hands a job to the worker pool without blocking the publisher; if
+// the queue is full the job is scheduled straight into the retry path
+// instead of stalling Publish.
+func (d *WebhookDispatcher) enqueue(job webhookDeliveryJob) {
+	select {
+	case d.jobs <- job:
+	default:
+		d.scheduleRetry(job.deliveryID, job.attempt, fmt.Errorf("delivery queue full"))
+	}
+}
+
+// Publish records a delivery attempt for every active endpoint belonging to
+// event.UserID whose event_mask matches event.Type, then queues each for
+// delivery. Call sites (ProviderRouter.persistTransaction/completeTransaction,
+// PollPaymentInvoiceStatus, ReconciliationChore.transition) call this once a
+// transaction reaches a terminal state; it is a no-op if d is nil, so
+// callers don't need to guard every call site themselves.
+func (d *WebhookDispatcher) Publish(event WebhookEvent) {
+	if d == nil {
+		return
+	}
+
+	endpoints, err := d.endpointsFor(event.UserID, event.Type)
+	if err != nil {
+		log.Printf("⚠️  webhook dispatcher: failed to load endpoints for user %d: %v", event.UserID, err)
+		return
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("⚠️  webhook dispatcher: failed to marshal event %s: %v", event.Type, err)
+		return
+	}
+
+	for _, endpoint := range endpoints {
+		deliveryID, err := d.recordAttempt(endpoint.ID, event.Type, payload)
+		if err != nil {
+			log.Printf("⚠️  webhook dispatcher: failed to record delivery for endpoint %d: %v", endpoint.ID, err)
+			continue
+		}
+		d.enqueue(webhookDeliveryJob{endpoint: endpoint, event: event, deliveryID: deliveryID})
+	}
+}
+
+// endpointsFor loads every active endpoint for userID whose event_mask
+// matches eventType (either the literal event type or the wildcard "*").
+func (d *WebhookDispatcher) endpointsFor(userID int, eventType string) ([]WebhookEndpoint, error) {
+	rows, err := d.db.Query(`
+		SELECT id, user_id, url, secret, event_mask, is_active, created_at
+		FROM webhook_endpoints WHERE user_id = ? AND is_active = TRUE
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var endpoints []WebhookEndpoint
+	for rows.Next() {
+		var e WebhookEndpoint
+		if err := rows.Scan(&e.ID, &e.UserID, &e.URL, &e.Secret, &e.EventMask, &e.IsActive, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		if webhookMaskMatches(e.EventMask, eventType) {
+			endpoints = append(endpoints, e)
+		}
+	}
+	return endpoints, rows.Err()
+}
+
+// webhookMaskMatches reports whether mask (a comma-separated list of event
+// types, or "*") subscribes its endpoint to eventType.
+func webhookMaskMatches(mask, eventType string) bool {
+	for _, t := range strings.Split(mask, ",") {
+		t = strings.TrimSpace(t)
+		if t == webhookEventWildcard || t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver POSTs event to endpoint.URL, signing timestamp+"."+body with
+// HMAC-SHA256 so a captured delivery can't be replayed indefinitely - the
+// receiver is expected to reject a X-Signature whose X-Webhook-Timestamp
+// has drifted too far from its own clock. Re-validates the destination
+// immediately before sending, since a hostname that resolved to a public
+// IP at registration time (CreateWebhookEndpoint) can be repointed at an
+// internal address later.
+func (d *WebhookDispatcher) deliver(job webhookDeliveryJob) {
+	if err := validateWebhookDestination(job.endpoint.URL); err != nil {
+		log.Printf("⚠️  webhook dispatcher: endpoint %d failed destination re-check, not delivering: %v", job.endpoint.ID, err)
+		d.markDelivery(job.deliveryID, "failed", 0, err)
+		return
+	}
+
+	body, err := json.Marshal(job.event)
+	if err != nil {
+		d.scheduleRetry(job.deliveryID, job.attempt, err)
+		return
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(job.endpoint.Secret))
+	mac.Write([]byte(timestamp + "." + string(body)))
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	req, err := http.NewRequest(http.MethodPost, job.endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		d.scheduleRetry(job.deliveryID, job.attempt, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Signature", signature)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Krili-Event", job.event.Type)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		log.Printf("⚠️  webhook dispatcher: delivery to endpoint %d failed: %v", job.endpoint.ID, err)
+		d.scheduleRetry(job.deliveryID, job.attempt, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		err := fmt.Errorf("endpoint returned status %d", resp.StatusCode)
+		d.markDelivery(job.deliveryID, "pending", resp.StatusCode, err)
+		d.scheduleRetry(job.deliveryID, job.attempt, err)
+		return
+	}
+	d.markDelivery(job.deliveryID, "delivered", resp.StatusCode, nil)
+}
+
+func (d *WebhookDispatcher) recordAttempt(endpointID int64, eventType string, payload []byte) (int64, error) {
+	result, err := d.db.Exec(`
+		INSERT INTO webhook_deliveries (endpoint_id, event_type, payload, status, attempt, next_attempt_at, created_at)
+		VALUES (?, ?, ?, 'pending', 0, NOW(), NOW())
+	`, endpointID, eventType, string(payload))
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func (d *WebhookDispatcher) markDelivery(deliveryID int64, status string, responseStatus int, deliveryErr error) {
+	errText := ""
+	if deliveryErr != nil {
+		errText = deliveryErr.Error()
+	}
+	_, err := d.db.Exec(`
+		UPDATE webhook_deliveries SET status = ?, response_status = ?, last_error = ?, delivered_at = NOW() WHERE id = ?
+	`, status, responseStatus, errText, deliveryID)
+	if err != nil {
+		log.Printf("⚠️  webhook dispatcher: failed to update delivery %d: %v", deliveryID, err)
+	}
+}
+
+// scheduleRetry marks a failed delivery for retry on webhookRetryBackoff's
+// schedule, or leaves it failed once webhookMaxDeliveryAttempts is reached.
+func (d *WebhookDispatcher) scheduleRetry(deliveryID int64, attempt int, deliveryErr error) {
+	if attempt+1 >= webhookMaxDeliveryAttempts {
+		d.markDelivery(deliveryID, "failed", 0, deliveryErr)
+		return
+	}
+	errText := ""
+	if deliveryErr != nil {
+		errText = deliveryErr.Error()
+	}
+	_, err := d.db.Exec(`
+		UPDATE webhook_deliveries
+		SET status = 'pending', attempt = ?, last_error = ?, next_attempt_at = ?
+		WHERE id = ?
+	`, attempt+1, errText, time.Now().Add(webhookRetryBackoff(attempt+1)), deliveryID)
+	if err != nil {
+		log.Printf("⚠️  webhook dispatcher: failed to schedule retry for delivery %d: %v", deliveryID, err)
+	}
+}
+
+// webhookRetryBackoff implements the 1m/5m/30m/2h/12h schedule subscribers
+// are told to expect, distinct from the generic exponential retryBackoff
+// (idempotency.go) AlertDispatcher uses: a subscriber's own endpoint being
+// briefly unreachable is common enough that this dispatcher gives it a
+// fixed, predictable schedule rather than the jittered exponential one,
+// which is tuned for the payment-provider retry queue instead.
+func webhookRetryBackoff(attempt int) time.Duration {
+	schedule := []time.Duration{
+		1 * time.Minute,
+		5 * time.Minute,
+		30 * time.Minute,
+		2 * time.Hour,
+		12 * time.Hour,
+	}
+	if attempt <= 0 {
+		return schedule[0]
+	}
+	if attempt >= len(schedule) {
+		return schedule[len(schedule)-1]
+	}
+	return schedule[attempt]
+}
+
+// retryDue re-delivers every pending webhook_deliveries row whose
+// next_attempt_at has passed.
+func (d *WebhookDispatcher) retryDue() {
+	rows, err := d.db.Query(`
+		SELECT wd.id, wd.event_type, wd.payload, wd.attempt,
+			we.id, we.user_id, we.url, we.secret, we.event_mask, we.is_active, we.created_at
+		FROM webhook_deliveries wd
+		JOIN webhook_endpoints we ON we.id = wd.endpoint_id
+		WHERE wd.status = 'pending' AND wd.next_attempt_at <= NOW() AND wd.attempt < ?
+	`, webhookMaxDeliveryAttempts)
+	if err != nil {
+		log.Printf("⚠️  webhook dispatcher: failed to load due retries: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	var jobs []webhookDeliveryJob
+	for rows.Next() {
+		var deliveryID int64
+		var eventType, payload string
+		var attempt int
+		var endpoint WebhookEndpoint
+		if err := rows.Scan(&deliveryID, &eventType, &payload, &attempt,
+			&endpoint.ID, &endpoint.UserID, &endpoint.URL, &endpoint.Secret, &endpoint.EventMask, &endpoint.IsActive, &endpoint.CreatedAt); err != nil {
+			continue
+		}
+		var event WebhookEvent
+		if err := json.Unmarshal([]byte(payload), &event); err != nil {
+			continue
+		}
+		jobs = append(jobs, webhookDeliveryJob{endpoint: endpoint, event: event, deliveryID: deliveryID, attempt: attempt})
+	}
+	rows.Close()
+
+	for _, job := range jobs {
+		d.enqueue(job)
+	}
+}
+
+// CreateWebhookEndpoint registers a new delivery target for userID. A
+// random secret is generated server-side (never accepted from the caller)
+// so a subscriber can't weaken their own HMAC verification. url is
+// resolved and checked against validateWebhookDestination first, so a
+// caller can't register a loopback/private/link-local/cloud-metadata
+// address for the server to POST to on their behalf.
+func CreateWebhookEndpoint(db *sql.DB, userID int, url, eventMask string) (*WebhookEndpoint, error) {
+	if err := validateWebhookDestination(url); err != nil {
+		return nil, err
+	}
+	if eventMask == "" {
+		eventMask = webhookEventWildcard
+	}
+	secret, err := newWebhookSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := db.Exec(`
+		INSERT INTO webhook_endpoints (user_id, url, secret, event_mask, is_active)
+		VALUES (?, ?, ?, ?, TRUE)
+	`, userID, url, secret, eventMask)
+	if err != nil {
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return &WebhookEndpoint{ID: id, UserID: userID, URL: url, Secret: secret, EventMask: eventMask, IsActive: true}, nil
+}
+
+// ListWebhookEndpoints returns userID's registered endpoints, newest first.
+func ListWebhookEndpoints(db *sql.DB, userID int) ([]WebhookEndpoint, error) {
+	rows, err := db.Query(`
+		SELECT id, user_id, url, secret, event_mask, is_active, created_at
+		FROM webhook_endpoints WHERE user_id = ? ORDER BY id DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	endpoints := []WebhookEndpoint{}
+	for rows.Next() {
+		var e WebhookEndpoint
+		if err := rows.Scan(&e.ID, &e.UserID, &e.URL, &e.Secret, &e.EventMask, &e.IsActive, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, e)
+	}
+	return endpoints, rows.Err()
+}
+
+// DeleteWebhookEndpoint removes id, scoped to userID so one caller can
+// never delete another's endpoint.
+func DeleteWebhookEndpoint(db *sql.DB, id int64, userID int) error {
+	_, err := db.Exec(`DELETE FROM webhook_endpoints WHERE id = ? AND user_id = ?`, id, userID)
+	return err
+}
+
+// GetWebhookEndpoint loads the endpoint with id, scoped to userID.
+func GetWebhookEndpoint(db *sql.DB, id int64, userID int) (*WebhookEndpoint, error) {
+	var e WebhookEndpoint
+	err := db.QueryRow(`
+		SELECT id, user_id, url, secret, event_mask, is_active, created_at
+		FROM webhook_endpoints WHERE id = ? AND user_id = ?
+	`, id, userID).Scan(&e.ID, &e.UserID, &e.URL, &e.Secret, &e.EventMask, &e.IsActive, &e.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// newWebhookSecret returns a random hex-encoded secret for HMAC-signing
+// deliveries to a newly-registered endpoint.
+func newWebhookSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,68 @@
+// SSRF guard for outbound webhook destinations: user_webhooks
+// (notification_channels.go) predates this check and isn't touched here,
+// but webhook_subscriptions.go lets any authenticated user register a URL
+// the server later POSTs to from inside the network, so it needs one.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+)
+
+// errWebhookDestinationDisallowed wraps every rejection
+// validateWebhookDestination returns, so a caller (createWebhookHandler)
+// can tell "this URL isn't allowed" apart from an unrelated failure (e.g.
+// a DB error) with errors.Is instead of matching on error text.
+var errWebhookDestinationDisallowed = errors.New("webhook destination not allowed")
+
+// validateWebhookDestination rejects a webhook URL that resolves to
+// somewhere the server shouldn't be making requests to on a caller's
+// behalf: a non-http(s) scheme, loopback, link-local (which covers the
+// 169.254.169.254 cloud metadata endpoint), or other private/reserved IP
+// ranges. It's called once at registration time (CreateWebhookEndpoint)
+// and again immediately before every delivery attempt (deliver), since a
+// hostname that resolved to a public IP at registration can be repointed
+// at an internal address later.
+func validateWebhookDestination(rawURL string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("%w: invalid URL: %v", errWebhookDestinationDisallowed, err)
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("%w: unsupported scheme %q, only http/https are allowed", errWebhookDestinationDisallowed, parsed.Scheme)
+	}
+	host := parsed.Hostname()
+	if host == "" {
+		return fmt.Errorf("%w: URL has no host", errWebhookDestinationDisallowed)
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return fmt.Errorf("%w: failed to resolve host %q: %v", errWebhookDestinationDisallowed, host, err)
+	}
+	for _, ip := range ips {
+		if isDisallowedWebhookIP(ip) {
+			return fmt.Errorf("%w: host %q resolves to a disallowed address %s", errWebhookDestinationDisallowed, host, ip)
+		}
+	}
+	return nil
+}
+
+// isDisallowedWebhookIP reports whether ip is loopback, link-local
+// (unicast or multicast - link-local unicast is where 169.254.169.254
+// cloud metadata endpoints live), a private RFC 1918/ULA range, or
+// otherwise not a routable public address.
+func isDisallowedWebhookIP(ip net.IP) bool {
+	switch {
+	case ip.IsLoopback(),
+		ip.IsLinkLocalUnicast(),
+		ip.IsLinkLocalMulticast(),
+		ip.IsPrivate(),
+		ip.IsUnspecified(),
+		ip.IsMulticast():
+		return true
+	}
+	return false
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsSendQueueSize  = 64               // per-client buffered send queue before drop-oldest kicks in
+	wsRingBufferSize = 1000             // buffered alerts available for last_event_id replay
+	wsPingInterval   = 30 * time.Second // heartbeat so dead browser tabs get evicted, not leaked
+	wsIdleTimeout    = 90 * time.Second // no pong within this window and handleWebSocket closes the conn
+	wsTicketTTL      = 30 * time.Second // ticket must be redeemed by the upgrade shortly after issueWSTicketHandler mints it
+)
+
+// severityRank orders SecurityAlert.Severity for "events.severity>=high"
+// style subscriptions. Unknown severities rank below everything.
+var severityRank = map[string]int{
+	"low":      1,
+	"medium":   2,
+	"high":     3,
+	"critical": 4,
+}
+
+// wsSubscription is one topic a wsClient has subscribed to. kind selects
+// which field(s) matter; the rest are zero for kinds that don't use them.
+type wsSubscription struct {
+	topic       string
+	kind        string // "alerts", "severity", "user", "ip"
+	minSeverity int
+	userID      string
+	ipNet       *net.IPNet
+}
+
+// parseWSTopic parses the small topic language the dashboard protocol
+// exposes: "alerts" (everything), "events.severity>=<level>", "user:<id>",
+// and "ip:<cidr>" (bare IPs are normalized to /32 or /128 the same way
+// block_store.go's BlockStore does).
+func parseWSTopic(topic string) (wsSubscription, error) {
+	switch {
+	case topic == "alerts":
+		return wsSubscription{topic: topic, kind: "alerts"}, nil
+
+	case strings.HasPrefix(topic, "events.severity>="):
+		level := strings.TrimPrefix(topic, "events.severity>=")
+		rank, ok := severityRank[level]
+		if !ok {
+			return wsSubscription{}, fmt.Errorf("unknown severity %q", level)
+		}
+		return wsSubscription{topic: topic, kind: "severity", minSeverity: rank}, nil
+
+	case strings.HasPrefix(topic, "user:"):
+		id := strings.TrimPrefix(topic, "user:")
+		if id == "" {
+			return wsSubscription{}, fmt.Errorf("user topic requires an id")
+		}
+		return wsSubscription{topic: topic, kind: "user", userID: id}, nil
+
+	case strings.HasPrefix(topic, "ip:"):
+		cidr := asCIDR(strings.TrimPrefix(topic, "ip:"))
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return wsSubscription{}, fmt.Errorf("invalid ip topic %q: %v", topic, err)
+		}
+		return wsSubscription{topic: topic, kind: "ip", ipNet: ipNet}, nil
+
+	default:
+		return wsSubscription{}, fmt.Errorf("unknown topic %q", topic)
+	}
+}
+
+// matchesAlert reports whether sub should receive alert.
+func (sub wsSubscription) matchesAlert(alert SecurityAlert) bool {
+	switch sub.kind {
+	case "alerts":
+		return true
+	case "severity":
+		return severityRank[alert.Severity] >= sub.minSeverity
+	case "user":
+		return alert.UserID != nil && strconv.Itoa(*alert.UserID) == sub.userID
+	case "ip":
+		ip := net.ParseIP(alert.IPAddress)
+		return ip != nil && sub.ipNet.Contains(ip)
+	default:
+		return false
+	}
+}
+
+// wsRingEntry is one buffered alert a reconnecting client can replay via
+// last_event_id.
+type wsRingEntry struct {
+	id    uint64
+	alert SecurityAlert
+}
+
+// wsRingBuffer keeps the last wsRingBufferSize broadcast alerts so a
+// dashboard that drops its connection can replay whatever it missed instead
+// of silently losing events between the disconnect and the reconnect.
+type wsRingBuffer struct {
+	mu     sync.Mutex
+	nextID uint64
+	buf    []wsRingEntry // ring, oldest first
+}
+
+func newWSRingBuffer() *wsRingBuffer {
+	return &wsRingBuffer{buf: make([]wsRingEntry, 0, wsRingBufferSize)}
+}
+
+// Append records alert and returns its assigned event id.
+func (r *wsRingBuffer) Append(alert SecurityAlert) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	id := r.nextID
+	r.buf = append(r.buf, wsRingEntry{id: id, alert: alert})
+	if len(r.buf) > wsRingBufferSize {
+		r.buf = r.buf[len(r.buf)-wsRingBufferSize:]
+	}
+	return id
+}
+
+// Since returns every buffered entry with id > lastEventID, oldest first.
+func (r *wsRingBuffer) Since(lastEventID uint64) []wsRingEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var out []wsRingEntry
+	for _, entry := range r.buf {
+		if entry.id > lastEventID {
+			out = append(out, entry)
+		}
+	}
+	return out
+}
+
+// wsTicket is a single-use credential that stands in for a bearer token
+// during the WebSocket upgrade, since a browser's WebSocket constructor
+// can't set an Authorization header.
+type wsTicket struct {
+	role      string
+	expiresAt time.Time
+}
+
+// wsTicketStore issues and redeems the tickets minted by
+// issueWSTicketHandler. Tickets are single-use and short-lived, so a ticket
+// leaked in a referrer header or browser history is worthless within
+// seconds of being issued.
+type wsTicketStore struct {
+	mu      sync.Mutex
+	tickets map[string]wsTicket
+}
+
+func newWSTicketStore() *wsTicketStore {
+	return &wsTicketStore{tickets: make(map[string]wsTicket)}
+}
+
+// Issue mints a new ticket carrying role, redeemable once within wsTicketTTL.
+func (s *wsTicketStore) Issue(role string) string {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		log.Printf("⚠️  ws ticket store: failed to read random bytes: %v", err)
+	}
+	ticket := base64.RawURLEncoding.EncodeToString(raw)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gc()
+	s.tickets[ticket] = wsTicket{role: role, expiresAt: time.Now().Add(wsTicketTTL)}
+	return ticket
+}
+
+// Redeem consumes ticket and returns the role it was issued for. A ticket
+// can only be redeemed once; a second attempt (or an expired/unknown
+// ticket) fails.
+func (s *wsTicketStore) Redeem(ticket string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tickets[ticket]
+	delete(s.tickets, ticket)
+	if !ok || time.Now().After(t.expiresAt) {
+		return "", false
+	}
+	return t.role, true
+}
+
+// gc drops expired, never-redeemed tickets. Called under s.mu.
+func (s *wsTicketStore) gc() {
+	now := time.Now()
+	for k, t := range s.tickets {
+		if now.After(t.expiresAt) {
+			delete(s.tickets, k)
+		}
+	}
+}
+
+// wsClient is one connected dashboard WebSocket, subscribed to zero or more
+// topics and fed through a bounded send queue so a slow browser tab can't
+// block the broadcaster that every other client shares.
+type wsClient struct {
+	conn *websocket.Conn
+	role string
+	send chan []byte
+	done chan struct{}
+
+	subsMu sync.RWMutex
+	subs   []wsSubscription
+
+	droppedCount int64
+}
+
+func newWSClient(conn *websocket.Conn, role string) *wsClient {
+	return &wsClient{
+		conn: conn,
+		role: role,
+		send: make(chan []byte, wsSendQueueSize),
+		done: make(chan struct{}),
+	}
+}
+
+// subscribe adds topic to c's subscriptions, replacing any earlier
+// subscription to the same topic.
+func (c *wsClient) subscribe(topic string) error {
+	sub, err := parseWSTopic(topic)
+	if err != nil {
+		return err
+	}
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+	for _, existing := range c.subs {
+		if existing.topic == topic {
+			return nil
+		}
+	}
+	c.subs = append(c.subs, sub)
+	return nil
+}
+
+func (c *wsClient) unsubscribe(topic string) {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+	for i, existing := range c.subs {
+		if existing.topic == topic {
+			c.subs = append(c.subs[:i], c.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+func (c *wsClient) subscriptions() []wsSubscription {
+	c.subsMu.RLock()
+	defer c.subsMu.RUnlock()
+	out := make([]wsSubscription, len(c.subs))
+	copy(out, c.subs)
+	return out
+}
+
+func (c *wsClient) matchesAlert(alert SecurityAlert) bool {
+	for _, sub := range c.subscriptions() {
+		if sub.matchesAlert(alert) {
+			return true
+		}
+	}
+	return false
+}
+
+// enqueue queues payload for delivery without ever blocking the caller: a
+// full send queue drops its oldest queued message and appends a
+// dropped_count notice instead of backing up the shared broadcaster behind
+// one slow client.
+func (c *wsClient) enqueue(payload []byte) {
+	select {
+	case c.send <- payload:
+		return
+	default:
+	}
+
+	select {
+	case <-c.send:
+	default:
+	}
+	dropped := atomic.AddInt64(&c.droppedCount, 1)
+	select {
+	case c.send <- payload:
+	default:
+	}
+
+	notice, err := json.Marshal(map[string]interface{}{
+		"type":          "dropped_notice",
+		"dropped_count": dropped,
+	})
+	if err == nil {
+		select {
+		case c.send <- notice:
+		default:
+		}
+	}
+}
+
+// writePump drains c.send to the socket and pings on wsPingInterval so idle
+// connections don't look alive to handleWebSocket's read-side deadline
+// forever. It returns (closing the connection) once c.done is closed or a
+// write fails.
+func (c *wsClient) writePump() {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case payload := <-c.send:
+			if err := c.conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *wsClient) close() {
+	select {
+	case <-c.done:
+	default:
+		close(c.done)
+	}
+}
+
+// wsHub owns every connected dashboard WebSocket client, replacing the bare
+// clients/clientRoles maps SecurityMonitor used to hold directly. It adds
+// topic subscriptions, per-client backpressure, and a ring buffer for
+// last_event_id replay on reconnect.
+type wsHub struct {
+	mu      sync.RWMutex
+	clients map[*wsClient]bool
+
+	ring    *wsRingBuffer
+	tickets *wsTicketStore
+}
+
+func newWSHub() *wsHub {
+	return &wsHub{
+		clients: make(map[*wsClient]bool),
+		ring:    newWSRingBuffer(),
+		tickets: newWSTicketStore(),
+	}
+}
+
+func (h *wsHub) register(c *wsClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clients[c] = true
+}
+
+func (h *wsHub) unregister(c *wsClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients, c)
+	c.close()
+}
+
+// ClientCount returns the number of currently connected dashboard WebSocket
+// clients, for the krili_websocket_clients gauge (see security_prometheus.go).
+func (h *wsHub) ClientCount() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.clients)
+}
+
+// BroadcastAlert records alert in the ring buffer and delivers it to every
+// client subscribed to a topic it matches.
+func (h *wsHub) BroadcastAlert(alert SecurityAlert) {
+	h.ring.Append(alert)
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"type": "security_alert",
+		"data": alert,
+	})
+	if err != nil {
+		log.Printf("⚠️  ws hub: failed to marshal alert: %v", err)
+		return
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for c := range h.clients {
+		if c.matchesAlert(alert) {
+			c.enqueue(payload)
+		}
+	}
+}
+
+// BroadcastMetrics delivers a metrics snapshot to every connected client,
+// independent of topic subscriptions -- metrics updates aren't a topic a
+// client opts into, they're the dashboard's baseline heartbeat.
+func (h *wsHub) BroadcastMetrics(msgType string, metrics *SecurityMetrics) {
+	payload, err := json.Marshal(map[string]interface{}{
+		"type": msgType,
+		"data": metrics,
+	})
+	if err != nil {
+		log.Printf("⚠️  ws hub: failed to marshal metrics: %v", err)
+		return
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for c := range h.clients {
+		c.enqueue(payload)
+	}
+}
+
+// Replay delivers every ring-buffered alert since lastEventID that matches
+// one of c's subscriptions, in order, so a dashboard that reconnects with
+// last_event_id doesn't miss anything that happened while it was offline.
+func (h *wsHub) Replay(c *wsClient, lastEventID uint64) {
+	if lastEventID == 0 {
+		return
+	}
+	for _, entry := range h.ring.Since(lastEventID) {
+		if !c.matchesAlert(entry.alert) {
+			continue
+		}
+		payload, err := json.Marshal(map[string]interface{}{
+			"type": "security_alert",
+			"data": entry.alert,
+		})
+		if err != nil {
+			continue
+		}
+		c.enqueue(payload)
+	}
+}